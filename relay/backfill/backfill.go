@@ -0,0 +1,213 @@
+package backfill
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"nostr-relay/channels"
+	"nostr-relay/kinds"
+
+	"github.com/fiatjaf/eventstore/sqlite3"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// backfill_cursor has how far back the history of a channel was fetched
+// from every relay it declares. until is the created_at the next page ends
+// at, 0 before the first one, and floor the oldest created_at wanted.
+var ddls = []string{
+	`CREATE TABLE IF NOT EXISTS backfill_cursor (
+       channel text NOT NULL,
+       relay text NOT NULL,
+       until integer NOT NULL DEFAULT 0,
+       floor integer NOT NULL DEFAULT 0,
+       done integer NOT NULL DEFAULT 0,
+       fetched integer NOT NULL DEFAULT 0,
+       stored integer NOT NULL DEFAULT 0,
+       rejected integer NOT NULL DEFAULT 0,
+       failures integer NOT NULL DEFAULT 0,
+       next_attempt_at integer NOT NULL,
+       last_error text NOT NULL DEFAULT '',
+       created_at integer NOT NULL,
+       updated_at integer NOT NULL,
+       PRIMARY KEY (channel, relay));`,
+	`CREATE INDEX IF NOT EXISTS backfill_cursor_due ON backfill_cursor (done, next_attempt_at);`,
+}
+
+// Options tune the backfill, zero values use the defaults
+type Options struct {
+	// Self has the URLs of this relay, which are never fetched from
+	Self []string
+
+	// MaxAge is how far back history is fetched, from when the channel was
+	// learned, 0 meaning all of it
+	MaxAge time.Duration
+
+	// MaxEvents is how many events are fetched per channel and relay
+	MaxEvents int
+
+	// PageSize is how many events are asked for at once
+	PageSize int
+
+	// MaxFailures is how many times in a row a relay can fail before the
+	// channel isn't fetched from it anymore, RetryInterval the wait after
+	// the first failure, growing with the next ones
+	MaxFailures   int
+	RetryInterval time.Duration
+
+	// Timeout bounds connecting to a relay and every page
+	Timeout time.Duration
+
+	// BatchSize is how many cursors are advanced per round
+	BatchSize int
+}
+
+func (o Options) withDefaults() Options {
+	if o.MaxAge < 0 {
+		o.MaxAge = 0
+	}
+	if o.MaxEvents <= 0 {
+		o.MaxEvents = 5000
+	}
+	if o.PageSize <= 0 {
+		o.PageSize = 250
+	}
+	if o.MaxFailures <= 0 {
+		o.MaxFailures = 5
+	}
+	if o.RetryInterval <= 0 {
+		o.RetryInterval = time.Minute
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = 10 * time.Second
+	}
+	if o.BatchSize <= 0 {
+		o.BatchSize = 16
+	}
+	return o
+}
+
+// Accept runs an event fetched from another relay through the hooks of
+// this one, see ingest.Accept
+type Accept func(ctx context.Context, event *nostr.Event) error
+
+// Backfiller fetches the past messages of the channels this relay learns
+// about from the relays their metadata declares
+type Backfiller struct {
+	db       *sqlite3.SQLite3Backend
+	channels *channels.Store
+	accept   Accept
+	options  Options
+
+	// wake tells the worker there is a new channel to fetch
+	wake chan struct{}
+}
+
+func New(db *sqlite3.SQLite3Backend, channelStore *channels.Store, accept Accept, options Options) (*Backfiller, error) {
+	for _, ddl := range ddls {
+		if _, err := db.Exec(ddl); err != nil {
+			return nil, fmt.Errorf("failed to create backfill tables: %w", err)
+		}
+	}
+
+	options = options.withDefaults()
+	self := make([]string, 0, len(options.Self))
+	for _, url := range options.Self {
+		if url = channels.RelayURL(url); url != "" {
+			self = append(self, url)
+		}
+	}
+	options.Self = self
+
+	return &Backfiller{
+		db:       db,
+		channels: channelStore,
+		accept:   accept,
+		options:  options,
+		wake:     make(chan struct{}, 1),
+	}, nil
+}
+
+// EventSaved is meant to be added to relay.OnEventSaved after the channel
+// store, so the relays of a channel are the ones its event just declared
+func (b *Backfiller) EventSaved(ctx context.Context, event *nostr.Event) {
+	if err := b.Learn(ctx, event); err != nil {
+		log.Printf("Failed to schedule the backfill of %s: %v", event.ID, err)
+	}
+}
+
+// Learn schedules fetching the history of the channel of a kind 40 or 41
+// from every relay it declares and that wasn't scheduled yet. The relay
+// hinted by the "e" tag of a kind 41 is used too, it has the channel.
+func (b *Backfiller) Learn(ctx context.Context, event *nostr.Event) error {
+	var channelID string
+	var declared []string
+	switch event.Kind {
+	case 40:
+		channelID = event.ID
+	case 41:
+		channelID = kinds.ChannelID(event)
+		for _, tag := range event.Tags {
+			if len(tag) >= 3 && tag[0] == "e" && tag[1] == channelID {
+				declared = append(declared, tag[2])
+			}
+		}
+	default:
+		return nil
+	}
+	if channelID == "" {
+		return nil
+	}
+
+	channel, err := b.channels.Get(ctx, channelID)
+	if err != nil && !errors.Is(err, channels.ErrNotFound) {
+		return err
+	}
+	if channel != nil {
+		declared = append(declared, channel.Relays...)
+	}
+
+	relays := b.sources(declared)
+	if len(relays) == 0 {
+		return nil
+	}
+
+	now := nostr.Now()
+	floor := nostr.Timestamp(0)
+	if b.options.MaxAge > 0 {
+		floor = now - nostr.Timestamp(b.options.MaxAge.Seconds())
+	}
+	for _, relay := range relays {
+		_, err := b.db.ExecContext(ctx, `
+            INSERT INTO backfill_cursor (channel, relay, floor, next_attempt_at, created_at, updated_at)
+            VALUES (?, ?, ?, ?, ?, ?) ON CONFLICT (channel, relay) DO NOTHING
+        `, channelID, relay, floor, now, now, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// sources normalizes the relays declared by a channel, leaving out this
+// relay and anything that isn't a websocket URL
+func (b *Backfiller) sources(declared []string) []string {
+	relays := make([]string, 0, len(declared))
+	for _, url := range declared {
+		url = channels.RelayURL(url)
+		if url == "" || slices.Contains(b.options.Self, url) || slices.Contains(relays, url) {
+			continue
+		}
+		relays = append(relays, url)
+	}
+	return relays
+}
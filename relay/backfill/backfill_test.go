@@ -0,0 +1,181 @@
+package backfill
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"nostr-relay/channels"
+	"nostr-relay/ingest"
+	"nostr-relay/internal/testutil"
+	"nostr-relay/kinds"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func cursorStatus(t *testing.T, b *Backfiller, url string) CursorStatus {
+	status, err := b.Status(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range status.Cursors {
+		if c.Relay == nostr.NormalizeURL(url) {
+			return c
+		}
+	}
+	t.Fatalf("no cursor for %s", url)
+	return CursorStatus{}
+}
+
+func TestBackfill(t *testing.T) {
+	ctx := context.Background()
+
+	db := testutil.DB(t, "backfill")
+
+	channelStore, err := channels.New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the hooks the relay would run for the kinds fetched
+	relay := khatru.NewRelay()
+	relay.RejectEvent = append(relay.RejectEvent, kinds.Validators(db)...)
+	relay.StoreEvent = append(relay.StoreEvent, db.SaveEvent)
+	relay.QueryEvents = append(relay.QueryEvents, db.QueryEvents)
+	relay.OnEventSaved = append(relay.OnEventSaved, channelStore.EventSaved)
+	accept := func(ctx context.Context, event *nostr.Event) error {
+		return ingest.Accept(ctx, relay, event)
+	}
+
+	options := Options{
+		Self:          []string{"wss://relay.example.com"},
+		MaxAge:        30 * 24 * time.Hour,
+		PageSize:      2,
+		MaxFailures:   2,
+		RetryInterval: time.Millisecond,
+		Timeout:       2 * time.Second,
+	}
+	b, err := New(db, channelStore, accept, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay.OnEventSaved = append(relay.OnEventSaved, b.EventSaved)
+
+	// sqlite upstream, as slicestore can't query a single second
+	upstreamStore := testutil.DB(t, "upstream")
+	upstream := testutil.Relay(t, upstreamStore)
+	gone := testutil.Unreachable()
+
+	privateKey := nostr.GeneratePrivateKey()
+	now := nostr.Now()
+	publish := func(event nostr.Event, age nostr.Timestamp) nostr.Event {
+		event.CreatedAt = now - age
+		if err := event.Sign(privateKey); err != nil {
+			t.Fatal(err)
+		}
+		if err := upstreamStore.SaveEvent(ctx, &event); err != nil {
+			t.Fatal(err)
+		}
+		return event
+	}
+
+	content, _ := json.Marshal(map[string]any{"name": "Backfill", "relays": []string{upstream, gone, "wss://relay.example.com"}})
+	channel := publish(nostr.Event{Kind: 40, Content: string(content)}, 3600)
+	root := nostr.Tags{{"e", channel.ID, upstream, "root"}}
+	update := publish(nostr.Event{Kind: 41, Content: string(content), Tags: root}, 3000)
+
+	recent := make([]nostr.Event, 0)
+	for i := range 5 {
+		recent = append(recent, publish(nostr.Event{Kind: 42, Content: "hello", Tags: root}, nostr.Timestamp(100+i)))
+	}
+	// a page of the same second
+	for i := range 3 {
+		recent = append(recent, publish(nostr.Event{Kind: 7353, Content: strings.Repeat("!", i+1), Tags: root}, 50))
+	}
+	old := publish(nostr.Event{Kind: 42, Content: "too old", Tags: root}, 40*24*3600)
+
+	// a valid id, but signed for other content: go-nostr drops it before
+	// the backfill checks it again
+	forged := nostr.Event{Kind: 42, Content: "signed", Tags: root, CreatedAt: now - 200}
+	forged.Sign(privateKey)
+	forged.Content = "forged"
+	forged.ID = forged.GetID()
+	if err := upstreamStore.SaveEvent(ctx, &forged); err != nil {
+		t.Fatal(err)
+	}
+
+	// the channel is learned from a kind 41 seen elsewhere, its hint is the
+	// only relay known until the kind 40 is fetched
+	if err := b.Learn(ctx, &update); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := b.Step(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := channelStore.Get(ctx, channel.ID); err != nil {
+		t.Fatalf("the channel should be fetched first: %v", err)
+	}
+	if status := cursorStatus(t, b, gone); status.Done {
+		t.Errorf("the relays declared by the channel are fetched from too: %+v", status)
+	}
+
+	// cursors survive restarts
+	b, err = New(db, channelStore, accept, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 50 {
+		count, err := b.Step(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count == 0 {
+			break
+		}
+	}
+
+	has := func(id string) bool {
+		count, err := db.CountEvents(ctx, nostr.Filter{IDs: []string{id}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return count > 0
+	}
+	for _, event := range append(recent, update) {
+		if !has(event.ID) {
+			t.Errorf("%s (kind %d, %q) wasn't fetched", event.ID, event.Kind, event.Content)
+		}
+	}
+	if has(old.ID) {
+		t.Error("events older than MaxAge aren't fetched")
+	}
+	if has(forged.ID) {
+		t.Error("events with a bad signature aren't stored")
+	}
+
+	status := cursorStatus(t, b, upstream)
+	if !status.Done || status.Stored != len(recent)+2 || status.Failures != 0 {
+		t.Errorf("upstream cursor: %+v", status)
+	}
+	if status := cursorStatus(t, b, gone); !status.Done || status.Failures != 2 || status.LastError == "" {
+		t.Errorf("unreachable relays are given up: %+v", status)
+	}
+
+	t.Run("max events", func(t *testing.T) {
+		b := &Backfiller{options: Options{MaxEvents: 10}.withDefaults(), db: db}
+		c := cursor{channel: channel.ID, relay: "wss://other.example.com", until: now, fetched: 8}
+		if _, err := db.Exec(`INSERT INTO backfill_cursor (channel, relay, next_attempt_at, created_at, updated_at) VALUES (?, ?, 0, 0, 0)`,
+			c.channel, c.relay); err != nil {
+			t.Fatal(err)
+		}
+
+		b.advance(ctx, c, page{events: 2, oldest: now - 10})
+		if status := cursorStatus(t, b, c.relay); !status.Done || status.Until != now-10 {
+			t.Errorf("cursors stop at MaxEvents: %+v", status)
+		}
+	})
+}
@@ -0,0 +1,79 @@
+package backfill
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// CursorStatus is how far the history of a channel was fetched from a relay
+type CursorStatus struct {
+	Channel       string          `json:"channel"`
+	Relay         string          `json:"relay"`
+	Until         nostr.Timestamp `json:"until,omitempty"`
+	Floor         nostr.Timestamp `json:"floor,omitempty"`
+	Done          bool            `json:"done"`
+	Fetched       int             `json:"fetched"`
+	Stored        int             `json:"stored"`
+	Rejected      int             `json:"rejected"`
+	Failures      int             `json:"failures"`
+	NextAttemptAt nostr.Timestamp `json:"next_attempt_at,omitempty"`
+	LastError     string          `json:"last_error,omitempty"`
+	UpdatedAt     nostr.Timestamp `json:"updated_at"`
+}
+
+// Status is what the backfill has left to do and where every cursor stands
+type Status struct {
+	Pending int            `json:"pending"`
+	Done    int            `json:"done"`
+	Cursors []CursorStatus `json:"cursors"`
+}
+
+// Status returns the cursors, those still fetching first, most recently
+// updated first
+func (b *Backfiller) Status(ctx context.Context) (Status, error) {
+	status := Status{Cursors: make([]CursorStatus, 0)}
+
+	rows, err := b.db.QueryContext(ctx, `
+        SELECT channel, relay, until, floor, done, fetched, stored, rejected, failures, next_attempt_at, last_error, updated_at
+        FROM backfill_cursor ORDER BY done, updated_at DESC
+    `)
+	if err != nil {
+		return status, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c CursorStatus
+		if err := rows.Scan(&c.Channel, &c.Relay, &c.Until, &c.Floor, &c.Done, &c.Fetched, &c.Stored, &c.Rejected,
+			&c.Failures, &c.NextAttemptAt, &c.LastError, &c.UpdatedAt); err != nil {
+			return status, err
+		}
+		if c.Done {
+			status.Done++
+			c.NextAttemptAt = 0
+		} else {
+			status.Pending++
+		}
+		status.Cursors = append(status.Cursors, c)
+	}
+
+	return status, rows.Err()
+}
+
+// HandleStatus serves the Status as JSON, it's meant to be behind the admin
+// authentication of the dashboard
+func (b *Backfiller) HandleStatus(w http.ResponseWriter, r *http.Request) {
+	status, err := b.Status(r.Context())
+	if err != nil {
+		log.Printf("Failed to load the backfill status: %v", err)
+		http.Error(w, "could not load the backfill status", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,304 @@
+package backfill
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"nostr-relay/ingest"
+	"nostr-relay/kinds"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// historyKinds are what's fetched for a channel, besides its kind 40
+var historyKinds = []int{41, 42, 7353}
+
+// cursor is where the history of a channel stands on a relay
+type cursor struct {
+	channel  string
+	relay    string
+	until    nostr.Timestamp
+	floor    nostr.Timestamp
+	fetched  int
+	failures int
+}
+
+// page is what came out of fetching a page
+type page struct {
+	events   int
+	oldest   nostr.Timestamp
+	stored   int
+	rejected int
+}
+
+// Run fetches a page for every channel due every interval, and as soon as a
+// channel is learned, until ctx is done
+func (b *Backfiller) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		for {
+			count, err := b.Step(ctx)
+			if err != nil && ctx.Err() == nil {
+				log.Printf("Backfill round failed: %v", err)
+			}
+			// channels with more history are due again right away
+			if err != nil || count == 0 {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-b.wake:
+		}
+	}
+}
+
+// Step fetches the next page of a batch of the cursors that are due, one
+// relay at a time, returning how many were tried
+func (b *Backfiller) Step(ctx context.Context) (int, error) {
+	cursors, err := b.due(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	byRelay := make(map[string][]cursor)
+	for _, c := range cursors {
+		byRelay[c.relay] = append(byRelay[c.relay], c)
+	}
+
+	var wg sync.WaitGroup
+	for url, cursors := range byRelay {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.fetch(ctx, url, cursors)
+		}()
+	}
+	wg.Wait()
+
+	return len(cursors), nil
+}
+
+func (b *Backfiller) due(ctx context.Context) ([]cursor, error) {
+	rows, err := b.db.QueryContext(ctx, `
+        SELECT channel, relay, until, floor, fetched, failures FROM backfill_cursor
+        WHERE done = 0 AND next_attempt_at <= ?
+        ORDER BY next_attempt_at LIMIT ?
+    `, nostr.Now(), b.options.BatchSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load backfill cursors: %w", err)
+	}
+	defer rows.Close()
+
+	cursors := make([]cursor, 0)
+	for rows.Next() {
+		var c cursor
+		if err := rows.Scan(&c.channel, &c.relay, &c.until, &c.floor, &c.fetched, &c.failures); err != nil {
+			return nil, err
+		}
+		cursors = append(cursors, c)
+	}
+
+	return cursors, rows.Err()
+}
+
+// fetch advances the cursors of one relay on a single connection
+func (b *Backfiller) fetch(ctx context.Context, url string, cursors []cursor) {
+	connectCtx, cancel := context.WithTimeout(ctx, b.options.Timeout)
+	relay, err := nostr.RelayConnect(connectCtx, url)
+	cancel()
+	if err != nil {
+		for _, c := range cursors {
+			b.fail(ctx, c, err)
+		}
+		return
+	}
+	defer relay.Close()
+
+	for _, c := range cursors {
+		p, err := b.next(ctx, relay, c)
+		if err != nil {
+			b.fail(ctx, c, err)
+			continue
+		}
+		b.advance(ctx, c, p)
+	}
+}
+
+// next fetches and accepts the page of c, starting with the kind 40 of the
+// channel when this relay doesn't have it: nothing else can be accepted
+// without it
+func (b *Backfiller) next(ctx context.Context, relay *nostr.Relay, c cursor) (page, error) {
+	var p page
+
+	// validators must not look for missing channels elsewhere, this relay
+	// is the one to ask
+	ctx = kinds.WithoutRemoteLookups(ctx)
+
+	if c.until == 0 {
+		create, err := b.query(ctx, relay, nostr.Filter{IDs: []string{c.channel}, Kinds: []int{40}})
+		if err != nil {
+			return p, err
+		}
+		if err := b.acceptAll(ctx, c, create, &p); err != nil {
+			return p, err
+		}
+	}
+
+	filter := nostr.Filter{
+		Kinds: historyKinds,
+		Tags:  nostr.TagMap{"e": []string{c.channel}},
+		Limit: min(b.options.PageSize, b.options.MaxEvents-c.fetched),
+	}
+	if c.until > 0 {
+		filter.Until = &c.until
+	}
+	if c.floor > 0 {
+		filter.Since = &c.floor
+	}
+
+	events, err := b.query(ctx, relay, filter)
+	if err != nil {
+		return p, err
+	}
+
+	// a full page of the second the cursor is at would come back every
+	// time, so that second is fetched at once
+	if c.until > 0 && len(events) == filter.Limit && sameSecond(events, c.until) {
+		filter.Since = &c.until
+		filter.Limit = b.options.MaxEvents
+		if events, err = b.query(ctx, relay, filter); err != nil {
+			return p, err
+		}
+	}
+
+	// the kind 41 are accepted before the messages, which may follow the
+	// metadata they set
+	p.events = len(events)
+	updates := make([]*nostr.Event, 0)
+	messages := make([]*nostr.Event, 0, len(events))
+	for _, event := range events {
+		if !filter.Matches(event) || kinds.ChannelID(event) != c.channel {
+			p.rejected++
+			continue
+		}
+		if p.oldest == 0 || event.CreatedAt < p.oldest {
+			p.oldest = event.CreatedAt
+		}
+		if event.Kind == 41 {
+			updates = append(updates, event)
+		} else {
+			messages = append(messages, event)
+		}
+	}
+	if err := b.acceptAll(ctx, c, updates, &p); err != nil {
+		return p, err
+	}
+	err = b.acceptAll(ctx, c, messages, &p)
+
+	return p, err
+}
+
+func (b *Backfiller) query(ctx context.Context, relay *nostr.Relay, filter nostr.Filter) ([]*nostr.Event, error) {
+	ctx, cancel := context.WithTimeout(ctx, b.options.Timeout)
+	defer cancel()
+
+	return relay.QuerySync(ctx, filter)
+}
+
+func sameSecond(events []*nostr.Event, second nostr.Timestamp) bool {
+	for _, event := range events {
+		if event.CreatedAt != second {
+			return false
+		}
+	}
+	return true
+}
+
+// acceptAll stores the events whose id and signature check out, oldest
+// first, and which this relay would have accepted if they were published
+// to it. It stops at the first error that isn't about the event itself,
+// like the relay shutting down.
+func (b *Backfiller) acceptAll(ctx context.Context, c cursor, events []*nostr.Event, p *page) error {
+	for i := len(events) - 1; i >= 0; i-- {
+		event := events[i]
+		if !event.CheckID() {
+			p.rejected++
+			continue
+		}
+		if ok, _ := event.CheckSignature(); !ok {
+			p.rejected++
+			continue
+		}
+
+		err := b.accept(ctx, event)
+		switch {
+		case err == nil:
+			p.stored++
+		case errors.Is(err, eventstore.ErrDupEvent):
+		case errors.Is(err, ingest.ErrRejected):
+			log.Printf("Backfill of %s from %s: %s refused: %v", c.channel, c.relay, event.ID, err)
+			p.rejected++
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// advance moves c past the page just fetched, it's done when the relay
+// has nothing older or when it reached its limits
+func (b *Backfiller) advance(ctx context.Context, c cursor, p page) {
+	until := p.oldest
+	// a page filled by events of the same second would be fetched again
+	if c.until > 0 && until >= c.until {
+		until = c.until - 1
+	}
+	fetched := c.fetched + p.events
+	done := p.oldest == 0 || fetched >= b.options.MaxEvents || until < c.floor || until <= 0
+	if p.oldest == 0 {
+		until = c.until
+	}
+
+	_, err := b.db.ExecContext(ctx, `
+        UPDATE backfill_cursor SET until = ?, done = ?, fetched = ?, stored = stored + ?, rejected = rejected + ?,
+          failures = 0, next_attempt_at = ?, last_error = '', updated_at = ?
+        WHERE channel = ? AND relay = ?
+    `, until, done, fetched, p.stored, p.rejected, nostr.Now(), nostr.Now(), c.channel, c.relay)
+	if err != nil {
+		log.Printf("Failed to advance the backfill of %s from %s: %v", c.channel, c.relay, err)
+	}
+}
+
+// fail waits before trying c again, longer after every failure in a row,
+// until there were too many
+func (b *Backfiller) fail(ctx context.Context, c cursor, cause error) {
+	if ctx.Err() != nil {
+		return
+	}
+
+	failures := c.failures + 1
+	done := failures >= b.options.MaxFailures
+	if done {
+		log.Printf("Giving up the backfill of %s from %s after %d failures: %v", c.channel, c.relay, failures, cause)
+	}
+
+	next := nostr.Now() + nostr.Timestamp(b.options.RetryInterval.Seconds())*nostr.Timestamp(failures)
+	_, err := b.db.ExecContext(ctx, `
+        UPDATE backfill_cursor SET failures = ?, done = ?, next_attempt_at = ?, last_error = ?, updated_at = ?
+        WHERE channel = ? AND relay = ?
+    `, failures, done, next, cause.Error(), nostr.Now(), c.channel, c.relay)
+	if err != nil {
+		log.Printf("Failed to record the backfill failure of %s from %s: %v", c.channel, c.relay, err)
+	}
+}
@@ -0,0 +1,88 @@
+package blossom
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// clockSkew is how far in the future an authorization may be created
+const clockSkew = 60
+
+// authorize checks the kind 24242 event of the "Authorization: Nostr
+// <base64 event>" header, which must allow verb and not be expired. It
+// returns nil when there is no authorization.
+func authorize(r *http.Request, verb string) (*nostr.Event, error) {
+	encoded, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Nostr ")
+	if !ok {
+		return nil, nil
+	}
+
+	eventj, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, errorf(http.StatusUnauthorized, "invalid base64 authorization")
+	}
+
+	var event nostr.Event
+	if err := json.Unmarshal(eventj, &event); err != nil {
+		return nil, errorf(http.StatusUnauthorized, "invalid authorization event json")
+	}
+
+	if event.Kind != 24242 {
+		return nil, errorf(http.StatusUnauthorized, "authorization event must be kind 24242")
+	}
+	if !event.CheckID() {
+		return nil, errorf(http.StatusUnauthorized, "invalid authorization event id")
+	}
+	if ok, _ := event.CheckSignature(); !ok {
+		return nil, errorf(http.StatusUnauthorized, "invalid authorization event signature")
+	}
+
+	now := nostr.Now()
+	if event.CreatedAt > now+clockSkew {
+		return nil, errorf(http.StatusUnauthorized, "authorization event is in the future")
+	}
+
+	expiration := event.Tags.Find("expiration")
+	if expiration == nil {
+		return nil, errorf(http.StatusUnauthorized, "authorization event has no expiration")
+	}
+	if at, err := strconv.ParseInt(expiration[1], 10, 64); err != nil || nostr.Timestamp(at) <= now {
+		return nil, errorf(http.StatusUnauthorized, "authorization event expired")
+	}
+
+	if event.Tags.FindWithValue("t", verb) == nil {
+		return nil, errorf(http.StatusForbidden, "authorization event isn't for %s", verb)
+	}
+
+	return &event, nil
+}
+
+// requireAuthorization is authorize for the endpoints that can't be used
+// without one
+func requireAuthorization(r *http.Request, verb string) (*nostr.Event, error) {
+	auth, err := authorize(r, verb)
+	if err == nil && auth == nil {
+		err = errorf(http.StatusUnauthorized, "missing authorization")
+	}
+	return auth, err
+}
+
+// allows tells if auth names the blob, when it names any: an upload
+// authorization without "x" tags is good for any blob
+func allows(auth *nostr.Event, sha256 string, required bool) bool {
+	named := false
+	for _, tag := range auth.Tags {
+		if len(tag) >= 2 && tag[0] == "x" {
+			if tag[1] == sha256 {
+				return true
+			}
+			named = true
+		}
+	}
+	return !named && !required
+}
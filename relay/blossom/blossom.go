@@ -0,0 +1,167 @@
+package blossom
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/eventstore/sqlite3"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// blob has what's stored, blob_owner who uploaded or mirrored it: a blob is
+// kept while someone owns it. Owners are pubkeys, or names for what the
+// relay keeps itself, like "drive:<address>" for pinned drives.
+var ddls = []string{
+	`CREATE TABLE IF NOT EXISTS blob (
+       sha256 text PRIMARY KEY,
+       size integer NOT NULL,
+       type text NOT NULL,
+       uploaded_at integer NOT NULL);`,
+	`CREATE TABLE IF NOT EXISTS blob_owner (
+       sha256 text NOT NULL,
+       pubkey text NOT NULL,
+       uploaded_at integer NOT NULL,
+       PRIMARY KEY (sha256, pubkey));`,
+	`CREATE INDEX IF NOT EXISTS blob_owner_pubkey ON blob_owner (pubkey, uploaded_at DESC);`,
+}
+
+// DefaultTypes are what characters, backgrounds and fonts are made of
+var DefaultTypes = []string{
+	"image/svg+xml", "image/png", "image/jpeg", "image/webp", "image/gif",
+	"font/woff2", "font/woff", "font/ttf", "font/otf",
+}
+
+// Options tune the server, zero values use the defaults
+type Options struct {
+	// Dir is where blobs are stored
+	Dir string
+
+	// ServiceURL is the public URL of the relay, blob URLs are made from it
+	// or, when empty, from the request
+	ServiceURL string
+
+	// MaxSize is the size limit of an upload, in bytes
+	MaxSize int64
+
+	// Types are the MIME types that can be uploaded
+	Types []string
+
+	// Uploaders are the pubkeys allowed to upload, anyone when empty
+	Uploaders []string
+
+	// MirrorTimeout bounds the download of a mirrored blob
+	MirrorTimeout time.Duration
+
+	// PrivateMirrors lets mirrors download from loopback, private and
+	// link-local addresses, which are refused so users can't make the relay
+	// reach its own network
+	PrivateMirrors bool
+
+	// SVG is what's done with uploaded SVGs that could run scripts once
+	// rendered inline: SVGSanitize rewrites them, SVGStrict refuses them
+	// and SVGAsIs stores them unchanged
+	SVG string
+}
+
+const (
+	SVGSanitize = "sanitize"
+	SVGStrict   = "strict"
+	SVGAsIs     = "off"
+)
+
+func (o Options) withDefaults() Options {
+	if o.Dir == "" {
+		o.Dir = "./blobs"
+	}
+	if o.MaxSize <= 0 {
+		o.MaxSize = 10 << 20
+	}
+	if len(o.Types) == 0 {
+		o.Types = DefaultTypes
+	}
+	if o.MirrorTimeout <= 0 {
+		o.MirrorTimeout = time.Minute
+	}
+	if o.SVG == "" {
+		o.SVG = SVGSanitize
+	}
+	return o
+}
+
+// Server serves the BUD-01, BUD-02 and BUD-04 endpoints of a Blossom server
+// from blobs kept on the local disk, named after their sha256
+type Server struct {
+	db      *sqlite3.SQLite3Backend
+	client  *http.Client
+	options Options
+
+	// mu keeps a blob from being deleted while it's uploaded again
+	mu sync.Mutex
+}
+
+func New(db *sqlite3.SQLite3Backend, options Options) (*Server, error) {
+	for _, ddl := range ddls {
+		if _, err := db.Exec(ddl); err != nil {
+			return nil, fmt.Errorf("failed to create blob tables: %w", err)
+		}
+	}
+
+	options = options.withDefaults()
+	if err := os.MkdirAll(options.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create the blob directory: %w", err)
+	}
+
+	client := PublicClient(options.MirrorTimeout)
+	if options.PrivateMirrors {
+		client = &http.Client{Timeout: options.MirrorTimeout}
+	}
+	return &Server{db: db, client: client, options: options}, nil
+}
+
+// Register adds the Blossom routes to mux. Blobs are served at the root,
+// besides the relay itself, which only answers websockets and NIP-11 there.
+func (s *Server) Register(mux *http.ServeMux) {
+	mux.HandleFunc("PUT /upload", s.handleUpload)
+	mux.HandleFunc("HEAD /upload", s.handleUploadCheck)
+	mux.HandleFunc("PUT /mirror", s.handleMirror)
+	mux.HandleFunc("GET /list/{pubkey}", s.handleList)
+	mux.HandleFunc("/{blob}", s.handleBlob)
+}
+
+// baseURL is the http URL blobs are served at
+func (s *Server) baseURL(r *http.Request) string {
+	if url := s.options.ServiceURL; url != "" {
+		url = strings.TrimSuffix(url, "/")
+		switch {
+		case strings.HasPrefix(url, "wss://"):
+			return "https://" + strings.TrimPrefix(url, "wss://")
+		case strings.HasPrefix(url, "ws://"):
+			return "http://" + strings.TrimPrefix(url, "ws://")
+		}
+		return url
+	}
+
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+func (s *Server) canUpload(pubkey string) bool {
+	return len(s.options.Uploaders) == 0 || slices.Contains(s.options.Uploaders, pubkey)
+}
+
+// Descriptor describes a blob, as BUD-02 returns it
+type Descriptor struct {
+	URL      string          `json:"url"`
+	SHA256   string          `json:"sha256"`
+	Size     int64           `json:"size"`
+	Type     string          `json:"type"`
+	Uploaded nostr.Timestamp `json:"uploaded"`
+}
@@ -0,0 +1,393 @@
+package blossom
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/fiatjaf/eventstore/sqlite3"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const svg = `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 10 10"><circle cx="5" cy="5" r="4"/></svg>`
+
+func newServer(t *testing.T, options Options) *httptest.Server {
+	db := &sqlite3.SQLite3Backend{DatabaseURL: filepath.Join(t.TempDir(), "blossom.sqlite")}
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+
+	options.Dir = filepath.Join(t.TempDir(), "blobs")
+	// the origins of tests listen on the loopback address
+	options.PrivateMirrors = true
+	s, err := New(db, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {})
+	s.Register(mux)
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// authorization signs a kind 24242 event for verb, expiring in expiresIn
+// seconds
+func authorization(t *testing.T, privateKey string, verb string, expiresIn int64, tags ...nostr.Tag) string {
+	event := nostr.Event{
+		Kind:      24242,
+		CreatedAt: nostr.Now(),
+		Content:   verb,
+		Tags:      append(nostr.Tags{{"t", verb}, {"expiration", strconv.FormatInt(int64(nostr.Now())+expiresIn, 10)}}, tags...),
+	}
+	if err := event.Sign(privateKey); err != nil {
+		t.Fatal(err)
+	}
+	eventj, _ := json.Marshal(event)
+	return "Nostr " + base64.StdEncoding.EncodeToString(eventj)
+}
+
+func do(t *testing.T, method string, url string, auth string, contentType string, body []byte) *http.Response {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestBlossom(t *testing.T) {
+	server := newServer(t, Options{MaxSize: 1024})
+
+	alice, bob := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+	alicePub, _ := nostr.GetPublicKey(alice)
+	sha := hash([]byte(svg))
+
+	upload := func(privateKey string, contentType string, body []byte, tags ...nostr.Tag) *http.Response {
+		return do(t, "PUT", server.URL+"/upload", authorization(t, privateKey, "upload", 60, tags...), contentType, body)
+	}
+
+	resp := upload(alice, "image/svg+xml", []byte(svg), nostr.Tag{"x", sha})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("upload: %d %s", resp.StatusCode, resp.Header.Get("X-Reason"))
+	}
+	var descriptor Descriptor
+	json.NewDecoder(resp.Body).Decode(&descriptor)
+	if descriptor.SHA256 != sha || descriptor.Size != int64(len(svg)) || descriptor.Type != "image/svg+xml" ||
+		descriptor.URL != server.URL+"/"+sha+".svg" {
+		t.Errorf("descriptor: %+v", descriptor)
+	}
+
+	t.Run("get", func(t *testing.T) {
+		for _, path := range []string{"/" + sha, "/" + sha + ".svg"} {
+			resp := do(t, "GET", server.URL+path, "", "", nil)
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusOK || string(body) != svg || resp.Header.Get("Content-Type") != "image/svg+xml" {
+				t.Errorf("GET %s: %d %s %q", path, resp.StatusCode, resp.Header.Get("Content-Type"), body)
+			}
+			if resp.Header.Get("Content-Security-Policy") != "sandbox; default-src 'none'" || resp.Header.Get("X-Content-Type-Options") != "nosniff" {
+				t.Errorf("GET %s, a blob opened directly can run scripts: %v", path, resp.Header)
+			}
+		}
+
+		resp := do(t, "HEAD", server.URL+"/"+sha, "", "", nil)
+		if resp.StatusCode != http.StatusOK || resp.ContentLength != int64(len(svg)) {
+			t.Errorf("HEAD: %d, length %d", resp.StatusCode, resp.ContentLength)
+		}
+
+		if resp := do(t, "GET", server.URL+"/"+hash([]byte("nope")), "", "", nil); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("missing blob: %d", resp.StatusCode)
+		}
+		if resp := do(t, "GET", server.URL+"/healthz", "", "", nil); resp.StatusCode != http.StatusOK {
+			t.Errorf("other routes still work: %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		resp := do(t, "GET", server.URL+"/list/"+alicePub, "", "", nil)
+		var list []Descriptor
+		json.NewDecoder(resp.Body).Decode(&list)
+		if len(list) != 1 || list[0].SHA256 != sha {
+			t.Errorf("list: %+v", list)
+		}
+
+		wrongVerb := authorization(t, alice, "upload", 60)
+		if resp := do(t, "GET", server.URL+"/list/"+alicePub, wrongVerb, "", nil); resp.StatusCode != http.StatusForbidden {
+			t.Errorf("list with an upload authorization: %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("refused uploads", func(t *testing.T) {
+		cases := map[string]struct {
+			resp   *http.Response
+			status int
+		}{
+			"no authorization": {do(t, "PUT", server.URL+"/upload", "", "image/svg+xml", []byte(svg)), http.StatusUnauthorized},
+			"expired": {do(t, "PUT", server.URL+"/upload", authorization(t, alice, "upload", -1), "image/svg+xml", []byte(svg)),
+				http.StatusUnauthorized},
+			"wrong verb": {do(t, "PUT", server.URL+"/upload", authorization(t, alice, "delete", 60), "image/svg+xml", []byte(svg)),
+				http.StatusForbidden},
+			"other blob":     {upload(alice, "image/svg+xml", []byte(svg), nostr.Tag{"x", hash([]byte("other"))}), http.StatusForbidden},
+			"too large":      {upload(alice, "image/svg+xml", bytes.Repeat([]byte(" "), 2048)), http.StatusRequestEntityTooLarge},
+			"not accepted":   {upload(alice, "text/html", []byte("<html><script>alert(1)</script></html>")), http.StatusUnsupportedMediaType},
+			"not really svg": {upload(alice, "image/svg+xml", []byte("\x89PNG\r\n\x1a\n not svg")), http.StatusOK},
+		}
+		for name, c := range cases {
+			if c.resp.StatusCode != c.status {
+				t.Errorf("%s: %d %s, want %d", name, c.resp.StatusCode, c.resp.Header.Get("X-Reason"), c.status)
+			}
+			if c.status != http.StatusOK && c.resp.Header.Get("X-Reason") == "" {
+				t.Errorf("%s: no X-Reason", name)
+			}
+		}
+
+		// a PNG declared as SVG is stored as what it is
+		resp := do(t, "HEAD", server.URL+"/"+hash([]byte("\x89PNG\r\n\x1a\n not svg")), "", "", nil)
+		if resp.Header.Get("Content-Type") != "image/png" {
+			t.Errorf("sniffed type: %s", resp.Header.Get("Content-Type"))
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		// bob owns the same blob now
+		if resp := upload(bob, "image/svg+xml", []byte(svg)); resp.StatusCode != http.StatusOK {
+			t.Fatalf("second upload: %d", resp.StatusCode)
+		}
+
+		remove := func(privateKey string, tags ...nostr.Tag) int {
+			return do(t, "DELETE", server.URL+"/"+sha, authorization(t, privateKey, "delete", 60, tags...), "", nil).StatusCode
+		}
+
+		if status := remove(alice); status != http.StatusForbidden {
+			t.Errorf("deleting without naming the blob: %d", status)
+		}
+		if status := remove(alice, nostr.Tag{"x", sha}); status != http.StatusNoContent {
+			t.Errorf("delete: %d", status)
+		}
+		if status := remove(alice, nostr.Tag{"x", sha}); status != http.StatusNotFound {
+			t.Errorf("deleting twice: %d", status)
+		}
+		if resp := do(t, "GET", server.URL+"/"+sha, "", "", nil); resp.StatusCode != http.StatusOK {
+			t.Errorf("blobs owned by someone else are kept: %d", resp.StatusCode)
+		}
+
+		if status := remove(bob, nostr.Tag{"x", sha}); status != http.StatusNoContent {
+			t.Errorf("delete: %d", status)
+		}
+		if resp := do(t, "GET", server.URL+"/"+sha, "", "", nil); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("blobs nobody owns are deleted: %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("uploaders", func(t *testing.T) {
+		server := newServer(t, Options{Uploaders: []string{alicePub}})
+		resp := do(t, "PUT", server.URL+"/upload", authorization(t, bob, "upload", 60), "image/svg+xml", []byte(svg))
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("upload by someone else: %d", resp.StatusCode)
+		}
+	})
+}
+
+func TestSanitizeSVG(t *testing.T) {
+	alice := nostr.GeneratePrivateKey()
+	unsafe := []byte(`<svg xmlns="http://www.w3.org/2000/svg" onload="alert(1)"><script>alert(2)</script><circle r="4"/></svg>`)
+	safe := `<svg xmlns="http://www.w3.org/2000/svg"><circle r="4"></circle></svg>`
+
+	server := newServer(t, Options{})
+	resp := do(t, "PUT", server.URL+"/upload", authorization(t, alice, "upload", 60, nostr.Tag{"x", hash(unsafe)}), "image/svg+xml", unsafe)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("upload: %d %s", resp.StatusCode, resp.Header.Get("X-Reason"))
+	}
+	var descriptor Descriptor
+	json.NewDecoder(resp.Body).Decode(&descriptor)
+	if descriptor.SHA256 != hash([]byte(safe)) || descriptor.Size != int64(len(safe)) {
+		t.Errorf("descriptor of the sanitized SVG: %+v", descriptor)
+	}
+
+	body, _ := io.ReadAll(do(t, "GET", server.URL+"/"+descriptor.SHA256, "", "", nil).Body)
+	if string(body) != safe {
+		t.Errorf("stored %s", body)
+	}
+	if resp := do(t, "HEAD", server.URL+"/"+hash(unsafe), "", "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("the unsafe SVG was stored: %d", resp.StatusCode)
+	}
+
+	strict := newServer(t, Options{SVG: SVGStrict})
+	resp = do(t, "PUT", strict.URL+"/upload", authorization(t, alice, "upload", 60), "image/svg+xml", unsafe)
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(resp.Header.Get("X-Reason"), "script") {
+		t.Errorf("strict upload: %d %s", resp.StatusCode, resp.Header.Get("X-Reason"))
+	}
+
+	asIs := newServer(t, Options{SVG: SVGAsIs})
+	resp = do(t, "PUT", asIs.URL+"/upload", authorization(t, alice, "upload", 60), "image/svg+xml", unsafe)
+	json.NewDecoder(resp.Body).Decode(&descriptor)
+	if descriptor.SHA256 != hash(unsafe) {
+		t.Errorf("SVG changed without sanitizing: %+v", descriptor)
+	}
+}
+
+func TestDetectType(t *testing.T) {
+	cases := []struct {
+		declared string
+		content  string
+		want     string
+	}{
+		{"image/svg+xml", svg, "image/svg+xml"},
+		{"", `<?xml version="1.0"?>` + svg, "image/svg+xml"},
+		{"image/svg+xml", "hello", "text/plain"},
+		{"font/woff2", "wOF2\x00\x01\x00\x00", "font/woff2"},
+		{"image/png", "\x00\x01\x02", "image/png"},
+	}
+	for _, c := range cases {
+		if got := DetectType(c.declared, []byte(c.content)); got != c.want {
+			t.Errorf("DetectType(%q, %q) = %s, want %s", c.declared, c.content, got, c.want)
+		}
+	}
+}
+
+func TestMirror(t *testing.T) {
+	evil := `<svg xmlns="http://www.w3.org/2000/svg" onload="alert(1)"/>`
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		switch strings.TrimPrefix(r.URL.Path, "/") {
+		case hash([]byte(svg)) + ".svg", hash([]byte("other")):
+			w.Write([]byte(svg))
+		case hash([]byte(evil)):
+			w.Write([]byte(evil))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(origin.Close)
+
+	server := newServer(t, Options{})
+	alice := nostr.GeneratePrivateKey()
+	sha := hash([]byte(svg))
+	mirror := func(url string, tags ...nostr.Tag) *http.Response {
+		body, _ := json.Marshal(map[string]string{"url": url})
+		return do(t, "PUT", server.URL+"/mirror", authorization(t, alice, "upload", 60, tags...), "application/json", body)
+	}
+
+	resp := mirror(origin.URL+"/"+sha+".svg", nostr.Tag{"x", sha})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("mirror: %d %s", resp.StatusCode, resp.Header.Get("X-Reason"))
+	}
+	var descriptor Descriptor
+	json.NewDecoder(resp.Body).Decode(&descriptor)
+	if descriptor.SHA256 != sha || descriptor.Type != "image/svg+xml" || descriptor.URL != server.URL+"/"+sha+".svg" {
+		t.Errorf("descriptor: %+v", descriptor)
+	}
+	if resp := do(t, "GET", server.URL+"/"+sha, "", "", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("mirrored blob: %d", resp.StatusCode)
+	}
+
+	if resp := mirror(origin.URL+"/"+sha+".svg", nostr.Tag{"x", hash([]byte("other"))}); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("authorization for another blob: %d", resp.StatusCode)
+	}
+	other := hash([]byte("other"))
+	if resp := mirror(origin.URL+"/"+other, nostr.Tag{"x", other}); resp.StatusCode != http.StatusConflict {
+		t.Errorf("content with another hash: %d", resp.StatusCode)
+	}
+	if resp := mirror(origin.URL+"/"+hash([]byte(evil)), nostr.Tag{"x", hash([]byte(evil))}); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unsafe SVG, which can't be rewritten: %d", resp.StatusCode)
+	}
+}
+
+func TestMirrorPrivate(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("the loopback address was reached")
+	}))
+	t.Cleanup(origin.Close)
+
+	db := &sqlite3.SQLite3Backend{DatabaseURL: filepath.Join(t.TempDir(), "blossom.sqlite")}
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+	s, err := New(db, Options{Dir: filepath.Join(t.TempDir(), "blobs")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sha := hash([]byte(svg))
+	for _, url := range []string{origin.URL, "http://[::1]:1", "http://169.254.169.254", "http://10.0.0.1"} {
+		_, err := s.Mirror(context.Background(), url+"/"+sha, sha, "alice")
+		var he *httpError
+		if !errors.As(err, &he) || he.status != http.StatusBadGateway || he.reason != "could not download the blob" {
+			t.Errorf("%s: %v", url, err)
+		}
+	}
+}
+
+func TestRelease(t *testing.T) {
+	db := &sqlite3.SQLite3Backend{DatabaseURL: filepath.Join(t.TempDir(), "blossom.sqlite")}
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+	s, err := New(db, Options{Dir: filepath.Join(t.TempDir(), "blobs"), PrivateMirrors: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Write([]byte(svg))
+	}))
+	t.Cleanup(origin.Close)
+
+	ctx := context.Background()
+	sha := hash([]byte(svg))
+	for _, owner := range []string{"drive:a", "drive:b"} {
+		if _, err := s.Mirror(ctx, origin.URL+"/"+sha, sha, owner); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.Release(ctx, sha, "drive:a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Open(ctx, sha); err != nil {
+		t.Errorf("blob still owned: %v", err)
+	}
+	if err := s.Release(ctx, sha, "drive:b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Open(ctx, sha); !errors.Is(err, ErrNotFound) {
+		t.Errorf("blob nobody owns: %v", err)
+	}
+	if err := s.Release(ctx, sha, "drive:b"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("released twice: %v", err)
+	}
+}
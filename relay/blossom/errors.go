@@ -0,0 +1,33 @@
+package blossom
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// httpError is an error answered with its own status
+type httpError struct {
+	status int
+	reason string
+}
+
+func (e *httpError) Error() string { return e.reason }
+
+func errorf(status int, format string, args ...any) error {
+	return &httpError{status: status, reason: fmt.Sprintf(format, args...)}
+}
+
+// writeError answers err, the reason going in the X-Reason header as
+// BUD-01 asks. Errors that aren't an httpError are logged and hidden.
+func writeError(w http.ResponseWriter, err error) {
+	var he *httpError
+	if !errors.As(err, &he) {
+		log.Printf("Blossom request failed: %v", err)
+		he = &httpError{status: http.StatusInternalServerError, reason: "internal error"}
+	}
+
+	w.Header().Set("X-Reason", he.reason)
+	http.Error(w, he.reason, he.status)
+}
@@ -0,0 +1,325 @@
+package blossom
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// handleUpload stores a blob, PUT /upload (BUD-02)
+func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
+	auth, err := requireAuthorization(r, "upload")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if !s.canUpload(auth.PubKey) {
+		writeError(w, errorf(http.StatusForbidden, "pubkey not allowed to upload"))
+		return
+	}
+	if r.ContentLength > s.options.MaxSize {
+		writeError(w, errorf(http.StatusRequestEntityTooLarge, "blob is larger than %d bytes", s.options.MaxSize))
+		return
+	}
+
+	u, err := s.receive(r.Body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	// nothing's left when the upload was kept
+	defer os.Remove(u.path)
+
+	if !allows(auth, u.sha256, false) {
+		writeError(w, errorf(http.StatusForbidden, "authorization isn't for this blob"))
+		return
+	}
+
+	mimeType := DetectType(r.Header.Get("Content-Type"), u.head)
+	if !slices.Contains(s.options.Types, mimeType) {
+		writeError(w, errorf(http.StatusUnsupportedMediaType, "%s blobs aren't accepted", mimeType))
+		return
+	}
+
+	// the authorization is for what was sent, what's stored might differ
+	if mimeType == "image/svg+xml" && s.options.SVG != SVGAsIs {
+		if err := s.sanitize(u, auth.PubKey, s.options.SVG == SVGStrict); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	descriptor, err := s.store(r.Context(), u, mimeType, auth.PubKey)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	descriptor.URL = s.baseURL(r) + "/" + descriptor.SHA256 + extension(descriptor.Type)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(descriptor)
+}
+
+// handleUploadCheck tells if an upload would be accepted before sending
+// it, HEAD /upload (BUD-06)
+func (s *Server) handleUploadCheck(w http.ResponseWriter, r *http.Request) {
+	auth, err := requireAuthorization(r, "upload")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if !s.canUpload(auth.PubKey) {
+		writeError(w, errorf(http.StatusForbidden, "pubkey not allowed to upload"))
+		return
+	}
+
+	if size, err := strconv.ParseInt(r.Header.Get("X-Content-Length"), 10, 64); err == nil && size > s.options.MaxSize {
+		writeError(w, errorf(http.StatusRequestEntityTooLarge, "blob is larger than %d bytes", s.options.MaxSize))
+		return
+	}
+	if sha256 := r.Header.Get("X-SHA-256"); sha256 != "" && !allows(auth, sha256, false) {
+		writeError(w, errorf(http.StatusForbidden, "authorization isn't for this blob"))
+		return
+	}
+	// the content can't be sniffed yet, the declared type must do
+	if mimeType := r.Header.Get("X-Content-Type"); mimeType != "" && !slices.Contains(s.options.Types, mimeType) {
+		writeError(w, errorf(http.StatusUnsupportedMediaType, "%s blobs aren't accepted", mimeType))
+		return
+	}
+}
+
+// handleBlob serves GET, HEAD and DELETE /<sha256>[.ext] (BUD-01, BUD-02)
+func (s *Server) handleBlob(w http.ResponseWriter, r *http.Request) {
+	sha256, _, _ := strings.Cut(r.PathValue("blob"), ".")
+	if !isHash(sha256) {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		s.serveBlob(w, r, sha256)
+	case http.MethodDelete:
+		s.deleteBlob(w, r, sha256)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, DELETE")
+		writeError(w, errorf(http.StatusMethodNotAllowed, "method not allowed"))
+	}
+}
+
+func (s *Server) serveBlob(w http.ResponseWriter, r *http.Request, sha256 string) {
+	// blobs opened directly, like an SVG or an HTML file uploaded as
+	// something else, can't run scripts on the relay's origin
+	w.Header().Set("Content-Security-Policy", "sandbox; default-src 'none'")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	descriptor, err := s.get(r.Context(), sha256)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	file, err := os.Open(s.path(sha256))
+	if errors.Is(err, os.ErrNotExist) {
+		writeError(w, errorf(http.StatusNotFound, "blob not found"))
+		return
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer file.Close()
+
+	// the content of a hash never changes
+	w.Header().Set("Content-Type", descriptor.Type)
+	w.Header().Set("ETag", `"`+sha256+`"`)
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	http.ServeContent(w, r, "", descriptor.Uploaded.Time(), file)
+}
+
+func (s *Server) deleteBlob(w http.ResponseWriter, r *http.Request, sha256 string) {
+	auth, err := requireAuthorization(r, "delete")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if !allows(auth, sha256, true) {
+		writeError(w, errorf(http.StatusForbidden, "authorization isn't for this blob"))
+		return
+	}
+
+	if err := s.disown(r.Context(), sha256, auth.PubKey); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleList returns the blobs uploaded by a pubkey, newest first, GET
+// /list/<pubkey> (BUD-02)
+func (s *Server) handleList(w http.ResponseWriter, r *http.Request) {
+	pubkey := r.PathValue("pubkey")
+	if !nostr.IsValidPublicKey(pubkey) {
+		writeError(w, errorf(http.StatusBadRequest, "invalid pubkey"))
+		return
+	}
+
+	// listing is public, an authorization must still be for listing
+	if _, err := authorize(r, "list"); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	since, until := int64(0), int64(math.MaxInt64)
+	if value := r.URL.Query().Get("since"); value != "" {
+		since, _ = strconv.ParseInt(value, 10, 64)
+	}
+	if value := r.URL.Query().Get("until"); value != "" {
+		until, _ = strconv.ParseInt(value, 10, 64)
+	}
+
+	descriptors, err := s.list(r.Context(), pubkey, since, until)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	base := s.baseURL(r)
+	for i := range descriptors {
+		descriptors[i].URL = base + "/" + descriptors[i].SHA256 + extension(descriptors[i].Type)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(descriptors)
+}
+
+func isHash(s string) bool {
+	if len(s) != 64 || strings.ToLower(s) != s {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// store keeps an upload and records who uploaded it, the type and date of
+// a blob being those of its first upload
+func (s *Server) store(ctx context.Context, u *upload, mimeType string, pubkey string) (Descriptor, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.keep(u); err != nil {
+		return Descriptor{}, err
+	}
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return Descriptor{}, err
+	}
+	defer tx.Rollback()
+
+	now := nostr.Now()
+	_, err = tx.ExecContext(ctx, `
+        INSERT INTO blob (sha256, size, type, uploaded_at) VALUES (?, ?, ?, ?) ON CONFLICT (sha256) DO NOTHING
+    `, u.sha256, u.size, mimeType, now)
+	if err != nil {
+		return Descriptor{}, err
+	}
+	_, err = tx.ExecContext(ctx, `
+        INSERT INTO blob_owner (sha256, pubkey, uploaded_at) VALUES (?, ?, ?) ON CONFLICT (sha256, pubkey) DO NOTHING
+    `, u.sha256, pubkey, now)
+	if err != nil {
+		return Descriptor{}, err
+	}
+
+	descriptor := Descriptor{SHA256: u.sha256}
+	err = tx.QueryRowContext(ctx, "SELECT size, type, uploaded_at FROM blob WHERE sha256 = ?", u.sha256).
+		Scan(&descriptor.Size, &descriptor.Type, &descriptor.Uploaded)
+	if err != nil {
+		return Descriptor{}, err
+	}
+
+	return descriptor, tx.Commit()
+}
+
+func (s *Server) get(ctx context.Context, sha256 string) (Descriptor, error) {
+	descriptor := Descriptor{SHA256: sha256}
+	err := s.db.QueryRowContext(ctx, "SELECT size, type, uploaded_at FROM blob WHERE sha256 = ?", sha256).
+		Scan(&descriptor.Size, &descriptor.Type, &descriptor.Uploaded)
+	if errors.Is(err, sql.ErrNoRows) {
+		return descriptor, errorf(http.StatusNotFound, "blob not found")
+	}
+	return descriptor, err
+}
+
+// disown forgets that pubkey uploaded a blob, which is deleted once nobody
+// owns it
+func (s *Server) disown(ctx context.Context, sha256 string, pubkey string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, "DELETE FROM blob_owner WHERE sha256 = ? AND pubkey = ?", sha256, pubkey)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errorf(http.StatusNotFound, "blob not found")
+	}
+
+	var owners int
+	if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM blob_owner WHERE sha256 = ?", sha256).Scan(&owners); err != nil {
+		return err
+	}
+	if owners == 0 {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM blob WHERE sha256 = ?", sha256); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if owners == 0 {
+		return s.remove(sha256)
+	}
+	return nil
+}
+
+func (s *Server) list(ctx context.Context, pubkey string, since int64, until int64) ([]Descriptor, error) {
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT b.sha256, b.size, b.type, o.uploaded_at FROM blob_owner o JOIN blob b ON b.sha256 = o.sha256
+        WHERE o.pubkey = ? AND o.uploaded_at >= ? AND o.uploaded_at <= ?
+        ORDER BY o.uploaded_at DESC, b.sha256
+    `, pubkey, since, until)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	descriptors := make([]Descriptor, 0)
+	for rows.Next() {
+		var d Descriptor
+		if err := rows.Scan(&d.SHA256, &d.Size, &d.Type, &d.Uploaded); err != nil {
+			return nil, err
+		}
+		descriptors = append(descriptors, d)
+	}
+
+	return descriptors, rows.Err()
+}
@@ -0,0 +1,165 @@
+package blossom
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Mirror stores the blob at url for owner, who can be a pubkey or a name the
+// relay keeps blobs under, like "drive:<address>" (BUD-04). A blob that is
+// already stored isn't downloaded again, owner is only added to its owners.
+// The content must have the given hash: SVGs are never rewritten here, those
+// that aren't safe are refused unless sanitizing is off.
+func (s *Server) Mirror(ctx context.Context, url string, sha256 string, owner string) (Descriptor, error) {
+	if !isHash(sha256) {
+		return Descriptor{}, errorf(http.StatusBadRequest, "invalid sha256")
+	}
+
+	descriptor, err := s.own(ctx, sha256, owner)
+	if err == nil || !errors.Is(err, ErrNotFound) {
+		return descriptor, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return Descriptor{}, errorf(http.StatusBadRequest, "invalid url")
+	}
+	// the reason is only logged, it would tell what answers on the relay's
+	// network
+	resp, err := s.client.Do(req)
+	if err != nil {
+		log.Printf("Failed to mirror %s: %v", url, err)
+		return Descriptor{}, errorf(http.StatusBadGateway, "could not download the blob")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("Failed to mirror %s: status %d", url, resp.StatusCode)
+		return Descriptor{}, errorf(http.StatusBadGateway, "could not download the blob")
+	}
+	if resp.ContentLength > s.options.MaxSize {
+		return Descriptor{}, errorf(http.StatusRequestEntityTooLarge, "blob is larger than %d bytes", s.options.MaxSize)
+	}
+
+	u, err := s.receive(resp.Body)
+	if err != nil {
+		return Descriptor{}, err
+	}
+	defer os.Remove(u.path)
+
+	if u.sha256 != sha256 {
+		return Descriptor{}, errorf(http.StatusConflict, "%s has another hash", url)
+	}
+
+	mimeType := DetectType(resp.Header.Get("Content-Type"), u.head)
+	if !slices.Contains(s.options.Types, mimeType) {
+		return Descriptor{}, errorf(http.StatusUnsupportedMediaType, "%s blobs aren't accepted", mimeType)
+	}
+	if mimeType == "image/svg+xml" && s.options.SVG != SVGAsIs {
+		if err := s.sanitize(u, owner, true); err != nil {
+			return Descriptor{}, err
+		}
+	}
+
+	return s.store(ctx, u, mimeType, owner)
+}
+
+// Release forgets that owner keeps a blob, which is deleted once nobody does
+func (s *Server) Release(ctx context.Context, sha256 string, owner string) error {
+	var he *httpError
+	if err := s.disown(ctx, sha256, owner); errors.As(err, &he) && he.status == http.StatusNotFound {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// own adds owner to the owners of a stored blob
+func (s *Server) own(ctx context.Context, sha256 string, owner string) (Descriptor, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	descriptor, err := s.get(ctx, sha256)
+	var he *httpError
+	if errors.As(err, &he) && he.status == http.StatusNotFound {
+		return descriptor, ErrNotFound
+	}
+	if err != nil {
+		return descriptor, err
+	}
+	if _, err := os.Stat(s.path(sha256)); err != nil {
+		return descriptor, ErrNotFound
+	}
+
+	_, err = s.db.ExecContext(ctx, `
+        INSERT INTO blob_owner (sha256, pubkey, uploaded_at) VALUES (?, ?, ?) ON CONFLICT (sha256, pubkey) DO NOTHING
+    `, sha256, owner, nostr.Now())
+	return descriptor, err
+}
+
+// handleMirror stores a blob from another server, PUT /mirror (BUD-04)
+func (s *Server) handleMirror(w http.ResponseWriter, r *http.Request) {
+	auth, err := requireAuthorization(r, "upload")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if !s.canUpload(auth.PubKey) {
+		writeError(w, errorf(http.StatusForbidden, "pubkey not allowed to upload"))
+		return
+	}
+
+	var body struct {
+		URL string `json:"url"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.URL == "" {
+		writeError(w, errorf(http.StatusBadRequest, "body must be a JSON object with a url"))
+		return
+	}
+
+	// the hash is the last segment of blob URLs, the authorization must name
+	// it
+	sha256 := hashOf(body.URL)
+	if sha256 == "" {
+		if x := auth.Tags.GetAll([]string{"x", ""}); len(x) == 1 {
+			sha256 = x[0][1]
+		}
+	}
+	if sha256 == "" || !allows(auth, sha256, true) {
+		writeError(w, errorf(http.StatusForbidden, "authorization isn't for this blob"))
+		return
+	}
+
+	descriptor, err := s.Mirror(r.Context(), body.URL, sha256, auth.PubKey)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	descriptor.URL = s.baseURL(r) + "/" + descriptor.SHA256 + extension(descriptor.Type)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(descriptor)
+}
+
+// hashOf is the sha256 a blob URL ends with, "" when it doesn't
+func hashOf(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	name, _, _ := strings.Cut(path.Base(parsed.Path), ".")
+	if !isHash(name) {
+		return ""
+	}
+	return name
+}
@@ -0,0 +1,200 @@
+package blossom
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"nostr-relay/sanitize"
+)
+
+// ErrNotFound is returned by Open for blobs that aren't stored
+var ErrNotFound = errors.New("blob not found")
+
+// sniffLength is how much of a blob is looked at to tell its type
+const sniffLength = 512
+
+// upload is a blob written to a temporary file while being hashed
+type upload struct {
+	path   string
+	sha256 string
+	size   int64
+	head   []byte
+}
+
+// path is where a blob is stored, spread over directories named after the
+// start of its hash
+func (s *Server) path(sha256 string) string {
+	return filepath.Join(s.options.Dir, sha256[:2], sha256[2:4], sha256)
+}
+
+// receive writes body to a temporary file, failing when it's larger than
+// MaxSize
+func (s *Server) receive(body io.Reader) (*upload, error) {
+	tmp, err := os.CreateTemp(s.options.Dir, "upload-*")
+	if err != nil {
+		return nil, err
+	}
+	defer tmp.Close()
+
+	u := &upload{path: tmp.Name()}
+	hash := sha256.New()
+	head := &prefix{limit: sniffLength}
+
+	// one more byte than allowed tells it's too large
+	n, err := io.Copy(io.MultiWriter(tmp, hash, head), io.LimitReader(body, s.options.MaxSize+1))
+	if err == nil && n > s.options.MaxSize {
+		err = errorf(http.StatusRequestEntityTooLarge, "blob is larger than %d bytes", s.options.MaxSize)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		os.Remove(u.path)
+		return nil, err
+	}
+
+	u.sha256 = hex.EncodeToString(hash.Sum(nil))
+	u.size = n
+	u.head = head.Bytes()
+	return u, nil
+}
+
+// sanitize rewrites an uploaded SVG without what could run scripts or load
+// something, or refuses it in strict mode. The upload is then the blob that
+// will be stored, with its own hash.
+func (s *Server) sanitize(u *upload, pubkey string, strict bool) error {
+	data, err := os.ReadFile(u.path)
+	if err != nil {
+		return err
+	}
+
+	clean, report, err := sanitize.SVG(data, strict)
+	if errors.Is(err, sanitize.ErrInvalid) || errors.Is(err, sanitize.ErrUnsafe) {
+		return errorf(http.StatusBadRequest, "%v", err)
+	}
+	if err != nil {
+		return err
+	}
+	if report.Clean() {
+		return nil
+	}
+
+	log.Printf("Sanitized SVG %s uploaded by %s: %s", u.sha256, pubkey, report)
+	if err := os.WriteFile(u.path, clean, 0o644); err != nil {
+		return err
+	}
+
+	hash := sha256.Sum256(clean)
+	u.sha256 = hex.EncodeToString(hash[:])
+	u.size = int64(len(clean))
+	u.head = clean[:min(len(clean), sniffLength)]
+	return nil
+}
+
+// keep moves an upload to where its blob is stored, unless it's already
+// there
+func (s *Server) keep(u *upload) error {
+	path := s.path(u.sha256)
+	if _, err := os.Stat(path); err == nil {
+		return os.Remove(u.path)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.Rename(u.path, path)
+}
+
+// Open reads a stored blob, failing with ErrNotFound when there is none
+func (s *Server) Open(ctx context.Context, sha256 string) (io.ReadCloser, error) {
+	if !isHash(sha256) {
+		return nil, ErrNotFound
+	}
+
+	var he *httpError
+	if _, err := s.get(ctx, sha256); errors.As(err, &he) && he.status == http.StatusNotFound {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(s.path(sha256))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return file, err
+}
+
+// remove deletes a stored blob, it being gone already is fine
+func (s *Server) remove(sha256 string) error {
+	err := os.Remove(s.path(sha256))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// prefix keeps the first bytes written to it
+type prefix struct {
+	bytes.Buffer
+	limit int
+}
+
+func (p *prefix) Write(b []byte) (int, error) {
+	if room := p.limit - p.Len(); room > 0 {
+		p.Buffer.Write(b[:min(room, len(b))])
+	}
+	return len(b), nil
+}
+
+// DetectType tells the MIME type of a blob from its first bytes, the type
+// declared by the uploader is only trusted for SVG, which can't be sniffed
+// from a prefix, and when the content says nothing
+func DetectType(declared string, head []byte) string {
+	declared, _, _ = mime.ParseMediaType(declared)
+
+	sniffed, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	switch {
+	case declared == "image/svg+xml" && isMarkup(sniffed) && bytes.Contains(head, []byte("<svg")):
+		return declared
+	case sniffed == "text/xml" && bytes.Contains(head, []byte("<svg")):
+		return "image/svg+xml"
+	case sniffed != "application/octet-stream":
+		return sniffed
+	case declared != "":
+		return declared
+	default:
+		return sniffed
+	}
+}
+
+func isMarkup(sniffed string) bool {
+	return sniffed == "text/xml" || sniffed == "text/plain" || sniffed == "text/html"
+}
+
+// extension is what blob URLs end with for a type
+func extension(mimeType string) string {
+	switch mimeType {
+	case "image/svg+xml":
+		return ".svg"
+	case "image/jpeg":
+		return ".jpg"
+	case "font/woff2", "font/woff", "font/ttf", "font/otf":
+		return "." + strings.TrimPrefix(mimeType, "font/")
+	}
+
+	if extensions, _ := mime.ExtensionsByType(mimeType); len(extensions) > 0 {
+		return extensions[0]
+	}
+	return ""
+}
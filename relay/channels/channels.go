@@ -0,0 +1,223 @@
+package channels
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+
+	"nostr-relay/kinds"
+
+	"github.com/fiatjaf/eventstore/sqlite3"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+var ddls = []string{
+	`CREATE TABLE IF NOT EXISTS channel (
+       id text PRIMARY KEY,
+       owner text NOT NULL,
+       name text NOT NULL,
+       about text NOT NULL,
+       picture text NOT NULL,
+       relays text NOT NULL,
+       created_at integer NOT NULL,
+       updated_at integer NOT NULL,
+       messages integer NOT NULL DEFAULT 0,
+       last_message_at integer NOT NULL DEFAULT 0,
+       message_expiration integer NOT NULL DEFAULT 0,
+       moderators text NOT NULL DEFAULT '[]',
+       retention_max_age integer NOT NULL DEFAULT 0,
+       retention_max_messages integer NOT NULL DEFAULT 0);`,
+	`CREATE INDEX IF NOT EXISTS channelcreatedidx ON channel(created_at DESC)`,
+}
+
+// migrations add the columns missing from tables created by older versions,
+// the channel state is then rebuilt to fill them
+var migrations = []struct{ column, ddl string }{
+	{"message_expiration", `ALTER TABLE channel ADD COLUMN message_expiration integer NOT NULL DEFAULT 0`},
+	{"moderators", `ALTER TABLE channel ADD COLUMN moderators text NOT NULL DEFAULT '[]'`},
+	{"retention_max_age", `ALTER TABLE channel ADD COLUMN retention_max_age integer NOT NULL DEFAULT 0`},
+	{"retention_max_messages", `ALTER TABLE channel ADD COLUMN retention_max_messages integer NOT NULL DEFAULT 0`},
+}
+
+var ErrNotFound = errors.New("channel not found")
+
+// Channel is the current state of a channel: its creation event, the latest
+// metadata published by the owner and some message statistics.
+type Channel struct {
+	ID            string          `json:"id"`
+	Owner         string          `json:"owner"`
+	Name          string          `json:"name"`
+	About         string          `json:"about"`
+	Picture       string          `json:"picture"`
+	Relays        []string        `json:"relays"`
+	CreatedAt     nostr.Timestamp `json:"created_at"`
+	UpdatedAt     nostr.Timestamp `json:"updated_at"`
+	Messages      int64           `json:"messages"`
+	LastMessageAt nostr.Timestamp `json:"last_message_at"`
+
+	// MessageExpiration is the default NIP-40 expiration of messages, in
+	// seconds, 0 when they don't expire
+	MessageExpiration int64 `json:"message_expiration"`
+
+	// Moderators can delete messages, besides the owner
+	Moderators []string `json:"moderators"`
+
+	// RetentionMaxAge (seconds) and RetentionMaxMessages are the retention
+	// asked by the owner, 0 when not set
+	RetentionMaxAge      int64 `json:"retention_max_age"`
+	RetentionMaxMessages int64 `json:"retention_max_messages"`
+}
+
+// CanModerate tells if pubkey can delete messages of the channel
+func (c *Channel) CanModerate(pubkey string) bool {
+	return pubkey == c.Owner || slices.Contains(c.Moderators, pubkey)
+}
+
+// Store keeps the channel table, which is derived from the kind 40, 41, 42
+// and 7353 events and can always be rebuilt from them.
+type Store struct {
+	db *sqlite3.SQLite3Backend
+}
+
+func New(db *sqlite3.SQLite3Backend) (*Store, error) {
+	for _, ddl := range ddls {
+		if _, err := db.Exec(ddl); err != nil {
+			return nil, fmt.Errorf("failed to create channel tables: %w", err)
+		}
+	}
+
+	s := &Store{db: db}
+
+	migrated := false
+	for _, migration := range migrations {
+		var count int
+		err := db.Get(&count, "SELECT COUNT(*) FROM pragma_table_info('channel') WHERE name = $1", migration.column)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check channel table: %w", err)
+		}
+		if count > 0 {
+			continue
+		}
+
+		if _, err := db.Exec(migration.ddl); err != nil {
+			return nil, fmt.Errorf("failed to migrate channel table: %w", err)
+		}
+		migrated = true
+	}
+
+	if migrated {
+		count, err := s.Rebuild(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Channel table migrated, rebuilt state of %d channels", count)
+	}
+
+	return s, nil
+}
+
+// EventSaved is meant to be added to relay.OnEventSaved
+func (s *Store) EventSaved(ctx context.Context, event *nostr.Event) {
+	if err := s.apply(ctx, s.db.DB, event); err != nil {
+		// the table can be fixed later with a reindex, don't fail the event
+		log.Printf("Failed to update channel state for %s: %v", event.ID, err)
+	}
+}
+
+// EventDeleted is meant to be added to relay.DeleteEvent
+func (s *Store) EventDeleted(ctx context.Context, event *nostr.Event) error {
+	switch {
+	case event.Kind == 40:
+		_, err := s.db.ExecContext(ctx, "DELETE FROM channel WHERE id = $1", event.ID)
+		return err
+	case event.Kind == 41:
+		// the previous metadata has to be found again
+		return s.RebuildChannel(ctx, kinds.ChannelID(event))
+	case kinds.IsChannelMessage(event):
+		_, err := s.db.ExecContext(ctx, `
+            UPDATE channel SET messages = MAX(messages - 1, 0) WHERE id = $1
+        `, kinds.ChannelID(event))
+		return err
+	}
+
+	return nil
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+func (s *Store) apply(ctx context.Context, db execer, event *nostr.Event) error {
+	switch {
+	case event.Kind == 40:
+		metadata := parseMetadata(event.Content)
+		relays, _ := json.Marshal(metadata.Relays)
+		moderators, _ := json.Marshal(metadata.Moderators)
+		_, err := db.ExecContext(ctx, `
+            INSERT INTO channel (id, owner, name, about, picture, relays, created_at, updated_at,
+              message_expiration, moderators, retention_max_age, retention_max_messages)
+            VALUES ($1, $2, $3, $4, $5, $6, $7, $7, $8, $9, $10, $11)
+            ON CONFLICT (id) DO UPDATE SET created_at = excluded.created_at
+        `, event.ID, event.PubKey, metadata.Name, metadata.About, metadata.Picture, relays, event.CreatedAt,
+			metadata.MessageExpiration, moderators, metadata.RetentionMaxAge, metadata.RetentionMaxMessages)
+		return err
+
+	case event.Kind == 41:
+		channelID := kinds.ChannelID(event)
+		if channelID == "" {
+			return nil
+		}
+
+		// the creation event may live on another relay, the kind 41 validation
+		// already made sure its author owns the channel
+		metadata := parseMetadata(event.Content)
+		relays, _ := json.Marshal(metadata.Relays)
+		moderators, _ := json.Marshal(metadata.Moderators)
+		_, err := db.ExecContext(ctx, `
+            INSERT INTO channel (id, owner, name, about, picture, relays, created_at, updated_at,
+              message_expiration, moderators, retention_max_age, retention_max_messages)
+            VALUES ($1, $2, $3, $4, $5, $6, $7, $7, $8, $9, $10, $11)
+            ON CONFLICT (id) DO UPDATE SET
+              name = excluded.name,
+              about = excluded.about,
+              picture = excluded.picture,
+              relays = excluded.relays,
+              updated_at = excluded.updated_at,
+              message_expiration = excluded.message_expiration,
+              moderators = excluded.moderators,
+              retention_max_age = excluded.retention_max_age,
+              retention_max_messages = excluded.retention_max_messages
+            WHERE channel.owner = excluded.owner AND channel.updated_at <= excluded.updated_at
+        `, channelID, event.PubKey, metadata.Name, metadata.About, metadata.Picture, relays, event.CreatedAt,
+			metadata.MessageExpiration, moderators, metadata.RetentionMaxAge, metadata.RetentionMaxMessages)
+		return err
+
+	case kinds.IsChannelMessage(event):
+		_, err := db.ExecContext(ctx, `
+            UPDATE channel SET
+              messages = messages + 1,
+              last_message_at = MAX(last_message_at, $1)
+            WHERE id = $2
+        `, event.CreatedAt, kinds.ChannelID(event))
+		return err
+	}
+
+	return nil
+}
+
+func parseMetadata(content string) kinds.Channel {
+	metadata := kinds.Channel{}
+	json.Unmarshal([]byte(content), &metadata)
+	if metadata.Relays == nil {
+		metadata.Relays = []string{}
+	}
+	if metadata.Moderators == nil {
+		metadata.Moderators = []string{}
+	}
+
+	return metadata
+}
@@ -0,0 +1,69 @@
+package channels
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const channelColumns = `id, owner, name, about, picture, relays, created_at, updated_at, messages, last_message_at,
+  message_expiration, moderators, retention_max_age, retention_max_messages`
+
+// Get returns the current state of a channel or ErrNotFound
+func (s *Store) Get(ctx context.Context, id string) (*Channel, error) {
+	rows, err := s.db.QueryxContext(ctx, "SELECT "+channelColumns+" FROM channel WHERE id = $1", id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get channel: %w", err)
+	}
+
+	channels, err := scanChannels(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(channels) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return &channels[0], nil
+}
+
+// List returns the most recently created channels, all of them when limit
+// is negative
+func (s *Store) List(ctx context.Context, limit int) ([]Channel, error) {
+	rows, err := s.db.QueryxContext(ctx, "SELECT "+channelColumns+" FROM channel ORDER BY created_at DESC LIMIT $1", limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list channels: %w", err)
+	}
+
+	return scanChannels(rows)
+}
+
+func scanChannels(rows *sqlx.Rows) ([]Channel, error) {
+	defer rows.Close()
+
+	channels := make([]Channel, 0)
+	for rows.Next() {
+		var channel Channel
+		var relays, moderators string
+		err := rows.Scan(&channel.ID, &channel.Owner, &channel.Name, &channel.About, &channel.Picture,
+			&relays, &channel.CreatedAt, &channel.UpdatedAt, &channel.Messages, &channel.LastMessageAt,
+			&channel.MessageExpiration, &moderators, &channel.RetentionMaxAge, &channel.RetentionMaxMessages)
+		if err != nil {
+			return nil, err
+		}
+		json.Unmarshal([]byte(relays), &channel.Relays)
+		json.Unmarshal([]byte(moderators), &channel.Moderators)
+
+		channels = append(channels, channel)
+	}
+
+	if err := rows.Err(); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	return channels, nil
+}
@@ -0,0 +1,116 @@
+package channels
+
+import (
+	"context"
+	"fmt"
+
+	"nostr-relay/kinds"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// countMessages sets the message statistics from the stored kind 42 and 7353
+// events, for every channel or just for the channel passed as argument. A
+// message counts in its own channel only, not in the ones it mentions.
+const countMessages = `
+    WITH counts AS (
+      SELECT ` + kinds.ChannelIDSQL + ` AS channel, COUNT(*) AS n, MAX(e.created_at) AS last
+      FROM event e
+      WHERE e.kind IN (42, 7353)
+      GROUP BY channel
+    )
+    UPDATE channel SET messages = counts.n, last_message_at = counts.last
+    FROM counts WHERE counts.channel = channel.id`
+
+// Rebuild recreates the whole channel table from the stored events
+func (s *Store) Rebuild(ctx context.Context) (int, error) {
+	events, err := s.loadEvents(ctx, "SELECT id, pubkey, created_at, kind, tags, content, sig FROM event WHERE kind IN (40, 41) ORDER BY kind, created_at")
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM channel"); err != nil {
+		return 0, fmt.Errorf("failed to clear channels: %w", err)
+	}
+
+	for _, event := range events {
+		if err := s.apply(ctx, tx, event); err != nil {
+			return 0, fmt.Errorf("failed to apply %s: %w", event.ID, err)
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, countMessages); err != nil {
+		return 0, fmt.Errorf("failed to count messages: %w", err)
+	}
+
+	var total int
+	if err := tx.GetContext(ctx, &total, "SELECT COUNT(*) FROM channel"); err != nil {
+		return 0, err
+	}
+
+	return total, tx.Commit()
+}
+
+// RebuildChannel recreates the state of a single channel
+func (s *Store) RebuildChannel(ctx context.Context, id string) error {
+	events, err := s.loadEvents(ctx, `
+        SELECT id, pubkey, created_at, kind, tags, content, sig FROM event
+        WHERE (kind = 40 AND id = $1) OR (kind = 41 AND tags LIKE '%' || $1 || '%')
+        ORDER BY kind, created_at
+    `, id)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM channel WHERE id = $1", id); err != nil {
+		return err
+	}
+
+	for _, event := range events {
+		if event.Kind == 41 && kinds.ChannelID(event) != id {
+			continue
+		}
+		if err := s.apply(ctx, tx, event); err != nil {
+			return fmt.Errorf("failed to apply %s: %w", event.ID, err)
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, countMessages+" AND channel.id = $1", id); err != nil {
+		return fmt.Errorf("failed to count messages: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+func (s *Store) loadEvents(ctx context.Context, query string, args ...any) ([]*nostr.Event, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load channel events: %w", err)
+	}
+	defer rows.Close()
+
+	events := make([]*nostr.Event, 0)
+	for rows.Next() {
+		var event nostr.Event
+		var createdAt int64
+		if err := rows.Scan(&event.ID, &event.PubKey, &createdAt, &event.Kind, &event.Tags, &event.Content, &event.Sig); err != nil {
+			return nil, err
+		}
+		event.CreatedAt = nostr.Timestamp(createdAt)
+		events = append(events, &event)
+	}
+
+	return events, rows.Err()
+}
@@ -0,0 +1,23 @@
+package channels
+
+import (
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// RelayURL normalizes a relay declared by a channel, http ones being turned
+// into their websocket equivalent, or returns "" when it isn't one
+func RelayURL(url string) string {
+	url = strings.TrimSpace(url)
+	switch {
+	case strings.HasPrefix(url, "https://"):
+		url = "wss://" + strings.TrimPrefix(url, "https://")
+	case strings.HasPrefix(url, "http://"):
+		url = "ws://" + strings.TrimPrefix(url, "http://")
+	case !strings.HasPrefix(url, "wss://") && !strings.HasPrefix(url, "ws://"):
+		return ""
+	}
+
+	return nostr.NormalizeURL(url)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"nostr-relay/config"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func runCheck(cfg config.Config, args []string) error {
+	flags := newFlagSet("check", "", &cfg)
+	deleteInvalid := flags.Bool("delete", false, "delete events with an invalid id or signature")
+	flags.Parse(args)
+
+	db, err := openDatabase(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	problems := 0
+
+	log.Printf("Running SQLite integrity check...")
+	results := make([]string, 0)
+	if err := db.SelectContext(ctx, &results, "PRAGMA integrity_check"); err != nil {
+		return err
+	}
+	for _, result := range results {
+		if result != "ok" {
+			log.Printf("Integrity problem: %s", result)
+			problems++
+		}
+	}
+
+	log.Printf("Verifying event ids and signatures...")
+	rows, err := db.QueryContext(ctx, "SELECT id, pubkey, created_at, kind, tags, content, sig FROM event")
+	if err != nil {
+		return err
+	}
+
+	invalid := make([]string, 0)
+	checked := 0
+	for rows.Next() {
+		var event nostr.Event
+		var createdAt int64
+		if err := rows.Scan(&event.ID, &event.PubKey, &createdAt, &event.Kind, &event.Tags, &event.Content, &event.Sig); err != nil {
+			log.Printf("Unreadable event row: %v", err)
+			problems++
+			continue
+		}
+		event.CreatedAt = nostr.Timestamp(createdAt)
+		checked++
+
+		if !event.CheckID() {
+			log.Printf("Event %s (kind %d): id doesn't match its content", event.ID, event.Kind)
+			invalid = append(invalid, event.ID)
+		} else if ok, _ := event.CheckSignature(); !ok {
+			log.Printf("Event %s (kind %d): invalid signature", event.ID, event.Kind)
+			invalid = append(invalid, event.ID)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	log.Printf("Checked %d events, %d invalid", checked, len(invalid))
+
+	if *deleteInvalid {
+		for _, id := range invalid {
+			if _, err := db.ExecContext(ctx, "DELETE FROM event WHERE id = $1", id); err != nil {
+				return err
+			}
+		}
+		log.Printf("Deleted %d invalid events, run reindex to refresh derived tables", len(invalid))
+	} else {
+		problems += len(invalid)
+	}
+
+	if problems > 0 {
+		return fmt.Errorf("found %d problems", problems)
+	}
+
+	log.Printf("No problems found")
+	return nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"nostr-relay/blossom"
+	"nostr-relay/comic"
+	"nostr-relay/config"
+	"nostr-relay/drives"
+	"nostr-relay/transcript"
+)
+
+// localStore is the local Blossom store blobs are read from first, nil
+// when there is none
+func localStore(blobs *blossom.Server) drives.Store {
+	if blobs == nil {
+		return nil
+	}
+	return blobs
+}
+
+// newExporter draws transcripts with the blobs of the local Blossom store,
+// when there is one, before asking the servers of drives
+func newExporter(cfg config.Config, query drives.QueryFunc, blobs *blossom.Server, options transcript.Options) *transcript.Exporter {
+	if options.MaxMessages <= 0 {
+		options.MaxMessages = cfg.ComicExportMaxMessages
+	}
+	options.MaxSize = int64(cfg.BlossomMaxSize)
+	return transcript.New(query, localStore(blobs), options)
+}
+
+func runComic(cfg config.Config, args []string) error {
+	flags := newFlagSet("comic", "", &cfg)
+	channel := flags.String("channel", "", "id of the channel to export (required)")
+	since := flags.String("since", "", "only messages created at or after (unix, RFC3339 or 2006-01-02)")
+	until := flags.String("until", "", "only messages created at or before (unix, RFC3339 or 2006-01-02)")
+	limit := flags.Int("limit", 0, "maximum number of messages, the latest ones (default RELAY_COMIC_EXPORT_MAX_MESSAGES)")
+	format := flags.String("format", "html", "svg, html, pdf, png or webp")
+	output := flags.String("o", "-", "output file, - for stdout; a directory for svg, png and webp, which are zipped to stdout")
+	width := flags.Int("width", 0, "panel width in pixels (default 480)")
+	height := flags.Int("height", 0, "panel height in pixels (default 360)")
+	size := flags.Int("size", 0, "longest side of png and webp pages in pixels (default the panel size)")
+	flags.Parse(args)
+
+	if *channel == "" {
+		flags.Usage()
+		return fmt.Errorf("-channel is required")
+	}
+	if !slices.Contains(transcript.Formats, *format) {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	var rng transcript.Range
+	var err error
+	if rng.Since, err = parseTimestamp(*since); err != nil {
+		return err
+	}
+	if rng.Until, err = parseTimestamp(*until); err != nil {
+		return err
+	}
+
+	db, err := openDatabase(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var blobs *blossom.Server
+	if cfg.Blossom {
+		if blobs, err = blossom.New(db, blossom.Options{Dir: cfg.BlossomDir}); err != nil {
+			return err
+		}
+	}
+	exporter := newExporter(cfg, db.QueryEvents, blobs, transcript.Options{
+		MaxMessages: *limit,
+		Comic:       comic.Options{Width: *width, Height: *height},
+	})
+
+	t, err := exporter.Load(context.Background(), *channel, rng)
+	if err != nil {
+		return err
+	}
+
+	images := *format == "png" || *format == "webp"
+	if (*format == "svg" || images) && *output != "-" {
+		if err := os.MkdirAll(*output, 0o755); err != nil {
+			return err
+		}
+		files := t.Files()
+		if images {
+			if files, err = t.Images(*format, *size); err != nil {
+				return err
+			}
+		}
+		for _, file := range files {
+			if err := os.WriteFile(filepath.Join(*output, file.Name), file.Data, 0o644); err != nil {
+				return err
+			}
+		}
+		log.Printf("Exported %d messages as %d panels to %s", len(t.Messages), len(t.Panels), *output)
+		return nil
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "-" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+
+	buffered := bufio.NewWriter(w)
+	if images {
+		err = t.WriteImages(buffered, *format, *size)
+	} else {
+		err = t.Write(buffered, *format)
+	}
+	if err != nil {
+		return err
+	}
+	if err := buffered.Flush(); err != nil {
+		return err
+	}
+
+	log.Printf("Exported %d messages as %d panels", len(t.Messages), len(t.Panels))
+	return nil
+}
@@ -0,0 +1,319 @@
+package comic
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"nostr-relay/blossom"
+	"nostr-relay/drives"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Asset is the content of a file of a drive
+type Asset struct {
+	SHA256 string
+	Type   string
+	Data   []byte
+}
+
+// Assets finds the files messages are drawn with
+type Assets interface {
+	// Character is the art of a character with an emotion, or with its
+	// default one when the emotion is "" or unknown
+	Character(drive string, character string, emotion string) (Asset, bool)
+
+	// Font is a font file of a drive
+	Font(drive string, path string) (Asset, bool)
+}
+
+// Library has the drives of a transcript and the blobs they list, loaded
+// once so rendering doesn't depend on what servers answer meanwhile
+type Library struct {
+	drives map[string]drives.Drive
+	blobs  map[string]Asset
+}
+
+// Character finds the file "<character>/<emotion>" of a drive. The default
+// emotion is the first file of the character in the drive other than its
+// profile picture.
+func (l *Library) Character(drive string, character string, emotion string) (Asset, bool) {
+	d, ok := l.drives[drive]
+	if !ok || character == "" {
+		return Asset{}, false
+	}
+
+	if emotion != "" {
+		if asset, ok := l.file(d, character+"/"+emotion); ok {
+			return asset, true
+		}
+	}
+	for _, blob := range d.Blobs {
+		p := normalizePath(blob.Path)
+		if path.Dir(p) == character && path.Base(p) != "profile" {
+			if asset, ok := l.blobs[blob.SHA256]; ok {
+				return asset, true
+			}
+		}
+	}
+	return Asset{}, false
+}
+
+func (l *Library) Font(drive string, path string) (Asset, bool) {
+	d, ok := l.drives[drive]
+	if !ok || path == "" {
+		return Asset{}, false
+	}
+	return l.file(d, path)
+}
+
+func (l *Library) file(d drives.Drive, p string) (Asset, bool) {
+	for _, blob := range d.Blobs {
+		if normalizePath(blob.Path) == p {
+			asset, ok := l.blobs[blob.SHA256]
+			return asset, ok
+		}
+	}
+	return Asset{}, false
+}
+
+// Loader fetches the drives of messages and their blobs, from the local
+// Blossom store first and then from the servers of each drive
+type Loader struct {
+	Query drives.QueryFunc
+
+	// Store is the local Blossom store, nil when there is none
+	Store drives.Store
+
+	// MaxSize is the largest blob downloaded, 10MB when 0
+	MaxSize int64
+
+	// Client downloads the blobs of drives and backgrounds, nil for one
+	// that only connects to public addresses: the servers are chosen by
+	// whoever publishes the drive or the channel
+	Client *http.Client
+
+	// client is made on the first download, loaders being shared by
+	// concurrent requests
+	client     *http.Client
+	clientOnce sync.Once
+}
+
+// Load resolves every drive the messages refer to into a Library. Drives
+// that aren't stored and blobs that can't be found are left out, messages
+// using them are drawn with a default character and font.
+func (l *Loader) Load(ctx context.Context, messages []Message) (*Library, error) {
+	library := &Library{drives: make(map[string]drives.Drive), blobs: make(map[string]Asset)}
+
+	addresses := make([]string, 0)
+	for _, m := range messages {
+		if m.Drive != "" && !slices.Contains(addresses, m.Drive) {
+			addresses = append(addresses, m.Drive)
+		}
+	}
+
+	for _, address := range addresses {
+		drive, err := l.drive(ctx, address)
+		if err != nil {
+			return nil, err
+		}
+		if drive == nil {
+			continue
+		}
+		library.drives[address] = *drive
+
+		servers, err := drives.Servers(ctx, l.Query, *drive)
+		if err != nil {
+			return nil, err
+		}
+		for _, blob := range drive.Blobs {
+			if _, ok := library.blobs[blob.SHA256]; ok || !used(blob.Path) {
+				continue
+			}
+			if data, err := l.blob(ctx, blob.SHA256, servers); err == nil {
+				library.blobs[blob.SHA256] = Asset{SHA256: blob.SHA256, Type: blossom.DetectType(blob.Type, data), Data: data}
+			} else if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+		}
+	}
+
+	return library, nil
+}
+
+// File loads the file at path in the current version of a drive, failing
+// with blossom.ErrNotFound when the drive, the file or its blob can't be
+// found
+func (l *Loader) File(ctx context.Context, address string, p string) (Asset, error) {
+	drive, err := l.drive(ctx, address)
+	if err != nil {
+		return Asset{}, err
+	}
+	if drive == nil {
+		return Asset{}, blossom.ErrNotFound
+	}
+
+	p = normalizePath(p)
+	for _, blob := range drive.Blobs {
+		if normalizePath(blob.Path) != p {
+			continue
+		}
+		servers, err := drives.Servers(ctx, l.Query, *drive)
+		if err != nil {
+			return Asset{}, err
+		}
+		data, err := l.blob(ctx, blob.SHA256, servers)
+		if err != nil {
+			return Asset{}, err
+		}
+		return Asset{SHA256: blob.SHA256, Type: blossom.DetectType(blob.Type, data), Data: data}, nil
+	}
+	return Asset{}, blossom.ErrNotFound
+}
+
+// used tells if a file of a drive can be drawn, which profile pictures
+// aren't
+func used(p string) bool {
+	p = normalizePath(p)
+	return (strings.HasPrefix(p, "characters/") || strings.HasPrefix(p, "fonts/")) && path.Base(p) != "profile"
+}
+
+// drive loads the current version of a drive, nil when it isn't stored
+func (l *Loader) drive(ctx context.Context, address string) (*drives.Drive, error) {
+	parts := strings.SplitN(address, ":", 3)
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid drive address %s", address)
+	}
+
+	ch, err := l.Query(ctx, nostr.Filter{Kinds: []int{drives.Kind}, Authors: []string{parts[1]}, Tags: nostr.TagMap{"d": {parts[2]}}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load drive %s: %w", address, err)
+	}
+	var latest *nostr.Event
+	for event := range ch {
+		// the store matches tag values loosely
+		if event.Tags.GetD() != parts[2] {
+			continue
+		}
+		if latest == nil || event.CreatedAt > latest.CreatedAt {
+			latest = event
+		}
+	}
+	if latest == nil {
+		return nil, nil
+	}
+
+	drive := drives.Parse(latest)
+	return &drive, nil
+}
+
+// blob reads a blob with the right hash, locally or from the first server
+// that has it
+func (l *Loader) blob(ctx context.Context, hash string, servers []string) ([]byte, error) {
+	if l.Store != nil {
+		r, err := l.Store.Open(ctx, hash)
+		if err == nil {
+			data, err := io.ReadAll(io.LimitReader(r, l.maxSize()+1))
+			r.Close()
+			if err == nil && sum(data) == hash {
+				return data, nil
+			}
+		} else if !errors.Is(err, blossom.ErrNotFound) {
+			return nil, err
+		}
+	}
+
+	for _, server := range servers {
+		data, _, err := l.download(ctx, server+"/"+hash)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err == nil && sum(data) == hash {
+			return data, nil
+		}
+	}
+
+	return nil, blossom.ErrNotFound
+}
+
+// download gets a file of at most MaxSize bytes and its declared type
+func (l *Loader) download(ctx context.Context, url string) ([]byte, string, error) {
+	l.clientOnce.Do(func() {
+		l.client = l.Client
+		if l.client == nil {
+			l.client = blossom.PublicClient(30 * time.Second)
+		}
+	})
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, l.maxSize()+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(len(data)) > l.maxSize() {
+		return nil, "", fmt.Errorf("larger than %d bytes", l.maxSize())
+	}
+	return data, resp.Header.Get("Content-Type"), nil
+}
+
+func (l *Loader) maxSize() int64 {
+	if l.MaxSize <= 0 {
+		return 10 << 20
+	}
+	return l.MaxSize
+}
+
+func sum(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+// Background loads the image at url, a channel background. Blossom URLs,
+// which end with the hash of the blob, are read from the local store first.
+func (l *Loader) Background(ctx context.Context, rawURL string) (Asset, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") {
+		return Asset{}, fmt.Errorf("invalid background url %q", rawURL)
+	}
+
+	hash, _, _ := strings.Cut(path.Base(parsed.Path), ".")
+	if len(hash) == 64 && strings.ToLower(hash) == hash {
+		if _, err := hex.DecodeString(hash); err == nil {
+			server := parsed.Scheme + "://" + parsed.Host + strings.TrimSuffix(path.Dir(parsed.Path), "/")
+			data, err := l.blob(ctx, hash, []string{server})
+			if err != nil {
+				return Asset{}, err
+			}
+			return Asset{SHA256: hash, Type: blossom.DetectType("", data), Data: data}, nil
+		}
+	}
+
+	data, mimeType, err := l.download(ctx, rawURL)
+	if err != nil {
+		return Asset{}, err
+	}
+	return Asset{SHA256: sum(data), Type: blossom.DetectType(mimeType, data), Data: data}, nil
+}
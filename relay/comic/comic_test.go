@@ -0,0 +1,222 @@
+package comic
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"nostr-relay/blossom"
+	"nostr-relay/drives"
+	"nostr-relay/internal/testutil"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// assets is a drive in memory, by character/emotion and font path
+type assets map[string]Asset
+
+func (a assets) Character(drive string, character string, emotion string) (Asset, bool) {
+	asset, ok := a[character+"/"+emotion]
+	return asset, ok
+}
+
+func (a assets) Font(drive string, path string) (Asset, bool) {
+	asset, ok := a[path]
+	return asset, ok
+}
+
+func message(pubkey string, content string, tags ...nostr.Tag) Message {
+	return ParseMessage(&nostr.Event{Kind: 7353, PubKey: pubkey, Content: content, Tags: tags})
+}
+
+func TestParseMessage(t *testing.T) {
+	pubkey := strings.Repeat("a", 64)
+	m := message(pubkey, "Hello dhalsim, <bold>welcome</bold> to <c1>chat</c1>",
+		nostr.Tag{"drive", "my-comic-characters"},
+		nostr.Tag{"character", "/characters/char1"},
+		nostr.Tag{"emotion", "emotion-a.svg"},
+		nostr.Tag{"font", "/fonts/font-a/bold.woff2"},
+		nostr.Tag{"color", "c1", "#76b5c5"},
+		nostr.Tag{"color", "c2", "red;stroke:url(x)"})
+
+	if m.Drive != "30563:"+pubkey+":my-comic-characters" || m.Character != "characters/char1" || m.Emotion != "emotion-a" ||
+		m.Font != "fonts/font-a/bold" {
+		t.Errorf("message: %+v", m)
+	}
+	if len(m.Colors) != 1 || m.Colors["c1"] != "#76b5c5" {
+		t.Errorf("colors, only hex ones: %v", m.Colors)
+	}
+	if len(m.Runs) != 4 {
+		t.Errorf("runs: %+v", m.Runs)
+	}
+}
+
+func TestRender(t *testing.T) {
+	alice, bob, carol := strings.Repeat("a", 64), strings.Repeat("b", 64), strings.Repeat("c", 64)
+	art := func(fill string) Asset {
+		return Asset{SHA256: fill, Type: "image/svg+xml", Data: []byte(`<svg xmlns="http://www.w3.org/2000/svg"><circle r="4" fill="` + fill + `"/></svg>`)}
+	}
+	library := assets{
+		"characters/robo/happy": art("#ff0"),
+		"characters/robo/":      art("#00f"),
+		"fonts/roboto":          {SHA256: "font", Type: "font/woff2", Data: []byte("wOF2")},
+		"fonts/roboto-bold":     {SHA256: "bold", Type: "font/ttf", Data: []byte("\x00\x01\x00\x00")},
+	}
+	background := &Asset{Type: "image/png", Data: []byte("\x89PNG")}
+
+	robo := []nostr.Tag{{"character", "/characters/robo"}, {"font", "fonts/roboto"}}
+	messages := []Message{
+		message(alice, "Hi <bold>Bob</bold> & <c1>all</c1>", append(robo, nostr.Tag{"emotion", "happy"}, nostr.Tag{"color", "c1", "#76b5c5"})...),
+		message(alice, "How are you?", robo...),
+		message(bob, "Hello!"),
+		message(carol, "Fine"),
+		message(bob, "Bye", nostr.Tag{"p", carol}),
+	}
+
+	panels := Render(messages, library, background, Options{})
+	if len(panels) != 2 || len(panels[0].Messages) != 4 || len(panels[1].Messages) != 1 {
+		t.Fatalf("panels: %d", len(panels))
+	}
+	again := Render(messages, library, background, Options{})
+	for i := range panels {
+		if !bytes.Equal(panels[i].SVG, again[i].SVG) {
+			t.Errorf("panel %d renders differently", i)
+		}
+	}
+
+	svg := string(panels[0].SVG)
+	if err := xml.Unmarshal(panels[0].SVG, new(struct{})); err != nil {
+		t.Errorf("invalid XML: %v", err)
+	}
+	for _, want := range []string{
+		`<tspan font-weight="bold">Bob</tspan> &amp; <tspan fill="#76b5c5">all</tspan>`,
+		`@font-face{font-family:"font-font";src:url(data:font/woff2;base64,`,
+		`@font-face{font-family:"font-font";font-weight:bold;src:url(data:font/ttf;base64,AAEAAA==) format("truetype")}`,
+		`font-family="&#39;font-font&#39;, `,
+		`preserveAspectRatio="xMidYMid slice"`,
+		// alice is drawn with the emotion of the last message, the default
+		`data:image/svg+xml;base64,PHN2ZyB4bWxucz0iaHR0cDovL3d3dy53My5vcmcvMjAwMC9zdmciPjxjaXJjbGUgcj0iNCIgZmlsbD0iIzAwZiIvPjwvc3ZnPg==`,
+		// carol has no art and stands on the right, facing left
+		`<g transform="translate(800 0) scale(-1 1)"><circle`,
+	} {
+		if !strings.Contains(svg, want) {
+			t.Errorf("panel doesn't have %s:\n%s", want, svg)
+		}
+	}
+	if strings.Count(svg, "<path") != 3+2 {
+		t.Errorf("the messages of alice share a balloon: %d paths", strings.Count(svg, "<path"))
+	}
+
+	// bob answers carol, who listens on the right
+	second := string(panels[1].SVG)
+	if strings.Count(second, "<circle") != 2 || !strings.Contains(second, `<g transform="translate(720 0) scale(-1 1)"><circle`) {
+		t.Errorf("second panel:\n%s", second)
+	}
+	if strings.Count(svg, "@font-face") != 2 {
+		t.Errorf("a font is embedded once")
+	}
+	if strings.Contains(string(panels[1].SVG), "@font-face") {
+		t.Errorf("panels embed the fonts they use only")
+	}
+
+	// steps show the messages posted so far
+	if !bytes.Equal(panels[0].Step(4), panels[0].SVG) {
+		t.Errorf("the last step is the panel")
+	}
+	first := string(panels[0].Step(1))
+	if strings.Count(first, "<path") != 2+1 || strings.Count(first, "<text") != 1 || !strings.Contains(first, `data-message="0"`) ||
+		strings.Contains(first, "How are you?") || !strings.Contains(first, dataURL(library["characters/robo/happy"])) {
+		t.Errorf("first step:\n%s", first)
+	}
+	if none := string(panels[0].Step(0)); strings.Contains(none, "<text") || strings.Count(none, "<circle") != 2 {
+		t.Errorf("step without messages:\n%s", none)
+	}
+}
+
+func TestRenderLongMessage(t *testing.T) {
+	long := strings.Repeat("words that go on and on ", 200)
+	panels := Render([]Message{message(strings.Repeat("a", 64), long)}, nil, nil, Options{})
+	if len(panels) != 1 {
+		t.Fatalf("panels: %d", len(panels))
+	}
+	if !strings.Contains(string(panels[0].SVG), "…") {
+		t.Errorf("a message too long for a panel is cut")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	ctx := context.Background()
+	db := testutil.DB(t, "comic")
+
+	happy, sad, profile := []byte(`<svg xmlns="http://www.w3.org/2000/svg"/>`), []byte(`<svg xmlns="http://www.w3.org/2000/svg" width="1"/>`), []byte("profile")
+	local := map[string][]byte{sum(happy): happy}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch strings.TrimPrefix(r.URL.Path, "/") {
+		case sum(sad):
+			w.Write(sad)
+		case sum(profile):
+			t.Errorf("profile pictures aren't loaded")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	sk := nostr.GeneratePrivateKey()
+	x := func(data []byte, path string) nostr.Tag {
+		return nostr.Tag{"x", sum(data), path, strconv.Itoa(len(data)), "image/svg+xml"}
+	}
+	drive := nostr.Event{Kind: drives.Kind, CreatedAt: nostr.Now(), Tags: nostr.Tags{
+		{"d", "robo"}, {"server", server.URL},
+		x(profile, "/characters/robo/profile"), x(happy, "/characters/robo/happy"), x(sad, "/characters/robo/sad"),
+	}}
+	drive.Sign(sk)
+	if err := db.SaveEvent(ctx, &drive); err != nil {
+		t.Fatal(err)
+	}
+
+	event := nostr.Event{Kind: 7353, Content: "hi", Tags: nostr.Tags{{"drive", "robo"}, {"character", "/characters/robo"}}}
+	event.Sign(sk)
+	loader := &Loader{Query: db.QueryEvents, Store: testutil.Blobs(local), Client: server.Client()}
+	library, err := loader.Load(ctx, []Message{ParseMessage(&event)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	address := "30563:" + drive.PubKey + ":robo"
+	if asset, ok := library.Character(address, "characters/robo", "sad"); !ok || !bytes.Equal(asset.Data, sad) || asset.Type != "image/svg+xml" {
+		t.Errorf("an emotion from the server of the drive: %v %+v", ok, asset)
+	}
+	if asset, ok := library.Character(address, "characters/robo", "unknown"); !ok || !bytes.Equal(asset.Data, happy) {
+		t.Errorf("the default emotion is the first one that isn't the profile: %v %s", ok, asset.Data)
+	}
+	if _, ok := library.Character(address, "characters/other", ""); ok {
+		t.Errorf("unknown character")
+	}
+
+	if asset, err := loader.File(ctx, address, "characters/robo/sad.svg"); err != nil || !bytes.Equal(asset.Data, sad) {
+		t.Errorf("a file of the drive: %v %+v", err, asset)
+	}
+	if _, err := loader.File(ctx, address, "characters/robo/angry"); !errors.Is(err, blossom.ErrNotFound) {
+		t.Errorf("unknown file: %v", err)
+	}
+	if _, err := loader.File(ctx, "30563:"+drive.PubKey+":other", "characters/robo/sad"); !errors.Is(err, blossom.ErrNotFound) {
+		t.Errorf("unknown drive: %v", err)
+	}
+
+	// backgrounds and drive servers are chosen by users, the relay's own
+	// network isn't reachable
+	guarded := &Loader{Query: db.QueryEvents}
+	if _, err := guarded.Background(ctx, server.URL+"/"+sum(sad)); err == nil {
+		t.Errorf("a background on the loopback address")
+	}
+	if _, err := guarded.Background(ctx, "http://169.254.169.254/latest/meta-data"); err == nil {
+		t.Errorf("a background on a link-local address")
+	}
+}
@@ -0,0 +1,79 @@
+package comic
+
+import (
+	"path"
+	"slices"
+
+	"nostr-relay/typeset"
+)
+
+// fontFile is a file of the font of a message and the style it's for
+type fontFile struct {
+	Asset
+	bold, italic bool
+}
+
+// fontStyles are the names of the files of the styles of a font: beside it
+// as in "fonts/font-roboto-bold", or in its directory when it's named by its
+// style as in "fonts/font-a/regular"
+var fontStyles = []struct {
+	name         string
+	bold, italic bool
+}{
+	{"bold", true, false},
+	{"italic", false, true},
+	{"bold-italic", true, true},
+}
+
+// fontFiles are the files of the font of a message, the one it names first
+// as the regular face, nil when there is none
+func fontFiles(assets Assets, m *Message) []fontFile {
+	if assets == nil || m.Font == "" {
+		return nil
+	}
+	regular, ok := assets.Font(m.Drive, m.Font)
+	if !ok {
+		return nil
+	}
+
+	files := []fontFile{{Asset: regular}}
+	named := slices.Contains([]string{"regular", "bold", "italic", "bold-italic"}, path.Base(m.Font))
+	for _, style := range fontStyles {
+		p := m.Font + "-" + style.name
+		if named {
+			p = path.Join(path.Dir(m.Font), style.name)
+		}
+		if p == m.Font {
+			continue
+		}
+		if asset, ok := assets.Font(m.Drive, p); ok {
+			files = append(files, fontFile{Asset: asset, bold: style.bold, italic: style.italic})
+		}
+	}
+	return files
+}
+
+// faces parses font files to measure text with, parsed keeps fonts by hash
+// as messages share them. Files that aren't fonts are skipped, browsers
+// might still draw them.
+func faces(files []fontFile, parsed map[string]*typeset.Font) typeset.Faces {
+	var faces typeset.Faces
+	for _, f := range files {
+		font, ok := parsed[f.SHA256]
+		if !ok {
+			font, _ = typeset.Parse(f.Data)
+			parsed[f.SHA256] = font
+		}
+		switch {
+		case f.bold && f.italic:
+			faces.BoldItalic = font
+		case f.bold:
+			faces.Bold = font
+		case f.italic:
+			faces.Italic = font
+		default:
+			faces.Regular = font
+		}
+	}
+	return faces
+}
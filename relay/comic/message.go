@@ -0,0 +1,82 @@
+package comic
+
+import (
+	"path"
+	"regexp"
+	"strings"
+
+	"nostr-relay/drives"
+	"nostr-relay/kinds"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Message is what a kind 7353 message asks to be drawn with
+type Message struct {
+	Event *nostr.Event
+
+	// Drive is the address of the drive of the character and font, "" when
+	// the message doesn't name one
+	Drive string
+
+	// Character and Font are paths of the drive, without extension, like
+	// "characters/char1" and "fonts/font-roboto"
+	Character string
+	Emotion   string
+	Font      string
+
+	// To is who the message answers, from its first "p" tag
+	To string
+
+	// Colors are the hex colors of the markup tags named by "color" tags
+	Colors map[string]string
+
+	Runs []kinds.Run
+}
+
+var hexColor = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6}|[0-9a-fA-F]{8})$`)
+
+// ParseMessage reads the tags and markup of a channel message, kind 42
+// messages are drawn with a default character
+func ParseMessage(event *nostr.Event) Message {
+	m := Message{Event: event, Colors: make(map[string]string), Runs: kinds.ParseMarkup(event.Content)}
+	if event.Kind != 7353 {
+		m.Runs = []kinds.Run{{Text: event.Content}}
+	}
+	m.Drive, _ = drives.Reference(event)
+
+	for _, tag := range event.Tags {
+		if len(tag) < 2 {
+			continue
+		}
+
+		switch tag[0] {
+		case "character":
+			m.Character = normalizePath(tag[1])
+		case "emotion":
+			m.Emotion = path.Base(normalizePath(tag[1]))
+		case "font":
+			m.Font = normalizePath(tag[1])
+		case "p":
+			if m.To == "" && tag[1] != event.PubKey && nostr.IsValidPublicKey(tag[1]) {
+				m.To = tag[1]
+			}
+		case "color":
+			if len(tag) > 2 && hexColor.MatchString(tag[2]) {
+				m.Colors[tag[1]] = tag[2]
+			}
+		}
+	}
+
+	return m
+}
+
+// normalizePath is a drive path without its leading slash and extension, so
+// "/characters/char1/happy.svg" and "characters/char1/happy" are the same
+func normalizePath(p string) string {
+	p = strings.Trim(p, "/")
+	if ext := path.Ext(p); ext != "" && !strings.Contains(ext, "/") {
+		p = strings.TrimSuffix(p, ext)
+	}
+	return p
+}
@@ -0,0 +1,399 @@
+package comic
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+
+	"nostr-relay/layout"
+	"nostr-relay/typeset"
+)
+
+// Options tune the panels, zero values use the defaults
+type Options struct {
+	// Width and Height are the size of a panel, in pixels
+	Width  int
+	Height int
+
+	// FontSize is the size of balloon text, in pixels
+	FontSize float64
+
+	// FontFamily is used for messages without a font of their drive
+	FontFamily string
+
+	// MaxBalloons and MaxCharacters are how many messages and speakers a
+	// panel holds at most
+	MaxBalloons   int
+	MaxCharacters int
+}
+
+func (o Options) withDefaults() Options {
+	if o.Width <= 0 {
+		o.Width = 480
+	}
+	if o.Height <= 0 {
+		o.Height = 360
+	}
+	if o.FontSize <= 0 {
+		o.FontSize = 14
+	}
+	if o.FontFamily == "" {
+		o.FontFamily = "'Comic Neue', 'Comic Sans MS', sans-serif"
+	}
+	if o.MaxBalloons <= 0 {
+		o.MaxBalloons = 3
+	}
+	if o.MaxCharacters <= 0 {
+		o.MaxCharacters = 4
+	}
+	return o
+}
+
+// Panel is a rendered frame and the messages it shows
+type Panel struct {
+	Messages []*Message
+	SVG      []byte
+
+	renderer   *renderer
+	layout     layout.Panel
+	background *Asset
+}
+
+// Step draws the panel as it was when the first n of its messages had been
+// posted, for animations: the balloons and text of later messages are left
+// out and characters have the emotion of their last message so far
+func (p Panel) Step(n int) []byte {
+	return p.renderer.panel(p.layout, p.background, n)
+}
+
+// geometry of a panel, from its size
+type geometry struct {
+	width, height float64
+	margin        float64
+	padding       float64
+	fontSize      float64
+	lineHeight    float64
+	balloonWidth  float64
+	characterSize float64
+}
+
+func newGeometry(o Options) geometry {
+	g := geometry{width: float64(o.Width), height: float64(o.Height), fontSize: o.FontSize}
+	g.margin = g.width * 0.03
+	g.padding = g.fontSize * 0.6
+	g.lineHeight = g.fontSize * 1.25
+	g.balloonWidth = g.width * 0.6
+	g.characterSize = g.height * 0.45
+	return g
+}
+
+// Render draws messages, in order, as comic panels laid out by the layout
+// package: speakers stand at the bottom with the emotion of their last
+// message, balloons are above with tails pointing at them. assets can be
+// nil, and background too, to draw default characters on white. The same
+// input always renders the same bytes.
+func Render(messages []Message, assets Assets, background *Asset, options Options) []Panel {
+	options = options.withDefaults()
+	g := newGeometry(options)
+
+	// text is laid out first with the fonts of the messages, the layout
+	// only needs its size; what doesn't fit above the characters is cut
+	fonts := make([][]fontFile, len(messages))
+	texts := make([]typeset.Block, len(messages))
+	sizes := make([]layout.Message, len(messages))
+	parsed := make(map[string]*typeset.Font)
+	shape := typeset.Box{Width: g.balloonWidth - 2*g.padding, Height: g.height - g.characterSize - 3*g.margin - 2*g.padding}
+	for i, m := range messages {
+		fonts[i] = fontFiles(assets, &m)
+		block := typeset.Layout(m.Runs, faces(fonts[i], parsed), typeset.Options{Size: g.fontSize, Shape: shape, Hyphenate: true})
+		texts[i] = block
+		sizes[i] = layout.Message{
+			Speaker: m.Event.PubKey,
+			To:      m.To,
+			Width:   max(block.Bounds.Width, 2*g.fontSize),
+			Height:  max(block.Bounds.Height, g.lineHeight),
+		}
+	}
+
+	panels := make([]Panel, 0)
+	for _, p := range layout.Compose(sizes, layout.Options{
+		Width:           g.width,
+		Height:          g.height,
+		Margin:          g.margin,
+		Padding:         g.padding,
+		CharacterHeight: g.characterSize,
+		MaxBalloons:     options.MaxBalloons,
+		MaxCharacters:   options.MaxCharacters,
+	}) {
+		r := &renderer{g: g, options: options, assets: assets, messages: messages, texts: texts, fontFiles: fonts, fonts: make(map[string]string)}
+		rendered := Panel{SVG: r.panel(p, background, len(p.Messages)), renderer: r, layout: p, background: background}
+		for _, i := range p.Messages {
+			rendered.Messages = append(rendered.Messages, &messages[i])
+		}
+		panels = append(panels, rendered)
+	}
+	return panels
+}
+
+// renderer writes the SVG of a panel
+type renderer struct {
+	g        geometry
+	options  Options
+	assets   Assets
+	messages []Message
+	texts    []typeset.Block
+
+	// fontFiles are the fonts of the messages, by message
+	fontFiles [][]fontFile
+
+	// fonts are the families of the fonts embedded, by hash of their
+	// regular file
+	fonts     map[string]string
+	fontFaces bytes.Buffer
+}
+
+// panel draws the first n messages of a panel. Balloons and text are tagged
+// with the index of their message, data-message="<i>", for animations.
+func (r *renderer) panel(p layout.Panel, background *Asset, n int) []byte {
+	shown := make(map[int]bool)
+	for _, i := range p.Messages[:min(max(n, 0), len(p.Messages))] {
+		shown[i] = true
+	}
+
+	var body bytes.Buffer
+	w, h := r.g.width, r.g.height
+
+	if background != nil && isImage(background.Type) {
+		fmt.Fprintf(&body, `<image href="%s" x="0" y="0" width="%s" height="%s" preserveAspectRatio="xMidYMid slice"/>`,
+			dataURL(*background), num(w), num(h))
+	} else {
+		fmt.Fprintf(&body, `<rect x="0" y="0" width="%s" height="%s" fill="#ffffff"/>`, num(w), num(h))
+	}
+
+	for _, c := range p.Characters {
+		c.Message = r.current(p, c, shown)
+		r.character(&body, c)
+	}
+	for _, b := range p.Balloons {
+		if shown[b.Messages[0]] {
+			r.balloon(&body, b, shown)
+		}
+	}
+	fmt.Fprintf(&body, `<rect x="1" y="1" width="%s" height="%s" fill="none" stroke="#000000" stroke-width="2"/>`, num(w-2), num(h-2))
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, `<svg xmlns="http://www.w3.org/2000/svg" width="%s" height="%s" viewBox="0 0 %s %s">`, num(w), num(h), num(w), num(h))
+	if r.fontFaces.Len() > 0 {
+		fmt.Fprintf(&out, `<style>%s</style>`, r.fontFaces.String())
+	}
+	// the id is unique to the content, for panels put in the same page
+	id := fmt.Sprintf("panel-%x", sha256.Sum256(body.Bytes()))[:14]
+	fmt.Fprintf(&out, `<clipPath id="%s"><rect x="0" y="0" width="%s" height="%s"/></clipPath>`, id, num(w), num(h))
+	fmt.Fprintf(&out, `<g clip-path="url(#%s)">%s</g></svg>`, id, body.String())
+	return out.Bytes()
+}
+
+// current is the last message of a character among those shown, or their
+// first one in the panel when none is, whose emotion they have
+func (r *renderer) current(p layout.Panel, c layout.Character, shown map[int]bool) int {
+	if shown[c.Message] {
+		return c.Message
+	}
+	first := c.Message
+	for _, i := range slices.Backward(p.Messages) {
+		if r.messages[i].Event.PubKey != c.Speaker {
+			continue
+		}
+		if shown[i] {
+			return i
+		}
+		first = i
+	}
+	return first
+}
+
+// character draws the art of a character standing at the bottom of the
+// panel, or a silhouette in a color of their own when there's none. Art
+// faces right, it's mirrored for characters facing left.
+func (r *renderer) character(out *bytes.Buffer, c layout.Character) {
+	x, y, w, h := c.Rect.X, c.Rect.Y, c.Rect.Width, c.Rect.Height
+	cx := x + w/2
+
+	transform := ""
+	if c.Facing == layout.Left {
+		transform = fmt.Sprintf(` transform="translate(%s 0) scale(-1 1)"`, num(2*cx))
+	}
+
+	m := &r.messages[c.Message]
+	if r.assets != nil {
+		if art, ok := r.assets.Character(m.Drive, m.Character, m.Emotion); ok && isImage(art.Type) {
+			fmt.Fprintf(out, `<image href="%s" x="%s" y="%s" width="%s" height="%s" preserveAspectRatio="xMidYMax meet"%s/>`,
+				dataURL(art), num(x), num(y), num(w), num(h), transform)
+			return
+		}
+	}
+
+	color := silhouetteColor(c.Speaker)
+	size := min(w, h)
+	bottom := y + h
+	top := bottom - size
+	fmt.Fprintf(out, `<g%s><circle cx="%s" cy="%s" r="%s" fill="%s"/>`, transform, num(cx), num(top+size*0.3), num(size*0.16), color)
+	fmt.Fprintf(out, `<path d="M%s %s Q%s %s %s %s Q%s %s %s %s Z" fill="%s"/></g>`,
+		num(cx-size*0.28), num(bottom),
+		num(cx-size*0.28), num(top+size*0.5), num(cx), num(top+size*0.5),
+		num(cx+size*0.28), num(top+size*0.5), num(cx+size*0.28), num(bottom),
+		color)
+}
+
+// balloon draws a rounded balloon whose tail points at the head of the
+// speaker, and the text of its messages that are shown
+func (r *renderer) balloon(out *bytes.Buffer, b layout.Balloon, shown map[int]bool) {
+	x, y, w, h := b.Rect.X, b.Rect.Y, b.Rect.Width, b.Rect.Height
+	radius := min(h/2, r.g.fontSize)
+	tail := min(r.g.fontSize*0.5, (w-2*radius)/2)
+
+	// the tail leaves the bottom edge above the speaker, as far as the
+	// corners allow, and stops short of the head
+	tx := min(max(b.Tail.X, x+radius+tail), x+w-radius-tail)
+	tipX := tx + (b.Tail.X-tx)*0.6
+	tipY := max(b.Tail.Y-r.g.fontSize*0.2, y+h+r.g.fontSize*0.5)
+
+	fmt.Fprintf(out, `<path d="M%s %s H%s Q%s %s %s %s V%s Q%s %s %s %s H%s L%s %s L%s %s H%s Q%s %s %s %s V%s Q%s %s %s %s Z" fill="#ffffff" stroke="#000000" stroke-width="1.5" data-message="%d"/>`,
+		num(x+radius), num(y), num(x+w-radius),
+		num(x+w), num(y), num(x+w), num(y+radius),
+		num(y+h-radius),
+		num(x+w), num(y+h), num(x+w-radius), num(y+h),
+		num(tx+tail),
+		num(tipX), num(tipY),
+		num(tx-tail), num(y+h),
+		num(x+radius),
+		num(x), num(y+h), num(x), num(y+h-radius),
+		num(y+radius),
+		num(x), num(y), num(x+radius), num(y), b.Messages[0])
+
+	for k, i := range b.Messages {
+		if !shown[i] {
+			continue
+		}
+		m, area, text := &r.messages[i], b.Text[k], r.texts[i]
+		center := text.Bounds.X + text.Bounds.Width/2
+		fmt.Fprintf(out, `<text font-family="%s" font-size="%s" text-anchor="middle" fill="#000000" data-message="%d">`, attr(r.font(i)), num(r.g.fontSize), i)
+		for _, l := range text.Lines {
+			// lines are centered in the balloon as they are in the block
+			cx := area.X + area.Width/2 + l.X + l.Width/2 - center
+			fmt.Fprintf(out, `<tspan x="%s" y="%s">`, num(cx), num(area.Y+l.Baseline-text.Bounds.Y))
+			for _, s := range l.Spans {
+				r.span(out, s, m.Colors)
+			}
+			out.WriteString(`</tspan>`)
+		}
+		out.WriteString(`</text>`)
+	}
+}
+
+// span writes text with the styles of its markup: bold, italic, underline
+// and the colors named by the message
+func (r *renderer) span(out *bytes.Buffer, s typeset.Span, colors map[string]string) {
+	attrs := ""
+	for _, style := range s.Styles {
+		switch style {
+		case "bold", "b":
+			attrs += ` font-weight="bold"`
+		case "italic", "i":
+			attrs += ` font-style="italic"`
+		case "underline", "u":
+			attrs += ` text-decoration="underline"`
+		default:
+			if color, ok := colors[style]; ok {
+				attrs += ` fill="` + color + `"`
+			}
+		}
+	}
+
+	if attrs == "" {
+		xml.EscapeText(out, []byte(s.Text))
+		return
+	}
+	fmt.Fprintf(out, `<tspan%s>`, attrs)
+	xml.EscapeText(out, []byte(s.Text))
+	out.WriteString(`</tspan>`)
+}
+
+// font embeds the font files of a message the first time they're used in
+// the panel and returns the families to write with. The files of a font are
+// faces of the same family, told apart by their weight and style.
+func (r *renderer) font(message int) string {
+	files := r.fontFiles[message]
+	if len(files) == 0 {
+		return r.options.FontFamily
+	}
+
+	// families are named by hash so panels put on the same page don't
+	// redefine each other's fonts
+	family, ok := r.fonts[files[0].SHA256]
+	if !ok {
+		family = "font-" + files[0].SHA256[:min(12, len(files[0].SHA256))]
+		r.fonts[files[0].SHA256] = family
+		for _, f := range files {
+			descriptors := ""
+			if f.bold {
+				descriptors += "font-weight:bold;"
+			}
+			if f.italic {
+				descriptors += "font-style:italic;"
+			}
+			fmt.Fprintf(&r.fontFaces, `@font-face{font-family:"%s";%ssrc:url(%s)%s}`, family, descriptors, dataURL(f.Asset), fontFormat(f.Type))
+		}
+	}
+	return fmt.Sprintf("'%s', %s", family, r.options.FontFamily)
+}
+
+func fontFormat(mimeType string) string {
+	switch mimeType {
+	case "font/woff2", "font/woff":
+		return fmt.Sprintf(` format("%s")`, strings.TrimPrefix(mimeType, "font/"))
+	case "font/ttf":
+		return ` format("truetype")`
+	case "font/otf":
+		return ` format("opentype")`
+	}
+	return ""
+}
+
+var imageTypes = []string{"image/svg+xml", "image/png", "image/jpeg", "image/webp", "image/gif"}
+
+func isImage(mimeType string) bool {
+	return slices.Contains(imageTypes, mimeType)
+}
+
+func dataURL(asset Asset) string {
+	return "data:" + asset.Type + ";base64," + base64.StdEncoding.EncodeToString(asset.Data)
+}
+
+// silhouetteColor is a color of its own for a pubkey without art
+func silhouetteColor(pubkey string) string {
+	hash := sha256.Sum256([]byte(pubkey))
+	return fmt.Sprintf("#%02x%02x%02x", hash[0]/2+64, hash[1]/2+64, hash[2]/2+64)
+}
+
+// num formats a coordinate with at most two decimals, so output doesn't
+// depend on float noise
+func num(v float64) string {
+	v = math.Round(v*100) / 100
+	if v == 0 {
+		v = 0
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func attr(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
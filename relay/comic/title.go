@@ -0,0 +1,91 @@
+package comic
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/xml"
+	"fmt"
+
+	"nostr-relay/kinds"
+	"nostr-relay/typeset"
+)
+
+// Title draws the title page of a strip, the size of its panels: the title
+// in bold, the about text below it and a caption, such as dates, in grey,
+// on a card over the background. Text that doesn't fit is cut.
+func Title(title string, about string, caption string, background *Asset, options Options) []byte {
+	options = options.withDefaults()
+	g := newGeometry(options)
+	w, h := g.width, g.height
+
+	var body bytes.Buffer
+	if background != nil && isImage(background.Type) {
+		fmt.Fprintf(&body, `<image href="%s" x="0" y="0" width="%s" height="%s" preserveAspectRatio="xMidYMid slice"/>`,
+			dataURL(*background), num(w), num(h))
+	} else {
+		fmt.Fprintf(&body, `<rect x="0" y="0" width="%s" height="%s" fill="#ffffff"/>`, num(w), num(h))
+	}
+
+	card := 2 * g.margin
+	fmt.Fprintf(&body, `<rect x="%s" y="%s" width="%s" height="%s" rx="%s" fill="#ffffff" fill-opacity="0.85" stroke="#000000" stroke-width="1.5"/>`,
+		num(card), num(card), num(w-2*card), num(h-2*card), num(g.fontSize))
+
+	// the blocks share the height of the card and are centered together
+	width := w - 2*card - 2*g.padding
+	room := h - 2*card - 2*g.padding
+	type block struct {
+		typeset.Block
+		size  float64
+		style string
+	}
+	blocks := make([]block, 0, 3)
+	for _, b := range []struct {
+		text  string
+		size  float64
+		style string
+		share float64
+	}{
+		{title, g.fontSize * 2, ` font-weight="bold"`, 0.35},
+		{about, g.fontSize, ``, 0.5},
+		{caption, g.fontSize * 0.85, ` fill="#555555"`, 0.15},
+	} {
+		if b.text == "" {
+			continue
+		}
+		laid := typeset.Layout([]kinds.Run{{Text: b.text}}, typeset.Faces{}, typeset.Options{
+			Size:  b.size,
+			Shape: typeset.Box{Width: width, Height: max(room*b.share, b.size*1.5)},
+		})
+		blocks = append(blocks, block{Block: laid, size: b.size, style: b.style})
+	}
+
+	gap := g.fontSize
+	total := 0.0
+	for i, b := range blocks {
+		total += b.Bounds.Height
+		if i > 0 {
+			total += gap
+		}
+	}
+	y := (h - total) / 2
+	for _, b := range blocks {
+		fmt.Fprintf(&body, `<text font-family="%s" font-size="%s" text-anchor="middle"%s>`, attr(options.FontFamily), num(b.size), b.style)
+		for _, l := range b.Lines {
+			fmt.Fprintf(&body, `<tspan x="%s" y="%s">`, num(w/2), num(y+l.Baseline-b.Bounds.Y))
+			for _, s := range l.Spans {
+				xml.EscapeText(&body, []byte(s.Text))
+			}
+			body.WriteString(`</tspan>`)
+		}
+		body.WriteString(`</text>`)
+		y += b.Bounds.Height + gap
+	}
+	fmt.Fprintf(&body, `<rect x="1" y="1" width="%s" height="%s" fill="none" stroke="#000000" stroke-width="2"/>`, num(w-2), num(h-2))
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, `<svg xmlns="http://www.w3.org/2000/svg" width="%s" height="%s" viewBox="0 0 %s %s">`, num(w), num(h), num(w), num(h))
+	id := fmt.Sprintf("title-%x", sha256.Sum256(body.Bytes()))[:14]
+	fmt.Fprintf(&out, `<clipPath id="%s"><rect x="0" y="0" width="%s" height="%s"/></clipPath>`, id, num(w), num(h))
+	fmt.Fprintf(&out, `<g clip-path="url(#%s)">%s</g></svg>`, id, body.String())
+	return out.Bytes()
+}
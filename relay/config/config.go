@@ -0,0 +1,442 @@
+package config
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// Config holds the relay settings. Every field can be overridden with an
+// environment variable, so the same binary works locally and in deployments.
+type Config struct {
+	// Host and Port the relay listens on (RELAY_HOST, RELAY_PORT)
+	Host string
+	Port int
+
+	// ServiceURL is the public URL of the relay, used to validate NIP-98
+	// authorization when we are behind a proxy (RELAY_SERVICE_URL)
+	ServiceURL string
+
+	// DatabasePath is the SQLite file used by the event store (RELAY_DB_PATH)
+	DatabasePath string
+
+	// ShutdownTimeout is how long we wait for connections and in-flight writes
+	// to finish after SIGINT/SIGTERM before giving up (RELAY_SHUTDOWN_TIMEOUT)
+	ShutdownTimeout time.Duration
+
+	// HTTPReadTimeout and HTTPWriteTimeout bound how long reading a request
+	// and writing its response take, for the HTTP endpoints other than
+	// websockets: uploads, exports and renders (RELAY_HTTP_READ_TIMEOUT,
+	// RELAY_HTTP_WRITE_TIMEOUT)
+	HTTPReadTimeout  time.Duration
+	HTTPWriteTimeout time.Duration
+
+	// AdminPubKeys can use the NIP-86 management API, hex or npub, separated
+	// by commas (RELAY_ADMIN_PUBKEYS)
+	AdminPubKeys []string
+
+	// ExpirationSweepInterval is how often NIP-40 expired events are deleted
+	// (RELAY_EXPIRATION_SWEEP_INTERVAL)
+	ExpirationSweepInterval time.Duration
+
+	// RetentionMaxAge and RetentionMaxMessages are the default retention of
+	// channel messages, 0 to keep them (RELAY_RETENTION_MAX_AGE,
+	// RELAY_RETENTION_MAX_MESSAGES)
+	RetentionMaxAge      time.Duration
+	RetentionMaxMessages int
+
+	// RetentionMaxAgeLimit and RetentionMaxMessagesLimit bound what channel
+	// owners can ask for, 0 for no bound (RELAY_RETENTION_MAX_AGE_LIMIT,
+	// RELAY_RETENTION_MAX_MESSAGES_LIMIT)
+	RetentionMaxAgeLimit      time.Duration
+	RetentionMaxMessagesLimit int
+
+	// RetentionInterval is how often messages are pruned
+	// (RELAY_RETENTION_INTERVAL)
+	RetentionInterval time.Duration
+
+	// RetentionDryRun only logs what would be pruned (RELAY_RETENTION_DRY_RUN)
+	RetentionDryRun bool
+
+	// ReadConnections is the size of the read connection pool, events are
+	// written on a connection of their own (RELAY_DB_READ_CONNECTIONS)
+	ReadConnections int
+
+	// WriteQueueSize is how many events can wait to be written, and
+	// WriteBatchSize how many are committed together (RELAY_WRITE_QUEUE_SIZE,
+	// RELAY_WRITE_BATCH_SIZE)
+	WriteQueueSize int
+	WriteBatchSize int
+
+	// WriteQueueTimeout is how long an event waits for room in a full queue
+	// before it's rejected as rate-limited (RELAY_WRITE_QUEUE_TIMEOUT)
+	WriteQueueTimeout time.Duration
+
+	// HistoryCacheMessages is how many recent messages are kept in memory
+	// per channel, and HistoryCacheSize the bytes all channels can take,
+	// 0 to disable the cache (RELAY_HISTORY_CACHE_MESSAGES,
+	// RELAY_HISTORY_CACHE_SIZE)
+	HistoryCacheMessages int
+	HistoryCacheSize     int
+
+	// Outbox republishes channel events and messages to the relays declared
+	// by their channel (RELAY_OUTBOX)
+	Outbox bool
+
+	// OutboxInterval is how often the outbox queue is looked at, besides
+	// when something is queued (RELAY_OUTBOX_INTERVAL)
+	OutboxInterval time.Duration
+
+	// OutboxMaxAttempts is how many times an unreachable relay is tried, the
+	// wait doubling from OutboxMinBackoff up to OutboxMaxBackoff
+	// (RELAY_OUTBOX_MAX_ATTEMPTS, RELAY_OUTBOX_MIN_BACKOFF,
+	// RELAY_OUTBOX_MAX_BACKOFF)
+	OutboxMaxAttempts int
+	OutboxMinBackoff  time.Duration
+	OutboxMaxBackoff  time.Duration
+
+	// Backfill fetches the history of newly learned channels from the
+	// relays they declare (RELAY_BACKFILL)
+	Backfill bool
+
+	// BackfillInterval is how often pending backfills are looked at, besides
+	// when a channel is learned (RELAY_BACKFILL_INTERVAL)
+	BackfillInterval time.Duration
+
+	// BackfillMaxAge is how far back history is fetched, 0 for all of it,
+	// and BackfillMaxEvents how many events per channel and relay
+	// (RELAY_BACKFILL_MAX_AGE, RELAY_BACKFILL_MAX_EVENTS)
+	BackfillMaxAge    time.Duration
+	BackfillMaxEvents int
+
+	// NegentropyMaxItems bounds how many events a NIP-77 session
+	// reconciles, for peers and clients alike (RELAY_NEGENTROPY_MAX_ITEMS)
+	NegentropyMaxItems int
+
+	// SyncPeers are relays kept in sync with this one using NIP-77, separated
+	// by commas, none to disable syncing (RELAY_SYNC_PEERS)
+	SyncPeers []string
+
+	// SyncFilters are what's reconciled with every peer, a JSON array of
+	// filters, all comic chat kinds by default (RELAY_SYNC_FILTERS)
+	SyncFilters []nostr.Filter
+
+	// SyncDirection is "down" to only fetch what peers have, "up" to only
+	// publish to them, or "both" (RELAY_SYNC_DIRECTION)
+	SyncDirection string
+
+	// SyncInterval is how often peers are reconciled (RELAY_SYNC_INTERVAL)
+	SyncInterval time.Duration
+
+	// Blossom serves BUD-01/BUD-02 blob endpoints next to the relay, blobs
+	// being stored in BlossomDir (RELAY_BLOSSOM, RELAY_BLOSSOM_DIR)
+	Blossom    bool
+	BlossomDir string
+
+	// BlossomMaxSize is the size limit of an upload in bytes
+	// (RELAY_BLOSSOM_MAX_SIZE)
+	BlossomMaxSize int
+
+	// BlossomTypes are the MIME types accepted, separated by commas, images
+	// and fonts by default (RELAY_BLOSSOM_TYPES)
+	BlossomTypes []string
+
+	// BlossomUploaders are the pubkeys allowed to upload, hex or npub, anyone
+	// when empty (RELAY_BLOSSOM_UPLOADERS)
+	BlossomUploaders []string
+
+	// BlossomSVG is "sanitize" to strip scripts and external references from
+	// uploaded SVGs, "strict" to refuse SVGs that have any, or "off"
+	// (RELAY_BLOSSOM_SVG)
+	BlossomSVG string
+
+	// VerifyDrives checks the blobs of every new 30563 drive in the
+	// background, from the Blossom store or the servers of their author
+	// (RELAY_VERIFY_DRIVES)
+	VerifyDrives bool
+
+	// PinDrives mirrors the blobs of the drives used in channels into the
+	// Blossom store, and deletes them once no stored drive lists them; it
+	// needs RELAY_BLOSSOM (RELAY_PIN_DRIVES)
+	PinDrives bool
+
+	// PinQuota is how many bytes are pinned for the drives of an author
+	// (RELAY_PIN_QUOTA)
+	PinQuota int
+
+	// PinInterval is how often pins are brought in line with the drives,
+	// besides when one changes (RELAY_PIN_INTERVAL)
+	PinInterval time.Duration
+
+	// ComicExport serves channel transcripts as comic strips at
+	// /channels/{id}/comic (RELAY_COMIC_EXPORT)
+	ComicExport bool
+
+	// ComicExportMaxMessages is how many messages a transcript holds at
+	// most, the latest of its time range (RELAY_COMIC_EXPORT_MAX_MESSAGES)
+	ComicExportMaxMessages int
+
+	// ComicExportCacheSize is the memory the transcripts and replays served
+	// lately can take, in bytes (RELAY_COMIC_EXPORT_CACHE_SIZE), and
+	// ComicExportCacheTTL how long they're kept at most
+	// (RELAY_COMIC_EXPORT_CACHE_TTL)
+	ComicExportCacheSize int
+	ComicExportCacheTTL  time.Duration
+
+	// ReplayCompression divides the time between messages in the replays
+	// of channels served at /channels/{id}/replay with RELAY_COMIC_EXPORT
+	// (RELAY_REPLAY_COMPRESSION)
+	ReplayCompression float64
+
+	// Thumbnails serves PNG and WebP thumbnails of Blossom blobs, drive
+	// files and channel pictures (RELAY_THUMBNAILS)
+	Thumbnails bool
+
+	// ThumbnailDir is where rendered thumbnails are cached
+	// (RELAY_THUMBNAIL_DIR)
+	ThumbnailDir string
+
+	// ThumbnailSizes are the sizes thumbnails are rendered at, in pixels,
+	// separated by commas (RELAY_THUMBNAIL_SIZES)
+	ThumbnailSizes []int
+
+	// ThumbnailCacheSize is how many bytes of thumbnails are cached
+	// (RELAY_THUMBNAIL_CACHE_SIZE)
+	ThumbnailCacheSize int
+}
+
+func Load() Config {
+	return Config{
+		Host:                    getString("RELAY_HOST", ""),
+		Port:                    getInt("RELAY_PORT", 3334),
+		ServiceURL:              getString("RELAY_SERVICE_URL", ""),
+		DatabasePath:            getString("RELAY_DB_PATH", "./db.sqlite"),
+		ShutdownTimeout:         getDuration("RELAY_SHUTDOWN_TIMEOUT", 10*time.Second),
+		HTTPReadTimeout:         getDuration("RELAY_HTTP_READ_TIMEOUT", time.Minute),
+		HTTPWriteTimeout:        getDuration("RELAY_HTTP_WRITE_TIMEOUT", 2*time.Minute),
+		AdminPubKeys:            getPubKeys("RELAY_ADMIN_PUBKEYS"),
+		ExpirationSweepInterval: getDuration("RELAY_EXPIRATION_SWEEP_INTERVAL", time.Minute),
+
+		RetentionMaxAge:           getDuration("RELAY_RETENTION_MAX_AGE", 0),
+		RetentionMaxMessages:      getInt("RELAY_RETENTION_MAX_MESSAGES", 0),
+		RetentionMaxAgeLimit:      getDuration("RELAY_RETENTION_MAX_AGE_LIMIT", 0),
+		RetentionMaxMessagesLimit: getInt("RELAY_RETENTION_MAX_MESSAGES_LIMIT", 0),
+		RetentionInterval:         getDuration("RELAY_RETENTION_INTERVAL", 10*time.Minute),
+		RetentionDryRun:           getBool("RELAY_RETENTION_DRY_RUN", false),
+
+		ReadConnections:   getInt("RELAY_DB_READ_CONNECTIONS", 16),
+		WriteQueueSize:    getInt("RELAY_WRITE_QUEUE_SIZE", 1024),
+		WriteBatchSize:    getInt("RELAY_WRITE_BATCH_SIZE", 256),
+		WriteQueueTimeout: getDuration("RELAY_WRITE_QUEUE_TIMEOUT", 5*time.Second),
+
+		HistoryCacheMessages: getInt("RELAY_HISTORY_CACHE_MESSAGES", 500),
+		HistoryCacheSize:     getInt("RELAY_HISTORY_CACHE_SIZE", 64<<20),
+
+		Outbox:            getBool("RELAY_OUTBOX", false),
+		OutboxInterval:    getDuration("RELAY_OUTBOX_INTERVAL", 10*time.Second),
+		OutboxMaxAttempts: getInt("RELAY_OUTBOX_MAX_ATTEMPTS", 10),
+		OutboxMinBackoff:  getDuration("RELAY_OUTBOX_MIN_BACKOFF", 30*time.Second),
+		OutboxMaxBackoff:  getDuration("RELAY_OUTBOX_MAX_BACKOFF", time.Hour),
+
+		Backfill:          getBool("RELAY_BACKFILL", false),
+		BackfillInterval:  getDuration("RELAY_BACKFILL_INTERVAL", time.Minute),
+		BackfillMaxAge:    getDuration("RELAY_BACKFILL_MAX_AGE", 30*24*time.Hour),
+		BackfillMaxEvents: getInt("RELAY_BACKFILL_MAX_EVENTS", 5000),
+
+		NegentropyMaxItems: getInt("RELAY_NEGENTROPY_MAX_ITEMS", 500000),
+		SyncPeers:          getList("RELAY_SYNC_PEERS"),
+		SyncFilters:        getFilters("RELAY_SYNC_FILTERS", []nostr.Filter{{Kinds: []int{40, 41, 42, 7353}}}),
+		SyncDirection:      getChoice("RELAY_SYNC_DIRECTION", "both", "down", "up"),
+		SyncInterval:       getDuration("RELAY_SYNC_INTERVAL", 5*time.Minute),
+
+		Blossom:          getBool("RELAY_BLOSSOM", false),
+		BlossomDir:       getString("RELAY_BLOSSOM_DIR", "./blobs"),
+		BlossomMaxSize:   getInt("RELAY_BLOSSOM_MAX_SIZE", 10<<20),
+		BlossomTypes:     getList("RELAY_BLOSSOM_TYPES"),
+		BlossomUploaders: getPubKeys("RELAY_BLOSSOM_UPLOADERS"),
+		BlossomSVG:       getChoice("RELAY_BLOSSOM_SVG", "sanitize", "strict", "off"),
+
+		VerifyDrives: getBool("RELAY_VERIFY_DRIVES", false),
+
+		PinDrives:   getBool("RELAY_PIN_DRIVES", false),
+		PinQuota:    getInt("RELAY_PIN_QUOTA", 100<<20),
+		PinInterval: getDuration("RELAY_PIN_INTERVAL", 10*time.Minute),
+
+		ComicExport:            getBool("RELAY_COMIC_EXPORT", false),
+		ComicExportMaxMessages: getInt("RELAY_COMIC_EXPORT_MAX_MESSAGES", 500),
+		ComicExportCacheSize:   getInt("RELAY_COMIC_EXPORT_CACHE_SIZE", 32<<20),
+		ComicExportCacheTTL:    getDuration("RELAY_COMIC_EXPORT_CACHE_TTL", 10*time.Minute),
+		ReplayCompression:      getFloat("RELAY_REPLAY_COMPRESSION", 60),
+
+		Thumbnails:         getBool("RELAY_THUMBNAILS", false),
+		ThumbnailDir:       getString("RELAY_THUMBNAIL_DIR", "./thumbnails"),
+		ThumbnailSizes:     getSizes("RELAY_THUMBNAIL_SIZES", []int{64, 128, 256, 512}),
+		ThumbnailCacheSize: getInt("RELAY_THUMBNAIL_CACHE_SIZE", 256<<20),
+	}
+}
+
+func getString(key string, def string) string {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value
+	}
+
+	return def
+}
+
+func getList(key string) []string {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return nil
+	}
+
+	list := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
+
+// getPubKeys reads a list of public keys, accepting both hex and npub
+func getPubKeys(key string) []string {
+	pubkeys := make([]string, 0)
+	for _, item := range getList(key) {
+		if strings.HasPrefix(item, "npub1") {
+			_, data, err := nip19.Decode(item)
+			if err != nil {
+				log.Printf("Invalid npub in %s (%q): %v", key, item, err)
+				continue
+			}
+			item = data.(string)
+		}
+
+		if !nostr.IsValidPublicKey(item) {
+			log.Printf("Invalid public key in %s: %q", key, item)
+			continue
+		}
+
+		pubkeys = append(pubkeys, item)
+	}
+
+	return pubkeys
+}
+
+// getFilters reads a JSON array of filters
+func getFilters(key string, def []nostr.Filter) []nostr.Filter {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return def
+	}
+
+	var filters []nostr.Filter
+	if err := json.Unmarshal([]byte(value), &filters); err != nil || len(filters) == 0 {
+		log.Printf("Invalid value for %s (%q), using the default filters", key, value)
+		return def
+	}
+
+	return filters
+}
+
+// getChoice reads one of the values allowed, def being the first
+func getChoice(key string, def string, others ...string) string {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return def
+	}
+
+	value = strings.ToLower(strings.TrimSpace(value))
+	if value != def && !slices.Contains(others, value) {
+		log.Printf("Invalid value for %s (%q), using default %s", key, value, def)
+		return def
+	}
+
+	return value
+}
+
+func getInt(key string, def int) int {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return def
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid value for %s (%q), using default %d", key, value, def)
+		return def
+	}
+
+	return n
+}
+
+func getFloat(key string, def float64) float64 {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return def
+	}
+
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || f <= 0 {
+		log.Printf("Invalid value for %s (%q), using default %v", key, value, def)
+		return def
+	}
+
+	return f
+}
+
+// getSizes reads a list of positive integers, leaving out invalid ones
+func getSizes(key string, def []int) []int {
+	sizes := make([]int, 0)
+	for _, item := range getList(key) {
+		n, err := strconv.Atoi(item)
+		if err != nil || n <= 0 {
+			log.Printf("Invalid size in %s (%q), ignoring it", key, item)
+			continue
+		}
+		sizes = append(sizes, n)
+	}
+	if len(sizes) == 0 {
+		return def
+	}
+	return sizes
+}
+
+func getBool(key string, def bool) bool {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return def
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Invalid value for %s (%q), using default %v", key, value, def)
+		return def
+	}
+
+	return b
+}
+
+func getDuration(key string, def time.Duration) time.Duration {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return def
+	}
+
+	// zero only makes sense where it's the default, meaning no limit,
+	// intervals and timeouts must be positive
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 || (d == 0 && def != 0) {
+		log.Printf("Invalid value for %s (%q), using default %v", key, value, def)
+		return def
+	}
+
+	return d
+}
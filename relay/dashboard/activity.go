@@ -0,0 +1,122 @@
+package dashboard
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ActivityEntry is an event seen by the relay, Reason is only set for
+// rejected events.
+type ActivityEntry struct {
+	Time    time.Time
+	ID      string
+	Kind    int
+	PubKey  string
+	Content string
+	IP      string
+	Reason  string
+}
+
+// Activity keeps the most recent accepted and rejected events in memory so
+// the dashboard can show what is going on without touching the database.
+type Activity struct {
+	mu       sync.Mutex
+	size     int
+	accepted []ActivityEntry
+	rejected []ActivityEntry
+}
+
+func NewActivity(size int) *Activity {
+	return &Activity{
+		size:     size,
+		accepted: make([]ActivityEntry, 0, size),
+		rejected: make([]ActivityEntry, 0, size),
+	}
+}
+
+// EventSaved is meant to be added to relay.OnEventSaved
+func (a *Activity) EventSaved(ctx context.Context, event *nostr.Event) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.accepted = a.push(a.accepted, newEntry(ctx, event, ""))
+}
+
+// TrackRejections wraps every RejectEvent hook so the rejection reasons are
+// recorded, use it after all hooks were added:
+//
+//	relay.RejectEvent = activity.TrackRejections(relay.RejectEvent)
+func (a *Activity) TrackRejections(
+	hooks []func(ctx context.Context, event *nostr.Event) (bool, string),
+) []func(ctx context.Context, event *nostr.Event) (bool, string) {
+	wrapped := make([]func(ctx context.Context, event *nostr.Event) (bool, string), len(hooks))
+	for i, hook := range hooks {
+		wrapped[i] = func(ctx context.Context, event *nostr.Event) (bool, string) {
+			reject, msg := hook(ctx, event)
+			if reject {
+				a.mu.Lock()
+				a.rejected = a.push(a.rejected, newEntry(ctx, event, msg))
+				a.mu.Unlock()
+			}
+
+			return reject, msg
+		}
+	}
+
+	return wrapped
+}
+
+// Accepted returns the recent accepted events, newest first
+func (a *Activity) Accepted() []ActivityEntry {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return reversed(a.accepted)
+}
+
+// Rejected returns the recent rejected events, newest first
+func (a *Activity) Rejected() []ActivityEntry {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return reversed(a.rejected)
+}
+
+func (a *Activity) push(list []ActivityEntry, entry ActivityEntry) []ActivityEntry {
+	if len(list) >= a.size {
+		copy(list, list[1:])
+		list = list[:len(list)-1]
+	}
+
+	return append(list, entry)
+}
+
+func newEntry(ctx context.Context, event *nostr.Event, reason string) ActivityEntry {
+	content := event.Content
+	if runes := []rune(content); len(runes) > 120 {
+		content = string(runes[:120]) + "…"
+	}
+
+	return ActivityEntry{
+		Time:    time.Now(),
+		ID:      event.ID,
+		Kind:    event.Kind,
+		PubKey:  event.PubKey,
+		Content: content,
+		IP:      khatru.GetIP(ctx),
+		Reason:  reason,
+	}
+}
+
+func reversed(list []ActivityEntry) []ActivityEntry {
+	out := make([]ActivityEntry, len(list))
+	for i, entry := range list {
+		out[len(list)-1-i] = entry
+	}
+
+	return out
+}
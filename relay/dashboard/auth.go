@@ -0,0 +1,256 @@
+package dashboard
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	sessionCookie   = "relay_admin_session"
+	sessionDuration = 12 * time.Hour
+
+	// how far the NIP-98 created_at may be from our clock
+	authWindow = 60 * time.Second
+)
+
+type session struct {
+	pubkey  string
+	expires time.Time
+}
+
+type sessions struct {
+	mu   sync.Mutex
+	byID map[string]session
+}
+
+func (s *sessions) create(pubkey string) (string, time.Time) {
+	token := make([]byte, 32)
+	rand.Read(token)
+	id := hex.EncodeToString(token)
+	expires := time.Now().Add(sessionDuration)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// drop expired sessions while we are here
+	for id, sess := range s.byID {
+		if time.Now().After(sess.expires) {
+			delete(s.byID, id)
+		}
+	}
+	s.byID[id] = session{pubkey: pubkey, expires: expires}
+
+	return id, expires
+}
+
+func (s *sessions) get(id string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess, ok := s.byID[id]
+	if !ok || time.Now().After(sess.expires) {
+		delete(s.byID, id)
+		return "", false
+	}
+
+	return sess.pubkey, true
+}
+
+func (s *sessions) remove(id string) {
+	s.mu.Lock()
+	delete(s.byID, id)
+	s.mu.Unlock()
+}
+
+// validateNIP98 checks the "Authorization: Nostr <base64 event>" header
+// against the request and returns the pubkey that signed it.
+func (d *Dashboard) validateNIP98(r *http.Request) (string, error) {
+	auth := r.Header.Get("Authorization")
+	encoded, ok := strings.CutPrefix(auth, "Nostr ")
+	if !ok {
+		return "", errors.New("missing auth")
+	}
+
+	evtj, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", errors.New("invalid base64 auth")
+	}
+
+	var evt nostr.Event
+	if err := json.Unmarshal(evtj, &evt); err != nil {
+		return "", errors.New("invalid auth event json")
+	}
+
+	if evt.Kind != 27235 {
+		return "", errors.New("auth event must be kind 27235")
+	}
+
+	if ok, _ := evt.CheckSignature(); !ok {
+		return "", errors.New("invalid auth event signature")
+	}
+
+	createdAt := evt.CreatedAt.Time()
+	if time.Since(createdAt) > authWindow || time.Until(createdAt) > authWindow {
+		return "", errors.New("auth event is too old or in the future")
+	}
+
+	if uTag := evt.Tags.Find("u"); uTag == nil || nostr.NormalizeURL(uTag[1]) != nostr.NormalizeURL(d.requestURL(r)) {
+		return "", errors.New("invalid 'u' tag")
+	}
+
+	if methodTag := evt.Tags.Find("method"); methodTag == nil || !strings.EqualFold(methodTag[1], r.Method) {
+		return "", errors.New("invalid 'method' tag")
+	}
+
+	if payloadTag := evt.Tags.Find("payload"); payloadTag != nil {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return "", errors.New("failed to read body")
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		hash := sha256.Sum256(body)
+		if payloadTag[1] != hex.EncodeToString(hash[:]) {
+			return "", errors.New("invalid auth event payload hash")
+		}
+	}
+
+	return evt.PubKey, nil
+}
+
+// requestURL rebuilds the absolute URL the client used to reach us
+func (d *Dashboard) requestURL(r *http.Request) string {
+	if d.serviceURL != "" {
+		return strings.TrimRight(d.serviceURL, "/") + r.URL.Path
+	}
+
+	host := r.Header.Get("X-Forwarded-Host")
+	if host == "" {
+		host = r.Host
+	}
+
+	proto := r.Header.Get("X-Forwarded-Proto")
+	if proto == "" {
+		proto = "http"
+		if r.TLS != nil {
+			proto = "https"
+		}
+	}
+
+	return proto + "://" + host + r.URL.Path
+}
+
+// authenticated returns the admin pubkey behind the request, coming either
+// from a session cookie or from a NIP-98 header.
+func (d *Dashboard) authenticated(r *http.Request) (string, bool) {
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		if pubkey, ok := d.sessions.get(cookie.Value); ok && d.manager.IsAdmin(pubkey) {
+			return pubkey, true
+		}
+	}
+
+	if r.Header.Get("Authorization") != "" {
+		if pubkey, err := d.validateNIP98(r); err == nil && d.manager.IsAdmin(pubkey) {
+			return pubkey, true
+		}
+	}
+
+	return "", false
+}
+
+// RequireAdmin only lets admins through to next, also used for the admin
+// endpoints registered outside of the dashboard
+func (d *Dashboard) RequireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pubkey, ok := d.authenticated(r)
+		if !ok {
+			if r.Method == http.MethodGet {
+				http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
+			} else {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+			}
+			return
+		}
+
+		next(w, r.WithContext(context.WithValue(r.Context(), adminKey{}, pubkey)))
+	}
+}
+
+type adminKey struct{}
+
+// adminPubKey is the pubkey RequireAdmin let through. Checking again could
+// fail: a NIP-98 payload can't be hashed once the form consumed the body.
+func adminPubKey(ctx context.Context) string {
+	pubkey, _ := ctx.Value(adminKey{}).(string)
+	return pubkey
+}
+
+func (d *Dashboard) handleLoginPage(w http.ResponseWriter, r *http.Request) {
+	if _, ok := d.authenticated(r); ok {
+		http.Redirect(w, r, "/admin/", http.StatusSeeOther)
+		return
+	}
+
+	d.render(w, "login", map[string]any{
+		"Page": "login",
+		"Info": d.info(),
+	})
+}
+
+// handleLogin exchanges a NIP-98 authorization (usually signed with NIP-07 by
+// the login page) for a session cookie.
+func (d *Dashboard) handleLogin(w http.ResponseWriter, r *http.Request) {
+	pubkey, err := d.validateNIP98(r)
+	if err != nil {
+		http.Error(w, "unauthorized: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if !d.manager.IsAdmin(pubkey) {
+		http.Error(w, "unauthorized: "+pubkey+" is not an admin of this relay", http.StatusForbidden)
+		return
+	}
+
+	id, expires := d.sessions.create(pubkey)
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    id,
+		Path:     "/admin",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (d *Dashboard) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		d.sessions.remove(cookie.Value)
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    "",
+		Path:     "/admin",
+		MaxAge:   -1,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
+}
@@ -0,0 +1,286 @@
+package dashboard
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"nostr-relay/channels"
+	"nostr-relay/config"
+	"nostr-relay/management"
+
+	"github.com/fiatjaf/eventstore/sqlite3"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip11"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+//go:embed templates/*.html
+var templatesFS embed.FS
+
+var (
+	errInvalidID = errors.New("invalid event id")
+	errNotFound  = errors.New("event not found")
+)
+
+// Connection describes an open websocket for the connections list
+type Connection struct {
+	IP          string
+	UserAgent   string
+	PubKey      string
+	ConnectedAt time.Time
+}
+
+// Dashboard is a small server-rendered admin interface. All moderation goes
+// through the NIP-86 operations of the management.Manager so the dashboard
+// and the JSON-RPC API always agree.
+type Dashboard struct {
+	relay       *khatru.Relay
+	manager     *management.Manager
+	channels    *channels.Store
+	db          *sqlite3.SQLite3Backend
+	cfg         config.Config
+	activity    *Activity
+	connections func() []Connection
+
+	// removeEvent runs the relay DeleteEvent hooks, unless the relay is
+	// shutting down
+	removeEvent func(ctx context.Context, event *nostr.Event) error
+
+	serviceURL string
+	sessions   *sessions
+	templates  map[string]*template.Template
+}
+
+func New(
+	relay *khatru.Relay,
+	manager *management.Manager,
+	channels *channels.Store,
+	db *sqlite3.SQLite3Backend,
+	cfg config.Config,
+	activity *Activity,
+	connections func() []Connection,
+	removeEvent func(ctx context.Context, event *nostr.Event) error,
+) *Dashboard {
+	funcs := template.FuncMap{
+		"short": func(s string) string {
+			if len(s) <= 16 {
+				return s
+			}
+			return s[:8] + "…" + s[len(s)-8:]
+		},
+		"ago": func(t time.Time) string {
+			if t.IsZero() || t.Unix() == 0 {
+				return "never"
+			}
+			return time.Since(t).Truncate(time.Second).String() + " ago"
+		},
+		"npub": func(pubkey string) string {
+			npub, err := nip19.EncodePublicKey(pubkey)
+			if err != nil {
+				return pubkey
+			}
+			return npub
+		},
+	}
+
+	pages := []string{"login", "overview", "channels", "moderation", "config"}
+	templates := make(map[string]*template.Template, len(pages))
+	for _, page := range pages {
+		templates[page] = template.Must(template.New(page).Funcs(funcs).ParseFS(
+			templatesFS, "templates/layout.html", "templates/"+page+".html",
+		))
+	}
+
+	return &Dashboard{
+		relay:       relay,
+		manager:     manager,
+		channels:    channels,
+		db:          db,
+		cfg:         cfg,
+		activity:    activity,
+		connections: connections,
+		removeEvent: removeEvent,
+		serviceURL:  cfg.ServiceURL,
+		sessions:    &sessions{byID: make(map[string]session)},
+		templates:   templates,
+	}
+}
+
+// Register adds the dashboard routes under /admin/ to mux
+func (d *Dashboard) Register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /admin/login", d.handleLoginPage)
+	mux.HandleFunc("POST /admin/login", d.handleLogin)
+	mux.HandleFunc("POST /admin/logout", d.handleLogout)
+
+	mux.HandleFunc("GET /admin/{$}", d.RequireAdmin(d.handleOverview))
+	mux.HandleFunc("GET /admin/channels", d.RequireAdmin(d.handleChannels))
+	mux.HandleFunc("GET /admin/moderation", d.RequireAdmin(d.handleModeration))
+	mux.HandleFunc("GET /admin/config", d.RequireAdmin(d.handleConfig))
+
+	mux.HandleFunc("POST /admin/actions/{action}", d.RequireAdmin(d.handleAction))
+}
+
+// info is the NIP-11 document with the settings changed while running
+func (d *Dashboard) info() nip11.RelayInformationDocument {
+	return d.manager.Info(*d.relay.Info)
+}
+
+func (d *Dashboard) render(w http.ResponseWriter, page string, data map[string]any) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := d.templates[page].ExecuteTemplate(w, "layout", data); err != nil {
+		log.Printf("Failed to render dashboard page %s: %v", page, err)
+	}
+}
+
+func (d *Dashboard) handleOverview(w http.ResponseWriter, r *http.Request) {
+	d.render(w, "overview", map[string]any{
+		"Page":        "overview",
+		"Info":        d.info(),
+		"Connections": d.connections(),
+		"Accepted":    d.activity.Accepted(),
+		"Rejected":    d.activity.Rejected(),
+	})
+}
+
+func (d *Dashboard) handleChannels(w http.ResponseWriter, r *http.Request) {
+	list, err := d.channels.List(r.Context(), 200)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	d.render(w, "channels", map[string]any{
+		"Page":     "channels",
+		"Info":     d.info(),
+		"Channels": list,
+	})
+}
+
+func (d *Dashboard) handleModeration(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	data := map[string]any{
+		"Page": "moderation",
+		"Info": d.info(),
+	}
+
+	var err error
+	if data["BannedPubKeys"], err = d.manager.ListBannedPubKeys(ctx); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if data["BannedEvents"], err = d.manager.ListBannedEvents(ctx); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if data["BlockedIPs"], err = d.manager.ListBlockedIPs(ctx); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	d.render(w, "moderation", data)
+}
+
+func (d *Dashboard) handleConfig(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	data := map[string]any{
+		"Page":   "config",
+		"Info":   d.info(),
+		"Config": d.cfg,
+	}
+
+	var err error
+	if data["AllowedKinds"], err = d.manager.ListAllowedKinds(ctx); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if data["DisallowedKinds"], err = d.manager.ListDisallowedKinds(ctx); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	d.render(w, "config", data)
+}
+
+func (d *Dashboard) handleAction(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	reason := strings.TrimSpace(r.FormValue("reason"))
+
+	var err error
+	switch action := r.PathValue("action"); action {
+	case "ban-pubkey":
+		err = d.manager.BanPubKey(ctx, decodePubKey(r.FormValue("pubkey")), reason)
+	case "allow-pubkey":
+		err = d.manager.AllowPubKey(ctx, decodePubKey(r.FormValue("pubkey")), reason)
+	case "hide-event":
+		err = d.manager.BanEvent(ctx, strings.TrimSpace(r.FormValue("id")), reason)
+	case "unhide-event":
+		err = d.manager.AllowEvent(ctx, strings.TrimSpace(r.FormValue("id")), reason)
+	case "delete-event":
+		err = d.deleteEvent(ctx, strings.TrimSpace(r.FormValue("id")))
+	case "block-ip":
+		err = d.manager.BlockIP(ctx, net.ParseIP(strings.TrimSpace(r.FormValue("ip"))), reason)
+	case "unblock-ip":
+		err = d.manager.UnblockIP(ctx, net.ParseIP(strings.TrimSpace(r.FormValue("ip"))), reason)
+	case "relay-info":
+		if err = d.manager.ChangeRelayName(ctx, r.FormValue("name")); err == nil {
+			if err = d.manager.ChangeRelayDescription(ctx, r.FormValue("description")); err == nil {
+				err = d.manager.ChangeRelayIcon(ctx, r.FormValue("icon"))
+			}
+		}
+	default:
+		http.Error(w, "unknown action "+action, http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("Admin %s performed %s", adminPubKey(ctx), r.PathValue("action"))
+
+	redirect := r.FormValue("redirect")
+	if !strings.HasPrefix(redirect, "/admin/") {
+		redirect = "/admin/moderation"
+	}
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
+
+// deleteEvent removes an event from the store with removeEvent, which runs
+// the relay hooks so everything attached to DeleteEvent sees it.
+func (d *Dashboard) deleteEvent(ctx context.Context, id string) error {
+	if !nostr.IsValid32ByteHex(id) {
+		return errInvalidID
+	}
+
+	ch, err := d.db.QueryEvents(ctx, nostr.Filter{IDs: []string{id}})
+	if err != nil {
+		return err
+	}
+
+	event := <-ch
+	if event == nil {
+		return errNotFound
+	}
+
+	return d.removeEvent(ctx, event)
+}
+
+func decodePubKey(value string) string {
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, "npub1") {
+		if _, data, err := nip19.Decode(value); err == nil {
+			return data.(string)
+		}
+	}
+
+	return value
+}
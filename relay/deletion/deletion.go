@@ -0,0 +1,183 @@
+package deletion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"nostr-relay/channels"
+	"nostr-relay/kinds"
+
+	"github.com/fiatjaf/eventstore/sqlite3"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// deleted_event remembers the events removed by NIP-09 deletion requests, so
+// they can't be published again. channel_tombstone remembers the channels
+// deleted by their owner, which outlive their kind 40.
+var ddls = []string{
+	`CREATE TABLE IF NOT EXISTS deleted_event (
+       id text PRIMARY KEY,
+       pubkey text NOT NULL,
+       deleted_by text NOT NULL,
+       deleted_at integer NOT NULL);`,
+	`CREATE TABLE IF NOT EXISTS channel_tombstone (
+       id text PRIMARY KEY,
+       owner text NOT NULL,
+       deleted_at integer NOT NULL);`,
+}
+
+// Policy decides who can delete what and enforces the consequences
+type Policy struct {
+	db       *sqlite3.SQLite3Backend
+	channels *channels.Store
+
+	// isAdmin tells if a pubkey is a relay admin, who moderates every channel
+	isAdmin func(pubkey string) bool
+
+	// deleteEvent runs the relay DeleteEvent hooks, used to cascade the
+	// deletion of a channel to its metadata updates
+	deleteEvent func(ctx context.Context, event *nostr.Event) error
+
+	mu         sync.RWMutex
+	tombstones map[string]struct{}
+	// target id -> the deletion request allowed to delete it, recorded once
+	// the DeleteEvent hooks got to EventDeleted
+	pending map[string]pending
+}
+
+// pending is a deletion request allowed by OverwriteDeletionOutcome. khatru
+// runs the DeleteEvent hooks with the context it was allowed in, so when
+// its hooks failed, another deletion of the target (retention, expiration,
+// the dashboard) doesn't get it.
+type pending struct {
+	deletion *nostr.Event
+	ctx      context.Context
+}
+
+func New(
+	db *sqlite3.SQLite3Backend,
+	channelStore *channels.Store,
+	isAdmin func(pubkey string) bool,
+	deleteEvent func(ctx context.Context, event *nostr.Event) error,
+) (*Policy, error) {
+	for _, ddl := range ddls {
+		if _, err := db.Exec(ddl); err != nil {
+			return nil, fmt.Errorf("failed to create deletion tables: %w", err)
+		}
+	}
+
+	ids := make([]string, 0)
+	if err := db.Select(&ids, "SELECT id FROM channel_tombstone"); err != nil {
+		return nil, fmt.Errorf("failed to load channel tombstones: %w", err)
+	}
+
+	p := &Policy{
+		db:          db,
+		channels:    channelStore,
+		isAdmin:     isAdmin,
+		deleteEvent: deleteEvent,
+		tombstones:  make(map[string]struct{}, len(ids)),
+		pending:     make(map[string]pending),
+	}
+	for _, id := range ids {
+		p.tombstones[id] = struct{}{}
+	}
+
+	return p, nil
+}
+
+// IsTombstoned tells if the channel was deleted by its owner
+func (p *Policy) IsTombstoned(channelID string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	_, ok := p.tombstones[channelID]
+	return ok
+}
+
+// OverwriteDeletionOutcome is meant to be set as the only
+// relay.OverwriteDeletionOutcome hook. Authors can delete their own events;
+// messages can also be deleted by the channel owner, its moderators and
+// relay admins.
+func (p *Policy) OverwriteDeletionOutcome(ctx context.Context, target *nostr.Event, deletion *nostr.Event) (bool, string) {
+	allowed, err := p.canDelete(ctx, target, deletion.PubKey)
+	if err != nil {
+		log.Printf("Failed to check deletion of %s: %v", target.ID, err)
+		return false, "error: could not check permissions"
+	}
+	if !allowed {
+		if kinds.IsChannelMessage(target) {
+			return false, "only the author or a channel moderator can delete this message"
+		}
+		return false, "you are not the author of this event"
+	}
+
+	p.mu.Lock()
+	p.pending[target.ID] = pending{deletion: deletion, ctx: ctx}
+	p.mu.Unlock()
+
+	return true, ""
+}
+
+func (p *Policy) canDelete(ctx context.Context, target *nostr.Event, pubkey string) (bool, error) {
+	if target.PubKey == pubkey {
+		return true, nil
+	}
+
+	if !kinds.IsChannelMessage(target) {
+		return false, nil
+	}
+
+	if p.isAdmin != nil && p.isAdmin(pubkey) {
+		return true, nil
+	}
+
+	channel, err := p.channels.Get(ctx, kinds.ChannelID(target))
+	if errors.Is(err, channels.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return channel.CanModerate(pubkey), nil
+}
+
+func (p *Policy) record(ctx context.Context, target *nostr.Event, deletion *nostr.Event) error {
+	tx, err := p.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+        INSERT OR IGNORE INTO deleted_event (id, pubkey, deleted_by, deleted_at) VALUES ($1, $2, $3, $4)
+    `, target.ID, target.PubKey, deletion.PubKey, deletion.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	if target.Kind == 40 {
+		_, err = tx.ExecContext(ctx, `
+            INSERT OR IGNORE INTO channel_tombstone (id, owner, deleted_at) VALUES ($1, $2, $3)
+        `, target.ID, target.PubKey, deletion.CreatedAt)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if target.Kind == 40 {
+		p.mu.Lock()
+		p.tombstones[target.ID] = struct{}{}
+		p.mu.Unlock()
+	}
+
+	return nil
+}
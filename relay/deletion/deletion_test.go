@@ -0,0 +1,96 @@
+package deletion
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"nostr-relay/channels"
+	"nostr-relay/internal/testutil"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+type requestKey struct{}
+
+// TestFailedHooks checks a deletion request whose DeleteEvent hooks failed
+// isn't recorded when something else deletes its target later
+func TestFailedHooks(t *testing.T) {
+	db := testutil.DB(t, "deletion")
+	channelStore, err := channels.New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fail := true
+	var p *Policy
+	hooks := []func(ctx context.Context, event *nostr.Event) error{
+		db.DeleteEvent,
+		func(ctx context.Context, event *nostr.Event) error {
+			if fail {
+				return errors.New("hook failed")
+			}
+			return nil
+		},
+		func(ctx context.Context, event *nostr.Event) error { return p.EventDeleted(ctx, event) },
+	}
+	deleteEvent := func(ctx context.Context, event *nostr.Event) error {
+		for _, del := range hooks {
+			if err := del(ctx, event); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	p, err = New(db, channelStore, nil, deleteEvent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sk := nostr.GeneratePrivateKey()
+	save := testutil.Saver(t, db)
+	target := save(sk, nostr.Event{Kind: 1, CreatedAt: 1000, Content: "to delete"})
+	deletion := save(sk, nostr.Event{Kind: 5, CreatedAt: 2000, Tags: nostr.Tags{{"e", target.ID}}})
+
+	deleted := func() bool {
+		var count int
+		if err := db.Get(&count, "SELECT COUNT(*) FROM deleted_event WHERE id = $1", target.ID); err != nil {
+			t.Fatal(err)
+		}
+		return count > 0
+	}
+
+	// a NIP-09 request, like khatru runs it
+	request := context.WithValue(context.Background(), requestKey{}, 1)
+	if allowed, msg := p.OverwriteDeletionOutcome(request, &target, &deletion); !allowed {
+		t.Fatalf("deletion refused: %s", msg)
+	}
+	if err := deleteEvent(request, &target); err == nil {
+		t.Fatal("expected the hooks to fail")
+	}
+	if deleted() {
+		t.Fatal("deletion recorded although its hooks failed")
+	}
+
+	// then retention removes it
+	fail = false
+	if err := deleteEvent(context.Background(), &target); err != nil {
+		t.Fatal(err)
+	}
+	if deleted() {
+		t.Error("deletion recorded for a later relay deletion")
+	}
+
+	// the request is recorded once its own hooks succeed
+	target = save(sk, nostr.Event{Kind: 1, CreatedAt: 1001, Content: "to delete"})
+	request = context.WithValue(context.Background(), requestKey{}, 2)
+	if allowed, msg := p.OverwriteDeletionOutcome(request, &target, &deletion); !allowed {
+		t.Fatalf("deletion refused: %s", msg)
+	}
+	if err := deleteEvent(request, &target); err != nil {
+		t.Fatal(err)
+	}
+	if !deleted() {
+		t.Error("deletion not recorded")
+	}
+}
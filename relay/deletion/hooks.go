@@ -0,0 +1,142 @@
+package deletion
+
+import (
+	"context"
+	"fmt"
+
+	"nostr-relay/kinds"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// RejectEvent refuses deleted events published again and anything posted
+// to a deleted channel
+func (p *Policy) RejectEvent(ctx context.Context, event *nostr.Event) (bool, string) {
+	var count int
+	if err := p.db.GetContext(ctx, &count, "SELECT COUNT(*) FROM deleted_event WHERE id = $1", event.ID); err != nil {
+		return true, "error: could not check deletions"
+	}
+	if count > 0 {
+		return true, "blocked: this event has been deleted"
+	}
+
+	if p.referencesTombstone(event) {
+		return true, "blocked: this channel has been deleted"
+	}
+
+	return false, ""
+}
+
+func (p *Policy) referencesTombstone(event *nostr.Event) bool {
+	switch {
+	case event.Kind == 40:
+		return p.IsTombstoned(event.ID)
+	case event.Kind == 41 || kinds.IsChannelMessage(event):
+		return p.IsTombstoned(kinds.ChannelID(event))
+	}
+
+	return false
+}
+
+// HideTombstoned wraps a QueryEvents hook so the metadata of deleted
+// channels isn't returned, even if some of it is still stored. Internal
+// calls see everything.
+func (p *Policy) HideTombstoned(
+	query func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error),
+) func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	return func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		ch, err := query(ctx, filter)
+		if err != nil || khatru.IsInternalCall(ctx) {
+			return ch, err
+		}
+
+		filtered := make(chan *nostr.Event)
+		go func() {
+			defer close(filtered)
+			for event := range ch {
+				if (event.Kind == 40 || event.Kind == 41) && p.referencesTombstone(event) {
+					continue
+				}
+
+				select {
+				case filtered <- event:
+				case <-ctx.Done():
+					for range ch {
+					}
+					return
+				}
+			}
+		}()
+
+		return filtered, nil
+	}
+}
+
+// VisibleSQL is the condition of HideTombstoned for the visible store
+func (p *Policy) VisibleSQL() (string, []any) {
+	return `NOT (e.kind = 40 AND e.id IN (SELECT id FROM channel_tombstone))
+        AND NOT (e.kind = 41 AND ` + kinds.ChannelIDSQL + ` IN (SELECT id FROM channel_tombstone))`, nil
+}
+
+// EventDeleted is meant to be the last relay.DeleteEvent hook, so a
+// deletion request is only remembered once the event is gone. Deleting a
+// channel deletes its metadata updates too.
+func (p *Policy) EventDeleted(ctx context.Context, event *nostr.Event) error {
+	p.mu.Lock()
+	allowed, ok := p.pending[event.ID]
+	delete(p.pending, event.ID)
+	p.mu.Unlock()
+
+	// recorded before the cascade, so it sees the tombstone. A request
+	// allowed in another context is left from hooks that failed.
+	if ok && allowed.ctx == ctx {
+		if err := p.record(ctx, event, allowed.deletion); err != nil {
+			return fmt.Errorf("failed to record deletion of %s: %w", event.ID, err)
+		}
+	}
+
+	if event.Kind != 40 || !p.IsTombstoned(event.ID) {
+		return nil
+	}
+
+	updates, err := p.loadUpdates(ctx, event.ID)
+	if err != nil {
+		return err
+	}
+
+	for _, update := range updates {
+		if err := p.deleteEvent(ctx, update); err != nil {
+			return fmt.Errorf("failed to delete channel update %s: %w", update.ID, err)
+		}
+	}
+
+	return nil
+}
+
+func (p *Policy) loadUpdates(ctx context.Context, channelID string) ([]*nostr.Event, error) {
+	rows, err := p.db.QueryContext(ctx, `
+        SELECT id, pubkey, created_at, kind, tags, content, sig FROM event
+        WHERE kind = 41 AND tags LIKE '%' || $1 || '%'
+    `, channelID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load channel updates: %w", err)
+	}
+	defer rows.Close()
+
+	updates := make([]*nostr.Event, 0)
+	for rows.Next() {
+		var event nostr.Event
+		var createdAt int64
+		if err := rows.Scan(&event.ID, &event.PubKey, &createdAt, &event.Kind, &event.Tags, &event.Content, &event.Sig); err != nil {
+			return nil, err
+		}
+		event.CreatedAt = nostr.Timestamp(createdAt)
+
+		if kinds.ChannelID(&event) == channelID {
+			updates = append(updates, &event)
+		}
+	}
+
+	return updates, rows.Err()
+}
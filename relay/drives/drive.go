@@ -0,0 +1,108 @@
+package drives
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Kind is a blossom drive, which lists the files of characters,
+// backgrounds and fonts
+const Kind = 30563
+
+// ServerListKind is the list of Blossom servers of a user (BUD-03)
+const ServerListKind = 10063
+
+// Blob is a file of a drive, from an "x" tag: hash, path, size and MIME type
+type Blob struct {
+	SHA256 string `json:"sha256"`
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	Type   string `json:"type"`
+}
+
+// Drive is what a 30563 event declares
+type Drive struct {
+	Event   *nostr.Event
+	D       string
+	Name    string
+	Servers []string
+	Blobs   []Blob
+}
+
+// Parse reads the tags of a drive event, malformed "x" tags are kept so
+// they show up as broken
+func Parse(event *nostr.Event) Drive {
+	drive := Drive{Event: event, D: event.Tags.GetD()}
+	for _, tag := range event.Tags {
+		if len(tag) < 2 {
+			continue
+		}
+
+		switch tag[0] {
+		case "name":
+			drive.Name = tag[1]
+		case "server":
+			drive.Servers = append(drive.Servers, tag[1])
+		case "x":
+			blob := Blob{SHA256: tag[1]}
+			if len(tag) > 2 {
+				blob.Path = tag[2]
+			}
+			if len(tag) > 3 {
+				blob.Size, _ = strconv.ParseInt(tag[3], 10, 64)
+			}
+			if len(tag) > 4 {
+				blob.Type = tag[4]
+			}
+			drive.Blobs = append(drive.Blobs, blob)
+		}
+	}
+	return drive
+}
+
+// Address is the NIP-01 address of the drive, "30563:<pubkey>:<d>"
+func (d Drive) Address() string {
+	return address(d.Event.PubKey, d.D)
+}
+
+// Reference is the address of the drive a channel message is drawn with,
+// from its "drive" tag: either a full address or the "d" of a drive, of the
+// pubkey that follows or else of the author of the message
+func Reference(event *nostr.Event) (string, bool) {
+	tag := event.Tags.Find("drive")
+	if tag == nil || tag[1] == "" {
+		return "", false
+	}
+
+	if kind, rest, ok := strings.Cut(tag[1], ":"); ok && kind == strconv.Itoa(Kind) {
+		pubkey, d, ok := strings.Cut(rest, ":")
+		if !ok || !nostr.IsValidPublicKey(pubkey) {
+			return "", false
+		}
+		return address(pubkey, d), true
+	}
+
+	pubkey := event.PubKey
+	if len(tag) > 2 && nostr.IsValidPublicKey(tag[2]) {
+		pubkey = tag[2]
+	}
+	return address(pubkey, tag[1]), true
+}
+
+func address(pubkey string, d string) string {
+	return fmt.Sprintf("%d:%s:%s", Kind, pubkey, d)
+}
+
+// Asset is the character, background or font a path belongs to, its first
+// two segments: "/characters/char1/emotion-a" is part of
+// "characters/char1"
+func Asset(path string) string {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	if len(segments) > 2 {
+		segments = segments[:2]
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,174 @@
+package drives
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/fiatjaf/eventstore/sqlite3"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// drive_health has the last report of every drive
+var ddls = []string{
+	`CREATE TABLE IF NOT EXISTS drive_health (
+       address text PRIMARY KEY,
+       event_id text NOT NULL,
+       pubkey text NOT NULL,
+       created_at integer NOT NULL,
+       healthy integer NOT NULL,
+       checked_at integer NOT NULL,
+       report text NOT NULL);`,
+	`CREATE INDEX IF NOT EXISTS drive_health_healthy ON drive_health (healthy, checked_at DESC);`,
+}
+
+// Options tune the verifier, zero values use the defaults
+type Options struct {
+	// MaxSize is the largest blob downloaded, in bytes
+	MaxSize int64
+
+	// Timeout bounds the download of a blob
+	Timeout time.Duration
+
+	// Concurrency is how many blobs of a drive are fetched at once
+	Concurrency int
+
+	// QueueSize is how many new drives can wait to be verified, more are
+	// left unverified
+	QueueSize int
+}
+
+func (o Options) withDefaults() Options {
+	if o.MaxSize <= 0 {
+		o.MaxSize = 10 << 20
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = 30 * time.Second
+	}
+	if o.Concurrency <= 0 {
+		o.Concurrency = 4
+	}
+	if o.QueueSize <= 0 {
+		o.QueueSize = 64
+	}
+	return o
+}
+
+// Verifier checks that the blobs listed by drives exist and match what the
+// drives declare, and keeps the last report of every drive
+type Verifier struct {
+	db      *sqlite3.SQLite3Backend
+	store   Store
+	query   QueryFunc
+	client  *http.Client
+	options Options
+
+	// queue has the drives saved since, waiting for the worker
+	queue chan *nostr.Event
+}
+
+// New creates a verifier looking for blobs in store, which can be nil, and
+// for the server lists of authors with query
+func New(db *sqlite3.SQLite3Backend, store Store, query QueryFunc, options Options) (*Verifier, error) {
+	for _, ddl := range ddls {
+		if _, err := db.Exec(ddl); err != nil {
+			return nil, fmt.Errorf("failed to create drive health tables: %w", err)
+		}
+	}
+
+	options = options.withDefaults()
+	return &Verifier{
+		db:      db,
+		store:   store,
+		query:   query,
+		client:  &http.Client{Timeout: options.Timeout},
+		options: options,
+		queue:   make(chan *nostr.Event, options.QueueSize),
+	}, nil
+}
+
+// EventSaved queues new drives for the worker, it's meant to be added to
+// relay.OnEventSaved
+func (v *Verifier) EventSaved(ctx context.Context, event *nostr.Event) {
+	if event.Kind != Kind {
+		return
+	}
+
+	select {
+	case v.queue <- event:
+	default:
+		log.Printf("Drive verification queue is full, %s isn't verified", event.ID)
+	}
+}
+
+// Run verifies the queued drives one after the other, until ctx is done
+func (v *Verifier) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-v.queue:
+			report, err := v.Check(ctx, event)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Printf("Failed to verify drive %s: %v", event.ID, err)
+				}
+				continue
+			}
+			if !report.Healthy {
+				log.Printf("Drive %s is broken: %s", report.Address, summary(report))
+			}
+		}
+	}
+}
+
+// Check verifies a drive and saves its report, unless a newer version of the
+// drive was checked since
+func (v *Verifier) Check(ctx context.Context, event *nostr.Event) (Report, error) {
+	report, err := v.Verify(ctx, event)
+	if err != nil {
+		return report, err
+	}
+
+	reportj, err := json.Marshal(report)
+	if err != nil {
+		return report, err
+	}
+	_, err = v.db.ExecContext(ctx, `
+        INSERT INTO drive_health (address, event_id, pubkey, created_at, healthy, checked_at, report) VALUES (?, ?, ?, ?, ?, ?, ?)
+        ON CONFLICT (address) DO UPDATE SET event_id = excluded.event_id, created_at = excluded.created_at,
+          healthy = excluded.healthy, checked_at = excluded.checked_at, report = excluded.report
+        WHERE excluded.created_at >= drive_health.created_at
+    `, report.Address, report.EventID, event.PubKey, report.CreatedAt, report.Healthy, report.CheckedAt, reportj)
+	if err != nil {
+		return report, fmt.Errorf("failed to save the report: %w", err)
+	}
+
+	return report, nil
+}
+
+// summary counts the blobs of a report by status
+func summary(report Report) string {
+	counts := make(map[Status]int)
+	order := make([]Status, 0)
+	for _, asset := range report.Assets {
+		for _, blob := range asset.Blobs {
+			if counts[blob.Status] == 0 {
+				order = append(order, blob.Status)
+			}
+			counts[blob.Status]++
+		}
+	}
+
+	s := ""
+	for i, status := range order {
+		if i > 0 {
+			s += ", "
+		}
+		s += fmt.Sprintf("%d %s", counts[status], status)
+	}
+	return s
+}
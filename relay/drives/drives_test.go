@@ -0,0 +1,201 @@
+package drives
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"nostr-relay/internal/testutil"
+
+	"github.com/andybalholm/brotli"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// woff2 makes a font with a single head table
+func woff2() []byte {
+	table := bytes.Repeat([]byte{1}, 54)
+	var compressed bytes.Buffer
+	w := brotli.NewWriter(&compressed)
+	w.Write(table)
+	w.Close()
+
+	header := make([]byte, 48)
+	copy(header, "wOF2\x00\x01\x00\x00")
+	binary.BigEndian.PutUint16(header[12:], 1)
+	binary.BigEndian.PutUint32(header[20:], uint32(compressed.Len()))
+
+	// head, untransformed, then its length
+	font := append(header, 1, byte(len(table)))
+	font = append(font, compressed.Bytes()...)
+	binary.BigEndian.PutUint32(font[8:], uint32(len(font)))
+	return font
+}
+
+func TestVerify(t *testing.T) {
+	db := testutil.DB(t, "drives")
+
+	svg := func(fill string) []byte {
+		return []byte(`<svg xmlns="http://www.w3.org/2000/svg"><circle r="4" fill="` + fill + `"/></svg>`)
+	}
+	happy, sad, bg, font := svg("#ff0"), svg("#00f"), svg("#0f0"), woff2()
+	evil := []byte(`<svg xmlns="http://www.w3.org/2000/svg" onload="alert(1)"/>`)
+	brokenFont := append([]byte("wOF2\x00\x01\x00\x00"), bytes.Repeat([]byte{0}, 60)...)
+	tampered := svg("#f00")
+
+	// the server of the author has most blobs, one of them tampered with
+	served := map[string][]byte{sum(sad): sad, sum(bg): bg, sum(font): font, sum(evil): evil, sum(brokenFont): brokenFont,
+		sum(svg("#fff")): tampered}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := served[strings.TrimPrefix(r.URL.Path, "/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	}))
+	t.Cleanup(server.Close)
+
+	sk := nostr.GeneratePrivateKey()
+	servers := nostr.Event{Kind: ServerListKind, CreatedAt: nostr.Now(), Tags: nostr.Tags{{"server", server.URL + "/"}}}
+	servers.Sign(sk)
+	if err := db.SaveEvent(context.Background(), &servers); err != nil {
+		t.Fatal(err)
+	}
+
+	x := func(data []byte, path string, size int, mimeType string) nostr.Tag {
+		return nostr.Tag{"x", sum(data), path, strconv.Itoa(size), mimeType}
+	}
+	drive := nostr.Event{Kind: Kind, CreatedAt: nostr.Now(), Tags: nostr.Tags{
+		{"d", "my-characters"},
+		{"name", "My characters"},
+		x(happy, "/characters/robo/happy", len(happy), "image/svg+xml"),
+		x(sad, "/characters/robo/sad", len(sad), "image/svg+xml"),
+		x(bg, "/backgrounds/park", len(bg)+1, "image/svg+xml"),
+		x(font, "fonts/roboto", len(font), "application/font-woff2"),
+		x(brokenFont, "fonts/broken", len(brokenFont), "font/woff2"),
+		x(evil, "/characters/evil/hello", len(evil), "image/svg+xml"),
+		x(svg("#fff"), "/characters/ghost/boo", len(tampered), "image/svg+xml"),
+		x([]byte("nowhere"), "/characters/ghost/profile", 7, "image/svg+xml"),
+		{"x", "", "/characters/ghost/nohash", "1", "image/svg+xml"},
+	}}
+	drive.Sign(sk)
+
+	verifier, err := New(db, testutil.Blobs{sum(happy): happy}, db.QueryEvents, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := verifier.Check(context.Background(), &drive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Healthy || report.Address != "30563:"+drive.PubKey+":my-characters" {
+		t.Errorf("report: %+v", report)
+	}
+
+	want := map[string]Status{
+		"/characters/robo/happy":    OK,
+		"/characters/robo/sad":      OK,
+		"/backgrounds/park":         Mismatch,
+		"fonts/roboto":              OK,
+		"fonts/broken":              Invalid,
+		"/characters/evil/hello":    Unsafe,
+		"/characters/ghost/boo":     Corrupt,
+		"/characters/ghost/profile": Missing,
+		"/characters/ghost/nohash":  Invalid,
+	}
+	healthy := map[string]bool{"characters/robo": true, "fonts/roboto": true}
+	for _, asset := range report.Assets {
+		if asset.Healthy != healthy[asset.Name] {
+			t.Errorf("%s healthy: %v", asset.Name, asset.Healthy)
+		}
+		for _, blob := range asset.Blobs {
+			if blob.Status != want[blob.Path] {
+				t.Errorf("%s: %s %v, want %s", blob.Path, blob.Status, blob.Problems, want[blob.Path])
+			}
+			delete(want, blob.Path)
+		}
+	}
+	if len(want) > 0 {
+		t.Errorf("not in the report: %v", want)
+	}
+	if len(report.Assets) != 6 {
+		t.Errorf("%d assets", len(report.Assets))
+	}
+
+	t.Run("sources", func(t *testing.T) {
+		for _, asset := range report.Assets {
+			for _, blob := range asset.Blobs {
+				switch blob.Path {
+				case "/characters/robo/happy":
+					if blob.Source != "local" {
+						t.Errorf("happy from %s", blob.Source)
+					}
+				case "/characters/robo/sad":
+					if blob.Source != server.URL+"/"+sum(sad) {
+						t.Errorf("sad from %s", blob.Source)
+					}
+				}
+			}
+		}
+	})
+
+	t.Run("saved", func(t *testing.T) {
+		reports, err := verifier.Reports(context.Background(), true)
+		if err != nil || len(reports) != 1 || reports[0].EventID != drive.ID {
+			t.Fatalf("broken drives: %v %+v", err, reports)
+		}
+
+		// an older version of the drive checked later doesn't replace it
+		older := drive
+		older.CreatedAt--
+		older.Tags = nostr.Tags{{"d", "my-characters"}, x(happy, "/characters/robo/happy", len(happy), "image/svg+xml")}
+		older.Sign(sk)
+		if _, err := verifier.Check(context.Background(), &older); err != nil {
+			t.Fatal(err)
+		}
+		reports, _ = verifier.Reports(context.Background(), false)
+		if len(reports) != 1 || reports[0].EventID != drive.ID {
+			t.Errorf("reports: %+v", reports)
+		}
+	})
+
+	t.Run("in the background", func(t *testing.T) {
+		fixed := drive
+		fixed.CreatedAt++
+		fixed.Tags = nostr.Tags{{"d", "my-characters"}, x(happy, "/characters/robo/happy", len(happy), "image/svg+xml")}
+		fixed.Sign(sk)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go verifier.Run(ctx)
+
+		verifier.EventSaved(ctx, &servers)
+		verifier.EventSaved(ctx, &fixed)
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if reports, _ := verifier.Reports(ctx, true); len(reports) == 0 {
+				return
+			}
+		}
+		t.Error("the fixed drive wasn't verified")
+	})
+}
+
+func TestAsset(t *testing.T) {
+	for path, want := range map[string]string{
+		"/characters/char1/emotion-a": "characters/char1",
+		"fonts/font-roboto":           "fonts/font-roboto",
+		"/backgrounds/bg1":            "backgrounds/bg1",
+		"profile.svg":                 "profile.svg",
+	} {
+		if got := Asset(path); got != want {
+			t.Errorf("Asset(%q) = %s, want %s", path, got, want)
+		}
+	}
+}
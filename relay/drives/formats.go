@@ -0,0 +1,27 @@
+package drives
+
+import "mime"
+
+// aliases are older names of the types drives declare
+var aliases = map[string]string{
+	"application/font-woff2":   "font/woff2",
+	"application/x-font-woff2": "font/woff2",
+	"application/font-woff":    "font/woff",
+	"application/x-font-woff":  "font/woff",
+	"application/x-font-ttf":   "font/ttf",
+	"application/font-sfnt":    "font/ttf",
+	"application/x-font-otf":   "font/otf",
+	"image/svg":                "image/svg+xml",
+	"image/jpg":                "image/jpeg",
+}
+
+// normalizeType is a MIME type without parameters, older aliases replaced
+func normalizeType(mimeType string) string {
+	if parsed, _, err := mime.ParseMediaType(mimeType); err == nil {
+		mimeType = parsed
+	}
+	if alias, ok := aliases[mimeType]; ok {
+		return alias
+	}
+	return mimeType
+}
@@ -0,0 +1,53 @@
+package drives
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// Reports returns the last report of every drive, or of the broken ones
+// only, the most recently checked first
+func (v *Verifier) Reports(ctx context.Context, brokenOnly bool) ([]Report, error) {
+	query := "SELECT report FROM drive_health ORDER BY checked_at DESC"
+	if brokenOnly {
+		query = "SELECT report FROM drive_health WHERE healthy = 0 ORDER BY checked_at DESC"
+	}
+
+	rows, err := v.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reports := make([]Report, 0)
+	for rows.Next() {
+		var reportj []byte
+		if err := rows.Scan(&reportj); err != nil {
+			return nil, err
+		}
+		var report Report
+		if err := json.Unmarshal(reportj, &report); err != nil {
+			return nil, err
+		}
+		reports = append(reports, report)
+	}
+
+	return reports, rows.Err()
+}
+
+// HandleStatus serves the reports as JSON, the broken drives only with
+// ?broken=true. It's meant to be behind the admin authentication of the
+// dashboard.
+func (v *Verifier) HandleStatus(w http.ResponseWriter, r *http.Request) {
+	reports, err := v.Reports(r.Context(), r.URL.Query().Get("broken") == "true")
+	if err != nil {
+		log.Printf("Failed to load the drive reports: %v", err)
+		http.Error(w, "could not load the drive reports", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reports)
+}
@@ -0,0 +1,333 @@
+package drives
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"nostr-relay/blossom"
+	"nostr-relay/sanitize"
+	"nostr-relay/typeset"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Status is the health of a blob
+type Status string
+
+const (
+	// OK blobs were found, match their hash, size and type and are well
+	// formed
+	OK Status = "ok"
+	// Missing blobs couldn't be found anywhere
+	Missing Status = "missing"
+	// Corrupt blobs were only found with another hash
+	Corrupt Status = "corrupt"
+	// Mismatch blobs don't have the size or the type the drive declares
+	Mismatch Status = "mismatch"
+	// Invalid blobs aren't well-formed SVGs or fonts
+	Invalid Status = "invalid"
+	// Unsafe SVGs could run scripts or load something once rendered inline
+	Unsafe Status = "unsafe"
+)
+
+// BlobReport is how a blob of a drive is doing
+type BlobReport struct {
+	Blob
+	Status   Status   `json:"status"`
+	Source   string   `json:"source,omitempty"`
+	Problems []string `json:"problems,omitempty"`
+}
+
+// AssetReport is how a character, a background or a font is doing, it's
+// healthy when all of its blobs are
+type AssetReport struct {
+	Name    string       `json:"name"`
+	Healthy bool         `json:"healthy"`
+	Blobs   []BlobReport `json:"blobs"`
+}
+
+// Report is the health of every asset of a drive
+type Report struct {
+	Address   string          `json:"address"`
+	EventID   string          `json:"event_id"`
+	Name      string          `json:"name,omitempty"`
+	CreatedAt nostr.Timestamp `json:"created_at"`
+	CheckedAt nostr.Timestamp `json:"checked_at"`
+	Healthy   bool            `json:"healthy"`
+	Assets    []AssetReport   `json:"assets"`
+}
+
+// Store has blobs on the local disk, like the built-in Blossom server
+type Store interface {
+	Open(ctx context.Context, sha256 string) (io.ReadCloser, error)
+}
+
+// QueryFunc finds the server lists of authors, like QueryEvents hooks
+type QueryFunc func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error)
+
+// fetched is a blob found by its hash, shared by the paths of a drive that
+// have the same content
+type fetched struct {
+	data     []byte
+	source   string
+	status   Status
+	problems []string
+}
+
+// Verify checks every blob of a drive: each is looked up in the local store,
+// then on its Servers, hashed, compared with what the drive declares and, for SVGs and
+// WOFF2 fonts, parsed.
+func (v *Verifier) Verify(ctx context.Context, event *nostr.Event) (Report, error) {
+	drive := Parse(event)
+	report := Report{
+		Address:   drive.Address(),
+		EventID:   event.ID,
+		Name:      drive.Name,
+		CreatedAt: event.CreatedAt,
+		CheckedAt: nostr.Now(),
+		Healthy:   true,
+		Assets:    make([]AssetReport, 0),
+	}
+
+	servers, err := Servers(ctx, v.query, drive)
+	if err != nil {
+		return report, err
+	}
+
+	// every hash is fetched once, however many paths have it
+	unique := make([]string, 0, len(drive.Blobs))
+	for _, blob := range drive.Blobs {
+		if isHash(blob.SHA256) && !slices.Contains(unique, blob.SHA256) {
+			unique = append(unique, blob.SHA256)
+		}
+	}
+
+	hashes := make(map[string]*fetched, len(unique))
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	limit := make(chan struct{}, v.options.Concurrency)
+	for _, hash := range unique {
+		wg.Add(1)
+		limit <- struct{}{}
+		go func() {
+			defer func() { <-limit; wg.Done() }()
+
+			f := v.fetch(ctx, hash, servers)
+			mu.Lock()
+			hashes[hash] = f
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return report, err
+	}
+
+	assets := make(map[string]int)
+	for _, blob := range drive.Blobs {
+		name := Asset(blob.Path)
+		i, ok := assets[name]
+		if !ok {
+			i = len(report.Assets)
+			assets[name] = i
+			report.Assets = append(report.Assets, AssetReport{Name: name, Healthy: true})
+		}
+
+		b := check(blob, hashes[blob.SHA256])
+		report.Assets[i].Blobs = append(report.Assets[i].Blobs, b)
+		if b.Status != OK {
+			report.Assets[i].Healthy = false
+			report.Healthy = false
+		}
+	}
+
+	return report, nil
+}
+
+// Servers are where the blobs of a drive are looked for: the servers of the
+// drive first, then those of its author's latest server list, found with
+// query when it's not nil
+func Servers(ctx context.Context, query QueryFunc, drive Drive) ([]string, error) {
+	servers := make([]string, 0)
+	add := func(url string) {
+		url = strings.TrimSuffix(strings.TrimSpace(url), "/")
+		if (strings.HasPrefix(url, "https://") || strings.HasPrefix(url, "http://")) && !slices.Contains(servers, url) {
+			servers = append(servers, url)
+		}
+	}
+
+	for _, url := range drive.Servers {
+		add(url)
+	}
+
+	if query == nil {
+		return servers, nil
+	}
+	ch, err := query(ctx, nostr.Filter{Kinds: []int{ServerListKind}, Authors: []string{drive.Event.PubKey}, Limit: 1})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the server list of %s: %w", drive.Event.PubKey, err)
+	}
+	var latest *nostr.Event
+	for event := range ch {
+		if latest == nil || event.CreatedAt > latest.CreatedAt {
+			latest = event
+		}
+	}
+	if latest != nil {
+		for _, tag := range latest.Tags {
+			if len(tag) >= 2 && tag[0] == "server" {
+				add(tag[1])
+			}
+		}
+	}
+
+	return servers, nil
+}
+
+// fetch finds a blob with the right hash, locally or on the first server
+// that has it
+func (v *Verifier) fetch(ctx context.Context, hash string, servers []string) *fetched {
+	f := &fetched{status: Missing}
+
+	if v.store != nil {
+		data, err := v.readLocal(ctx, hash)
+		switch {
+		case err == nil && sum(data) == hash:
+			return &fetched{data: data, source: "local"}
+		case err == nil:
+			f.status = Corrupt
+			f.problems = append(f.problems, "local copy has another hash")
+		case !errors.Is(err, blossom.ErrNotFound):
+			f.problems = append(f.problems, fmt.Sprintf("local: %v", err))
+		}
+	}
+
+	for _, server := range servers {
+		url := server + "/" + hash
+		data, err := v.download(ctx, url)
+		switch {
+		case err == nil && sum(data) == hash:
+			return &fetched{data: data, source: url}
+		case err == nil:
+			f.status = Corrupt
+			f.problems = append(f.problems, fmt.Sprintf("%s: content has another hash", server))
+		default:
+			f.problems = append(f.problems, fmt.Sprintf("%s: %v", server, err))
+		}
+	}
+
+	if len(servers) == 0 && v.store == nil {
+		f.problems = append(f.problems, "no server to look for it")
+	}
+	return f
+}
+
+func (v *Verifier) readLocal(ctx context.Context, hash string) ([]byte, error) {
+	file, err := v.store.Open(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return readAll(file, v.options.MaxSize)
+}
+
+func (v *Verifier) download(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return readAll(resp.Body, v.options.MaxSize)
+}
+
+// readAll reads up to limit bytes, failing when there is more
+func readAll(r io.Reader, limit int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("larger than %d bytes", limit)
+	}
+	return data, nil
+}
+
+// check compares a blob with what the drive declares about it
+func check(blob Blob, f *fetched) BlobReport {
+	b := BlobReport{Blob: blob, Status: OK}
+	if !isHash(blob.SHA256) {
+		b.Status = Invalid
+		b.Problems = []string{"no valid sha256"}
+		return b
+	}
+	if f.data == nil {
+		b.Status = f.status
+		b.Problems = f.problems
+		return b
+	}
+	b.Source = f.source
+
+	if size := int64(len(f.data)); size != blob.Size {
+		b.Status = Mismatch
+		b.Problems = append(b.Problems, fmt.Sprintf("size is %d, the drive declares %d", size, blob.Size))
+	}
+	declared := normalizeType(blob.Type)
+	actual := normalizeType(blossom.DetectType(declared, f.data[:min(len(f.data), 512)]))
+	if actual != declared {
+		b.Status = Mismatch
+		b.Problems = append(b.Problems, fmt.Sprintf("type is %s, the drive declares %s", actual, blob.Type))
+	}
+
+	switch actual {
+	case "image/svg+xml":
+		_, report, err := sanitize.SVG(f.data, false)
+		if err != nil {
+			b.Status = Invalid
+			b.Problems = append(b.Problems, err.Error())
+		} else if !report.Clean() {
+			if b.Status == OK {
+				b.Status = Unsafe
+			}
+			for _, removal := range report.Removed {
+				b.Problems = append(b.Problems, removal.String())
+			}
+		}
+	case "font/woff2":
+		if err := typeset.CheckWOFF2(f.data); err != nil {
+			b.Status = Invalid
+			b.Problems = append(b.Problems, "woff2: "+err.Error())
+		}
+	}
+
+	return b
+}
+
+func sum(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+func isHash(s string) bool {
+	if len(s) != 64 || strings.ToLower(s) != s {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
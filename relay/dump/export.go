@@ -0,0 +1,146 @@
+package dump
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/fiatjaf/eventstore/sqlite3"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Export streams every event matching any of filters to w as JSON lines,
+// oldest first. Unlike relay queries there is no implicit limit, the largest
+// filter Limit is only applied when set.
+func Export(ctx context.Context, db *sqlite3.SQLite3Backend, filters nostr.Filters, w io.Writer) (int, error) {
+	query, params := exportSQL(filters)
+
+	rows, err := db.QueryContext(ctx, query, params...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query events: %w", err)
+	}
+	defer rows.Close()
+
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+
+	count := 0
+	for rows.Next() {
+		var event nostr.Event
+		var createdAt int64
+		if err := rows.Scan(&event.ID, &event.PubKey, &createdAt, &event.Kind, &event.Tags, &event.Content, &event.Sig); err != nil {
+			return count, fmt.Errorf("failed to read event: %w", err)
+		}
+		event.CreatedAt = nostr.Timestamp(createdAt)
+
+		if err := encoder.Encode(event); err != nil {
+			return count, fmt.Errorf("failed to write event %s: %w", event.ID, err)
+		}
+		count++
+	}
+
+	return count, rows.Err()
+}
+
+// ChannelFilters narrows filter to a channel: its kind 40 and every event
+// referencing it
+func ChannelFilters(filter nostr.Filter, channelID string) nostr.Filters {
+	creation := filter.Clone()
+	creation.IDs = []string{channelID}
+
+	references := filter.Clone()
+	if references.Tags == nil {
+		references.Tags = nostr.TagMap{}
+	}
+	references.Tags["e"] = []string{channelID}
+
+	return nostr.Filters{creation, references}
+}
+
+func exportSQL(filters nostr.Filters) (string, []any) {
+	alternatives := make([]string, 0, len(filters))
+	params := make([]any, 0, 20)
+	limit := 0
+
+	for _, filter := range filters {
+		conditions, filterParams := filterSQL(filter)
+		params = append(params, filterParams...)
+		limit = max(limit, filter.Limit)
+
+		if len(conditions) == 0 {
+			// a filter without conditions matches everything
+			alternatives = nil
+			params = params[:0]
+			break
+		}
+		alternatives = append(alternatives, "("+strings.Join(conditions, " AND ")+")")
+	}
+
+	query := "SELECT id, pubkey, created_at, kind, tags, content, sig FROM event"
+	if len(alternatives) > 0 {
+		query += " WHERE " + strings.Join(alternatives, " OR ")
+	}
+	query += " ORDER BY created_at, id"
+
+	if limit > 0 {
+		query += " LIMIT ?"
+		params = append(params, limit)
+	}
+
+	return query, params
+}
+
+func filterSQL(filter nostr.Filter) ([]string, []any) {
+	conditions := make([]string, 0, 6)
+	params := make([]any, 0, 20)
+
+	if len(filter.IDs) > 0 {
+		conditions = append(conditions, "id IN ("+placeholders(len(filter.IDs))+")")
+		for _, id := range filter.IDs {
+			params = append(params, id)
+		}
+	}
+
+	if len(filter.Authors) > 0 {
+		conditions = append(conditions, "pubkey IN ("+placeholders(len(filter.Authors))+")")
+		for _, author := range filter.Authors {
+			params = append(params, author)
+		}
+	}
+
+	if len(filter.Kinds) > 0 {
+		conditions = append(conditions, "kind IN ("+placeholders(len(filter.Kinds))+")")
+		for _, kind := range filter.Kinds {
+			params = append(params, kind)
+		}
+	}
+
+	// unlike the backend queries we match the tag name as well as the value
+	for name, values := range filter.Tags {
+		conditions = append(conditions, `EXISTS (
+            SELECT 1 FROM json_each(CAST(event.tags AS TEXT)) t
+            WHERE json_extract(t.value, '$[0]') = ? AND json_extract(t.value, '$[1]') IN (`+placeholders(len(values))+`))`)
+		params = append(params, strings.TrimPrefix(name, "#"))
+		for _, value := range values {
+			params = append(params, value)
+		}
+	}
+
+	if filter.Since != nil {
+		conditions = append(conditions, "created_at >= ?")
+		params = append(params, *filter.Since)
+	}
+
+	if filter.Until != nil {
+		conditions = append(conditions, "created_at <= ?")
+		params = append(params, *filter.Until)
+	}
+
+	return conditions, params
+}
+
+func placeholders(n int) string {
+	return strings.TrimRight(strings.Repeat("?,", n), ",")
+}
@@ -0,0 +1,219 @@
+package dump
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/eventstore/sqlite3"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// maxLineSize is the longest JSON line we accept, a bit more than the relay
+// websocket message limit
+const maxLineSize = 1024 * 1024
+
+// ImportOptions tune what happens with each imported event
+type ImportOptions struct {
+	// RejectEvent hooks run on every verified event before it's stored, with
+	// the same semantics as the relay hooks
+	RejectEvent []func(ctx context.Context, event *nostr.Event) (reject bool, msg string)
+
+	// OnEventSaved is called for every stored event, to keep derived tables
+	// up to date
+	OnEventSaved []func(ctx context.Context, event *nostr.Event)
+
+	// DeleteEvent and OverwriteDeletionOutcome apply the deletion requests
+	// imported as the relay does published ones: the events they refer to
+	// are deleted when allowed, and the request is rejected otherwise
+	DeleteEvent              []func(ctx context.Context, event *nostr.Event) error
+	OverwriteDeletionOutcome []func(ctx context.Context, target *nostr.Event, deletion *nostr.Event) (bool, string)
+}
+
+// Summary reports what happened to the events of an import
+type Summary struct {
+	Accepted   int `json:"accepted"`
+	Duplicates int `json:"duplicates"`
+	Rejected   int `json:"rejected"`
+
+	// Reasons counts rejected events by rejection message
+	Reasons map[string]int `json:"reasons"`
+}
+
+func (s *Summary) reject(reason string) {
+	s.Rejected++
+	s.Reasons[reason]++
+}
+
+// Import reads JSON lines from r, checks each event id and signature, runs
+// the RejectEvent hooks and stores the events that pass. Lines that can't be
+// parsed, verified or are rejected are counted and don't stop the import.
+func Import(ctx context.Context, db *sqlite3.SQLite3Backend, r io.Reader, opts ImportOptions) (Summary, error) {
+	summary := Summary{Reasons: make(map[string]int)}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		if err := ctx.Err(); err != nil {
+			return summary, err
+		}
+
+		var event nostr.Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			summary.reject("invalid json")
+			continue
+		}
+
+		if !event.CheckID() {
+			summary.reject("invalid id")
+			continue
+		}
+
+		if ok, _ := event.CheckSignature(); !ok {
+			summary.reject("invalid signature")
+			continue
+		}
+
+		if reject, msg := rejected(ctx, opts.RejectEvent, &event); reject {
+			summary.reject(msg)
+			continue
+		}
+
+		if event.Kind == 5 {
+			msg, err := deleteTargets(ctx, db, opts, &event)
+			if err != nil {
+				return summary, fmt.Errorf("line %d: failed to apply deletion %s: %w", line, event.ID, err)
+			}
+			if msg != "" {
+				summary.reject(msg)
+				continue
+			}
+		}
+
+		duplicate, err := store(ctx, db, &event)
+		if err != nil {
+			return summary, fmt.Errorf("line %d: failed to store %s: %w", line, event.ID, err)
+		}
+		if duplicate {
+			summary.Duplicates++
+			continue
+		}
+
+		summary.Accepted++
+		for _, onSaved := range opts.OnEventSaved {
+			onSaved(ctx, &event)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return summary, fmt.Errorf("line %d: %w", line+1, err)
+	}
+
+	return summary, nil
+}
+
+func rejected(ctx context.Context, hooks []func(ctx context.Context, event *nostr.Event) (bool, string), event *nostr.Event) (bool, string) {
+	for _, reject := range hooks {
+		if ok, msg := reject(ctx, event); ok {
+			if msg == "" {
+				msg = "rejected"
+			}
+			return true, msg
+		}
+	}
+
+	return false, ""
+}
+
+// deleteTargets deletes the events a deletion request refers to by "e" and
+// "a" tags, like khatru does for published requests. The message says why
+// the request is refused, "" when it isn't.
+func deleteTargets(ctx context.Context, db *sqlite3.SQLite3Backend, opts ImportOptions, deletion *nostr.Event) (string, error) {
+	for _, tag := range deletion.Tags {
+		if len(tag) < 2 {
+			continue
+		}
+
+		var filter nostr.Filter
+		match := func(*nostr.Event) bool { return true }
+		switch tag[0] {
+		case "e":
+			filter = nostr.Filter{IDs: []string{tag[1]}}
+		case "a":
+			parts := strings.SplitN(tag[1], ":", 3)
+			kind, err := strconv.Atoi(parts[0])
+			if len(parts) != 3 || err != nil {
+				continue
+			}
+			filter = nostr.Filter{Kinds: []int{kind}, Authors: []string{parts[1]}, Tags: nostr.TagMap{"d": {parts[2]}}, Until: &deletion.CreatedAt}
+			// the store matches tag values loosely
+			match = func(event *nostr.Event) bool { return event.Tags.GetD() == parts[2] }
+		default:
+			continue
+		}
+
+		ch, err := db.QueryEvents(ctx, filter)
+		if err != nil {
+			return "", err
+		}
+		var target *nostr.Event
+		for event := range ch {
+			if target == nil && match(event) {
+				target = event
+			}
+		}
+		if target == nil {
+			continue
+		}
+
+		allowed, msg := target.PubKey == deletion.PubKey, "you are not the author of this event"
+		for _, overwrite := range opts.OverwriteDeletionOutcome {
+			allowed, msg = overwrite(ctx, target, deletion)
+		}
+		if !allowed {
+			return "blocked: " + msg, nil
+		}
+		for _, del := range opts.DeleteEvent {
+			if err := del(ctx, target); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	return "", nil
+}
+
+// store saves event like the relay would, replacing older versions of
+// replaceable and addressable events
+func store(ctx context.Context, db *sqlite3.SQLite3Backend, event *nostr.Event) (duplicate bool, err error) {
+	if nostr.IsRegularKind(event.Kind) {
+		err := db.SaveEvent(ctx, event)
+		if errors.Is(err, eventstore.ErrDupEvent) {
+			return true, nil
+		}
+		return false, err
+	}
+
+	var count int64
+	if err := db.GetContext(ctx, &count, "SELECT COUNT(*) FROM event WHERE id = $1", event.ID); err != nil {
+		return false, err
+	}
+	if count > 0 {
+		return true, nil
+	}
+
+	return false, db.ReplaceEvent(ctx, event)
+}
@@ -0,0 +1,65 @@
+package dump
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fiatjaf/eventstore/sqlite3"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestImportDeletions(t *testing.T) {
+	ctx := context.Background()
+	db := &sqlite3.SQLite3Backend{DatabaseURL: filepath.Join(t.TempDir(), "import.sqlite")}
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+
+	alice, bob := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+	var lines []string
+	event := func(sk string, e nostr.Event) nostr.Event {
+		e.Sign(sk)
+		line, _ := json.Marshal(e)
+		lines = append(lines, string(line))
+		return e
+	}
+
+	kept := event(alice, nostr.Event{Kind: 1, CreatedAt: 1000, Content: "kept"})
+	deleted := event(alice, nostr.Event{Kind: 1, CreatedAt: 1001, Content: "deleted"})
+	profile := event(alice, nostr.Event{Kind: 30000, CreatedAt: 1002, Tags: nostr.Tags{{"d", "list"}}})
+	event(alice, nostr.Event{Kind: 5, CreatedAt: 1100, Tags: nostr.Tags{{"e", deleted.ID}, {"a", "30000:" + profile.PubKey + ":list"}}})
+	event(bob, nostr.Event{Kind: 5, CreatedAt: 1200, Tags: nostr.Tags{{"e", kept.ID}}})
+
+	var deletedIDs []string
+	summary, err := Import(ctx, db, strings.NewReader(strings.Join(lines, "\n")), ImportOptions{
+		DeleteEvent: []func(ctx context.Context, event *nostr.Event) error{db.DeleteEvent, func(ctx context.Context, event *nostr.Event) error {
+			deletedIDs = append(deletedIDs, event.ID)
+			return nil
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Accepted != 4 || summary.Rejected != 1 || summary.Reasons["blocked: you are not the author of this event"] != 1 {
+		t.Errorf("summary: %+v", summary)
+	}
+	if len(deletedIDs) != 2 || deletedIDs[0] != deleted.ID || deletedIDs[1] != profile.ID {
+		t.Errorf("deleted: %v", deletedIDs)
+	}
+
+	ch, err := db.QueryEvents(ctx, nostr.Filter{Kinds: []int{1, 30000}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	remaining := make([]string, 0)
+	for e := range ch {
+		remaining = append(remaining, e.ID)
+	}
+	if len(remaining) != 1 || remaining[0] != kept.ID {
+		t.Errorf("remaining: %v", remaining)
+	}
+}
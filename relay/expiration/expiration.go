@@ -0,0 +1,300 @@
+package expiration
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"nostr-relay/channels"
+	"nostr-relay/kinds"
+
+	"github.com/fiatjaf/eventstore/sqlite3"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip40"
+)
+
+// expiration holds when each expiring event has to go. Rows coming from a
+// channel default have the channel set, so they can be recomputed when the
+// owner changes it; rows from an event's own tag have it NULL and win.
+var ddls = []string{
+	`CREATE TABLE IF NOT EXISTS expiration (
+       event_id text PRIMARY KEY,
+       expires_at integer NOT NULL,
+       channel text);`,
+	`CREATE INDEX IF NOT EXISTS expirationidx ON expiration(expires_at)`,
+	`CREATE INDEX IF NOT EXISTS expirationchannelidx ON expiration(channel) WHERE channel IS NOT NULL`,
+}
+
+// Expirer implements NIP-40: it refuses expired events, hides them from
+// queries and deletes them in the background. Channel owners can set a
+// default expiration for the messages of their channel.
+type Expirer struct {
+	db       *sqlite3.SQLite3Backend
+	channels *channels.Store
+
+	// OnDefaultChanged are called with the channel whose default message
+	// expiration was applied to its stored messages
+	OnDefaultChanged []func(channel string)
+
+	mu sync.RWMutex
+	// channel id -> default message expiration in seconds
+	defaults map[string]int64
+}
+
+func New(db *sqlite3.SQLite3Backend, channelStore *channels.Store) (*Expirer, error) {
+	var existing int
+	if err := db.Get(&existing, "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'expiration'"); err != nil {
+		return nil, fmt.Errorf("failed to check expiration table: %w", err)
+	}
+
+	for _, ddl := range ddls {
+		if _, err := db.Exec(ddl); err != nil {
+			return nil, fmt.Errorf("failed to create expiration tables: %w", err)
+		}
+	}
+
+	x := &Expirer{db: db, channels: channelStore}
+	if err := x.loadDefaults(context.Background()); err != nil {
+		return nil, err
+	}
+
+	// a new table has to catch up with the events stored before it existed
+	if existing == 0 {
+		count, err := x.Rebuild(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Expiration table created, tracking %d events", count)
+	}
+
+	return x, nil
+}
+
+// ExpiresAt returns when event expires, from its own tag or the default of
+// its channel, or -1 when it doesn't
+func (x *Expirer) ExpiresAt(event *nostr.Event) nostr.Timestamp {
+	if expiresAt := nip40.GetExpiration(event.Tags); expiresAt != -1 {
+		return expiresAt
+	}
+
+	if kinds.IsChannelMessage(event) {
+		x.mu.RLock()
+		seconds := x.defaults[kinds.ChannelID(event)]
+		x.mu.RUnlock()
+
+		if seconds > 0 {
+			return event.CreatedAt + nostr.Timestamp(seconds)
+		}
+	}
+
+	return -1
+}
+
+// Expired tells if event expired by now
+func (x *Expirer) Expired(event *nostr.Event) bool {
+	expiresAt := x.ExpiresAt(event)
+	return expiresAt != -1 && expiresAt <= nostr.Now()
+}
+
+// EventSaved is meant to be added to relay.OnEventSaved after the channel
+// store, which has the channel defaults
+func (x *Expirer) EventSaved(ctx context.Context, event *nostr.Event) {
+	if err := x.track(ctx, event); err != nil {
+		log.Printf("Failed to track expiration of %s: %v", event.ID, err)
+	}
+}
+
+// EventDeleted is meant to be added to relay.DeleteEvent after the channel
+// store
+func (x *Expirer) EventDeleted(ctx context.Context, event *nostr.Event) error {
+	if _, err := x.db.ExecContext(ctx, "DELETE FROM expiration WHERE event_id = $1", event.ID); err != nil {
+		return err
+	}
+
+	switch event.Kind {
+	case 40:
+		x.mu.Lock()
+		delete(x.defaults, event.ID)
+		x.mu.Unlock()
+		_, err := x.db.ExecContext(ctx, "DELETE FROM expiration WHERE channel = $1", event.ID)
+		return err
+	case 41:
+		// the channel went back to its previous metadata
+		return x.channelChanged(ctx, kinds.ChannelID(event))
+	}
+
+	return nil
+}
+
+func (x *Expirer) track(ctx context.Context, event *nostr.Event) error {
+	switch event.Kind {
+	case 40:
+		return x.channelChanged(ctx, event.ID)
+	case 41:
+		return x.channelChanged(ctx, kinds.ChannelID(event))
+	}
+
+	expiresAt := x.ExpiresAt(event)
+	if expiresAt == -1 {
+		return nil
+	}
+
+	var channel any
+	if nip40.GetExpiration(event.Tags) == -1 {
+		channel = kinds.ChannelID(event)
+	}
+
+	_, err := x.db.ExecContext(ctx, `
+        INSERT OR REPLACE INTO expiration (event_id, expires_at, channel) VALUES ($1, $2, $3)
+    `, event.ID, expiresAt, channel)
+	return err
+}
+
+// channelChanged picks up the current default of a channel and applies it
+// to the messages already stored
+func (x *Expirer) channelChanged(ctx context.Context, id string) error {
+	var seconds int64
+	channel, err := x.channels.Get(ctx, id)
+	switch {
+	case err == nil:
+		seconds = channel.MessageExpiration
+	case !errors.Is(err, channels.ErrNotFound):
+		return err
+	}
+
+	x.mu.Lock()
+	previous := x.defaults[id]
+	if seconds > 0 {
+		x.defaults[id] = seconds
+	} else {
+		delete(x.defaults, id)
+	}
+	x.mu.Unlock()
+
+	if previous == seconds {
+		return nil
+	}
+
+	tx, err := x.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := applyDefault(ctx, tx, id, seconds); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	for _, changed := range x.OnDefaultChanged {
+		changed(id)
+	}
+
+	return nil
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// applyDefault recomputes the expiration of the messages of a channel that
+// don't have their own
+func applyDefault(ctx context.Context, db execer, channel string, seconds int64) error {
+	if _, err := db.ExecContext(ctx, "DELETE FROM expiration WHERE channel = ?", channel); err != nil {
+		return fmt.Errorf("failed to clear channel expirations: %w", err)
+	}
+
+	if seconds <= 0 {
+		return nil
+	}
+
+	// events with their own tag already have a row, which is kept. Messages
+	// only mentioning the channel belong to another one.
+	_, err := db.ExecContext(ctx, `
+        INSERT OR IGNORE INTO expiration (event_id, expires_at, channel)
+        SELECT e.id, e.created_at + ?, ? FROM event e
+        WHERE e.kind IN (42, 7353) AND e.tags LIKE ? AND `+kinds.ChannelIDSQL+` = ?
+    `, seconds, channel, "%"+channel+"%", channel)
+	if err != nil {
+		return fmt.Errorf("failed to apply channel expiration: %w", err)
+	}
+
+	return nil
+}
+
+func (x *Expirer) loadDefaults(ctx context.Context) error {
+	rows, err := x.db.QueryContext(ctx, "SELECT id, message_expiration FROM channel WHERE message_expiration > 0")
+	if err != nil {
+		return fmt.Errorf("failed to load channel expirations: %w", err)
+	}
+	defer rows.Close()
+
+	defaults := make(map[string]int64)
+	for rows.Next() {
+		var id string
+		var seconds int64
+		if err := rows.Scan(&id, &seconds); err != nil {
+			return err
+		}
+		defaults[id] = seconds
+	}
+
+	x.mu.Lock()
+	x.defaults = defaults
+	x.mu.Unlock()
+
+	return rows.Err()
+}
+
+// Rebuild recreates the expiration table from the event tags and the
+// channel defaults
+func (x *Expirer) Rebuild(ctx context.Context) (int, error) {
+	if err := x.loadDefaults(ctx); err != nil {
+		return 0, err
+	}
+
+	tx, err := x.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM expiration"); err != nil {
+		return 0, fmt.Errorf("failed to clear expirations: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+        INSERT OR REPLACE INTO expiration (event_id, expires_at, channel)
+        SELECT e.id, CAST(json_extract(t.value, '$[1]') AS INTEGER), NULL
+        FROM event e, json_each(CAST(e.tags AS TEXT)) t
+        WHERE e.tags LIKE '%"expiration"%' AND json_extract(t.value, '$[0]') = 'expiration'
+    `)
+	if err != nil {
+		return 0, fmt.Errorf("failed to load expiration tags: %w", err)
+	}
+
+	x.mu.RLock()
+	defaults := make(map[string]int64, len(x.defaults))
+	for id, seconds := range x.defaults {
+		defaults[id] = seconds
+	}
+	x.mu.RUnlock()
+
+	for id, seconds := range defaults {
+		if err := applyDefault(ctx, tx, id, seconds); err != nil {
+			return 0, err
+		}
+	}
+
+	var count int
+	if err := tx.GetContext(ctx, &count, "SELECT COUNT(*) FROM expiration"); err != nil {
+		return 0, err
+	}
+
+	return count, tx.Commit()
+}
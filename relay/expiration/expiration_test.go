@@ -0,0 +1,78 @@
+package expiration
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"nostr-relay/channels"
+
+	"github.com/fiatjaf/eventstore/sqlite3"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestChannelDefault(t *testing.T) {
+	ctx := context.Background()
+	db := &sqlite3.SQLite3Backend{DatabaseURL: filepath.Join(t.TempDir(), "expiration.sqlite")}
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+
+	channelStore, err := channels.New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, err := New(db, channelStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sk := nostr.GeneratePrivateKey()
+	save := func(event nostr.Event) nostr.Event {
+		event.Sign(sk)
+		if err := db.SaveEvent(ctx, &event); err != nil {
+			t.Fatal(err)
+		}
+		channelStore.EventSaved(ctx, &event)
+		x.EventSaved(ctx, &event)
+		return event
+	}
+
+	expiring := save(nostr.Event{Kind: 40, CreatedAt: 1000, Content: `{"name":"Expiring"}`})
+	other := save(nostr.Event{Kind: 40, CreatedAt: 1000, Content: `{"name":"Other"}`})
+	message := save(nostr.Event{Kind: 42, CreatedAt: 2000, Tags: nostr.Tags{{"e", expiring.ID, "", "root"}}})
+	// posted in the other channel, only mentioning the expiring one
+	mention := save(nostr.Event{Kind: 42, CreatedAt: 2000, Tags: nostr.Tags{{"e", expiring.ID, "", "mention"}, {"e", other.ID, "", "root"}}})
+
+	save(nostr.Event{Kind: 41, CreatedAt: 3000, Content: `{"name":"Expiring","message_expiration":60}`, Tags: nostr.Tags{{"e", expiring.ID, "", "root"}}})
+
+	check := func(when string) {
+		rows := make(map[string]int64)
+		result, err := db.QueryContext(ctx, "SELECT event_id, expires_at FROM expiration")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for result.Next() {
+			var id string
+			var expiresAt int64
+			if err := result.Scan(&id, &expiresAt); err != nil {
+				t.Fatal(err)
+			}
+			rows[id] = expiresAt
+		}
+		result.Close()
+		if len(rows) != 1 || rows[message.ID] != 2060 {
+			t.Errorf("%s: expirations %v, message %s, mention %s", when, rows, message.ID, mention.ID)
+		}
+		if x.ExpiresAt(&mention) != -1 {
+			t.Errorf("%s: the mention expires", when)
+		}
+	}
+	check("default set")
+
+	if _, err := x.Rebuild(ctx); err != nil {
+		t.Fatal(err)
+	}
+	check("rebuilt")
+}
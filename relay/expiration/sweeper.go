@@ -0,0 +1,147 @@
+package expiration
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// sweepBatch is how many expired events are deleted per query
+const sweepBatch = 500
+
+// RejectEvent refuses events that are already expired when they arrive
+func (x *Expirer) RejectEvent(ctx context.Context, event *nostr.Event) (bool, string) {
+	if x.Expired(event) {
+		return true, "invalid: event is expired"
+	}
+
+	return false, ""
+}
+
+// HideExpired wraps a QueryEvents hook so expired events that weren't swept
+// yet aren't returned. Internal calls see everything, so khatru can still
+// delete them.
+func (x *Expirer) HideExpired(
+	query func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error),
+) func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	return func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		ch, err := query(ctx, filter)
+		if err != nil || khatru.IsInternalCall(ctx) {
+			return ch, err
+		}
+
+		filtered := make(chan *nostr.Event)
+		go func() {
+			defer close(filtered)
+			for event := range ch {
+				if x.Expired(event) {
+					continue
+				}
+
+				select {
+				case filtered <- event:
+				case <-ctx.Done():
+					// drain so the query can finish
+					for range ch {
+					}
+					return
+				}
+			}
+		}()
+
+		return filtered, nil
+	}
+}
+
+// VisibleSQL is the condition of HideExpired for the visible store
+func (x *Expirer) VisibleSQL() (string, []any) {
+	return "e.id NOT IN (SELECT event_id FROM expiration WHERE expires_at <= ?)", []any{nostr.Now()}
+}
+
+// Run sweeps expired events every interval until ctx is done. Events are
+// removed with deleteEvent, which should run the relay DeleteEvent hooks so
+// derived tables stay in sync. It runs next to khatru's hourly sweeper,
+// which misses the channel defaults.
+func (x *Expirer) Run(ctx context.Context, interval time.Duration, deleteEvent func(ctx context.Context, event *nostr.Event) error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		count, err := x.Sweep(ctx, deleteEvent)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Expiration sweep failed: %v", err)
+		}
+		if count > 0 {
+			log.Printf("Deleted %d expired events", count)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sweep deletes every event expired by now and returns how many were
+func (x *Expirer) Sweep(ctx context.Context, deleteEvent func(ctx context.Context, event *nostr.Event) error) (int, error) {
+	count := 0
+	for {
+		events, err := x.loadExpired(ctx, nostr.Now())
+		if err != nil {
+			return count, err
+		}
+
+		for _, event := range events {
+			if err := deleteEvent(ctx, event); err != nil {
+				return count, fmt.Errorf("failed to delete %s: %w", event.ID, err)
+			}
+			if _, err := x.db.ExecContext(ctx, "DELETE FROM expiration WHERE event_id = $1", event.ID); err != nil {
+				return count, err
+			}
+			count++
+		}
+
+		// rows without an event (deleted some other way) are dropped here
+		if _, err := x.db.ExecContext(ctx, `
+            DELETE FROM expiration WHERE expires_at <= $1
+              AND NOT EXISTS (SELECT 1 FROM event WHERE event.id = expiration.event_id)
+        `, nostr.Now()); err != nil {
+			return count, err
+		}
+
+		if len(events) < sweepBatch {
+			return count, nil
+		}
+	}
+}
+
+func (x *Expirer) loadExpired(ctx context.Context, now nostr.Timestamp) ([]*nostr.Event, error) {
+	rows, err := x.db.QueryContext(ctx, `
+        SELECT e.id, e.pubkey, e.created_at, e.kind, e.tags, e.content, e.sig
+        FROM expiration x JOIN event e ON e.id = x.event_id
+        WHERE x.expires_at <= $1
+        ORDER BY x.expires_at LIMIT $2
+    `, now, sweepBatch)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load expired events: %w", err)
+	}
+	defer rows.Close()
+
+	events := make([]*nostr.Event, 0)
+	for rows.Next() {
+		var event nostr.Event
+		var createdAt int64
+		if err := rows.Scan(&event.ID, &event.PubKey, &createdAt, &event.Kind, &event.Tags, &event.Content, &event.Sig); err != nil {
+			return nil, err
+		}
+		event.CreatedAt = nostr.Timestamp(createdAt)
+		events = append(events, &event)
+	}
+
+	return events, rows.Err()
+}
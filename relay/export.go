@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"nostr-relay/config"
+	"nostr-relay/dump"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+func runExport(cfg config.Config, args []string) error {
+	flags := newFlagSet("export", "", &cfg)
+	kinds := flags.String("kinds", "", "comma separated kinds to export")
+	authors := flags.String("authors", "", "comma separated authors (hex or npub)")
+	channel := flags.String("channel", "", "only this channel and the events referencing it")
+	since := flags.String("since", "", "only events created at or after (unix, RFC3339 or 2006-01-02)")
+	until := flags.String("until", "", "only events created at or before (unix, RFC3339 or 2006-01-02)")
+	limit := flags.Int("limit", 0, "maximum number of events, 0 for all")
+	output := flags.String("o", "-", "output file, - for stdout")
+	flags.Parse(args)
+
+	filter := nostr.Filter{Limit: *limit}
+
+	var err error
+	if filter.Kinds, err = parseKinds(*kinds); err != nil {
+		return err
+	}
+	if filter.Authors, err = parsePubKeys(*authors); err != nil {
+		return err
+	}
+	if filter.Since, err = parseTimestamp(*since); err != nil {
+		return err
+	}
+	if filter.Until, err = parseTimestamp(*until); err != nil {
+		return err
+	}
+
+	filters := nostr.Filters{filter}
+	if *channel != "" {
+		filters = dump.ChannelFilters(filter, *channel)
+	}
+
+	db, err := openDatabase(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var w io.Writer = os.Stdout
+	if *output != "-" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+
+	buffered := bufio.NewWriter(w)
+	count, err := dump.Export(context.Background(), db, filters, buffered)
+	if err != nil {
+		return err
+	}
+	if err := buffered.Flush(); err != nil {
+		return err
+	}
+
+	log.Printf("Exported %d events", count)
+	return nil
+}
+
+func parseKinds(value string) ([]int, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	kinds := make([]int, 0)
+	for _, item := range strings.Split(value, ",") {
+		kind, err := strconv.Atoi(strings.TrimSpace(item))
+		if err != nil {
+			return nil, fmt.Errorf("invalid kind %q", item)
+		}
+		kinds = append(kinds, kind)
+	}
+
+	return kinds, nil
+}
+
+func parsePubKeys(value string) ([]string, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	pubkeys := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if strings.HasPrefix(item, "npub1") {
+			_, data, err := nip19.Decode(item)
+			if err != nil {
+				return nil, fmt.Errorf("invalid npub %q: %w", item, err)
+			}
+			item = data.(string)
+		}
+
+		if !nostr.IsValidPublicKey(item) {
+			return nil, fmt.Errorf("invalid pubkey %q", item)
+		}
+		pubkeys = append(pubkeys, item)
+	}
+
+	return pubkeys, nil
+}
+
+// parseTimestamp accepts unix seconds, RFC3339 or a plain date
+func parseTimestamp(value string) (*nostr.Timestamp, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	if unix, err := strconv.ParseInt(value, 10, 64); err == nil {
+		ts := nostr.Timestamp(unix)
+		return &ts, nil
+	}
+
+	for _, layout := range []string{time.RFC3339, time.DateOnly} {
+		if t, err := time.Parse(layout, value); err == nil {
+			ts := nostr.Timestamp(t.Unix())
+			return &ts, nil
+		}
+	}
+
+	return nil, fmt.Errorf("invalid time %q", value)
+}
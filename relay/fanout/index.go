@@ -0,0 +1,148 @@
+package fanout
+
+import (
+	"slices"
+	"sync"
+
+	"nostr-relay/kinds"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Subscription is a filter of a REQ waiting for new events
+type Subscription struct {
+	WS     *khatru.WebSocket
+	ID     string
+	Filter nostr.Filter
+
+	keys []key
+}
+
+// key is an "e" value and a kind, a message with both might match
+type key struct {
+	tag  string
+	kind int
+}
+
+// Index finds the subscriptions a channel message might match without
+// looking at the others: subscriptions are indexed by every "#e" value and
+// kind of their filter, a message is looked up by its "e" tags and kind.
+type Index struct {
+	mu            sync.RWMutex
+	subscriptions map[key]map[*Subscription]struct{}
+	count         int
+}
+
+func NewIndex() *Index {
+	return &Index{subscriptions: make(map[key]map[*Subscription]struct{})}
+}
+
+// Indexable tells if a filter only asks for channel messages tagged with
+// given "e" values, which is what clients in a room subscribe to
+func Indexable(filter nostr.Filter) bool {
+	if len(filter.Kinds) == 0 || len(filter.Tags["e"]) == 0 {
+		return false
+	}
+	for _, kind := range filter.Kinds {
+		if !slices.Contains(kinds.ChannelMessageKinds, kind) {
+			return false
+		}
+	}
+	return true
+}
+
+// Add indexes filter, which must be Indexable
+func (x *Index) Add(ws *khatru.WebSocket, id string, filter nostr.Filter) *Subscription {
+	sub := &Subscription{WS: ws, ID: id, Filter: filter}
+	for _, tag := range filter.Tags["e"] {
+		for _, kind := range filter.Kinds {
+			sub.keys = append(sub.keys, key{tag, kind})
+		}
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	for _, k := range sub.keys {
+		subs, ok := x.subscriptions[k]
+		if !ok {
+			subs = make(map[*Subscription]struct{})
+			x.subscriptions[k] = subs
+		}
+		subs[sub] = struct{}{}
+	}
+	x.count++
+
+	return sub
+}
+
+// Remove forgets a subscription, removing it twice is fine
+func (x *Index) Remove(sub *Subscription) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	removed := false
+	for _, k := range sub.keys {
+		subs := x.subscriptions[k]
+		if _, ok := subs[sub]; !ok {
+			continue
+		}
+		removed = true
+		delete(subs, sub)
+		if len(subs) == 0 {
+			delete(x.subscriptions, k)
+		}
+	}
+	if removed {
+		x.count--
+	}
+}
+
+// Len returns how many subscriptions are indexed
+func (x *Index) Len() int {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	return x.count
+}
+
+// Match returns the subscriptions whose filter matches event
+func (x *Index) Match(event *nostr.Event) []*Subscription {
+	if !kinds.IsChannelMessage(event) {
+		return nil
+	}
+
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	var matches []*Subscription
+	var seen map[*Subscription]struct{}
+	tags := 0
+	for _, tag := range event.Tags {
+		if len(tag) < 2 || tag[0] != "e" {
+			continue
+		}
+
+		// a message tagging two values of the same filter would be found
+		// twice, replies tag the channel and the message they reply to
+		if tags++; tags == 2 {
+			seen = make(map[*Subscription]struct{}, len(matches))
+			for _, sub := range matches {
+				seen[sub] = struct{}{}
+			}
+		}
+
+		for sub := range x.subscriptions[key{tag[1], event.Kind}] {
+			if _, ok := seen[sub]; ok || !sub.Filter.Matches(event) {
+				continue
+			}
+			matches = append(matches, sub)
+			if seen != nil {
+				seen[sub] = struct{}{}
+			}
+		}
+	}
+
+	return matches
+}
@@ -0,0 +1,214 @@
+package fanout
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/eventstore/slicestore"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// subscriptions opens per channels rooms, each with perChannel clients
+// subscribed to its messages
+func subscriptions(channels int, perChannel int) ([]nostr.Filter, []string) {
+	filters := make([]nostr.Filter, 0, channels*perChannel)
+	ids := make([]string, 0, channels)
+	for c := range channels {
+		id := fmt.Sprintf("%064x", c)
+		ids = append(ids, id)
+		for range perChannel {
+			filters = append(filters, nostr.Filter{Kinds: []int{42, 7353}, Tags: nostr.TagMap{"e": {id}}})
+		}
+	}
+	return filters, ids
+}
+
+func message(channelID string) *nostr.Event {
+	return &nostr.Event{
+		Kind:      7353,
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"e", channelID, "", "root"}},
+		Content:   "<bold>hello</bold>",
+	}
+}
+
+// linear is what khatru does with every listener
+func linear(filters []nostr.Filter, event *nostr.Event) int {
+	count := 0
+	for _, filter := range filters {
+		if filter.Matches(event) {
+			count++
+		}
+	}
+	return count
+}
+
+func BenchmarkFanout(b *testing.B) {
+	for _, channels := range []int{10, 100, 1000} {
+		filters, ids := subscriptions(channels, 20)
+
+		x := NewIndex()
+		for i, filter := range filters {
+			x.Add(nil, fmt.Sprint(i), filter)
+		}
+
+		event := message(ids[len(ids)/2])
+		if got, want := len(x.Match(event)), linear(filters, event); got != want {
+			b.Fatalf("index matched %d subscriptions, linear matching %d", got, want)
+		}
+
+		b.Run(fmt.Sprintf("linear/%d-subscriptions", len(filters)), func(b *testing.B) {
+			for range b.N {
+				linear(filters, event)
+			}
+		})
+
+		b.Run(fmt.Sprintf("index/%d-subscriptions", len(filters)), func(b *testing.B) {
+			for range b.N {
+				x.Match(event)
+			}
+		})
+	}
+}
+
+func matched(x *Index, event *nostr.Event) []string {
+	ids := make([]string, 0)
+	for _, sub := range x.Match(event) {
+		ids = append(ids, sub.ID)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+func TestMatch(t *testing.T) {
+	channel, parent, other := fmt.Sprintf("%064x", 1), fmt.Sprintf("%064x", 2), fmt.Sprintf("%064x", 3)
+
+	since, until := nostr.Timestamp(2000), nostr.Timestamp(1500)
+	x := NewIndex()
+	for id, filter := range map[string]nostr.Filter{
+		"room":   {Kinds: []int{42, 7353}, Tags: nostr.TagMap{"e": {channel}}},
+		"thread": {Kinds: []int{7353}, Tags: nostr.TagMap{"e": {channel, parent}}},
+		"since":  {Kinds: []int{7353}, Tags: nostr.TagMap{"e": {channel}}, Since: &since},
+		"until":  {Kinds: []int{7353}, Tags: nostr.TagMap{"e": {channel}}, Until: &until},
+		"kind":   {Kinds: []int{42}, Tags: nostr.TagMap{"e": {channel}}},
+		"other":  {Kinds: []int{42, 7353}, Tags: nostr.TagMap{"e": {other}}},
+	} {
+		x.Add(nil, id, filter)
+	}
+
+	// a reply tags the channel and the message it replies to
+	reply := &nostr.Event{Kind: 7353, CreatedAt: 1000, Tags: nostr.Tags{{"e", channel, "", "root"}, {"e", parent, "", "reply"}}}
+	if got := matched(x, reply); !slices.Equal(got, []string{"room", "thread", "until"}) {
+		t.Errorf("reply: %v", got)
+	}
+
+	reply.CreatedAt = 3000
+	if got := matched(x, reply); !slices.Equal(got, []string{"room", "since", "thread"}) {
+		t.Errorf("later reply: %v", got)
+	}
+
+	note := &nostr.Event{Kind: 1, CreatedAt: 1000, Tags: nostr.Tags{{"e", channel}}}
+	if got := x.Match(note); got != nil {
+		t.Errorf("not a channel message: %v", got)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	channel := fmt.Sprintf("%064x", 1)
+	filter := nostr.Filter{Kinds: []int{42, 7353}, Tags: nostr.TagMap{"e": {channel}}}
+
+	x := NewIndex()
+	first, second := x.Add(nil, "first", filter), x.Add(nil, "second", filter)
+	x.Remove(first)
+	x.Remove(first)
+	if x.Len() != 1 {
+		t.Errorf("len: %d", x.Len())
+	}
+	if got := matched(x, message(channel)); !slices.Equal(got, []string{"second"}) {
+		t.Errorf("matched: %v", got)
+	}
+
+	x.Remove(second)
+	if x.Len() != 0 || len(x.subscriptions) != 0 {
+		t.Errorf("left: %d %v", x.Len(), x.subscriptions)
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func receive(t *testing.T, sub *nostr.Subscription, id string) {
+	t.Helper()
+	select {
+	case event := <-sub.Events:
+		if event.ID != id {
+			t.Errorf("%s: got %s", sub.GetID(), event.ID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s: no event", sub.GetID())
+	}
+	select {
+	case event := <-sub.Events:
+		t.Errorf("%s: delivered twice: %s", sub.GetID(), event.ID)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestInstall(t *testing.T) {
+	ctx := context.Background()
+	store := &slicestore.SliceStore{}
+	store.Init()
+
+	router := khatru.NewRouter()
+	router.StoreEvent = append(router.StoreEvent, store.SaveEvent)
+	router.QueryEvents = append(router.QueryEvents, store.QueryEvents)
+	x := Install(router)
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	// the connection goes with the server, closing it first races in
+	// go-nostr
+	relay, err := nostr.RelayConnect(ctx, "ws"+strings.TrimPrefix(server.URL, "http"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	channel := fmt.Sprintf("%064x", 1)
+	room, err := relay.Subscribe(ctx, nostr.Filters{{Kinds: []int{42, 7353}, Tags: nostr.TagMap{"e": {channel}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// not indexable, khatru matches it against every event
+	everything, err := relay.Subscribe(ctx, nostr.Filters{{Kinds: []int{7353}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the room subscription", func() bool { return x.Len() == 1 })
+	<-room.EndOfStoredEvents
+	<-everything.EndOfStoredEvents
+
+	event := message(channel)
+	event.Tags = append(event.Tags, nostr.Tag{"e", fmt.Sprintf("%064x", 2), "", "reply"})
+	event.Sign(nostr.GeneratePrivateKey())
+	if err := relay.Publish(ctx, *event); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, room, event.ID)
+	receive(t, everything, event.ID)
+
+	room.Unsub()
+	waitFor(t, "the closed subscription to go", func() bool { return x.Len() == 0 })
+}
@@ -0,0 +1,75 @@
+package fanout
+
+import (
+	"context"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Install routes the Indexable subscriptions of router to a relay of their
+// own. No event is ever routed there, so khatru doesn't test every new
+// event against them: new channel messages are delivered through the index
+// instead, to the subscriptions of their channel only.
+//
+// The subscriptions are answered with the hooks router has when Install is
+// called, so it must come after they are all set.
+func Install(router *khatru.Router) *Index {
+	x := NewIndex()
+
+	channels := khatru.NewRelay()
+	channels.OverwriteFilter = append([]func(ctx context.Context, filter *nostr.Filter){track(x)}, router.OverwriteFilter...)
+	channels.RejectFilter = router.RejectFilter
+	channels.QueryEvents = router.QueryEvents
+	channels.OverwriteResponseEvent = router.OverwriteResponseEvent
+	channels.RejectCountFilter = router.RejectCountFilter
+	channels.CountEvents = router.CountEvents
+	channels.CountEventsHLL = router.CountEventsHLL
+	channels.Negentropy = router.Negentropy
+
+	router.Route().Req(Indexable).Relay(channels)
+
+	router.OnEventSaved = append(router.OnEventSaved, func(ctx context.Context, event *nostr.Event) {
+		broadcast(router.Relay, x, event)
+	})
+
+	return x
+}
+
+// track indexes a subscription until it's closed, which cancels its
+// context, like when the connection goes away or another filter of the
+// same REQ is rejected. Negentropy sessions get the filter hooks too, but
+// they don't listen to new events.
+func track(x *Index) func(ctx context.Context, filter *nostr.Filter) {
+	return func(ctx context.Context, filter *nostr.Filter) {
+		ws := khatru.GetConnection(ctx)
+		if ws == nil || eventstore.IsNegentropySession(ctx) {
+			return
+		}
+
+		// before any other hook changes it, khatru listens to the filter
+		// as it was sent
+		sub := x.Add(ws, khatru.GetSubscriptionID(ctx), filter.Clone())
+		context.AfterFunc(ctx, func() { x.Remove(sub) })
+	}
+}
+
+// broadcast sends event to the subscriptions it matches, returning how many
+func broadcast(relay *khatru.Relay, x *Index, event *nostr.Event) int {
+	count := 0
+
+subscriptions:
+	for _, sub := range x.Match(event) {
+		for _, prevent := range relay.PreventBroadcast {
+			if prevent(sub.WS, event) {
+				continue subscriptions
+			}
+		}
+
+		sub.WS.WriteJSON(nostr.EventEnvelope{SubscriptionID: &sub.ID, Event: *event})
+		count++
+	}
+
+	return count
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"nostr-relay/ingest"
+
+	"github.com/fiatjaf/eventstore/sqlite3"
+)
+
+// healthz reports that the process is up, it doesn't look at any dependency
+func healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok\n"))
+}
+
+// readyz reports whether we can take traffic: we are not shutting down and
+// the database answers.
+func readyz(lc *lifecycle, db *sqlite3.SQLite3Backend, writer *ingest.Writer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+
+		if lc.isDraining() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("shutting down\n"))
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+		defer cancel()
+
+		if err := db.PingContext(ctx); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("database unavailable: " + err.Error() + "\n"))
+			return
+		}
+
+		// events would be rejected as rate-limited
+		if stats := writer.Stats(); stats.Queued >= stats.Capacity {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("write queue full\n"))
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ready\n"))
+	}
+}
@@ -0,0 +1,320 @@
+package history
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"nostr-relay/kinds"
+	"nostr-relay/visible"
+
+	"github.com/fiatjaf/eventstore/sqlite3"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// eventOverhead roughly accounts for what an event costs besides its
+// strings: the struct, slices headers and the buffer entry
+const eventOverhead = 256
+
+// buffer holds the newest messages tagged with one "e" value, newest first
+// in store order (created_at descending, then id). It's always a contiguous
+// prefix of what's stored: nothing newer than its oldest message is missing.
+type buffer struct {
+	key      string
+	messages []*nostr.Event
+	bytes    int
+
+	// complete is set when the buffer holds every stored message, so
+	// queries reaching past its oldest message don't need the store
+	complete bool
+
+	// element is the place of the buffer in the least recently used list
+	element *list.Element
+}
+
+// Cache keeps the recent channel messages of the busiest channels in memory,
+// so every client joining a room doesn't ask the store for the same history.
+// Buffers are loaded on the first query and evicted, least recently used
+// first, when the messages held take more than the memory bound. They only
+// hold messages clients can see, so a limit counts the messages they get.
+type Cache struct {
+	db         *sqlite3.SQLite3Backend
+	conditions []visible.Condition
+
+	// Hidden, when set, tells if a message held can't be seen anymore, like
+	// one that expired since it was loaded
+	Hidden func(event *nostr.Event) bool
+
+	// perChannel is how many messages a buffer holds, maxBytes the memory
+	// bound of all buffers together
+	perChannel int
+	maxBytes   int
+
+	mu      sync.Mutex
+	buffers map[string]*buffer
+	recent  *list.List
+	bytes   int
+
+	// loading has the buffers being loaded, flagged when a message of theirs
+	// was saved or deleted meanwhile so a stale load isn't kept
+	loading map[string]bool
+}
+
+// New returns a cache loading the messages meeting conditions, the ones
+// of the visible store
+func New(db *sqlite3.SQLite3Backend, perChannel int, maxBytes int, conditions ...visible.Condition) *Cache {
+	return &Cache{
+		db:         db,
+		conditions: conditions,
+		perChannel: perChannel,
+		maxBytes:   maxBytes,
+		buffers:    make(map[string]*buffer),
+		recent:     list.New(),
+		loading:    make(map[string]bool),
+	}
+}
+
+// EventSaved is meant to be added to relay.OnEventSaved
+func (c *Cache) EventSaved(ctx context.Context, event *nostr.Event) {
+	if !kinds.IsChannelMessage(event) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, key := range keys(event) {
+		if _, ok := c.loading[key]; ok {
+			c.loading[key] = true
+		}
+		if b, ok := c.buffers[key]; ok {
+			c.insert(b, event)
+		}
+	}
+	c.evict(nil)
+}
+
+// EventDeleted is meant to be added to relay.DeleteEvent
+func (c *Cache) EventDeleted(ctx context.Context, event *nostr.Event) error {
+	if !kinds.IsChannelMessage(event) {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, key := range keys(event) {
+		if _, ok := c.loading[key]; ok {
+			c.loading[key] = true
+		}
+		if b, ok := c.buffers[key]; ok {
+			c.remove(b, event.ID)
+		}
+	}
+
+	return nil
+}
+
+// Forget drops the buffer of key, to be loaded again by the next query
+func (c *Cache) Forget(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.drop(key)
+}
+
+// Reset drops every buffer
+func (c *Cache) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key := range c.buffers {
+		c.drop(key)
+	}
+	for key := range c.loading {
+		c.loading[key] = true
+	}
+}
+
+func (c *Cache) drop(key string) {
+	if _, ok := c.loading[key]; ok {
+		c.loading[key] = true
+	}
+	if b, ok := c.buffers[key]; ok {
+		c.recent.Remove(b.element)
+		delete(c.buffers, key)
+		c.bytes -= b.bytes
+	}
+}
+
+// keys are the distinct "e" values of a message, a buffer per value can hold it
+func keys(event *nostr.Event) []string {
+	keys := make([]string, 0, 2)
+	for _, tag := range event.Tags {
+		if len(tag) >= 2 && tag[0] == "e" && !contains(keys, tag[1]) {
+			keys = append(keys, tag[1])
+		}
+	}
+	return keys
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// newer tells if a comes before b in store order
+func newer(a, b *nostr.Event) bool {
+	return a.CreatedAt > b.CreatedAt || (a.CreatedAt == b.CreatedAt && a.ID < b.ID)
+}
+
+func size(event *nostr.Event) int {
+	n := eventOverhead + len(event.ID) + len(event.PubKey) + len(event.Sig) + len(event.Content)
+	for _, tag := range event.Tags {
+		for _, value := range tag {
+			n += len(value) + 16
+		}
+	}
+	return n
+}
+
+func (c *Cache) insert(b *buffer, event *nostr.Event) {
+	i := sort.Search(len(b.messages), func(i int) bool { return !newer(b.messages[i], event) })
+	if i < len(b.messages) && b.messages[i].ID == event.ID {
+		return
+	}
+	// older than everything held, but more could be stored in between
+	if i == len(b.messages) && !b.complete {
+		return
+	}
+
+	b.messages = append(b.messages, nil)
+	copy(b.messages[i+1:], b.messages[i:])
+	b.messages[i] = event
+	c.grow(b, size(event))
+
+	if len(b.messages) > c.perChannel {
+		c.grow(b, -size(b.messages[len(b.messages)-1]))
+		b.messages = b.messages[:len(b.messages)-1]
+		b.complete = false
+	}
+}
+
+func (c *Cache) remove(b *buffer, id string) {
+	for i, message := range b.messages {
+		if message.ID == id {
+			c.grow(b, -size(message))
+			b.messages = append(b.messages[:i], b.messages[i+1:]...)
+			return
+		}
+	}
+}
+
+func (c *Cache) grow(b *buffer, bytes int) {
+	b.bytes += bytes
+	c.bytes += bytes
+}
+
+// evict drops the least recently used buffers until the cache fits its
+// memory bound, keeping the one in use
+func (c *Cache) evict(keep *buffer) {
+	for c.bytes > c.maxBytes {
+		element := c.recent.Back()
+		if element == nil {
+			return
+		}
+		b := element.Value.(*buffer)
+		if b == keep {
+			if element = element.Prev(); element == nil {
+				return
+			}
+			b = element.Value.(*buffer)
+		}
+
+		c.drop(b.key)
+	}
+}
+
+// load reads the newest messages tagged with key from the store and keeps
+// them, unless they changed while loading
+func (c *Cache) load(ctx context.Context, key string) error {
+	c.mu.Lock()
+	_, loaded := c.buffers[key]
+	if _, ok := c.loading[key]; ok || loaded {
+		c.mu.Unlock()
+		return nil
+	}
+	c.loading[key] = false
+	c.mu.Unlock()
+
+	messages, err := c.loadMessages(ctx, key)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stale := c.loading[key]
+	delete(c.loading, key)
+	if err != nil || stale {
+		return err
+	}
+
+	b := &buffer{key: key, complete: len(messages) <= c.perChannel}
+	if !b.complete {
+		messages = messages[:c.perChannel]
+	}
+	b.messages = messages
+	for _, message := range messages {
+		b.bytes += size(message)
+	}
+
+	c.buffers[key] = b
+	c.bytes += b.bytes
+	b.element = c.recent.PushFront(b)
+	c.evict(b)
+
+	return nil
+}
+
+func (c *Cache) loadMessages(ctx context.Context, key string) ([]*nostr.Event, error) {
+	conditions := []string{"e.kind IN (42, 7353)", "e.tags LIKE ?", `EXISTS (
+          SELECT 1 FROM json_each(CAST(e.tags AS TEXT)) t
+          WHERE json_extract(t.value, '$[0]') = 'e' AND json_extract(t.value, '$[1]') = ?)`}
+	params := []any{"%" + key + "%", key}
+	for _, condition := range c.conditions {
+		sql, args := condition()
+		conditions = append(conditions, "("+sql+")")
+		params = append(params, args...)
+	}
+	// one more than held, to know if the buffer is complete
+	params = append(params, c.perChannel+1)
+
+	rows, err := c.db.QueryContext(ctx, `
+        SELECT e.id, e.pubkey, e.created_at, e.kind, e.tags, e.content, e.sig FROM event e
+        WHERE `+strings.Join(conditions, " AND ")+`
+        ORDER BY e.created_at DESC, e.id LIMIT ?
+    `, params...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load history of %s: %w", key, err)
+	}
+	defer rows.Close()
+
+	messages := make([]*nostr.Event, 0)
+	for rows.Next() {
+		var event nostr.Event
+		var createdAt int64
+		if err := rows.Scan(&event.ID, &event.PubKey, &createdAt, &event.Kind, &event.Tags, &event.Content, &event.Sig); err != nil {
+			return nil, err
+		}
+		event.CreatedAt = nostr.Timestamp(createdAt)
+		messages = append(messages, &event)
+	}
+
+	return messages, rows.Err()
+}
@@ -0,0 +1,117 @@
+package history
+
+import (
+	"context"
+	"log"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Query wraps a QueryEvents hook, answering from memory the filters asking
+// for the recent messages of a channel: kinds 42 and/or 7353, a single "#e"
+// value, optionally since, until and a limit. Anything else, or history
+// older than what's held, goes to the store, and so do negentropy sessions
+// which want every message and internal calls which see hidden ones.
+func (c *Cache) Query(
+	next func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error),
+) func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	return func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		key, ok := c.hotPath(filter)
+		if !ok || eventstore.IsNegentropySession(ctx) || khatru.IsInternalCall(ctx) {
+			return next(ctx, filter)
+		}
+
+		messages, ok := c.serve(key, filter)
+		if !ok {
+			if err := c.load(ctx, key); err != nil {
+				log.Printf("Failed to cache history: %v", err)
+			}
+			messages, ok = c.serve(key, filter)
+		}
+
+		if !ok {
+			return next(ctx, filter)
+		}
+
+		ch := make(chan *nostr.Event)
+		go func() {
+			defer close(ch)
+			for _, message := range messages {
+				select {
+				case ch <- message:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+
+		return ch, nil
+	}
+}
+
+// hotPath tells if the cache can answer filter, returning the "e" value of
+// the buffer to look at
+func (c *Cache) hotPath(filter nostr.Filter) (string, bool) {
+	if c.perChannel <= 0 || c.maxBytes <= 0 {
+		return "", false
+	}
+	if len(filter.IDs) > 0 || len(filter.Authors) > 0 || filter.Search != "" || filter.LimitZero {
+		return "", false
+	}
+	if len(filter.Kinds) == 0 {
+		return "", false
+	}
+	for _, kind := range filter.Kinds {
+		if kind != 42 && kind != 7353 {
+			return "", false
+		}
+	}
+
+	values, ok := filter.Tags["e"]
+	if len(filter.Tags) != 1 || !ok || len(values) != 1 {
+		return "", false
+	}
+
+	return values[0], true
+}
+
+// serve answers filter from the buffer of key, unless it isn't loaded or
+// the store could have older matching messages that aren't held
+func (c *Cache) serve(key string, filter nostr.Filter) ([]*nostr.Event, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b, ok := c.buffers[key]
+	if !ok {
+		return nil, false
+	}
+	c.recent.MoveToFront(b.element)
+
+	// the same as the store
+	limit := filter.Limit
+	if limit < 1 || limit > c.db.QueryLimit {
+		limit = c.db.QueryLimit
+	}
+
+	messages := make([]*nostr.Event, 0, min(limit, len(b.messages)))
+	for _, message := range b.messages {
+		if len(messages) == limit {
+			return messages, true
+		}
+		if filter.Until != nil && message.CreatedAt > *filter.Until {
+			continue
+		}
+		if filter.Since != nil && message.CreatedAt < *filter.Since {
+			// everything after is older still
+			return messages, true
+		}
+		if !filter.Matches(message) || (c.Hidden != nil && c.Hidden(message)) {
+			continue
+		}
+		messages = append(messages, message)
+	}
+
+	return messages, len(messages) == limit || b.complete
+}
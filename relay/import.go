@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"slices"
+
+	"nostr-relay/channels"
+	"nostr-relay/config"
+	"nostr-relay/deletion"
+	"nostr-relay/dump"
+	"nostr-relay/expiration"
+	"nostr-relay/kinds"
+	"nostr-relay/management"
+	"nostr-relay/search"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip11"
+)
+
+func runImport(cfg config.Config, args []string) error {
+	flags := newFlagSet("import", "[file.jsonl]", &cfg)
+	offline := flags.Bool("offline", false, "don't query other relays while validating, reject what can't be checked locally")
+	flags.Parse(args)
+
+	var r io.Reader = os.Stdin
+	if file := flags.Arg(0); file != "" && file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	db, err := openDatabase(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	channelStore, err := channels.New(db)
+	if err != nil {
+		return err
+	}
+
+	searchIndex, err := search.New(db, channelStore)
+	if err != nil {
+		return err
+	}
+
+	expirer, err := expiration.New(db, channelStore)
+	if err != nil {
+		return err
+	}
+
+	// bans and deletions are enforced as they are for published events
+	manager, err := management.New(db, cfg.AdminPubKeys, &nip11.RelayInformationDocument{})
+	if err != nil {
+		return err
+	}
+
+	var deleteHooks []func(ctx context.Context, event *nostr.Event) error
+	deleteEvent := func(ctx context.Context, event *nostr.Event) error {
+		for _, del := range deleteHooks {
+			if err := del(ctx, event); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	deletions, err := deletion.New(db, channelStore, manager.IsAdmin, deleteEvent)
+	if err != nil {
+		return err
+	}
+	deleteHooks = []func(ctx context.Context, event *nostr.Event) error{
+		db.DeleteEvent, channelStore.EventDeleted, searchIndex.EventDeleted, expirer.EventDeleted, deletions.EventDeleted,
+	}
+
+	ctx := context.Background()
+	if *offline {
+		ctx = kinds.WithoutRemoteLookups(ctx)
+	}
+
+	summary, err := dump.Import(ctx, db, r, dump.ImportOptions{
+		RejectEvent:              rejectEvent(db, manager, expirer, deletions),
+		OnEventSaved:             []func(ctx context.Context, event *nostr.Event){channelStore.EventSaved, searchIndex.EventSaved, expirer.EventSaved},
+		DeleteEvent:              deleteHooks,
+		OverwriteDeletionOutcome: []func(ctx context.Context, target *nostr.Event, deletion *nostr.Event) (bool, string){deletions.OverwriteDeletionOutcome},
+	})
+	log.Printf("Imported %d events, %d duplicates, %d rejected", summary.Accepted, summary.Duplicates, summary.Rejected)
+	for _, reason := range slices.Sorted(maps.Keys(summary.Reasons)) {
+		fmt.Fprintf(os.Stderr, "  %6d  %s\n", summary.Reasons[reason], reason)
+	}
+
+	return err
+}
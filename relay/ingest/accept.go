@@ -0,0 +1,85 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ErrRejected is wrapped by Accept when the relay refused the event
+var ErrRejected = errors.New("rejected")
+
+// Accept runs an event the relay fetched by itself through the same hooks
+// as a published one: RejectEvent, the check for a deletion request, then
+// StoreEvent or ReplaceEvent and OnEventSaved. Refusals wrap ErrRejected and
+// duplicates are eventstore.ErrDupEvent. The signature must have been
+// checked already.
+func Accept(ctx context.Context, relay *khatru.Relay, event *nostr.Event) error {
+	if nostr.IsEphemeralKind(event.Kind) {
+		return fmt.Errorf("%w: ephemeral events aren't stored", ErrRejected)
+	}
+
+	for _, reject := range relay.RejectEvent {
+		if rejected, msg := reject(ctx, event); rejected {
+			return fmt.Errorf("%w: %s", ErrRejected, nostr.NormalizeOKMessage(msg, "blocked"))
+		}
+	}
+
+	deleted, err := isDeleted(ctx, relay, event)
+	if err != nil {
+		return err
+	}
+	if deleted {
+		return fmt.Errorf("%w: blocked: this event has been deleted", ErrRejected)
+	}
+
+	if nostr.IsRegularKind(event.Kind) {
+		for _, store := range relay.StoreEvent {
+			if err := store(ctx, event); err != nil {
+				return err
+			}
+		}
+	} else {
+		for _, replace := range relay.ReplaceEvent {
+			if err := replace(ctx, event); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, onSaved := range relay.OnEventSaved {
+		onSaved(ctx, event)
+	}
+
+	return nil
+}
+
+// isDeleted tells if a deletion request for event is stored, by id or, for
+// addressable events, by address
+func isDeleted(ctx context.Context, relay *khatru.Relay, event *nostr.Event) (bool, error) {
+	filters := []nostr.Filter{{Kinds: []int{5}, Tags: nostr.TagMap{"e": []string{event.ID}}, Limit: 1}}
+	if nostr.IsAddressableKind(event.Kind) {
+		address := fmt.Sprintf("%d:%s:%s", event.Kind, event.PubKey, event.Tags.GetD())
+		filters = append(filters, nostr.Filter{Kinds: []int{5}, Since: &event.CreatedAt, Tags: nostr.TagMap{"a": []string{address}}, Limit: 1})
+	}
+
+	for _, filter := range filters {
+		for _, query := range relay.QueryEvents {
+			ch, err := query(ctx, filter)
+			if err != nil {
+				return false, err
+			}
+			found := false
+			for range ch {
+				found = true
+			}
+			if found {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
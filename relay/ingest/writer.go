@@ -0,0 +1,361 @@
+package ingest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ErrBusy is returned when the queue stayed full for longer than the enqueue
+// timeout, the message is sent back to the client as is
+var ErrBusy = errors.New("rate-limited: relay is busy, try again later")
+
+// ErrClosed is returned once the writer stopped accepting events
+var ErrClosed = errors.New("error: relay is shutting down")
+
+// Options tune the writer, zero values use the defaults
+type Options struct {
+	// QueueSize is how many writes can wait for the writer
+	QueueSize int
+
+	// BatchSize is the most writes committed in one transaction
+	BatchSize int
+
+	// EnqueueTimeout is how long a write waits for room in the queue before
+	// failing with ErrBusy
+	EnqueueTimeout time.Duration
+}
+
+func (o Options) withDefaults() Options {
+	if o.QueueSize <= 0 {
+		o.QueueSize = 1024
+	}
+	if o.BatchSize <= 0 {
+		o.BatchSize = 256
+	}
+	if o.EnqueueTimeout <= 0 {
+		o.EnqueueTimeout = 5 * time.Second
+	}
+	return o
+}
+
+type operation int
+
+const (
+	save operation = iota
+	replace
+	remove
+)
+
+type request struct {
+	op     operation
+	event  *nostr.Event
+	result chan error
+}
+
+// Writer is the only one writing to the event table. Writes are queued and
+// committed by a single goroutine, as many as are waiting in one transaction,
+// on a connection of its own so reads never wait for it.
+type Writer struct {
+	db      *sqlx.DB
+	options Options
+
+	// mu guards closed, writes hold it for reading while they enqueue so the
+	// queue is never closed under them
+	mu     sync.RWMutex
+	closed bool
+	queue  chan *request
+	done   chan struct{}
+
+	batches atomic.Int64
+	writes  atomic.Int64
+	busy    atomic.Int64
+}
+
+// Stats count what the writer did since it started
+type Stats struct {
+	Batches  int64 `json:"batches"`
+	Writes   int64 `json:"writes"`
+	Busy     int64 `json:"busy"`
+	Queued   int   `json:"queued"`
+	Capacity int   `json:"capacity"`
+}
+
+// New opens the write connection to the database at dsn and starts the
+// writer goroutine. The event table must already exist.
+func New(dsn string, options Options) (*Writer, error) {
+	db, err := sqlx.Connect("sqlite3", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open write connection: %w", err)
+	}
+	db.SetMaxOpenConns(1)
+
+	options = options.withDefaults()
+	w := &Writer{
+		db:      db,
+		options: options,
+		queue:   make(chan *request, options.QueueSize),
+		done:    make(chan struct{}),
+	}
+	go w.run()
+
+	return w, nil
+}
+
+// SaveEvent is meant to be added to relay.StoreEvent, it returns once the
+// event is committed
+func (w *Writer) SaveEvent(ctx context.Context, event *nostr.Event) error {
+	return w.enqueue(ctx, save, event)
+}
+
+// ReplaceEvent is meant to be added to relay.ReplaceEvent. Like the
+// eventstore, the event is only stored if it's newer than what it replaces.
+func (w *Writer) ReplaceEvent(ctx context.Context, event *nostr.Event) error {
+	return w.enqueue(ctx, replace, event)
+}
+
+// DeleteEvent is meant to be added to relay.DeleteEvent
+func (w *Writer) DeleteEvent(ctx context.Context, event *nostr.Event) error {
+	return w.enqueue(ctx, remove, event)
+}
+
+// Stats returns the counters of the writer
+func (w *Writer) Stats() Stats {
+	return Stats{
+		Batches:  w.batches.Load(),
+		Writes:   w.writes.Load(),
+		Busy:     w.busy.Load(),
+		Queued:   len(w.queue),
+		Capacity: cap(w.queue),
+	}
+}
+
+// Close stops accepting writes, commits the queued ones and closes the
+// connection. It waits for the queue to drain until ctx is done.
+func (w *Writer) Close(ctx context.Context) error {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.mu.Unlock()
+
+	select {
+	case <-w.done:
+	case <-ctx.Done():
+		return fmt.Errorf("queued writes not committed: %w", ctx.Err())
+	}
+
+	return w.db.Close()
+}
+
+func (w *Writer) enqueue(ctx context.Context, op operation, event *nostr.Event) error {
+	r := &request{op: op, event: event, result: make(chan error, 1)}
+
+	if err := w.push(ctx, r); err != nil {
+		return err
+	}
+
+	// once queued it's committed even if ctx is done meanwhile, so the
+	// outcome is reported and khatru runs OnEventSaved for it
+	return <-r.result
+}
+
+func (w *Writer) push(ctx context.Context, r *request) error {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	if w.closed {
+		return ErrClosed
+	}
+
+	select {
+	case w.queue <- r:
+		return nil
+	default:
+	}
+
+	// the queue is full, wait a bit for the writer to catch up
+	timer := time.NewTimer(w.options.EnqueueTimeout)
+	defer timer.Stop()
+
+	select {
+	case w.queue <- r:
+		return nil
+	case <-timer.C:
+		w.busy.Add(1)
+		return ErrBusy
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (w *Writer) run() {
+	defer close(w.done)
+
+	batch := make([]*request, 0, w.options.BatchSize)
+	for first := range w.queue {
+		batch = append(batch[:0], first)
+
+	collect:
+		for len(batch) < w.options.BatchSize {
+			select {
+			case r, ok := <-w.queue:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, r)
+			default:
+				break collect
+			}
+		}
+
+		w.commit(batch)
+		w.batches.Add(1)
+		w.writes.Add(int64(len(batch)))
+	}
+}
+
+// commit applies a batch in one transaction and answers every request once
+// it's durable. A failing write doesn't fail the others, a failing commit
+// fails them all.
+func (w *Writer) commit(batch []*request) {
+	// the queue is drained on shutdown even if the callers are gone
+	ctx := context.Background()
+
+	results := make([]error, len(batch))
+	tx, err := w.db.BeginTxx(ctx, nil)
+	if err == nil {
+		for i, r := range batch {
+			results[i] = applyAtomically(ctx, tx, r)
+		}
+		err = tx.Commit()
+	}
+
+	if err != nil {
+		log.Printf("Failed to commit %d writes: %v", len(batch), err)
+		if tx != nil {
+			tx.Rollback()
+		}
+	}
+
+	for i, r := range batch {
+		if err != nil && results[i] == nil {
+			results[i] = fmt.Errorf("failed to commit: %w", err)
+		}
+		r.result <- results[i]
+	}
+}
+
+// applyAtomically undoes what a failing write did so far, without touching
+// the rest of the batch
+func applyAtomically(ctx context.Context, tx *sqlx.Tx, r *request) error {
+	if _, err := tx.ExecContext(ctx, "SAVEPOINT write"); err != nil {
+		return err
+	}
+
+	err := apply(ctx, tx, r)
+	if err != nil && err != eventstore.ErrDupEvent {
+		tx.ExecContext(ctx, "ROLLBACK TO write")
+	}
+
+	if _, releaseErr := tx.ExecContext(ctx, "RELEASE write"); releaseErr != nil && err == nil {
+		err = releaseErr
+	}
+	return err
+}
+
+func apply(ctx context.Context, tx *sqlx.Tx, r *request) error {
+	switch r.op {
+	case save:
+		return insert(ctx, tx, r.event)
+	case replace:
+		return replaceEvent(ctx, tx, r.event)
+	case remove:
+		_, err := tx.ExecContext(ctx, "DELETE FROM event WHERE id = ?", r.event.ID)
+		return err
+	}
+
+	return fmt.Errorf("unknown operation %d", r.op)
+}
+
+// insert is what the eventstore SaveEvent does
+func insert(ctx context.Context, tx *sqlx.Tx, event *nostr.Event) error {
+	tags, _ := json.Marshal(event.Tags)
+	res, err := tx.ExecContext(ctx, `
+        INSERT OR IGNORE INTO event (id, pubkey, created_at, kind, tags, content, sig)
+        VALUES (?, ?, ?, ?, ?, ?, ?)
+    `, event.ID, event.PubKey, event.CreatedAt, event.Kind, tags, event.Content, event.Sig)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return eventstore.ErrDupEvent
+	}
+
+	return nil
+}
+
+// replaceEvent is what the eventstore ReplaceEvent does, inside the batch
+// so earlier writes of the same batch are seen
+func replaceEvent(ctx context.Context, tx *sqlx.Tx, event *nostr.Event) error {
+	rows, err := tx.QueryContext(ctx, "SELECT id, created_at, tags FROM event WHERE kind = ? AND pubkey = ?", event.Kind, event.PubKey)
+	if err != nil {
+		return fmt.Errorf("failed to query before replacing: %w", err)
+	}
+
+	older := make([]string, 0)
+	shouldStore := true
+	for rows.Next() {
+		var previous nostr.Event
+		var createdAt int64
+		if err := rows.Scan(&previous.ID, &createdAt, &previous.Tags); err != nil {
+			rows.Close()
+			return err
+		}
+		previous.CreatedAt = nostr.Timestamp(createdAt)
+
+		if nostr.IsAddressableKind(event.Kind) && previous.Tags.GetD() != event.Tags.GetD() {
+			continue
+		}
+
+		if previous.CreatedAt < event.CreatedAt || (previous.CreatedAt == event.CreatedAt && previous.ID > event.ID) {
+			older = append(older, previous.ID)
+		} else {
+			shouldStore = false
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range older {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM event WHERE id = ?", id); err != nil {
+			return fmt.Errorf("failed to delete event for replacing: %w", err)
+		}
+	}
+
+	if shouldStore {
+		if err := insert(ctx, tx, event); err != nil && err != eventstore.ErrDupEvent {
+			return fmt.Errorf("failed to save: %w", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,393 @@
+package ingest
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/eventstore/sqlite3"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// publishers is how many goroutines per CPU publish concurrently
+const publishers = 64
+
+// benchmarkEvent makes a distinct message, storing doesn't check signatures
+// so they are left out
+func benchmarkEvent(n int64) *nostr.Event {
+	id := sha256.Sum256([]byte(fmt.Sprint(n)))
+	return &nostr.Event{
+		ID:        hex.EncodeToString(id[:]),
+		PubKey:    "79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798",
+		CreatedAt: nostr.Timestamp(1700000000 + n),
+		Kind:      42,
+		Tags:      nostr.Tags{{"e", "25e5c82273a271cb1a840d0060391a0bf4965cafeb029d5ab55350b418953fbb", "", "root"}},
+		Content:   "hello from the benchmark",
+	}
+}
+
+func benchmarkPublishers(b *testing.B, save func(ctx context.Context, event *nostr.Event) error) {
+	var next atomic.Int64
+	ctx := context.Background()
+
+	b.SetParallelism(publishers)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := save(ctx, benchmarkEvent(next.Add(1))); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "events/s")
+}
+
+// BenchmarkDirect is every publisher committing its own event, what the
+// relay did before the writer
+func BenchmarkDirect(b *testing.B) {
+	db, _ := openDatabase(b)
+	benchmarkPublishers(b, db.SaveEvent)
+}
+
+func BenchmarkWriter(b *testing.B) {
+	_, dsn := openDatabase(b)
+
+	writer, err := New(dsn, Options{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer writer.Close(context.Background())
+
+	benchmarkPublishers(b, writer.SaveEvent)
+
+	stats := writer.Stats()
+	if stats.Batches > 0 {
+		b.ReportMetric(float64(stats.Writes)/float64(stats.Batches), "events/batch")
+	}
+}
+
+func openDatabase(t testing.TB) (*sqlite3.SQLite3Backend, string) {
+	dsn := filepath.Join(t.TempDir(), "ingest.sqlite") + "?_journal_mode=WAL&_synchronous=NORMAL&_busy_timeout=5000&_txlock=immediate"
+
+	db := &sqlite3.SQLite3Backend{DatabaseURL: dsn}
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+
+	return db, dsn
+}
+
+func newWriter(t *testing.T, dsn string, options Options) *Writer {
+	w, err := New(dsn, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { w.Close(context.Background()) })
+	return w
+}
+
+// lock holds the database so the writer waits to begin its next
+// transaction, until unlock is called
+func lock(t *testing.T, db *sqlite3.SQLite3Backend) (unlock func()) {
+	ctx := context.Background()
+	conn, err := db.DB.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.ExecContext(ctx, "BEGIN IMMEDIATE"); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		conn.ExecContext(ctx, "ROLLBACK")
+		conn.Close()
+	}
+}
+
+// waitFor polls until condition holds
+func waitFor(t *testing.T, what string, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// queue pushes a write, returning once it's queued with where its result
+// comes
+func queue(t *testing.T, w *Writer, op operation, events ...*nostr.Event) []chan error {
+	results := make([]chan error, len(events))
+	for i, event := range events {
+		r := &request{op: op, event: event, result: make(chan error, 1)}
+		if err := w.push(context.Background(), r); err != nil {
+			t.Fatal(err)
+		}
+		results[i] = r.result
+	}
+	return results
+}
+
+// wait collects the results of writes
+func wait(results ...[]chan error) []error {
+	errs := make([]error, 0)
+	for _, list := range results {
+		for _, result := range list {
+			errs = append(errs, <-result)
+		}
+	}
+	return errs
+}
+
+func stored(t *testing.T, db *sqlite3.SQLite3Backend, filter nostr.Filter) []string {
+	ch, err := db.QueryEvents(context.Background(), filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]string, 0)
+	for event := range ch {
+		ids = append(ids, event.ID)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+func ids(events ...*nostr.Event) []string {
+	list := make([]string, len(events))
+	for i, event := range events {
+		list[i] = event.ID
+	}
+	slices.Sort(list)
+	return list
+}
+
+func TestBatches(t *testing.T) {
+	db, dsn := openDatabase(t)
+	w := newWriter(t, dsn, Options{BatchSize: 3})
+
+	unlock := lock(t, db)
+	first := benchmarkEvent(0)
+	firstResult := queue(t, w, save, first)
+	waitFor(t, "the first write", func() bool { return w.Stats().Queued == 0 })
+
+	// queued while the first batch waits, then committed 3 at a time: 7
+	// writes are 3 batches however many the first one took
+	events := make([]*nostr.Event, 6)
+	for i := range events {
+		events[i] = benchmarkEvent(int64(i + 1))
+	}
+	results := queue(t, w, save, events...)
+	unlock()
+
+	for _, err := range wait(firstResult, results) {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if stats := w.Stats(); stats.Batches != 3 || stats.Writes != 7 {
+		t.Errorf("stats: %+v", stats)
+	}
+	if got := stored(t, db, nostr.Filter{Kinds: []int{42}}); !slices.Equal(got, ids(append(events, first)...)) {
+		t.Errorf("stored: %v", got)
+	}
+}
+
+// TestCancelledCaller checks a write queued before its caller gave up is
+// reported as saved, since it's committed anyway
+func TestCancelledCaller(t *testing.T) {
+	db, dsn := openDatabase(t)
+	w := newWriter(t, dsn, Options{})
+
+	unlock := lock(t, db)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	event := benchmarkEvent(0)
+	result := make(chan error, 1)
+	go func() { result <- w.SaveEvent(ctx, event) }()
+
+	select {
+	case err := <-result:
+		t.Fatalf("returned before the commit: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+
+	if err := <-result; err != nil {
+		t.Errorf("save: %v", err)
+	}
+	if got := stored(t, db, nostr.Filter{Kinds: []int{42}}); !slices.Equal(got, ids(event)) {
+		t.Errorf("stored: %v", got)
+	}
+}
+
+func TestBatchIsolation(t *testing.T) {
+	db, dsn := openDatabase(t)
+	// what fails a write halfway, after the replaced event is deleted
+	if _, err := db.DB.Exec(`CREATE TRIGGER refuse BEFORE INSERT ON event WHEN NEW.content = 'refused'
+        BEGIN SELECT RAISE(ABORT, 'refused'); END`); err != nil {
+		t.Fatal(err)
+	}
+	w := newWriter(t, dsn, Options{})
+
+	sk := nostr.GeneratePrivateKey()
+	event := func(kind int, createdAt nostr.Timestamp, content string) *nostr.Event {
+		e := &nostr.Event{Kind: kind, CreatedAt: createdAt, Content: content}
+		e.Sign(sk)
+		return e
+	}
+	profile := event(0, 1000, "profile")
+	if err := w.ReplaceEvent(context.Background(), profile); err != nil {
+		t.Fatal(err)
+	}
+
+	before, refused, after := event(1, 1000, "before"), event(0, 2000, "refused"), event(1, 1001, "after")
+	batch := []*request{
+		{op: save, event: before, result: make(chan error, 1)},
+		{op: replace, event: refused, result: make(chan error, 1)},
+		{op: save, event: after, result: make(chan error, 1)},
+	}
+	w.commit(batch)
+
+	if err := <-batch[1].result; err == nil || !strings.Contains(err.Error(), "refused") {
+		t.Errorf("the failing write: %v", err)
+	}
+	if err := <-batch[0].result; err != nil {
+		t.Errorf("the write before: %v", err)
+	}
+	if err := <-batch[2].result; err != nil {
+		t.Errorf("the write after: %v", err)
+	}
+	if got := stored(t, db, nostr.Filter{Kinds: []int{0, 1}}); !slices.Equal(got, ids(profile, before, after)) {
+		t.Errorf("the failing write is undone, not the others: %v", got)
+	}
+}
+
+func TestBusy(t *testing.T) {
+	db, dsn := openDatabase(t)
+	w := newWriter(t, dsn, Options{QueueSize: 1, EnqueueTimeout: 10 * time.Millisecond})
+	ctx := context.Background()
+
+	unlock := lock(t, db)
+	results := queue(t, w, save, benchmarkEvent(0))
+
+	// the writer can take another write before it waits on the lock
+	busy := 0
+	for i := int64(1); i <= 3 && busy == 0; i++ {
+		r := &request{op: save, event: benchmarkEvent(i), result: make(chan error, 1)}
+		switch err := w.push(ctx, r); {
+		case errors.Is(err, ErrBusy):
+			busy++
+		case err != nil:
+			t.Fatal(err)
+		default:
+			results = append(results, r.result)
+		}
+	}
+	if err := w.SaveEvent(ctx, benchmarkEvent(10)); !errors.Is(err, ErrBusy) {
+		t.Errorf("full queue: %v", err)
+	}
+	if stats := w.Stats(); busy != 1 || stats.Busy != 2 {
+		t.Errorf("stats: %+v", stats)
+	}
+
+	unlock()
+	for _, err := range wait(results) {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestReplaceEvent(t *testing.T) {
+	db, dsn := openDatabase(t)
+	w := newWriter(t, dsn, Options{})
+	ctx := context.Background()
+
+	sk := nostr.GeneratePrivateKey()
+	event := func(kind int, createdAt nostr.Timestamp, d string) *nostr.Event {
+		e := &nostr.Event{Kind: kind, CreatedAt: createdAt}
+		if d != "" {
+			e.Tags = nostr.Tags{{"d", d}}
+		}
+		e.Sign(sk)
+		return e
+	}
+
+	older, newer, oldest := event(0, 1000, ""), event(0, 2000, ""), event(0, 500, "")
+	a, b, a2 := event(30000, 1000, "a"), event(30000, 1000, "b"), event(30000, 1500, "a")
+	for _, e := range []*nostr.Event{older, newer, oldest, a, b, a2} {
+		if err := w.ReplaceEvent(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := stored(t, db, nostr.Filter{Kinds: []int{0, 30000}}); !slices.Equal(got, ids(newer, b, a2)) {
+		t.Errorf("the newest of each kind and d tag: %v", got)
+	}
+
+	// at the same time, the lowest id wins
+	x, y := event(3, 3000, ""), event(3, 3000, "")
+	x.Content, y.Content = "x", "y"
+	x.Sign(sk)
+	y.Sign(sk)
+	low, high := x, y
+	if low.ID > high.ID {
+		low, high = high, low
+	}
+	for _, e := range []*nostr.Event{low, high} {
+		if err := w.ReplaceEvent(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := stored(t, db, nostr.Filter{Kinds: []int{3}}); !slices.Equal(got, ids(low)) {
+		t.Errorf("same created_at: %v, want %s", got, low.ID)
+	}
+}
+
+func TestClose(t *testing.T) {
+	db, dsn := openDatabase(t)
+	w, err := New(dsn, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unlock := lock(t, db)
+	events := make([]*nostr.Event, 5)
+	for i := range events {
+		events[i] = benchmarkEvent(int64(i))
+	}
+	results := queue(t, w, save, events...)
+
+	closed := make(chan error)
+	go func() { closed <- w.Close(context.Background()) }()
+	waitFor(t, "closing", func() bool {
+		w.mu.RLock()
+		defer w.mu.RUnlock()
+		return w.closed
+	})
+	if err := w.SaveEvent(context.Background(), benchmarkEvent(10)); !errors.Is(err, ErrClosed) {
+		t.Errorf("write after closing: %v", err)
+	}
+
+	unlock()
+	if err := <-closed; err != nil {
+		t.Fatal(err)
+	}
+	for _, err := range wait(results) {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if got := stored(t, db, nostr.Filter{Kinds: []int{42}}); !slices.Equal(got, ids(events...)) {
+		t.Errorf("the queued writes are committed: %v", got)
+	}
+}
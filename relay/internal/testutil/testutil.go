@@ -0,0 +1,85 @@
+// Package testutil has the fixtures shared by the tests of several packages
+package testutil
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"nostr-relay/blossom"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/eventstore/sqlite3"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// DB opens an event store in a temporary directory, closed with the test
+func DB(t testing.TB, name string) *sqlite3.SQLite3Backend {
+	t.Helper()
+	db := &sqlite3.SQLite3Backend{DatabaseURL: filepath.Join(t.TempDir(), name+".sqlite")}
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+	return db
+}
+
+// Saver returns a function signing events with a private key and storing
+// them in db
+func Saver(t testing.TB, db eventstore.Store) func(sk string, event nostr.Event) nostr.Event {
+	return func(sk string, event nostr.Event) nostr.Event {
+		t.Helper()
+		if err := event.Sign(sk); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.SaveEvent(context.Background(), &event); err != nil {
+			t.Fatal(err)
+		}
+		return event
+	}
+}
+
+// Relay starts a relay keeping events in store and returns its URL. The
+// reject hooks decide what it refuses.
+func Relay(t testing.TB, store eventstore.Store, reject ...func(ctx context.Context, event *nostr.Event) (bool, string)) string {
+	relay := khatru.NewRelay()
+	relay.StoreEvent = append(relay.StoreEvent, store.SaveEvent)
+	relay.QueryEvents = append(relay.QueryEvents, store.QueryEvents)
+	relay.RejectEvent = append(relay.RejectEvent, reject...)
+
+	server := httptest.NewServer(relay)
+	t.Cleanup(server.Close)
+
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+// Unreachable returns the URL of a relay that is gone
+func Unreachable() string {
+	server := httptest.NewServer(nil)
+	server.Close()
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+// Blobs is a blob store in memory, by hash
+type Blobs map[string][]byte
+
+func (b Blobs) Open(ctx context.Context, sha256 string) (io.ReadCloser, error) {
+	data, ok := b[sha256]
+	if !ok {
+		return nil, blossom.ErrNotFound
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// Sum is the hex SHA-256 of data, the hash blobs are known by
+func Sum(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
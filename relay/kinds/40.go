@@ -12,6 +12,22 @@ type Channel struct {
 	About   string   `json:"about"`
 	Picture string   `json:"picture"`
 	Relays  []string `json:"relays"`
+
+	// Background is the URL of the image comic panels of the channel are
+	// drawn on, usually a Blossom blob
+	Background string `json:"background,omitempty"`
+
+	// MessageExpiration is the number of seconds after which messages
+	// without their own NIP-40 expiration tag expire, 0 to keep them
+	MessageExpiration int64 `json:"message_expiration,omitempty"`
+
+	// Moderators can delete any message of the channel, besides its owner
+	Moderators []string `json:"moderators,omitempty"`
+
+	// RetentionMaxAge (seconds) and RetentionMaxMessages ask the relay to
+	// prune older messages, within the bounds set by the operator
+	RetentionMaxAge      int64 `json:"retention_max_age,omitempty"`
+	RetentionMaxMessages int64 `json:"retention_max_messages,omitempty"`
 }
 
 func ValidateCreateChannel(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
@@ -24,5 +40,24 @@ func ValidateCreateChannel(ctx context.Context, event *nostr.Event) (reject bool
 		return true, "Invalid content"
 	}
 
+	return validateMetadata(content)
+}
+
+// validateMetadata checks the fields of kind 40 and 41 contents
+func validateMetadata(content Channel) (reject bool, msg string) {
+	if content.MessageExpiration < 0 {
+		return true, "invalid: negative message_expiration"
+	}
+
+	if content.RetentionMaxAge < 0 || content.RetentionMaxMessages < 0 {
+		return true, "invalid: negative retention"
+	}
+
+	for _, moderator := range content.Moderators {
+		if !nostr.IsValidPublicKey(moderator) {
+			return true, "invalid: moderators must be hex pubkeys"
+		}
+	}
+
 	return false, ""
 }
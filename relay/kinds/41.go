@@ -27,6 +27,9 @@ func ValidateUpdateChannel(
 		}
 	}
 
+	if len(eventTag) < 2 {
+		return true, "missing channel reference"
+	}
 	eventId := eventTag[1]
 
 	// we need to check if the channel is already created and it exists in the database
@@ -38,8 +41,15 @@ func ValidateUpdateChannel(
 
 	// if the channel is found in database, we still need to validate content
 	if count == 0 {
+		if !RemoteLookups(ctx) {
+			return true, "40 channel not found locally and remote lookups are disabled"
+		}
+
 		// Channel not in database, check remote relays
-		relayToCheck := eventTag[2]
+		relayToCheck := ""
+		if len(eventTag) > 2 {
+			relayToCheck = eventTag[2]
+		}
 		_, err = getCreateEvent(ctx, event, relayToCheck, eventId)
 		if err != nil {
 			return true, "failed to get create event: " + err.Error()
@@ -52,6 +62,10 @@ func ValidateUpdateChannel(
 		return true, "Invalid content"
 	}
 
+	if reject, msg := validateMetadata(content); reject {
+		return true, msg
+	}
+
 	// everything is fine
 	return false, ""
 }
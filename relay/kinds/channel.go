@@ -0,0 +1,43 @@
+package kinds
+
+import "github.com/nbd-wtf/go-nostr"
+
+// ChannelMessageKinds are the kinds posted inside a channel: plain NIP-28
+// messages and comic messages.
+var ChannelMessageKinds = []int{42, 7353}
+
+// IsChannelMessage tells if event is a message posted in a channel
+func IsChannelMessage(event *nostr.Event) bool {
+	return event.Kind == 42 || event.Kind == 7353
+}
+
+// ChannelID returns the channel an event (41, 42 or 7353) refers to, which is
+// the "e" tag marked as "root" or, failing that, the first "e" tag.
+func ChannelID(event *nostr.Event) string {
+	first := ""
+	for _, tag := range event.Tags {
+		if len(tag) < 2 || tag[0] != "e" {
+			continue
+		}
+
+		if len(tag) >= 4 && tag[3] == "root" {
+			return tag[1]
+		}
+
+		if first == "" {
+			first = tag[1]
+		}
+	}
+
+	return first
+}
+
+// ChannelIDSQL is ChannelID as an SQL expression, for a query on the event
+// table aliased e
+const ChannelIDSQL = `COALESCE(
+          (SELECT json_extract(t.value, '$[1]') FROM json_each(CAST(e.tags AS TEXT)) t
+           WHERE json_extract(t.value, '$[0]') = 'e' AND json_extract(t.value, '$[1]') IS NOT NULL
+             AND json_extract(t.value, '$[3]') = 'root' ORDER BY t.key LIMIT 1),
+          (SELECT json_extract(t.value, '$[1]') FROM json_each(CAST(e.tags AS TEXT)) t
+           WHERE json_extract(t.value, '$[0]') = 'e' AND json_extract(t.value, '$[1]') IS NOT NULL
+           ORDER BY t.key LIMIT 1))`
@@ -0,0 +1,93 @@
+package kinds
+
+import (
+	"slices"
+	"strings"
+)
+
+// Run is a piece of kind 7353 message text sharing the same styles, which
+// are the names of the markup tags around it, outermost first ("bold", "c1").
+type Run struct {
+	Text   string
+	Styles []string
+}
+
+// ParseMarkup splits the content of a comic message into runs. Markup tags
+// look like <bold>...</bold> or <c1>...</c1>; anything else that looks like
+// a tag, and unmatched closing tags, are kept as text.
+func ParseMarkup(content string) []Run {
+	runs := make([]Run, 0)
+	styles := make([]string, 0)
+	text := strings.Builder{}
+
+	flush := func() {
+		if text.Len() > 0 {
+			runs = append(runs, Run{Text: text.String(), Styles: slices.Clone(styles)})
+			text.Reset()
+		}
+	}
+
+	for len(content) > 0 {
+		start := strings.IndexByte(content, '<')
+		if start < 0 {
+			text.WriteString(content)
+			break
+		}
+		text.WriteString(content[:start])
+		content = content[start:]
+
+		name, closing, length := markupTag(content)
+		switch {
+		case length == 0:
+			text.WriteByte('<')
+			content = content[1:]
+			continue
+		case !closing:
+			flush()
+			styles = append(styles, name)
+		default:
+			open := slices.Index(styles, name)
+			if open < 0 {
+				text.WriteString(content[:length])
+				break
+			}
+			flush()
+			styles = slices.Delete(styles, open, open+1)
+		}
+		content = content[length:]
+	}
+	flush()
+
+	return runs
+}
+
+// PlainText returns the content of a comic message without its markup
+func PlainText(content string) string {
+	text := strings.Builder{}
+	for _, run := range ParseMarkup(content) {
+		text.WriteString(run.Text)
+	}
+
+	return text.String()
+}
+
+// markupTag reads the tag at the start of s, returning a zero length when s
+// doesn't start with one
+func markupTag(s string) (name string, closing bool, length int) {
+	i := 1
+	if i < len(s) && s[i] == '/' {
+		closing = true
+		i++
+	}
+
+	start := i
+	for i < len(s) && (s[i] >= 'a' && s[i] <= 'z' || i > start && s[i] >= '0' && s[i] <= '9') {
+		i++
+	}
+
+	if i == start || i >= len(s) || s[i] != '>' {
+		return "", false, 0
+	}
+
+	return s[start:i], closing, i + 1
+}
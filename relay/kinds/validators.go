@@ -0,0 +1,36 @@
+package kinds
+
+import (
+	"context"
+
+	"github.com/fiatjaf/eventstore/sqlite3"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+type contextKey int
+
+const skipRemoteLookupsKey contextKey = iota
+
+// Validators returns the RejectEvent hooks checking the kinds of this
+// project, in the order the relay runs them. Imports use the same list so a
+// dump can't bring in events the relay would have refused.
+func Validators(db *sqlite3.SQLite3Backend) []func(ctx context.Context, event *nostr.Event) (bool, string) {
+	return []func(ctx context.Context, event *nostr.Event) (bool, string){
+		ValidateCreateChannel,
+		func(ctx context.Context, event *nostr.Event) (bool, string) {
+			return ValidateUpdateChannel(ctx, db, event)
+		},
+	}
+}
+
+// WithoutRemoteLookups marks ctx so validators only consult the local
+// database, rejecting what they would otherwise fetch from other relays
+func WithoutRemoteLookups(ctx context.Context) context.Context {
+	return context.WithValue(ctx, skipRemoteLookupsKey, true)
+}
+
+// RemoteLookups tells if validators may query other relays
+func RemoteLookups(ctx context.Context) bool {
+	skip, _ := ctx.Value(skipRemoteLookupsKey).(bool)
+	return !skip
+}
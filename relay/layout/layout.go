@@ -0,0 +1,381 @@
+package layout
+
+import (
+	"slices"
+)
+
+// Message is what the layout needs of a message: who says it, to whom, and
+// the size its text takes in a balloon
+type Message struct {
+	Speaker string `json:"speaker"`
+
+	// To is who the message answers or mentions, "" for everyone
+	To string `json:"to,omitempty"`
+
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+}
+
+// Options tune the layout, zero values use the defaults
+type Options struct {
+	// Width and Height are the size of a panel
+	Width  float64
+	Height float64
+
+	// Margin is kept around and between balloons, Padding inside them
+	// around the text
+	Margin  float64
+	Padding float64
+
+	// CharacterHeight is how tall characters stand at the bottom of panels
+	CharacterHeight float64
+
+	// MaxBalloons and MaxCharacters are how many balloons and characters a
+	// panel holds at most
+	MaxBalloons   int
+	MaxCharacters int
+}
+
+func (o Options) withDefaults() Options {
+	if o.Width <= 0 {
+		o.Width = 480
+	}
+	if o.Height <= 0 {
+		o.Height = 360
+	}
+	if o.Margin <= 0 {
+		o.Margin = o.Width * 0.03
+	}
+	if o.Padding <= 0 {
+		o.Padding = 8
+	}
+	if o.CharacterHeight <= 0 {
+		o.CharacterHeight = o.Height * 0.45
+	}
+	if o.MaxBalloons <= 0 {
+		o.MaxBalloons = 3
+	}
+	if o.MaxCharacters <= 0 {
+		o.MaxCharacters = 4
+	}
+	return o
+}
+
+// Rect is an area of a panel, from its top left corner
+type Rect struct {
+	X      float64 `json:"x"`
+	Y      float64 `json:"y"`
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+}
+
+// Point is a position in a panel
+type Point struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+const (
+	Left  = "left"
+	Right = "right"
+)
+
+// Character is someone standing in a panel
+type Character struct {
+	Speaker string `json:"speaker"`
+
+	// Message is the last message of the speaker up to the panel, which
+	// says how they look; listeners didn't speak in the panel
+	Message  int  `json:"message"`
+	Speaking bool `json:"speaking"`
+
+	Rect   Rect   `json:"rect"`
+	Facing string `json:"facing"`
+}
+
+// Balloon has the consecutive messages of a character in a panel
+type Balloon struct {
+	// Character is the index of the speaker in the characters of the panel
+	Character int   `json:"character"`
+	Messages  []int `json:"messages"`
+
+	Rect Rect `json:"rect"`
+
+	// Text is where the text of each message goes, inside the padding
+	Text []Rect `json:"text"`
+
+	// Tail is where the tail points, the head of the speaker
+	Tail Point `json:"tail"`
+}
+
+// Panel is a frame of the comic, the indexes of its messages follow each
+// other
+type Panel struct {
+	Messages   []int       `json:"messages"`
+	Characters []Character `json:"characters"`
+	Balloons   []Balloon   `json:"balloons"`
+}
+
+// Compose cuts messages into panels the way Microsoft Comic Chat did, and
+// says where characters stand, which way they face and where balloons go.
+// Nothing is drawn, so panels can be shared as JSON with clients that draw
+// themselves. A message goes in the current panel unless:
+//   - its speaker already has a balloon in the panel that isn't the last
+//     one, as the balloons would be read out of order,
+//   - it makes more than MaxBalloons balloons or MaxCharacters speakers,
+//   - its balloon doesn't fit above the characters anymore.
+//
+// Consecutive messages of a speaker share a balloon. A message alone in its
+// panel stays there even when it doesn't fit.
+func Compose(messages []Message, options Options) []Panel {
+	o := options.withDefaults()
+	panels := make([]Panel, 0)
+
+	// the last message of every speaker before the current panel
+	seen := make(map[string]int)
+	var previous *Panel
+
+	for start := 0; start < len(messages); {
+		end := start + 1
+		panel, _ := o.compose(messages, start, end, previous, seen)
+		for end < len(messages) && !interrupts(messages, start, end) {
+			next, ok := o.compose(messages, start, end+1, previous, seen)
+			if !ok {
+				break
+			}
+			panel, end = next, end+1
+		}
+
+		panels = append(panels, panel)
+		previous = &panels[len(panels)-1]
+		for i := start; i < end; i++ {
+			seen[messages[i].Speaker] = i
+		}
+		start = end
+	}
+	return panels
+}
+
+// interrupts tells if messages[end] is by a speaker who spoke in
+// messages[start:end] before someone else did
+func interrupts(messages []Message, start int, end int) bool {
+	speaker := messages[end].Speaker
+	if messages[end-1].Speaker == speaker {
+		return false
+	}
+	for i := start; i < end-1; i++ {
+		if messages[i].Speaker == speaker {
+			return true
+		}
+	}
+	return false
+}
+
+// compose lays out messages[start:end] as a panel, telling if it fits
+func (o Options) compose(messages []Message, start int, end int, previous *Panel, seen map[string]int) (Panel, bool) {
+	panel := Panel{Messages: make([]int, 0, end-start), Characters: make([]Character, 0), Balloons: make([]Balloon, 0)}
+
+	// speakers in the order they first speak, which is the reading order
+	speakers := make([]string, 0)
+	for i := start; i < end; i++ {
+		panel.Messages = append(panel.Messages, i)
+		m := messages[i]
+		if n := len(panel.Balloons); n > 0 && messages[panel.Balloons[n-1].Messages[0]].Speaker == m.Speaker {
+			panel.Balloons[n-1].Messages = append(panel.Balloons[n-1].Messages, i)
+			continue
+		}
+		if !slices.Contains(speakers, m.Speaker) {
+			speakers = append(speakers, m.Speaker)
+		}
+		panel.Balloons = append(panel.Balloons, Balloon{Messages: []int{i}})
+	}
+	ok := len(panel.Balloons) <= o.MaxBalloons && len(speakers) <= o.MaxCharacters
+
+	o.cast(&panel, messages, speakers, previous, seen)
+	o.face(&panel, messages)
+	if !o.balloons(&panel, messages) {
+		ok = false
+	}
+	return panel, ok
+}
+
+// cast puts the speakers of a panel in reading order, the first on the
+// left, with listeners: those they answer who spoke before and, when the
+// speaker is alone, the last other speaker of the previous panel. Listeners
+// stand on the side they stood on before.
+func (o Options) cast(panel *Panel, messages []Message, speakers []string, previous *Panel, seen map[string]int) {
+	last := make(map[string]int)
+	for _, i := range panel.Messages {
+		last[messages[i].Speaker] = i
+	}
+
+	listeners := make([]string, 0)
+	listen := func(speaker string) {
+		if _, ok := seen[speaker]; ok && !slices.Contains(speakers, speaker) && !slices.Contains(listeners, speaker) &&
+			len(speakers)+len(listeners) < o.MaxCharacters {
+			listeners = append(listeners, speaker)
+		}
+	}
+	for _, i := range panel.Messages {
+		if to := messages[i].To; to != "" {
+			listen(to)
+		}
+	}
+	if len(speakers) == 1 && len(listeners) == 0 && previous != nil {
+		// the conversation goes on with whoever spoke last
+		latest := -1
+		for _, c := range previous.Characters {
+			if c.Speaker != speakers[0] && c.Speaking && c.Message > latest {
+				latest = c.Message
+			}
+		}
+		if latest >= 0 {
+			listen(messages[latest].Speaker)
+		}
+	}
+
+	side := func(speaker string) string {
+		if previous != nil {
+			for _, c := range previous.Characters {
+				if c.Speaker == speaker && c.Rect.X+c.Rect.Width/2 < o.Width/2 {
+					return Left
+				}
+			}
+		}
+		return Right
+	}
+
+	order := make([]string, 0, len(speakers)+len(listeners))
+	for _, l := range listeners {
+		if side(l) == Left {
+			order = append(order, l)
+		}
+	}
+	order = append(order, speakers...)
+	for _, l := range listeners {
+		if side(l) == Right {
+			order = append(order, l)
+		}
+	}
+
+	n := float64(len(order))
+	width := min(o.CharacterHeight, o.Width/n)
+	for i, speaker := range order {
+		c := Character{Speaker: speaker, Facing: Right}
+		if m, ok := last[speaker]; ok {
+			c.Message, c.Speaking = m, true
+		} else {
+			c.Message = seen[speaker]
+		}
+		center := o.Width * (float64(i) + 0.5) / n
+		c.Rect = Rect{X: center - width/2, Y: o.Height - o.CharacterHeight, Width: width, Height: o.CharacterHeight}
+		panel.Characters = append(panel.Characters, c)
+	}
+
+	for i := range panel.Balloons {
+		speaker := messages[panel.Balloons[i].Messages[0]].Speaker
+		panel.Balloons[i].Character = slices.IndexFunc(panel.Characters, func(c Character) bool { return c.Speaker == speaker })
+	}
+}
+
+// face turns characters toward who they talk to, listeners toward who
+// talks to them, and everyone else toward the others
+func (o Options) face(panel *Panel, messages []Message) {
+	center := func(c Character) float64 { return c.Rect.X + c.Rect.Width/2 }
+	index := func(speaker string) int {
+		return slices.IndexFunc(panel.Characters, func(c Character) bool { return c.Speaker == speaker })
+	}
+
+	for i := range panel.Characters {
+		c := &panel.Characters[i]
+		target := -1
+
+		if c.Speaking {
+			if to := messages[c.Message].To; to != "" && to != c.Speaker {
+				target = index(to)
+			}
+		} else {
+			for _, m := range panel.Messages {
+				if messages[m].To == c.Speaker {
+					target = index(messages[m].Speaker)
+					break
+				}
+			}
+		}
+
+		var x float64
+		if target >= 0 {
+			x = center(panel.Characters[target])
+		} else {
+			if len(panel.Characters) == 1 {
+				continue
+			}
+			for j, other := range panel.Characters {
+				if j != i {
+					x += center(other)
+				}
+			}
+			x /= float64(len(panel.Characters) - 1)
+		}
+		if x < center(*c) {
+			c.Facing = Left
+		}
+	}
+}
+
+// balloons places balloons above their speakers in reading order: a
+// balloon is never higher than the one before, and is below it unless it's
+// entirely to its right. It tells if they all fit above the characters.
+func (o Options) balloons(panel *Panel, messages []Message) bool {
+	bottom := o.Height - o.CharacterHeight - o.Margin
+	fits := true
+
+	for i := range panel.Balloons {
+		b := &panel.Balloons[i]
+
+		w, h := 0.0, 0.0
+		for k, m := range b.Messages {
+			w = max(w, messages[m].Width)
+			if k > 0 {
+				h += o.Padding
+			}
+			h += messages[m].Height
+		}
+		w = min(w+2*o.Padding, o.Width-2*o.Margin)
+		h += 2 * o.Padding
+
+		speaker := panel.Characters[b.Character]
+		x := speaker.Rect.X + speaker.Rect.Width/2 - w/2
+		x = min(max(x, o.Margin), o.Width-o.Margin-w)
+
+		y := o.Margin
+		if i > 0 {
+			before := panel.Balloons[i-1].Rect
+			y = max(y, before.Y)
+			if x < before.X+before.Width+o.Margin {
+				y = max(y, before.Y+before.Height+o.Margin)
+			}
+		}
+		for _, other := range panel.Balloons[:i] {
+			if x < other.Rect.X+other.Rect.Width+o.Margin && other.Rect.X < x+w+o.Margin {
+				y = max(y, other.Rect.Y+other.Rect.Height+o.Margin)
+			}
+		}
+
+		b.Rect = Rect{X: x, Y: y, Width: w, Height: h}
+		if y+h > bottom {
+			fits = false
+		}
+
+		b.Text = make([]Rect, 0, len(b.Messages))
+		ty := y + o.Padding
+		for _, m := range b.Messages {
+			b.Text = append(b.Text, Rect{X: x + o.Padding, Y: ty, Width: w - 2*o.Padding, Height: messages[m].Height})
+			ty += messages[m].Height + o.Padding
+		}
+
+		b.Tail = Point{X: speaker.Rect.X + speaker.Rect.Width/2, Y: speaker.Rect.Y}
+	}
+
+	return fits
+}
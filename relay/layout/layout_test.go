@@ -0,0 +1,151 @@
+package layout
+
+import (
+	"slices"
+	"testing"
+)
+
+func says(speaker string, to string) Message {
+	return Message{Speaker: speaker, To: to, Width: 80, Height: 20}
+}
+
+func speakers(p Panel) []string {
+	s := make([]string, 0)
+	for _, c := range p.Characters {
+		s = append(s, c.Speaker)
+	}
+	return s
+}
+
+func TestCompose(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages []Message
+		options  Options
+		want     [][]int
+	}{
+		{
+			name:     "consecutive messages share a balloon",
+			messages: []Message{says("a", ""), says("a", ""), says("b", "")},
+			want:     [][]int{{0, 1, 2}},
+		},
+		{
+			name:     "speaking again after someone else starts a panel",
+			messages: []Message{says("a", ""), says("b", ""), says("a", ""), says("b", "")},
+			want:     [][]int{{0, 1}, {2, 3}},
+		},
+		{
+			name:     "max balloons",
+			messages: []Message{says("a", ""), says("b", ""), says("c", ""), says("d", "")},
+			options:  Options{MaxBalloons: 2},
+			want:     [][]int{{0, 1}, {2, 3}},
+		},
+		{
+			name:     "max characters",
+			messages: []Message{says("a", ""), says("b", ""), says("c", "")},
+			options:  Options{MaxCharacters: 2},
+			want:     [][]int{{0, 1}, {2}},
+		},
+		{
+			name: "balloons that don't fit",
+			messages: []Message{
+				{Speaker: "a", Width: 300, Height: 100}, {Speaker: "b", Width: 300, Height: 100}, {Speaker: "c", Width: 80, Height: 500},
+			},
+			want: [][]int{{0}, {1}, {2}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := make([][]int, 0)
+			for _, p := range Compose(tt.messages, tt.options) {
+				got = append(got, p.Messages)
+			}
+			if !slices.EqualFunc(got, tt.want, slices.Equal) {
+				t.Errorf("panels %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCast(t *testing.T) {
+	first := Compose([]Message{says("a", ""), says("b", ""), says("c", "")}, Options{})[0]
+	if !slices.Equal(speakers(first), []string{"a", "b", "c"}) {
+		t.Errorf("speakers in reading order: %v", speakers(first))
+	}
+	for i, c := range first.Characters {
+		if i > 0 && c.Rect.X <= first.Characters[i-1].Rect.X {
+			t.Errorf("characters from left to right: %+v", first.Characters)
+		}
+	}
+	if facing := []string{first.Characters[0].Facing, first.Characters[2].Facing}; !slices.Equal(facing, []string{Right, Left}) {
+		t.Errorf("characters face the others: %v", facing)
+	}
+
+	// b answers a, who was on the left
+	panels := Compose([]Message{says("a", ""), says("b", ""), says("c", ""), says("b", "a")}, Options{})
+	answer := panels[len(panels)-1]
+	if !slices.Equal(speakers(answer), []string{"a", "b"}) || answer.Characters[0].Speaking || answer.Characters[0].Message != 0 {
+		t.Errorf("the one answered listens on the side they were: %+v", answer.Characters)
+	}
+	if answer.Characters[0].Facing != Right || answer.Characters[1].Facing != Left {
+		t.Errorf("speaker and listener face each other: %+v", answer.Characters)
+	}
+
+	// a goes on alone, b listens
+	panels = Compose([]Message{says("a", ""), says("b", ""), says("a", "")}, Options{})
+	alone := panels[len(panels)-1]
+	if !slices.Equal(speakers(alone), []string{"a", "b"}) || alone.Characters[1].Speaking || alone.Characters[1].Message != 1 {
+		t.Errorf("the last speaker listens to someone alone: %+v", alone.Characters)
+	}
+
+	panels = Compose([]Message{says("a", ""), says("b", ""), says("a", "nobody")}, Options{})
+	if s := speakers(panels[len(panels)-1]); slices.Contains(s, "nobody") {
+		t.Errorf("only those who spoke listen: %v", s)
+	}
+}
+
+func TestBalloons(t *testing.T) {
+	messages := []Message{
+		{Speaker: "a", Width: 60, Height: 20},
+		{Speaker: "a", Width: 100, Height: 40},
+		{Speaker: "b", Width: 60, Height: 20},
+		{Speaker: "c", Width: 250, Height: 20},
+	}
+	o := Options{}.withDefaults()
+	panels := Compose(messages, o)
+	if len(panels) != 1 {
+		t.Fatalf("panels: %d", len(panels))
+	}
+	balloons := panels[0].Balloons
+	if len(balloons) != 3 {
+		t.Fatalf("balloons: %+v", balloons)
+	}
+
+	a := balloons[0]
+	if a.Rect.Width != 100+2*o.Padding || a.Rect.Height != 20+40+3*o.Padding || len(a.Text) != 2 || a.Text[1].Y != a.Text[0].Y+20+o.Padding {
+		t.Errorf("a balloon with two messages: %+v", a)
+	}
+
+	for i, b := range balloons {
+		if b.Rect.X < o.Margin || b.Rect.X+b.Rect.Width > o.Width-o.Margin+0.001 {
+			t.Errorf("balloon %d leaves the panel: %+v", i, b.Rect)
+		}
+		speaker := panels[0].Characters[b.Character]
+		if b.Tail.X != speaker.Rect.X+speaker.Rect.Width/2 || b.Tail.Y != speaker.Rect.Y {
+			t.Errorf("balloon %d points at %+v, its speaker is %+v", i, b.Tail, speaker.Rect)
+		}
+		if i == 0 {
+			continue
+		}
+		before := balloons[i-1].Rect
+		if b.Rect.Y < before.Y || b.Rect.Y == before.Y && b.Rect.X < before.X+before.Width {
+			t.Errorf("balloon %d is read before balloon %d: %+v %+v", i, i-1, b.Rect, before)
+		}
+	}
+
+	// b is right of a, c is too wide to be beside them
+	if balloons[1].Rect.Y != balloons[0].Rect.Y || balloons[2].Rect.Y <= balloons[1].Rect.Y {
+		t.Errorf("rows: %+v", balloons)
+	}
+}
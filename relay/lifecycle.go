@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"nostr-relay/dashboard"
+	"nostr-relay/ingest"
+
+	"github.com/fiatjaf/eventstore/sqlite3"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+var errShuttingDown = errors.New("error: relay is shutting down")
+
+// lifecycle keeps track of what the relay is doing so it can stop cleanly:
+// which websockets are open, which writes are in flight and whether we are
+// still accepting new work.
+type lifecycle struct {
+	mu       sync.Mutex
+	draining bool
+	clients  map[*khatru.WebSocket]time.Time
+	writes   sync.WaitGroup
+}
+
+func newLifecycle() *lifecycle {
+	return &lifecycle{
+		clients: make(map[*khatru.WebSocket]time.Time),
+	}
+}
+
+func (lc *lifecycle) onConnect(ctx context.Context) {
+	ws := khatru.GetConnection(ctx)
+	if ws == nil {
+		return
+	}
+
+	lc.mu.Lock()
+	lc.clients[ws] = time.Now()
+	lc.mu.Unlock()
+}
+
+func (lc *lifecycle) onDisconnect(ctx context.Context) {
+	ws := khatru.GetConnection(ctx)
+	if ws == nil {
+		return
+	}
+
+	lc.mu.Lock()
+	delete(lc.clients, ws)
+	lc.mu.Unlock()
+}
+
+// connections lists the open websockets for the dashboard
+func (lc *lifecycle) connections() []dashboard.Connection {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	list := make([]dashboard.Connection, 0, len(lc.clients))
+	for ws, connectedAt := range lc.clients {
+		list = append(list, dashboard.Connection{
+			IP:          khatru.GetIPFromRequest(ws.Request),
+			UserAgent:   ws.Request.UserAgent(),
+			PubKey:      ws.AuthedPublicKey,
+			ConnectedAt: connectedAt,
+		})
+	}
+
+	slices.SortFunc(list, func(a, b dashboard.Connection) int {
+		return a.ConnectedAt.Compare(b.ConnectedAt)
+	})
+
+	return list
+}
+
+// rejectConnection refuses new websockets once we started shutting down
+func (lc *lifecycle) rejectConnection(r *http.Request) bool {
+	return lc.isDraining()
+}
+
+func (lc *lifecycle) isDraining() bool {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	return lc.draining
+}
+
+// beginWrite registers an in-flight write, it returns false when the relay is
+// shutting down and the write must not start.
+func (lc *lifecycle) beginWrite() bool {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	if lc.draining {
+		return false
+	}
+
+	lc.writes.Add(1)
+	return true
+}
+
+func (lc *lifecycle) endWrite() {
+	lc.writes.Done()
+}
+
+// shutdown stops accepting connections, tells every client we are going away,
+// waits for in-flight writes and finally closes the database. It gives up
+// waiting when ctx is done.
+func (lc *lifecycle) shutdown(ctx context.Context, relay *khatru.Relay, writer *ingest.Writer, db *sqlite3.SQLite3Backend) {
+	lc.mu.Lock()
+	lc.draining = true
+	clients := make([]*khatru.WebSocket, 0, len(lc.clients))
+	for ws := range lc.clients {
+		clients = append(clients, ws)
+	}
+	lc.mu.Unlock()
+
+	log.Printf("Notifying %d connected clients", len(clients))
+	notified := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		for _, ws := range clients {
+			wg.Add(1)
+			go func(ws *khatru.WebSocket) {
+				defer wg.Done()
+				ws.WriteJSON(nostr.NoticeEnvelope("restarting: relay is shutting down"))
+			}(ws)
+		}
+		wg.Wait()
+		close(notified)
+	}()
+
+	select {
+	case <-notified:
+	case <-ctx.Done():
+		log.Printf("Timed out notifying clients")
+	}
+
+	// stops the listener and closes all websockets (and their subscriptions)
+	relay.Shutdown(ctx)
+	log.Printf("Stopped accepting connections")
+
+	drained := make(chan struct{})
+	go func() {
+		lc.writes.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		log.Printf("All in-flight writes finished")
+	case <-ctx.Done():
+		log.Printf("Timed out waiting for in-flight writes: %v", ctx.Err())
+	}
+
+	// the queue is empty by now, unless waiting for the writes timed out
+	if err := writer.Close(ctx); err != nil {
+		log.Printf("Failed to stop the writer: %v", err)
+	}
+
+	db.Close()
+	log.Printf("Database closed")
+}
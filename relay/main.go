@@ -1,27 +1,95 @@
 package main
 
 import (
-	"context"
+	"flag"
 	"fmt"
 	"log"
-	"net/http"
+	"os"
 	"path/filepath"
-	"time"
+	"strings"
 
-	"nostr-relay/kinds"
+	"nostr-relay/config"
 
 	"github.com/fiatjaf/eventstore/sqlite3"
-	"github.com/fiatjaf/khatru"
-	"github.com/nbd-wtf/go-nostr"
 )
 
+type command struct {
+	name        string
+	description string
+	run         func(cfg config.Config, args []string) error
+}
+
+var commands = []command{
+	{"serve", "run the relay (default)", runServe},
+	{"export", "write events as JSON lines", runExport},
+	{"import", "read events from JSON lines, verifying signatures", runImport},
+	{"stats", "show per-kind and per-channel counts", runStats},
+	{"vacuum", "compact the database file", runVacuum},
+	{"reindex", "rebuild derived tables (channel state, search index, expirations)", runReindex},
+	{"check", "scan the database for corruption and invalid events", runCheck},
+	{"retention", "show or override the message retention of channels", runRetention},
+	{"verify", "check that the blobs of character drives exist and match", runVerify},
+	{"sanitize", "check SVG files for scripts and external references, -w to remove them", runSanitize},
+	{"comic", "export a channel as a comic strip in SVG, HTML or PDF", runComic},
+	{"replay", "export a channel as an animated SVG, GIF or APNG replay", runReplay},
+}
+
 func main() {
 	// Set up logging to include timestamps
 	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
-	log.Printf("Starting Nostr Comic Chat Relay...")
 
+	cfg := config.Load()
+
+	// serving is the default so `go run .` keeps working
+	name := "serve"
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	if name == "help" {
+		usage()
+		return
+	}
+
+	for _, cmd := range commands {
+		if cmd.name == name {
+			if err := cmd.run(cfg, args); err != nil {
+				log.Fatalf("%s: %v", name, err)
+			}
+			return
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+	usage()
+	os.Exit(2)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Nostr Comic Chat Relay\n\nUsage: %s <command> [flags]\n\nCommands:\n", filepath.Base(os.Args[0]))
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", cmd.name, cmd.description)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun '<command> -h' for the flags of a command. Settings are also read from RELAY_* environment variables.\n")
+}
+
+// newFlagSet creates the flags of a command, all of them can point to another
+// database than the configured one
+func newFlagSet(name string, arguments string, cfg *config.Config) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.StringVar(&cfg.DatabasePath, "db", cfg.DatabasePath, "path to the SQLite database")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s [flags] %s\n\nFlags:\n", filepath.Base(os.Args[0]), name, arguments)
+		flags.PrintDefaults()
+	}
+
+	return flags
+}
+
+func openDatabase(cfg config.Config) (*sqlite3.SQLite3Backend, error) {
 	// Log the database path for diagnostic purposes
-	dbPath := "./db.sqlite"
+	dbPath := cfg.DatabasePath
 	absPath, err := filepath.Abs(dbPath)
 	if err == nil {
 		log.Printf("Using database at: %s (absolute: %s)", dbPath, absPath)
@@ -29,70 +97,29 @@ func main() {
 		log.Printf("Using database at: %s (could not resolve absolute path)", dbPath)
 	}
 
-	db := sqlite3.SQLite3Backend{
-		DatabaseURL: dbPath,
+	db := &sqlite3.SQLite3Backend{
+		DatabaseURL: databaseDSN(dbPath),
 	}
 
 	// Add more diagnostic information for initialization
 	log.Printf("Initializing database connection...")
 	if err := db.Init(); err != nil {
-		log.Printf("Database initialization error: %v", err)
-		panic(err)
+		return nil, fmt.Errorf("database initialization error: %w", err)
 	}
 	log.Printf("Database initialized successfully")
 
-	relay := khatru.NewRelay()
-
-	// Add connection logging
-	relay.OnConnect = append(relay.OnConnect, func(ctx context.Context) {
-		log.Printf("New client connected")
-	})
-
-	relay.OnDisconnect = append(relay.OnDisconnect, func(ctx context.Context) {
-		log.Printf("Client disconnected")
-	})
-
-	// Add event logging
-	relay.OnEventSaved = append(relay.OnEventSaved, func(ctx context.Context, event *nostr.Event) {
-		log.Printf("Event saved: %s (kind: %d)", event.ID, event.Kind)
-	})
-
-	relay.OnEphemeralEvent = append(relay.OnEphemeralEvent, func(ctx context.Context, event *nostr.Event) {
-		log.Printf("Ephemeral event received: %s (kind: %d)", event.ID, event.Kind)
-	})
-
-	// Set up storage handlers with detailed logging
-	relay.StoreEvent = append(relay.StoreEvent, func(ctx context.Context, event *nostr.Event) error {
-		log.Printf("Attempting to store event: %s (kind: %d)", event.ID, event.Kind)
-		startTime := time.Now()
-
-		err := db.SaveEvent(ctx, event)
+	// events are written by the ingest writer on a connection of its own,
+	// these are mostly for reading
+	if cfg.ReadConnections > 0 {
+		db.SetMaxOpenConns(cfg.ReadConnections)
+	}
 
-		duration := time.Since(startTime)
-		if err != nil {
-			log.Printf("Error storing event %s: %v (took %v)", event.ID, err, duration)
-		} else {
-			log.Printf("Successfully stored event %s (took %v)", event.ID, duration)
-		}
+	return db, nil
+}
 
-		return err
-	})
-
-	relay.QueryEvents = append(relay.QueryEvents, db.QueryEvents)
-	relay.CountEvents = append(relay.CountEvents, db.CountEvents)
-	relay.DeleteEvent = append(relay.DeleteEvent, db.DeleteEvent)
-	relay.ReplaceEvent = append(relay.ReplaceEvent, db.ReplaceEvent)
-
-	relay.RejectEvent = append(
-		relay.RejectEvent,
-		kinds.ValidateCreateChannel,
-		func(ctx context.Context, event *nostr.Event) (bool, string) {
-			return kinds.ValidateUpdateChannel(ctx, &db, event)
-		},
-	)
-
-	fmt.Println("Nostr Comic Chat Relay running on :3334")
-	if err := http.ListenAndServe(":3334", relay); err != nil {
-		log.Fatal(err)
-	}
+// databaseDSN opens the database in WAL mode so reads don't wait for writes.
+// Transactions take the write lock when they begin, with a busy timeout, so
+// concurrent writers wait for each other instead of failing.
+func databaseDSN(path string) string {
+	return path + "?_journal_mode=WAL&_synchronous=NORMAL&_busy_timeout=5000&_txlock=immediate"
 }
@@ -0,0 +1,469 @@
+package management
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/eventstore/sqlite3"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip11"
+	"github.com/nbd-wtf/go-nostr/nip86"
+)
+
+var ddls = []string{
+	`CREATE TABLE IF NOT EXISTS banned_pubkey (
+       pubkey text PRIMARY KEY,
+       reason text NOT NULL,
+       created_at integer NOT NULL);`,
+	`CREATE TABLE IF NOT EXISTS allowed_pubkey (
+       pubkey text PRIMARY KEY,
+       reason text NOT NULL,
+       created_at integer NOT NULL);`,
+	`CREATE TABLE IF NOT EXISTS banned_event (
+       id text PRIMARY KEY,
+       reason text NOT NULL,
+       created_at integer NOT NULL);`,
+	`CREATE TABLE IF NOT EXISTS allowed_event (
+       id text PRIMARY KEY,
+       reason text NOT NULL,
+       created_at integer NOT NULL);`,
+	`CREATE TABLE IF NOT EXISTS blocked_ip (
+       ip text PRIMARY KEY,
+       reason text NOT NULL,
+       created_at integer NOT NULL);`,
+	`CREATE TABLE IF NOT EXISTS kind_policy (
+       kind integer PRIMARY KEY,
+       allowed integer NOT NULL);`,
+	`CREATE TABLE IF NOT EXISTS relay_setting (
+       key text PRIMARY KEY,
+       value text NOT NULL);`,
+}
+
+// Manager implements the NIP-86 relay management operations. Everything is
+// persisted in the relay database and mirrored in memory, since the policy
+// checks run for every event, filter and connection.
+type Manager struct {
+	db     *sqlite3.SQLite3Backend
+	info   *nip11.RelayInformationDocument
+	admins []string
+
+	mu              sync.RWMutex
+	bannedPubKeys   map[string]string
+	bannedEvents    map[string]string
+	blockedIPs      map[string]string
+	allowedKinds    map[int]struct{}
+	disallowedKinds map[int]struct{}
+	// relay name, description and icon changed since info was filled,
+	// khatru reads info without the lock
+	settings map[string]string
+
+	// OnBansChanged are called after a pubkey or an event is banned or
+	// allowed again, so what was cached of it can be dropped
+	OnBansChanged []func()
+}
+
+// New creates the management tables if needed, loads the current bans and
+// applies the stored relay name, description and icon to info.
+func New(db *sqlite3.SQLite3Backend, admins []string, info *nip11.RelayInformationDocument) (*Manager, error) {
+	for _, ddl := range ddls {
+		if _, err := db.Exec(ddl); err != nil {
+			return nil, fmt.Errorf("failed to create management tables: %w", err)
+		}
+	}
+
+	m := &Manager{
+		db:              db,
+		info:            info,
+		admins:          admins,
+		bannedPubKeys:   make(map[string]string),
+		bannedEvents:    make(map[string]string),
+		blockedIPs:      make(map[string]string),
+		allowedKinds:    make(map[int]struct{}),
+		disallowedKinds: make(map[int]struct{}),
+		settings:        make(map[string]string),
+	}
+
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func (m *Manager) load() error {
+	if err := loadReasons(m.db, "SELECT pubkey, reason FROM banned_pubkey", m.bannedPubKeys); err != nil {
+		return err
+	}
+	if err := loadReasons(m.db, "SELECT id, reason FROM banned_event", m.bannedEvents); err != nil {
+		return err
+	}
+	if err := loadReasons(m.db, "SELECT ip, reason FROM blocked_ip", m.blockedIPs); err != nil {
+		return err
+	}
+
+	rows, err := m.db.Query("SELECT kind, allowed FROM kind_policy")
+	if err != nil {
+		return fmt.Errorf("failed to load kind policy: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var kind int
+		var allowed bool
+		if err := rows.Scan(&kind, &allowed); err != nil {
+			return err
+		}
+		if allowed {
+			m.allowedKinds[kind] = struct{}{}
+		} else {
+			m.disallowedKinds[kind] = struct{}{}
+		}
+	}
+
+	settings := map[string]string{}
+	if err := loadReasons(m.db, "SELECT key, value FROM relay_setting", settings); err != nil {
+		return err
+	}
+	if name, ok := settings["name"]; ok {
+		m.info.Name = name
+	}
+	if desc, ok := settings["description"]; ok {
+		m.info.Description = desc
+	}
+	if icon, ok := settings["icon"]; ok {
+		m.info.Icon = icon
+	}
+
+	return nil
+}
+
+func loadReasons(db *sqlite3.SQLite3Backend, query string, into map[string]string) error {
+	rows, err := db.Query(query)
+	if err != nil {
+		return fmt.Errorf("failed to load %q: %w", query, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return err
+		}
+		into[key] = value
+	}
+
+	return rows.Err()
+}
+
+// IsAdmin tells if pubkey is one of the configured relay admins
+func (m *Manager) IsAdmin(pubkey string) bool {
+	return slices.Contains(m.admins, pubkey)
+}
+
+func (m *Manager) BanPubKey(ctx context.Context, pubkey string, reason string) error {
+	if !nostr.IsValidPublicKey(pubkey) {
+		return errors.New("invalid pubkey")
+	}
+
+	_, err := m.db.ExecContext(ctx, `
+        INSERT INTO banned_pubkey (pubkey, reason, created_at) VALUES ($1, $2, $3)
+        ON CONFLICT (pubkey) DO UPDATE SET reason = excluded.reason
+    `, pubkey, reason, time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("failed to ban pubkey: %w", err)
+	}
+	if _, err := m.db.ExecContext(ctx, "DELETE FROM allowed_pubkey WHERE pubkey = $1", pubkey); err != nil {
+		return fmt.Errorf("failed to ban pubkey: %w", err)
+	}
+
+	m.mu.Lock()
+	m.bannedPubKeys[pubkey] = reason
+	m.mu.Unlock()
+	m.bansChanged()
+
+	return nil
+}
+
+// AllowPubKey lifts a ban on pubkey and records it as explicitly allowed
+func (m *Manager) AllowPubKey(ctx context.Context, pubkey string, reason string) error {
+	if !nostr.IsValidPublicKey(pubkey) {
+		return errors.New("invalid pubkey")
+	}
+
+	_, err := m.db.ExecContext(ctx, `
+        INSERT INTO allowed_pubkey (pubkey, reason, created_at) VALUES ($1, $2, $3)
+        ON CONFLICT (pubkey) DO UPDATE SET reason = excluded.reason
+    `, pubkey, reason, time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("failed to allow pubkey: %w", err)
+	}
+	if _, err := m.db.ExecContext(ctx, "DELETE FROM banned_pubkey WHERE pubkey = $1", pubkey); err != nil {
+		return fmt.Errorf("failed to allow pubkey: %w", err)
+	}
+
+	m.mu.Lock()
+	delete(m.bannedPubKeys, pubkey)
+	m.mu.Unlock()
+	m.bansChanged()
+
+	return nil
+}
+
+func (m *Manager) bansChanged() {
+	for _, changed := range m.OnBansChanged {
+		changed()
+	}
+}
+
+func (m *Manager) ListBannedPubKeys(ctx context.Context) ([]nip86.PubKeyReason, error) {
+	return listPubKeys(ctx, m.db, "banned_pubkey")
+}
+
+func (m *Manager) ListAllowedPubKeys(ctx context.Context) ([]nip86.PubKeyReason, error) {
+	return listPubKeys(ctx, m.db, "allowed_pubkey")
+}
+
+func listPubKeys(ctx context.Context, db *sqlite3.SQLite3Backend, table string) ([]nip86.PubKeyReason, error) {
+	list := make([]nip86.PubKeyReason, 0)
+	err := db.SelectContext(ctx, &list, "SELECT pubkey, reason FROM "+table+" ORDER BY created_at DESC")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", table, err)
+	}
+
+	return list, nil
+}
+
+// BanEvent hides an event from queries and refuses it if it is published again
+func (m *Manager) BanEvent(ctx context.Context, id string, reason string) error {
+	if !nostr.IsValid32ByteHex(id) {
+		return errors.New("invalid event id")
+	}
+
+	_, err := m.db.ExecContext(ctx, `
+        INSERT INTO banned_event (id, reason, created_at) VALUES ($1, $2, $3)
+        ON CONFLICT (id) DO UPDATE SET reason = excluded.reason
+    `, id, reason, time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("failed to ban event: %w", err)
+	}
+	if _, err := m.db.ExecContext(ctx, "DELETE FROM allowed_event WHERE id = $1", id); err != nil {
+		return fmt.Errorf("failed to ban event: %w", err)
+	}
+
+	m.mu.Lock()
+	m.bannedEvents[id] = reason
+	m.mu.Unlock()
+	m.bansChanged()
+
+	return nil
+}
+
+func (m *Manager) AllowEvent(ctx context.Context, id string, reason string) error {
+	if !nostr.IsValid32ByteHex(id) {
+		return errors.New("invalid event id")
+	}
+
+	_, err := m.db.ExecContext(ctx, `
+        INSERT INTO allowed_event (id, reason, created_at) VALUES ($1, $2, $3)
+        ON CONFLICT (id) DO UPDATE SET reason = excluded.reason
+    `, id, reason, time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("failed to allow event: %w", err)
+	}
+	if _, err := m.db.ExecContext(ctx, "DELETE FROM banned_event WHERE id = $1", id); err != nil {
+		return fmt.Errorf("failed to allow event: %w", err)
+	}
+
+	m.mu.Lock()
+	delete(m.bannedEvents, id)
+	m.mu.Unlock()
+	m.bansChanged()
+
+	return nil
+}
+
+func (m *Manager) ListBannedEvents(ctx context.Context) ([]nip86.IDReason, error) {
+	return listEvents(ctx, m.db, "banned_event")
+}
+
+func (m *Manager) ListAllowedEvents(ctx context.Context) ([]nip86.IDReason, error) {
+	return listEvents(ctx, m.db, "allowed_event")
+}
+
+func listEvents(ctx context.Context, db *sqlite3.SQLite3Backend, table string) ([]nip86.IDReason, error) {
+	list := make([]nip86.IDReason, 0)
+	err := db.SelectContext(ctx, &list, "SELECT id, reason FROM "+table+" ORDER BY created_at DESC")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", table, err)
+	}
+
+	return list, nil
+}
+
+func (m *Manager) BlockIP(ctx context.Context, ip net.IP, reason string) error {
+	if ip == nil {
+		return errors.New("invalid ip")
+	}
+
+	_, err := m.db.ExecContext(ctx, `
+        INSERT INTO blocked_ip (ip, reason, created_at) VALUES ($1, $2, $3)
+        ON CONFLICT (ip) DO UPDATE SET reason = excluded.reason
+    `, ip.String(), reason, time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("failed to block ip: %w", err)
+	}
+
+	m.mu.Lock()
+	m.blockedIPs[ip.String()] = reason
+	m.mu.Unlock()
+
+	return nil
+}
+
+func (m *Manager) UnblockIP(ctx context.Context, ip net.IP, reason string) error {
+	if ip == nil {
+		return errors.New("invalid ip")
+	}
+
+	if _, err := m.db.ExecContext(ctx, "DELETE FROM blocked_ip WHERE ip = $1", ip.String()); err != nil {
+		return fmt.Errorf("failed to unblock ip: %w", err)
+	}
+
+	m.mu.Lock()
+	delete(m.blockedIPs, ip.String())
+	m.mu.Unlock()
+
+	return nil
+}
+
+func (m *Manager) ListBlockedIPs(ctx context.Context) ([]nip86.IPReason, error) {
+	list := make([]nip86.IPReason, 0)
+	err := m.db.SelectContext(ctx, &list, "SELECT ip, reason FROM blocked_ip ORDER BY created_at DESC")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list blocked ips: %w", err)
+	}
+
+	return list, nil
+}
+
+// AllowKind whitelists a kind, once any kind is allowed only those are accepted
+func (m *Manager) AllowKind(ctx context.Context, kind int) error {
+	return m.setKindPolicy(ctx, kind, true)
+}
+
+func (m *Manager) DisallowKind(ctx context.Context, kind int) error {
+	return m.setKindPolicy(ctx, kind, false)
+}
+
+func (m *Manager) setKindPolicy(ctx context.Context, kind int, allowed bool) error {
+	_, err := m.db.ExecContext(ctx, `
+        INSERT INTO kind_policy (kind, allowed) VALUES ($1, $2)
+        ON CONFLICT (kind) DO UPDATE SET allowed = excluded.allowed
+    `, kind, allowed)
+	if err != nil {
+		return fmt.Errorf("failed to change kind %d policy: %w", kind, err)
+	}
+
+	m.mu.Lock()
+	if allowed {
+		m.allowedKinds[kind] = struct{}{}
+		delete(m.disallowedKinds, kind)
+	} else {
+		m.disallowedKinds[kind] = struct{}{}
+		delete(m.allowedKinds, kind)
+	}
+	m.mu.Unlock()
+
+	return nil
+}
+
+func (m *Manager) ListAllowedKinds(ctx context.Context) ([]int, error) {
+	return m.listKinds(ctx, true)
+}
+
+func (m *Manager) ListDisallowedKinds(ctx context.Context) ([]int, error) {
+	return m.listKinds(ctx, false)
+}
+
+func (m *Manager) listKinds(ctx context.Context, allowed bool) ([]int, error) {
+	list := make([]int, 0)
+	err := m.db.SelectContext(ctx, &list, "SELECT kind FROM kind_policy WHERE allowed = $1 ORDER BY kind", allowed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list kinds: %w", err)
+	}
+
+	return list, nil
+}
+
+func (m *Manager) ChangeRelayName(ctx context.Context, name string) error {
+	if err := m.setSetting(ctx, "name", name); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.settings["name"] = name
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *Manager) ChangeRelayDescription(ctx context.Context, desc string) error {
+	if err := m.setSetting(ctx, "description", desc); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.settings["description"] = desc
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *Manager) ChangeRelayIcon(ctx context.Context, icon string) error {
+	if err := m.setSetting(ctx, "icon", icon); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.settings["icon"] = icon
+	m.mu.Unlock()
+	return nil
+}
+
+// Info is info with the relay name, description and icon set by admins
+func (m *Manager) Info(info nip11.RelayInformationDocument) nip11.RelayInformationDocument {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if name, ok := m.settings["name"]; ok {
+		info.Name = name
+	}
+	if desc, ok := m.settings["description"]; ok {
+		info.Description = desc
+	}
+	if icon, ok := m.settings["icon"]; ok {
+		info.Icon = icon
+	}
+	return info
+}
+
+// RelayInformation is meant to be added to relay.OverwriteRelayInformation,
+// so NIP-11 documents have the settings changed while running
+func (m *Manager) RelayInformation(ctx context.Context, r *http.Request, info nip11.RelayInformationDocument) nip11.RelayInformationDocument {
+	return m.Info(info)
+}
+
+func (m *Manager) setSetting(ctx context.Context, key string, value string) error {
+	_, err := m.db.ExecContext(ctx, `
+        INSERT INTO relay_setting (key, value) VALUES ($1, $2)
+        ON CONFLICT (key) DO UPDATE SET value = excluded.value
+    `, key, value)
+	if err != nil {
+		return fmt.Errorf("failed to change relay %s: %w", key, err)
+	}
+
+	return nil
+}
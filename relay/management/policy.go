@@ -0,0 +1,151 @@
+package management
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip86"
+)
+
+// API returns the NIP-86 handlers to be set as relay.ManagementAPI
+func (m *Manager) API() khatru.RelayManagementAPI {
+	return khatru.RelayManagementAPI{
+		RejectAPICall: []func(ctx context.Context, mp nip86.MethodParams) (reject bool, msg string){
+			m.RejectAPICall,
+		},
+
+		BanPubKey:          m.BanPubKey,
+		ListBannedPubKeys:  m.ListBannedPubKeys,
+		AllowPubKey:        m.AllowPubKey,
+		ListAllowedPubKeys: m.ListAllowedPubKeys,
+		BanEvent:           m.BanEvent,
+		AllowEvent:         m.AllowEvent,
+		ListBannedEvents:   m.ListBannedEvents,
+		ListAllowedEvents:  m.ListAllowedEvents,
+		// khatru routes "listbannedevents" to this handler, we have no
+		// moderation queue so it just answers with the banned events
+		ListEventsNeedingModeration: m.ListBannedEvents,
+		ChangeRelayName:             m.ChangeRelayName,
+		ChangeRelayDescription:      m.ChangeRelayDescription,
+		ChangeRelayIcon:             m.ChangeRelayIcon,
+		AllowKind:                   m.AllowKind,
+		DisallowKind:                m.DisallowKind,
+		ListAllowedKinds:            m.ListAllowedKinds,
+		ListDisAllowedKinds:         m.ListDisallowedKinds,
+		BlockIP:                     m.BlockIP,
+		UnblockIP:                   m.UnblockIP,
+		ListBlockedIPs:              m.ListBlockedIPs,
+	}
+}
+
+// RejectAPICall only lets configured admins through. The NIP-98 authorization
+// itself (signature, url, payload hash, age) is checked by khatru.
+func (m *Manager) RejectAPICall(ctx context.Context, mp nip86.MethodParams) (reject bool, msg string) {
+	pubkey := khatru.GetAuthed(ctx)
+	if !m.IsAdmin(pubkey) {
+		return true, "unauthorized: " + pubkey + " is not an admin of this relay"
+	}
+
+	// khatru v0.18.1 panics when listing the supported methods
+	if _, ok := mp.(nip86.SupportedMethods); ok {
+		return true, "supportedmethods is not available, see NIP-86 for the method list"
+	}
+
+	return false, ""
+}
+
+// RejectEvent refuses events from banned pubkeys, banned events and kinds
+// not allowed by the kind policy.
+func (m *Manager) RejectEvent(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if reason, ok := m.bannedPubKeys[event.PubKey]; ok {
+		return true, withReason("blocked: pubkey is banned", reason)
+	}
+
+	if reason, ok := m.bannedEvents[event.ID]; ok {
+		return true, withReason("blocked: event is banned", reason)
+	}
+
+	if _, ok := m.disallowedKinds[event.Kind]; ok {
+		return true, "blocked: kind " + strconv.Itoa(event.Kind) + " is not allowed"
+	}
+
+	if _, ok := m.allowedKinds[event.Kind]; !ok && len(m.allowedKinds) > 0 {
+		return true, "blocked: kind " + strconv.Itoa(event.Kind) + " is not allowed"
+	}
+
+	return false, ""
+}
+
+// RejectConnection refuses websockets coming from blocked IPs
+func (m *Manager) RejectConnection(r *http.Request) bool {
+	ip := khatru.GetIPFromRequest(r)
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	_, blocked := m.blockedIPs[ip]
+	return blocked
+}
+
+// HideBanned wraps a query function so banned events and events from banned
+// pubkeys are never returned to clients, from the cache and the search index
+// too. Internal calls (deletions, expiration) still see everything.
+func (m *Manager) HideBanned(
+	query func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error),
+) func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	return func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		ch, err := query(ctx, filter)
+		if err != nil || ch == nil || khatru.IsInternalCall(ctx) {
+			return ch, err
+		}
+
+		out := make(chan *nostr.Event)
+		go func() {
+			defer close(out)
+			for event := range ch {
+				if m.isHidden(event) {
+					continue
+				}
+
+				select {
+				case out <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+
+		return out, nil
+	}
+}
+
+// VisibleSQL is the condition of HideBanned for the visible store, so bans
+// are left out by the query instead of after its limit
+func (m *Manager) VisibleSQL() (string, []any) {
+	return "e.id NOT IN (SELECT id FROM banned_event) AND e.pubkey NOT IN (SELECT pubkey FROM banned_pubkey)", nil
+}
+
+func (m *Manager) isHidden(event *nostr.Event) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if _, ok := m.bannedPubKeys[event.PubKey]; ok {
+		return true
+	}
+	_, ok := m.bannedEvents[event.ID]
+	return ok
+}
+
+func withReason(msg string, reason string) string {
+	if reason == "" {
+		return msg
+	}
+
+	return msg + " (" + reason + ")"
+}
@@ -0,0 +1,194 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"nostr-relay/channels"
+	"nostr-relay/kinds"
+
+	"github.com/fiatjaf/eventstore/sqlite3"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// outbox_queue has what's left to republish, an event per relay, and
+// outbox_relay how every relay we republish to is doing
+var ddls = []string{
+	`CREATE TABLE IF NOT EXISTS outbox_queue (
+       event_id text NOT NULL,
+       relay text NOT NULL,
+       attempts integer NOT NULL DEFAULT 0,
+       next_attempt_at integer NOT NULL,
+       last_error text NOT NULL DEFAULT '',
+       queued_at integer NOT NULL,
+       PRIMARY KEY (event_id, relay));`,
+	`CREATE INDEX IF NOT EXISTS outbox_queue_due ON outbox_queue (next_attempt_at);`,
+	`CREATE TABLE IF NOT EXISTS outbox_relay (
+       url text PRIMARY KEY,
+       published integer NOT NULL DEFAULT 0,
+       rejected integer NOT NULL DEFAULT 0,
+       failed integer NOT NULL DEFAULT 0,
+       consecutive_failures integer NOT NULL DEFAULT 0,
+       last_success_at integer NOT NULL DEFAULT 0,
+       last_failure_at integer NOT NULL DEFAULT 0,
+       last_error text NOT NULL DEFAULT '');`,
+}
+
+// Options tune the outbox, zero values use the defaults
+type Options struct {
+	// Self has the URLs of this relay, which are never republished to
+	Self []string
+
+	// MaxAttempts is how many times an event is sent to a relay that can't
+	// be reached before giving up
+	MaxAttempts int
+
+	// MinBackoff is the wait after the first failure, doubled after every
+	// other one up to MaxBackoff
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// Timeout bounds connecting and publishing to a relay
+	Timeout time.Duration
+
+	// RoundTimeout bounds the time spent on a relay per round, what it
+	// didn't get is sent in the next one
+	RoundTimeout time.Duration
+
+	// MaxFailures is how many consecutive failures get a relay skipped,
+	// until MaxBackoff after the last one
+	MaxFailures int
+
+	// BatchSize is how many queued events are sent per round
+	BatchSize int
+}
+
+func (o Options) withDefaults() Options {
+	if o.MaxAttempts <= 0 {
+		o.MaxAttempts = 10
+	}
+	if o.MinBackoff <= 0 {
+		o.MinBackoff = 30 * time.Second
+	}
+	if o.MaxBackoff <= 0 {
+		o.MaxBackoff = time.Hour
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = 10 * time.Second
+	}
+	if o.RoundTimeout <= 0 {
+		o.RoundTimeout = 30 * time.Second
+	}
+	if o.MaxFailures <= 0 {
+		o.MaxFailures = 5
+	}
+	if o.BatchSize <= 0 {
+		o.BatchSize = 100
+	}
+	return o
+}
+
+// Outbox republishes channel events and messages to the relays declared in
+// the current metadata of their channel
+type Outbox struct {
+	db       *sqlite3.SQLite3Backend
+	channels *channels.Store
+	options  Options
+
+	// wake tells the worker there is something new to send
+	wake chan struct{}
+}
+
+func New(db *sqlite3.SQLite3Backend, channelStore *channels.Store, options Options) (*Outbox, error) {
+	for _, ddl := range ddls {
+		if _, err := db.Exec(ddl); err != nil {
+			return nil, fmt.Errorf("failed to create outbox tables: %w", err)
+		}
+	}
+
+	options = options.withDefaults()
+	self := make([]string, 0, len(options.Self))
+	for _, url := range options.Self {
+		if url = channels.RelayURL(url); url != "" {
+			self = append(self, url)
+		}
+	}
+	options.Self = self
+
+	return &Outbox{
+		db:       db,
+		channels: channelStore,
+		options:  options,
+		wake:     make(chan struct{}, 1),
+	}, nil
+}
+
+// EventSaved is meant to be added to relay.OnEventSaved after the channel
+// store, so the relays of a channel are the ones its event just declared
+func (o *Outbox) EventSaved(ctx context.Context, event *nostr.Event) {
+	if err := o.Enqueue(ctx, event); err != nil {
+		log.Printf("Failed to queue %s for republishing: %v", event.ID, err)
+	}
+}
+
+// Enqueue queues event for every relay of its channel
+func (o *Outbox) Enqueue(ctx context.Context, event *nostr.Event) error {
+	var channelID string
+	switch {
+	case event.Kind == 40:
+		channelID = event.ID
+	case event.Kind == 41 || kinds.IsChannelMessage(event):
+		channelID = kinds.ChannelID(event)
+	default:
+		return nil
+	}
+
+	channel, err := o.channels.Get(ctx, channelID)
+	if errors.Is(err, channels.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	relays := o.targets(channel.Relays)
+	if len(relays) == 0 {
+		return nil
+	}
+
+	now := nostr.Now()
+	for _, relay := range relays {
+		_, err := o.db.ExecContext(ctx, `
+            INSERT INTO outbox_queue (event_id, relay, next_attempt_at, queued_at) VALUES (?, ?, ?, ?)
+            ON CONFLICT (event_id, relay) DO NOTHING
+        `, event.ID, relay, now, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// targets normalizes the relays declared by a channel, leaving out this
+// relay and anything that isn't a websocket URL
+func (o *Outbox) targets(declared []string) []string {
+	relays := make([]string, 0, len(declared))
+	for _, url := range declared {
+		url = channels.RelayURL(url)
+		if url == "" || slices.Contains(o.options.Self, url) || slices.Contains(relays, url) {
+			continue
+		}
+		relays = append(relays, url)
+	}
+	return relays
+}
@@ -0,0 +1,253 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"nostr-relay/channels"
+	"nostr-relay/internal/testutil"
+
+	"github.com/fiatjaf/eventstore/slicestore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// fakeRelay starts a relay keeping events in memory, refusing all of them
+// when reason isn't empty
+func fakeRelay(t *testing.T, reason string) (string, *slicestore.SliceStore) {
+	store := &slicestore.SliceStore{}
+	store.Init()
+
+	if reason == "" {
+		return testutil.Relay(t, store), store
+	}
+	return testutil.Relay(t, store, func(ctx context.Context, event *nostr.Event) (bool, string) {
+		return true, reason
+	}), store
+}
+
+func stored(t *testing.T, store *slicestore.SliceStore, id string) bool {
+	count, err := store.CountEvents(context.Background(), nostr.Filter{IDs: []string{id}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count > 0
+}
+
+func relayStatus(t *testing.T, o *Outbox, url string) RelayStatus {
+	status, err := o.Status(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, relay := range status.Relays {
+		if relay.URL == nostr.NormalizeURL(url) {
+			return relay
+		}
+	}
+	t.Fatalf("no status for %s", url)
+	return RelayStatus{}
+}
+
+func TestOutbox(t *testing.T) {
+	ctx := context.Background()
+
+	db := testutil.DB(t, "outbox")
+
+	channelStore, err := channels.New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	self := "wss://relay.example.com"
+	o, err := New(db, channelStore, Options{Self: []string{"https://relay.example.com"}, MaxAttempts: 3, MinBackoff: time.Millisecond, Timeout: 2 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	good, goodStore := fakeRelay(t, "")
+	picky, pickyStore := fakeRelay(t, "blocked: not here")
+	gone := testutil.Unreachable()
+
+	privateKey := nostr.GeneratePrivateKey()
+	save := func(event nostr.Event) nostr.Event {
+		event.CreatedAt = nostr.Now()
+		if err := event.Sign(privateKey); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.SaveEvent(ctx, &event); err != nil {
+			t.Fatal(err)
+		}
+		channelStore.EventSaved(ctx, &event)
+		o.EventSaved(ctx, &event)
+		return event
+	}
+
+	content, _ := json.Marshal(map[string]any{"name": "Outbox", "relays": []string{good, picky, gone, self, "not a relay"}})
+	channel := save(nostr.Event{Kind: 40, Content: string(content)})
+	message := save(nostr.Event{Kind: 42, Content: "hello", Tags: nostr.Tags{{"e", channel.ID, "", "root"}}})
+
+	count, err := o.Flush(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 6 {
+		t.Fatalf("tried %d times, want 2 events for 3 relays", count)
+	}
+
+	if !stored(t, goodStore, channel.ID) || !stored(t, goodStore, message.ID) {
+		t.Error("the channel and its message should be republished")
+	}
+	if stored(t, pickyStore, message.ID) {
+		t.Error("refused events aren't stored")
+	}
+
+	if status := relayStatus(t, o, good); !status.Healthy || status.Published != 2 || status.Queued != 0 {
+		t.Errorf("good relay status: %+v", status)
+	}
+	if status := relayStatus(t, o, picky); !status.Healthy || status.Rejected != 2 || status.Queued != 0 {
+		t.Errorf("refusing relays are healthy and aren't retried: %+v", status)
+	}
+	if status := relayStatus(t, o, gone); status.Healthy || status.Failed != 2 || status.Queued != 2 {
+		t.Errorf("unreachable relays are retried: %+v", status)
+	}
+
+	t.Run("retries until giving up", func(t *testing.T) {
+		for range 2 {
+			if _, err := o.Flush(ctx); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		status := relayStatus(t, o, gone)
+		if status.Queued != 0 || status.Failed != 6 || status.ConsecutiveFailures != 6 {
+			t.Errorf("after 3 attempts: %+v", status)
+		}
+	})
+
+	t.Run("deleted events are dropped", func(t *testing.T) {
+		deleted := save(nostr.Event{Kind: 42, Content: "oops", Tags: nostr.Tags{{"e", channel.ID, "", "root"}}})
+		if err := db.DeleteEvent(ctx, &deleted); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := o.Flush(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if stored(t, goodStore, deleted.ID) {
+			t.Error("deleted events aren't republished")
+		}
+
+		status, _ := o.Status(ctx)
+		if status.Queued != 0 {
+			t.Errorf("%d events still queued", status.Queued)
+		}
+	})
+
+	t.Run("backoff", func(t *testing.T) {
+		o := &Outbox{options: Options{MinBackoff: time.Second, MaxBackoff: 10 * time.Second}}
+		for attempts, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 4: 8 * time.Second, 10: 10 * time.Second} {
+			if got := o.backoff(attempts); got != want {
+				t.Errorf("backoff after %d attempts is %v, want %v", attempts, got, want)
+			}
+		}
+	})
+}
+
+// setup opens an outbox for a channel republished to relays, returning it
+// with a function posting messages in the channel
+func setup(t *testing.T, relays []string, options Options) (*Outbox, func(content string) nostr.Event) {
+	ctx := context.Background()
+
+	db := testutil.DB(t, "outbox")
+
+	channelStore, err := channels.New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, err := New(db, channelStore, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	privateKey := nostr.GeneratePrivateKey()
+	save := func(event nostr.Event) nostr.Event {
+		event.CreatedAt = nostr.Now()
+		if err := event.Sign(privateKey); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.SaveEvent(ctx, &event); err != nil {
+			t.Fatal(err)
+		}
+		channelStore.EventSaved(ctx, &event)
+		o.EventSaved(ctx, &event)
+		return event
+	}
+
+	content, _ := json.Marshal(map[string]any{"name": "Outbox", "relays": relays})
+	channel := save(nostr.Event{Kind: 40, Content: string(content)})
+
+	return o, func(content string) nostr.Event {
+		return save(nostr.Event{Kind: 42, Content: content, Tags: nostr.Tags{{"e", channel.ID, "", "root"}}})
+	}
+}
+
+func TestSkipFailing(t *testing.T) {
+	ctx := context.Background()
+	gone := testutil.Unreachable()
+	o, post := setup(t, []string{gone}, Options{MaxFailures: 2, MinBackoff: time.Millisecond, Timeout: time.Second})
+	post("hello")
+
+	if count, err := o.Flush(ctx); err != nil || count != 2 {
+		t.Fatalf("tried %d times: %v", count, err)
+	}
+
+	// new events wait too
+	post("anyone?")
+	if count, err := o.Flush(ctx); err != nil || count != 0 {
+		t.Fatalf("a failing relay is skipped, tried %d times: %v", count, err)
+	}
+	if status := relayStatus(t, o, gone); status.Queued != 3 || status.ConsecutiveFailures != 2 {
+		t.Errorf("status: %+v", status)
+	}
+
+	// until MaxBackoff after its last failure
+	if _, err := o.db.ExecContext(ctx, "UPDATE outbox_relay SET last_failure_at = last_failure_at - 3600"); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := o.Flush(ctx); err != nil || count != 3 {
+		t.Fatalf("tried %d times: %v", count, err)
+	}
+}
+
+func TestRoundTimeout(t *testing.T) {
+	ctx := context.Background()
+
+	// a relay taking its time to answer
+	store := &slicestore.SliceStore{}
+	store.Init()
+	slow := testutil.Relay(t, store, func(ctx context.Context, event *nostr.Event) (bool, string) {
+		time.Sleep(300 * time.Millisecond)
+		return false, ""
+	})
+
+	o, post := setup(t, []string{slow}, Options{Timeout: time.Second, RoundTimeout: time.Second})
+	for i := range 10 {
+		post(fmt.Sprint("message ", i))
+	}
+
+	start := time.Now()
+	if _, err := o.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("a round took %v", elapsed)
+	}
+
+	// what's left is still due, and wasn't counted as a failure
+	status := relayStatus(t, o, slow)
+	if status.Published == 0 || status.Queued == 0 || status.Failed != 0 || int(status.Published)+status.Queued != 11 {
+		t.Errorf("status: %+v", status)
+	}
+}
@@ -0,0 +1,90 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// RelayStatus is how republishing to a relay is going
+type RelayStatus struct {
+	URL                 string          `json:"url"`
+	Healthy             bool            `json:"healthy"`
+	Queued              int             `json:"queued"`
+	Published           int64           `json:"published"`
+	Rejected            int64           `json:"rejected"`
+	Failed              int64           `json:"failed"`
+	ConsecutiveFailures int             `json:"consecutive_failures"`
+	LastSuccessAt       nostr.Timestamp `json:"last_success_at,omitempty"`
+	LastFailureAt       nostr.Timestamp `json:"last_failure_at,omitempty"`
+	LastError           string          `json:"last_error,omitempty"`
+}
+
+// Status is what the outbox has left to do and how every relay is doing
+type Status struct {
+	Queued int           `json:"queued"`
+	Due    int           `json:"due"`
+	Relays []RelayStatus `json:"relays"`
+}
+
+// Status returns the queue size and the health of every relay, a relay is
+// healthy until its last attempt couldn't reach it
+func (o *Outbox) Status(ctx context.Context) (Status, error) {
+	status := Status{Relays: make([]RelayStatus, 0)}
+
+	err := o.db.QueryRowContext(ctx, `
+        SELECT COUNT(*), COUNT(*) FILTER (WHERE next_attempt_at <= ?) FROM outbox_queue
+    `, nostr.Now()).Scan(&status.Queued, &status.Due)
+	if err != nil {
+		return status, err
+	}
+
+	// relays only show up after their first attempt, those waiting for it
+	// are healthy until proven otherwise
+	rows, err := o.db.QueryContext(ctx, `
+        WITH queued AS (SELECT relay, COUNT(*) AS queued FROM outbox_queue GROUP BY relay)
+        SELECT r.url, COALESCE(q.queued, 0), r.published, r.rejected, r.failed, r.consecutive_failures,
+          r.last_success_at, r.last_failure_at, r.last_error
+        FROM outbox_relay r LEFT JOIN queued q ON q.relay = r.url
+        UNION ALL
+        SELECT q.relay, q.queued, 0, 0, 0, 0, 0, 0, '' FROM queued q
+        WHERE q.relay NOT IN (SELECT url FROM outbox_relay)
+        ORDER BY 1
+    `)
+	if err != nil {
+		return status, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var relay RelayStatus
+		var lastSuccessAt, lastFailureAt int64
+		if err := rows.Scan(&relay.URL, &relay.Queued, &relay.Published, &relay.Rejected, &relay.Failed,
+			&relay.ConsecutiveFailures, &lastSuccessAt, &lastFailureAt, &relay.LastError); err != nil {
+			return status, err
+		}
+		relay.LastSuccessAt = nostr.Timestamp(lastSuccessAt)
+		relay.LastFailureAt = nostr.Timestamp(lastFailureAt)
+		relay.Healthy = relay.ConsecutiveFailures == 0
+		status.Relays = append(status.Relays, relay)
+	}
+
+	return status, rows.Err()
+}
+
+// HandleStatus serves the Status as JSON, it's meant to be behind the admin
+// authentication of the dashboard
+func (o *Outbox) HandleStatus(w http.ResponseWriter, r *http.Request) {
+	status, err := o.Status(r.Context())
+	if err != nil {
+		log.Printf("Failed to load the outbox status: %v", err)
+		http.Error(w, "could not load the outbox status", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
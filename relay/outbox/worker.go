@@ -0,0 +1,261 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// entry is an event queued for a relay
+type entry struct {
+	relay    string
+	attempts int
+	event    *nostr.Event
+}
+
+// outcome is what a relay did with an entry
+type outcome int
+
+const (
+	published outcome = iota
+	rejected
+	failed
+)
+
+// Run republishes what's queued every interval, and as soon as something is
+// queued, until ctx is done
+func (o *Outbox) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		for {
+			count, err := o.Flush(ctx)
+			if err != nil && ctx.Err() == nil {
+				log.Printf("Outbox round failed: %v", err)
+			}
+			// more is due right away when the batch was full
+			if err != nil || count < o.options.BatchSize {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-o.wake:
+		}
+	}
+}
+
+// Flush sends a batch of the queued events that are due, returning how many
+// were tried
+func (o *Outbox) Flush(ctx context.Context) (int, error) {
+	entries, err := o.due(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	byRelay := make(map[string][]entry)
+	for _, e := range entries {
+		byRelay[e.relay] = append(byRelay[e.relay], e)
+	}
+
+	var wg sync.WaitGroup
+	for relay, entries := range byRelay {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			o.send(ctx, relay, entries)
+		}()
+	}
+	wg.Wait()
+
+	return len(entries), nil
+}
+
+// due loads the entries whose next attempt has come, dropping those whose
+// event was deleted since. Relays that failed MaxFailures times in a row are
+// left out until MaxBackoff after their last failure, then tried again.
+func (o *Outbox) due(ctx context.Context) ([]entry, error) {
+	now := nostr.Now()
+	rows, err := o.db.QueryContext(ctx, `
+        SELECT q.event_id, q.relay, q.attempts, e.pubkey, e.created_at, e.kind, COALESCE(e.tags, '[]'), e.content, e.sig
+        FROM outbox_queue q LEFT JOIN event e ON e.id = q.event_id
+        WHERE q.next_attempt_at <= ? AND q.relay NOT IN (
+          SELECT url FROM outbox_relay WHERE consecutive_failures >= ? AND last_failure_at > ?)
+        ORDER BY q.next_attempt_at LIMIT ?
+    `, now, o.options.MaxFailures, now-nostr.Timestamp(o.options.MaxBackoff.Seconds()), o.options.BatchSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the outbox queue: %w", err)
+	}
+	defer rows.Close()
+
+	entries := make([]entry, 0)
+	gone := make([]string, 0)
+	for rows.Next() {
+		var e entry
+		var id string
+		var pubkey, content, sig sql.NullString
+		var createdAt, kind sql.NullInt64
+		var tags nostr.Tags
+		if err := rows.Scan(&id, &e.relay, &e.attempts, &pubkey, &createdAt, &kind, &tags, &content, &sig); err != nil {
+			return nil, err
+		}
+
+		if !pubkey.Valid {
+			gone = append(gone, id)
+			continue
+		}
+
+		e.event = &nostr.Event{
+			ID:        id,
+			PubKey:    pubkey.String,
+			CreatedAt: nostr.Timestamp(createdAt.Int64),
+			Kind:      int(kind.Int64),
+			Tags:      tags,
+			Content:   content.String,
+			Sig:       sig.String,
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for _, id := range gone {
+		if _, err := o.db.ExecContext(ctx, "DELETE FROM outbox_queue WHERE event_id = ?", id); err != nil {
+			return nil, err
+		}
+	}
+
+	return entries, nil
+}
+
+// send publishes the entries of one relay on a single connection, for
+// RoundTimeout at most. Entries cut off by it are left as they are.
+func (o *Outbox) send(ctx context.Context, url string, entries []entry) {
+	roundCtx, cancelRound := context.WithTimeout(ctx, o.options.RoundTimeout)
+	defer cancelRound()
+
+	connectCtx, cancel := context.WithTimeout(roundCtx, o.options.Timeout)
+	relay, err := nostr.RelayConnect(connectCtx, url)
+	cancel()
+	if err != nil {
+		if roundCtx.Err() != nil {
+			return
+		}
+		for _, e := range entries {
+			o.record(ctx, e, failed, err)
+		}
+		return
+	}
+	defer relay.Close()
+
+	for _, e := range entries {
+		publishCtx, cancel := context.WithTimeout(roundCtx, o.options.Timeout)
+		err := relay.Publish(publishCtx, *e.event)
+		cancel()
+		if roundCtx.Err() != nil {
+			return
+		}
+
+		o.record(ctx, e, classify(err), err)
+	}
+}
+
+// classify tells apart relays that answered from relays that couldn't be
+// reached. go-nostr reports a refusal as "msg: <reason>"; a duplicate is as
+// good as published.
+func classify(err error) outcome {
+	switch {
+	case err == nil:
+		return published
+	case strings.HasPrefix(err.Error(), "msg: duplicate:"):
+		return published
+	case strings.HasPrefix(err.Error(), "msg: "):
+		return rejected
+	default:
+		return failed
+	}
+}
+
+// record updates the queue and the health of the relay after an attempt.
+// Published and rejected entries leave the queue, failed ones are tried
+// again later, until they ran out of attempts.
+func (o *Outbox) record(ctx context.Context, e entry, result outcome, err error) {
+	now := nostr.Now()
+
+	tx, txErr := o.db.BeginTxx(ctx, nil)
+	if txErr != nil {
+		log.Printf("Failed to record the outbox attempt of %s to %s: %v", e.event.ID, e.relay, txErr)
+		return
+	}
+	defer tx.Rollback()
+
+	_, txErr = tx.ExecContext(ctx, "INSERT INTO outbox_relay (url) VALUES (?) ON CONFLICT (url) DO NOTHING", e.relay)
+	if txErr != nil {
+		log.Printf("Failed to record the outbox attempt of %s to %s: %v", e.event.ID, e.relay, txErr)
+		return
+	}
+
+	attempts := e.attempts + 1
+	switch {
+	case result == published:
+		_, txErr = tx.ExecContext(ctx, `
+            UPDATE outbox_relay SET published = published + 1, consecutive_failures = 0, last_success_at = ? WHERE url = ?
+        `, now, e.relay)
+	case result == rejected:
+		// the relay is fine, it just doesn't want the event
+		log.Printf("Relay %s refused %s: %v", e.relay, e.event.ID, err)
+		_, txErr = tx.ExecContext(ctx, `
+            UPDATE outbox_relay SET rejected = rejected + 1, consecutive_failures = 0, last_success_at = ?, last_error = ? WHERE url = ?
+        `, now, err.Error(), e.relay)
+	default:
+		_, txErr = tx.ExecContext(ctx, `
+            UPDATE outbox_relay SET failed = failed + 1, consecutive_failures = consecutive_failures + 1, last_failure_at = ?, last_error = ?
+            WHERE url = ?
+        `, now, err.Error(), e.relay)
+	}
+	if txErr != nil {
+		log.Printf("Failed to record the health of %s: %v", e.relay, txErr)
+		return
+	}
+
+	if result == failed && attempts < o.options.MaxAttempts {
+		next := now + nostr.Timestamp(o.backoff(attempts).Seconds())
+		_, txErr = tx.ExecContext(ctx, `
+            UPDATE outbox_queue SET attempts = ?, next_attempt_at = ?, last_error = ? WHERE event_id = ? AND relay = ?
+        `, attempts, next, err.Error(), e.event.ID, e.relay)
+	} else {
+		if result == failed {
+			log.Printf("Giving up republishing %s to %s after %d attempts: %v", e.event.ID, e.relay, attempts, err)
+		}
+		_, txErr = tx.ExecContext(ctx, "DELETE FROM outbox_queue WHERE event_id = ? AND relay = ?", e.event.ID, e.relay)
+	}
+	if txErr != nil {
+		log.Printf("Failed to update the outbox queue: %v", txErr)
+		return
+	}
+
+	if txErr := tx.Commit(); txErr != nil {
+		log.Printf("Failed to record the outbox attempt of %s to %s: %v", e.event.ID, e.relay, txErr)
+	}
+}
+
+// backoff is the wait after a number of failed attempts
+func (o *Outbox) backoff(attempts int) time.Duration {
+	wait := o.options.MinBackoff
+	for i := 1; i < attempts && wait < o.options.MaxBackoff; i++ {
+		wait *= 2
+	}
+	return min(wait, o.options.MaxBackoff)
+}
@@ -0,0 +1,596 @@
+package pdf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha256"
+	"fmt"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+
+	"nostr-relay/typeset"
+	"nostr-relay/vector"
+
+	"golang.org/x/image/font/gofont/goregular"
+	_ "golang.org/x/image/webp"
+)
+
+// pointsPerPixel converts CSS pixels to PDF points
+const pointsPerPixel = 0.75
+
+// Info describes the document
+type Info struct {
+	Title   string
+	Subject string
+	Created time.Time
+}
+
+// Write writes drawings as the pages of a PDF, each page the size of its
+// drawing. Text is drawn as outlines with the fonts of the drawings, under
+// an invisible layer of text so it can be searched and copied. Images
+// used on several pages are stored once.
+func Write(w io.Writer, pages []*vector.Drawing, info Info) error {
+	doc := &document{images: make(map[string]int), glyphs: make(map[uint16]rune)}
+	catalog := doc.reserve()
+	pageTree := doc.reserve()
+	doc.font = doc.reserve()
+
+	kids := make([]string, 0, len(pages))
+	for _, d := range pages {
+		page, err := doc.page(d, pageTree)
+		if err != nil {
+			return err
+		}
+		kids = append(kids, ref(page))
+	}
+
+	doc.set(pageTree, fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(kids)))
+	doc.set(catalog, fmt.Sprintf("<< /Type /Catalog /Pages %s >>", ref(pageTree)))
+	if err := doc.writeFont(); err != nil {
+		return err
+	}
+
+	fields := []string{"/Producer " + text("Nostr Comic Chat Relay")}
+	if info.Title != "" {
+		fields = append(fields, "/Title "+text(info.Title))
+	}
+	if info.Subject != "" {
+		fields = append(fields, "/Subject "+text(info.Subject))
+	}
+	if !info.Created.IsZero() {
+		fields = append(fields, "/CreationDate ("+info.Created.UTC().Format("D:20060102150405Z")+")")
+	}
+	infoObject := doc.add("<< " + strings.Join(fields, " ") + " >>")
+
+	return doc.write(w, catalog, infoObject)
+}
+
+// document holds the objects of the file, by number less one
+type document struct {
+	objects [][]byte
+
+	// images are the image objects by hash of their file, font the object
+	// of the invisible text font and glyphs the characters it's used for
+	images map[string]int
+	font   int
+	glyphs map[uint16]rune
+}
+
+func (doc *document) reserve() int {
+	doc.objects = append(doc.objects, nil)
+	return len(doc.objects)
+}
+
+func (doc *document) set(n int, object string) {
+	doc.objects[n-1] = []byte(object)
+}
+
+func (doc *document) add(object string) int {
+	n := doc.reserve()
+	doc.set(n, object)
+	return n
+}
+
+// stream adds a stream object, compressed unless filter is given
+func (doc *document) stream(dict string, data []byte, filter string) int {
+	if filter == "" {
+		var b bytes.Buffer
+		z := zlib.NewWriter(&b)
+		z.Write(data)
+		z.Close()
+		data, filter = b.Bytes(), "/FlateDecode"
+	}
+	n := doc.reserve()
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<< %s /Filter %s /Length %d >>\nstream\n", dict, filter, len(data))
+	b.Write(data)
+	b.WriteString("\nendstream")
+	doc.objects[n-1] = b.Bytes()
+	return n
+}
+
+func (doc *document) write(w io.Writer, catalog int, info int) error {
+	var b bytes.Buffer
+	b.WriteString("%PDF-1.7\n%\xe2\xe3\xcf\xd3\n")
+	offsets := make([]int, len(doc.objects))
+	for i, object := range doc.objects {
+		offsets[i] = b.Len()
+		fmt.Fprintf(&b, "%d 0 obj\n", i+1)
+		b.Write(object)
+		b.WriteString("\nendobj\n")
+	}
+
+	xref := b.Len()
+	fmt.Fprintf(&b, "xref\n0 %d\n0000000000 65535 f \n", len(doc.objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&b, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&b, "trailer\n<< /Size %d /Root %s /Info %s >>\nstartxref\n%d\n%%%%EOF\n", len(doc.objects)+1, ref(catalog), ref(info), xref)
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// page is the content of a page being written and the resources it uses
+type page struct {
+	doc     *document
+	content bytes.Buffer
+
+	states   map[string]string
+	patterns map[string]string
+	images   map[string]string
+	text     bool
+}
+
+func (doc *document) page(d *vector.Drawing, parent int) (int, error) {
+	p := &page{doc: doc, states: make(map[string]string), patterns: make(map[string]string), images: make(map[string]string)}
+
+	// drawings go down from their top left corner, in pixels
+	base := vector.Matrix{pointsPerPixel, 0, 0, -pointsPerPixel, 0, d.Height * pointsPerPixel}
+	fmt.Fprintf(&p.content, "%s cm\n", matrix(base))
+	if err := p.drawing(d, base); err != nil {
+		return 0, err
+	}
+
+	content := doc.stream("", p.content.Bytes(), "")
+	resources := make([]string, 0)
+	for _, r := range []struct {
+		name  string
+		items map[string]string
+	}{{"ExtGState", p.states}, {"Pattern", p.patterns}, {"XObject", p.images}} {
+		if len(r.items) > 0 {
+			resources = append(resources, fmt.Sprintf("/%s << %s >>", r.name, dict(r.items)))
+		}
+	}
+	if p.text {
+		resources = append(resources, fmt.Sprintf("/Font << /F1 %s >>", ref(doc.font)))
+	}
+
+	return doc.add(fmt.Sprintf("<< /Type /Page /Parent %s /MediaBox [0 0 %s %s] /Contents %s /Resources << %s >> >>",
+		ref(parent), num(d.Width*pointsPerPixel), num(d.Height*pointsPerPixel), ref(content), strings.Join(resources, " "))), nil
+}
+
+// drawing writes the items of a drawing, base being the transform from its
+// coordinates to the page, which patterns are placed with
+func (p *page) drawing(d *vector.Drawing, base vector.Matrix) error {
+	for _, item := range d.Items {
+		switch item := item.(type) {
+		case *vector.Shape:
+			p.shape(item, base)
+
+		case *vector.Text:
+			for _, run := range d.Glyphs(item) {
+				for _, shape := range run.Shapes {
+					p.shape(shape, base)
+				}
+				p.invisibleText(item, run)
+			}
+
+		case *vector.Image:
+			if err := p.image(item, base); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// clip writes the clip paths of an item, outermost first
+func (p *page) clip(clip *vector.Clip) {
+	chain := make([]*vector.Clip, 0)
+	for c := clip; c != nil; c = c.Parent {
+		chain = append(chain, c)
+	}
+	slices.Reverse(chain)
+
+	for _, c := range chain {
+		if len(c.Shapes) == 0 {
+			p.content.WriteString("0 0 0 0 re W n\n")
+			continue
+		}
+		evenOdd := true
+		for _, s := range c.Shapes {
+			p.path(s.Path.Transform(s.Matrix))
+			evenOdd = evenOdd && s.EvenOdd
+		}
+		if evenOdd {
+			p.content.WriteString("W* n\n")
+		} else {
+			p.content.WriteString("W n\n")
+		}
+	}
+}
+
+// transform moves what's drawn next by m, unless it's the identity
+func (p *page) transform(m vector.Matrix) {
+	if m != vector.Identity {
+		fmt.Fprintf(&p.content, "%s cm\n", matrix(m))
+	}
+}
+
+func (p *page) path(path vector.Path) {
+	for _, s := range path {
+		switch s.Op {
+		case 'M':
+			fmt.Fprintf(&p.content, "%s %s m\n", num(s.Points[0].X), num(s.Points[0].Y))
+		case 'L':
+			fmt.Fprintf(&p.content, "%s %s l\n", num(s.Points[0].X), num(s.Points[0].Y))
+		case 'C':
+			fmt.Fprintf(&p.content, "%s %s %s %s %s %s c\n",
+				num(s.Points[0].X), num(s.Points[0].Y), num(s.Points[1].X), num(s.Points[1].Y), num(s.Points[2].X), num(s.Points[2].Y))
+		case 'Z':
+			p.content.WriteString("h\n")
+		}
+	}
+}
+
+func (p *page) shape(s *vector.Shape, base vector.Matrix) {
+	fill, stroke := !s.Fill.None(), !s.Stroke.None() && s.StrokeWidth > 0
+	if !fill && !stroke {
+		return
+	}
+
+	p.content.WriteString("q\n")
+	p.clip(s.Clip)
+	p.transform(s.Matrix)
+
+	m := base.Multiply(s.Matrix)
+	var fillAlpha, strokeAlpha uint8 = 255, 255
+	if fill {
+		fillAlpha = p.paint(s.Fill, m, "rg", "cs", "scn")
+	}
+	if stroke {
+		strokeAlpha = p.paint(s.Stroke, m, "RG", "CS", "SCN")
+		fmt.Fprintf(&p.content, "%s w %d J %d j %s M\n", num(s.StrokeWidth),
+			max(slices.Index([]string{"butt", "round", "square"}, s.LineCap), 0),
+			max(slices.Index([]string{"miter", "round", "bevel"}, s.LineJoin), 0),
+			num(max(s.MiterLimit, 1)))
+	}
+	if fillAlpha < 255 || strokeAlpha < 255 {
+		fmt.Fprintf(&p.content, "/%s gs\n", p.state(fillAlpha, strokeAlpha))
+	}
+
+	p.path(s.Path)
+	operator := "f"
+	switch {
+	case fill && stroke:
+		operator = "B"
+	case stroke:
+		operator = "S"
+	}
+	if s.EvenOdd && fill {
+		operator += "*"
+	}
+	p.content.WriteString(operator + "\nQ\n")
+}
+
+// paint sets a color or gradient with the operators given, returning the
+// alpha to paint with. Stops of a gradient share its most opaque alpha.
+func (p *page) paint(paint vector.Paint, m vector.Matrix, color string, space string, pattern string) uint8 {
+	g := paint.Gradient
+	if g == nil || len(g.Stops) == 1 {
+		c := paint.Color
+		if g != nil {
+			c = g.Stops[0].Color
+		}
+		fmt.Fprintf(&p.content, "%s %s %s %s\n", channel(c.R), channel(c.G), channel(c.B), color)
+		return c.A
+	}
+
+	var alpha uint8
+	for _, s := range g.Stops {
+		alpha = max(alpha, s.Color.A)
+	}
+	fmt.Fprintf(&p.content, "/Pattern %s /%s %s\n", space, p.pattern(g, m.Multiply(g.Matrix)), pattern)
+	return alpha
+}
+
+// pattern adds a shading pattern for a gradient, m placing it on the page
+func (p *page) pattern(g *vector.Gradient, m vector.Matrix) string {
+	stops := slices.Clone(g.Stops)
+	if stops[0].Offset > 0 {
+		stops = append([]vector.Stop{{Offset: 0, Color: stops[0].Color}}, stops...)
+	}
+	if stops[len(stops)-1].Offset < 1 {
+		stops = append(stops, vector.Stop{Offset: 1, Color: stops[len(stops)-1].Color})
+	}
+
+	functions := make([]string, 0, len(stops)-1)
+	bounds := make([]string, 0, len(stops)-2)
+	encode := make([]string, 0, 2*(len(stops)-1))
+	for i := 1; i < len(stops); i++ {
+		a, b := stops[i-1].Color, stops[i].Color
+		functions = append(functions, fmt.Sprintf("<< /FunctionType 2 /Domain [0 1] /C0 [%s %s %s] /C1 [%s %s %s] /N 1 >>",
+			channel(a.R), channel(a.G), channel(a.B), channel(b.R), channel(b.G), channel(b.B)))
+		if i < len(stops)-1 {
+			bounds = append(bounds, num(stops[i].Offset))
+		}
+		encode = append(encode, "0 1")
+	}
+
+	coords := fmt.Sprintf("/ShadingType 2 /Coords [%s %s %s %s]", num(g.X1), num(g.Y1), num(g.X2), num(g.Y2))
+	if g.Radial {
+		coords = fmt.Sprintf("/ShadingType 3 /Coords [%s %s 0 %s %s %s]", num(g.Fx), num(g.Fy), num(g.Cx), num(g.Cy), num(g.R))
+	}
+	// spread methods other than pad are drawn padded
+	shading := fmt.Sprintf("<< %s /ColorSpace /DeviceRGB /Extend [true true] /Function << /FunctionType 3 /Domain [0 1] /Functions [%s] /Bounds [%s] /Encode [%s] >> >>",
+		coords, strings.Join(functions, " "), strings.Join(bounds, " "), strings.Join(encode, " "))
+	n := p.doc.add(fmt.Sprintf("<< /Type /Pattern /PatternType 2 /Shading %s /Matrix [%s] >>", shading, matrix(m)))
+
+	name := fmt.Sprintf("P%d", len(p.patterns)+1)
+	p.patterns[name] = ref(n)
+	return name
+}
+
+// state is the graphics state of an opacity
+func (p *page) state(fill uint8, stroke uint8) string {
+	key := fmt.Sprintf("<< /ca %s /CA %s >>", channel(fill), channel(stroke))
+	for name, value := range p.states {
+		if value == key {
+			return name
+		}
+	}
+	name := fmt.Sprintf("G%d", len(p.states)+1)
+	p.states[name] = key
+	return name
+}
+
+// image draws a raster image, or the drawing of an SVG image
+func (p *page) image(img *vector.Image, base vector.Matrix) error {
+	p.content.WriteString("q\n")
+	p.clip(img.Clip)
+	p.transform(img.Matrix)
+	defer p.content.WriteString("Q\n")
+
+	if img.Drawing != nil {
+		return p.drawing(img.Drawing, base.Multiply(img.Matrix))
+	}
+
+	name, err := p.raster(img)
+	if err != nil || name == "" {
+		return err
+	}
+	if img.Opacity < 1 {
+		alpha := uint8(math.Round(img.Opacity * 255))
+		fmt.Fprintf(&p.content, "/%s gs\n", p.state(alpha, alpha))
+	}
+	// images fill the unit square from the bottom, drawings go down
+	fmt.Fprintf(&p.content, "%s 0 0 %s 0 %s cm /%s Do\n", num(img.Width), num(-img.Height), num(img.Height), name)
+	return nil
+}
+
+// raster adds the image object of a raster image once per document,
+// naming it in the resources of the page. Images that can't be decoded are
+// left out.
+func (p *page) raster(img *vector.Image) (string, error) {
+	hash := sha256.Sum256(img.Data)
+	key := string(hash[:])
+	n, ok := p.doc.images[key]
+	if !ok {
+		n = p.doc.imageObject(img)
+		p.doc.images[key] = n
+	}
+	if n == 0 {
+		return "", nil
+	}
+
+	name := fmt.Sprintf("I%d", n)
+	p.images[name] = ref(n)
+	return name, nil
+}
+
+// imageObject adds an image: JPEG files as they are, others as RGB pixels
+// with their alpha as a soft mask, 0 when the image can't be decoded
+func (doc *document) imageObject(img *vector.Image) int {
+	if img.Type == "image/jpeg" {
+		if config, err := jpeg.DecodeConfig(bytes.NewReader(img.Data)); err == nil {
+			space := ""
+			switch config.ColorModel {
+			case color.YCbCrModel:
+				space = "/DeviceRGB"
+			case color.GrayModel:
+				space = "/DeviceGray"
+			}
+			if space != "" {
+				return doc.stream(fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace %s /BitsPerComponent 8",
+					config.Width, config.Height, space), img.Data, "/DCTDecode")
+			}
+		}
+	}
+
+	decoded, err := img.Decode()
+	if err != nil {
+		return 0
+	}
+	bounds := decoded.Bounds()
+	rgb := make([]byte, 0, 3*bounds.Dx()*bounds.Dy())
+	alpha := make([]byte, 0, bounds.Dx()*bounds.Dy())
+	opaque := true
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(decoded.At(x, y)).(color.NRGBA)
+			rgb = append(rgb, c.R, c.G, c.B)
+			alpha = append(alpha, c.A)
+			opaque = opaque && c.A == 255
+		}
+	}
+
+	dict := fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceRGB /BitsPerComponent 8", bounds.Dx(), bounds.Dy())
+	if !opaque {
+		mask := doc.stream(fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceGray /BitsPerComponent 8",
+			bounds.Dx(), bounds.Dy()), alpha, "")
+		dict += " /SMask " + ref(mask)
+	}
+	return doc.stream(dict, rgb, "")
+}
+
+// invisibleText writes a run as text that isn't painted, stretched over
+// its outlines, with a font every reader has the glyphs of
+func (p *page) invisibleText(t *vector.Text, run vector.Glyphs) {
+	if strings.TrimSpace(run.Run.Text) == "" || run.Width <= 0 {
+		return
+	}
+	font := invisibleFont()
+
+	var hex strings.Builder
+	width := 0.0
+	for _, r := range run.Run.Text {
+		g := font.Glyph(r)
+		if _, ok := p.doc.glyphs[g]; !ok && g != 0 {
+			p.doc.glyphs[g] = r
+		}
+		fmt.Fprintf(&hex, "%04X", g)
+		width += font.Advance(g)
+	}
+	if width <= 0 {
+		return
+	}
+	p.text = true
+
+	p.content.WriteString("q\n")
+	p.clip(t.Clip)
+	// text goes up in PDF and down in drawings
+	p.transform(t.Matrix)
+	fmt.Fprintf(&p.content, "BT 3 Tr /F1 1 Tf %s 0 0 %s %s %s Tm %s Tz <%s> Tj ET\nQ\n",
+		num(run.Size), num(-run.Size), num(run.X), num(run.Y),
+		num(100*run.Width/(width*run.Size)), hex.String())
+}
+
+// invisibleFont is the font of the invisible text, Go Regular
+var invisibleFont = sync.OnceValue(func() *typeset.Font {
+	font, err := typeset.Parse(goregular.TTF)
+	if err != nil {
+		panic(fmt.Sprintf("go font: %v", err))
+	}
+	return font
+})
+
+// writeFont adds the font of the invisible text, with the widths and
+// characters of the glyphs used
+func (doc *document) writeFont() error {
+	if len(doc.glyphs) == 0 {
+		doc.set(doc.font, "null")
+		return nil
+	}
+	font := invisibleFont()
+
+	glyphs := make([]uint16, 0, len(doc.glyphs))
+	for g := range doc.glyphs {
+		glyphs = append(glyphs, g)
+	}
+	slices.Sort(glyphs)
+
+	widths := make([]string, 0, len(glyphs))
+	var cmap strings.Builder
+	cmap.WriteString("/CIDInit /ProcSet findresource begin 12 dict begin begincmap /CIDSystemInfo << /Registry (Adobe) /Ordering (UCS) /Supplement 0 >> def " +
+		"/CMapName /Adobe-Identity-UCS def /CMapType 2 def 1 begincodespacerange <0000> <FFFF> endcodespacerange\n")
+	for i, g := range glyphs {
+		widths = append(widths, fmt.Sprintf("%d [%s]", g, num(font.Advance(g)*1000)))
+		if i%100 == 0 {
+			fmt.Fprintf(&cmap, "%d beginbfchar\n", min(100, len(glyphs)-i))
+		}
+		units := utf16.Encode([]rune{doc.glyphs[g]})
+		fmt.Fprintf(&cmap, "<%04X> <", g)
+		for _, u := range units {
+			fmt.Fprintf(&cmap, "%04X", u)
+		}
+		cmap.WriteString(">\n")
+		if i%100 == 99 || i == len(glyphs)-1 {
+			cmap.WriteString("endbfchar\n")
+		}
+	}
+	cmap.WriteString("endcmap CMapName currentdict /CMap defineresource pop end end")
+
+	file := doc.stream(fmt.Sprintf("/Length1 %d", len(goregular.TTF)), goregular.TTF, "")
+	ascent, descent := num(font.Ascent()*1000), num(font.Descent()*1000)
+	descriptor := doc.add(fmt.Sprintf("<< /Type /FontDescriptor /FontName /GoRegular /Flags 32 /FontBBox [0 %s 1000 %s] /ItalicAngle 0 /Ascent %s /Descent %s /CapHeight %s /StemV 80 /FontFile2 %s >>",
+		descent, ascent, ascent, descent, ascent, ref(file)))
+	cid := doc.add(fmt.Sprintf("<< /Type /Font /Subtype /CIDFontType2 /BaseFont /GoRegular /CIDSystemInfo << /Registry (Adobe) /Ordering (Identity) /Supplement 0 >> /FontDescriptor %s /CIDToGIDMap /Identity /W [%s] >>",
+		ref(descriptor), strings.Join(widths, " ")))
+	toUnicode := doc.stream("", []byte(cmap.String()), "")
+	doc.set(doc.font, fmt.Sprintf("<< /Type /Font /Subtype /Type0 /BaseFont /GoRegular /Encoding /Identity-H /DescendantFonts [%s] /ToUnicode %s >>",
+		ref(cid), ref(toUnicode)))
+	return nil
+}
+
+func ref(n int) string {
+	return strconv.Itoa(n) + " 0 R"
+}
+
+func dict(items map[string]string) string {
+	names := make([]string, 0, len(items))
+	for name := range items {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	entries := make([]string, len(names))
+	for i, name := range names {
+		entries[i] = "/" + name + " " + items[name]
+	}
+	return strings.Join(entries, " ")
+}
+
+func matrix(m vector.Matrix) string {
+	parts := make([]string, len(m))
+	for i, v := range m {
+		parts[i] = num(v)
+	}
+	return strings.Join(parts, " ")
+}
+
+// num formats a number with at most four decimals, PDF has no exponents
+func num(v float64) string {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return "0"
+	}
+	s := strconv.FormatFloat(v, 'f', 4, 64)
+	s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	if s == "-0" || s == "" {
+		return "0"
+	}
+	return s
+}
+
+func channel(v uint8) string {
+	return num(float64(v) / 255)
+}
+
+// text is a string of the document information, in UTF-16
+func text(s string) string {
+	var b strings.Builder
+	b.WriteString("<FEFF")
+	for _, u := range utf16.Encode([]rune(s)) {
+		fmt.Fprintf(&b, "%04X", u)
+	}
+	b.WriteString(">")
+	return b.String()
+}
@@ -0,0 +1,130 @@
+package pdf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"nostr-relay/vector"
+)
+
+// objects checks the cross-reference table of a file and returns its
+// objects, streams decompressed
+func objects(t *testing.T, data []byte) []string {
+	t.Helper()
+	if !bytes.HasPrefix(data, []byte("%PDF-1.7\n")) || !bytes.HasSuffix(data, []byte("%%EOF\n")) {
+		t.Fatalf("not a PDF")
+	}
+	start := bytes.LastIndex(data, []byte("startxref\n"))
+	xref, _ := strconv.Atoi(strings.Fields(string(data[start+10:]))[0])
+	if !bytes.HasPrefix(data[xref:], []byte("xref\n")) {
+		t.Fatalf("startxref points at %q", data[xref:min(xref+10, len(data))])
+	}
+	lines := strings.Split(string(data[xref:]), "\n")
+	count, _ := strconv.Atoi(strings.Fields(lines[1])[1])
+
+	stream := regexp.MustCompile(`(?s)^(.*)/Length (\d+) >>\nstream\n`)
+	objects := make([]string, count)
+	for i := 1; i < count; i++ {
+		offset, _ := strconv.Atoi(lines[2+i][:10])
+		header := strconv.Itoa(i) + " 0 obj\n"
+		if !bytes.HasPrefix(data[offset:], []byte(header)) {
+			t.Fatalf("object %d isn't at %d", i, offset)
+		}
+		body := data[offset+len(header):]
+		body = body[:bytes.Index(body, []byte("\nendobj\n"))]
+		objects[i] = string(body)
+
+		if m := stream.FindSubmatch(body); m != nil {
+			length, _ := strconv.Atoi(string(m[2]))
+			content := body[len(m[0]):]
+			if len(content) != length+len("\nendstream") {
+				t.Fatalf("object %d: stream length %d, has %d", i, length, len(content)-len("\nendstream"))
+			}
+			content = content[:length]
+			if bytes.Contains(m[1], []byte("/FlateDecode")) {
+				r, err := zlib.NewReader(bytes.NewReader(content))
+				if err != nil {
+					t.Fatalf("object %d: %v", i, err)
+				}
+				content, _ = io.ReadAll(r)
+			}
+			objects[i] = string(m[1]) + string(content)
+		}
+	}
+	return objects
+}
+
+func TestWrite(t *testing.T) {
+	pixels := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+	pixels.Set(0, 0, color.NRGBA{255, 0, 0, 128})
+	var picture bytes.Buffer
+	png.Encode(&picture, pixels)
+
+	black := vector.Paint{Color: color.NRGBA{A: 255}}
+	square := vector.Path{{Op: 'M'}, {Op: 'L', Points: [3]vector.Point{{X: 10}}}, {Op: 'L', Points: [3]vector.Point{{X: 10, Y: 10}}}, {Op: 'Z'}}
+	img := &vector.Image{Matrix: vector.Identity, Width: 2, Height: 2, Type: "image/png", Data: picture.Bytes(), Opacity: 1}
+	first := &vector.Drawing{Width: 100, Height: 40, Items: []vector.Item{
+		&vector.Shape{Path: square, Matrix: vector.Translate(5, 5), Fill: vector.Paint{Gradient: &vector.Gradient{
+			X2: 1, Matrix: vector.Identity, Stops: []vector.Stop{{Offset: 0.2, Color: color.NRGBA{255, 0, 0, 255}}, {Offset: 1, Color: color.NRGBA{0, 0, 255, 255}}},
+		}}},
+		&vector.Shape{Path: square, Matrix: vector.Identity, Stroke: vector.Paint{Color: color.NRGBA{0, 0, 0, 128}}, StrokeWidth: 2, LineCap: "round",
+			Clip: &vector.Clip{Shapes: []vector.ClipShape{{Path: square, Matrix: vector.Scale(2, 2)}}}},
+		&vector.Text{Matrix: vector.Identity, X: 50, Y: 30, Size: 12, Runs: []vector.Run{{Text: "Hi é", Fill: black}}},
+		img,
+	}}
+	second := &vector.Drawing{Width: 50, Height: 50, Items: []vector.Item{img}}
+
+	var out bytes.Buffer
+	if err := Write(&out, []*vector.Drawing{first, second}, Info{Title: "Robots & friends", Created: time.Unix(0, 0)}); err != nil {
+		t.Fatal(err)
+	}
+	all := strings.Join(objects(t, out.Bytes()), "\n")
+
+	for _, want := range []string{
+		"/Type /Pages /Kids [",
+		"/Count 2",
+		"/MediaBox [0 0 75 30]",
+		"/MediaBox [0 0 37.5 37.5]",
+		"0.75 0 0 -0.75 0 30 cm",
+		// the gradient starts with its first color
+		"/ShadingType 2 /Coords [0 0 1 0]",
+		"/Bounds [0.2]",
+		"/Pattern cs /P1 scn",
+		"0 0 0 RG\n2 w 1 J 0 j 1 M\n/G1 gs",
+		"0 0 m\n20 0 l\n20 20 l\nh\nW n",
+		"3 Tr /F1 1 Tf",
+		"/ToUnicode",
+		"/SMask",
+		"2 0 0 -2 0 2 cm /I",
+		"/Title <FEFF0052006F0062006F007400730020002600200066007200690065006E00640073>",
+		"/CreationDate (D:19700101000000Z)",
+	} {
+		if !strings.Contains(all, want) {
+			t.Errorf("no %q", want)
+		}
+	}
+	if n := strings.Count(all, "/Subtype /Image"); n != 2 {
+		t.Errorf("the image and its mask are stored once: %d images", n)
+	}
+	// the invisible text maps its glyphs back to characters
+	if !strings.Contains(all, "> <0048>\n") || !strings.Contains(all, "> <00E9>\n") {
+		t.Errorf("ToUnicode map:\n%s", all)
+	}
+
+	var empty bytes.Buffer
+	if err := Write(&empty, []*vector.Drawing{{Width: 10, Height: 10}}, Info{}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(strings.Join(objects(t, empty.Bytes()), "\n"), "FontFile2") {
+		t.Errorf("the font is embedded only for text")
+	}
+}
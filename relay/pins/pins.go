@@ -0,0 +1,217 @@
+package pins
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"nostr-relay/blossom"
+	"nostr-relay/drives"
+	"nostr-relay/kinds"
+
+	"github.com/fiatjaf/eventstore/sqlite3"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// pin_drive has the drives channel messages are drawn with, pin every blob
+// of their current version: a blob is kept in the Blossom store while a pin
+// of it is "pinned", under the owner "drive:<address>"
+var ddls = []string{
+	`CREATE TABLE IF NOT EXISTS pin_drive (
+       address text PRIMARY KEY,
+       pubkey text NOT NULL,
+       first_used_at integer NOT NULL,
+       last_used_at integer NOT NULL);`,
+	`CREATE INDEX IF NOT EXISTS pin_drive_pubkey ON pin_drive (pubkey);`,
+	`CREATE TABLE IF NOT EXISTS pin (
+       address text NOT NULL,
+       sha256 text NOT NULL,
+       size integer NOT NULL,
+       state text NOT NULL,
+       attempts integer NOT NULL DEFAULT 0,
+       last_error text NOT NULL DEFAULT '',
+       next_attempt_at integer NOT NULL DEFAULT 0,
+       updated_at integer NOT NULL,
+       PRIMARY KEY (address, sha256));`,
+	`CREATE INDEX IF NOT EXISTS pin_sha256 ON pin (sha256);`,
+}
+
+// states of a pin
+const (
+	pinned    = "pinned"
+	failed    = "failed"
+	overQuota = "over_quota"
+)
+
+// Options tune the pinner, zero values use the defaults
+type Options struct {
+	// Quota is how many bytes of blobs are pinned for the drives of an
+	// author
+	Quota int64
+
+	// RetryInterval is the wait after a failed mirror, multiplied by the
+	// number of failures up to a day
+	RetryInterval time.Duration
+}
+
+func (o Options) withDefaults() Options {
+	if o.Quota <= 0 {
+		o.Quota = 100 << 20
+	}
+	if o.RetryInterval <= 0 {
+		o.RetryInterval = 10 * time.Minute
+	}
+	return o
+}
+
+// Pinner mirrors the blobs of the drives used in channels into the local
+// Blossom store, so conversations keep their art when the servers of the
+// drives go away, and releases them once no stored drive lists them
+type Pinner struct {
+	db      *sqlite3.SQLite3Backend
+	blobs   *blossom.Server
+	query   drives.QueryFunc
+	options Options
+
+	// wake tells the worker a drive is new or changed
+	wake chan struct{}
+}
+
+func New(db *sqlite3.SQLite3Backend, blobs *blossom.Server, query drives.QueryFunc, options Options) (*Pinner, error) {
+	for _, ddl := range ddls {
+		if _, err := db.Exec(ddl); err != nil {
+			return nil, fmt.Errorf("failed to create pin tables: %w", err)
+		}
+	}
+
+	return &Pinner{
+		db:      db,
+		blobs:   blobs,
+		query:   query,
+		options: options.withDefaults(),
+		wake:    make(chan struct{}, 1),
+	}, nil
+}
+
+// owner is who the Blossom store keeps the blobs of a drive for
+func owner(address string) string {
+	return "drive:" + address
+}
+
+// EventSaved learns the drives messages are drawn with and notices new
+// versions of them, it's meant to be added to relay.OnEventSaved
+func (p *Pinner) EventSaved(ctx context.Context, event *nostr.Event) {
+	switch {
+	case kinds.IsChannelMessage(event):
+		address, ok := drives.Reference(event)
+		if !ok {
+			return
+		}
+		added, err := p.use(ctx, address, event.CreatedAt)
+		if err != nil {
+			log.Printf("Failed to record the use of drive %s: %v", address, err)
+			return
+		}
+		if added {
+			p.notify()
+		}
+
+	case event.Kind == drives.Kind:
+		p.notify()
+	}
+}
+
+// EventDeleted lets the worker release the blobs of deleted drives, it's
+// meant to be added to relay.DeleteEvent
+func (p *Pinner) EventDeleted(ctx context.Context, event *nostr.Event) error {
+	if event.Kind == drives.Kind {
+		p.notify()
+	}
+	return nil
+}
+
+func (p *Pinner) notify() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// use records that a message was drawn with a drive, telling if the drive
+// wasn't known
+func (p *Pinner) use(ctx context.Context, address string, at nostr.Timestamp) (bool, error) {
+	_, pubkey, ok := strings.Cut(address, ":")
+	if !ok {
+		return false, fmt.Errorf("invalid address")
+	}
+	pubkey, _, _ = strings.Cut(pubkey, ":")
+
+	result, err := p.db.ExecContext(ctx, `
+        INSERT INTO pin_drive (address, pubkey, first_used_at, last_used_at) VALUES (?, ?, ?, ?)
+        ON CONFLICT (address) DO NOTHING
+    `, address, pubkey, at, at)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		return true, nil
+	}
+
+	_, err = p.db.ExecContext(ctx, `
+        UPDATE pin_drive SET last_used_at = max(last_used_at, ?) WHERE address = ?
+    `, at, address)
+	return false, err
+}
+
+// Learn records the drives of the messages already stored, for when pinning
+// is enabled on a relay that has history. It returns how many drives were
+// new.
+func (p *Pinner) Learn(ctx context.Context) (int, error) {
+	rows, err := p.db.QueryContext(ctx, `
+        SELECT e.pubkey, e.created_at, t.value FROM event e, json_each(e.tags) t
+        WHERE e.kind IN (42, 7353) AND json_extract(t.value, '$[0]') = 'drive'
+    `)
+	if err != nil {
+		return 0, err
+	}
+
+	type use struct {
+		address string
+		at      nostr.Timestamp
+	}
+	uses := make([]use, 0)
+	for rows.Next() {
+		var pubkey, tagj string
+		var createdAt int64
+		if err := rows.Scan(&pubkey, &createdAt, &tagj); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		var tag nostr.Tag
+		if json.Unmarshal([]byte(tagj), &tag) != nil {
+			continue
+		}
+		if address, ok := drives.Reference(&nostr.Event{PubKey: pubkey, Tags: nostr.Tags{tag}}); ok {
+			uses = append(uses, use{address, nostr.Timestamp(createdAt)})
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	added := 0
+	for _, u := range uses {
+		ok, err := p.use(ctx, u.address, u.at)
+		if err != nil {
+			return added, err
+		}
+		if ok {
+			added++
+		}
+	}
+	return added, nil
+}
@@ -0,0 +1,197 @@
+package pins
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"nostr-relay/blossom"
+	"nostr-relay/drives"
+	"nostr-relay/internal/testutil"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func svg(fill string) []byte {
+	return []byte(`<svg xmlns="http://www.w3.org/2000/svg"><circle r="4" fill="` + fill + `"/></svg>`)
+}
+
+func TestPin(t *testing.T) {
+	ctx := context.Background()
+	db := testutil.DB(t, "pins")
+
+	blobs, err := blossom.New(db, blossom.Options{Dir: filepath.Join(t.TempDir(), "blobs"), PrivateMirrors: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	happy, sad, bg := svg("#ff0"), svg("#00f"), svg("#0f0")
+	served := map[string][]byte{testutil.Sum(happy): happy, testutil.Sum(sad): sad, testutil.Sum(bg): bg}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := served[strings.TrimPrefix(r.URL.Path, "/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Write(data)
+	}))
+	t.Cleanup(server.Close)
+
+	sk := nostr.GeneratePrivateKey()
+	now := nostr.Now() - 100
+	save := func(event nostr.Event) *nostr.Event {
+		now++
+		event.CreatedAt = now
+		event.Sign(sk)
+		if err := db.SaveEvent(ctx, &event); err != nil {
+			t.Fatal(err)
+		}
+		return &event
+	}
+	drive := func(d string, blobs ...[]byte) *nostr.Event {
+		event := nostr.Event{Kind: drives.Kind, Tags: nostr.Tags{{"d", d}, {"server", server.URL}}}
+		for _, data := range blobs {
+			event.Tags = append(event.Tags, nostr.Tag{"x", testutil.Sum(data), "/characters/robo/" + testutil.Sum(data)[:4], strconv.Itoa(len(data)), "image/svg+xml"})
+		}
+		return save(event)
+	}
+	message := func(d string) *nostr.Event {
+		return save(nostr.Event{Kind: 7353, Content: "hi", Tags: nostr.Tags{{"e", strings.Repeat("0", 64)}, {"drive", d}}})
+	}
+	stored := func(data []byte) bool {
+		r, err := blobs.Open(ctx, testutil.Sum(data))
+		if errors.Is(err, blossom.ErrNotFound) {
+			return false
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Close()
+		return true
+	}
+
+	// a message sent before pinning was enabled
+	drive("robo", happy, sad)
+	message("robo")
+
+	pinner, err := New(db, blobs, db.QueryEvents, Options{Quota: int64(len(happy) + len(sad) + len(bg) - 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added, err := pinner.Learn(ctx); err != nil || added != 1 {
+		t.Fatalf("learn: %d %v", added, err)
+	}
+	if err := pinner.Step(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !stored(happy) || !stored(sad) {
+		t.Errorf("the blobs of a used drive are pinned")
+	}
+
+	// drives nobody draws with aren't pinned, until someone does
+	drive("scenery", bg)
+	if err := pinner.Step(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if stored(bg) {
+		t.Errorf("the blobs of an unused drive aren't pinned")
+	}
+	pinner.EventSaved(ctx, message("scenery"))
+	if err := pinner.Step(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if stored(bg) {
+		t.Errorf("the quota is for all the drives of an author")
+	}
+
+	status, err := pinner.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	states := make(map[string]string)
+	for _, d := range status.Drives {
+		for _, pin := range d.Pins {
+			states[pin.SHA256] = pin.State
+		}
+	}
+	if states[testutil.Sum(happy)] != pinned || states[testutil.Sum(sad)] != pinned || states[testutil.Sum(bg)] != overQuota {
+		t.Errorf("states: %v", states)
+	}
+	if len(status.Authors) != 1 || status.Authors[0].Used != int64(len(happy)+len(sad)) {
+		t.Errorf("authors: %+v", status.Authors)
+	}
+
+	// a new version without a blob releases it, which makes room for others
+	pinner.EventSaved(ctx, drive("robo", happy))
+	if err := pinner.Step(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !stored(happy) || stored(sad) || !stored(bg) {
+		t.Errorf("after the new version: happy %v, sad %v, bg %v", stored(happy), stored(sad), stored(bg))
+	}
+
+	// blobs owned by someone else too are kept when released
+	if _, err := blobs.Mirror(ctx, server.URL+"/"+testutil.Sum(happy), testutil.Sum(happy), "someone"); err != nil {
+		t.Fatal(err)
+	}
+	drive("robo")
+	if err := pinner.Step(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !stored(happy) {
+		t.Errorf("a blob someone else owns is kept")
+	}
+}
+
+func TestPinFailure(t *testing.T) {
+	ctx := context.Background()
+	db := testutil.DB(t, "pins")
+
+	blobs, err := blossom.New(db, blossom.Options{Dir: filepath.Join(t.TempDir(), "blobs"), PrivateMirrors: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pinner, err := New(db, blobs, db.QueryEvents, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.NotFoundHandler())
+	t.Cleanup(server.Close)
+
+	sk := nostr.GeneratePrivateKey()
+	drive := nostr.Event{Kind: drives.Kind, CreatedAt: nostr.Now(), Tags: nostr.Tags{
+		{"d", "robo"}, {"server", server.URL}, {"x", testutil.Sum(svg("#fff")), "/characters/robo/happy", "80", "image/svg+xml"},
+	}}
+	drive.Sign(sk)
+	if err := db.SaveEvent(ctx, &drive); err != nil {
+		t.Fatal(err)
+	}
+	message := nostr.Event{Kind: 42, CreatedAt: nostr.Now(), Content: "hi", Tags: nostr.Tags{{"drive", "robo"}}}
+	message.Sign(sk)
+	pinner.EventSaved(ctx, &message)
+
+	for range 2 {
+		if err := pinner.Step(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	status, err := pinner.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Drives) != 1 || status.Drives[0].Failed != 1 {
+		t.Fatalf("status: %+v", status)
+	}
+	pin := status.Drives[0].Pins[0]
+	if pin.Attempts != 1 || pin.NextAttemptAt <= nostr.Now() || pin.LastError == "" {
+		t.Errorf("a failure is retried later, not on the next round: %+v", pin)
+	}
+}
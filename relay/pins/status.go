@@ -0,0 +1,138 @@
+package pins
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// PinStatus is where a blob of a drive stands
+type PinStatus struct {
+	SHA256        string          `json:"sha256"`
+	Size          int64           `json:"size"`
+	State         string          `json:"state"`
+	Attempts      int             `json:"attempts,omitempty"`
+	NextAttemptAt nostr.Timestamp `json:"next_attempt_at,omitempty"`
+	LastError     string          `json:"last_error,omitempty"`
+	UpdatedAt     nostr.Timestamp `json:"updated_at"`
+}
+
+// DriveStatus is what's pinned of a drive used in channels
+type DriveStatus struct {
+	Address    string          `json:"address"`
+	PubKey     string          `json:"pubkey"`
+	LastUsedAt nostr.Timestamp `json:"last_used_at"`
+	Pinned     int             `json:"pinned"`
+	Failed     int             `json:"failed"`
+	OverQuota  int             `json:"over_quota"`
+	Pins       []PinStatus     `json:"pins"`
+}
+
+// AuthorStatus is how much of their quota the drives of an author use
+type AuthorStatus struct {
+	PubKey string `json:"pubkey"`
+	Used   int64  `json:"used"`
+	Quota  int64  `json:"quota"`
+}
+
+// Status is every drive used in channels and what's pinned of it
+type Status struct {
+	Drives  []DriveStatus  `json:"drives"`
+	Authors []AuthorStatus `json:"authors"`
+}
+
+// Status returns the drives, most recently used first
+func (p *Pinner) Status(ctx context.Context) (Status, error) {
+	status := Status{Drives: make([]DriveStatus, 0), Authors: make([]AuthorStatus, 0)}
+
+	rows, err := p.db.QueryContext(ctx, "SELECT address, pubkey, last_used_at FROM pin_drive ORDER BY last_used_at DESC")
+	if err != nil {
+		return status, err
+	}
+	index := make(map[string]int)
+	for rows.Next() {
+		d := DriveStatus{Pins: make([]PinStatus, 0)}
+		if err := rows.Scan(&d.Address, &d.PubKey, &d.LastUsedAt); err != nil {
+			rows.Close()
+			return status, err
+		}
+		index[d.Address] = len(status.Drives)
+		status.Drives = append(status.Drives, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return status, err
+	}
+
+	rows, err = p.db.QueryContext(ctx, `
+        SELECT address, sha256, size, state, attempts, next_attempt_at, last_error, updated_at
+        FROM pin ORDER BY updated_at DESC
+    `)
+	if err != nil {
+		return status, err
+	}
+	for rows.Next() {
+		var address string
+		var s PinStatus
+		if err := rows.Scan(&address, &s.SHA256, &s.Size, &s.State, &s.Attempts, &s.NextAttemptAt, &s.LastError, &s.UpdatedAt); err != nil {
+			rows.Close()
+			return status, err
+		}
+		i, ok := index[address]
+		if !ok {
+			continue
+		}
+		d := &status.Drives[i]
+		switch s.State {
+		case pinned:
+			d.Pinned++
+			s.NextAttemptAt = 0
+		case failed:
+			d.Failed++
+		case overQuota:
+			d.OverQuota++
+		}
+		d.Pins = append(d.Pins, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return status, err
+	}
+
+	rows, err = p.db.QueryContext(ctx, `
+        SELECT pubkey, sum(size) FROM (
+            SELECT DISTINCT d.pubkey, p.sha256, p.size FROM pin p JOIN pin_drive d ON d.address = p.address
+            WHERE p.state = ?)
+        GROUP BY pubkey ORDER BY sum(size) DESC
+    `, pinned)
+	if err != nil {
+		return status, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		a := AuthorStatus{Quota: p.options.Quota}
+		if err := rows.Scan(&a.PubKey, &a.Used); err != nil {
+			return status, err
+		}
+		status.Authors = append(status.Authors, a)
+	}
+
+	return status, rows.Err()
+}
+
+// HandleStatus serves the Status as JSON, it's meant to be behind the admin
+// authentication of the dashboard
+func (p *Pinner) HandleStatus(w http.ResponseWriter, r *http.Request) {
+	status, err := p.Status(r.Context())
+	if err != nil {
+		log.Printf("Failed to load the pin status: %v", err)
+		http.Error(w, "could not load the pin status", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
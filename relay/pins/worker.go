@@ -0,0 +1,307 @@
+package pins
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"nostr-relay/blossom"
+	"nostr-relay/drives"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// pinState is a blob a drive lists, pinned or not yet
+type pinState struct {
+	sha256        string
+	size          int64
+	state         string
+	attempts      int
+	nextAttemptAt nostr.Timestamp
+}
+
+// Run pins what's missing every interval, and as soon as a drive is new or
+// changed, until ctx is done
+func (p *Pinner) Run(ctx context.Context, interval time.Duration) {
+	if added, err := p.Learn(ctx); err != nil {
+		log.Printf("Failed to learn the drives of stored messages: %v", err)
+	} else if added > 0 {
+		log.Printf("Pinning the blobs of %d drives used in stored messages", added)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := p.Step(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Pinning round failed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-p.wake:
+		}
+	}
+}
+
+// Step brings the pins of every used drive in line with its current version:
+// blobs they no longer list are released first, so they don't count in the
+// quota, then new blobs are mirrored
+func (p *Pinner) Step(ctx context.Context) error {
+	rows, err := p.db.QueryContext(ctx, "SELECT address FROM pin_drive ORDER BY last_used_at DESC")
+	if err != nil {
+		return err
+	}
+	addresses := make([]string, 0)
+	for rows.Next() {
+		var address string
+		if err := rows.Scan(&address); err != nil {
+			rows.Close()
+			return err
+		}
+		addresses = append(addresses, address)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	type pending struct {
+		drive drives.Drive
+		pins  map[string]*pinState
+	}
+	todo := make([]pending, 0, len(addresses))
+	released := false
+	for _, address := range addresses {
+		drive, pins, n, err := p.collect(ctx, address)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Printf("Failed to release the blobs of drive %s: %v", address, err)
+			continue
+		}
+		released = released || n > 0
+		if drive != nil {
+			todo = append(todo, pending{*drive, pins})
+		}
+	}
+
+	now := nostr.Now()
+	for _, t := range todo {
+		if err := p.sync(ctx, t.drive, t.pins, now, released); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Printf("Failed to pin drive %s: %v", t.drive.Address(), err)
+		}
+	}
+	return nil
+}
+
+// collect releases the pins of blobs a drive doesn't list anymore, all of
+// them when it isn't stored, and returns the drive, its remaining pins and
+// how many were released
+func (p *Pinner) collect(ctx context.Context, address string) (*drives.Drive, map[string]*pinState, int, error) {
+	drive, err := p.drive(ctx, address)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	pins, err := p.pins(ctx, address)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	wanted := make(map[string]bool)
+	if drive != nil {
+		for _, blob := range drive.Blobs {
+			wanted[blob.SHA256] = true
+		}
+	}
+
+	n := 0
+	for sha256, pin := range pins {
+		if wanted[sha256] {
+			continue
+		}
+		if err := p.release(ctx, address, pin); err != nil {
+			return nil, nil, n, err
+		}
+		delete(pins, sha256)
+		n++
+	}
+	return drive, pins, n, nil
+}
+
+// sync mirrors the blobs of a drive that aren't pinned yet and are due,
+// those over quota are tried again at once when something was released
+func (p *Pinner) sync(ctx context.Context, drive drives.Drive, pins map[string]*pinState, now nostr.Timestamp, released bool) error {
+	var servers []string
+	for _, blob := range drive.Blobs {
+		if !isHash(blob.SHA256) {
+			continue
+		}
+		pin, ok := pins[blob.SHA256]
+		if ok && (pin.state == pinned || (pin.nextAttemptAt > now && !(released && pin.state == overQuota))) {
+			continue
+		}
+		if !ok {
+			pin = &pinState{sha256: blob.SHA256, size: max(blob.Size, 0)}
+			pins[blob.SHA256] = pin
+		}
+
+		if servers == nil {
+			var err error
+			if servers, err = drives.Servers(ctx, p.query, drive); err != nil {
+				return err
+			}
+		}
+		if err := p.pin(ctx, drive, pin, servers); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// drive loads the current version of a drive, nil when it isn't stored
+func (p *Pinner) drive(ctx context.Context, address string) (*drives.Drive, error) {
+	parts := strings.SplitN(address, ":", 3)
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid address")
+	}
+
+	ch, err := p.query(ctx, nostr.Filter{Kinds: []int{drives.Kind}, Authors: []string{parts[1]}, Tags: nostr.TagMap{"d": {parts[2]}}})
+	if err != nil {
+		return nil, err
+	}
+	var latest *nostr.Event
+	for event := range ch {
+		// the store matches tag values loosely
+		if event.Tags.GetD() != parts[2] {
+			continue
+		}
+		if latest == nil || event.CreatedAt > latest.CreatedAt {
+			latest = event
+		}
+	}
+	if latest == nil {
+		return nil, nil
+	}
+
+	drive := drives.Parse(latest)
+	return &drive, nil
+}
+
+// pins loads the pins of a drive, by hash
+func (p *Pinner) pins(ctx context.Context, address string) (map[string]*pinState, error) {
+	rows, err := p.db.QueryContext(ctx, `
+        SELECT sha256, size, state, attempts, next_attempt_at FROM pin WHERE address = ?
+    `, address)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pins := make(map[string]*pinState)
+	for rows.Next() {
+		pin := &pinState{}
+		if err := rows.Scan(&pin.sha256, &pin.size, &pin.state, &pin.attempts, &pin.nextAttemptAt); err != nil {
+			return nil, err
+		}
+		pins[pin.sha256] = pin
+	}
+	return pins, rows.Err()
+}
+
+// release forgets a blob a drive doesn't list anymore, the Blossom store
+// deletes it when nothing else keeps it
+func (p *Pinner) release(ctx context.Context, address string, pin *pinState) error {
+	if pin.state == pinned {
+		if err := p.blobs.Release(ctx, pin.sha256, owner(address)); err != nil && !errors.Is(err, blossom.ErrNotFound) {
+			return fmt.Errorf("failed to release %s: %w", pin.sha256, err)
+		}
+	}
+	_, err := p.db.ExecContext(ctx, "DELETE FROM pin WHERE address = ? AND sha256 = ?", address, pin.sha256)
+	return err
+}
+
+// pin mirrors a blob from the first server that has it, unless the author
+// of the drive is over quota
+func (p *Pinner) pin(ctx context.Context, drive drives.Drive, pin *pinState, servers []string) error {
+	address := drive.Address()
+
+	// blobs shared by the drives of an author only count once
+	var used int64
+	err := p.db.QueryRowContext(ctx, `
+        SELECT coalesce(sum(size), 0) FROM (
+            SELECT DISTINCT p.sha256, p.size FROM pin p JOIN pin_drive d ON d.address = p.address
+            WHERE d.pubkey = ? AND p.state = ? AND p.sha256 != ?)
+    `, drive.Event.PubKey, pinned, pin.sha256).Scan(&used)
+	if err != nil {
+		return err
+	}
+	if used+pin.size > p.options.Quota {
+		return p.save(ctx, address, pin, overQuota, "quota exceeded", 0)
+	}
+
+	lastError := "no server"
+	for _, server := range servers {
+		descriptor, err := p.blobs.Mirror(ctx, server+"/"+pin.sha256, pin.sha256, owner(address))
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			lastError = err.Error()
+			continue
+		}
+
+		// the size of the drive is only what its author says
+		pin.size = descriptor.Size
+		if used+pin.size > p.options.Quota {
+			if err := p.blobs.Release(ctx, pin.sha256, owner(address)); err != nil && !errors.Is(err, blossom.ErrNotFound) {
+				return err
+			}
+			return p.save(ctx, address, pin, overQuota, "quota exceeded", 0)
+		}
+		return p.save(ctx, address, pin, pinned, "", 0)
+	}
+
+	pin.attempts++
+	wait := min(p.options.RetryInterval*time.Duration(pin.attempts), 24*time.Hour)
+	return p.save(ctx, address, pin, failed, lastError, nostr.Now()+nostr.Timestamp(wait/time.Second))
+}
+
+// save records the state of a pin, attempts only count failures in a row
+func (p *Pinner) save(ctx context.Context, address string, pin *pinState, state string, lastError string, nextAttemptAt nostr.Timestamp) error {
+	if state != failed {
+		pin.attempts = 0
+	}
+	if state == overQuota {
+		// the quota is checked again when something else is released
+		nextAttemptAt = nostr.Now() + nostr.Timestamp(p.options.RetryInterval/time.Second)
+	}
+
+	_, err := p.db.ExecContext(ctx, `
+        INSERT INTO pin (address, sha256, size, state, attempts, last_error, next_attempt_at, updated_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+        ON CONFLICT (address, sha256) DO UPDATE SET
+            size = excluded.size, state = excluded.state, attempts = excluded.attempts,
+            last_error = excluded.last_error, next_attempt_at = excluded.next_attempt_at,
+            updated_at = excluded.updated_at
+    `, address, pin.sha256, pin.size, state, pin.attempts, lastError, nextAttemptAt, nostr.Now())
+	return err
+}
+
+func isHash(s string) bool {
+	if len(s) != 64 || strings.ToLower(s) != s {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
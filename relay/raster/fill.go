@@ -0,0 +1,283 @@
+package raster
+
+import (
+	"math"
+	"slices"
+
+	"nostr-relay/vector"
+)
+
+// tolerance is how far flattened curves stray from the real ones, in
+// pixels
+const tolerance = 0.2
+
+// subsamples are the scanlines sampled per row of pixels, coverage along
+// rows being exact
+const subsamples = 8
+
+// polygon is a closed outline, in pixels
+type polygon []vector.Point
+
+// polyline is a flattened subpath, closed or not
+type polyline struct {
+	points []vector.Point
+	closed bool
+}
+
+// flatten turns a path into polylines, curves into lines at most tol away
+// from them, after moving its points by m
+func flatten(path vector.Path, m vector.Matrix, tol float64) []polyline {
+	lines := make([]polyline, 0)
+	var current *polyline
+	start := vector.Point{}
+	last := vector.Point{}
+	for _, s := range path {
+		switch s.Op {
+		case 'M':
+			last = m.Apply(s.Points[0])
+			start = last
+			lines = append(lines, polyline{points: []vector.Point{last}})
+			current = &lines[len(lines)-1]
+		case 'L':
+			if current == nil {
+				lines = append(lines, polyline{points: []vector.Point{last}})
+				current = &lines[len(lines)-1]
+			}
+			last = m.Apply(s.Points[0])
+			current.points = append(current.points, last)
+		case 'C':
+			if current == nil {
+				lines = append(lines, polyline{points: []vector.Point{last}})
+				current = &lines[len(lines)-1]
+			}
+			c1, c2, p := m.Apply(s.Points[0]), m.Apply(s.Points[1]), m.Apply(s.Points[2])
+			current.points = cubic(current.points, last, c1, c2, p, tol)
+			last = p
+		case 'Z':
+			if current != nil {
+				current.closed = true
+				current = nil
+			}
+			last = start
+		}
+	}
+	return lines
+}
+
+// cubic appends the points of a flattened cubic curve, but its start
+func cubic(points []vector.Point, p0 vector.Point, p1 vector.Point, p2 vector.Point, p3 vector.Point, tol float64) []vector.Point {
+	// lines stray from the curve by at most 3/4 of its second difference
+	// over the square of their count
+	dd := math.Max(math.Hypot(p0.X-2*p1.X+p2.X, p0.Y-2*p1.Y+p2.Y), math.Hypot(p1.X-2*p2.X+p3.X, p1.Y-2*p2.Y+p3.Y))
+	n := int(math.Ceil(math.Sqrt(0.75 * dd / tol)))
+	n = min(max(n, 1), 500)
+	for i := 1; i <= n; i++ {
+		t := float64(i) / float64(n)
+		u := 1 - t
+		a, b, c, d := u*u*u, 3*u*u*t, 3*u*t*t, t*t*t
+		points = append(points, vector.Point{
+			X: a*p0.X + b*p1.X + c*p2.X + d*p3.X,
+			Y: a*p0.Y + b*p1.Y + c*p2.Y + d*p3.Y,
+		})
+	}
+	return points
+}
+
+// mask is the coverage of a shape, from 0 to 1, over the pixels of its
+// bounds
+type mask struct {
+	x0, y0, x1, y1 int
+	values         []float32
+}
+
+func (k *mask) at(x int, y int) float32 {
+	if k == nil {
+		return 1
+	}
+	if x < k.x0 || x >= k.x1 || y < k.y0 || y >= k.y1 {
+		return 0
+	}
+	return k.values[(y-k.y0)*(k.x1-k.x0)+x-k.x0]
+}
+
+func (k *mask) empty() bool {
+	return k.x0 >= k.x1 || k.y0 >= k.y1
+}
+
+type edge struct {
+	x0, y0, x1, y1 float64
+	winding        int
+}
+
+// fill rasterizes polygons into a mask of their bounds within a width by
+// height image, by the nonzero or even-odd rule
+func fill(polygons []polygon, evenOdd bool, width int, height int) *mask {
+	edges := make([]edge, 0)
+	minX, minY, maxX, maxY := math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)
+	for _, p := range polygons {
+		for i := range p {
+			a, b := p[i], p[(i+1)%len(p)]
+			if math.IsNaN(a.X+a.Y+b.X+b.Y) || math.IsInf(a.X+a.Y+b.X+b.Y, 0) {
+				continue
+			}
+			minX, maxX = math.Min(minX, math.Min(a.X, b.X)), math.Max(maxX, math.Max(a.X, b.X))
+			minY, maxY = math.Min(minY, math.Min(a.Y, b.Y)), math.Max(maxY, math.Max(a.Y, b.Y))
+			if a.Y == b.Y {
+				continue
+			}
+			if a.Y < b.Y {
+				edges = append(edges, edge{a.X, a.Y, b.X, b.Y, 1})
+			} else {
+				edges = append(edges, edge{b.X, b.Y, a.X, a.Y, -1})
+			}
+		}
+	}
+
+	k := &mask{
+		x0: max(int(math.Floor(minX)), 0), y0: max(int(math.Floor(minY)), 0),
+		x1: min(int(math.Ceil(maxX))+1, width), y1: min(int(math.Ceil(maxY))+1, height),
+	}
+	if len(edges) == 0 || k.empty() {
+		return &mask{}
+	}
+	w := k.x1 - k.x0
+	k.values = make([]float32, w*(k.y1-k.y0))
+	slices.SortFunc(edges, func(a edge, b edge) int {
+		switch {
+		case a.y0 < b.y0:
+			return -1
+		case a.y0 > b.y0:
+			return 1
+		}
+		return 0
+	})
+
+	type crossing struct {
+		x       float64
+		winding int
+	}
+	active := make([]edge, 0)
+	crossings := make([]crossing, 0)
+	next := 0
+	weight := float32(1) / subsamples
+	for y := k.y0; y < k.y1; y++ {
+		row := k.values[(y-k.y0)*w : (y-k.y0+1)*w]
+		for s := 0; s < subsamples; s++ {
+			sy := float64(y) + (float64(s)+0.5)/subsamples
+			for next < len(edges) && edges[next].y0 <= sy {
+				active = append(active, edges[next])
+				next++
+			}
+			crossings = crossings[:0]
+			kept := active[:0]
+			for _, e := range active {
+				if e.y1 <= sy {
+					continue
+				}
+				kept = append(kept, e)
+				if e.y0 <= sy {
+					crossings = append(crossings, crossing{e.x0 + (sy-e.y0)*(e.x1-e.x0)/(e.y1-e.y0), e.winding})
+				}
+			}
+			active = kept
+			slices.SortFunc(crossings, func(a crossing, b crossing) int {
+				switch {
+				case a.x < b.x:
+					return -1
+				case a.x > b.x:
+					return 1
+				}
+				return 0
+			})
+
+			winding := 0
+			for i, c := range crossings {
+				winding += c.winding
+				inside := winding != 0
+				if evenOdd {
+					inside = winding%2 != 0
+				}
+				if inside && i+1 < len(crossings) {
+					span(row, c.x-float64(k.x0), crossings[i+1].x-float64(k.x0), weight)
+				}
+			}
+		}
+	}
+	for i, v := range k.values {
+		k.values[i] = min(v, 1)
+	}
+	return k
+}
+
+// span adds weight to the pixels of a row from a to b, partly covered
+// pixels at the ends in proportion
+func span(row []float32, a float64, b float64, weight float32) {
+	a, b = math.Max(a, 0), math.Min(b, float64(len(row)))
+	if a >= b {
+		return
+	}
+	ia, ib := int(a), int(b)
+	if ia == ib {
+		row[ia] += float32(b-a) * weight
+		return
+	}
+	row[ia] += float32(float64(ia+1)-a) * weight
+	for i := ia + 1; i < ib; i++ {
+		row[i] += weight
+	}
+	if ib < len(row) {
+		row[ib] += float32(b-float64(ib)) * weight
+	}
+}
+
+// intersect multiplies the coverage of a mask by another's, nil being
+// full coverage
+func intersect(k *mask, other *mask) *mask {
+	if k == nil {
+		return other
+	}
+	if other == nil || k.empty() {
+		return k
+	}
+	out := &mask{x0: max(k.x0, other.x0), y0: max(k.y0, other.y0), x1: min(k.x1, other.x1), y1: min(k.y1, other.y1)}
+	if out.empty() {
+		return &mask{}
+	}
+	w := out.x1 - out.x0
+	out.values = make([]float32, w*(out.y1-out.y0))
+	for y := out.y0; y < out.y1; y++ {
+		for x := out.x0; x < out.x1; x++ {
+			out.values[(y-out.y0)*w+x-out.x0] = k.at(x, y) * other.at(x, y)
+		}
+	}
+	return out
+}
+
+// union combines the coverage of masks, as if they were drawn over each
+// other
+func union(masks []*mask) *mask {
+	if len(masks) == 1 {
+		return masks[0]
+	}
+	out := &mask{x0: math.MaxInt, y0: math.MaxInt, x1: math.MinInt, y1: math.MinInt}
+	for _, k := range masks {
+		if !k.empty() {
+			out.x0, out.y0, out.x1, out.y1 = min(out.x0, k.x0), min(out.y0, k.y0), max(out.x1, k.x1), max(out.y1, k.y1)
+		}
+	}
+	if out.empty() {
+		return &mask{}
+	}
+	w := out.x1 - out.x0
+	out.values = make([]float32, w*(out.y1-out.y0))
+	for y := out.y0; y < out.y1; y++ {
+		for x := out.x0; x < out.x1; x++ {
+			rest := float32(1)
+			for _, k := range masks {
+				rest *= 1 - k.at(x, y)
+			}
+			out.values[(y-out.y0)*w+x-out.x0] = 1 - rest
+		}
+	}
+	return out
+}
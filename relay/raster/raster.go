@@ -0,0 +1,354 @@
+package raster
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"math"
+
+	"nostr-relay/vector"
+
+	_ "golang.org/x/image/webp"
+)
+
+// Formats are the image formats drawings can be encoded in
+var Formats = []string{"png", "webp"}
+
+// Render draws a drawing on a width by height image, stretched over it
+func Render(d *vector.Drawing, width int, height int) *image.NRGBA {
+	c := &canvas{
+		width:  width,
+		height: height,
+		pixels: make([]float32, 4*width*height),
+		clips:  make(map[clipKey]*mask),
+	}
+	if d.Width > 0 && d.Height > 0 {
+		c.drawing(d, vector.Scale(float64(width)/d.Width, float64(height)/d.Height), nil)
+	}
+	return c.result()
+}
+
+// Fit is the size of an image of a drawing whose longest side is size
+// pixels, keeping its proportions
+func Fit(width float64, height float64, size int) (int, int) {
+	if width <= 0 || height <= 0 {
+		return size, size
+	}
+	if width >= height {
+		return size, max(int(math.Round(float64(size)*height/width)), 1)
+	}
+	return max(int(math.Round(float64(size)*width/height)), 1), size
+}
+
+// Encode writes an image as PNG or lossless WebP
+func Encode(w io.Writer, img image.Image, format string) error {
+	switch format {
+	case "png":
+		return (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(w, img)
+	case "webp":
+		return encodeWebP(w, img)
+	}
+	return fmt.Errorf("unknown image format %q", format)
+}
+
+// canvas holds premultiplied colors from 0 to 1, as they are blended
+type canvas struct {
+	width, height int
+	pixels        []float32
+
+	// clips are the masks of the clips drawn with so far, by clip and
+	// transform
+	clips map[clipKey]*mask
+}
+
+type clipKey struct {
+	clip *vector.Clip
+	base vector.Matrix
+}
+
+// drawing paints the items of a drawing, base taking its coordinates to
+// pixels, inside the outer mask of the image it's drawn in
+func (c *canvas) drawing(d *vector.Drawing, base vector.Matrix, outer *mask) {
+	for _, item := range d.Items {
+		switch item := item.(type) {
+		case *vector.Shape:
+			c.shape(item, base, outer)
+		case *vector.Text:
+			for _, run := range d.Glyphs(item) {
+				for _, shape := range run.Shapes {
+					c.shape(shape, base, outer)
+				}
+			}
+		case *vector.Image:
+			c.image(item, base, outer)
+		}
+	}
+}
+
+func (c *canvas) shape(s *vector.Shape, base vector.Matrix, outer *mask) {
+	filled, stroked := !s.Fill.None(), !s.Stroke.None() && s.StrokeWidth > 0
+	if !filled && !stroked {
+		return
+	}
+	clip := intersect(c.clip(s.Clip, base), outer)
+	if clip != nil && clip.empty() {
+		return
+	}
+	m := base.Multiply(s.Matrix)
+
+	if filled {
+		polygons := make([]polygon, 0)
+		for _, line := range flatten(s.Path, m, tolerance) {
+			polygons = append(polygons, line.points)
+		}
+		c.paint(intersect(fill(polygons, s.EvenOdd, c.width, c.height), clip), s.Fill, m)
+	}
+	if stroked {
+		scale := m.Scale()
+		if scale == 0 {
+			return
+		}
+		st := newStroker(s, scale)
+		for _, line := range flatten(s.Path, vector.Identity, tolerance/scale) {
+			st.stroke(line)
+		}
+		for i, p := range st.polygons {
+			moved := make(polygon, len(p))
+			for j, point := range p {
+				moved[j] = m.Apply(point)
+			}
+			st.polygons[i] = moved
+		}
+		c.paint(intersect(fill(st.polygons, false, c.width, c.height), clip), s.Stroke, m)
+	}
+}
+
+// clip is the mask of a clip and its parents, nil when nothing is clipped
+func (c *canvas) clip(clip *vector.Clip, base vector.Matrix) *mask {
+	if clip == nil {
+		return nil
+	}
+	key := clipKey{clip, base}
+	if k, ok := c.clips[key]; ok {
+		return k
+	}
+
+	masks := make([]*mask, 0, len(clip.Shapes))
+	for _, s := range clip.Shapes {
+		polygons := make([]polygon, 0)
+		for _, line := range flatten(s.Path, base.Multiply(s.Matrix), tolerance) {
+			polygons = append(polygons, line.points)
+		}
+		masks = append(masks, fill(polygons, s.EvenOdd, c.width, c.height))
+	}
+	k := &mask{}
+	if len(masks) > 0 {
+		k = intersect(union(masks), c.clip(clip.Parent, base))
+	}
+	c.clips[key] = k
+	return k
+}
+
+// paint blends a paint over the pixels of a mask, m taking the coordinates
+// of the shape painted to pixels
+func (c *canvas) paint(k *mask, paint vector.Paint, m vector.Matrix) {
+	if k.empty() {
+		return
+	}
+	if paint.Gradient == nil {
+		r, g, b, a := premultiply(paint.Color)
+		for y := k.y0; y < k.y1; y++ {
+			for x := k.x0; x < k.x1; x++ {
+				if v := k.at(x, y); v > 0 {
+					c.blend(x, y, r*v, g*v, b*v, a*v)
+				}
+			}
+		}
+		return
+	}
+
+	gradient := paint.Gradient
+	inverse := m.Multiply(gradient.Matrix).Invert()
+	for y := k.y0; y < k.y1; y++ {
+		for x := k.x0; x < k.x1; x++ {
+			v := k.at(x, y)
+			if v <= 0 {
+				continue
+			}
+			p := inverse.Apply(vector.Point{X: float64(x) + 0.5, Y: float64(y) + 0.5})
+			r, g, b, a := premultiply(gradient.At(offset(gradient, p)))
+			c.blend(x, y, r*v, g*v, b*v, a*v)
+		}
+	}
+}
+
+// offset is where a point is along a gradient, 0 at its start and 1 at
+// its end
+func offset(g *vector.Gradient, p vector.Point) float64 {
+	if !g.Radial {
+		dx, dy := g.X2-g.X1, g.Y2-g.Y1
+		length := dx*dx + dy*dy
+		if length == 0 {
+			return 1
+		}
+		return ((p.X-g.X1)*dx + (p.Y-g.Y1)*dy) / length
+	}
+
+	// the point is on the circle at t of those growing from the focal
+	// point, of radius 0, to the end circle
+	dx, dy := g.Cx-g.Fx, g.Cy-g.Fy
+	qx, qy := p.X-g.Fx, p.Y-g.Fy
+	a := dx*dx + dy*dy - g.R*g.R
+	b := qx*dx + qy*dy
+	cc := qx*qx + qy*qy
+	if math.Abs(a) < 1e-12 {
+		if b == 0 {
+			return 1
+		}
+		return cc / (2 * b)
+	}
+	discriminant := b*b - a*cc
+	if discriminant < 0 {
+		return 1
+	}
+	return max((b+math.Sqrt(discriminant))/a, (b-math.Sqrt(discriminant))/a)
+}
+
+// image draws a raster image, or the drawing of an SVG image. Images that
+// can't be decoded are left out.
+func (c *canvas) image(img *vector.Image, base vector.Matrix, outer *mask) {
+	clip := intersect(c.clip(img.Clip, base), outer)
+	if clip != nil && clip.empty() {
+		return
+	}
+	m := base.Multiply(img.Matrix)
+
+	if img.Drawing != nil {
+		if clip == nil {
+			clip = c.all()
+		}
+		c.drawing(img.Drawing, m, clip)
+		return
+	}
+	if img.Width <= 0 || img.Height <= 0 {
+		return
+	}
+	decoded, err := img.Decode()
+	if err != nil {
+		return
+	}
+	bounds := decoded.Bounds()
+	if bounds.Empty() {
+		return
+	}
+	pixels := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			pixels.SetNRGBA(x, y, color.NRGBAModel.Convert(decoded.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.NRGBA))
+		}
+	}
+
+	rect := polygon{m.Apply(vector.Point{}), m.Apply(vector.Point{X: img.Width}), m.Apply(vector.Point{X: img.Width, Y: img.Height}), m.Apply(vector.Point{Y: img.Height})}
+	k := intersect(fill([]polygon{rect}, false, c.width, c.height), clip)
+	if k.empty() {
+		return
+	}
+
+	// pixels of the image per unit, and samples per pixel when it is
+	// drawn smaller than it is
+	sx, sy := float64(bounds.Dx())/img.Width, float64(bounds.Dy())/img.Height
+	n := int(math.Ceil(math.Max(sx, sy) / math.Max(m.Scale(), 1e-9)))
+	n = min(max(n, 1), 8)
+	inverse := m.Invert()
+	opacity := float32(math.Max(math.Min(img.Opacity, 1), 0))
+	for y := k.y0; y < k.y1; y++ {
+		for x := k.x0; x < k.x1; x++ {
+			v := k.at(x, y) * opacity
+			if v <= 0 {
+				continue
+			}
+			var r, g, b, a float32
+			for j := 0; j < n; j++ {
+				for i := 0; i < n; i++ {
+					p := inverse.Apply(vector.Point{X: float64(x) + (float64(i)+0.5)/float64(n), Y: float64(y) + (float64(j)+0.5)/float64(n)})
+					sr, sg, sb, sa := bilinear(pixels, p.X*sx, p.Y*sy)
+					r, g, b, a = r+sr, g+sg, b+sb, a+sa
+				}
+			}
+			v /= float32(n * n)
+			c.blend(x, y, r*v, g*v, b*v, a*v)
+		}
+	}
+}
+
+// bilinear is the premultiplied color of an image between its pixels,
+// whose centers are at half units
+func bilinear(img *image.NRGBA, x float64, y float64) (float32, float32, float32, float32) {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	x, y = x-0.5, y-0.5
+	x0, y0 := int(math.Floor(x)), int(math.Floor(y))
+	fx, fy := float32(x-float64(x0)), float32(y-float64(y0))
+	var r, g, b, a float32
+	for j := 0; j < 2; j++ {
+		for i := 0; i < 2; i++ {
+			weight := (1 - fx) * (1 - fy)
+			switch {
+			case i == 1 && j == 0:
+				weight = fx * (1 - fy)
+			case i == 0 && j == 1:
+				weight = (1 - fx) * fy
+			case i == 1 && j == 1:
+				weight = fx * fy
+			}
+			px, py := min(max(x0+i, 0), w-1), min(max(y0+j, 0), h-1)
+			pr, pg, pb, pa := premultiply(img.NRGBAAt(px, py))
+			r, g, b, a = r+pr*weight, g+pg*weight, b+pb*weight, a+pa*weight
+		}
+	}
+	return r, g, b, a
+}
+
+// all is a mask covering the whole canvas
+func (c *canvas) all() *mask {
+	k := &mask{x1: c.width, y1: c.height, values: make([]float32, c.width*c.height)}
+	for i := range k.values {
+		k.values[i] = 1
+	}
+	return k
+}
+
+// blend paints a premultiplied color over a pixel
+func (c *canvas) blend(x int, y int, r float32, g float32, b float32, a float32) {
+	i := 4 * (y*c.width + x)
+	rest := 1 - a
+	c.pixels[i] = r + c.pixels[i]*rest
+	c.pixels[i+1] = g + c.pixels[i+1]*rest
+	c.pixels[i+2] = b + c.pixels[i+2]*rest
+	c.pixels[i+3] = a + c.pixels[i+3]*rest
+}
+
+// result is the image drawn, its colors no longer premultiplied
+func (c *canvas) result() *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, c.width, c.height))
+	for i := 0; i < len(c.pixels); i += 4 {
+		a := c.pixels[i+3]
+		if a <= 0 {
+			continue
+		}
+		channel := func(v float32) uint8 {
+			return uint8(math.Round(float64(min(max(v/a, 0), 1)) * 255))
+		}
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2] = channel(c.pixels[i]), channel(c.pixels[i+1]), channel(c.pixels[i+2])
+		img.Pix[i+3] = uint8(math.Round(float64(min(a, 1)) * 255))
+	}
+	return img
+}
+
+func premultiply(c color.NRGBA) (float32, float32, float32, float32) {
+	a := float32(c.A) / 255
+	return float32(c.R) / 255 * a, float32(c.G) / 255 * a, float32(c.B) / 255 * a, a
+}
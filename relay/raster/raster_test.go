@@ -0,0 +1,120 @@
+package raster
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+
+	"nostr-relay/vector"
+
+	"golang.org/x/image/webp"
+)
+
+func rect(x float64, y float64, w float64, h float64) vector.Path {
+	return vector.Path{
+		{Op: 'M', Points: [3]vector.Point{{X: x, Y: y}}},
+		{Op: 'L', Points: [3]vector.Point{{X: x + w, Y: y}}},
+		{Op: 'L', Points: [3]vector.Point{{X: x + w, Y: y + h}}},
+		{Op: 'L', Points: [3]vector.Point{{X: x, Y: y + h}}},
+		{Op: 'Z'},
+	}
+}
+
+func TestRender(t *testing.T) {
+	red := vector.Paint{Color: color.NRGBA{255, 0, 0, 255}}
+	blue := vector.Paint{Color: color.NRGBA{0, 0, 255, 255}}
+	// a square with a hole, by the even-odd rule
+	holed := append(rect(0, 0, 10, 10), rect(2.5, 2.5, 5, 5)...)
+	d := &vector.Drawing{Width: 20, Height: 20, Items: []vector.Item{
+		&vector.Shape{Path: holed, Matrix: vector.Identity, Fill: red, EvenOdd: true},
+		&vector.Shape{Path: rect(10, 10, 5, 5), Matrix: vector.Translate(2.5, 0), Fill: vector.Paint{Color: color.NRGBA{0, 0, 255, 128}},
+			Clip: &vector.Clip{Shapes: []vector.ClipShape{{Path: rect(0, 0, 15, 20), Matrix: vector.Identity}}}},
+		&vector.Shape{Path: vector.Path{{Op: 'M', Points: [3]vector.Point{{X: 2.5, Y: 17.5}}}, {Op: 'L', Points: [3]vector.Point{{X: 7.5, Y: 17.5}}}},
+			Matrix: vector.Identity, Stroke: blue, StrokeWidth: 1, LineCap: "square"},
+		&vector.Shape{Path: rect(16.25, 1, 2, 2), Matrix: vector.Identity, Fill: red},
+	}}
+	img := Render(d, 40, 40)
+
+	for _, c := range []struct {
+		x, y int
+		want color.NRGBA
+	}{
+		{1, 1, color.NRGBA{255, 0, 0, 255}},
+		{10, 10, color.NRGBA{}},
+		{25, 22, color.NRGBA{0, 0, 255, 128}},
+		// clipped away
+		{35, 22, color.NRGBA{}},
+		// the square cap lengthens the line by half its width
+		{4, 35, color.NRGBA{0, 0, 255, 255}},
+		{3, 35, color.NRGBA{0, 0, 255, 0}},
+		{4, 37, color.NRGBA{}},
+	} {
+		if got := img.NRGBAAt(c.x, c.y); got != c.want && !(got.A == 0 && c.want.A == 0) {
+			t.Errorf("%d,%d: %v, want %v", c.x, c.y, got, c.want)
+		}
+	}
+	// edges are antialiased
+	if edge := img.NRGBAAt(32, 3); edge.A != 128 {
+		t.Errorf("edge: %v", edge)
+	}
+
+	if w, h := Fit(480, 360, 128); w != 128 || h != 96 {
+		t.Errorf("fit: %dx%d", w, h)
+	}
+}
+
+func TestRenderGradient(t *testing.T) {
+	d := &vector.Drawing{Width: 100, Height: 10, Items: []vector.Item{
+		&vector.Shape{Path: rect(0, 0, 100, 10), Matrix: vector.Identity, Fill: vector.Paint{Gradient: &vector.Gradient{
+			X2: 100, Matrix: vector.Identity,
+			Stops: []vector.Stop{{Color: color.NRGBA{0, 0, 0, 255}}, {Offset: 1, Color: color.NRGBA{255, 255, 255, 255}}},
+		}}},
+	}}
+	img := Render(d, 100, 10)
+	if left, right := img.NRGBAAt(10, 5), img.NRGBAAt(90, 5); left.R > 40 || right.R < 215 {
+		t.Errorf("gradient: %v %v", left, right)
+	}
+}
+
+func TestEncodeWebP(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	for _, size := range []image.Point{{1, 1}, {3, 2}, {64, 48}, {300, 7}} {
+		img := image.NewNRGBA(image.Rect(0, 0, size.X, size.Y))
+		for y := 0; y < size.Y; y++ {
+			for x := 0; x < size.X; x++ {
+				switch {
+				case y%5 == 0:
+					// runs of the pixel to the left
+					img.SetNRGBA(x, y, color.NRGBA{10, 20, 30, 255})
+				case y%5 == 1 && y > 0:
+					// copies of the row above
+					img.SetNRGBA(x, y, img.NRGBAAt(x, y-1))
+				default:
+					img.SetNRGBA(x, y, color.NRGBA{uint8(random.Intn(256)), uint8(x), uint8(random.Intn(4)), uint8(128 + random.Intn(128))})
+				}
+			}
+		}
+
+		var out bytes.Buffer
+		if err := Encode(&out, img, "webp"); err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := webp.Decode(&out)
+		if err != nil {
+			t.Fatalf("%v: %v", size, err)
+		}
+		for y := 0; y < size.Y; y++ {
+			for x := 0; x < size.X; x++ {
+				if got, want := color.NRGBAModel.Convert(decoded.At(x, y)), img.NRGBAAt(x, y); got != want {
+					t.Fatalf("%v: %d,%d is %v, want %v", size, x, y, got, want)
+				}
+			}
+		}
+	}
+
+	if err := Encode(&bytes.Buffer{}, image.NewNRGBA(image.Rect(0, 0, 1, 1)), "bmp"); err == nil {
+		t.Errorf("unknown format")
+	}
+}
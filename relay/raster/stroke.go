@@ -0,0 +1,163 @@
+package raster
+
+import (
+	"math"
+
+	"nostr-relay/vector"
+)
+
+// stroker outlines the polylines of a shape as polygons, in the
+// coordinates of the shape, scale being how many pixels a unit of them is
+type stroker struct {
+	width      float64
+	cap        string
+	join       string
+	miterLimit float64
+	scale      float64
+
+	polygons []polygon
+}
+
+func newStroker(s *vector.Shape, scale float64) *stroker {
+	limit := s.MiterLimit
+	if limit < 1 {
+		limit = 4
+	}
+	return &stroker{width: s.StrokeWidth, cap: s.LineCap, join: s.LineJoin, miterLimit: limit, scale: scale}
+}
+
+// stroke outlines a polyline with a polygon per segment, join and cap.
+// They all turn the same way, so they add up under the nonzero rule.
+func (s *stroker) stroke(line polyline) {
+	points := make([]vector.Point, 0, len(line.points))
+	for _, p := range line.points {
+		if len(points) == 0 || p != points[len(points)-1] {
+			points = append(points, p)
+		}
+	}
+	if line.closed && len(points) > 1 && points[0] == points[len(points)-1] {
+		points = points[:len(points)-1]
+	}
+	hw := s.width / 2
+
+	if len(points) == 1 {
+		// a subpath of no length only shows its caps
+		p := points[0]
+		switch s.cap {
+		case "round":
+			s.add(s.circle(p, hw))
+		case "square":
+			s.add(polygon{{X: p.X - hw, Y: p.Y - hw}, {X: p.X + hw, Y: p.Y - hw}, {X: p.X + hw, Y: p.Y + hw}, {X: p.X - hw, Y: p.Y + hw}})
+		}
+		return
+	}
+
+	n := len(points) - 1
+	if line.closed && len(points) > 2 {
+		n = len(points)
+	}
+	for i := 0; i < n; i++ {
+		a, b := points[i], points[(i+1)%len(points)]
+		d := unit(a, b)
+		normal := vector.Point{X: -d.Y * hw, Y: d.X * hw}
+		if !line.closed || len(points) == 2 {
+			// square caps lengthen the first and last segments
+			if i == 0 && s.cap == "square" {
+				a = vector.Point{X: a.X - d.X*hw, Y: a.Y - d.Y*hw}
+			}
+			if i == n-1 && s.cap == "square" {
+				b = vector.Point{X: b.X + d.X*hw, Y: b.Y + d.Y*hw}
+			}
+		}
+		s.add(polygon{
+			{X: a.X + normal.X, Y: a.Y + normal.Y}, {X: b.X + normal.X, Y: b.Y + normal.Y},
+			{X: b.X - normal.X, Y: b.Y - normal.Y}, {X: a.X - normal.X, Y: a.Y - normal.Y},
+		})
+	}
+
+	for i := 0; i < len(points); i++ {
+		if !line.closed || len(points) == 2 {
+			if i == 0 || i == len(points)-1 {
+				if s.cap == "round" {
+					s.add(s.circle(points[i], hw))
+				}
+				continue
+			}
+		}
+		previous, next := points[(i+len(points)-1)%len(points)], points[(i+1)%len(points)]
+		s.joint(previous, points[i], next, hw)
+	}
+}
+
+// joint fills the gap on the outer side of the turn at p
+func (s *stroker) joint(previous vector.Point, p vector.Point, next vector.Point, hw float64) {
+	d1, d2 := unit(previous, p), unit(p, next)
+	cross := d1.X*d2.Y - d1.Y*d2.X
+	if math.Abs(cross) < 1e-9 && d1.X*d2.X+d1.Y*d2.Y > 0 {
+		return
+	}
+	if s.join == "round" {
+		s.add(s.circle(p, hw))
+		return
+	}
+
+	side := 1.0
+	if cross > 0 {
+		side = -1
+	}
+	n1 := vector.Point{X: -d1.Y * side, Y: d1.X * side}
+	n2 := vector.Point{X: -d2.Y * side, Y: d2.X * side}
+	a := vector.Point{X: p.X + n1.X*hw, Y: p.Y + n1.Y*hw}
+	b := vector.Point{X: p.X + n2.X*hw, Y: p.Y + n2.Y*hw}
+
+	cos := n1.X*n2.X + n1.Y*n2.Y
+	if s.join == "bevel" || cos <= -1+1e-9 || math.Sqrt(2/(1+cos)) > s.miterLimit {
+		s.add(polygon{p, a, b})
+		return
+	}
+	// the tip is where the outer edges meet, along the bisector
+	length := hw * 2 / (1 + cos)
+	tip := vector.Point{X: p.X + (n1.X+n2.X)*length/2, Y: p.Y + (n1.Y+n2.Y)*length/2}
+	s.add(polygon{p, a, tip, b})
+}
+
+// circle is a polygon close enough to a circle of radius r at its size in
+// pixels
+func (s *stroker) circle(c vector.Point, r float64) polygon {
+	pixels := r * s.scale
+	n := 8
+	if pixels > tolerance {
+		n = int(math.Ceil(math.Pi / math.Acos(1-tolerance/pixels)))
+	}
+	n = min(max(n, 8), 360)
+	out := make(polygon, n)
+	for i := range out {
+		angle := 2 * math.Pi * float64(i) / float64(n)
+		out[i] = vector.Point{X: c.X + r*math.Cos(angle), Y: c.Y + r*math.Sin(angle)}
+	}
+	return out
+}
+
+// add keeps a polygon, turned counterclockwise
+func (s *stroker) add(p polygon) {
+	area := 0.0
+	for i := range p {
+		a, b := p[i], p[(i+1)%len(p)]
+		area += a.X*b.Y - b.X*a.Y
+	}
+	if area < 0 {
+		for i, j := 0, len(p)-1; i < j; i, j = i+1, j-1 {
+			p[i], p[j] = p[j], p[i]
+		}
+	}
+	s.polygons = append(s.polygons, p)
+}
+
+// unit is the direction from a to b
+func unit(a vector.Point, b vector.Point) vector.Point {
+	l := math.Hypot(b.X-a.X, b.Y-a.Y)
+	if l == 0 {
+		return vector.Point{X: 1}
+	}
+	return vector.Point{X: (b.X - a.X) / l, Y: (b.Y - a.Y) / l}
+}
@@ -0,0 +1,406 @@
+package raster
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math/bits"
+)
+
+// maxWebPSide is the largest width or height of a WebP image
+const maxWebPSide = 1 << 14
+
+// encodeWebP writes an image as a lossless WebP file. It is kept simple,
+// with no transforms or color cache: pixels are coded as literals or as
+// copies of the pixels to their left or above, which the flat colors of
+// comics are mostly made of.
+func encodeWebP(w io.Writer, img image.Image) error {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= 0 || height <= 0 || width > maxWebPSide || height > maxWebPSide {
+		return fmt.Errorf("can't encode a %dx%d image as WebP", width, height)
+	}
+	pixels := make([]color.NRGBA, 0, width*height)
+	alpha := false
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if c.A == 0 {
+				c = color.NRGBA{}
+			}
+			pixels = append(pixels, c)
+			alpha = alpha || c.A < 255
+		}
+	}
+
+	tokens := lz77(pixels, width)
+	var counts [5][]int
+	for i, size := range []int{256 + 24, 256, 256, 256, 40} {
+		counts[i] = make([]int, size)
+	}
+	for _, t := range tokens {
+		if t.length == 0 {
+			counts[0][t.color.G]++
+			counts[1][t.color.R]++
+			counts[2][t.color.B]++
+			counts[3][t.color.A]++
+			continue
+		}
+		length, _, _ := prefix(t.length)
+		distance, _, _ := prefix(t.distance)
+		counts[0][256+length]++
+		counts[4][distance]++
+	}
+
+	b := &bitWriter{}
+	b.write(0x2f, 8)
+	b.write(uint64(width-1), 14)
+	b.write(uint64(height-1), 14)
+	if alpha {
+		b.write(1, 1)
+	} else {
+		b.write(0, 1)
+	}
+	b.write(0, 3)
+	// no transforms, no color cache, one group of prefix codes
+	b.write(0, 1)
+	b.write(0, 1)
+	b.write(0, 1)
+
+	var codes [5]prefixCode
+	for i := range codes {
+		codes[i] = b.prefixCode(counts[i])
+	}
+	for _, t := range tokens {
+		if t.length == 0 {
+			codes[0].write(b, int(t.color.G))
+			codes[1].write(b, int(t.color.R))
+			codes[2].write(b, int(t.color.B))
+			codes[3].write(b, int(t.color.A))
+			continue
+		}
+		symbol, n, extra := prefix(t.length)
+		codes[0].write(b, 256+symbol)
+		b.write(uint64(extra), n)
+		symbol, n, extra = prefix(t.distance)
+		codes[4].write(b, symbol)
+		b.write(uint64(extra), n)
+	}
+	data := b.bytes()
+
+	var out bytes.Buffer
+	padded := len(data) + len(data)%2
+	out.WriteString("RIFF")
+	binary.Write(&out, binary.LittleEndian, uint32(4+8+padded))
+	out.WriteString("WEBPVP8L")
+	binary.Write(&out, binary.LittleEndian, uint32(len(data)))
+	out.Write(data)
+	if len(data)%2 == 1 {
+		out.WriteByte(0)
+	}
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+// token is a pixel, or a copy of length pixels from distance codes back.
+// Distance code 1 is the pixel above, 2 the one to the left.
+type token struct {
+	color    color.NRGBA
+	length   int
+	distance int
+}
+
+// lz77 codes runs of the pixel to the left or of the row above as copies
+func lz77(pixels []color.NRGBA, width int) []token {
+	const minLength, maxLength = 3, 4096
+	tokens := make([]token, 0, len(pixels)/4)
+	for i := 0; i < len(pixels); {
+		left, above := 0, 0
+		if i > 0 {
+			for left < maxLength && i+left < len(pixels) && pixels[i+left] == pixels[i-1] {
+				left++
+			}
+		}
+		if i >= width {
+			for above < maxLength && i+above < len(pixels) && pixels[i+above] == pixels[i+above-width] {
+				above++
+			}
+		}
+		switch {
+		case above >= minLength && above >= left:
+			tokens = append(tokens, token{length: above, distance: 1})
+			i += above
+		case left >= minLength:
+			tokens = append(tokens, token{length: left, distance: 2})
+			i += left
+		default:
+			tokens = append(tokens, token{color: pixels[i]})
+			i++
+		}
+	}
+	return tokens
+}
+
+// prefix is the prefix symbol of a length or distance code, with the
+// number and value of its extra bits
+func prefix(v int) (int, int, int) {
+	if v <= 4 {
+		return v - 1, 0, 0
+	}
+	v--
+	high := bits.Len(uint(v)) - 1
+	second := (v >> (high - 1)) & 1
+	n := high - 1
+	return 2*high + second, n, v & (1<<n - 1)
+}
+
+type bitWriter struct {
+	out   []byte
+	bits  uint64
+	count int
+}
+
+// write adds the n low bits of v, least significant first
+func (b *bitWriter) write(v uint64, n int) {
+	b.bits |= v << b.count
+	b.count += n
+	for b.count >= 8 {
+		b.out = append(b.out, byte(b.bits))
+		b.bits >>= 8
+		b.count -= 8
+	}
+}
+
+func (b *bitWriter) bytes() []byte {
+	if b.count > 0 {
+		b.out = append(b.out, byte(b.bits))
+		b.bits, b.count = 0, 0
+	}
+	return b.out
+}
+
+// prefixCode is the bits written for each symbol, reversed since they are
+// read from the most significant one
+type prefixCode struct {
+	codes   []uint16
+	lengths []uint8
+}
+
+func (c prefixCode) write(b *bitWriter, symbol int) {
+	b.write(uint64(c.codes[symbol]), int(c.lengths[symbol]))
+}
+
+// codeLengthOrder is the order code lengths of the code of code lengths
+// are written in
+var codeLengthOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// prefixCode writes the prefix code of symbols counted so, returning it
+func (b *bitWriter) prefixCode(counts []int) prefixCode {
+	used := make([]int, 0, 2)
+	for s, n := range counts {
+		if n > 0 {
+			used = append(used, s)
+		}
+	}
+
+	// one or two symbols of 8 bits have a simple code, one of them taking
+	// no bits at all
+	if len(used) <= 2 && (len(used) == 0 || used[len(used)-1] < 256) {
+		code := prefixCode{codes: make([]uint16, len(counts)), lengths: make([]uint8, len(counts))}
+		b.write(1, 1)
+		if len(used) == 0 {
+			used = append(used, 0)
+		}
+		b.write(uint64(len(used)-1), 1)
+		if used[0] < 2 {
+			b.write(0, 1)
+			b.write(uint64(used[0]), 1)
+		} else {
+			b.write(1, 1)
+			b.write(uint64(used[0]), 8)
+		}
+		if len(used) == 2 {
+			b.write(uint64(used[1]), 8)
+			code.codes[used[1]], code.lengths[used[0]], code.lengths[used[1]] = 1, 1, 1
+		}
+		return code
+	}
+
+	lengths := codeLengths(counts, 15)
+	code := canonical(lengths)
+
+	// the lengths are written with runs of zeros and repeats
+	type item struct{ symbol, extra, bits int }
+	items := make([]item, 0)
+	for i := 0; i < len(lengths); {
+		v := lengths[i]
+		run := 1
+		for i+run < len(lengths) && lengths[i+run] == v {
+			run++
+		}
+		i += run
+		if v == 0 {
+			for run >= 11 {
+				n := min(run, 138)
+				items = append(items, item{18, n - 11, 7})
+				run -= n
+			}
+			if run >= 3 {
+				items = append(items, item{17, run - 3, 3})
+				run = 0
+			}
+		} else {
+			items = append(items, item{int(v), 0, 0})
+			run--
+			for run >= 3 {
+				n := min(run, 6)
+				items = append(items, item{16, n - 3, 2})
+				run -= n
+			}
+		}
+		for ; run > 0; run-- {
+			items = append(items, item{int(v), 0, 0})
+		}
+	}
+
+	lengthCounts := make([]int, 19)
+	for _, it := range items {
+		lengthCounts[it.symbol]++
+	}
+	lengthLengths := codeLengths(lengthCounts, 7)
+	lengthCode := canonical(lengthLengths)
+	n := len(codeLengthOrder)
+	for n > 4 && lengthLengths[codeLengthOrder[n-1]] == 0 {
+		n--
+	}
+
+	b.write(0, 1)
+	b.write(uint64(n-4), 4)
+	for _, s := range codeLengthOrder[:n] {
+		b.write(uint64(lengthLengths[s]), 3)
+	}
+	// all symbols have a length
+	b.write(0, 1)
+	for _, it := range items {
+		lengthCode.write(b, it.symbol)
+		b.write(uint64(it.extra), it.bits)
+	}
+	return code
+}
+
+// codeLengths are the lengths of a Huffman code for symbols counted so, no
+// longer than limit. At least two symbols have one, so that no code is
+// empty.
+func codeLengths(counts []int, limit int) []uint8 {
+	counts = append([]int(nil), counts...)
+	used := 0
+	for _, n := range counts {
+		if n > 0 {
+			used++
+		}
+	}
+	for s := 0; used < 2 && s < len(counts); s++ {
+		if counts[s] == 0 {
+			counts[s] = 1
+			used++
+		}
+	}
+
+	for {
+		lengths := huffman(counts)
+		longest := uint8(0)
+		for _, l := range lengths {
+			longest = max(longest, l)
+		}
+		if int(longest) <= limit {
+			return lengths
+		}
+		// flatter counts make shorter codes
+		for s, n := range counts {
+			if n > 0 {
+				counts[s] = (n + 1) / 2
+			}
+		}
+	}
+}
+
+type node struct {
+	count  int
+	symbol int
+	left   *node
+	right  *node
+}
+
+type nodes []*node
+
+func (h nodes) Len() int { return len(h) }
+func (h nodes) Less(i int, j int) bool {
+	if h[i].count != h[j].count {
+		return h[i].count < h[j].count
+	}
+	return h[i].symbol < h[j].symbol
+}
+func (h nodes) Swap(i int, j int) { h[i], h[j] = h[j], h[i] }
+func (h *nodes) Push(x any)       { *h = append(*h, x.(*node)) }
+func (h *nodes) Pop() any {
+	old := *h
+	n := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return n
+}
+
+// huffman is the length of the Huffman code of each symbol
+func huffman(counts []int) []uint8 {
+	h := &nodes{}
+	for s, n := range counts {
+		if n > 0 {
+			*h = append(*h, &node{count: n, symbol: s})
+		}
+	}
+	heap.Init(h)
+	for h.Len() > 1 {
+		a, b := heap.Pop(h).(*node), heap.Pop(h).(*node)
+		heap.Push(h, &node{count: a.count + b.count, symbol: min(a.symbol, b.symbol), left: a, right: b})
+	}
+
+	lengths := make([]uint8, len(counts))
+	var walk func(n *node, depth uint8)
+	walk = func(n *node, depth uint8) {
+		if n.left == nil {
+			lengths[n.symbol] = depth
+			return
+		}
+		walk(n.left, depth+1)
+		walk(n.right, depth+1)
+	}
+	walk(heap.Pop(h).(*node), 0)
+	return lengths
+}
+
+// canonical is the canonical code of the lengths given
+func canonical(lengths []uint8) prefixCode {
+	var count [16]int
+	for _, l := range lengths {
+		count[l]++
+	}
+	count[0] = 0
+	var next [16]int
+	code := 0
+	for l := 1; l < 16; l++ {
+		code = (code + count[l-1]) << 1
+		next[l] = code
+	}
+
+	c := prefixCode{codes: make([]uint16, len(lengths)), lengths: lengths}
+	for s, l := range lengths {
+		if l > 0 {
+			c.codes[s] = uint16(bits.Reverse16(uint16(next[l])) >> (16 - l))
+			next[l]++
+		}
+	}
+	return c
+}
@@ -0,0 +1,38 @@
+package reconcile
+
+import (
+	"context"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/eventstore/sqlite3"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Query wraps the QueryEvents hook next so negentropy sessions see every
+// event matching their filter, up to maxItems, instead of the page of them
+// a REQ gets: a peer missing what's past the page would fetch it again and
+// again. Other filters are passed to next.
+func Query(
+	db *sqlite3.SQLite3Backend,
+	maxItems int,
+	next func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error),
+) func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	// the same database, with a limit fit for sessions
+	sessions := &sqlite3.SQLite3Backend{
+		DB:                db.DB,
+		DatabaseURL:       db.DatabaseURL,
+		QueryLimit:        maxItems,
+		QueryIDsLimit:     db.QueryIDsLimit,
+		QueryAuthorsLimit: db.QueryAuthorsLimit,
+		QueryKindsLimit:   db.QueryKindsLimit,
+		QueryTagsLimit:    db.QueryTagsLimit,
+	}
+
+	return func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		if !eventstore.IsNegentropySession(ctx) {
+			return next(ctx, filter)
+		}
+
+		return sessions.QueryEvents(ctx, filter)
+	}
+}
@@ -0,0 +1,172 @@
+package reconcile
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"nostr-relay/ingest"
+	"nostr-relay/kinds"
+
+	"github.com/fiatjaf/eventstore/sqlite3"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// instance is an in-process relay set up like the real one, as far as
+// syncing goes
+type instance struct {
+	url   string
+	db    *sqlite3.SQLite3Backend
+	relay *khatru.Relay
+	query QueryFunc
+}
+
+func newInstance(t *testing.T, name string) *instance {
+	db := &sqlite3.SQLite3Backend{DatabaseURL: filepath.Join(t.TempDir(), name+".sqlite")}
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+
+	i := &instance{db: db, relay: khatru.NewRelay()}
+	i.query = Query(db, 10000, db.QueryEvents)
+	i.relay.Negentropy = true
+	i.relay.RejectEvent = append(i.relay.RejectEvent, kinds.Validators(db)...)
+	i.relay.StoreEvent = append(i.relay.StoreEvent, db.SaveEvent)
+	i.relay.QueryEvents = append(i.relay.QueryEvents, i.query)
+
+	server := httptest.NewServer(i.relay)
+	t.Cleanup(server.Close)
+	i.url = "ws" + strings.TrimPrefix(server.URL, "http")
+
+	return i
+}
+
+func (i *instance) syncer(peer *instance, direction Direction) *Syncer {
+	return New(i.query, func(ctx context.Context, event *nostr.Event) error {
+		return ingest.Accept(ctx, i.relay, event)
+	}, Options{Peers: []string{peer.url}, Direction: direction, Timeout: 10 * time.Second, BatchSize: 40})
+}
+
+func (i *instance) count(t *testing.T) int {
+	var count int
+	if err := i.db.Get(&count, "SELECT COUNT(*) FROM event"); err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func (i *instance) has(t *testing.T, id string) bool {
+	var count int
+	if err := i.db.Get(&count, "SELECT COUNT(*) FROM event WHERE id = ?", id); err != nil {
+		t.Fatal(err)
+	}
+	return count > 0
+}
+
+func TestSync(t *testing.T) {
+	ctx := context.Background()
+
+	a := newInstance(t, "a")
+	b := newInstance(t, "b")
+
+	privateKey := nostr.GeneratePrivateKey()
+	now := nostr.Now()
+	save := func(i *instance, event nostr.Event, age int) nostr.Event {
+		event.CreatedAt = now - nostr.Timestamp(age)
+		if err := event.Sign(privateKey); err != nil {
+			t.Fatal(err)
+		}
+		if err := i.db.SaveEvent(ctx, &event); err != nil {
+			t.Fatal(err)
+		}
+		return event
+	}
+
+	content, _ := json.Marshal(map[string]any{"name": "Sync"})
+	channel := save(a, nostr.Event{Kind: 40, Content: string(content)}, 1000)
+	save(b, channel, 1000)
+	root := nostr.Tags{{"e", channel.ID, "", "root"}}
+
+	// more than a REQ gets, sessions must see them all
+	for n := range 150 {
+		save(a, nostr.Event{Kind: 42, Content: fmt.Sprintf("from a %d", n), Tags: root}, 500-n)
+	}
+	update := save(b, nostr.Event{Kind: 41, Content: string(content), Tags: root}, 900)
+	for n := range 2 {
+		save(b, nostr.Event{Kind: 7353, Content: fmt.Sprintf("from b %d", n), Tags: root}, 100+n)
+	}
+	// stored behind the back of the validators, which refuse it
+	invalid := save(a, nostr.Event{Kind: 40, Content: "not a channel"}, 50)
+
+	result, err := b.syncer(a, Both).Sync(ctx, a.url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Have != 3 || result.HaveNot != 151 || result.Received != 150 || result.Sent != 3 || result.Rejected != 1 {
+		t.Errorf("first sync: %+v", result)
+	}
+	if a.count(t) != 155 || b.count(t) != 154 {
+		t.Errorf("a has %d events, b %d", a.count(t), b.count(t))
+	}
+	if !a.has(t, update.ID) || b.has(t, invalid.ID) {
+		t.Error("the update should be sent and the invalid channel refused")
+	}
+
+	t.Run("nothing left to transfer", func(t *testing.T) {
+		result, err := b.syncer(a, Both).Sync(ctx, a.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Have != 0 || result.HaveNot != 1 || result.Received != 0 || result.Sent != 0 {
+			t.Errorf("second sync: %+v", result)
+		}
+	})
+
+	t.Run("down only", func(t *testing.T) {
+		c := newInstance(t, "c")
+		mine := save(c, nostr.Event{Kind: 1, Content: "not synced"}, 10)
+		local := save(c, nostr.Event{Kind: 42, Content: "from c", Tags: root}, 10)
+
+		s := c.syncer(a, Down)
+		// the channel may come in a later batch than its update, which is
+		// then accepted on the next sync
+		for range 2 {
+			if _, err := s.Sync(ctx, a.url); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if c.count(t) != 156 || !c.has(t, update.ID) {
+			t.Errorf("c has %d events", c.count(t))
+		}
+		if a.has(t, local.ID) || a.has(t, mine.ID) {
+			t.Error("nothing is sent down only")
+		}
+
+		status := s.Status()
+		if len(status) != 1 || !status[0].Healthy || status[0].Total.Received != 154 {
+			t.Errorf("status: %+v", status)
+		}
+	})
+
+	t.Run("unreachable peer", func(t *testing.T) {
+		server := httptest.NewServer(nil)
+		server.Close()
+		gone := &instance{url: "ws" + strings.TrimPrefix(server.URL, "http")}
+
+		s := b.syncer(gone, Both)
+		if _, err := s.Sync(ctx, gone.url); err == nil {
+			t.Fatal("syncing with a relay that is gone should fail")
+		}
+		if status := s.Status(); status[0].Healthy || status[0].LastError == "" {
+			t.Errorf("status: %+v", status)
+		}
+	})
+}
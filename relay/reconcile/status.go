@@ -0,0 +1,58 @@
+package reconcile
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// PeerStatus is how syncing with a peer went, the last sync and since start.
+// A peer is healthy until a sync with it fails.
+type PeerStatus struct {
+	URL       string          `json:"url"`
+	Healthy   bool            `json:"healthy"`
+	LastSync  nostr.Timestamp `json:"last_sync_at,omitempty"`
+	LastError string          `json:"last_error,omitempty"`
+	Last      Result          `json:"last"`
+	Total     Result          `json:"total"`
+}
+
+func (s *Syncer) record(peer string, result Result, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status, ok := s.status[peer]
+	if !ok {
+		status = &PeerStatus{URL: peer, Healthy: true}
+		s.status[peer] = status
+	}
+
+	status.LastSync = nostr.Now()
+	status.Healthy = err == nil
+	status.LastError = ""
+	if err != nil {
+		status.LastError = err.Error()
+	}
+	status.Last = result
+	status.Total.add(result)
+}
+
+// Status returns how every peer is doing, in the order they're configured
+func (s *Syncer) Status() []PeerStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	peers := make([]PeerStatus, 0, len(s.status))
+	for _, peer := range s.options.Peers {
+		peers = append(peers, *s.status[peer])
+	}
+	return peers
+}
+
+// HandleStatus serves the Status as JSON, it's meant to be behind the admin
+// authentication of the dashboard
+func (s *Syncer) HandleStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"peers": s.Status()})
+}
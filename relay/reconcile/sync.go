@@ -0,0 +1,422 @@
+package reconcile
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"nostr-relay/ingest"
+	"nostr-relay/kinds"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip77"
+	"github.com/nbd-wtf/go-nostr/nip77/negentropy"
+	"github.com/nbd-wtf/go-nostr/nip77/negentropy/storage/vector"
+)
+
+// Direction tells which side of a reconciliation gets the missing events
+type Direction string
+
+const (
+	// Down fetches what peers have and we don't
+	Down Direction = "down"
+	// Up publishes what we have and peers don't
+	Up Direction = "up"
+	// Both does both
+	Both Direction = "both"
+)
+
+// frameSizeLimit keeps negentropy messages well under the 512kB khatru
+// accepts by default
+const frameSizeLimit = 256 * 1024
+
+// QueryFunc is a QueryEvents hook
+type QueryFunc func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error)
+
+// Accept runs an event fetched from a peer through the hooks of this relay,
+// see ingest.Accept
+type Accept func(ctx context.Context, event *nostr.Event) error
+
+// Options tune the sync, zero values use the defaults
+type Options struct {
+	// Peers are the relays kept in sync with this one
+	Peers []string
+
+	// Filters are reconciled one after the other with every peer
+	Filters []nostr.Filter
+
+	Direction Direction
+
+	// Timeout bounds a reconciliation, transfers included
+	Timeout time.Duration
+
+	// BatchSize is how many events are fetched from a peer at once
+	BatchSize int
+}
+
+func (o Options) withDefaults() Options {
+	if len(o.Filters) == 0 {
+		o.Filters = []nostr.Filter{{Kinds: []int{40, 41, 42, 7353}}}
+	}
+	if o.Direction == "" {
+		o.Direction = Both
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = 5 * time.Minute
+	}
+	if o.BatchSize <= 0 {
+		o.BatchSize = 100
+	}
+	return o
+}
+
+// Result is what a reconciliation found and transferred
+type Result struct {
+	// Have is how many events the peer was missing, HaveNot how many we were
+	Have    int `json:"have"`
+	HaveNot int `json:"have_not"`
+
+	Sent     int `json:"sent"`
+	Received int `json:"received"`
+
+	// Rejected counts events refused by either side
+	Rejected int `json:"rejected"`
+}
+
+func (r *Result) add(other Result) {
+	r.Have += other.Have
+	r.HaveNot += other.HaveNot
+	r.Sent += other.Sent
+	r.Received += other.Received
+	r.Rejected += other.Rejected
+}
+
+// Syncer reconciles the events of this relay with its peers using NIP-77,
+// so only the events one side is missing are transferred
+type Syncer struct {
+	query   QueryFunc
+	accept  Accept
+	options Options
+
+	mu     sync.Mutex
+	status map[string]*PeerStatus
+}
+
+// New returns a Syncer computing the sets to reconcile with query, which
+// must be what the relay answers negentropy sessions with, and storing what
+// peers send with accept
+func New(query QueryFunc, accept Accept, options Options) *Syncer {
+	options = options.withDefaults()
+
+	s := &Syncer{query: query, accept: accept, options: options, status: make(map[string]*PeerStatus)}
+	for _, peer := range options.Peers {
+		s.status[peer] = &PeerStatus{URL: peer, Healthy: true}
+	}
+
+	return s
+}
+
+// Run syncs with every peer every interval until ctx is done
+func (s *Syncer) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		var wg sync.WaitGroup
+		for _, peer := range s.options.Peers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := s.Sync(ctx, peer); err != nil && ctx.Err() == nil {
+					log.Printf("Sync with %s failed: %v", peer, err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sync reconciles every filter with peer on a single connection
+func (s *Syncer) Sync(ctx context.Context, peer string) (Result, error) {
+	var total Result
+
+	ctx, cancel := context.WithTimeout(ctx, s.options.Timeout)
+	defer cancel()
+
+	// negentropy messages come as unknown envelopes, routed to the session
+	// they belong to
+	sessions := make(map[string]func(data string))
+	var sessionsMu sync.Mutex
+	relay, err := nostr.RelayConnect(ctx, peer, nostr.WithCustomHandler(func(data string) {
+		envelope := nip77.ParseNegMessage(data)
+		if envelope == nil {
+			return
+		}
+
+		var id string
+		switch env := envelope.(type) {
+		case *nip77.MessageEnvelope:
+			id = env.SubscriptionID
+		case *nip77.ErrorEnvelope:
+			id = env.SubscriptionID
+		default:
+			return
+		}
+
+		sessionsMu.Lock()
+		handle := sessions[id]
+		sessionsMu.Unlock()
+		if handle != nil {
+			handle(data)
+		}
+	}))
+	if err != nil {
+		s.record(peer, total, err)
+		return total, err
+	}
+	defer relay.Close()
+
+	for i, filter := range s.options.Filters {
+		id := fmt.Sprintf("sync-%d", i)
+		result, err := s.reconcile(ctx, relay, id, filter, func(handle func(data string)) {
+			sessionsMu.Lock()
+			defer sessionsMu.Unlock()
+			if handle == nil {
+				delete(sessions, id)
+			} else {
+				sessions[id] = handle
+			}
+		})
+		total.add(result)
+		if err != nil {
+			err = fmt.Errorf("filter %d: %w", i, err)
+			s.record(peer, total, err)
+			return total, err
+		}
+	}
+
+	s.record(peer, total, nil)
+	return total, nil
+}
+
+// reconcile runs a negentropy session for filter, then transfers what's
+// missing on either side
+func (s *Syncer) reconcile(
+	ctx context.Context,
+	relay *nostr.Relay,
+	id string,
+	filter nostr.Filter,
+	register func(handle func(data string)),
+) (Result, error) {
+	var result Result
+
+	have, haveNot, err := s.diff(ctx, relay, id, filter, register)
+	if err != nil {
+		return result, err
+	}
+	result.Have = len(have)
+	result.HaveNot = len(haveNot)
+
+	if s.options.Direction != Up {
+		if err := s.receive(ctx, relay, haveNot, &result); err != nil {
+			return result, err
+		}
+	}
+	if s.options.Direction != Down {
+		if err := s.send(ctx, relay, have, &result); err != nil {
+			return result, err
+		}
+	}
+
+	return result, nil
+}
+
+// diff returns the ids of the events matching filter only we have and
+// those only the peer has
+func (s *Syncer) diff(
+	ctx context.Context,
+	relay *nostr.Relay,
+	id string,
+	filter nostr.Filter,
+	register func(handle func(data string)),
+) (have []string, haveNot []string, err error) {
+	ch, err := s.query(eventstore.SetNegentropy(ctx), filter)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query the local events: %w", err)
+	}
+	vec := vector.New()
+	for event := range ch {
+		vec.Insert(event.CreatedAt, event.ID)
+	}
+	vec.Seal()
+
+	neg := negentropy.New(vec, frameSizeLimit)
+
+	// the ids are sent on channels while reconciling, they must be read
+	// meanwhile
+	collected := make(chan struct{})
+	sessionCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		defer close(collected)
+		haves, haveNots := neg.Haves, neg.HaveNots
+		for haves != nil || haveNots != nil {
+			select {
+			case id, ok := <-haves:
+				if !ok {
+					haves = nil
+					continue
+				}
+				have = append(have, id)
+			case id, ok := <-haveNots:
+				if !ok {
+					haveNots = nil
+					continue
+				}
+				haveNot = append(haveNot, id)
+			case <-sessionCtx.Done():
+				return
+			}
+		}
+	}()
+
+	done := make(chan error, 1)
+	finish := func(err error) {
+		select {
+		case done <- err:
+		default:
+		}
+	}
+	register(func(data string) {
+		switch env := nip77.ParseNegMessage(data).(type) {
+		case *nip77.ErrorEnvelope:
+			finish(fmt.Errorf("peer refused to reconcile: %s", env.Reason))
+		case *nip77.MessageEnvelope:
+			next, err := neg.Reconcile(env.Message)
+			if err != nil {
+				finish(fmt.Errorf("failed to reconcile: %w", err))
+				return
+			}
+			if next == "" {
+				finish(nil)
+				return
+			}
+			message, _ := nip77.MessageEnvelope{SubscriptionID: id, Message: next}.MarshalJSON()
+			relay.Write(message)
+		}
+	})
+	defer register(nil)
+
+	open, _ := nip77.OpenEnvelope{SubscriptionID: id, Filter: filter, Message: neg.Start()}.MarshalJSON()
+	if err := <-relay.Write(open); err != nil {
+		return nil, nil, fmt.Errorf("failed to open a negentropy session: %w", err)
+	}
+	defer func() {
+		// go-nostr can't write once the connection is closed, so this must
+		// be sent before returning
+		message, _ := nip77.CloseEnvelope{SubscriptionID: id}.MarshalJSON()
+		<-relay.Write(message)
+	}()
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		cancel()
+		<-collected
+		return nil, nil, err
+	}
+
+	<-collected
+	return have, haveNot, nil
+}
+
+// receive fetches the events we are missing from the peer and stores them.
+// Channel creations go first in every batch so the updates of the same
+// batch can be accepted, anything refused is tried again on the next sync.
+func (s *Syncer) receive(ctx context.Context, relay *nostr.Relay, ids []string, result *Result) error {
+	// the channels are synced too, validators don't need to look for them
+	ctx = kinds.WithoutRemoteLookups(ctx)
+
+	for batch := range slices.Chunk(ids, s.options.BatchSize) {
+		// go-nostr drops the events whose signature doesn't check out
+		events, err := relay.QuerySync(ctx, nostr.Filter{IDs: batch})
+		if err != nil {
+			return fmt.Errorf("failed to fetch missing events: %w", err)
+		}
+
+		slices.SortFunc(events, func(a, b *nostr.Event) int {
+			if (a.Kind == 40) != (b.Kind == 40) {
+				if a.Kind == 40 {
+					return -1
+				}
+				return 1
+			}
+			return cmp.Compare(a.CreatedAt, b.CreatedAt)
+		})
+
+		for _, event := range events {
+			if !slices.Contains(batch, event.ID) || !event.CheckID() {
+				result.Rejected++
+				continue
+			}
+
+			err := s.accept(ctx, event)
+			switch {
+			case err == nil:
+				result.Received++
+			case errors.Is(err, eventstore.ErrDupEvent):
+			case errors.Is(err, ingest.ErrRejected):
+				result.Rejected++
+			default:
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// send publishes the events the peer is missing
+func (s *Syncer) send(ctx context.Context, relay *nostr.Relay, ids []string, result *Result) error {
+	for batch := range slices.Chunk(ids, s.options.BatchSize) {
+		ch, err := s.query(ctx, nostr.Filter{IDs: batch})
+		if err != nil {
+			return fmt.Errorf("failed to load events to send: %w", err)
+		}
+
+		for event := range ch {
+			err := relay.Publish(ctx, *event)
+			switch {
+			case err == nil:
+				result.Sent++
+			// go-nostr reports a refusal as "msg: <reason>"
+			case strings.HasPrefix(err.Error(), "msg: duplicate:"):
+			case strings.HasPrefix(err.Error(), "msg: "):
+				result.Rejected++
+			default:
+				// the channel must be drained before giving up
+				for range ch {
+				}
+				return fmt.Errorf("failed to send %s: %w", event.ID, err)
+			}
+		}
+	}
+
+	return nil
+}
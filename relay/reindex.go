@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"nostr-relay/channels"
+	"nostr-relay/config"
+	"nostr-relay/expiration"
+	"nostr-relay/search"
+)
+
+func runReindex(cfg config.Config, args []string) error {
+	flags := newFlagSet("reindex", "", &cfg)
+	flags.Parse(args)
+
+	db, err := openDatabase(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+
+	channelStore, err := channels.New(db)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Rebuilding channel state...")
+	count, err := channelStore.Rebuild(ctx)
+	if err != nil {
+		return err
+	}
+	log.Printf("Rebuilt state of %d channels", count)
+
+	// the search index reads the channel state, so it goes last
+	searchIndex, err := search.New(db, channelStore)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Rebuilding search index...")
+	if count, err = searchIndex.Rebuild(ctx); err != nil {
+		return err
+	}
+	log.Printf("Indexed %d documents", count)
+
+	expirer, err := expiration.New(db, channelStore)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Rebuilding expirations...")
+	if count, err = expirer.Rebuild(ctx); err != nil {
+		return err
+	}
+	log.Printf("Tracking %d expiring events", count)
+
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+
+	"nostr-relay/blossom"
+	"nostr-relay/comic"
+	"nostr-relay/config"
+	"nostr-relay/replay"
+	"nostr-relay/transcript"
+)
+
+func runReplay(cfg config.Config, args []string) error {
+	flags := newFlagSet("replay", "", &cfg)
+	channel := flags.String("channel", "", "id of the channel to replay (required)")
+	since := flags.String("since", "", "only messages created at or after (unix, RFC3339 or 2006-01-02)")
+	until := flags.String("until", "", "only messages created at or before (unix, RFC3339 or 2006-01-02)")
+	limit := flags.Int("limit", 0, "maximum number of messages, the latest ones (default RELAY_COMIC_EXPORT_MAX_MESSAGES)")
+	format := flags.String("format", "svg", "svg, gif or apng")
+	output := flags.String("o", "-", "output file, - for stdout")
+	width := flags.Int("width", 0, "panel width in pixels (default 480)")
+	height := flags.Int("height", 0, "panel height in pixels (default 360)")
+	size := flags.Int("size", 0, "longest side of gif and apng frames in pixels (default the panel size)")
+	compression := flags.Float64("compression", cfg.ReplayCompression, "how many times faster than posted messages appear")
+	minDelay := flags.Duration("min-delay", 0, "shortest time a message shows before the next (default 1.5s)")
+	maxDelay := flags.Duration("max-delay", 0, "longest time a message shows before the next (default 8s)")
+	flags.Parse(args)
+
+	if *channel == "" {
+		flags.Usage()
+		return fmt.Errorf("-channel is required")
+	}
+	if !slices.Contains(replay.Formats, *format) {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	var rng transcript.Range
+	var err error
+	if rng.Since, err = parseTimestamp(*since); err != nil {
+		return err
+	}
+	if rng.Until, err = parseTimestamp(*until); err != nil {
+		return err
+	}
+
+	db, err := openDatabase(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var blobs *blossom.Server
+	if cfg.Blossom {
+		if blobs, err = blossom.New(db, blossom.Options{Dir: cfg.BlossomDir}); err != nil {
+			return err
+		}
+	}
+	exporter := newExporter(cfg, db.QueryEvents, blobs, transcript.Options{
+		MaxMessages: *limit,
+		Comic:       comic.Options{Width: *width, Height: *height},
+	})
+
+	t, err := exporter.Load(context.Background(), *channel, rng)
+	if err != nil {
+		return err
+	}
+	r := replay.New(t, replay.Options{Compression: *compression, MinDelay: *minDelay, MaxDelay: *maxDelay})
+
+	var w io.Writer = os.Stdout
+	if *output != "-" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+
+	buffered := bufio.NewWriter(w)
+	if err := r.Write(buffered, *format, *size); err != nil {
+		return err
+	}
+	if err := buffered.Flush(); err != nil {
+		return err
+	}
+
+	log.Printf("Exported %d messages as a replay of %s", len(t.Messages), r.Duration)
+	return nil
+}
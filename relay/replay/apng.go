@@ -0,0 +1,115 @@
+package replay
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image/png"
+	"io"
+)
+
+// pngSignature starts every PNG file
+const pngSignature = "\x89PNG\r\n\x1a\n"
+
+// WriteAPNG writes the replay as an animated PNG looping forever. Frames
+// are encoded by image/png, their image data then moved into the frame
+// chunks of APNG; frames after the first only hold what changed.
+func (r *Replay) WriteAPNG(w io.Writer, size int) error {
+	frames, err := r.frames(size)
+	if err != nil {
+		return err
+	}
+
+	var out bytes.Buffer
+	out.WriteString(pngSignature)
+	sequence := uint32(0)
+	encoder := png.Encoder{CompressionLevel: png.BestCompression}
+	for k, f := range frames {
+		var encoded bytes.Buffer
+		if err := encoder.Encode(&encoded, f.image.SubImage(f.bounds)); err != nil {
+			return err
+		}
+		chunks, err := readChunks(encoded.Bytes())
+		if err != nil {
+			return err
+		}
+
+		if k == 0 {
+			// frames are opaque NRGBA images, all encoded with the header of
+			// the first
+			writeChunk(&out, "IHDR", chunks[0].data)
+			writeChunk(&out, "acTL", be32(uint32(len(frames)), 0))
+		}
+
+		control := be32(sequence, uint32(f.bounds.Dx()), uint32(f.bounds.Dy()), uint32(f.bounds.Min.X), uint32(f.bounds.Min.Y))
+		// the delay in hundredths of a second, dispose and blend ops 0: the
+		// frame stays and replaces what is under it
+		delay := uint16(min(hundredths(f.duration), 0xffff))
+		control = binary.BigEndian.AppendUint16(control, delay)
+		control = binary.BigEndian.AppendUint16(control, 100)
+		control = append(control, 0, 0)
+		writeChunk(&out, "fcTL", control)
+		sequence++
+
+		for _, c := range chunks {
+			if c.kind != "IDAT" {
+				continue
+			}
+			if k == 0 {
+				writeChunk(&out, "IDAT", c.data)
+				continue
+			}
+			writeChunk(&out, "fdAT", append(be32(sequence), c.data...))
+			sequence++
+		}
+	}
+	writeChunk(&out, "IEND", nil)
+
+	_, err = w.Write(out.Bytes())
+	return err
+}
+
+type chunk struct {
+	kind string
+	data []byte
+}
+
+// readChunks splits a PNG file into its chunks
+func readChunks(data []byte) ([]chunk, error) {
+	if !bytes.HasPrefix(data, []byte(pngSignature)) {
+		return nil, errors.New("not a PNG file")
+	}
+	data = data[len(pngSignature):]
+	chunks := make([]chunk, 0)
+	for len(data) >= 12 {
+		length := binary.BigEndian.Uint32(data)
+		if uint64(length)+12 > uint64(len(data)) {
+			return nil, errors.New("truncated PNG chunk")
+		}
+		chunks = append(chunks, chunk{kind: string(data[4:8]), data: data[8 : 8+length]})
+		data = data[12+length:]
+	}
+	if len(chunks) == 0 || chunks[0].kind != "IHDR" {
+		return nil, errors.New("PNG file without a header")
+	}
+	return chunks, nil
+}
+
+func writeChunk(out *bytes.Buffer, kind string, data []byte) {
+	out.Write(be32(uint32(len(data))))
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(kind))
+	crc.Write(data)
+	out.WriteString(kind)
+	out.Write(data)
+	out.Write(be32(crc.Sum32()))
+}
+
+func be32(values ...uint32) []byte {
+	b := make([]byte, 0, 4*len(values))
+	for _, v := range values {
+		b = binary.BigEndian.AppendUint32(b, v)
+	}
+	return b
+}
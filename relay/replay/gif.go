@@ -0,0 +1,142 @@
+package replay
+
+import (
+	"cmp"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"io"
+	"slices"
+	"time"
+)
+
+// WriteGIF writes the replay as an animated GIF looping forever. Frames
+// after the first only hold what changed, each with a palette of its own.
+func (r *Replay) WriteGIF(w io.Writer, size int) error {
+	frames, err := r.frames(size)
+	if err != nil {
+		return err
+	}
+
+	bounds := frames[0].image.Bounds()
+	animation := &gif.GIF{Config: image.Config{Width: bounds.Dx(), Height: bounds.Dy()}}
+	for _, f := range frames {
+		paletted := image.NewPaletted(f.bounds, quantize(f.image, f.bounds, 256))
+		draw.FloydSteinberg.Draw(paletted, f.bounds, f.image, f.bounds.Min)
+		animation.Image = append(animation.Image, paletted)
+		animation.Delay = append(animation.Delay, hundredths(f.duration))
+		animation.Disposal = append(animation.Disposal, gif.DisposalNone)
+	}
+	return gif.EncodeAll(w, animation)
+}
+
+// hundredths is a duration in hundredths of a second, the unit of GIF and
+// APNG delays
+func hundredths(d time.Duration) int {
+	return int((d + 5*time.Millisecond) / (10 * time.Millisecond))
+}
+
+// box is a set of colors of an image and how many pixels have them
+type box struct {
+	colors []counted
+	pixels int
+}
+
+type counted struct {
+	color color.NRGBA
+	count int
+}
+
+// quantize picks at most n colors for an area of an opaque image by median
+// cut: the box of colors with the widest channel, weighted by its pixels, is
+// split in halves until there are n boxes, each giving its average color.
+// Images with n colors or less keep them.
+func quantize(img *image.NRGBA, area image.Rectangle, n int) color.Palette {
+	counts := make(map[color.NRGBA]int)
+	for y := area.Min.Y; y < area.Max.Y; y++ {
+		for x := area.Min.X; x < area.Max.X; x++ {
+			counts[img.NRGBAAt(x, y)]++
+		}
+	}
+	all := box{colors: make([]counted, 0, len(counts))}
+	for c, count := range counts {
+		all.colors = append(all.colors, counted{c, count})
+		all.pixels += count
+	}
+	// sorted so the same image always has the same palette
+	slices.SortFunc(all.colors, func(a counted, b counted) int {
+		return cmp.Compare(uint32(a.color.R)<<16|uint32(a.color.G)<<8|uint32(a.color.B), uint32(b.color.R)<<16|uint32(b.color.G)<<8|uint32(b.color.B))
+	})
+
+	boxes := []box{all}
+	for len(boxes) < n {
+		best, channel, widest := -1, 0, 0
+		for k, b := range boxes {
+			if len(b.colors) < 2 {
+				continue
+			}
+			c, width := b.widest()
+			if width*b.pixels > widest {
+				best, channel, widest = k, c, width*b.pixels
+			}
+		}
+		if best < 0 {
+			break
+		}
+		low, high := boxes[best].split(channel)
+		boxes[best] = low
+		boxes = append(boxes, high)
+	}
+
+	palette := make(color.Palette, len(boxes))
+	for k, b := range boxes {
+		palette[k] = b.average()
+	}
+	return palette
+}
+
+func channelOf(c color.NRGBA, channel int) int {
+	return int([3]uint8{c.R, c.G, c.B}[channel])
+}
+
+// widest is the channel whose values spread the most in the box, and how
+// far they spread
+func (b box) widest() (int, int) {
+	best, width := 0, -1
+	for channel := range 3 {
+		lo, hi := 255, 0
+		for _, c := range b.colors {
+			v := channelOf(c.color, channel)
+			lo, hi = min(lo, v), max(hi, v)
+		}
+		if hi-lo > width {
+			best, width = channel, hi-lo
+		}
+	}
+	return best, width
+}
+
+// split cuts a box along a channel where half of its pixels are on each
+// side, both halves keeping a color at least
+func (b box) split(channel int) (box, box) {
+	slices.SortStableFunc(b.colors, func(x counted, y counted) int {
+		return cmp.Compare(channelOf(x.color, channel), channelOf(y.color, channel))
+	})
+	k, seen := 1, b.colors[0].count
+	for k < len(b.colors)-1 && seen+b.colors[k].count <= b.pixels/2 {
+		seen += b.colors[k].count
+		k++
+	}
+	return box{colors: b.colors[:k], pixels: seen}, box{colors: b.colors[k:], pixels: b.pixels - seen}
+}
+
+func (b box) average() color.Color {
+	var r, g, bl int
+	for _, c := range b.colors {
+		r += int(c.color.R) * c.count
+		g += int(c.color.G) * c.count
+		bl += int(c.color.B) * c.count
+	}
+	return color.NRGBA{uint8((r + b.pixels/2) / b.pixels), uint8((g + b.pixels/2) / b.pixels), uint8((bl + b.pixels/2) / b.pixels), 255}
+}
@@ -0,0 +1,107 @@
+package replay
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"nostr-relay/transcript"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// contentTypes of the formats, APNG files being named .png
+var contentTypes = map[string]string{"svg": "image/svg+xml", "gif": "image/gif", "apng": "image/apng"}
+
+var extensions = map[string]string{"svg": "svg", "gif": "gif", "apng": "png"}
+
+// maxSize is the longest side of GIF and APNG frames, in pixels
+const maxSize = 1024
+
+// Handler serves the replay of the channel {id}, with the transcripts of
+// exporter. ?format= is "svg" (default), "gif" or "apng", ?size= the longest
+// side of GIF and APNG frames in pixels and ?compression= replaces that of
+// options. ?since=, ?until= and ?limit= select the messages as they do for
+// transcripts. Replays are cached and drawn by exporter, like transcripts.
+func Handler(exporter *transcript.Exporter, options Options) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		if !nostr.IsValid32ByteHex(id) {
+			http.Error(w, "invalid channel id", http.StatusBadRequest)
+			return
+		}
+
+		query := r.URL.Query()
+		format := query.Get("format")
+		if format == "" {
+			format = "svg"
+		}
+		if !slices.Contains(Formats, format) {
+			http.Error(w, "format must be svg, gif or apng", http.StatusBadRequest)
+			return
+		}
+		size := 0
+		if value := query.Get("size"); value != "" {
+			var err error
+			if size, err = strconv.Atoi(value); err != nil || size <= 0 || size > maxSize {
+				http.Error(w, fmt.Sprintf("size must be from 1 to %d", maxSize), http.StatusBadRequest)
+				return
+			}
+		}
+		options := options
+		if value := query.Get("compression"); value != "" {
+			var err error
+			if options.Compression, err = strconv.ParseFloat(value, 64); err != nil || options.Compression <= 0 {
+				http.Error(w, "invalid compression", http.StatusBadRequest)
+				return
+			}
+		}
+
+		var rng transcript.Range
+		var err error
+		if rng.Since, err = transcript.ParseTime(query.Get("since")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if rng.Until, err = transcript.ParseTime(query.Get("until")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if limit := query.Get("limit"); limit != "" {
+			if rng.Limit, err = strconv.Atoi(limit); err != nil || rng.Limit <= 0 {
+				http.Error(w, "invalid limit", http.StatusBadRequest)
+				return
+			}
+		}
+
+		// written whole first, so a failure is still an error status
+		data, err := exporter.Render(r.Context(), id, rng, fmt.Sprintf("replay %s %d %g", format, size, options.Compression), func(ctx context.Context) ([]byte, error) {
+			t, err := exporter.Load(ctx, id, rng)
+			if err != nil {
+				return nil, err
+			}
+
+			var b bytes.Buffer
+			err = New(t, options).Write(&b, format, size)
+			return b.Bytes(), err
+		})
+		if errors.Is(err, transcript.ErrNotFound) {
+			http.Error(w, "channel not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to export the replay of channel %s: %v", id, err)
+			http.Error(w, "could not export the replay", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", contentTypes[format])
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="channel-%s.%s"`, id[:8], extensions[format]))
+		w.Write(data)
+	}
+}
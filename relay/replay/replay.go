@@ -0,0 +1,229 @@
+package replay
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"runtime"
+	"sync"
+	"time"
+
+	"nostr-relay/raster"
+	"nostr-relay/transcript"
+	"nostr-relay/vector"
+)
+
+// Formats are the formats a replay is written in
+var Formats = []string{"svg", "gif", "apng"}
+
+// Options tune the pacing of replays, zero values use the defaults
+type Options struct {
+	// Compression divides the time between messages, 60 when 0 so a minute
+	// of conversation plays in a second
+	Compression float64
+
+	// MinDelay and MaxDelay bound the time a message shows before the next
+	// one, after compression, so every message can be read and pauses don't
+	// go on: 1.5s and 8s when 0
+	MinDelay time.Duration
+	MaxDelay time.Duration
+
+	// Title is how long the title page shows first, 3s when 0
+	Title time.Duration
+
+	// Hold is how long the last message shows before the replay starts
+	// again, 5s when 0
+	Hold time.Duration
+}
+
+func (o Options) withDefaults() Options {
+	if o.Compression <= 0 {
+		o.Compression = 60
+	}
+	if o.MinDelay <= 0 {
+		o.MinDelay = 1500 * time.Millisecond
+	}
+	if o.MaxDelay <= 0 {
+		o.MaxDelay = 8 * time.Second
+	}
+	o.MaxDelay = max(o.MaxDelay, o.MinDelay)
+	if o.Title <= 0 {
+		o.Title = 3 * time.Second
+	}
+	if o.Hold <= 0 {
+		o.Hold = 5 * time.Second
+	}
+	return o
+}
+
+// Replay is a transcript timed to be played back: panels show in turn and
+// their balloons appear as the messages were posted
+type Replay struct {
+	Transcript *transcript.Transcript
+
+	// Times are when each message of the transcript appears, from the start
+	// of the replay, and Duration how long it plays before starting again
+	Times    []time.Duration
+	Duration time.Duration
+}
+
+// New times the messages of a transcript by the time between them, divided
+// by Compression and kept between MinDelay and MaxDelay
+func New(t *transcript.Transcript, options Options) *Replay {
+	options = options.withDefaults()
+	r := &Replay{Transcript: t, Times: make([]time.Duration, len(t.Messages))}
+
+	at := options.Title
+	for i, m := range t.Messages {
+		if i > 0 {
+			gap := time.Duration(m.Event.CreatedAt-t.Messages[i-1].Event.CreatedAt) * time.Second
+			at += min(max(time.Duration(float64(gap)/options.Compression), options.MinDelay), options.MaxDelay)
+		}
+		r.Times[i] = at
+	}
+	r.Duration = at + options.Hold
+	if len(t.Messages) == 0 {
+		r.Duration = options.Title
+	}
+	return r
+}
+
+// Write writes the replay in a format of Formats. The longest side of GIF
+// and APNG frames is size pixels, that of the panels when 0.
+func (r *Replay) Write(w io.Writer, format string, size int) error {
+	switch format {
+	case "svg":
+		return r.WriteSVG(w)
+	case "gif":
+		return r.WriteGIF(w, size)
+	case "apng":
+		return r.WriteAPNG(w, size)
+	}
+	return fmt.Errorf("unknown format %q", format)
+}
+
+// step is a state of the strip: a page with some of its balloons, showing
+// from a time until the next step
+type step struct {
+	svg      []byte
+	start    time.Duration
+	duration time.Duration
+}
+
+// steps are the title page, then every panel once per message as its
+// balloons appear
+func (r *Replay) steps() []step {
+	t := r.Transcript
+	steps := []step{{svg: t.Title}}
+	i := 0
+	for _, p := range t.Panels {
+		for n := range p.Messages {
+			steps = append(steps, step{svg: p.Step(n + 1), start: r.Times[i]})
+			i++
+		}
+	}
+	for k := range steps {
+		end := r.Duration
+		if k+1 < len(steps) {
+			end = steps[k+1].start
+		}
+		steps[k].duration = end - steps[k].start
+	}
+	return steps
+}
+
+// frame is a step rasterized, bounds being the part of it that changed
+// since the previous frame
+type frame struct {
+	image    *image.NRGBA
+	bounds   image.Rectangle
+	duration time.Duration
+}
+
+// frames rasterizes the steps of the replay, on as many CPUs as there are.
+// Steps that look the same as the one before are merged into it.
+func (r *Replay) frames(size int) ([]frame, error) {
+	steps := r.steps()
+	d, err := vector.Parse(steps[0].svg)
+	if err != nil {
+		return nil, fmt.Errorf("title page: %w", err)
+	}
+	if size <= 0 {
+		size = int(max(d.Width, d.Height))
+	}
+	width, height := raster.Fit(d.Width, d.Height, size)
+
+	images := make([]*image.NRGBA, len(steps))
+	errs := make([]error, len(steps))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for range runtime.NumCPU() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := range next {
+				d, err := vector.Parse(steps[k].svg)
+				if err != nil {
+					errs[k] = fmt.Errorf("frame %d: %w", k, err)
+					continue
+				}
+				images[k] = opaque(raster.Render(d, width, height))
+			}
+		}()
+	}
+	for k := range steps {
+		next <- k
+	}
+	close(next)
+	wg.Wait()
+
+	frames := make([]frame, 0, len(steps))
+	for k, s := range steps {
+		if errs[k] != nil {
+			return nil, errs[k]
+		}
+		if k == 0 {
+			frames = append(frames, frame{image: images[k], bounds: images[k].Bounds(), duration: s.duration})
+			continue
+		}
+		changed := difference(images[k-1], images[k])
+		if changed.Empty() {
+			frames[len(frames)-1].duration += s.duration
+			continue
+		}
+		frames = append(frames, frame{image: images[k], bounds: changed, duration: s.duration})
+	}
+	return frames, nil
+}
+
+// opaque puts an image on white, animations having no transparency
+func opaque(img *image.NRGBA) *image.NRGBA {
+	for i := 0; i < len(img.Pix); i += 4 {
+		a := uint32(img.Pix[i+3])
+		for c := range 3 {
+			img.Pix[i+c] = uint8((uint32(img.Pix[i+c])*a + 255*(255-a) + 127) / 255)
+		}
+		img.Pix[i+3] = 255
+	}
+	return img
+}
+
+// difference is the smallest rectangle holding the pixels that differ
+// between two images of the same size
+func difference(a *image.NRGBA, b *image.NRGBA) image.Rectangle {
+	bounds := a.Bounds()
+	changed := image.Rectangle{Min: bounds.Max, Max: bounds.Min}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			i := a.PixOffset(x, y)
+			if [4]uint8(a.Pix[i:i+4]) != [4]uint8(b.Pix[i:i+4]) {
+				changed.Min = image.Pt(min(changed.Min.X, x), min(changed.Min.Y, y))
+				changed.Max = image.Pt(max(changed.Max.X, x+1), max(changed.Max.Y, y+1))
+			}
+		}
+	}
+	if changed.Min.X >= changed.Max.X {
+		return image.Rectangle{}
+	}
+	return changed
+}
@@ -0,0 +1,199 @@
+package replay
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/xml"
+	"image/gif"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"nostr-relay/comic"
+	"nostr-relay/internal/testutil"
+	"nostr-relay/transcript"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func setup(t *testing.T) (*transcript.Exporter, string) {
+	db := testutil.DB(t, "replay")
+	save := testutil.Saver(t, db)
+	alice, bob := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+
+	channel := save(alice, nostr.Event{Kind: 40, CreatedAt: 1000, Content: `{"name":"Robots"}`})
+	for _, m := range []struct {
+		sk      string
+		at      nostr.Timestamp
+		content string
+	}{
+		{alice, 2000, "Hello"},
+		{bob, 2030, "Hi!"},
+		{alice, 2600, "Sorry, I was away"},
+		{bob, 2720, "No problem"},
+	} {
+		save(m.sk, nostr.Event{Kind: 7353, CreatedAt: m.at, Content: m.content, Tags: nostr.Tags{{"e", channel.ID, "", "root"}}})
+	}
+
+	return transcript.New(db.QueryEvents, nil, transcript.Options{Comic: comic.Options{Width: 160, Height: 120}}), channel.ID
+}
+
+func load(t *testing.T) *Replay {
+	e, id := setup(t)
+	tr, err := e.Load(context.Background(), id, transcript.Range{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(tr, Options{})
+}
+
+func TestNew(t *testing.T) {
+	r := load(t)
+	// 30s between messages get the shortest delay, 10 minutes the longest
+	want := []time.Duration{3 * time.Second, 4500 * time.Millisecond, 12500 * time.Millisecond, 14500 * time.Millisecond}
+	if !slices.Equal(r.Times, want) || r.Duration != 19500*time.Millisecond {
+		t.Errorf("times: %v, duration %v", r.Times, r.Duration)
+	}
+
+	slow := New(r.Transcript, Options{Compression: 10, MaxDelay: time.Minute})
+	if slow.Times[2]-slow.Times[1] != 57*time.Second {
+		t.Errorf("compression: %v", slow.Times)
+	}
+}
+
+func TestWriteSVG(t *testing.T) {
+	r := load(t)
+	var b bytes.Buffer
+	if err := r.WriteSVG(&b); err != nil {
+		t.Fatal(err)
+	}
+	svg := b.String()
+	if err := xml.Unmarshal(b.Bytes(), new(struct{})); err != nil {
+		t.Errorf("invalid XML: %v", err)
+	}
+	for _, want := range []string{
+		`@keyframes message-2{0%{visibility:hidden}64.103%,100%{visibility:visible}}`,
+		`[data-message="2"]{animation:message-2 19.500s step-end infinite}`,
+		`<g data-message="0"><svg`,
+	} {
+		if !strings.Contains(svg, want) {
+			t.Errorf("replay doesn't have %s:\n%s", want, svg)
+		}
+	}
+	if strings.Count(svg, "<svg") != 2+len(r.Transcript.Panels) {
+		t.Errorf("the title and every panel are stacked")
+	}
+}
+
+func TestWriteGIF(t *testing.T) {
+	r := load(t)
+	var b bytes.Buffer
+	if err := r.WriteGIF(&b, 0); err != nil {
+		t.Fatal(err)
+	}
+	animation, err := gif.DecodeAll(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(animation.Delay, []int{300, 150, 800, 200, 500}) || animation.LoopCount != 0 {
+		t.Errorf("delays: %v, loops %d", animation.Delay, animation.LoopCount)
+	}
+	if animation.Config.Width != 160 || animation.Config.Height != 120 || animation.Image[0].Bounds().Dx() != 160 {
+		t.Errorf("size: %+v", animation.Config)
+	}
+	// balloons appearing in a panel change part of it only
+	if second := animation.Image[2].Bounds(); second.Dx() >= 160 && second.Dy() >= 120 {
+		t.Errorf("the frames after the first hold what changed: %v", second)
+	}
+
+	b.Reset()
+	if err := r.WriteGIF(&b, 80); err != nil {
+		t.Fatal(err)
+	}
+	if config, err := gif.DecodeConfig(&b); err != nil || config.Width != 80 || config.Height != 60 {
+		t.Errorf("smaller frames: %+v %v", config, err)
+	}
+}
+
+func TestWriteAPNG(t *testing.T) {
+	r := load(t)
+	var b bytes.Buffer
+	if err := r.WriteAPNG(&b, 0); err != nil {
+		t.Fatal(err)
+	}
+	chunks, err := readChunks(b.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kinds := make([]string, 0)
+	delays := make([]uint16, 0)
+	sequence := uint32(0)
+	for _, c := range chunks {
+		if len(kinds) == 0 || kinds[len(kinds)-1] != c.kind {
+			kinds = append(kinds, c.kind)
+		}
+		switch c.kind {
+		case "acTL":
+			if frames := binary.BigEndian.Uint32(c.data); frames != 5 {
+				t.Errorf("frames: %d", frames)
+			}
+		case "fcTL", "fdAT":
+			if binary.BigEndian.Uint32(c.data) != sequence {
+				t.Errorf("%s out of sequence", c.kind)
+			}
+			sequence++
+			if c.kind == "fcTL" {
+				delays = append(delays, binary.BigEndian.Uint16(c.data[20:]))
+			}
+		}
+	}
+	if !slices.Equal(kinds[:5], []string{"IHDR", "acTL", "fcTL", "IDAT", "fcTL"}) || kinds[len(kinds)-1] != "IEND" {
+		t.Errorf("chunks: %v", kinds)
+	}
+	if !slices.Equal(delays, []uint16{300, 150, 800, 200, 500}) {
+		t.Errorf("delays: %v", delays)
+	}
+
+	// viewers without APNG show the first frame
+	img, err := png.Decode(&b)
+	if err != nil || img.Bounds().Dx() != 160 {
+		t.Errorf("first frame: %v", err)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	e, id := setup(t)
+	handler := Handler(e, Options{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /channels/{id}/replay", handler)
+
+	for url, want := range map[string]int{
+		"/channels/" + id + "/replay":                      http.StatusOK,
+		"/channels/" + id + "/replay?format=gif&size=64":   http.StatusOK,
+		"/channels/" + id + "/replay?format=apng":          http.StatusOK,
+		"/channels/" + id + "/replay?format=webm":          http.StatusBadRequest,
+		"/channels/" + id + "/replay?size=5000":            http.StatusBadRequest,
+		"/channels/" + id + "/replay?compression=0":        http.StatusBadRequest,
+		"/channels/" + id + "/replay?since=yesterday":      http.StatusBadRequest,
+		"/channels/nope/replay":                            http.StatusBadRequest,
+		"/channels/" + strings.Repeat("0", 64) + "/replay": http.StatusNotFound,
+	} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+		if w.Code != want {
+			t.Errorf("%s: %d %s", url, w.Code, w.Body)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/channels/"+id+"/replay?format=apng&compression=1", nil))
+	if w.Header().Get("Content-Type") != "image/apng" || !strings.HasSuffix(w.Header().Get("Content-Disposition"), `.png"`) {
+		t.Errorf("headers: %v", w.Header())
+	}
+}
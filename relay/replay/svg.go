@@ -0,0 +1,51 @@
+package replay
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+
+	"nostr-relay/vector"
+)
+
+// WriteSVG writes the replay as an SVG animated with CSS. Pages are stacked,
+// the title at the bottom, and the panels and balloons tagged with a
+// message by the comic package are hidden until its time. Viewers without
+// animations show the last panel.
+func (r *Replay) WriteSVG(w io.Writer) error {
+	t := r.Transcript
+	d, err := vector.Parse(t.Title)
+	if err != nil {
+		return fmt.Errorf("title page: %w", err)
+	}
+	width, height := strconv.FormatFloat(d.Width, 'f', -1, 64), strconv.FormatFloat(d.Height, 'f', -1, 64)
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%s" height="%s" viewBox="0 0 %s %s">`, width, height, width, height)
+
+	// every message has keyframes of its own, hidden until its share of the
+	// duration has passed
+	duration := strconv.FormatFloat(r.Duration.Seconds(), 'f', 3, 64)
+	b.WriteString(`<style>`)
+	for i, at := range r.Times {
+		share := strconv.FormatFloat(100*at.Seconds()/r.Duration.Seconds(), 'f', 3, 64)
+		fmt.Fprintf(&b, `@keyframes message-%d{0%%{visibility:hidden}%s%%,100%%{visibility:visible}}`, i, share)
+		fmt.Fprintf(&b, `[data-message="%d"]{animation:message-%d %ss step-end infinite}`, i, i, duration)
+	}
+	b.WriteString(`</style>`)
+
+	b.Write(t.Title)
+	i := 0
+	for _, p := range t.Panels {
+		// a panel shows with its first message
+		fmt.Fprintf(&b, `<g data-message="%d">`, i)
+		b.Write(p.SVG)
+		b.WriteString(`</g>`)
+		i += len(p.Messages)
+	}
+	b.WriteString(`</svg>`)
+
+	_, err = w.Write(b.Bytes())
+	return err
+}
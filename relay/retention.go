@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"nostr-relay/channels"
+	"nostr-relay/config"
+	"nostr-relay/retention"
+)
+
+func retentionDefaults(cfg config.Config) retention.Limits {
+	return retention.Limits{MaxAge: cfg.RetentionMaxAge, MaxMessages: cfg.RetentionMaxMessages}
+}
+
+func retentionBounds(cfg config.Config) retention.Limits {
+	return retention.Limits{MaxAge: cfg.RetentionMaxAgeLimit, MaxMessages: cfg.RetentionMaxMessagesLimit}
+}
+
+func runRetention(cfg config.Config, args []string) error {
+	flags := newFlagSet("retention", "[report | set <channel> | clear <channel>]", &cfg)
+	maxAge := flags.Duration("max-age", 0, "with set: maximum age of messages, 0 to keep them")
+	maxMessages := flags.Int("max-messages", 0, "with set: maximum number of messages, 0 for no limit")
+	flags.Parse(args)
+
+	action := flags.Arg(0)
+	if action == "" {
+		action = "report"
+	}
+	channelID := flags.Arg(1)
+	if action != "report" && channelID == "" {
+		flags.Usage()
+		return errors.New("missing channel id")
+	}
+
+	db, err := openDatabase(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	channelStore, err := channels.New(db)
+	if err != nil {
+		return err
+	}
+
+	policy, err := retention.New(db, channelStore, retentionDefaults(cfg), retentionBounds(cfg))
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	switch action {
+	case "report":
+		return retentionReport(ctx, channelStore, policy)
+	case "set":
+		return policy.SetOverride(ctx, channelID, retention.Limits{MaxAge: *maxAge, MaxMessages: *maxMessages})
+	case "clear":
+		return policy.ClearOverride(ctx, channelID)
+	}
+
+	flags.Usage()
+	return fmt.Errorf("unknown action %q", action)
+}
+
+// retentionReport shows the retention of every channel and what the next
+// pruning would delete
+func retentionReport(ctx context.Context, channelStore *channels.Store, policy *retention.Policy) error {
+	list, err := channelStore.List(ctx, -1)
+	if err != nil {
+		return err
+	}
+
+	pruned, err := policy.Prune(ctx, true, nil)
+	if err != nil {
+		return err
+	}
+	pending := make(map[string]int, len(pruned))
+	for _, p := range pruned {
+		pending[p.ChannelID] = p.Messages
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "default retention: %s\n\n", policy.Defaults())
+	fmt.Fprintln(w, "CHANNEL\tNAME\tRETENTION\tSET BY\tMESSAGES\tTO PRUNE")
+	for _, channel := range list {
+		override, err := policy.Override(ctx, channel.ID)
+		if err != nil {
+			return err
+		}
+
+		setBy := "default"
+		switch {
+		case override != nil:
+			setBy = "operator"
+		case channel.RetentionMaxAge > 0 || channel.RetentionMaxMessages > 0:
+			setBy = "owner"
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\n", channel.ID, channel.Name, policy.Effective(&channel, override),
+			setBy, channel.Messages, pending[channel.ID])
+	}
+
+	return w.Flush()
+}
@@ -0,0 +1,205 @@
+package retention
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"nostr-relay/kinds"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// pruneBatch is how many messages are deleted per query
+const pruneBatch = 500
+
+// Pruned reports the messages of a channel that were, or would be, pruned
+type Pruned struct {
+	ChannelID string `json:"channel"`
+	Name      string `json:"name"`
+	Limits    Limits `json:"limits"`
+	Messages  int    `json:"messages"`
+}
+
+// Run prunes every interval until ctx is done. Messages are removed with
+// deleteEvent, which should run the relay DeleteEvent hooks so derived
+// tables stay in sync. In dry run mode nothing is deleted, what would be is
+// logged.
+func (p *Policy) Run(ctx context.Context, interval time.Duration, dryRun bool, deleteEvent func(ctx context.Context, event *nostr.Event) error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		report, err := p.Prune(ctx, dryRun, deleteEvent)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Retention pruning failed: %v", err)
+		}
+		for _, pruned := range report {
+			if dryRun {
+				log.Printf("Retention dry run: would prune %d messages of channel %s (%s)", pruned.Messages, pruned.ChannelID, pruned.Limits)
+			} else {
+				log.Printf("Pruned %d messages of channel %s (%s)", pruned.Messages, pruned.ChannelID, pruned.Limits)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Prune deletes the messages beyond the retention of every channel, or only
+// counts them when dryRun is set. Channels with nothing to prune aren't
+// reported.
+func (p *Policy) Prune(ctx context.Context, dryRun bool, deleteEvent func(ctx context.Context, event *nostr.Event) error) ([]Pruned, error) {
+	list, err := p.channels.List(ctx, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	overrides, err := p.overrides(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	report := make([]Pruned, 0)
+	for _, channel := range list {
+		var override *Limits
+		if limits, ok := overrides[channel.ID]; ok {
+			override = &limits
+		}
+
+		limits := p.Effective(&channel, override)
+		if limits.IsZero() {
+			continue
+		}
+
+		pruned := Pruned{ChannelID: channel.ID, Name: channel.Name, Limits: limits}
+		if dryRun {
+			pruned.Messages, err = p.count(ctx, channel.ID, limits)
+		} else {
+			pruned.Messages, err = p.prune(ctx, channel.ID, limits, deleteEvent)
+		}
+		if err != nil {
+			return report, fmt.Errorf("channel %s: %w", channel.ID, err)
+		}
+
+		if pruned.Messages > 0 {
+			report = append(report, pruned)
+		}
+	}
+
+	return report, nil
+}
+
+func (p *Policy) prune(ctx context.Context, channelID string, limits Limits, deleteEvent func(ctx context.Context, event *nostr.Event) error) (int, error) {
+	query, params := expiredSQL(channelID, limits, nostr.Now())
+	query = `SELECT id, pubkey, created_at, kind, tags, content, sig FROM event
+        WHERE id IN (` + query + `) LIMIT ?`
+	params = append(params, pruneBatch)
+
+	count := 0
+	for {
+		events, err := p.load(ctx, query, params...)
+		if err != nil {
+			return count, err
+		}
+
+		for _, event := range events {
+			if err := deleteEvent(ctx, event); err != nil {
+				return count, fmt.Errorf("failed to delete %s: %w", event.ID, err)
+			}
+			_, err := p.db.ExecContext(ctx, `
+                INSERT OR IGNORE INTO pruned_event (id, channel, pruned_at) VALUES ($1, $2, $3)
+            `, event.ID, channelID, nostr.Now())
+			if err != nil {
+				return count, fmt.Errorf("failed to remember %s was pruned: %w", event.ID, err)
+			}
+			count++
+		}
+
+		if len(events) < pruneBatch {
+			return count, nil
+		}
+	}
+}
+
+// RejectEvent refuses the messages that were pruned, which peers and
+// backfill would otherwise bring back
+func (p *Policy) RejectEvent(ctx context.Context, event *nostr.Event) (bool, string) {
+	if !kinds.IsChannelMessage(event) {
+		return false, ""
+	}
+
+	var count int
+	if err := p.db.GetContext(ctx, &count, "SELECT COUNT(*) FROM pruned_event WHERE id = $1", event.ID); err != nil {
+		return true, "error: could not check retention"
+	}
+	if count > 0 {
+		return true, "blocked: this message was pruned by the channel retention"
+	}
+
+	return false, ""
+}
+
+func (p *Policy) count(ctx context.Context, channelID string, limits Limits) (int, error) {
+	query, params := expiredSQL(channelID, limits, nostr.Now())
+
+	var count int
+	err := p.db.GetContext(ctx, &count, "SELECT COUNT(*) FROM ("+query+")", params...)
+	return count, err
+}
+
+// expiredSQL selects the ids of the messages of a channel that are older
+// than the maximum age or beyond the maximum count. Messages of other
+// channels only mentioning it aren't its own.
+func expiredSQL(channelID string, limits Limits, now nostr.Timestamp) (string, []any) {
+	query := `WITH messages AS (
+          SELECT e.id, e.created_at FROM event e
+          WHERE e.kind IN (42, 7353) AND e.tags LIKE ? AND ` + kinds.ChannelIDSQL + ` = ?
+        )`
+	params := []any{"%" + channelID + "%", channelID}
+
+	parts := make([]string, 0, 2)
+	if limits.MaxAge > 0 {
+		parts = append(parts, "SELECT id FROM messages WHERE created_at < ?")
+		params = append(params, now-nostr.Timestamp(limits.MaxAge.Seconds()))
+	}
+	if limits.MaxMessages > 0 {
+		parts = append(parts, "SELECT id FROM (SELECT id FROM messages ORDER BY created_at DESC, id DESC LIMIT -1 OFFSET ?)")
+		params = append(params, limits.MaxMessages)
+	}
+
+	for i, part := range parts {
+		if i > 0 {
+			query += " UNION "
+		}
+		query += " " + part
+	}
+
+	return query, params
+}
+
+func (p *Policy) load(ctx context.Context, query string, params ...any) ([]*nostr.Event, error) {
+	rows, err := p.db.QueryContext(ctx, query, params...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load messages to prune: %w", err)
+	}
+	defer rows.Close()
+
+	events := make([]*nostr.Event, 0)
+	for rows.Next() {
+		var event nostr.Event
+		var createdAt int64
+		if err := rows.Scan(&event.ID, &event.PubKey, &createdAt, &event.Kind, &event.Tags, &event.Content, &event.Sig); err != nil {
+			return nil, err
+		}
+		event.CreatedAt = nostr.Timestamp(createdAt)
+		events = append(events, &event)
+	}
+
+	return events, rows.Err()
+}
@@ -0,0 +1,176 @@
+package retention
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"nostr-relay/channels"
+
+	"github.com/fiatjaf/eventstore/sqlite3"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// channel_retention holds the operator overrides, which win over what the
+// channel owner asked for and over the bounds. pruned_event remembers the
+// messages pruned, so peers and backfill don't bring them back.
+var ddls = []string{
+	`CREATE TABLE IF NOT EXISTS channel_retention (
+       channel text PRIMARY KEY,
+       max_age integer NOT NULL,
+       max_messages integer NOT NULL,
+       updated_at integer NOT NULL);`,
+	`CREATE TABLE IF NOT EXISTS pruned_event (
+       id text PRIMARY KEY,
+       channel text NOT NULL,
+       pruned_at integer NOT NULL);`,
+}
+
+// Limits say which messages of a channel are kept, zero values keep
+// everything
+type Limits struct {
+	MaxAge      time.Duration `json:"max_age"`
+	MaxMessages int           `json:"max_messages"`
+}
+
+// IsZero tells if nothing gets pruned
+func (l Limits) IsZero() bool {
+	return l.MaxAge <= 0 && l.MaxMessages <= 0
+}
+
+func (l Limits) String() string {
+	switch {
+	case l.IsZero():
+		return "keep everything"
+	case l.MaxAge <= 0:
+		return fmt.Sprintf("last %d messages", l.MaxMessages)
+	case l.MaxMessages <= 0:
+		return fmt.Sprintf("%v", l.MaxAge)
+	default:
+		return fmt.Sprintf("%v, last %d messages", l.MaxAge, l.MaxMessages)
+	}
+}
+
+// tighter combines two limits keeping the shortest of each, zero meaning
+// no limit
+func (l Limits) tighter(other Limits) Limits {
+	return Limits{
+		MaxAge:      tighter(l.MaxAge, other.MaxAge),
+		MaxMessages: tighter(l.MaxMessages, other.MaxMessages),
+	}
+}
+
+func tighter[T time.Duration | int](a, b T) T {
+	switch {
+	case a <= 0:
+		return b
+	case b <= 0:
+		return a
+	default:
+		return min(a, b)
+	}
+}
+
+// Policy computes the retention of every channel: the operator override if
+// any, otherwise what the owner asked for, or the default, within bounds
+type Policy struct {
+	db       *sqlite3.SQLite3Backend
+	channels *channels.Store
+
+	defaults Limits
+	bounds   Limits
+}
+
+func New(db *sqlite3.SQLite3Backend, channelStore *channels.Store, defaults Limits, bounds Limits) (*Policy, error) {
+	for _, ddl := range ddls {
+		if _, err := db.Exec(ddl); err != nil {
+			return nil, fmt.Errorf("failed to create retention tables: %w", err)
+		}
+	}
+
+	return &Policy{db: db, channels: channelStore, defaults: defaults, bounds: bounds}, nil
+}
+
+// Defaults returns the retention of channels whose owner didn't ask for one
+func (p *Policy) Defaults() Limits {
+	return p.defaults.tighter(p.bounds)
+}
+
+// Effective returns the retention applied to channel
+func (p *Policy) Effective(channel *channels.Channel, override *Limits) Limits {
+	if override != nil {
+		return *override
+	}
+
+	asked := Limits{
+		MaxAge:      time.Duration(channel.RetentionMaxAge) * time.Second,
+		MaxMessages: int(channel.RetentionMaxMessages),
+	}
+	if asked.MaxAge <= 0 {
+		asked.MaxAge = p.defaults.MaxAge
+	}
+	if asked.MaxMessages <= 0 {
+		asked.MaxMessages = p.defaults.MaxMessages
+	}
+
+	return asked.tighter(p.bounds)
+}
+
+// SetOverride sets the retention of a channel regardless of its owner
+func (p *Policy) SetOverride(ctx context.Context, channelID string, limits Limits) error {
+	_, err := p.db.ExecContext(ctx, `
+        INSERT INTO channel_retention (channel, max_age, max_messages, updated_at) VALUES ($1, $2, $3, $4)
+        ON CONFLICT (channel) DO UPDATE SET
+          max_age = excluded.max_age,
+          max_messages = excluded.max_messages,
+          updated_at = excluded.updated_at
+    `, channelID, int64(limits.MaxAge.Seconds()), limits.MaxMessages, nostr.Now())
+	return err
+}
+
+// ClearOverride gives the control of the retention back to the owner
+func (p *Policy) ClearOverride(ctx context.Context, channelID string) error {
+	_, err := p.db.ExecContext(ctx, "DELETE FROM channel_retention WHERE channel = $1", channelID)
+	return err
+}
+
+// Override returns the operator override of a channel, nil when there's none
+func (p *Policy) Override(ctx context.Context, channelID string) (*Limits, error) {
+	var maxAge int64
+	var limits Limits
+	err := p.db.QueryRowContext(ctx, "SELECT max_age, max_messages FROM channel_retention WHERE channel = $1", channelID).
+		Scan(&maxAge, &limits.MaxMessages)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	limits.MaxAge = time.Duration(maxAge) * time.Second
+
+	return &limits, nil
+}
+
+func (p *Policy) overrides(ctx context.Context) (map[string]Limits, error) {
+	rows, err := p.db.QueryContext(ctx, "SELECT channel, max_age, max_messages FROM channel_retention")
+	if err != nil {
+		return nil, fmt.Errorf("failed to load retention overrides: %w", err)
+	}
+	defer rows.Close()
+
+	overrides := make(map[string]Limits)
+	for rows.Next() {
+		var channel string
+		var maxAge int64
+		var limits Limits
+		if err := rows.Scan(&channel, &maxAge, &limits.MaxMessages); err != nil {
+			return nil, err
+		}
+		limits.MaxAge = time.Duration(maxAge) * time.Second
+		overrides[channel] = limits
+	}
+
+	return overrides, rows.Err()
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"nostr-relay/config"
+	"nostr-relay/sanitize"
+)
+
+func runSanitize(cfg config.Config, args []string) error {
+	// no database here, the flags of newFlagSet don't apply
+	flags := flag.NewFlagSet("sanitize", flag.ExitOnError)
+	write := flags.Bool("w", false, "rewrite unsafe files without what was found instead of only reporting it")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s sanitize [flags] <file.svg>...\n\nFlags:\n", filepath.Base(os.Args[0]))
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("missing SVG files")
+	}
+
+	problems := 0
+	for _, path := range flags.Args() {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		clean, report, err := sanitize.SVG(data, false)
+		if err != nil {
+			log.Printf("%s: %v", path, err)
+			problems++
+			continue
+		}
+		if report.Clean() {
+			log.Printf("%s: safe", path)
+			continue
+		}
+
+		for _, removal := range report.Removed {
+			log.Printf("%s: %s", path, removal)
+		}
+		if !*write {
+			problems++
+			continue
+		}
+		if err := os.WriteFile(path, clean, 0o644); err != nil {
+			return err
+		}
+		log.Printf("%s: rewritten without %d unsafe parts", path, len(report.Removed))
+	}
+
+	if problems > 0 {
+		return fmt.Errorf("%d of %d files aren't safe", problems, flags.NArg())
+	}
+	return nil
+}
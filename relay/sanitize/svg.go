@@ -0,0 +1,440 @@
+package sanitize
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+var (
+	// ErrInvalid is returned for what isn't a well-formed SVG document
+	ErrInvalid = errors.New("invalid svg")
+
+	// ErrUnsafe is returned in strict mode for an SVG that would have been
+	// rewritten
+	ErrUnsafe = errors.New("unsafe svg")
+)
+
+// Removal is something taken out of an SVG
+type Removal struct {
+	Line      int    `json:"line"`
+	Element   string `json:"element"`
+	Attribute string `json:"attribute,omitempty"`
+	Reason    string `json:"reason"`
+}
+
+func (r Removal) String() string {
+	if r.Attribute != "" {
+		return fmt.Sprintf("line %d: %s attribute of <%s>: %s", r.Line, r.Attribute, r.Element, r.Reason)
+	}
+	return fmt.Sprintf("line %d: <%s>: %s", r.Line, r.Element, r.Reason)
+}
+
+// Report lists what was removed from an SVG, nothing when it was safe
+type Report struct {
+	Removed []Removal `json:"removed"`
+}
+
+// Clean tells if nothing had to be removed
+func (r Report) Clean() bool {
+	return len(r.Removed) == 0
+}
+
+func (r Report) String() string {
+	removed := make([]string, len(r.Removed))
+	for i, removal := range r.Removed {
+		removed[i] = removal.String()
+	}
+	return strings.Join(removed, "; ")
+}
+
+// elements are never rendered inline: they run scripts, embed other
+// documents or are HTML
+var elements = map[string]string{
+	"script":        "script",
+	"foreignobject": "foreign content",
+	"iframe":        "embedded document",
+	"embed":         "embedded document",
+	"object":        "embedded document",
+	"handler":       "script",
+	"listener":      "event listener",
+	"audio":         "media",
+	"video":         "media",
+}
+
+// animations can set an attribute to what the attribute itself can't hold
+var animations = map[string]bool{
+	"set":              true,
+	"animate":          true,
+	"animatecolor":     true,
+	"animatemotion":    true,
+	"animatetransform": true,
+}
+
+// SVG removes from an SVG what could run scripts or load something once
+// rendered inline: script and foreignObject elements, event handlers,
+// references to anything outside the document and CSS that does either.
+// A safe SVG is returned as it was, byte for byte, so its hash doesn't
+// change. In strict mode an SVG that isn't safe is refused with ErrUnsafe
+// instead of being rewritten.
+func SVG(data []byte, strict bool) ([]byte, Report, error) {
+	s := &sanitizer{decoder: xml.NewDecoder(bytes.NewReader(data))}
+	// only the predefined entities are known, a DOCTYPE can't declare more
+	s.decoder.Strict = true
+
+	if err := s.run(); err != nil {
+		return nil, s.report, err
+	}
+
+	if s.report.Clean() {
+		return data, s.report, nil
+	}
+	if strict {
+		return nil, s.report, fmt.Errorf("%w: %s", ErrUnsafe, s.report)
+	}
+	return s.out.Bytes(), s.report, nil
+}
+
+type sanitizer struct {
+	decoder *xml.Decoder
+	out     bytes.Buffer
+	report  Report
+
+	// open has the elements written and not closed yet, RawToken doesn't
+	// check they are closed in order
+	open []xml.Name
+	root bool
+}
+
+func (s *sanitizer) run() error {
+	for {
+		token, err := s.decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalid, err)
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			if len(s.open) == 0 {
+				if s.root {
+					return fmt.Errorf("%w: more than one root element", ErrInvalid)
+				}
+				if !strings.EqualFold(t.Name.Local, "svg") {
+					return fmt.Errorf("%w: root element is <%s>", ErrInvalid, qualified(t.Name))
+				}
+				s.root = true
+			}
+			if err := s.start(t); err != nil {
+				return err
+			}
+
+		case xml.EndElement:
+			if err := s.end(t); err != nil {
+				return err
+			}
+
+		case xml.CharData:
+			if len(s.open) == 0 {
+				// only whitespace can be around the root, the decoder
+				// doesn't check
+				if len(bytes.TrimSpace(t)) > 0 {
+					return fmt.Errorf("%w: text outside of the root element", ErrInvalid)
+				}
+				s.out.Write(t)
+				continue
+			}
+			xml.EscapeText(&s.out, t)
+
+		case xml.Comment:
+			s.out.WriteString("<!--")
+			s.out.Write(t)
+			s.out.WriteString("-->")
+
+		case xml.ProcInst:
+			// the XML declaration is the only one kept, others like
+			// xml-stylesheet load something
+			if t.Target == "xml" && s.out.Len() == 0 {
+				fmt.Fprintf(&s.out, "<?xml %s?>", t.Inst)
+				continue
+			}
+			s.remove(t.Target, "", "processing instruction")
+
+		case xml.Directive:
+			s.remove("!"+firstWord(t), "", "document type declaration")
+		}
+	}
+
+	if len(s.open) > 0 {
+		return fmt.Errorf("%w: <%s> is never closed", ErrInvalid, qualified(s.open[len(s.open)-1]))
+	}
+	if !s.root {
+		return fmt.Errorf("%w: no root element", ErrInvalid)
+	}
+	return nil
+}
+
+func (s *sanitizer) start(t xml.StartElement) error {
+	name := qualified(t.Name)
+	local := strings.ToLower(t.Name.Local)
+
+	if reason, ok := elements[local]; ok {
+		s.remove(name, "", reason)
+		return s.skip(t.Name)
+	}
+	if animations[local] {
+		if target := attribute(t, "attributeName"); isDangerousTarget(target) {
+			s.remove(name, "", "animates "+target)
+			return s.skip(t.Name)
+		}
+	}
+	if local == "style" {
+		return s.style(t)
+	}
+
+	s.out.WriteByte('<')
+	s.out.WriteString(name)
+	s.attributes(name, t.Attr)
+	s.out.WriteByte('>')
+
+	s.open = append(s.open, t.Name)
+	return nil
+}
+
+func (s *sanitizer) end(t xml.EndElement) error {
+	if len(s.open) == 0 || s.open[len(s.open)-1] != t.Name {
+		return fmt.Errorf("%w: unexpected </%s>", ErrInvalid, qualified(t.Name))
+	}
+	s.open = s.open[:len(s.open)-1]
+
+	fmt.Fprintf(&s.out, "</%s>", qualified(t.Name))
+	return nil
+}
+
+// attributes writes those that are safe
+func (s *sanitizer) attributes(element string, attrs []xml.Attr) {
+	for _, attr := range attrs {
+		name := qualified(attr.Name)
+		if reason := unsafeAttribute(attr); reason != "" {
+			s.remove(element, name, reason)
+			continue
+		}
+
+		s.out.WriteByte(' ')
+		s.out.WriteString(name)
+		s.out.WriteString(`="`)
+		xml.EscapeText(&s.out, []byte(attr.Value))
+		s.out.WriteByte('"')
+	}
+}
+
+// style keeps a style element when its CSS is safe, the whole element goes
+// otherwise
+func (s *sanitizer) style(t xml.StartElement) error {
+	var css bytes.Buffer
+	for {
+		token, err := s.decoder.RawToken()
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalid, err)
+		}
+
+		switch child := token.(type) {
+		case xml.CharData:
+			css.Write(child)
+			continue
+		case xml.Comment:
+			continue
+		case xml.EndElement:
+			if child.Name != t.Name {
+				return fmt.Errorf("%w: unexpected </%s>", ErrInvalid, qualified(child.Name))
+			}
+		default:
+			s.remove(qualified(t.Name), "", "markup in a stylesheet")
+			if child, ok := child.(xml.StartElement); ok {
+				if err := s.skip(child.Name); err != nil {
+					return err
+				}
+			}
+			return s.skip(t.Name)
+		}
+		break
+	}
+
+	name := qualified(t.Name)
+	if reason := unsafeCSS(css.String()); reason != "" {
+		s.remove(name, "", reason)
+		return nil
+	}
+
+	s.out.WriteByte('<')
+	s.out.WriteString(name)
+	s.attributes(name, t.Attr)
+	s.out.WriteByte('>')
+	xml.EscapeText(&s.out, css.Bytes())
+	fmt.Fprintf(&s.out, "</%s>", name)
+	return nil
+}
+
+// skip reads up to the end of an element that was just started
+func (s *sanitizer) skip(name xml.Name) error {
+	open := []xml.Name{name}
+	for len(open) > 0 {
+		token, err := s.decoder.RawToken()
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalid, err)
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			open = append(open, t.Name)
+		case xml.EndElement:
+			if open[len(open)-1] != t.Name {
+				return fmt.Errorf("%w: unexpected </%s>", ErrInvalid, qualified(t.Name))
+			}
+			open = open[:len(open)-1]
+		}
+	}
+	return nil
+}
+
+func (s *sanitizer) remove(element string, attribute string, reason string) {
+	line, _ := s.decoder.InputPos()
+	s.report.Removed = append(s.report.Removed, Removal{Line: line, Element: element, Attribute: attribute, Reason: reason})
+}
+
+// unsafeAttribute tells why an attribute can't be kept, or "" when it can
+func unsafeAttribute(attr xml.Attr) string {
+	local := strings.ToLower(attr.Name.Local)
+	value := strings.ToLower(attr.Value)
+
+	switch {
+	case attr.Name.Space == "xmlns" || (attr.Name.Space == "" && local == "xmlns"):
+		return ""
+	case strings.HasPrefix(local, "on"):
+		return "event handler"
+	case local == "href" || local == "src":
+		if !isSafeURL(attr.Value) {
+			return "external reference"
+		}
+	case attr.Name.Space == "xml" && local == "base":
+		return "external reference"
+	case local == "style":
+		return unsafeCSS(attr.Value)
+	}
+
+	if strings.Contains(value, "javascript:") || strings.Contains(value, "vbscript:") {
+		return "script URL"
+	}
+	if reason := unsafeURLs(attr.Value); reason != "" {
+		return reason
+	}
+	return ""
+}
+
+// unsafeCSS tells why a stylesheet or a style attribute can't be kept, or ""
+// when it can
+func unsafeCSS(css string) string {
+	lower := strings.ToLower(css)
+
+	switch {
+	case strings.Contains(lower, `\`):
+		// escapes could spell anything below
+		return "escaped CSS"
+	case strings.Contains(lower, "@import"):
+		return "CSS import"
+	case strings.Contains(lower, "expression("):
+		return "CSS expression"
+	case hasProperty(lower, "behavior") || hasProperty(lower, "-moz-binding"):
+		return "CSS binding"
+	case strings.Contains(lower, "javascript:") || strings.Contains(lower, "vbscript:"):
+		return "script URL"
+	}
+	return unsafeURLs(css)
+}
+
+// unsafeURLs checks the url() of a value, like fill="url(#gradient)"
+func unsafeURLs(value string) string {
+	lower := strings.ToLower(value)
+	for {
+		i := strings.Index(lower, "url(")
+		if i < 0 {
+			return ""
+		}
+		lower, value = lower[i+4:], value[i+4:]
+
+		end := strings.IndexByte(value, ')')
+		if end < 0 {
+			return "unterminated url()"
+		}
+		if !isSafeURL(strings.Trim(value[:end], " \t\r\n'\"")) {
+			return "external reference"
+		}
+		lower, value = lower[end:], value[end:]
+	}
+}
+
+// hasProperty tells if a declaration of property is in css
+func hasProperty(css string, property string) bool {
+	for {
+		i := strings.Index(css, property)
+		if i < 0 {
+			return false
+		}
+		css = css[i+len(property):]
+		if strings.HasPrefix(strings.TrimLeft(css, " \t\r\n"), ":") {
+			return true
+		}
+	}
+}
+
+// isSafeURL tells if a URL stays within the document: a fragment, or an
+// image or font embedded as data
+func isSafeURL(url string) bool {
+	url = strings.ToLower(strings.TrimSpace(url))
+	if strings.HasPrefix(url, "#") {
+		return true
+	}
+	for _, prefix := range []string{"data:image/png", "data:image/jpeg", "data:image/gif", "data:image/webp", "data:font/"} {
+		if strings.HasPrefix(url, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// isDangerousTarget tells if an animation of an attribute could add a script
+// or a reference
+func isDangerousTarget(name string) bool {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if i := strings.IndexByte(name, ':'); i >= 0 {
+		name = name[i+1:]
+	}
+	return strings.HasPrefix(name, "on") || name == "href" || name == "src" || name == "style"
+}
+
+func attribute(t xml.StartElement, local string) string {
+	for _, attr := range t.Attr {
+		if attr.Name.Local == local {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+// qualified is a name as written, RawToken leaves prefixes unresolved
+func qualified(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+	return name.Space + ":" + name.Local
+}
+
+func firstWord(directive xml.Directive) string {
+	word, _, _ := strings.Cut(strings.TrimSpace(string(directive)), " ")
+	return word
+}
@@ -0,0 +1,128 @@
+package sanitize
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestSVG(t *testing.T) {
+	cases := []struct {
+		name    string
+		svg     string
+		want    string
+		reasons []string
+	}{
+		{
+			name: "safe",
+			svg: `<?xml version="1.0" encoding="UTF-8"?>
+<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" viewBox="0 0 10 10">
+  <!-- a face -->
+  <defs><linearGradient id="g"><stop offset="0" stop-color="#fff"/></linearGradient></defs>
+  <style>circle { fill: url(#g) } a > b {}</style>
+  <circle cx="5" cy="5" r="4" fill="url('#g')" style="stroke: black"/>
+  <use xlink:href="#g"/>
+  <image href="data:image/png;base64,iVBORw0KGgo="/>
+  <animate attributeName="opacity" from="0" to="1"/>
+</svg>`,
+		},
+		{
+			name:    "script",
+			svg:     `<svg><script>alert(1)</script><SCRIPT type="text/javascript"><![CDATA[alert(2)]]></SCRIPT><g/></svg>`,
+			want:    `<svg><g></g></svg>`,
+			reasons: []string{"script", "script"},
+		},
+		{
+			name:    "event handlers",
+			svg:     `<svg onload="alert(1)"><g id="a" ONCLICK="alert(2)"/></svg>`,
+			want:    `<svg><g id="a"></g></svg>`,
+			reasons: []string{"event handler", "event handler"},
+		},
+		{
+			name:    "external references",
+			svg:     `<svg xmlns:xlink="http://www.w3.org/1999/xlink"><image href="https://example.com/x.png"/><use xlink:href="other.svg#a"/><a href="javascript:alert(1)"><g/></a><rect fill="url(https://example.com/#g)" xml:base="https://example.com/"/></svg>`,
+			want:    `<svg xmlns:xlink="http://www.w3.org/1999/xlink"><image></image><use></use><a><g></g></a><rect></rect></svg>`,
+			reasons: []string{"external reference", "external reference", "external reference", "external reference", "external reference"},
+		},
+		{
+			name:    "embedded documents",
+			svg:     `<svg><foreignObject><div xmlns="http://www.w3.org/1999/xhtml"><iframe src="x"/></div></foreignObject><iframe/></svg>`,
+			want:    `<svg></svg>`,
+			reasons: []string{"foreign content", "embedded document"},
+		},
+		{
+			name:    "animations",
+			svg:     `<svg><a><set attributeName="href" to="javascript:alert(1)"/><animate attributeName="xlink:href" values="x"/><animate attributeName="r" values="javascript:alert(1)"/></a></svg>`,
+			want:    `<svg><a><animate attributeName="r"></animate></a></svg>`,
+			reasons: []string{"animates href", "animates xlink:href", "script URL"},
+		},
+		{
+			name:    "css",
+			svg:     `<svg><style>@import url(https://example.com/x.css);</style><style>g { background: url("https://example.com/t.png") }</style><style>g { -moz-binding : url(#x) }</style><g style="behavior: url(x.htc)"/><g style="fill: \75rl(x)"/><g style="width: expression(alert(1))"/></svg>`,
+			want:    `<svg><g></g><g></g><g></g></svg>`,
+			reasons: []string{"CSS import", "external reference", "CSS binding", "CSS binding", "escaped CSS", "CSS expression"},
+		},
+		{
+			name:    "prolog",
+			svg:     `<?xml version="1.0"?><?xml-stylesheet href="https://example.com/x.css"?><!DOCTYPE svg><svg/>`,
+			want:    `<?xml version="1.0"?><svg></svg>`,
+			reasons: []string{"processing instruction", "document type declaration"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			out, report, err := SVG([]byte(c.svg), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			reasons := make([]string, len(report.Removed))
+			for i, removal := range report.Removed {
+				reasons[i] = removal.Reason
+			}
+			if strings.Join(reasons, ",") != strings.Join(c.reasons, ",") {
+				t.Errorf("removed %v, want %v", report, c.reasons)
+			}
+
+			want := c.want
+			if report.Clean() {
+				want = c.svg
+			}
+			if string(out) != want {
+				t.Errorf("got\n%s\nwant\n%s", out, want)
+			}
+
+			_, _, err = SVG([]byte(c.svg), true)
+			if report.Clean() && err != nil {
+				t.Errorf("strict mode refused a safe SVG: %v", err)
+			}
+			if !report.Clean() && !errors.Is(err, ErrUnsafe) {
+				t.Errorf("strict mode: %v, want ErrUnsafe", err)
+			}
+		})
+	}
+}
+
+func TestSVGInvalid(t *testing.T) {
+	for _, svg := range []string{
+		``,
+		`<html><script>alert(1)</script></html>`,
+		`<svg><g></svg>`,
+		`<svg></svg><svg></svg>`,
+		`<svg>&xxe;</svg>`,
+		`<!DOCTYPE svg [<!ENTITY xxe SYSTEM "file:///etc/passwd">]><svg>&xxe;</svg>`,
+		`<svg></svg>trailing`,
+	} {
+		if _, _, err := SVG([]byte(svg), false); !errors.Is(err, ErrInvalid) {
+			t.Errorf("%q: %v, want ErrInvalid", svg, err)
+		}
+	}
+}
+
+func TestSVGLines(t *testing.T) {
+	_, report, _ := SVG([]byte("<svg>\n<g/>\n<g onclick=\"x()\"/>\n</svg>"), false)
+	if len(report.Removed) != 1 || report.Removed[0].Line != 3 || report.Removed[0].Element != "g" || report.Removed[0].Attribute != "onclick" {
+		t.Errorf("report: %+v", report)
+	}
+}
@@ -0,0 +1,240 @@
+package search
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// searchableKinds are the kinds having documents in the index
+var searchableKinds = []int{40, 42, 7353}
+
+// columnWeights rank names above descriptions, and both above messages
+var columnWeights = []float64{10, 4, 1}
+
+const (
+	defaultLimit = 100
+	maxLimit     = 500
+
+	// maxCandidates is how many of the newest matches FTS4 ranks, so a
+	// common word doesn't load the whole index
+	maxCandidates = 5000
+)
+
+// Query wraps the QueryEvents hook next: NIP-50 filters are answered from
+// the index, every other filter is passed to next
+func (x *Index) Query(
+	next func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error),
+) func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	return func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		if filter.Search == "" {
+			return next(ctx, filter)
+		}
+
+		return x.search(ctx, filter)
+	}
+}
+
+func (x *Index) search(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	ch := make(chan *nostr.Event)
+
+	query, params, limit, ok := x.searchSQL(filter)
+	if !ok {
+		close(ch)
+		return ch, nil
+	}
+
+	rows, err := x.db.QueryContext(ctx, query, params...)
+	if err != nil {
+		close(ch)
+		return nil, fmt.Errorf("failed to search: %w", err)
+	}
+
+	go func() {
+		defer rows.Close()
+		defer close(ch)
+
+		results := make([]result, 0)
+		for rows.Next() {
+			var event nostr.Event
+			var createdAt int64
+			var info []byte
+			dest := []any{&event.ID, &event.PubKey, &createdAt, &event.Kind, &event.Tags, &event.Content, &event.Sig}
+			if !x.fts5 {
+				dest = append(dest, &info)
+			}
+			if err := rows.Scan(dest...); err != nil {
+				log.Printf("Failed to read search result: %v", err)
+				return
+			}
+			event.CreatedAt = nostr.Timestamp(createdAt)
+
+			if x.fts5 {
+				select {
+				case ch <- &event:
+				case <-ctx.Done():
+					return
+				}
+				continue
+			}
+
+			results = append(results, result{event: &event, score: bm25(info, columnWeights)})
+		}
+
+		// FTS4 can't rank, it happens here over the newest matches
+		slices.SortStableFunc(results, func(a, b result) int {
+			return cmp.Compare(b.score, a.score)
+		})
+		for _, r := range results[:min(limit, len(results))] {
+			select {
+			case ch <- r.event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+type result struct {
+	event *nostr.Event
+	score float64
+}
+
+// searchSQL translates filter, ok is false when nothing can match
+func (x *Index) searchSQL(filter nostr.Filter) (query string, params []any, limit int, ok bool) {
+	match := matchQuery(filter.Search, x.fts5)
+	if match == "" {
+		return "", nil, 0, false
+	}
+
+	kinds := searchableKinds
+	if len(filter.Kinds) > 0 {
+		kinds = slices.DeleteFunc(slices.Clone(searchableKinds), func(kind int) bool {
+			return !slices.Contains(filter.Kinds, kind)
+		})
+		if len(kinds) == 0 {
+			return "", nil, 0, false
+		}
+	}
+
+	conditions := []string{"search_text MATCH ?", "d.kind IN (" + placeholders(len(kinds)) + ")"}
+	params = []any{match}
+	for _, kind := range kinds {
+		params = append(params, kind)
+	}
+
+	if len(filter.IDs) > 0 {
+		conditions = append(conditions, "e.id IN ("+placeholders(len(filter.IDs))+")")
+		for _, id := range filter.IDs {
+			params = append(params, id)
+		}
+	}
+
+	if len(filter.Authors) > 0 {
+		conditions = append(conditions, "e.pubkey IN ("+placeholders(len(filter.Authors))+")")
+		for _, author := range filter.Authors {
+			params = append(params, author)
+		}
+	}
+
+	for name, values := range filter.Tags {
+		// "#e" scopes the search to channels, only messages belong to one
+		if name == "e" {
+			conditions = append(conditions, "d.kind <> 40 AND d.channel IN ("+placeholders(len(values))+")")
+			for _, value := range values {
+				params = append(params, value)
+			}
+			continue
+		}
+
+		conditions = append(conditions, `EXISTS (
+            SELECT 1 FROM json_each(CAST(e.tags AS TEXT)) t
+            WHERE json_extract(t.value, '$[0]') = ? AND json_extract(t.value, '$[1]') IN (`+placeholders(len(values))+`))`)
+		params = append(params, name)
+		for _, value := range values {
+			params = append(params, value)
+		}
+	}
+
+	if filter.Since != nil {
+		conditions = append(conditions, "e.created_at >= ?")
+		params = append(params, *filter.Since)
+	}
+
+	if filter.Until != nil {
+		conditions = append(conditions, "e.created_at <= ?")
+		params = append(params, *filter.Until)
+	}
+
+	limit = filter.Limit
+	if limit <= 0 {
+		limit = defaultLimit
+	}
+	limit = min(limit, maxLimit)
+
+	columns := "e.id, e.pubkey, e.created_at, e.kind, e.tags, e.content, e.sig"
+	order := "ORDER BY e.created_at DESC"
+	if x.fts5 {
+		order = fmt.Sprintf("ORDER BY bm25(search_text, %g, %g, %g), e.created_at DESC LIMIT ?",
+			columnWeights[0], columnWeights[1], columnWeights[2])
+		params = append(params, limit)
+	} else {
+		columns += ", matchinfo(search_text, 'pcnalx')"
+		order += " LIMIT ?"
+		params = append(params, maxCandidates)
+	}
+
+	query = `SELECT ` + columns + `
+        FROM search_text
+        JOIN search_document d ON d.docid = search_text.rowid
+        JOIN event e ON e.id = d.event_id
+        WHERE ` + strings.Join(conditions, " AND ") + `
+        ` + order
+
+	return query, params, limit, true
+}
+
+// matchQuery turns a NIP-50 search string into an FTS query: every word has
+// to match and the last one can be a prefix, so results show up while
+// typing. NIP-50 extensions (key:value) aren't supported and are ignored.
+func matchQuery(search string, fts5 bool) string {
+	terms := make([]string, 0)
+	for _, word := range strings.Fields(search) {
+		if strings.Contains(word, ":") {
+			continue
+		}
+
+		word = strings.ReplaceAll(word, `"`, "")
+		if word != "" {
+			terms = append(terms, word)
+		}
+	}
+
+	if len(terms) == 0 {
+		return ""
+	}
+
+	for i, term := range terms {
+		switch {
+		case i < len(terms)-1:
+			terms[i] = `"` + term + `"`
+		case fts5:
+			terms[i] = `"` + term + `"*`
+		default:
+			terms[i] = `"` + term + `*"`
+		}
+	}
+
+	return strings.Join(terms, " ")
+}
+
+func placeholders(n int) string {
+	return strings.TrimRight(strings.Repeat("?,", n), ",")
+}
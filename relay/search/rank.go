@@ -0,0 +1,49 @@
+package search
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// BM25 parameters, the same as the FTS5 bm25() function
+const (
+	k1 = 1.2
+	b  = 0.75
+)
+
+// bm25 scores a row from its FTS4 matchinfo(..., 'pcnalx') blob, higher is
+// better. It follows the FTS5 bm25() function so both builds rank alike.
+func bm25(info []byte, weights []float64) float64 {
+	values := make([]uint32, len(info)/4)
+	for i := range values {
+		values[i] = binary.NativeEndian.Uint32(info[i*4:])
+	}
+	if len(values) < 3 {
+		return 0
+	}
+
+	phrases, columns, rows := int(values[0]), int(values[1]), float64(values[2])
+	averages := values[3 : 3+columns]
+	lengths := values[3+columns : 3+2*columns]
+	hits := values[3+2*columns:]
+	if len(hits) < 3*phrases*columns {
+		return 0
+	}
+
+	score := 0.0
+	for p := 0; p < phrases; p++ {
+		for c := 0; c < columns && c < len(weights); c++ {
+			x := hits[3*(p*columns+c):]
+			frequency, matchingRows := float64(x[0]), float64(x[2])
+			if frequency == 0 {
+				continue
+			}
+
+			idf := math.Max(math.Log((rows-matchingRows+0.5)/(matchingRows+0.5)), 1e-6)
+			length := float64(lengths[c]) / math.Max(float64(averages[c]), 1)
+			score += weights[c] * idf * frequency * (k1 + 1) / (frequency + k1*(1-b+b*length))
+		}
+	}
+
+	return score
+}
@@ -0,0 +1,310 @@
+package search
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"nostr-relay/channels"
+	"nostr-relay/kinds"
+
+	"github.com/fiatjaf/eventstore/sqlite3"
+	"github.com/jmoiron/sqlx"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// search_document maps the rows of the full-text table to events. Channels
+// have a single document, keyed by their kind 40, holding the current
+// name and about; messages have one document each.
+var ddls = []string{
+	`CREATE TABLE IF NOT EXISTS search_document (
+       docid integer PRIMARY KEY,
+       event_id text NOT NULL UNIQUE,
+       channel text NOT NULL,
+       kind integer NOT NULL);`,
+	`CREATE INDEX IF NOT EXISTS searchchannelidx ON search_document(channel)`,
+}
+
+// FTS5 is only compiled in with the sqlite_fts5 build tag of go-sqlite3,
+// FTS4 is always there but has no ranking function, see bm25
+const (
+	fts5Table = `CREATE VIRTUAL TABLE search_text USING fts5(name, about, text, tokenize = 'unicode61 remove_diacritics 2')`
+	fts4Table = `CREATE VIRTUAL TABLE search_text USING fts4(name, about, text, tokenize=unicode61 "remove_diacritics=2")`
+)
+
+// Index is the NIP-50 full-text index over channel metadata and messages
+type Index struct {
+	db       *sqlite3.SQLite3Backend
+	channels *channels.Store
+	fts5     bool
+}
+
+func New(db *sqlite3.SQLite3Backend, channelStore *channels.Store) (*Index, error) {
+	for _, ddl := range ddls {
+		if _, err := db.Exec(ddl); err != nil {
+			return nil, fmt.Errorf("failed to create search tables: %w", err)
+		}
+	}
+
+	x := &Index{db: db, channels: channelStore}
+
+	var table string
+	err := db.Get(&table, "SELECT sql FROM sqlite_master WHERE name = 'search_text'")
+	switch {
+	case err == nil:
+		x.fts5 = strings.Contains(strings.ToLower(table), "fts5")
+		return x, nil
+	case !errors.Is(err, sql.ErrNoRows):
+		return nil, fmt.Errorf("failed to check search table: %w", err)
+	}
+
+	x.fts5 = true
+	if _, err := db.Exec(fts5Table); err != nil {
+		if !strings.Contains(err.Error(), "no such module") {
+			return nil, fmt.Errorf("failed to create search table: %w", err)
+		}
+
+		log.Printf("SQLite was built without FTS5 (go build -tags sqlite_fts5), ranking the newest %d matches of a search in Go", maxCandidates)
+		x.fts5 = false
+		if _, err := db.Exec(fts4Table); err != nil {
+			return nil, fmt.Errorf("failed to create search table: %w", err)
+		}
+	}
+
+	// a new index has to catch up with the events stored before it existed
+	count, err := x.Rebuild(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Search index created with %d documents", count)
+
+	return x, nil
+}
+
+// EventSaved is meant to be added to relay.OnEventSaved after the channel
+// store, which has the channel metadata to index
+func (x *Index) EventSaved(ctx context.Context, event *nostr.Event) {
+	if err := x.update(ctx, event); err != nil {
+		// a reindex will fix it, don't fail the event
+		log.Printf("Failed to index %s: %v", event.ID, err)
+	}
+}
+
+// EventDeleted is meant to be added to relay.DeleteEvent after the channel
+// store
+func (x *Index) EventDeleted(ctx context.Context, event *nostr.Event) error {
+	switch {
+	case event.Kind == 41:
+		return x.update(ctx, event)
+	case event.Kind == 40 || kinds.IsChannelMessage(event):
+		return x.inTx(ctx, func(tx *sqlx.Tx) error {
+			return remove(ctx, tx, event.ID)
+		})
+	}
+
+	return nil
+}
+
+func (x *Index) update(ctx context.Context, event *nostr.Event) error {
+	switch {
+	case event.Kind == 40 || event.Kind == 41:
+		id := event.ID
+		if event.Kind == 41 {
+			id = kinds.ChannelID(event)
+		}
+
+		channel, err := x.channels.Get(ctx, id)
+		if errors.Is(err, channels.ErrNotFound) {
+			return x.inTx(ctx, func(tx *sqlx.Tx) error {
+				return remove(ctx, tx, id)
+			})
+		}
+		if err != nil {
+			return err
+		}
+
+		return x.inTx(ctx, func(tx *sqlx.Tx) error {
+			return put(ctx, tx, document{eventID: channel.ID, channel: channel.ID, kind: 40, name: channel.Name, about: channel.About})
+		})
+
+	case kinds.IsChannelMessage(event):
+		return x.inTx(ctx, func(tx *sqlx.Tx) error {
+			return put(ctx, tx, messageDocument(event))
+		})
+	}
+
+	return nil
+}
+
+// Rebuild recreates the whole index from the channel table and the stored
+// messages
+func (x *Index) Rebuild(ctx context.Context) (int, error) {
+	count := 0
+	err := x.inTx(ctx, func(tx *sqlx.Tx) error {
+		for _, clear := range []string{"DELETE FROM search_text", "DELETE FROM search_document"} {
+			if _, err := tx.ExecContext(ctx, clear); err != nil {
+				return fmt.Errorf("failed to clear search index: %w", err)
+			}
+		}
+
+		documents := make([]document, 0)
+		rows, err := tx.QueryContext(ctx, "SELECT id, name, about FROM channel")
+		if err != nil {
+			return fmt.Errorf("failed to load channels: %w", err)
+		}
+		for rows.Next() {
+			doc := document{kind: 40}
+			if err := rows.Scan(&doc.eventID, &doc.name, &doc.about); err != nil {
+				rows.Close()
+				return err
+			}
+			doc.channel = doc.eventID
+			documents = append(documents, doc)
+		}
+		rows.Close()
+
+		// messages are loaded in pages, the statement can't stay open
+		// while the same transaction writes
+		var last int64
+		for {
+			page, next, err := loadMessages(ctx, tx, last, 1000)
+			if err != nil {
+				return err
+			}
+			if len(page) == 0 {
+				break
+			}
+			for _, event := range page {
+				documents = append(documents, messageDocument(event))
+			}
+			last = next
+
+			if err := putAll(ctx, tx, documents); err != nil {
+				return err
+			}
+			count += len(documents)
+			documents = documents[:0]
+		}
+
+		if err := putAll(ctx, tx, documents); err != nil {
+			return err
+		}
+		count += len(documents)
+
+		return nil
+	})
+
+	return count, err
+}
+
+func (x *Index) inTx(ctx context.Context, fn func(tx *sqlx.Tx) error) error {
+	tx, err := x.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+type document struct {
+	eventID string
+	channel string
+	kind    int
+	name    string
+	about   string
+	text    string
+}
+
+func messageDocument(event *nostr.Event) document {
+	text := event.Content
+	if event.Kind == 7353 {
+		text = kinds.PlainText(event.Content)
+	}
+
+	return document{eventID: event.ID, channel: kinds.ChannelID(event), kind: event.Kind, text: text}
+}
+
+func put(ctx context.Context, tx *sqlx.Tx, doc document) error {
+	if err := remove(ctx, tx, doc.eventID); err != nil {
+		return err
+	}
+
+	var docid int64
+	err := tx.GetContext(ctx, &docid, `
+        INSERT INTO search_document (event_id, channel, kind) VALUES ($1, $2, $3) RETURNING docid
+    `, doc.eventID, doc.channel, doc.kind)
+	if err != nil {
+		return fmt.Errorf("failed to add search document: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+        INSERT INTO search_text (rowid, name, about, text) VALUES ($1, $2, $3, $4)
+    `, docid, doc.name, doc.about, doc.text)
+	if err != nil {
+		return fmt.Errorf("failed to index search document: %w", err)
+	}
+
+	return nil
+}
+
+func putAll(ctx context.Context, tx *sqlx.Tx, documents []document) error {
+	for _, doc := range documents {
+		if err := put(ctx, tx, doc); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func remove(ctx context.Context, tx *sqlx.Tx, eventID string) error {
+	var docid int64
+	err := tx.GetContext(ctx, &docid, "SELECT docid FROM search_document WHERE event_id = $1", eventID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM search_text WHERE rowid = $1", docid); err != nil {
+		return fmt.Errorf("failed to remove search document: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM search_document WHERE docid = $1", docid); err != nil {
+		return fmt.Errorf("failed to remove search document: %w", err)
+	}
+
+	return nil
+}
+
+func loadMessages(ctx context.Context, tx *sqlx.Tx, after int64, limit int) ([]*nostr.Event, int64, error) {
+	rows, err := tx.QueryContext(ctx, `
+        SELECT rowid, id, pubkey, created_at, kind, tags, content, sig FROM event
+        WHERE kind IN (42, 7353) AND rowid > $1 ORDER BY rowid LIMIT $2
+    `, after, limit)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to load messages: %w", err)
+	}
+	defer rows.Close()
+
+	events := make([]*nostr.Event, 0, limit)
+	for rows.Next() {
+		var event nostr.Event
+		var createdAt int64
+		if err := rows.Scan(&after, &event.ID, &event.PubKey, &createdAt, &event.Kind, &event.Tags, &event.Content, &event.Sig); err != nil {
+			return nil, 0, err
+		}
+		event.CreatedAt = nostr.Timestamp(createdAt)
+		events = append(events, &event)
+	}
+
+	return events, after, rows.Err()
+}
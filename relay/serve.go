@@ -0,0 +1,475 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"nostr-relay/backfill"
+	"nostr-relay/blossom"
+	"nostr-relay/channels"
+	"nostr-relay/config"
+	"nostr-relay/dashboard"
+	"nostr-relay/deletion"
+	"nostr-relay/drives"
+	"nostr-relay/expiration"
+	"nostr-relay/fanout"
+	"nostr-relay/history"
+	"nostr-relay/ingest"
+	"nostr-relay/kinds"
+	"nostr-relay/management"
+	"nostr-relay/outbox"
+	"nostr-relay/pins"
+	"nostr-relay/reconcile"
+	"nostr-relay/replay"
+	"nostr-relay/retention"
+	"nostr-relay/search"
+	"nostr-relay/thumbnail"
+	"nostr-relay/transcript"
+	"nostr-relay/visible"
+
+	"github.com/fiatjaf/eventstore/sqlite3"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip11"
+)
+
+func runServe(cfg config.Config, args []string) error {
+	flags := newFlagSet("serve", "", &cfg)
+	flags.StringVar(&cfg.Host, "host", cfg.Host, "host to listen on")
+	flags.IntVar(&cfg.Port, "port", cfg.Port, "port to listen on")
+	flags.Parse(args)
+
+	log.Printf("Starting Nostr Comic Chat Relay...")
+
+	db, err := openDatabase(cfg)
+	if err != nil {
+		return err
+	}
+
+	// accepted events are queued and committed in batches by a single writer
+	writer, err := ingest.New(databaseDSN(cfg.DatabasePath), ingest.Options{
+		QueueSize:      cfg.WriteQueueSize,
+		BatchSize:      cfg.WriteBatchSize,
+		EnqueueTimeout: cfg.WriteQueueTimeout,
+	})
+	if err != nil {
+		db.Close()
+		return fmt.Errorf("writer initialization error: %w", err)
+	}
+
+	// a router so the subscriptions to channel messages can be handled by
+	// the fan-out index, see below
+	relay := khatru.NewRouter()
+	relay.ServiceURL = cfg.ServiceURL
+	lc := newLifecycle()
+
+	// NIP-86 management API, bans are enforced by the hooks below
+	manager, err := management.New(db, cfg.AdminPubKeys, relay.Info)
+	if err != nil {
+		return fmt.Errorf("management initialization error: %w", err)
+	}
+
+	// derived channel state, see the reindex command
+	channelStore, err := channels.New(db)
+	if err != nil {
+		return fmt.Errorf("channel state initialization error: %w", err)
+	}
+
+	// NIP-50 search over channel metadata and messages
+	searchIndex, err := search.New(db, channelStore)
+	if err != nil {
+		return fmt.Errorf("search index initialization error: %w", err)
+	}
+	relay.Info.SupportedNIPs = append(relay.Info.SupportedNIPs, 50)
+
+	// NIP-40, with per-channel defaults for messages
+	expirer, err := expiration.New(db, channelStore)
+	if err != nil {
+		return fmt.Errorf("expiration initialization error: %w", err)
+	}
+
+	// recent messages of the busiest channels, served from memory. Like the
+	// visible store, the buffers leave out what clients can't see, and are
+	// loaded again when that changes.
+	hot := history.New(db, cfg.HistoryCacheMessages, cfg.HistoryCacheSize, manager.VisibleSQL, expirer.VisibleSQL)
+	hot.Hidden = expirer.Expired
+	manager.OnBansChanged = append(manager.OnBansChanged, hot.Reset)
+	expirer.OnDefaultChanged = append(expirer.OnDefaultChanged, hot.Forget)
+
+	// deletions made by the relay itself go through the same hooks as
+	// NIP-09 deletion requests, so derived tables stay in sync
+	deleteEvent := func(ctx context.Context, event *nostr.Event) error {
+		if !lc.beginWrite() {
+			return errShuttingDown
+		}
+		defer lc.endWrite()
+
+		for _, del := range relay.DeleteEvent {
+			if err := del(ctx, event); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// NIP-09 permissions, channel tombstones and deleted ids
+	deletions, err := deletion.New(db, channelStore, manager.IsAdmin, deleteEvent)
+	if err != nil {
+		return fmt.Errorf("deletion policy initialization error: %w", err)
+	}
+	relay.OverwriteDeletionOutcome = append(relay.OverwriteDeletionOutcome, deletions.OverwriteDeletionOutcome)
+
+	// message retention per channel, bounded by the operator
+	retentionPolicy, err := retention.New(db, channelStore, retentionDefaults(cfg), retentionBounds(cfg))
+	if err != nil {
+		return fmt.Errorf("retention initialization error: %w", err)
+	}
+	if defaults := retentionPolicy.Defaults(); !defaults.IsZero() {
+		relay.Info.Retention = append(relay.Info.Retention, &nip11.RelayRetentionDocument{
+			Time:  int64(defaults.MaxAge.Seconds()),
+			Count: defaults.MaxMessages,
+			Kinds: [][]int{{42, 42}, {7353, 7353}},
+		})
+	}
+
+	// republishing to the relays declared by channels, when enabled
+	var republisher *outbox.Outbox
+	if cfg.Outbox {
+		republisher, err = outbox.New(db, channelStore, outbox.Options{
+			Self:        selfURLs(cfg),
+			MaxAttempts: cfg.OutboxMaxAttempts,
+			MinBackoff:  cfg.OutboxMinBackoff,
+			MaxBackoff:  cfg.OutboxMaxBackoff,
+		})
+		if err != nil {
+			return fmt.Errorf("outbox initialization error: %w", err)
+		}
+	}
+
+	// history of the channels learned from elsewhere, when enabled: fetched
+	// events go through the same hooks as published ones
+	var backfiller *backfill.Backfiller
+	if cfg.Backfill {
+		accept := func(ctx context.Context, event *nostr.Event) error {
+			return ingest.Accept(ctx, relay.Relay, event)
+		}
+		backfiller, err = backfill.New(db, channelStore, accept, backfill.Options{
+			Self:      selfURLs(cfg),
+			MaxAge:    cfg.BackfillMaxAge,
+			MaxEvents: cfg.BackfillMaxEvents,
+		})
+		if err != nil {
+			return fmt.Errorf("backfill initialization error: %w", err)
+		}
+	}
+
+	// character assets hosted next to the relay, when enabled
+	var blobs *blossom.Server
+	if cfg.Blossom {
+		blobs, err = blossom.New(db, blossom.Options{
+			Dir:        cfg.BlossomDir,
+			ServiceURL: cfg.ServiceURL,
+			MaxSize:    int64(cfg.BlossomMaxSize),
+			Types:      cfg.BlossomTypes,
+			Uploaders:  cfg.BlossomUploaders,
+			SVG:        cfg.BlossomSVG,
+		})
+		if err != nil {
+			return fmt.Errorf("blossom initialization error: %w", err)
+		}
+	}
+
+	// the blobs of new drives checked in the background, when enabled
+	var verifier *drives.Verifier
+	if cfg.VerifyDrives {
+		verifier, err = newVerifier(cfg, db, blobs)
+		if err != nil {
+			return fmt.Errorf("drive verifier initialization error: %w", err)
+		}
+	}
+
+	// the blobs of the drives used in channels kept in the Blossom store,
+	// when enabled
+	var pinner *pins.Pinner
+	if cfg.PinDrives {
+		if blobs == nil {
+			return fmt.Errorf("RELAY_PIN_DRIVES needs RELAY_BLOSSOM")
+		}
+		pinner, err = pins.New(db, blobs, db.QueryEvents, pins.Options{Quota: int64(cfg.PinQuota)})
+		if err != nil {
+			return fmt.Errorf("pinner initialization error: %w", err)
+		}
+	}
+
+	relay.ManagementAPI = manager.API()
+	relay.OverwriteRelayInformation = append(relay.OverwriteRelayInformation, manager.RelayInformation)
+	if len(cfg.AdminPubKeys) == 0 {
+		log.Printf("No admin pubkeys configured, the management API is disabled")
+	} else {
+		log.Printf("Management API enabled for %d admin pubkeys", len(cfg.AdminPubKeys))
+	}
+
+	// Add connection logging
+	relay.OnConnect = append(relay.OnConnect, func(ctx context.Context) {
+		log.Printf("New client connected")
+	}, lc.onConnect)
+
+	relay.OnDisconnect = append(relay.OnDisconnect, func(ctx context.Context) {
+		log.Printf("Client disconnected")
+	}, lc.onDisconnect)
+
+	relay.RejectConnection = append(relay.RejectConnection, lc.rejectConnection, manager.RejectConnection)
+
+	// Add event logging
+	activity := dashboard.NewActivity(100)
+	relay.OnEventSaved = append(relay.OnEventSaved, func(ctx context.Context, event *nostr.Event) {
+		log.Printf("Event saved: %s (kind: %d)", event.ID, event.Kind)
+	}, activity.EventSaved, channelStore.EventSaved, searchIndex.EventSaved, expirer.EventSaved, hot.EventSaved)
+
+	// after the channel store, so the relays are the ones just declared
+	if republisher != nil {
+		relay.OnEventSaved = append(relay.OnEventSaved, republisher.EventSaved)
+	}
+	if backfiller != nil {
+		relay.OnEventSaved = append(relay.OnEventSaved, backfiller.EventSaved)
+	}
+	if verifier != nil {
+		relay.OnEventSaved = append(relay.OnEventSaved, verifier.EventSaved)
+	}
+	if pinner != nil {
+		relay.OnEventSaved = append(relay.OnEventSaved, pinner.EventSaved)
+	}
+
+	relay.OnEphemeralEvent = append(relay.OnEphemeralEvent, func(ctx context.Context, event *nostr.Event) {
+		log.Printf("Ephemeral event received: %s (kind: %d)", event.ID, event.Kind)
+	})
+
+	// Set up storage handlers with detailed logging
+	relay.StoreEvent = append(relay.StoreEvent, func(ctx context.Context, event *nostr.Event) error {
+		// writes are tracked so a shutdown can wait for them before closing the database
+		if !lc.beginWrite() {
+			return errShuttingDown
+		}
+		defer lc.endWrite()
+
+		log.Printf("Attempting to store event: %s (kind: %d)", event.ID, event.Kind)
+		startTime := time.Now()
+
+		err := writer.SaveEvent(ctx, event)
+
+		duration := time.Since(startTime)
+		if err != nil {
+			log.Printf("Error storing event %s: %v (took %v)", event.ID, err, duration)
+		} else {
+			log.Printf("Successfully stored event %s (took %v)", event.ID, duration)
+		}
+
+		return err
+	})
+
+	// NIP-77 sessions reconcile what's visible to clients, but all of it
+	relay.Negentropy = true
+	// what's hidden is left out by the store queries, so their limits hold,
+	// and after the cache and the search index, which answer on their own
+	visibleEvents := visible.New(db, manager.VisibleSQL, deletions.VisibleSQL, expirer.VisibleSQL)
+	queryEvents := manager.HideBanned(deletions.HideTombstoned(expirer.HideExpired(searchIndex.Query(hot.Query(
+		reconcile.Query(db, cfg.NegentropyMaxItems, visibleEvents.QueryEvents))))))
+	relay.QueryEvents = append(relay.QueryEvents, queryEvents)
+	relay.CountEvents = append(relay.CountEvents, visibleEvents.CountEvents)
+	relay.DeleteEvent = append(relay.DeleteEvent, writer.DeleteEvent, channelStore.EventDeleted, searchIndex.EventDeleted, expirer.EventDeleted, hot.EventDeleted)
+	if pinner != nil {
+		relay.DeleteEvent = append(relay.DeleteEvent, pinner.EventDeleted)
+	}
+	relay.ReplaceEvent = append(relay.ReplaceEvent, writer.ReplaceEvent)
+
+	relay.RejectEvent = append(relay.RejectEvent, rejectEvent(db, manager, expirer, deletions)...)
+	// pruned messages aren't taken back, from peers and backfill either
+	relay.RejectEvent = append(relay.RejectEvent, retentionPolicy.RejectEvent)
+
+	// keep this after every RejectEvent hook so the dashboard sees all rejections
+	relay.RejectEvent = activity.TrackRejections(relay.RejectEvent)
+
+	// the HTTP endpoints get deadlines of their own, see withDeadlines
+	mux := http.NewServeMux()
+	relay.Router().Handle("/", withDeadlines(mux, cfg.HTTPReadTimeout, cfg.HTTPWriteTimeout))
+
+	// Health endpoints for load balancers and orchestrators
+	mux.HandleFunc("/healthz", healthz)
+	mux.HandleFunc("/readyz", readyz(lc, db, writer))
+
+	// Admin dashboard, using the same operations as the management API
+	admin := dashboard.New(relay.Relay, manager, channelStore, db, cfg, activity, lc.connections, deleteEvent)
+	admin.Register(mux)
+	if republisher != nil {
+		mux.HandleFunc("GET /admin/outbox", admin.RequireAdmin(republisher.HandleStatus))
+	}
+	if backfiller != nil {
+		mux.HandleFunc("GET /admin/backfill", admin.RequireAdmin(backfiller.HandleStatus))
+	}
+
+	if blobs != nil {
+		blobs.Register(mux)
+		log.Printf("Blossom server enabled, storing blobs in %s", cfg.BlossomDir)
+	}
+	if verifier != nil {
+		mux.HandleFunc("GET /admin/drives", admin.RequireAdmin(verifier.HandleStatus))
+	}
+	if pinner != nil {
+		mux.HandleFunc("GET /admin/pins", admin.RequireAdmin(pinner.HandleStatus))
+		log.Printf("Pinning the blobs of drives used in channels, %d bytes per author", cfg.PinQuota)
+	}
+
+	var thumbnails *thumbnail.Server
+	if cfg.Thumbnails {
+		thumbnails, err = thumbnail.New(queryEvents, localStore(blobs), channelStore, thumbnail.Options{
+			Dir:       cfg.ThumbnailDir,
+			CacheSize: int64(cfg.ThumbnailCacheSize),
+			Sizes:     cfg.ThumbnailSizes,
+			MaxSize:   int64(cfg.BlossomMaxSize),
+		})
+		if err != nil {
+			return fmt.Errorf("thumbnail initialization error: %w", err)
+		}
+		thumbnails.Register(mux)
+		log.Printf("Serving thumbnails at sizes %v, cached in %s", cfg.ThumbnailSizes, cfg.ThumbnailDir)
+	}
+
+	// transcripts are drawn from what subscriptions would return, hidden
+	// events left out
+	if cfg.ComicExport {
+		exporter := newExporter(cfg, queryEvents, blobs, transcript.Options{
+			Thumbnails: thumbnails,
+			CacheSize:  cfg.ComicExportCacheSize,
+			CacheTTL:   cfg.ComicExportCacheTTL,
+		})
+		relay.OnEventSaved = append(relay.OnEventSaved, exporter.EventSaved)
+		relay.DeleteEvent = append(relay.DeleteEvent, exporter.EventDeleted)
+		mux.HandleFunc("GET /channels/{id}/comic", exporter.HandleExport)
+		mux.HandleFunc("GET /channels/{id}/replay", replay.Handler(exporter, replay.Options{Compression: cfg.ReplayCompression}))
+		log.Printf("Serving channel transcripts as comic strips at /channels/{id}/comic and replays at /channels/{id}/replay")
+	}
+
+	// peers kept in sync with NIP-77, when configured
+	var syncer *reconcile.Syncer
+	if len(cfg.SyncPeers) > 0 {
+		syncer = reconcile.New(queryEvents, func(ctx context.Context, event *nostr.Event) error {
+			return ingest.Accept(ctx, relay.Relay, event)
+		}, reconcile.Options{
+			Peers:     cfg.SyncPeers,
+			Filters:   cfg.SyncFilters,
+			Direction: reconcile.Direction(cfg.SyncDirection),
+		})
+		mux.HandleFunc("GET /admin/sync", admin.RequireAdmin(syncer.HandleStatus))
+		log.Printf("Syncing with %d peers every %v", len(cfg.SyncPeers), cfg.SyncInterval)
+	}
+
+	// a deletion request is remembered once every other hook removed what
+	// it deletes
+	relay.DeleteEvent = append(relay.DeleteEvent, deletions.EventDeleted)
+
+	// last, the subscriptions to channel messages are answered with the
+	// hooks set above
+	fanout.Install(relay)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	started := make(chan bool)
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- relay.Start(cfg.Host, cfg.Port, started)
+	}()
+
+	select {
+	case <-started:
+		fmt.Printf("Nostr Comic Chat Relay running on %s\n", net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port)))
+	case err := <-serveErr:
+		writer.Close(context.Background())
+		db.Close()
+		return fmt.Errorf("failed to start relay: %w", err)
+	}
+
+	// expired events go through the same hooks as deletion requests.
+	// khatru.NewRelay starts a NIP-40 sweeper of its own, which can't be
+	// turned off: it only knows expiration tags, not channel defaults, and
+	// wakes up hourly, so what it would delete is normally swept already and
+	// its lookup finds nothing.
+	go expirer.Run(ctx, cfg.ExpirationSweepInterval, deleteEvent)
+	go retentionPolicy.Run(ctx, cfg.RetentionInterval, cfg.RetentionDryRun, deleteEvent)
+	if republisher != nil {
+		go republisher.Run(ctx, cfg.OutboxInterval)
+	}
+	if backfiller != nil {
+		go backfiller.Run(ctx, cfg.BackfillInterval)
+	}
+	if syncer != nil {
+		go syncer.Run(ctx, cfg.SyncInterval)
+	}
+	if verifier != nil {
+		go verifier.Run(ctx)
+	}
+	if pinner != nil {
+		go pinner.Run(ctx, cfg.PinInterval)
+	}
+
+	select {
+	case <-ctx.Done():
+		log.Printf("Received shutdown signal, stopping relay (deadline %v)...", cfg.ShutdownTimeout)
+	case err := <-serveErr:
+		if err != nil {
+			log.Printf("Relay stopped unexpectedly: %v", err)
+		}
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	lc.shutdown(shutdownCtx, relay.Relay, writer, db)
+	log.Printf("Relay stopped")
+	return nil
+}
+
+// rejectEvent are the checks events go through before they're stored, when
+// published and when imported: bans, expiration, deletions, then the rules
+// of each kind
+func rejectEvent(db *sqlite3.SQLite3Backend, manager *management.Manager, expirer *expiration.Expirer, deletions *deletion.Policy) []func(ctx context.Context, event *nostr.Event) (bool, string) {
+	hooks := []func(ctx context.Context, event *nostr.Event) (bool, string){manager.RejectEvent, expirer.RejectEvent, deletions.RejectEvent}
+	return append(hooks, kinds.Validators(db)...)
+}
+
+// withDeadlines replaces the 2s read and write deadlines of the server
+// khatru starts, too short for uploads, exports and renders, with longer
+// ones. Websockets don't go through here.
+func withDeadlines(next http.Handler, read time.Duration, write time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		now := time.Now()
+		if err := rc.SetReadDeadline(now.Add(read)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			log.Printf("Failed to set the read deadline of %s: %v", r.URL.Path, err)
+		}
+		if err := rc.SetWriteDeadline(now.Add(write)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			log.Printf("Failed to set the write deadline of %s: %v", r.URL.Path, err)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// selfURLs are the URLs this relay can be reached at, which channels often
+// declare and which the outbox and the backfill must leave out
+func selfURLs(cfg config.Config) []string {
+	port := strconv.Itoa(cfg.Port)
+	urls := []string{cfg.ServiceURL, "ws://" + net.JoinHostPort("localhost", port), "ws://" + net.JoinHostPort("127.0.0.1", port)}
+	if cfg.Host != "" {
+		urls = append(urls, "ws://"+net.JoinHostPort(cfg.Host, port))
+	}
+	return urls
+}
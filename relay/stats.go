@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"nostr-relay/channels"
+	"nostr-relay/config"
+)
+
+func runStats(cfg config.Config, args []string) error {
+	flags := newFlagSet("stats", "", &cfg)
+	limit := flags.Int("channels", 50, "how many channels to list")
+	flags.Parse(args)
+
+	db, err := openDatabase(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+
+	rows, err := db.QueryContext(ctx, "SELECT kind, COUNT(*) FROM event GROUP BY kind ORDER BY kind")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "KIND\tEVENTS")
+
+	var total int64
+	for rows.Next() {
+		var kind int
+		var count int64
+		if err := rows.Scan(&kind, &count); err != nil {
+			return err
+		}
+		total += count
+		fmt.Fprintf(w, "%d\t%d\n", kind, count)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "total\t%d\n\n", total)
+
+	channelStore, err := channels.New(db)
+	if err != nil {
+		return err
+	}
+
+	list, err := channelStore.List(ctx, *limit)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w, "CHANNEL\tNAME\tMESSAGES\tLAST MESSAGE")
+	for _, channel := range list {
+		last := "never"
+		if channel.LastMessageAt > 0 {
+			last = channel.LastMessageAt.Time().Format("2006-01-02 15:04")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", channel.ID, channel.Name, channel.Messages, last)
+	}
+
+	return w.Flush()
+}
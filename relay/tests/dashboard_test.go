@@ -0,0 +1,110 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// dashboardLogin logs into the admin dashboard with NIP-98 and returns a
+// client holding the session cookie
+func dashboardLogin(ctx context.Context, t *testing.T, privateKey string) (*http.Client, int) {
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+
+	loginURL := relayHTTPURL + "/admin/login"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, loginURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	req.Header.Set("Authorization", nip98Header(t, privateKey, loginURL, http.MethodPost, nil))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to log in: %v", err)
+	}
+	resp.Body.Close()
+
+	return client, resp.StatusCode
+}
+
+func TestDashboardLogin(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), TestTimeout)
+	defer cancel()
+
+	client, status := dashboardLogin(ctx, t, admin.PrivateKey)
+	assert.Equal(t, http.StatusNoContent, status)
+
+	for _, page := range []string{"/admin/", "/admin/channels", "/admin/moderation", "/admin/config"} {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, relayHTTPURL+page, nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to get %s: %v", page, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode, page)
+		assert.Contains(t, string(body), "Log out", page)
+	}
+}
+
+func TestDashboardRejectsNonAdmins(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), TestTimeout)
+	defer cancel()
+
+	_, status := dashboardLogin(ctx, t, nostr.GeneratePrivateKey())
+	assert.Equal(t, http.StatusForbidden, status)
+
+	// without a session we are sent to the login page
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, relayHTTPURL+"/admin/", nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to get dashboard: %v", err)
+	}
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	assert.Equal(t, "/admin/login", resp.Header.Get("Location"))
+}
+
+// TestDashboardDeleteEvent deletes an event with an action authorized by
+// NIP-98, the payload hash covering the form
+func TestDashboardDeleteEvent(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), TestTimeout)
+	defer cancel()
+
+	relay, err := nostr.RelayConnect(ctx, RelayURL)
+	require.NoError(t, err)
+	defer relay.Close()
+
+	event := publishSigned(ctx, t, relay, nostr.Event{Kind: 1, Content: "deleted from the dashboard"})
+
+	actionURL := relayHTTPURL + "/admin/actions/delete-event"
+	body := []byte(url.Values{"id": {event.ID}}.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, actionURL, bytes.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", nip98Header(t, admin.PrivateKey, actionURL, http.MethodPost, body))
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusSeeOther, resp.StatusCode)
+
+	assert.Empty(t, searchIDs(ctx, t, relay, nostr.Filter{IDs: []string{event.ID}}))
+}
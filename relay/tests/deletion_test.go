@@ -0,0 +1,109 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// publishAs signs ev with privateKey and publishes it. The events aren't
+// tracked for cleanup, which deletes with the admin key.
+func publishAs(ctx context.Context, relay *nostr.Relay, privateKey string, ev nostr.Event) (nostr.Event, error) {
+	if ev.CreatedAt == 0 {
+		ev.CreatedAt = nostr.Now()
+	}
+	if err := ev.Sign(privateKey); err != nil {
+		return ev, err
+	}
+
+	return ev, relay.Publish(ctx, ev)
+}
+
+func deletionRequest(ids ...string) nostr.Event {
+	tags := nostr.Tags{}
+	for _, id := range ids {
+		tags = append(tags, nostr.Tag{"e", id})
+	}
+
+	return nostr.Event{Kind: 5, Tags: tags}
+}
+
+func TestDeletion(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), TestTimeout)
+	defer cancel()
+
+	relay, err := nostr.RelayConnect(ctx, RelayURL)
+	require.NoError(t, err)
+	defer func() {
+		cleanupTestEvents(ctx, relay)
+		relay.Close()
+	}()
+
+	owner := nostr.GeneratePrivateKey()
+	moderator := nostr.GeneratePrivateKey()
+	moderatorPubKey, _ := nostr.GetPublicKey(moderator)
+	member := nostr.GeneratePrivateKey()
+	stranger := nostr.GeneratePrivateKey()
+
+	content, _ := json.Marshal(map[string]any{"name": "Moderated", "moderators": []string{moderatorPubKey}})
+	channel, err := publishAs(ctx, relay, owner, nostr.Event{Kind: 40, Content: string(content)})
+	require.NoError(t, err)
+	root := nostr.Tags{{"e", channel.ID, RelayURL, "root"}}
+
+	update, err := publishAs(ctx, relay, owner, nostr.Event{Kind: 41, Content: string(content), Tags: root})
+	require.NoError(t, err)
+
+	// numbered so messages posted in the same second have different ids
+	posted := 0
+	post := func(t *testing.T) nostr.Event {
+		posted++
+		message, err := publishAs(ctx, relay, member, nostr.Event{Kind: 42, Content: fmt.Sprintf("hello %d", posted), Tags: root})
+		require.NoError(t, err)
+		return message
+	}
+
+	t.Run("strangers can't delete messages", func(t *testing.T) {
+		message := post(t)
+		_, err := publishAs(ctx, relay, stranger, deletionRequest(message.ID))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "moderator")
+		assert.Equal(t, []string{message.ID}, searchIDs(ctx, t, relay, nostr.Filter{IDs: []string{message.ID}}))
+	})
+
+	for name, key := range map[string]string{"author": member, "owner": owner, "moderator": moderator} {
+		t.Run(name+" deletes a message", func(t *testing.T) {
+			message := post(t)
+			_, err := publishAs(ctx, relay, key, deletionRequest(message.ID))
+			require.NoError(t, err)
+			assert.Empty(t, searchIDs(ctx, t, relay, nostr.Filter{IDs: []string{message.ID}}))
+
+			_, err = publishAs(ctx, relay, member, message)
+			require.Error(t, err, "deleted events can't be published again")
+			assert.Contains(t, err.Error(), "deleted")
+		})
+	}
+
+	t.Run("only the owner deletes the channel", func(t *testing.T) {
+		_, err := publishAs(ctx, relay, moderator, deletionRequest(channel.ID))
+		require.Error(t, err)
+
+		_, err = publishAs(ctx, relay, owner, deletionRequest(channel.ID))
+		require.NoError(t, err)
+
+		ids := searchIDs(ctx, t, relay, nostr.Filter{IDs: []string{channel.ID, update.ID}})
+		assert.Empty(t, ids, "the channel and its updates are gone")
+
+		_, err = publishAs(ctx, relay, member, nostr.Event{Kind: 42, Content: "anyone?", Tags: root})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "channel has been deleted")
+
+		_, err = publishAs(ctx, relay, owner, nostr.Event{Kind: 41, Content: string(content), Tags: root})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "channel has been deleted")
+	})
+}
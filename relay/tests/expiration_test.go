@@ -0,0 +1,65 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpiration(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), TestTimeout)
+	defer cancel()
+
+	relay, err := nostr.RelayConnect(ctx, RelayURL)
+	require.NoError(t, err)
+	defer func() {
+		cleanupTestEvents(ctx, relay)
+		relay.Close()
+	}()
+
+	expiresIn := func(d time.Duration) nostr.Tag {
+		return nostr.Tag{"expiration", strconv.FormatInt(time.Now().Add(d).Unix(), 10)}
+	}
+
+	t.Run("expired events are rejected", func(t *testing.T) {
+		ev := nostr.Event{Kind: 1, CreatedAt: nostr.Now(), Content: "too late", Tags: nostr.Tags{expiresIn(-time.Minute)}}
+		require.NoError(t, ev.Sign(admin.PrivateKey))
+
+		err := relay.Publish(ctx, ev)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "expired")
+	})
+
+	t.Run("expired events are hidden", func(t *testing.T) {
+		ev := publishSigned(ctx, t, relay, nostr.Event{Kind: 1, Content: "short lived", Tags: nostr.Tags{expiresIn(2 * time.Second)}})
+		assert.Equal(t, []string{ev.ID}, searchIDs(ctx, t, relay, nostr.Filter{IDs: []string{ev.ID}}))
+
+		time.Sleep(3 * time.Second)
+		assert.Empty(t, searchIDs(ctx, t, relay, nostr.Filter{IDs: []string{ev.ID}}))
+	})
+
+	t.Run("channel default", func(t *testing.T) {
+		content, _ := json.Marshal(map[string]any{"name": "Party", "about": "Nothing stays", "message_expiration": 2})
+		channel := publishSigned(ctx, t, relay, nostr.Event{Kind: 40, Content: string(content)})
+		root := nostr.Tags{{"e", channel.ID, RelayURL, "root"}}
+
+		message := publishSigned(ctx, t, relay, nostr.Event{Kind: 42, Content: "see you never", Tags: root})
+		kept := publishSigned(ctx, t, relay, nostr.Event{Kind: 42, Content: "I stay a bit longer", Tags: append(root, expiresIn(time.Minute))})
+
+		old := nostr.Event{Kind: 42, CreatedAt: nostr.Now() - 10, Content: "from the past", Tags: root}
+		require.NoError(t, old.Sign(admin.PrivateKey))
+		assert.Error(t, relay.Publish(ctx, old), "messages older than the channel expiration are already expired")
+
+		filter := nostr.Filter{Kinds: []int{42}, Tags: nostr.TagMap{"e": {channel.ID}}}
+		assert.ElementsMatch(t, []string{message.ID, kept.ID}, searchIDs(ctx, t, relay, filter))
+
+		time.Sleep(3 * time.Second)
+		assert.Equal(t, []string{kept.ID}, searchIDs(ctx, t, relay, filter))
+	})
+}
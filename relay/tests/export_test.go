@@ -0,0 +1,65 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestLargeExport renders a channel of 500 messages, which takes longer
+// than the 2s deadlines khatru gives requests. Needs RELAY_COMIC_EXPORT.
+func TestLargeExport(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Minute)
+	defer cancel()
+
+	relay, err := nostr.RelayConnect(ctx, RelayURL)
+	require.NoError(t, err)
+	defer func() {
+		cleanupTestEvents(ctx, relay)
+		relay.Close()
+	}()
+
+	content, _ := json.Marshal(map[string]any{"name": "Long conversation", "about": "Many messages to draw"})
+	channel := publishSigned(ctx, t, relay, nostr.Event{Kind: 40, Content: string(content), CreatedAt: nostr.Now() - 1000})
+	if status, _ := getEndpoint(t, "/channels/"+channel.ID+"/comic?format=html"); status == http.StatusNotFound {
+		t.Skip("comic export is disabled, set RELAY_COMIC_EXPORT")
+	}
+
+	for i := range 500 {
+		publishSigned(ctx, t, relay, nostr.Event{
+			Kind:      7353,
+			Content:   fmt.Sprintf("message %d, with a few words so balloons have some text to wrap", i),
+			CreatedAt: channel.CreatedAt + nostr.Timestamp(i+1),
+			Tags:      nostr.Tags{{"e", channel.ID, RelayURL, "root"}},
+		})
+	}
+
+	for path, magic := range map[string]string{
+		"/channels/" + channel.ID + "/comic?format=png":   "PK",
+		"/channels/" + channel.ID + "/replay?format=gif":  "GIF89a",
+		"/channels/" + channel.ID + "/replay?format=apng": "\x89PNG",
+	} {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, relayHTTPURL+path, nil)
+		require.NoError(t, err)
+
+		start := time.Now()
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err, path)
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err, path)
+
+		t.Logf("%s: %d bytes in %v", path, len(body), time.Since(start))
+		assert.Equal(t, http.StatusOK, resp.StatusCode, path)
+		assert.True(t, bytes.HasPrefix(body, []byte(magic)), path)
+	}
+}
@@ -0,0 +1,76 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// received waits a little for the next event of sub, nil if none came
+func received(sub *nostr.Subscription) *nostr.Event {
+	select {
+	case event := <-sub.Events:
+		return event
+	case <-time.After(500 * time.Millisecond):
+		return nil
+	}
+}
+
+// TestFanout checks live channel messages reach the subscriptions of their
+// channel, which are indexed, and the other ones, which khatru matches
+func TestFanout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), TestTimeout)
+	defer cancel()
+
+	relay, err := nostr.RelayConnect(ctx, RelayURL)
+	require.NoError(t, err)
+	defer func() {
+		cleanupTestEvents(ctx, relay)
+		relay.Close()
+	}()
+
+	listener, err := nostr.RelayConnect(ctx, RelayURL)
+	require.NoError(t, err)
+	defer listener.Close()
+
+	content, _ := json.Marshal(map[string]any{"name": "Fan-out"})
+	channel := publishSigned(ctx, t, relay, nostr.Event{Kind: 40, Content: string(content)})
+	other := publishSigned(ctx, t, relay, nostr.Event{Kind: 40, Content: string(content), CreatedAt: nostr.Now() - 1})
+
+	now := nostr.Now()
+	subscribe := func(filter nostr.Filter) *nostr.Subscription {
+		filter.Since = &now
+		sub, err := listener.Subscribe(ctx, nostr.Filters{filter})
+		require.NoError(t, err)
+		// drain up to EOSE so only live events are left
+		<-sub.EndOfStoredEvents
+		return sub
+	}
+
+	room := subscribe(nostr.Filter{Kinds: []int{42, 7353}, Tags: nostr.TagMap{"e": {channel.ID}}})
+	comics := subscribe(nostr.Filter{Kinds: []int{7353}, Tags: nostr.TagMap{"e": {channel.ID}}})
+	elsewhere := subscribe(nostr.Filter{Kinds: []int{42, 7353}, Tags: nostr.TagMap{"e": {other.ID}}})
+	everything := subscribe(nostr.Filter{Kinds: []int{42}})
+
+	message := publishSigned(ctx, t, relay, nostr.Event{Kind: 42, Content: "live", Tags: nostr.Tags{{"e", channel.ID, RelayURL, "root"}}})
+
+	if event := received(room); assert.NotNil(t, event) {
+		assert.Equal(t, message.ID, event.ID)
+	}
+	if event := received(everything); assert.NotNil(t, event) {
+		assert.Equal(t, message.ID, event.ID)
+	}
+	assert.Nil(t, received(comics), "other kinds don't match")
+	assert.Nil(t, received(elsewhere), "other channels don't match")
+
+	t.Run("closed subscriptions get nothing", func(t *testing.T) {
+		room.Unsub()
+		publishSigned(ctx, t, relay, nostr.Event{Kind: 42, Content: "anyone?", Tags: nostr.Tags{{"e", channel.ID, RelayURL, "root"}}})
+		assert.Nil(t, received(room))
+	})
+}
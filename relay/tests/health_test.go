@@ -0,0 +1,51 @@
+package tests
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// relayHTTPURL is the plain HTTP address of the relay, derived from RelayURL
+var relayHTTPURL = strings.Replace(RelayURL, "ws://", "http://", 1)
+
+func getEndpoint(t *testing.T, path string) (int, string) {
+	ctx, cancel := context.WithTimeout(context.Background(), TestTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, relayHTTPURL+path, nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to call %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read %s response: %v", path, err)
+	}
+
+	return resp.StatusCode, string(body)
+}
+
+func TestHealthz(t *testing.T) {
+	status, body := getEndpoint(t, "/healthz")
+
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "ok\n", body)
+}
+
+func TestReadyz(t *testing.T) {
+	status, body := getEndpoint(t, "/readyz")
+
+	assert.Equal(t, http.StatusOK, status, "relay should be ready: %s", body)
+	assert.Equal(t, "ready\n", body)
+}
@@ -0,0 +1,82 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestHistory checks recent channel history stays right while it's served
+// from memory: the first query loads it, the next ones must see new and
+// deleted messages.
+func TestHistory(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), TestTimeout)
+	defer cancel()
+
+	relay, err := nostr.RelayConnect(ctx, RelayURL)
+	require.NoError(t, err)
+	defer func() {
+		cleanupTestEvents(ctx, relay)
+		relay.Close()
+	}()
+
+	content, _ := json.Marshal(map[string]any{"name": "History"})
+	channel := publishSigned(ctx, t, relay, nostr.Event{Kind: 40, Content: string(content)})
+	root := nostr.Tags{{"e", channel.ID, RelayURL, "root"}}
+
+	start := nostr.Now() - 100
+	messages := make([]nostr.Event, 0)
+	for i := range 5 {
+		messages = append(messages, publishSigned(ctx, t, relay, nostr.Event{
+			Kind: 42, Content: fmt.Sprintf("message %d", i), Tags: root, CreatedAt: start + nostr.Timestamp(i),
+		}))
+	}
+
+	recent := func(limit int, until *nostr.Timestamp) []string {
+		return searchIDs(ctx, t, relay, nostr.Filter{
+			Kinds: []int{42, 7353}, Tags: nostr.TagMap{"e": {channel.ID}}, Limit: limit, Until: until,
+		})
+	}
+
+	assert.Equal(t, []string{messages[4].ID, messages[3].ID, messages[2].ID}, recent(3, nil))
+	assert.Equal(t, []string{messages[4].ID, messages[3].ID, messages[2].ID}, recent(3, nil), "same answer once cached")
+
+	t.Run("new messages come first", func(t *testing.T) {
+		latest := publishSigned(ctx, t, relay, nostr.Event{Kind: 7353, Content: "<bold>latest</bold>", Tags: root, CreatedAt: start + 10})
+		messages = append(messages, latest)
+		assert.Equal(t, []string{latest.ID, messages[4].ID}, recent(2, nil))
+	})
+
+	t.Run("older messages fill in", func(t *testing.T) {
+		// older than everything, but the buffer holds the whole channel
+		oldest := publishSigned(ctx, t, relay, nostr.Event{Kind: 42, Content: "late", Tags: root, CreatedAt: start - 10})
+		ids := recent(0, nil)
+		require.Len(t, ids, 7)
+		assert.Equal(t, oldest.ID, ids[6])
+	})
+
+	t.Run("deleted messages are gone", func(t *testing.T) {
+		publishSigned(ctx, t, relay, deletionRequest(messages[4].ID))
+		assert.Equal(t, []string{messages[5].ID, messages[3].ID, messages[2].ID}, recent(3, nil))
+	})
+
+	t.Run("banned messages don't count in the limit", func(t *testing.T) {
+		resp := callManagementAPI(ctx, t, admin.PrivateKey, "banevent", messages[3].ID, "history")
+		require.Empty(t, resp.Error)
+		assert.Equal(t, []string{messages[5].ID, messages[2].ID}, recent(2, nil))
+
+		resp = callManagementAPI(ctx, t, admin.PrivateKey, "allowevent", messages[3].ID, "history")
+		require.Empty(t, resp.Error)
+		assert.Equal(t, []string{messages[5].ID, messages[3].ID}, recent(2, nil))
+	})
+
+	t.Run("until", func(t *testing.T) {
+		until := start + 2
+		assert.Equal(t, []string{messages[2].ID, messages[1].ID}, recent(2, &until))
+	})
+}
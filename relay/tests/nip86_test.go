@@ -0,0 +1,193 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip86"
+	"github.com/stretchr/testify/assert"
+)
+
+// nip98Header returns a NIP-98 "Authorization" header value for a request
+func nip98Header(t *testing.T, privateKey string, url string, method string, body []byte) string {
+	tags := nostr.Tags{{"u", url}, {"method", method}}
+	if body != nil {
+		payloadHash := sha256.Sum256(body)
+		tags = append(tags, nostr.Tag{"payload", hex.EncodeToString(payloadHash[:])})
+	}
+
+	auth := nostr.Event{
+		Kind:      27235,
+		CreatedAt: nostr.Now(),
+		Tags:      tags,
+	}
+	if err := auth.Sign(privateKey); err != nil {
+		t.Fatalf("Failed to sign auth event: %v", err)
+	}
+	authj, _ := json.Marshal(auth)
+
+	return "Nostr " + base64.StdEncoding.EncodeToString(authj)
+}
+
+// callManagementAPI sends a NIP-86 request signed (NIP-98) with privateKey.
+// The relay must be started with the admin pubkey in RELAY_ADMIN_PUBKEYS.
+func callManagementAPI(ctx context.Context, t *testing.T, privateKey string, method string, params ...any) nip86.Response {
+	body, err := json.Marshal(nip86.Request{Method: method, Params: params})
+	if err != nil {
+		t.Fatalf("Failed to marshal request: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, relayHTTPURL, bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/nostr+json+rpc")
+	req.Header.Set("Authorization", nip98Header(t, privateKey, relayHTTPURL, http.MethodPost, body))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to call %s: %v", method, err)
+	}
+	defer resp.Body.Close()
+
+	var result nip86.Response
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("Failed to decode %s response: %v", method, err)
+	}
+
+	log.Printf("NIP-86 %s -> result: %v, error: %q", method, result.Result, result.Error)
+	return result
+}
+
+func TestManagementRequiresAdmin(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), TestTimeout)
+	defer cancel()
+
+	resp := callManagementAPI(ctx, t, nostr.GeneratePrivateKey(), "listbannedpubkeys")
+	assert.Contains(t, resp.Error, "unauthorized")
+	assert.Nil(t, resp.Result)
+}
+
+func TestManagementBanPubKey(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), TestTimeout)
+	defer cancel()
+
+	relay, err := nostr.RelayConnect(ctx, RelayURL)
+	if err != nil {
+		t.Fatalf("Failed to connect to relay: %v", err)
+	}
+	defer relay.Close()
+
+	bannedKey := nostr.GeneratePrivateKey()
+	bannedPubKey, _ := nostr.GetPublicKey(bannedKey)
+
+	resp := callManagementAPI(ctx, t, admin.PrivateKey, "banpubkey", bannedPubKey, "test ban")
+	assert.Empty(t, resp.Error)
+	assert.Equal(t, true, resp.Result)
+
+	resp = callManagementAPI(ctx, t, admin.PrivateKey, "listbannedpubkeys")
+	assert.Empty(t, resp.Error)
+	assert.Contains(t, resp.Result, map[string]any{"pubkey": bannedPubKey, "reason": "test ban"})
+
+	// events from the banned pubkey are refused
+	ev := nostr.Event{
+		Kind:      1,
+		CreatedAt: nostr.Timestamp(time.Now().Unix()),
+		Tags:      nostr.Tags{},
+		Content:   "I am banned",
+	}
+	if err := ev.Sign(bannedKey); err != nil {
+		t.Fatalf("Failed to sign event: %v", err)
+	}
+	err = relay.Publish(ctx, ev)
+	assert.ErrorContains(t, err, "pubkey is banned")
+
+	// lifting the ban lets them publish again
+	resp = callManagementAPI(ctx, t, admin.PrivateKey, "allowpubkey", bannedPubKey, "test unban")
+	assert.Empty(t, resp.Error)
+
+	ev.CreatedAt = nostr.Timestamp(time.Now().Unix())
+	if err := ev.Sign(bannedKey); err != nil {
+		t.Fatalf("Failed to sign event: %v", err)
+	}
+	assert.NoError(t, relay.Publish(ctx, ev))
+}
+
+func TestManagementBanEvent(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), TestTimeout)
+	defer cancel()
+
+	relay, err := nostr.RelayConnect(ctx, RelayURL)
+	if err != nil {
+		t.Fatalf("Failed to connect to relay: %v", err)
+	}
+	defer relay.Close()
+
+	ev := nostr.Event{
+		Kind:      1,
+		CreatedAt: nostr.Timestamp(time.Now().Unix()),
+		Tags:      nostr.Tags{},
+		Content:   "This will be banned",
+	}
+	if err := ev.Sign(nostr.GeneratePrivateKey()); err != nil {
+		t.Fatalf("Failed to sign event: %v", err)
+	}
+	if err := relay.Publish(ctx, ev); err != nil {
+		t.Fatalf("Failed to publish event: %v", err)
+	}
+
+	resp := callManagementAPI(ctx, t, admin.PrivateKey, "banevent", ev.ID, "test ban")
+	assert.Empty(t, resp.Error)
+
+	// banned events are no longer served
+	events, err := relay.QuerySync(ctx, nostr.Filter{IDs: []string{ev.ID}})
+	assert.NoError(t, err)
+	assert.Empty(t, events)
+
+	// nor counted
+	count, _, err := relay.Count(ctx, nostr.Filters{{IDs: []string{ev.ID}}})
+	assert.NoError(t, err)
+	assert.Zero(t, count)
+
+	resp = callManagementAPI(ctx, t, admin.PrivateKey, "listbannedevents")
+	assert.Empty(t, resp.Error)
+	assert.Contains(t, resp.Result, map[string]any{"id": ev.ID, "reason": "test ban"})
+}
+
+func TestManagementChangeRelayName(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), TestTimeout)
+	defer cancel()
+
+	info := func() map[string]any {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, relayHTTPURL, nil)
+		req.Header.Set("Accept", "application/nostr+json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to get the relay information: %v", err)
+		}
+		defer resp.Body.Close()
+
+		var document map[string]any
+		if err := json.NewDecoder(resp.Body).Decode(&document); err != nil {
+			t.Fatalf("Failed to decode the relay information: %v", err)
+		}
+		return document
+	}
+
+	previous, _ := info()["name"].(string)
+	resp := callManagementAPI(ctx, t, admin.PrivateKey, "changerelayname", "Renamed relay")
+	assert.Empty(t, resp.Error)
+	defer callManagementAPI(ctx, t, admin.PrivateKey, "changerelayname", previous)
+
+	// the NIP-11 document has the new name right away
+	assert.Equal(t, "Renamed relay", info()["name"])
+}
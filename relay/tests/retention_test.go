@@ -0,0 +1,68 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetention(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), TestTimeout)
+	defer cancel()
+
+	relay, err := nostr.RelayConnect(ctx, RelayURL)
+	require.NoError(t, err)
+	defer func() {
+		cleanupTestEvents(ctx, relay)
+		relay.Close()
+	}()
+
+	content, _ := json.Marshal(map[string]any{"name": "Short memory", "retention_max_messages": 2})
+	channel := publishSigned(ctx, t, relay, nostr.Event{Kind: 40, Content: string(content)})
+	root := nostr.Tags{{"e", channel.ID, RelayURL, "root"}}
+
+	// an older message of another channel mentioning this one isn't pruned
+	content, _ = json.Marshal(map[string]any{"name": "Long memory"})
+	other := publishSigned(ctx, t, relay, nostr.Event{Kind: 40, Content: string(content)})
+	mention := publishSigned(ctx, t, relay, nostr.Event{
+		Kind:      42,
+		CreatedAt: nostr.Now() - 20,
+		Content:   "see the other channel",
+		Tags:      nostr.Tags{{"e", other.ID, RelayURL, "root"}, {"e", channel.ID, RelayURL, "mention"}},
+	})
+
+	messages := make([]string, 0)
+	var first nostr.Event
+	for i := 0; i < 4; i++ {
+		// spread over time so the newest are well defined
+		message := publishSigned(ctx, t, relay, nostr.Event{
+			Kind:      42,
+			CreatedAt: nostr.Now() - nostr.Timestamp(10-i),
+			Content:   fmt.Sprintf("message %d", i),
+			Tags:      root,
+		})
+		messages = append(messages, message.ID)
+		if i == 0 {
+			first = message
+		}
+	}
+
+	// the mention matches the filter too
+	filter := nostr.Filter{Kinds: []int{42}, Tags: nostr.TagMap{"e": {channel.ID}}}
+	assert.Eventually(t, func() bool {
+		return len(searchIDs(ctx, t, relay, filter)) == 3
+	}, 10*time.Second, 250*time.Millisecond, "the relay should prune down to 2 messages (is RELAY_RETENTION_INTERVAL short?)")
+
+	assert.ElementsMatch(t, append(messages[2:], mention.ID), searchIDs(ctx, t, relay, filter), "the newest messages are kept, messages of other channels are left alone")
+
+	// a peer or backfill bringing a pruned message back is refused
+	err = relay.Publish(ctx, first)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "pruned")
+}
@@ -0,0 +1,102 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// publishSigned signs ev with the admin key and publishes it, created now
+// unless it already has a timestamp
+func publishSigned(ctx context.Context, t *testing.T, relay *nostr.Relay, ev nostr.Event) nostr.Event {
+	t.Helper()
+
+	if ev.CreatedAt == 0 {
+		ev.CreatedAt = nostr.Now()
+	}
+	require.NoError(t, ev.Sign(admin.PrivateKey))
+	require.NoError(t, publishEvent(ctx, relay, ev))
+
+	return ev
+}
+
+func searchIDs(ctx context.Context, t *testing.T, relay *nostr.Relay, filter nostr.Filter) []string {
+	t.Helper()
+
+	events, err := relay.QuerySync(ctx, filter)
+	require.NoError(t, err)
+
+	ids := make([]string, 0, len(events))
+	for _, ev := range events {
+		ids = append(ids, ev.ID)
+	}
+
+	return ids
+}
+
+func TestSearch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), TestTimeout)
+	defer cancel()
+
+	relay, err := nostr.RelayConnect(ctx, RelayURL)
+	require.NoError(t, err)
+	defer func() {
+		cleanupTestEvents(ctx, relay)
+		relay.Close()
+	}()
+
+	// unique words so earlier runs don't interfere
+	word := fmt.Sprintf("zebra%d", time.Now().UnixNano())
+
+	content, _ := json.Marshal(map[string]any{"name": "Searchable " + word, "about": "A channel about stripes"})
+	// older, so only ranking can put it first
+	channel := publishSigned(ctx, t, relay, nostr.Event{Kind: 40, Content: string(content), CreatedAt: nostr.Now() - 60})
+
+	other, _ := json.Marshal(map[string]any{"name": "Another room", "about": "Mentions " + word + " in passing"})
+	otherChannel := publishSigned(ctx, t, relay, nostr.Event{Kind: 40, Content: string(other)})
+
+	message := publishSigned(ctx, t, relay, nostr.Event{
+		Kind:    42,
+		Content: "have you seen the " + word + " today?",
+		Tags:    nostr.Tags{{"e", channel.ID, RelayURL, "root"}},
+	})
+
+	comic := publishSigned(ctx, t, relay, nostr.Event{
+		Kind:    7353,
+		Content: "<bold>" + word + "</bold> <c1>crossing</c1>",
+		Tags:    nostr.Tags{{"e", otherChannel.ID, RelayURL, "root"}, {"color", "c1", "#76b5c5"}},
+	})
+
+	t.Run("channels", func(t *testing.T) {
+		ids := searchIDs(ctx, t, relay, nostr.Filter{Kinds: []int{40}, Search: word})
+		require.Len(t, ids, 2)
+		// a match in the name ranks above a match in the about text
+		assert.Equal(t, channel.ID, ids[0])
+	})
+
+	t.Run("prefix", func(t *testing.T) {
+		ids := searchIDs(ctx, t, relay, nostr.Filter{Kinds: []int{40}, Search: "searchable " + word[:len(word)-3]})
+		assert.Equal(t, []string{channel.ID}, ids)
+	})
+
+	t.Run("messages", func(t *testing.T) {
+		ids := searchIDs(ctx, t, relay, nostr.Filter{Kinds: []int{42, 7353}, Search: word})
+		assert.ElementsMatch(t, []string{message.ID, comic.ID}, ids)
+	})
+
+	t.Run("markup is not indexed", func(t *testing.T) {
+		ids := searchIDs(ctx, t, relay, nostr.Filter{Kinds: []int{7353}, Search: word + " bold"})
+		assert.Empty(t, ids)
+	})
+
+	t.Run("scoped to a channel", func(t *testing.T) {
+		ids := searchIDs(ctx, t, relay, nostr.Filter{Search: word, Tags: nostr.TagMap{"e": {otherChannel.ID}}})
+		assert.Equal(t, []string{comic.ID}, ids)
+	})
+}
@@ -0,0 +1,161 @@
+package thumbnail
+
+import (
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Cache keeps rendered thumbnails in files named by key, removing the
+// least recently used ones when they take more than its size
+type Cache struct {
+	dir     string
+	maxSize int64
+
+	mu   sync.Mutex
+	size int64
+
+	// pending are the thumbnails being rendered, so a thumbnail asked for
+	// by many at once is rendered once
+	pending map[string]*pending
+}
+
+type pending struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+func NewCache(dir string, maxSize int64) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	c := &Cache{dir: dir, maxSize: maxSize, pending: make(map[string]*pending)}
+	for _, f := range c.files() {
+		c.size += f.size
+	}
+	return c, nil
+}
+
+// Get reads a thumbnail, rendering and keeping it when it isn't cached.
+// Failed renders aren't kept.
+func (c *Cache) Get(key string, render func() ([]byte, error)) ([]byte, error) {
+	path := c.path(key)
+	if data, err := os.ReadFile(path); err == nil {
+		now := time.Now()
+		os.Chtimes(path, now, now)
+		return data, nil
+	}
+
+	c.mu.Lock()
+	if p, ok := c.pending[key]; ok {
+		c.mu.Unlock()
+		<-p.done
+		return p.data, p.err
+	}
+	p := &pending{done: make(chan struct{})}
+	c.pending[key] = p
+	c.mu.Unlock()
+
+	p.data, p.err = render()
+	if p.err == nil {
+		if err := c.put(key, p.data); err != nil {
+			log.Printf("Failed to cache thumbnail %s: %v", key, err)
+		}
+	}
+
+	c.mu.Lock()
+	delete(c.pending, key)
+	c.mu.Unlock()
+	close(p.done)
+	return p.data, p.err
+}
+
+// path spreads files over directories named by the first characters of
+// their keys
+func (c *Cache) path(key string) string {
+	return filepath.Join(c.dir, key[:2], key)
+}
+
+func (c *Cache) put(key string, data []byte) error {
+	path := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	// written aside then renamed, so readers never see part of a file
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.size += int64(len(data))
+	if c.size > c.maxSize {
+		c.prune()
+	}
+	return nil
+}
+
+// prune removes the least recently used files until the cache is back to
+// 90% of its size, leaving room before the next prune
+func (c *Cache) prune() {
+	files := c.files()
+	slices.SortFunc(files, func(a file, b file) int {
+		return a.used.Compare(b.used)
+	})
+
+	c.size = 0
+	for _, f := range files {
+		c.size += f.size
+	}
+	for _, f := range files {
+		if c.size <= c.maxSize*9/10 {
+			break
+		}
+		if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove thumbnail %s: %v", f.path, err)
+			continue
+		}
+		c.size -= f.size
+	}
+}
+
+type file struct {
+	path string
+	size int64
+	used time.Time
+}
+
+// files are the thumbnails of the cache, their modification time being
+// when they were last used
+func (c *Cache) files() []file {
+	files := make([]file, 0)
+	filepath.WalkDir(c.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || filepath.Base(path)[0] == '.' {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			files = append(files, file{path: path, size: info.Size(), used: info.ModTime()})
+		}
+		return nil
+	})
+	return files
+}
@@ -0,0 +1,175 @@
+package thumbnail
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"nostr-relay/blossom"
+	"nostr-relay/channels"
+	"nostr-relay/comic"
+	"nostr-relay/drives"
+	"nostr-relay/raster"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// defaultSize is the size thumbnails are asked for at without ?size=
+const defaultSize = 256
+
+// Register serves thumbnails at:
+//
+//	/thumbnails/{sha256}             blobs of the Blossom store
+//	/drives/{pubkey}/{d}/{path...}   files of the current version of a drive
+//	/channels/{id}/picture           pictures of channels
+//
+// ?size= is the longest side of the thumbnail in pixels and ?format= is
+// "png" (default) or "webp".
+func (s *Server) Register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /thumbnails/{sha256}", s.handleBlob)
+	mux.HandleFunc("GET /drives/{pubkey}/{d}/{path...}", s.handleDrive)
+	mux.HandleFunc("GET /channels/{id}/picture", s.handleChannel)
+}
+
+func (s *Server) handleBlob(w http.ResponseWriter, r *http.Request) {
+	size, format, ok := s.params(w, r)
+	if !ok {
+		return
+	}
+	sha := r.PathValue("sha256")
+	if s.loader.Store == nil || !nostr.IsValid32ByteHex(sha) {
+		http.Error(w, "blob not found", http.StatusNotFound)
+		return
+	}
+
+	blob, err := s.loader.Store.Open(r.Context(), sha)
+	if errors.Is(err, blossom.ErrNotFound) {
+		http.Error(w, "blob not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to open blob %s: %v", sha, err)
+		http.Error(w, "could not read the blob", http.StatusInternalServerError)
+		return
+	}
+	defer blob.Close()
+	data, err := io.ReadAll(blob)
+	if err != nil {
+		log.Printf("Failed to read blob %s: %v", sha, err)
+		http.Error(w, "could not read the blob", http.StatusInternalServerError)
+		return
+	}
+
+	// blobs never change, neither do their thumbnails
+	asset := comic.Asset{SHA256: sha, Type: blossom.DetectType("", data), Data: data}
+	s.serve(w, r, asset, size, format, "public, max-age=31536000, immutable")
+}
+
+func (s *Server) handleDrive(w http.ResponseWriter, r *http.Request) {
+	size, format, ok := s.params(w, r)
+	if !ok {
+		return
+	}
+	pubkey := r.PathValue("pubkey")
+	if !nostr.IsValid32ByteHex(pubkey) {
+		http.Error(w, "invalid pubkey", http.StatusBadRequest)
+		return
+	}
+
+	address := fmt.Sprintf("%d:%s:%s", drives.Kind, pubkey, r.PathValue("d"))
+	asset, err := s.loader.File(r.Context(), address, r.PathValue("path"))
+	if errors.Is(err, blossom.ErrNotFound) {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to load %s from drive %s: %v", r.PathValue("path"), address, err)
+		http.Error(w, "could not load the file", http.StatusInternalServerError)
+		return
+	}
+	s.serve(w, r, asset, size, format, "public, max-age=300")
+}
+
+func (s *Server) handleChannel(w http.ResponseWriter, r *http.Request) {
+	size, format, ok := s.params(w, r)
+	if !ok {
+		return
+	}
+	id := r.PathValue("id")
+	if !nostr.IsValid32ByteHex(id) {
+		http.Error(w, "invalid channel id", http.StatusBadRequest)
+		return
+	}
+
+	channel, err := s.channels.Get(r.Context(), id)
+	if errors.Is(err, channels.ErrNotFound) {
+		http.Error(w, "channel not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to get channel %s: %v", id, err)
+		http.Error(w, "could not get the channel", http.StatusInternalServerError)
+		return
+	}
+	if channel.Picture == "" {
+		http.Error(w, "the channel has no picture", http.StatusNotFound)
+		return
+	}
+
+	asset, err := s.loader.Background(r.Context(), channel.Picture)
+	if err != nil {
+		log.Printf("Failed to load the picture of channel %s: %v", id, err)
+		http.Error(w, "could not load the picture", http.StatusBadGateway)
+		return
+	}
+	s.serve(w, r, asset, size, format, "public, max-age=300")
+}
+
+// params reads ?size= and ?format=, answering with an error when they're
+// invalid
+func (s *Server) params(w http.ResponseWriter, r *http.Request) (int, string, bool) {
+	query := r.URL.Query()
+	size := defaultSize
+	if value := query.Get("size"); value != "" {
+		var err error
+		if size, err = strconv.Atoi(value); err != nil || size <= 0 {
+			http.Error(w, "invalid size", http.StatusBadRequest)
+			return 0, "", false
+		}
+	}
+	format := query.Get("format")
+	if format == "" {
+		format = "png"
+	}
+	if !slices.Contains(raster.Formats, format) {
+		http.Error(w, "format must be png or webp", http.StatusBadRequest)
+		return 0, "", false
+	}
+	return s.size(size), format, true
+}
+
+// serve answers with the thumbnail of a file, tagged by the hash of its
+// content so unchanged thumbnails aren't sent again
+func (s *Server) serve(w http.ResponseWriter, r *http.Request, asset comic.Asset, size int, format string, cacheControl string) {
+	data, key, err := s.Thumbnail(asset, size, format)
+	if errors.Is(err, ErrUnsupported) {
+		http.Error(w, "the file isn't an image", http.StatusUnsupportedMediaType)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to render a thumbnail of %s: %v", asset.SHA256, err)
+		http.Error(w, "could not render the thumbnail", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/"+format)
+	w.Header().Set("Cache-Control", cacheControl)
+	w.Header().Set("ETag", `"`+key+`"`)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
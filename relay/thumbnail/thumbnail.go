@@ -0,0 +1,165 @@
+package thumbnail
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"runtime"
+	"strings"
+
+	"nostr-relay/channels"
+	"nostr-relay/comic"
+	"nostr-relay/drives"
+	"nostr-relay/raster"
+	"nostr-relay/vector"
+)
+
+// ErrUnsupported is returned for files that aren't images, or images that
+// can't be decoded
+var ErrUnsupported = errors.New("not an image that can be rendered")
+
+// version changes when thumbnails are rendered differently, so the cached
+// ones aren't served anymore
+const version = "1"
+
+// Options tune the thumbnails, zero values use the defaults
+type Options struct {
+	// Dir is where rendered thumbnails are cached
+	Dir string
+
+	// CacheSize is how many bytes of thumbnails are kept
+	CacheSize int64
+
+	// Sizes are the sizes thumbnails are rendered at, in pixels, the
+	// longest side of a thumbnail being the size asked for rounded up to
+	// one of them
+	Sizes []int
+
+	// MaxSize is the largest file rendered, 10MB when 0
+	MaxSize int64
+}
+
+func (o Options) withDefaults() Options {
+	if o.Dir == "" {
+		o.Dir = "./thumbnails"
+	}
+	if o.CacheSize <= 0 {
+		o.CacheSize = 256 << 20
+	}
+	if len(o.Sizes) == 0 {
+		o.Sizes = []int{64, 128, 256, 512}
+	}
+	return o
+}
+
+// Server renders the art of drives, the pictures of channels and the
+// images of the Blossom store as PNG or WebP thumbnails, for the places
+// where comics are shared that can't show SVGs
+type Server struct {
+	loader   *comic.Loader
+	channels *channels.Store
+	cache    *Cache
+	options  Options
+
+	// renders holds a token per thumbnail being rendered, at most one per
+	// CPU
+	renders chan struct{}
+}
+
+// New serves thumbnails of what query returns, the blobs of store, nil when
+// there is none, and the pictures of channels
+func New(query drives.QueryFunc, store drives.Store, channelStore *channels.Store, options Options) (*Server, error) {
+	options = options.withDefaults()
+	cache, err := NewCache(options.Dir, options.CacheSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the thumbnail cache: %w", err)
+	}
+	return &Server{
+		loader:   &comic.Loader{Query: query, Store: store, MaxSize: options.MaxSize},
+		channels: channelStore,
+		cache:    cache,
+		options:  options,
+		renders:  make(chan struct{}, runtime.NumCPU()),
+	}, nil
+}
+
+// Thumbnail is the thumbnail of an image in a format of raster.Formats,
+// rendered once and then read from the cache
+func (s *Server) Thumbnail(asset comic.Asset, size int, format string) ([]byte, string, error) {
+	key := Key(asset.SHA256, size, format)
+	data, err := s.cache.Get(key, func() ([]byte, error) {
+		s.renders <- struct{}{}
+		defer func() { <-s.renders }()
+		return Render(asset.Data, asset.Type, size, format)
+	})
+	return data, key, err
+}
+
+// Key names the thumbnail of a file, by the hash of its content
+func Key(sha string, size int, format string) string {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s:%s:%d:%s", version, sha, size, format)))
+	return hex.EncodeToString(hash[:])
+}
+
+// Render draws an SVG or raster image with its longest side size pixels
+// long, raster images being shrunk but never enlarged
+func Render(data []byte, mimeType string, size int, format string) ([]byte, error) {
+	var d *vector.Drawing
+	width, height := 0, 0
+	if isSVG(mimeType, data) {
+		parsed, err := vector.Parse(data)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrUnsupported, err)
+		}
+		d = parsed
+		width, height = raster.Fit(d.Width, d.Height, size)
+	} else {
+		config, _, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrUnsupported, err)
+		}
+		if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > vector.MaxPixels {
+			return nil, fmt.Errorf("%w: %dx%d pixels", ErrUnsupported, config.Width, config.Height)
+		}
+		w, h := float64(config.Width), float64(config.Height)
+		d = &vector.Drawing{Width: w, Height: h, Items: []vector.Item{
+			&vector.Image{Matrix: vector.Identity, Width: w, Height: h, Type: mimeType, Data: data, Opacity: 1},
+		}}
+		width, height = raster.Fit(w, h, min(size, max(config.Width, config.Height)))
+	}
+
+	var out bytes.Buffer
+	if err := raster.Encode(&out, raster.Render(d, width, height), format); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// isSVG tells SVG files from others, SVGs without an XML declaration being
+// sniffed as text
+func isSVG(mimeType string, data []byte) bool {
+	if mimeType == "image/svg+xml" {
+		return true
+	}
+	return strings.HasPrefix(mimeType, "text/") && bytes.Contains(data[:min(len(data), 1024)], []byte("<svg"))
+}
+
+// size is the smallest size thumbnails are rendered at that is at least
+// the one asked for, the largest when none is
+func (s *Server) size(asked int) int {
+	best := 0
+	for _, size := range s.options.Sizes {
+		if size >= asked && (best == 0 || size < best) {
+			best = size
+		}
+	}
+	if best == 0 {
+		for _, size := range s.options.Sizes {
+			best = max(best, size)
+		}
+	}
+	return best
+}
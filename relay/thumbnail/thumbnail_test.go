@@ -0,0 +1,208 @@
+package thumbnail
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"nostr-relay/channels"
+	"nostr-relay/drives"
+	"nostr-relay/internal/testutil"
+
+	"github.com/nbd-wtf/go-nostr"
+	"golang.org/x/image/webp"
+)
+
+const robot = `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 200 100"><rect width="200" height="100" fill="#3a3"/><circle cx="100" cy="50" r="40" fill="red"/></svg>`
+
+func picture(width int, height int) []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for i := range img.Pix {
+		img.Pix[i] = 200
+	}
+	var b bytes.Buffer
+	png.Encode(&b, img)
+	return b.Bytes()
+}
+
+func TestRender(t *testing.T) {
+	data, err := Render([]byte(robot), "image/svg+xml", 128, "png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dx() != 128 || img.Bounds().Dy() != 64 {
+		t.Errorf("size: %v", img.Bounds())
+	}
+	if c := color.NRGBAModel.Convert(img.At(64, 32)).(color.NRGBA); c != (color.NRGBA{255, 0, 0, 255}) {
+		t.Errorf("center: %v", c)
+	}
+
+	// SVGs without an XML declaration are sniffed as text
+	if _, err := Render([]byte(robot), "text/plain; charset=utf-8", 64, "webp"); err != nil {
+		t.Errorf("sniffed svg: %v", err)
+	}
+
+	small, err := Render(picture(40, 20), "image/png", 512, "webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err = webp.Decode(bytes.NewReader(small))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dx() != 40 || img.Bounds().Dy() != 20 {
+		t.Errorf("raster images aren't enlarged: %v", img.Bounds())
+	}
+
+	if _, err := Render([]byte("hello"), "text/plain", 64, "png"); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("not an image: %v", err)
+	}
+}
+
+func TestCache(t *testing.T) {
+	dir := t.TempDir()
+	c, err := NewCache(dir, 250)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var renders atomic.Int32
+	render := func(data string) func() ([]byte, error) {
+		return func() ([]byte, error) {
+			renders.Add(1)
+			return []byte(data), nil
+		}
+	}
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if data, err := c.Get("aa01", render(strings.Repeat("a", 100))); err != nil || len(data) != 100 {
+				t.Errorf("get: %v %d", err, len(data))
+			}
+		}()
+	}
+	wg.Wait()
+	if renders.Load() != 1 {
+		t.Errorf("rendered %d times", renders.Load())
+	}
+
+	if _, err := c.Get("bb02", func() ([]byte, error) { return nil, errors.New("broken") }); err == nil {
+		t.Errorf("render error")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "bb", "bb02")); !os.IsNotExist(err) {
+		t.Errorf("failed renders aren't kept: %v", err)
+	}
+
+	c.Get("bb03", render(strings.Repeat("b", 100)))
+	// used last, so kept when the cache is full
+	c.Get("aa01", render(""))
+	c.Get("cc04", render(strings.Repeat("c", 100)))
+	if _, err := os.Stat(filepath.Join(dir, "bb", "bb03")); !os.IsNotExist(err) {
+		t.Errorf("the least recently used thumbnail is removed: %v", err)
+	}
+	for _, key := range []string{"aa01", "cc04"} {
+		if _, err := os.Stat(filepath.Join(dir, key[:2], key)); err != nil {
+			t.Errorf("%s: %v", key, err)
+		}
+	}
+
+	reopened, err := NewCache(dir, 250)
+	if err != nil || reopened.size != 200 {
+		t.Errorf("reopened with %d bytes: %v", reopened.size, err)
+	}
+}
+
+func TestHandlers(t *testing.T) {
+	ctx := context.Background()
+	db := testutil.DB(t, "thumbnail")
+	channelStore, err := channels.New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	profile, photo := []byte(robot), picture(300, 300)
+	local := testutil.Blobs{testutil.Sum(profile): profile, testutil.Sum(photo): photo}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(picture(64, 64))
+	}))
+	t.Cleanup(server.Close)
+
+	sk := nostr.GeneratePrivateKey()
+	save := func(event nostr.Event) nostr.Event {
+		event.Sign(sk)
+		if err := db.SaveEvent(ctx, &event); err != nil {
+			t.Fatal(err)
+		}
+		channelStore.EventSaved(ctx, &event)
+		return event
+	}
+	drive := save(nostr.Event{Kind: drives.Kind, CreatedAt: nostr.Now(), Tags: nostr.Tags{
+		{"d", "robo"}, {"x", testutil.Sum(profile), "/characters/robo/profile.svg", "100", "image/svg+xml"},
+	}})
+	withPicture := save(nostr.Event{Kind: 40, CreatedAt: nostr.Now(), Content: `{"name":"a","picture":"` + server.URL + `/picture.png"}`})
+	without := save(nostr.Event{Kind: 40, CreatedAt: nostr.Now(), Content: `{"name":"b"}`})
+
+	s, err := New(db.QueryEvents, local, channelStore, Options{Dir: t.TempDir(), Sizes: []int{32, 128}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the picture is served from the loopback address
+	s.loader.Client = server.Client()
+	mux := http.NewServeMux()
+	s.Register(mux)
+
+	for url, want := range map[string]int{
+		"/thumbnails/" + testutil.Sum(photo):                          http.StatusOK,
+		"/thumbnails/" + testutil.Sum(photo) + "?size=20&format=webp": http.StatusOK,
+		"/thumbnails/" + testutil.Sum(photo) + "?size=big":            http.StatusBadRequest,
+		"/thumbnails/" + testutil.Sum(photo) + "?format=gif":          http.StatusBadRequest,
+		"/thumbnails/" + strings.Repeat("0", 64):                      http.StatusNotFound,
+		"/drives/" + drive.PubKey + "/robo/characters/robo/profile":   http.StatusOK,
+		"/drives/" + drive.PubKey + "/robo/characters/robo/angry":     http.StatusNotFound,
+		"/drives/" + drive.PubKey + "/other/characters/robo/angry":    http.StatusNotFound,
+		"/drives/nope/robo/characters/robo/profile":                   http.StatusBadRequest,
+		"/channels/" + withPicture.ID + "/picture":                    http.StatusOK,
+		"/channels/" + without.ID + "/picture":                        http.StatusNotFound,
+		"/channels/" + strings.Repeat("0", 64) + "/picture":           http.StatusNotFound,
+	} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+		if w.Code != want {
+			t.Errorf("%s: %d %s", url, w.Code, w.Body)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/thumbnails/"+testutil.Sum(photo)+"?size=20&format=webp", nil))
+	img, err := webp.Decode(w.Body)
+	if err != nil || img.Bounds().Dx() != 32 || w.Header().Get("Content-Type") != "image/webp" {
+		t.Errorf("sizes are rounded up to the allowed ones: %v %v", err, w.Header())
+	}
+
+	etag := w.Header().Get("ETag")
+	req := httptest.NewRequest(http.MethodGet, "/thumbnails/"+testutil.Sum(photo)+"?size=20&format=webp", nil)
+	req.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusNotModified {
+		t.Errorf("unchanged thumbnail: %d", w.Code)
+	}
+}
@@ -0,0 +1,207 @@
+package transcript
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"nostr-relay/kinds"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// renders keeps the exports served lately in memory, so a strip or a
+// replay shared around isn't drawn again for every viewer. Entries are
+// evicted, least recently used first, when they take more than the memory
+// bound, and dropped when their channel changes or they get too old, which
+// covers the drives and backgrounds changing.
+type renders struct {
+	maxBytes int
+	ttl      time.Duration
+
+	// tokens holds one per export being drawn, at most one per CPU
+	tokens chan struct{}
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	recent  *list.List
+	bytes   int
+
+	// pending has the exports being drawn, so viewers asking for the same
+	// one wait for it
+	pending map[string]*pending
+}
+
+type entry struct {
+	key     string
+	channel string
+	data    []byte
+	made    time.Time
+}
+
+type pending struct {
+	channel string
+	done    chan struct{}
+	data    []byte
+	err     error
+
+	// stale is set when the channel changed while drawing, so the export
+	// isn't kept
+	stale bool
+}
+
+func newRenders(maxBytes int, ttl time.Duration, concurrency int) *renders {
+	return &renders{
+		maxBytes: maxBytes,
+		ttl:      ttl,
+		tokens:   make(chan struct{}, concurrency),
+		entries:  make(map[string]*list.Element),
+		recent:   list.New(),
+		pending:  make(map[string]*pending),
+	}
+}
+
+// Render returns the export of channel in format, drawn by render unless it
+// was lately. format has whatever changes the output besides the range,
+// like the size of images. Exports are drawn a few at a time, waiting for
+// their turn until ctx is done.
+func (e *Exporter) Render(ctx context.Context, channel string, r Range, format string, render func(ctx context.Context) ([]byte, error)) ([]byte, error) {
+	c := e.renders
+	key := fmt.Sprintf("%s %s %s", channel, r.key(), format)
+
+	for {
+		c.mu.Lock()
+		if data, ok := c.get(key); ok {
+			c.mu.Unlock()
+			return data, nil
+		}
+		p, ok := c.pending[key]
+		if !ok {
+			break
+		}
+		c.mu.Unlock()
+
+		select {
+		case <-p.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		// the viewer who asked first went away, someone else draws it
+		if errors.Is(p.err, context.Canceled) || errors.Is(p.err, context.DeadlineExceeded) {
+			continue
+		}
+		return p.data, p.err
+	}
+	p := &pending{channel: channel, done: make(chan struct{})}
+	c.pending[key] = p
+	c.mu.Unlock()
+
+	select {
+	case c.tokens <- struct{}{}:
+		p.data, p.err = render(ctx)
+		<-c.tokens
+	case <-ctx.Done():
+		p.err = ctx.Err()
+	}
+
+	c.mu.Lock()
+	delete(c.pending, key)
+	if p.err == nil && !p.stale {
+		c.put(key, channel, p.data)
+	}
+	c.mu.Unlock()
+	close(p.done)
+
+	return p.data, p.err
+}
+
+// EventSaved drops the exports of the channel of event, it's meant to be
+// added to relay.OnEventSaved
+func (e *Exporter) EventSaved(ctx context.Context, event *nostr.Event) {
+	e.renders.changed(event)
+}
+
+// EventDeleted is meant to be added to relay.DeleteEvent
+func (e *Exporter) EventDeleted(ctx context.Context, event *nostr.Event) error {
+	e.renders.changed(event)
+	return nil
+}
+
+func (c *renders) changed(event *nostr.Event) {
+	var channel string
+	switch {
+	case event.Kind == 40:
+		channel = event.ID
+	case event.Kind == 41 || kinds.IsChannelMessage(event):
+		channel = kinds.ChannelID(event)
+	default:
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, p := range c.pending {
+		if p.channel == channel {
+			p.stale = true
+		}
+	}
+	for element := c.recent.Front(); element != nil; {
+		next := element.Next()
+		if element.Value.(*entry).channel == channel {
+			c.remove(element)
+		}
+		element = next
+	}
+}
+
+func (c *renders) get(key string) ([]byte, bool) {
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	en := element.Value.(*entry)
+	if time.Since(en.made) > c.ttl {
+		c.remove(element)
+		return nil, false
+	}
+
+	c.recent.MoveToFront(element)
+	return en.data, true
+}
+
+func (c *renders) put(key string, channel string, data []byte) {
+	if len(data) > c.maxBytes {
+		return
+	}
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+
+	c.entries[key] = c.recent.PushFront(&entry{key: key, channel: channel, data: data, made: time.Now()})
+	c.bytes += len(data)
+	for c.bytes > c.maxBytes {
+		c.remove(c.recent.Back())
+	}
+}
+
+func (c *renders) remove(element *list.Element) {
+	en := c.recent.Remove(element).(*entry)
+	delete(c.entries, en.key)
+	c.bytes -= len(en.data)
+}
+
+// key tells ranges apart in the cache
+func (r Range) key() string {
+	var since, until int64 = -1, -1
+	if r.Since != nil {
+		since = int64(*r.Since)
+	}
+	if r.Until != nil {
+		until = int64(*r.Until)
+	}
+	return fmt.Sprintf("%d-%d-%d", since, until, r.Limit)
+}
@@ -0,0 +1,161 @@
+package transcript
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"io"
+	"math"
+
+	"nostr-relay/comic"
+	"nostr-relay/pdf"
+	"nostr-relay/thumbnail"
+	"nostr-relay/vector"
+)
+
+// Formats are the formats a transcript is written in
+var Formats = []string{"svg", "html", "pdf", "png", "webp"}
+
+// File is a page of the strip as an SVG, PNG or WebP file
+type File struct {
+	Name string
+	Data []byte
+}
+
+// Files are the pages of the strip, in order: "00-title.svg", then "01.svg"
+// and on, numbers being as wide as the last one
+func (t *Transcript) Files() []File {
+	return named(t.Pages(), "svg")
+}
+
+// Images are the pages of the strip as PNG or WebP files, named as Files
+// are. Their longest side is size pixels, that of the pages when 0.
+func (t *Transcript) Images(format string, size int) ([]File, error) {
+	pages := t.Pages()
+	images := make([][]byte, len(pages))
+	for i, page := range pages {
+		image, err := t.image(page, format, size)
+		if err != nil {
+			return nil, fmt.Errorf("page %d: %w", i, err)
+		}
+		images[i] = image
+	}
+	return named(images, format), nil
+}
+
+// image rasterizes a page, with the thumbnails of the exporter when it has
+// them so pages drawn the same are rendered once
+func (t *Transcript) image(page []byte, format string, size int) ([]byte, error) {
+	if size <= 0 {
+		d, err := vector.Parse(page)
+		if err != nil {
+			return nil, err
+		}
+		size = int(math.Ceil(max(d.Width, d.Height)))
+	}
+	if t.thumbnails == nil {
+		return thumbnail.Render(page, "image/svg+xml", size, format)
+	}
+	hash := sha256.Sum256(page)
+	data, _, err := t.thumbnails.Thumbnail(comic.Asset{SHA256: hex.EncodeToString(hash[:]), Type: "image/svg+xml", Data: page}, size, format)
+	return data, err
+}
+
+func named(pages [][]byte, extension string) []File {
+	width := len(fmt.Sprint(len(pages) - 1))
+	files := make([]File, len(pages))
+	for i, page := range pages {
+		name := fmt.Sprintf("%0*d.%s", width, i, extension)
+		if i == 0 {
+			name = fmt.Sprintf("%0*d-title.%s", width, i, extension)
+		}
+		files[i] = File{Name: name, Data: page}
+	}
+	return files
+}
+
+// WriteZip writes the pages of the strip as SVG files in a zip archive
+func (t *Transcript) WriteZip(w io.Writer) error {
+	return t.writeZip(w, t.Files())
+}
+
+// WriteImages writes the pages of the strip as PNG or WebP files in a zip
+// archive, size being as for Images
+func (t *Transcript) WriteImages(w io.Writer, format string, size int) error {
+	files, err := t.Images(format, size)
+	if err != nil {
+		return err
+	}
+	return t.writeZip(w, files)
+}
+
+func (t *Transcript) writeZip(w io.Writer, files []File) error {
+	archive := zip.NewWriter(w)
+	for _, file := range files {
+		f, err := archive.CreateHeader(&zip.FileHeader{Name: file.Name, Method: zip.Deflate, Modified: t.created()})
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(file.Data); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+// WriteHTML writes the strip as a single page, panels one under the other.
+// Panels are inlined with the fonts they embed, which are named by hash so
+// they don't clash.
+func (t *Transcript) WriteHTML(w io.Writer) error {
+	var b bytes.Buffer
+	b.WriteString("<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"><meta name=\"viewport\" content=\"width=device-width, initial-scale=1\">")
+	fmt.Fprintf(&b, "<title>%s</title>", html.EscapeString(t.Channel.Name))
+	if t.Channel.About != "" {
+		fmt.Fprintf(&b, "<meta name=\"description\" content=\"%s\">", html.EscapeString(t.Channel.About))
+	}
+	b.WriteString("<style>body{margin:0;background:#eeeeee}main{padding:16px}" +
+		"figure{margin:0 0 16px}figure svg{display:block;margin:0 auto;max-width:100%;height:auto}</style></head><body><main>\n")
+	for i, page := range t.Pages() {
+		label := t.Channel.Name
+		if i > 0 {
+			label = fmt.Sprintf("Panel %d", i)
+		}
+		fmt.Fprintf(&b, "<figure aria-label=\"%s\">%s</figure>\n", html.EscapeString(label), page)
+	}
+	b.WriteString("</main></body></html>\n")
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// WritePDF writes the strip as a PDF, a page per panel
+func (t *Transcript) WritePDF(w io.Writer) error {
+	pages := t.Pages()
+	drawings := make([]*vector.Drawing, len(pages))
+	for i, page := range pages {
+		d, err := vector.Parse(page)
+		if err != nil {
+			return fmt.Errorf("page %d: %w", i, err)
+		}
+		drawings[i] = d
+	}
+	return pdf.Write(w, drawings, pdf.Info{Title: t.Channel.Name, Subject: t.Channel.About, Created: t.created()})
+}
+
+// Write writes the strip in a format of Formats, SVG, PNG and WebP pages
+// being zipped
+func (t *Transcript) Write(w io.Writer, format string) error {
+	switch format {
+	case "svg":
+		return t.WriteZip(w)
+	case "png", "webp":
+		return t.WriteImages(w, format, 0)
+	case "html":
+		return t.WriteHTML(w)
+	case "pdf":
+		return t.WritePDF(w)
+	}
+	return fmt.Errorf("unknown format %q", format)
+}
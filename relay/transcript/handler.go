@@ -0,0 +1,165 @@
+package transcript
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// contentTypes of the formats, pages being zipped
+var contentTypes = map[string]string{
+	"svg":  "application/zip",
+	"html": "text/html; charset=utf-8",
+	"pdf":  "application/pdf",
+	"png":  "application/zip",
+	"webp": "application/zip",
+}
+
+var extensions = map[string]string{"svg": "zip", "html": "html", "pdf": "pdf", "png": "zip", "webp": "zip"}
+
+// pageTypes are the content types of single pages
+var pageTypes = map[string]string{"svg": "image/svg+xml", "png": "image/png", "webp": "image/webp"}
+
+// maxImageSize is the longest side of PNG and WebP pages, in pixels
+const maxImageSize = 2048
+
+// HandleExport serves the transcript of the channel {id} as a comic strip.
+// ?format= is "html" (default), "pdf", or "svg", "png" or "webp" for a zip
+// of the pages, and ?since=, ?until= and ?limit= select the messages, times
+// being unix timestamps, RFC 3339 times or dates. ?page= serves a single
+// page of a zip instead, 0 being the title, and ?size= is the longest side
+// of PNG and WebP pages in pixels. Exports go through Render.
+func (e *Exporter) HandleExport(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !nostr.IsValid32ByteHex(id) {
+		http.Error(w, "invalid channel id", http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format == "" {
+		format = "html"
+	}
+	if !slices.Contains(Formats, format) {
+		http.Error(w, "format must be html, pdf, svg, png or webp", http.StatusBadRequest)
+		return
+	}
+	size, page := 0, -1
+	if value := query.Get("size"); value != "" {
+		var err error
+		if size, err = strconv.Atoi(value); err != nil || size <= 0 || size > maxImageSize {
+			http.Error(w, fmt.Sprintf("size must be from 1 to %d", maxImageSize), http.StatusBadRequest)
+			return
+		}
+	}
+	if value := query.Get("page"); value != "" {
+		var err error
+		if page, err = strconv.Atoi(value); err != nil || page < 0 || pageTypes[format] == "" {
+			http.Error(w, "invalid page", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var rng Range
+	var err error
+	if rng.Since, err = ParseTime(query.Get("since")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if rng.Until, err = ParseTime(query.Get("until")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if limit := query.Get("limit"); limit != "" {
+		if rng.Limit, err = strconv.Atoi(limit); err != nil || rng.Limit <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// written whole first, so a failure is still an error status
+	data, err := e.Render(r.Context(), id, rng, fmt.Sprintf("%s %d %d", format, size, page), func(ctx context.Context) ([]byte, error) {
+		t, err := e.Load(ctx, id, rng)
+		if err != nil {
+			return nil, err
+		}
+		if page >= 0 {
+			return t.page(format, size, page)
+		}
+
+		var b bytes.Buffer
+		if format == "png" || format == "webp" {
+			err = t.WriteImages(&b, format, size)
+		} else {
+			err = t.Write(&b, format)
+		}
+		return b.Bytes(), err
+	})
+	switch {
+	case errors.Is(err, ErrNotFound):
+		http.Error(w, "channel not found", http.StatusNotFound)
+		return
+	case errors.Is(err, errPageNotFound):
+		http.Error(w, "page not found", http.StatusNotFound)
+		return
+	case err != nil:
+		log.Printf("Failed to export the transcript of channel %s: %v", id, err)
+		http.Error(w, "could not export the transcript", http.StatusInternalServerError)
+		return
+	}
+
+	if page >= 0 {
+		w.Header().Set("Content-Type", pageTypes[format])
+		w.Write(data)
+		return
+	}
+	w.Header().Set("Content-Type", contentTypes[format])
+	if format != "html" {
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="channel-%s.%s"`, id[:8], extensions[format]))
+	}
+	w.Write(data)
+}
+
+var errPageNotFound = errors.New("page not found")
+
+// page is a page of a transcript as an SVG, PNG or WebP file
+func (t *Transcript) page(format string, size int, page int) ([]byte, error) {
+	pages := t.Pages()
+	if page >= len(pages) {
+		return nil, errPageNotFound
+	}
+	if format == "svg" {
+		return pages[page], nil
+	}
+	return t.image(pages[page], format, size)
+}
+
+// ParseTime reads a unix timestamp, an RFC 3339 time or a date, nil for ""
+func ParseTime(value string) (*nostr.Timestamp, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	if unix, err := strconv.ParseInt(value, 10, 64); err == nil {
+		ts := nostr.Timestamp(unix)
+		return &ts, nil
+	}
+
+	for _, layout := range []string{time.RFC3339, time.DateOnly} {
+		if t, err := time.Parse(layout, value); err == nil {
+			ts := nostr.Timestamp(t.Unix())
+			return &ts, nil
+		}
+	}
+
+	return nil, fmt.Errorf("invalid time %q", value)
+}
@@ -0,0 +1,290 @@
+package transcript
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+
+	"nostr-relay/comic"
+	"nostr-relay/drives"
+	"nostr-relay/kinds"
+	"nostr-relay/thumbnail"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ErrNotFound is returned for channels whose creation event isn't stored
+var ErrNotFound = errors.New("channel not found")
+
+// Options tune exports, zero values use the defaults
+type Options struct {
+	// MaxMessages is how many messages a transcript holds at most, 500
+	// when 0
+	MaxMessages int
+
+	// MaxSize is the largest blob downloaded for drives and backgrounds,
+	// 10MB when 0
+	MaxSize int64
+
+	Comic comic.Options
+
+	// Thumbnails renders and caches the PNG and WebP pages of strips, nil
+	// to render them every time
+	Thumbnails *thumbnail.Server
+
+	// CacheSize is the memory the exports served lately can take, in
+	// bytes, 32MB when 0. They're kept for CacheTTL at most, 10 minutes
+	// when 0, since the drives and backgrounds they show can change.
+	CacheSize int
+	CacheTTL  time.Duration
+}
+
+func (o Options) withDefaults() Options {
+	if o.MaxMessages <= 0 {
+		o.MaxMessages = 500
+	}
+	if o.CacheSize <= 0 {
+		o.CacheSize = 32 << 20
+	}
+	if o.CacheTTL <= 0 {
+		o.CacheTTL = 10 * time.Minute
+	}
+	return o
+}
+
+// Range selects the messages of a transcript, nil bounds being open
+type Range struct {
+	Since *nostr.Timestamp
+	Until *nostr.Timestamp
+
+	// Limit is how many messages, the latest ones, at most MaxMessages and
+	// MaxMessages when 0
+	Limit int
+}
+
+// Exporter draws the transcripts of channels as comic strips, with the
+// stored messages and the drives and backgrounds they refer to
+type Exporter struct {
+	query   drives.QueryFunc
+	loader  *comic.Loader
+	renders *renders
+	options Options
+}
+
+// New creates an Exporter reading events with query and blobs from store
+// first, which can be nil
+func New(query drives.QueryFunc, store drives.Store, options Options) *Exporter {
+	options = options.withDefaults()
+	return &Exporter{
+		query:   query,
+		loader:  &comic.Loader{Query: query, Store: store, MaxSize: options.MaxSize},
+		renders: newRenders(options.CacheSize, options.CacheTTL, runtime.NumCPU()),
+		options: options,
+	}
+}
+
+// Transcript is a channel, or a time range of it, drawn as a strip
+type Transcript struct {
+	ID      string
+	Owner   string
+	Channel kinds.Channel
+
+	// Messages are in the order they were posted, Truncated set when the
+	// range had more than the limit and older ones were left out
+	Messages  []comic.Message
+	Truncated bool
+
+	// Title is the SVG of the title page, Panels the strip
+	Title  []byte
+	Panels []comic.Panel
+
+	thumbnails *thumbnail.Server
+}
+
+// Load reads a channel, the messages of a range and the assets they're
+// drawn with, and draws them
+func (e *Exporter) Load(ctx context.Context, id string, r Range) (*Transcript, error) {
+	t, err := e.channel(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	limit := e.options.MaxMessages
+	if r.Limit > 0 {
+		limit = min(r.Limit, limit)
+	}
+	// one more message than the limit tells if the range has more
+	events, err := e.messages(ctx, id, r, limit+1)
+	if err != nil {
+		return nil, err
+	}
+	if len(events) > limit {
+		events, t.Truncated = events[:limit], true
+	}
+	slices.Reverse(events)
+
+	t.Messages = make([]comic.Message, len(events))
+	for i, event := range events {
+		t.Messages[i] = comic.ParseMessage(event)
+	}
+
+	library, err := e.loader.Load(ctx, t.Messages)
+	if err != nil {
+		return nil, err
+	}
+	var background *comic.Asset
+	if t.Channel.Background != "" {
+		if asset, err := e.loader.Background(ctx, t.Channel.Background); err == nil {
+			background = &asset
+		} else if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+
+	t.Title = comic.Title(t.Channel.Name, t.Channel.About, t.caption(), background, e.options.Comic)
+	t.Panels = comic.Render(t.Messages, library, background, e.options.Comic)
+	t.thumbnails = e.options.Thumbnails
+	return t, nil
+}
+
+// channel reads the metadata of a channel: that of its creation event, or
+// of the latest kind 41 of its owner
+func (e *Exporter) channel(ctx context.Context, id string) (*Transcript, error) {
+	created, err := e.collect(ctx, nostr.Filter{IDs: []string{id}, Kinds: []int{40}}, func(event *nostr.Event) bool {
+		return event.ID == id
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(created) == 0 {
+		return nil, ErrNotFound
+	}
+	latest := created[0]
+
+	updates, err := e.collect(ctx, nostr.Filter{Kinds: []int{41}, Authors: []string{latest.PubKey}, Tags: nostr.TagMap{"e": {id}}}, func(event *nostr.Event) bool {
+		return kinds.ChannelID(event) == id
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, update := range updates {
+		if update.CreatedAt >= latest.CreatedAt {
+			latest = update
+		}
+	}
+
+	t := &Transcript{ID: id, Owner: created[0].PubKey}
+	json.Unmarshal([]byte(latest.Content), &t.Channel)
+	if t.Channel.Name == "" {
+		t.Channel.Name = "Untitled channel"
+	}
+	return t, nil
+}
+
+// messages reads the latest n messages of a channel in a range, latest
+// first. Messages that only mention the channel match the query too, pages
+// are read until n of its own are found.
+func (e *Exporter) messages(ctx context.Context, id string, r Range, n int) ([]*nostr.Event, error) {
+	events := make([]*nostr.Event, 0, n)
+	seen := make(map[string]bool)
+	until := r.Until
+	for {
+		ch, err := e.query(ctx, nostr.Filter{Kinds: kinds.ChannelMessageKinds, Tags: nostr.TagMap{"e": {id}}, Since: r.Since, Until: until, Limit: n})
+		if err != nil {
+			return nil, fmt.Errorf("failed to query messages: %w", err)
+		}
+		count := 0
+		oldest := nostr.Timestamp(math.MaxInt64)
+		for event := range ch {
+			count++
+			oldest = min(oldest, event.CreatedAt)
+			if !seen[event.ID] && kinds.ChannelID(event) == id {
+				seen[event.ID] = true
+				events = append(events, event)
+			}
+		}
+
+		slices.SortFunc(events, func(a *nostr.Event, b *nostr.Event) int {
+			if c := cmp.Compare(b.CreatedAt, a.CreatedAt); c != 0 {
+				return c
+			}
+			return strings.Compare(b.ID, a.ID)
+		})
+		if count < n || len(events) >= n {
+			return events[:min(n, len(events))], nil
+		}
+
+		// the next page starts at the oldest time, whose messages may go on,
+		// or right before when the whole page had that time
+		next := oldest
+		if until != nil && *until == oldest {
+			next--
+		}
+		until = &next
+	}
+}
+
+// collect runs a query, keeping the events keep accepts as tag matches of
+// the store are loose
+func (e *Exporter) collect(ctx context.Context, filter nostr.Filter, keep func(*nostr.Event) bool) ([]*nostr.Event, error) {
+	ch, err := e.query(ctx, filter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query events: %w", err)
+	}
+	events := make([]*nostr.Event, 0)
+	for event := range ch {
+		if keep(event) {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+// caption tells when the messages were posted and how many there are
+func (t *Transcript) caption() string {
+	if len(t.Messages) == 0 {
+		return "No messages"
+	}
+	date := func(ts nostr.Timestamp) string {
+		return ts.Time().UTC().Format("2 Jan 2006")
+	}
+	first, last := date(t.Messages[0].Event.CreatedAt), date(t.Messages[len(t.Messages)-1].Event.CreatedAt)
+
+	dates := first
+	if last != first {
+		dates += " – " + last
+	}
+	count := fmt.Sprintf("%d messages", len(t.Messages))
+	switch {
+	case len(t.Messages) == 1:
+		count = "1 message"
+	case t.Truncated:
+		count = fmt.Sprintf("the last %d messages", len(t.Messages))
+	}
+	return dates + " · " + count
+}
+
+// Pages are the SVGs of the strip, the title page first
+func (t *Transcript) Pages() [][]byte {
+	pages := make([][]byte, 0, len(t.Panels)+1)
+	pages = append(pages, t.Title)
+	for _, p := range t.Panels {
+		pages = append(pages, p.SVG)
+	}
+	return pages
+}
+
+// created is when the last message was posted, zero without messages
+func (t *Transcript) created() time.Time {
+	if len(t.Messages) == 0 {
+		return time.Time{}
+	}
+	return t.Messages[len(t.Messages)-1].Event.CreatedAt.Time()
+}
@@ -0,0 +1,223 @@
+package transcript
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"nostr-relay/internal/testutil"
+
+	"github.com/fiatjaf/eventstore/sqlite3"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func setup(t *testing.T) (*sqlite3.SQLite3Backend, string) {
+	db := testutil.DB(t, "transcript")
+	save := testutil.Saver(t, db)
+	owner, other := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+
+	channel := save(owner, nostr.Event{Kind: 40, CreatedAt: 1000, Content: `{"name":"Old name"}`})
+	save(owner, nostr.Event{Kind: 41, CreatedAt: 1100, Content: `{"name":"Robots & <friends>","about":"Talk about robots"}`, Tags: nostr.Tags{{"e", channel.ID, "", "root"}}})
+	save(other, nostr.Event{Kind: 41, CreatedAt: 1200, Content: `{"name":"Hijacked"}`, Tags: nostr.Tags{{"e", channel.ID, "", "root"}}})
+	elsewhere := save(owner, nostr.Event{Kind: 40, CreatedAt: 1000, Content: `{"name":"Elsewhere"}`})
+
+	for i, content := range []string{"first", "<b>second</b>", "third", "fourth"} {
+		save(owner, nostr.Event{Kind: 7353, CreatedAt: nostr.Timestamp(2000 + 100*i), Content: content, Tags: nostr.Tags{{"e", channel.ID, "", "root"}}})
+	}
+	save(other, nostr.Event{Kind: 42, CreatedAt: 2150, Content: "plain", Tags: nostr.Tags{{"e", channel.ID, "", "root"}}})
+	// mentions the channel but is posted in another one
+	save(other, nostr.Event{Kind: 42, CreatedAt: 2160, Content: "other", Tags: nostr.Tags{{"e", elsewhere.ID, "", "root"}, {"e", channel.ID, "", "mention"}}})
+	return db, channel.ID
+}
+
+func TestLoad(t *testing.T) {
+	ctx := context.Background()
+	db, id := setup(t)
+	e := New(db.QueryEvents, nil, Options{MaxMessages: 4})
+
+	all, err := e.Load(ctx, id, Range{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if all.Channel.Name != "Robots & <friends>" || all.Channel.About != "Talk about robots" {
+		t.Errorf("metadata of the latest kind 41 of the owner: %+v", all.Channel)
+	}
+	contents := make([]string, len(all.Messages))
+	for i, m := range all.Messages {
+		contents[i] = m.Event.Content
+	}
+	if strings.Join(contents, ",") != "<b>second</b>,plain,third,fourth" || !all.Truncated {
+		t.Errorf("the latest messages of the channel, in order: %v %v", contents, all.Truncated)
+	}
+	if len(all.Panels) == 0 || !bytes.Contains(all.Title, []byte("Robots &amp; &lt;friends&gt;")) || !bytes.Contains(all.Title, []byte("the last 4 messages")) {
+		t.Errorf("title page:\n%s", all.Title)
+	}
+
+	since, until := nostr.Timestamp(2100), nostr.Timestamp(2200)
+	ranged, err := e.Load(ctx, id, Range{Since: &since, Until: &until})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ranged.Messages) != 3 || ranged.Truncated {
+		t.Errorf("range: %d messages", len(ranged.Messages))
+	}
+	if limited, err := e.Load(ctx, id, Range{Limit: 1}); err != nil || len(limited.Messages) != 1 || limited.Messages[0].Event.Content != "fourth" {
+		t.Errorf("limit: %v", err)
+	}
+
+	if _, err := e.Load(ctx, strings.Repeat("0", 64), Range{}); err != ErrNotFound {
+		t.Errorf("unknown channel: %v", err)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	db, id := setup(t)
+	tr, err := New(db.QueryEvents, nil, Options{}).Load(context.Background(), id, Range{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var page bytes.Buffer
+	if err := tr.Write(&page, "html"); err != nil {
+		t.Fatal(err)
+	}
+	html := page.String()
+	if !strings.Contains(html, "<title>Robots &amp; &lt;friends&gt;</title>") || strings.Count(html, "<figure") != len(tr.Panels)+1 {
+		t.Errorf("html:\n%s", html)
+	}
+
+	var archive bytes.Buffer
+	if err := tr.Write(&archive, "svg"); err != nil {
+		t.Fatal(err)
+	}
+	r, err := zip.NewReader(bytes.NewReader(archive.Bytes()), int64(archive.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.File) != len(tr.Panels)+1 || r.File[0].Name != "0-title.svg" || r.File[1].Name != "1.svg" {
+		t.Errorf("zip: %d files, %s", len(r.File), r.File[0].Name)
+	}
+
+	var document bytes.Buffer
+	if err := tr.Write(&document, "pdf"); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(document.Bytes(), []byte("%PDF-")) || bytes.Count(document.Bytes(), []byte("/Type /Page ")) != len(tr.Panels)+1 {
+		t.Errorf("pdf of %d bytes", document.Len())
+	}
+
+	var images bytes.Buffer
+	if err := tr.WriteImages(&images, "png", 100); err != nil {
+		t.Fatal(err)
+	}
+	r, err = zip.NewReader(bytes.NewReader(images.Bytes()), int64(images.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := r.File[1].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	if config, err := png.DecodeConfig(first); err != nil || config.Width != 100 || r.File[0].Name != "0-title.png" {
+		t.Errorf("png pages: %v %+v %s", err, config, r.File[0].Name)
+	}
+
+	if err := tr.Write(&document, "gif"); err == nil {
+		t.Errorf("unknown format")
+	}
+}
+
+func TestHandleExport(t *testing.T) {
+	db, id := setup(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /channels/{id}/comic", New(db.QueryEvents, nil, Options{}).HandleExport)
+
+	for url, want := range map[string]int{
+		"/channels/" + id + "/comic":                             http.StatusOK,
+		"/channels/" + id + "/comic?format=pdf&since=2100":       http.StatusOK,
+		"/channels/" + id + "/comic?format=svg&until=1970-01-02": http.StatusOK,
+		"/channels/" + id + "/comic?format=webp":                 http.StatusOK,
+		"/channels/" + id + "/comic?format=png&page=1&size=120":  http.StatusOK,
+		"/channels/" + id + "/comic?format=svg&page=0":           http.StatusOK,
+		"/channels/" + id + "/comic?format=png&page=99":          http.StatusNotFound,
+		"/channels/" + id + "/comic?format=pdf&page=1":           http.StatusBadRequest,
+		"/channels/" + id + "/comic?format=png&size=5000":        http.StatusBadRequest,
+		"/channels/" + id + "/comic?format=gif":                  http.StatusBadRequest,
+		"/channels/" + id + "/comic?since=yesterday":             http.StatusBadRequest,
+		"/channels/" + id + "/comic?limit=-1":                    http.StatusBadRequest,
+		"/channels/nope/comic":                                   http.StatusBadRequest,
+		"/channels/" + strings.Repeat("0", 64) + "/comic":        http.StatusNotFound,
+	} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+		if w.Code != want {
+			t.Errorf("%s: %d %s", url, w.Code, w.Body)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/channels/"+id+"/comic?format=pdf", nil))
+	if w.Header().Get("Content-Type") != "application/pdf" || w.Header().Get("Content-Disposition") != `attachment; filename="channel-`+id[:8]+`.pdf"` {
+		t.Errorf("headers: %v", w.Header())
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/channels/"+id+"/comic?format=png&page=1&size=120", nil))
+	if config, err := png.DecodeConfig(w.Body); err != nil || config.Width != 120 || w.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("single page: %v %+v %v", err, config, w.Header())
+	}
+}
+
+func TestRender(t *testing.T) {
+	ctx := context.Background()
+	e := New(nil, nil, Options{CacheSize: 10})
+	renders := 0
+	render := func(data string) func(ctx context.Context) ([]byte, error) {
+		return func(ctx context.Context) ([]byte, error) {
+			renders++
+			return []byte(data), nil
+		}
+	}
+
+	channel, other := strings.Repeat("a", 64), strings.Repeat("b", 64)
+	since := nostr.Timestamp(100)
+	for _, want := range []string{"strip", "strip"} {
+		if data, err := e.Render(ctx, channel, Range{}, "html", render(want)); err != nil || string(data) != want {
+			t.Errorf("render: %q %v", data, err)
+		}
+	}
+	e.Render(ctx, channel, Range{Since: &since}, "html", render("later"))
+	e.Render(ctx, other, Range{}, "html", render("other"))
+	if renders != 3 {
+		t.Errorf("exports are drawn once per channel, range and format: %d renders", renders)
+	}
+
+	// a new message in the channel makes its exports stale
+	message := nostr.Event{Kind: 7353, Tags: nostr.Tags{{"e", channel, "", "root"}}}
+	e.EventSaved(ctx, &message)
+	e.Render(ctx, channel, Range{}, "html", render("strip"))
+	e.Render(ctx, other, Range{}, "html", render("other"))
+	if renders != 4 {
+		t.Errorf("only the exports of the channel are drawn again: %d renders", renders)
+	}
+
+	// evicted past the memory bound, least recently used first
+	e.Render(ctx, other, Range{}, "pdf", render("document"))
+	e.Render(ctx, other, Range{}, "html", render("other"))
+	if renders != 6 {
+		t.Errorf("memory bound: %d renders", renders)
+	}
+
+	if _, err := e.Render(ctx, channel, Range{}, "svg", func(ctx context.Context) ([]byte, error) {
+		return nil, ErrNotFound
+	}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("failed render: %v", err)
+	}
+}
@@ -0,0 +1,399 @@
+package typeset
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// Font has the metrics of a TrueType or OpenType font needed to measure
+// text: advances, kerning and vertical metrics. Outlines aren't read.
+type Font struct {
+	unitsPerEm float64
+
+	// ascent, descent and lineGap are in font units, descent is negative
+	ascent, descent, lineGap float64
+
+	// advances are by glyph, glyphs past the last one have its advance
+	advances []uint16
+
+	cmap cmap
+
+	// kern has the pairs of the kern table, by left<<16 | right
+	kern map[uint32]int16
+
+	// pairs are the pair adjustment subtables of the kern feature of GPOS
+	pairs []pairPos
+}
+
+// Parse reads a font file: TrueType, OpenType, WOFF or WOFF2. Collections
+// aren't supported.
+func Parse(data []byte) (*Font, error) {
+	tables, err := decode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &Font{}
+	if err := f.parse(tables); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// decode reads the tables of a font file, by tag
+func decode(data []byte) (map[string][]byte, error) {
+	if len(data) < 4 {
+		return nil, errors.New("too short for a font")
+	}
+	switch string(data[:4]) {
+	case "wOF2":
+		return decodeWOFF2(data)
+	case "wOFF":
+		return decodeWOFF(data)
+	case "\x00\x01\x00\x00", "OTTO", "true":
+		return decodeSFNT(data)
+	case "ttcf":
+		return nil, errors.New("font collections aren't supported")
+	}
+	return nil, errors.New("not a font")
+}
+
+// decodeSFNT reads the table directory of a TrueType or OpenType font
+func decodeSFNT(data []byte) (map[string][]byte, error) {
+	if len(data) < 12 {
+		return nil, errors.New("shorter than a font header")
+	}
+	numTables := int(binary.BigEndian.Uint16(data[4:]))
+	if len(data) < 12+16*numTables {
+		return nil, errors.New("table directory runs past the end")
+	}
+
+	tables := make(map[string][]byte, numTables)
+	for i := 0; i < numTables; i++ {
+		entry := data[12+16*i:]
+		offset, length := int(binary.BigEndian.Uint32(entry[8:])), int(binary.BigEndian.Uint32(entry[12:]))
+		if offset+length > len(data) || offset+length < offset {
+			return nil, fmt.Errorf("table %q runs past the end", entry[:4])
+		}
+		tables[string(entry[:4])] = data[offset : offset+length]
+	}
+	return tables, nil
+}
+
+// decodeWOFF decompresses the tables of a WOFF font, each compressed with
+// zlib unless it's smaller as is
+func decodeWOFF(data []byte) (map[string][]byte, error) {
+	if len(data) < 44 {
+		return nil, errors.New("shorter than a WOFF header")
+	}
+	numTables := int(binary.BigEndian.Uint16(data[12:]))
+	if len(data) < 44+20*numTables {
+		return nil, errors.New("table directory runs past the end")
+	}
+	if total := binary.BigEndian.Uint32(data[16:]); total > maxFontSize {
+		return nil, fmt.Errorf("tables decompress to more than %d bytes", maxFontSize)
+	}
+
+	tables := make(map[string][]byte, numTables)
+	for i := 0; i < numTables; i++ {
+		entry := data[44+20*i:]
+		tag := string(entry[:4])
+		offset := int(binary.BigEndian.Uint32(entry[4:]))
+		compressed := int(binary.BigEndian.Uint32(entry[8:]))
+		length := int(binary.BigEndian.Uint32(entry[12:]))
+		if offset+compressed > len(data) || offset+compressed < offset || length > maxFontSize {
+			return nil, fmt.Errorf("table %q runs past the end", tag)
+		}
+
+		table := data[offset : offset+compressed]
+		if compressed < length {
+			r, err := zlib.NewReader(bytes.NewReader(table))
+			if err != nil {
+				return nil, fmt.Errorf("table %q: %w", tag, err)
+			}
+			table, err = io.ReadAll(io.LimitReader(r, int64(length)+1))
+			if err != nil {
+				return nil, fmt.Errorf("table %q: %w", tag, err)
+			}
+		}
+		if len(table) != length {
+			return nil, fmt.Errorf("table %q is %d bytes, the directory declares %d", tag, len(table), length)
+		}
+		tables[tag] = table
+	}
+	return tables, nil
+}
+
+func (f *Font) parse(tables map[string][]byte) error {
+	head, hhea, maxp, hmtx := tables["head"], tables["hhea"], tables["maxp"], tables["hmtx"]
+	if len(head) < 54 || len(hhea) < 36 || len(maxp) < 6 {
+		return errors.New("missing or short head, hhea or maxp table")
+	}
+
+	f.unitsPerEm = float64(binary.BigEndian.Uint16(head[18:]))
+	if f.unitsPerEm < 16 || f.unitsPerEm > 16384 {
+		return fmt.Errorf("invalid units per em %v", f.unitsPerEm)
+	}
+
+	f.ascent = float64(int16(binary.BigEndian.Uint16(hhea[4:])))
+	f.descent = float64(int16(binary.BigEndian.Uint16(hhea[6:])))
+	f.lineGap = float64(int16(binary.BigEndian.Uint16(hhea[8:])))
+	if os2 := tables["OS/2"]; len(os2) >= 78 {
+		// fonts ask for their typographic metrics to be used
+		const useTypoMetrics = 1 << 7
+		ascent, descent := float64(int16(binary.BigEndian.Uint16(os2[68:]))), float64(int16(binary.BigEndian.Uint16(os2[70:])))
+		if binary.BigEndian.Uint16(os2[62:])&useTypoMetrics != 0 || (f.ascent == 0 && f.descent == 0) {
+			f.ascent, f.descent = ascent, descent
+			f.lineGap = float64(int16(binary.BigEndian.Uint16(os2[72:])))
+		}
+	}
+	if f.ascent-f.descent <= 0 {
+		return errors.New("no vertical metrics")
+	}
+
+	numGlyphs := int(binary.BigEndian.Uint16(maxp[4:]))
+	numMetrics := int(binary.BigEndian.Uint16(hhea[34:]))
+	if numMetrics == 0 || numMetrics > numGlyphs || len(hmtx) < 4*numMetrics {
+		return errors.New("missing or short hmtx table")
+	}
+	f.advances = make([]uint16, numMetrics)
+	for i := range f.advances {
+		f.advances[i] = binary.BigEndian.Uint16(hmtx[4*i:])
+	}
+
+	var err error
+	if f.cmap, err = parseCmap(tables["cmap"], numGlyphs); err != nil {
+		return fmt.Errorf("cmap: %w", err)
+	}
+
+	// kerning is optional, fonts whose kerning can't be read are measured
+	// without
+	f.kern = parseKern(tables["kern"])
+	f.pairs = parseGPOS(tables["GPOS"])
+	return nil
+}
+
+// Glyph is the glyph of a character, 0 when the font doesn't have it
+func (f *Font) Glyph(r rune) uint16 {
+	return f.cmap.lookup(r)
+}
+
+// Advance is the advance of a glyph in ems
+func (f *Font) Advance(glyph uint16) float64 {
+	i := min(int(glyph), len(f.advances)-1)
+	return float64(f.advances[i]) / f.unitsPerEm
+}
+
+// Kern is the adjustment of the advance of left when right follows, in ems
+func (f *Font) Kern(left uint16, right uint16) float64 {
+	// shapers ignore the kern table of fonts with GPOS kerning
+	if len(f.pairs) > 0 {
+		for _, p := range f.pairs {
+			if v, ok := p.adjust(left, right); ok {
+				return float64(v) / f.unitsPerEm
+			}
+		}
+		return 0
+	}
+	if v, ok := f.kern[uint32(left)<<16|uint32(right)]; ok {
+		return float64(v) / f.unitsPerEm
+	}
+	return 0
+}
+
+// Ascent, Descent and LineGap are the vertical metrics of the font in ems,
+// descent is negative
+func (f *Font) Ascent() float64  { return f.ascent / f.unitsPerEm }
+func (f *Font) Descent() float64 { return f.descent / f.unitsPerEm }
+func (f *Font) LineGap() float64 { return f.lineGap / f.unitsPerEm }
+
+// cmap maps characters to glyphs with ranges, from format 4 or 12
+type cmap []cmapRange
+
+type cmapRange struct {
+	start, end rune
+
+	// delta is added to characters of the range to get their glyph, when
+	// glyphs is nil
+	delta int
+
+	// glyphs are the glyphs of the range, by character from start
+	glyphs []uint16
+}
+
+func (c cmap) lookup(r rune) uint16 {
+	i, found := slices.BinarySearchFunc(c, r, func(cr cmapRange, r rune) int {
+		switch {
+		case cr.end < r:
+			return -1
+		case cr.start > r:
+			return 1
+		}
+		return 0
+	})
+	if !found {
+		return 0
+	}
+	cr := c[i]
+	if cr.glyphs != nil {
+		return cr.glyphs[r-cr.start]
+	}
+	return uint16(int(r) + cr.delta)
+}
+
+// parseCmap reads the Unicode subtable of a cmap, the full repertoire one
+// when there is one
+func parseCmap(data []byte, numGlyphs int) (cmap, error) {
+	if len(data) < 4 {
+		return nil, errors.New("missing")
+	}
+	numTables := int(binary.BigEndian.Uint16(data[2:]))
+	if len(data) < 4+8*numTables {
+		return nil, errors.New("encoding records run past the end")
+	}
+
+	best, bestRank := -1, 0
+	for i := 0; i < numTables; i++ {
+		record := data[4+8*i:]
+		platform, encoding := binary.BigEndian.Uint16(record), binary.BigEndian.Uint16(record[2:])
+		offset := int(binary.BigEndian.Uint32(record[4:]))
+		rank := 0
+		switch {
+		case platform == 3 && encoding == 10, platform == 0 && (encoding == 4 || encoding == 6):
+			rank = 3
+		case platform == 3 && encoding == 1, platform == 0 && encoding <= 3:
+			rank = 2
+		case platform == 3 && encoding == 0:
+			// symbol fonts
+			rank = 1
+		}
+		if rank > bestRank && offset+2 <= len(data) {
+			format := binary.BigEndian.Uint16(data[offset:])
+			if format == 4 || format == 12 {
+				best, bestRank = offset, rank
+			}
+		}
+	}
+	if best < 0 {
+		return nil, errors.New("no Unicode subtable")
+	}
+
+	sub := data[best:]
+	var c cmap
+	switch binary.BigEndian.Uint16(sub) {
+	case 4:
+		if len(sub) < 14 {
+			return nil, errors.New("short format 4 subtable")
+		}
+		segments := int(binary.BigEndian.Uint16(sub[6:])) / 2
+		if len(sub) < 16+8*segments {
+			return nil, errors.New("short format 4 subtable")
+		}
+		ends, starts := sub[14:], sub[16+2*segments:]
+		deltas, rangeOffsets := sub[16+4*segments:], sub[16+6*segments:]
+		for i := 0; i < segments; i++ {
+			start, end := rune(binary.BigEndian.Uint16(starts[2*i:])), rune(binary.BigEndian.Uint16(ends[2*i:]))
+			delta := int(int16(binary.BigEndian.Uint16(deltas[2*i:])))
+			rangeOffset := int(binary.BigEndian.Uint16(rangeOffsets[2*i:]))
+			if start > end || start == 0xffff {
+				continue
+			}
+			cr := cmapRange{start: start, end: end}
+			if rangeOffset == 0 {
+				// glyphs wrap around 65536
+				cr.delta = delta
+				if int(end)+delta > 0xffff || int(start)+delta < 0 {
+					cr.glyphs = make([]uint16, end-start+1)
+					for r := start; r <= end; r++ {
+						cr.glyphs[r-start] = uint16(int(r) + delta)
+					}
+				}
+			} else {
+				// the offset is from the idRangeOffset entry itself
+				cr.glyphs = make([]uint16, end-start+1)
+				base := 16 + 6*segments + 2*i + rangeOffset
+				for r := start; r <= end; r++ {
+					at := base + 2*int(r-start)
+					if at+2 > len(sub) {
+						break
+					}
+					if g := binary.BigEndian.Uint16(sub[at:]); g != 0 {
+						cr.glyphs[r-start] = uint16(int(g) + delta)
+					}
+				}
+			}
+			c = append(c, cr)
+		}
+	case 12:
+		if len(sub) < 16 {
+			return nil, errors.New("short format 12 subtable")
+		}
+		groups := int(binary.BigEndian.Uint32(sub[12:]))
+		if groups > (len(sub)-16)/12 {
+			return nil, errors.New("short format 12 subtable")
+		}
+		for i := 0; i < groups; i++ {
+			group := sub[16+12*i:]
+			start, end := rune(binary.BigEndian.Uint32(group)), rune(binary.BigEndian.Uint32(group[4:]))
+			glyph := int(binary.BigEndian.Uint32(group[8:]))
+			if start > end || end > 0x10ffff {
+				continue
+			}
+			c = append(c, cmapRange{start: start, end: end, delta: glyph - int(start)})
+		}
+	}
+
+	slices.SortFunc(c, func(a, b cmapRange) int { return int(a.start - b.start) })
+	// overlapping ranges would make the search miss characters
+	valid := make(cmap, 0, len(c))
+	for _, cr := range c {
+		// overlapping ranges would make the search miss characters, and
+		// ranges pointing past the last glyph are broken
+		if n := len(valid); n > 0 && cr.start <= valid[n-1].end {
+			continue
+		}
+		if cr.glyphs == nil && (int(cr.start)+cr.delta < 0 || int(cr.end)+cr.delta >= numGlyphs) {
+			continue
+		}
+		valid = append(valid, cr)
+	}
+	return valid, nil
+}
+
+// parseKern reads the horizontal pairs of a kern table, format 0
+func parseKern(data []byte) map[uint32]int16 {
+	pairs := make(map[uint32]int16)
+	if len(data) < 4 || binary.BigEndian.Uint16(data) != 0 {
+		return pairs
+	}
+	numTables := int(binary.BigEndian.Uint16(data[2:]))
+	offset := 4
+	for i := 0; i < numTables && offset+6 <= len(data); i++ {
+		length := int(binary.BigEndian.Uint16(data[offset+2:]))
+		coverage := binary.BigEndian.Uint16(data[offset+4:])
+		// horizontal, format 0, not cross-stream or minimums
+		if coverage&0xff07 == 0x0001 && offset+14 <= len(data) {
+			n := int(binary.BigEndian.Uint16(data[offset+6:]))
+			for j := 0; j < n; j++ {
+				at := offset + 14 + 6*j
+				if at+6 > len(data) {
+					break
+				}
+				key := binary.BigEndian.Uint32(data[at:])
+				if _, ok := pairs[key]; !ok {
+					pairs[key] = int16(binary.BigEndian.Uint16(data[at+4:]))
+				}
+			}
+		}
+		if length < 6 {
+			break
+		}
+		offset += length
+	}
+	return pairs
+}
@@ -0,0 +1,366 @@
+package typeset
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// flags of composite glyph components
+const (
+	argsAreWords     = 0x0001
+	haveScale        = 0x0008
+	moreComponents   = 0x0020
+	haveXYScale      = 0x0040
+	haveTwoByTwo     = 0x0080
+	haveInstructions = 0x0100
+)
+
+// stream reads the substreams of a transformed glyf table
+type stream struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (s *stream) bytes(n int) []byte {
+	if s.err != nil || n < 0 || s.pos+n > len(s.data) {
+		s.err = errors.New("stream runs past the end")
+		return make([]byte, max(n, 0))
+	}
+	b := s.data[s.pos : s.pos+n]
+	s.pos += n
+	return b
+}
+
+func (s *stream) u8() int {
+	return int(s.bytes(1)[0])
+}
+
+func (s *stream) u16() int {
+	return int(binary.BigEndian.Uint16(s.bytes(2)))
+}
+
+// u255 reads a 255UInt16
+func (s *stream) u255() int {
+	switch code := s.u8(); code {
+	case 253:
+		return s.u16()
+	case 254:
+		return 506 + s.u8()
+	case 255:
+		return 253 + s.u8()
+	default:
+		return code
+	}
+}
+
+// split cuts a stream into substreams of the sizes given
+func (s *stream) split(sizes ...int) []*stream {
+	streams := make([]*stream, len(sizes))
+	for i, size := range sizes {
+		streams[i] = &stream{data: s.bytes(size)}
+	}
+	return streams
+}
+
+type point struct {
+	x, y    int
+	onCurve bool
+}
+
+// reconstructGlyf rebuilds the glyf and loca tables from the transformed
+// glyf table of a WOFF2 font, and the xMin of every glyph which transformed
+// hmtx tables leave out as left side bearings
+func reconstructGlyf(data []byte) (glyf []byte, loca []byte, xMins []int16, err error) {
+	header := &stream{data: data}
+	header.u16() // reserved
+	options := header.u16()
+	numGlyphs := header.u16()
+	indexFormat := header.u16()
+	sizes := make([]int, 7)
+	for i := range sizes {
+		sizes[i] = int(binary.BigEndian.Uint32(header.bytes(4)))
+	}
+	if header.err != nil {
+		return nil, nil, nil, errors.New("transformed glyf header is too short")
+	}
+	total := 0
+	for _, size := range sizes {
+		if size > maxFontSize {
+			return nil, nil, nil, errors.New("transformed glyf stream is too large")
+		}
+		total += size
+	}
+	if total > len(data) {
+		return nil, nil, nil, errors.New("transformed glyf streams run past the end")
+	}
+
+	streams := header.split(sizes...)
+	contours, points, flags, glyphs, composites, bboxes, instructions := streams[0], streams[1], streams[2], streams[3], streams[4], streams[5], streams[6]
+	bitmapSize := ((numGlyphs + 31) >> 5) << 2
+	bboxBitmap := bboxes.bytes(bitmapSize)
+	var overlapBitmap []byte
+	if options&1 != 0 {
+		overlapBitmap = header.bytes((numGlyphs + 7) >> 3)
+	}
+	if header.err != nil || bboxes.err != nil {
+		return nil, nil, nil, errors.New("transformed glyf bitmaps run past the end")
+	}
+
+	// short offsets are halved so glyphs are 2 byte aligned, long ones 4
+	align := 4
+	if indexFormat == 0 {
+		align = 2
+	}
+	offsets := make([]int, 0, numGlyphs+1)
+	xMins = make([]int16, numGlyphs)
+	for i := 0; i < numGlyphs; i++ {
+		offsets = append(offsets, len(glyf))
+		hasBBox := bboxBitmap[i>>3]&(0x80>>(i&7)) != 0
+		numContours := int16(contours.u16())
+
+		var out []byte
+		switch {
+		case numContours == 0:
+			if hasBBox {
+				return nil, nil, nil, fmt.Errorf("empty glyph %d has a bounding box", i)
+			}
+
+		case numContours > 0:
+			ends := make([]int, numContours)
+			n := 0
+			for c := range ends {
+				n += points.u255()
+				ends[c] = n - 1
+			}
+			if n > 0xffff {
+				return nil, nil, nil, fmt.Errorf("glyph %d has too many points", i)
+			}
+			pts := decodeTriplets(flags, glyphs, n)
+			code := instructions.bytes(glyphs.u255())
+
+			bbox := bounds(pts)
+			if hasBBox {
+				bbox = readBBox(bboxes)
+			}
+			overlap := overlapBitmap != nil && overlapBitmap[i>>3]&(0x80>>(i&7)) != 0
+			out = simpleGlyph(numContours, bbox, ends, code, pts, overlap)
+			xMins[i] = int16(bbox[0])
+
+		default:
+			if !hasBBox {
+				return nil, nil, nil, fmt.Errorf("composite glyph %d has no bounding box", i)
+			}
+			bbox := readBBox(bboxes)
+			out = binary.BigEndian.AppendUint16(nil, uint16(numContours))
+			for _, v := range bbox {
+				out = binary.BigEndian.AppendUint16(out, uint16(int16(v)))
+			}
+			component, instructed := compositeGlyph(composites)
+			out = append(out, component...)
+			if instructed {
+				code := instructions.bytes(glyphs.u255())
+				out = binary.BigEndian.AppendUint16(out, uint16(len(code)))
+				out = append(out, code...)
+			}
+			xMins[i] = int16(bbox[0])
+		}
+
+		for _, s := range streams {
+			if s.err != nil {
+				return nil, nil, nil, fmt.Errorf("glyph %d: %w", i, s.err)
+			}
+		}
+		glyf = append(glyf, out...)
+		for len(glyf)%align != 0 {
+			glyf = append(glyf, 0)
+		}
+		if len(glyf) > maxFontSize {
+			return nil, nil, nil, errors.New("glyf table is too large")
+		}
+	}
+	offsets = append(offsets, len(glyf))
+
+	for _, offset := range offsets {
+		if indexFormat == 0 {
+			if offset/2 > 0xffff {
+				return nil, nil, nil, errors.New("glyf table is too large for short offsets")
+			}
+			loca = binary.BigEndian.AppendUint16(loca, uint16(offset/2))
+		} else {
+			loca = binary.BigEndian.AppendUint32(loca, uint32(offset))
+		}
+	}
+	return glyf, loca, xMins, nil
+}
+
+// decodeTriplets reads the points of a simple glyph: a flag per point and
+// coordinates packed by how far they are from the previous point
+func decodeTriplets(flags *stream, glyphs *stream, n int) []point {
+	pts := make([]point, n)
+	x, y := 0, 0
+	withSign := func(flag int, v int) int {
+		if flag&1 != 0 {
+			return v
+		}
+		return -v
+	}
+	for i := range pts {
+		flag := flags.u8()
+		onCurve := flag&0x80 == 0
+		flag &= 0x7f
+
+		var dx, dy int
+		switch {
+		case flag < 10:
+			dy = withSign(flag, (flag&14)<<7+glyphs.u8())
+		case flag < 20:
+			dx = withSign(flag, ((flag-10)&14)<<7+glyphs.u8())
+		case flag < 84:
+			b0, b1 := flag-20, glyphs.u8()
+			dx = withSign(flag, 1+(b0&0x30)+(b1>>4))
+			dy = withSign(flag>>1, 1+(b0&0x0c)<<2+(b1&0x0f))
+		case flag < 120:
+			b0 := flag - 84
+			dx = withSign(flag, 1+(b0/12)<<8+glyphs.u8())
+			dy = withSign(flag>>1, 1+((b0%12)>>2)<<8+glyphs.u8())
+		case flag < 124:
+			b := glyphs.bytes(3)
+			dx = withSign(flag, int(b[0])<<4+int(b[1])>>4)
+			dy = withSign(flag>>1, int(b[1]&0x0f)<<8+int(b[2]))
+		default:
+			b := glyphs.bytes(4)
+			dx = withSign(flag, int(b[0])<<8+int(b[1]))
+			dy = withSign(flag>>1, int(b[2])<<8+int(b[3]))
+		}
+		x, y = x+dx, y+dy
+		pts[i] = point{x, y, onCurve}
+	}
+	return pts
+}
+
+func readBBox(s *stream) [4]int {
+	var bbox [4]int
+	for i := range bbox {
+		bbox[i] = int(int16(s.u16()))
+	}
+	return bbox
+}
+
+// bounds is the xMin, yMin, xMax and yMax of points
+func bounds(pts []point) [4]int {
+	if len(pts) == 0 {
+		return [4]int{}
+	}
+	bbox := [4]int{pts[0].x, pts[0].y, pts[0].x, pts[0].y}
+	for _, p := range pts[1:] {
+		bbox = [4]int{min(bbox[0], p.x), min(bbox[1], p.y), max(bbox[2], p.x), max(bbox[3], p.y)}
+	}
+	return bbox
+}
+
+// simpleGlyph writes a glyph in the glyf format, coordinates as bytes when
+// they fit
+func simpleGlyph(numContours int16, bbox [4]int, ends []int, code []byte, pts []point, overlap bool) []byte {
+	out := binary.BigEndian.AppendUint16(nil, uint16(numContours))
+	for _, v := range bbox {
+		out = binary.BigEndian.AppendUint16(out, uint16(int16(v)))
+	}
+	for _, end := range ends {
+		out = binary.BigEndian.AppendUint16(out, uint16(end))
+	}
+	out = binary.BigEndian.AppendUint16(out, uint16(len(code)))
+	out = append(out, code...)
+
+	// the same bits say if a short coordinate is positive
+	const (
+		onCurve     = 0x01
+		xShort      = 0x02
+		yShort      = 0x04
+		xSame       = 0x10
+		ySame       = 0x20
+		overlapFlag = 0x40
+	)
+	var xs, ys []byte
+	prev := point{}
+	for i, p := range pts {
+		var flag byte
+		if p.onCurve {
+			flag |= onCurve
+		}
+		if i == 0 && overlap {
+			flag |= overlapFlag
+		}
+		dx, dy := p.x-prev.x, p.y-prev.y
+		switch {
+		case dx == 0:
+			flag |= xSame
+		case dx > -256 && dx < 256:
+			flag |= xShort
+			if dx > 0 {
+				flag |= xSame
+			}
+			xs = append(xs, byte(abs(dx)))
+		default:
+			xs = binary.BigEndian.AppendUint16(xs, uint16(int16(dx)))
+		}
+		switch {
+		case dy == 0:
+			flag |= ySame
+		case dy > -256 && dy < 256:
+			flag |= yShort
+			if dy > 0 {
+				flag |= ySame
+			}
+			ys = append(ys, byte(abs(dy)))
+		default:
+			ys = binary.BigEndian.AppendUint16(ys, uint16(int16(dy)))
+		}
+		out = append(out, flag)
+		prev = p
+	}
+	out = append(out, xs...)
+	return append(out, ys...)
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// compositeGlyph copies the components of a composite glyph, telling if it
+// has instructions
+func compositeGlyph(s *stream) ([]byte, bool) {
+	start := s.pos
+	instructed := false
+	for s.err == nil {
+		flags := s.u16()
+		s.u16() // glyph
+		size := 2
+		if flags&argsAreWords != 0 {
+			size = 4
+		}
+		switch {
+		case flags&haveScale != 0:
+			size += 2
+		case flags&haveXYScale != 0:
+			size += 4
+		case flags&haveTwoByTwo != 0:
+			size += 8
+		}
+		s.bytes(size)
+		if flags&haveInstructions != 0 {
+			instructed = true
+		}
+		if flags&moreComponents == 0 {
+			break
+		}
+	}
+	if s.err != nil {
+		return nil, false
+	}
+	return s.data[start:s.pos], instructed
+}
@@ -0,0 +1,215 @@
+package typeset
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"slices"
+)
+
+// GPOS lookup types read for kerning
+const (
+	pairAdjustment = 2
+	extension      = 9
+)
+
+// pairPos is a pair adjustment subtable of GPOS, read when pairs are
+// looked up as there are too many to expand
+type pairPos struct {
+	data []byte
+}
+
+// u16 reads a number, 0 past the end of data so broken offsets find nothing
+func u16(data []byte, offset int) int {
+	if offset < 0 || offset+2 > len(data) {
+		return 0
+	}
+	return int(binary.BigEndian.Uint16(data[offset:]))
+}
+
+func u32(data []byte, offset int) int {
+	if offset < 0 || offset+4 > len(data) {
+		return 0
+	}
+	return int(binary.BigEndian.Uint32(data[offset:]))
+}
+
+func from(data []byte, offset int) []byte {
+	if offset <= 0 || offset >= len(data) {
+		return nil
+	}
+	return data[offset:]
+}
+
+// parseGPOS finds the pair adjustment subtables of the lookups of the kern
+// feature, for every script as balloons don't say their language
+func parseGPOS(data []byte) []pairPos {
+	features, lookups := from(data, u16(data, 6)), from(data, u16(data, 8))
+	if features == nil || lookups == nil {
+		return nil
+	}
+
+	indexes := make([]int, 0)
+	for i := range u16(features, 0) {
+		record := 2 + 6*i
+		if string(features[min(record, len(features)):min(record+4, len(features))]) != "kern" {
+			continue
+		}
+		feature := from(features, u16(features, record+4))
+		for j := range u16(feature, 2) {
+			if index := u16(feature, 4+2*j); !slices.Contains(indexes, index) {
+				indexes = append(indexes, index)
+			}
+		}
+	}
+	slices.Sort(indexes)
+
+	pairs := make([]pairPos, 0)
+	for _, index := range indexes {
+		if index >= u16(lookups, 0) {
+			continue
+		}
+		lookup := from(lookups, u16(lookups, 2+2*index))
+		kind := u16(lookup, 0)
+		for k := range u16(lookup, 4) {
+			sub := from(lookup, u16(lookup, 6+2*k))
+			if kind == extension && u16(sub, 2) == pairAdjustment {
+				sub = from(sub, u32(sub, 4))
+			} else if kind != pairAdjustment {
+				continue
+			}
+			if format := u16(sub, 0); format == 1 || format == 2 {
+				pairs = append(pairs, pairPos{data: sub})
+			}
+		}
+	}
+	return pairs
+}
+
+// valueSize is the size of a value record of a format
+func valueSize(format int) int {
+	return 2 * bits.OnesCount8(uint8(format))
+}
+
+// xAdvance is where the x advance is in a value record, -1 when it has none
+func xAdvance(format int) int {
+	if format&0x4 == 0 {
+		return -1
+	}
+	return 2 * bits.OnesCount8(uint8(format&0x3))
+}
+
+// adjust is the change of the advance of left when right follows, ok when
+// the subtable has the pair
+func (p pairPos) adjust(left uint16, right uint16) (int16, bool) {
+	d := p.data
+	index, ok := coverage(from(d, u16(d, 2)), left)
+	if !ok {
+		return 0, false
+	}
+	format1, format2 := u16(d, 4), u16(d, 6)
+	size := valueSize(format1) + valueSize(format2)
+	advance := xAdvance(format1)
+
+	value := func(record int) int16 {
+		if advance < 0 {
+			return 0
+		}
+		return int16(u16(d, record+advance))
+	}
+
+	switch u16(d, 0) {
+	case 1:
+		if index >= u16(d, 8) {
+			return 0, false
+		}
+		set := u16(d, 10+2*index)
+		n := u16(d, set)
+		// records are sorted by their second glyph
+		lo, hi := 0, n
+		for lo < hi {
+			mid := (lo + hi) / 2
+			record := set + 2 + mid*(2+size)
+			switch second := uint16(u16(d, record)); {
+			case second == right:
+				return value(record + 2), true
+			case second < right:
+				lo = mid + 1
+			default:
+				hi = mid
+			}
+		}
+		return 0, false
+	case 2:
+		class1 := classOf(from(d, u16(d, 8)), left)
+		class2 := classOf(from(d, u16(d, 10)), right)
+		count1, count2 := u16(d, 12), u16(d, 14)
+		if class1 >= count1 || class2 >= count2 {
+			return 0, false
+		}
+		return value(16 + (class1*count2+class2)*size), true
+	}
+	return 0, false
+}
+
+// coverage is the index of a glyph in a coverage table
+func coverage(data []byte, glyph uint16) (int, bool) {
+	g := int(glyph)
+	switch u16(data, 0) {
+	case 1:
+		lo, hi := 0, u16(data, 2)
+		for lo < hi {
+			mid := (lo + hi) / 2
+			switch v := u16(data, 4+2*mid); {
+			case v == g:
+				return mid, true
+			case v < g:
+				lo = mid + 1
+			default:
+				hi = mid
+			}
+		}
+	case 2:
+		lo, hi := 0, u16(data, 2)
+		for lo < hi {
+			mid := (lo + hi) / 2
+			record := 4 + 6*mid
+			switch {
+			case u16(data, record+2) < g:
+				lo = mid + 1
+			case u16(data, record) > g:
+				hi = mid
+			default:
+				return u16(data, record+4) + g - u16(data, record), true
+			}
+		}
+	}
+	return 0, false
+}
+
+// classOf is the class of a glyph in a class definition table, 0 when it
+// isn't listed
+func classOf(data []byte, glyph uint16) int {
+	g := int(glyph)
+	switch u16(data, 0) {
+	case 1:
+		start := u16(data, 2)
+		if g >= start && g < start+u16(data, 4) {
+			return u16(data, 6+2*(g-start))
+		}
+	case 2:
+		lo, hi := 0, u16(data, 2)
+		for lo < hi {
+			mid := (lo + hi) / 2
+			record := 4 + 6*mid
+			switch {
+			case u16(data, record+2) < g:
+				lo = mid + 1
+			case u16(data, record) > g:
+				hi = mid
+			default:
+				return u16(data, record+4)
+			}
+		}
+	}
+	return 0
+}
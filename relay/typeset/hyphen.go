@@ -0,0 +1,54 @@
+package typeset
+
+import (
+	"strings"
+	"unicode"
+)
+
+// vowels of Latin scripts, hyphenation only happens between syllables it
+// can tell apart
+const vowels = "aeiouyàáâãäåæèéêëìíîïòóôõöøùúûüýÿœ"
+
+// digraphs are consonant pairs that stay together
+var digraphs = []string{"ch", "ck", "gh", "ph", "qu", "sh", "th", "wh"}
+
+// hyphenation is where a word can be hyphenated, as indexes of the
+// characters that start a new line. There are no dictionaries for the
+// languages of chats, so syllables are guessed: a consonant between vowels
+// starts a syllable (ho-tel), and two consonants between vowels are split
+// (bas-ket). At least two characters stay before a break and three after.
+func hyphenation(word []rune) []int {
+	breaks := make([]int, 0)
+	lower := make([]rune, len(word))
+	for i, r := range word {
+		lower[i] = unicode.ToLower(r)
+	}
+	vowel := func(i int) bool {
+		return i >= 0 && i < len(lower) && strings.ContainsRune(vowels, lower[i])
+	}
+	consonant := func(i int) bool {
+		return i >= 0 && i < len(lower) && unicode.IsLetter(lower[i]) && !vowel(i)
+	}
+
+	for i := 2; i <= len(word)-3; i++ {
+		if !unicode.IsLetter(word[i-2]) || !unicode.IsLetter(word[i-1]) {
+			continue
+		}
+		switch {
+		case vowel(i-1) && consonant(i) && vowel(i+1):
+			breaks = append(breaks, i)
+		case vowel(i-2) && consonant(i-1) && consonant(i) && vowel(i+1) && !isDigraph(lower[i-1], lower[i]):
+			breaks = append(breaks, i)
+		}
+	}
+	return breaks
+}
+
+func isDigraph(a rune, b rune) bool {
+	for _, d := range digraphs {
+		if string([]rune{a, b}) == d {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,72 @@
+package typeset
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"slices"
+)
+
+// SFNT is a font file as TrueType or OpenType, the format font renderers
+// read: WOFF and WOFF2 fonts are decoded, others returned as they are
+func SFNT(data []byte) ([]byte, error) {
+	tables, err := decode(data)
+	if err != nil {
+		return nil, err
+	}
+	if string(data[:4]) != "wOFF" && string(data[:4]) != "wOF2" {
+		return data, nil
+	}
+
+	// the flavor of web fonts is the version of the font they hold
+	version := data[4:8]
+	if _, ok := tables["CFF "]; !ok && string(version) == "OTTO" {
+		return nil, errors.New("OpenType font without a CFF table")
+	}
+
+	tags := make([]string, 0, len(tables))
+	for tag := range tables {
+		if len(tag) == 4 {
+			tags = append(tags, tag)
+		}
+	}
+	slices.Sort(tags)
+
+	n := len(tags)
+	entrySelector := bits.Len(uint(n)) - 1
+	searchRange := 16 << entrySelector
+	out := make([]byte, 0, 12+16*n)
+	out = append(out, version...)
+	out = binary.BigEndian.AppendUint16(out, uint16(n))
+	out = binary.BigEndian.AppendUint16(out, uint16(searchRange))
+	out = binary.BigEndian.AppendUint16(out, uint16(entrySelector))
+	out = binary.BigEndian.AppendUint16(out, uint16(16*n-searchRange))
+
+	offset := 12 + 16*n
+	for _, tag := range tags {
+		table := tables[tag]
+		out = append(out, tag...)
+		out = binary.BigEndian.AppendUint32(out, checksum(table))
+		out = binary.BigEndian.AppendUint32(out, uint32(offset))
+		out = binary.BigEndian.AppendUint32(out, uint32(len(table)))
+		offset += (len(table) + 3) &^ 3
+	}
+	for _, tag := range tags {
+		out = append(out, tables[tag]...)
+		for len(out)%4 != 0 {
+			out = append(out, 0)
+		}
+	}
+	return out, nil
+}
+
+// checksum is the sum of a table as big endian words
+func checksum(table []byte) uint32 {
+	var sum uint32
+	for i := 0; i < len(table); i += 4 {
+		var word [4]byte
+		copy(word[:], table[i:])
+		sum += binary.BigEndian.Uint32(word[:])
+	}
+	return sum
+}
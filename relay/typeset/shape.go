@@ -0,0 +1,51 @@
+package typeset
+
+import "math"
+
+// Shape is an area text is laid out in, from its top left corner
+type Shape interface {
+	// Span is the left and right of the horizontal segment that is inside
+	// the shape for every y between top and bottom
+	Span(top float64, bottom float64) (float64, float64)
+
+	// MaxHeight is how tall the shape is, 0 when it's unbounded
+	MaxHeight() float64
+}
+
+// Box is a rectangle, a 0 width or height leaves it unbounded that way
+type Box struct {
+	Width  float64
+	Height float64
+}
+
+func (b Box) Span(top float64, bottom float64) (float64, float64) {
+	if b.Width <= 0 {
+		return 0, math.Inf(1)
+	}
+	return 0, b.Width
+}
+
+func (b Box) MaxHeight() float64 { return b.Height }
+
+// Ellipse is the ellipse inside a box, like an oval balloon
+type Ellipse struct {
+	Width  float64
+	Height float64
+}
+
+func (e Ellipse) Span(top float64, bottom float64) (float64, float64) {
+	a, b := e.Width/2, e.Height/2
+	if a <= 0 || b <= 0 {
+		return a, a
+	}
+	// the segment is as wide as the ellipse where the band is the farthest
+	// from the middle
+	dy := max(math.Abs(top-b), math.Abs(bottom-b))
+	if dy >= b {
+		return a, a
+	}
+	half := a * math.Sqrt(1-(dy/b)*(dy/b))
+	return a - half, a + half
+}
+
+func (e Ellipse) MaxHeight() float64 { return e.Height }
@@ -0,0 +1,465 @@
+package typeset
+
+import (
+	"math"
+	"slices"
+	"strings"
+	"unicode"
+
+	"nostr-relay/kinds"
+)
+
+// Faces are the fonts of a typeface by style. Styles without a font use
+// the closest one, and text is measured with approximate metrics when
+// there is none at all.
+type Faces struct {
+	Regular    *Font
+	Bold       *Font
+	Italic     *Font
+	BoldItalic *Font
+}
+
+// face is the font for a style, bold is synthesized over the advances of
+// the regular font when there is no bold one, as browsers do
+func (f Faces) face(bold bool, italic bool) *Font {
+	candidates := []*Font{f.Regular}
+	switch {
+	case bold && italic:
+		candidates = []*Font{f.BoldItalic, f.Bold, f.Italic, f.Regular}
+	case bold:
+		candidates = []*Font{f.Bold, f.Regular}
+	case italic:
+		candidates = []*Font{f.Italic, f.Regular}
+	}
+	for _, font := range candidates {
+		if font != nil {
+			return font
+		}
+	}
+	return nil
+}
+
+// Options tune the layout, zero values use the defaults
+type Options struct {
+	// Size is the font size, in pixels
+	Size float64
+
+	// LineHeight is the distance between baselines in ems, the natural one
+	// of the regular font when 0
+	LineHeight float64
+
+	// Shape is what the text is laid out in, nil for a single line as wide
+	// as the text
+	Shape Shape
+
+	// Hyphenate breaks words between syllables when it fills lines better
+	Hyphenate bool
+}
+
+func (o Options) withDefaults() Options {
+	if o.Size <= 0 {
+		o.Size = 14
+	}
+	if o.Shape == nil {
+		o.Shape = Box{}
+	}
+	return o
+}
+
+// Rect is an area from its top left corner
+type Rect struct {
+	X      float64 `json:"x"`
+	Y      float64 `json:"y"`
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+}
+
+// Block is text laid out in a shape
+type Block struct {
+	Lines []Line `json:"lines"`
+
+	// Bounds is the box of the lines, from the top of the first one to the
+	// bottom of the last one
+	Bounds Rect `json:"bounds"`
+
+	// Truncated is set when the text doesn't fit in the shape, its last
+	// line then ends with an ellipsis
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// Line is a line of text, centered in the shape
+type Line struct {
+	Rect
+
+	// Baseline is where the baseline of the line is
+	Baseline float64 `json:"baseline"`
+
+	Spans []Span `json:"spans"`
+}
+
+// Span is a piece of a line sharing the same markup styles
+type Span struct {
+	Text   string   `json:"text"`
+	Styles []string `json:"styles,omitempty"`
+
+	X     float64 `json:"x"`
+	Width float64 `json:"width"`
+}
+
+// char is a character of text and its advance, with the kerning of the
+// character following it in the same word
+type char struct {
+	r       rune
+	styles  []string
+	advance float64
+}
+
+// word is what lines are broken between. breaks are where it can be broken
+// inside, at hyphens and between syllables.
+type word struct {
+	chars  []char
+	breaks []wordBreak
+}
+
+type wordBreak struct {
+	at int
+
+	// hyphen tells if a hyphen is added at the end of the line
+	hyphen bool
+}
+
+// metrics measure characters with faces at a size
+type metrics struct {
+	faces Faces
+	size  float64
+}
+
+// Layout measures runs of markup with faces and breaks them into lines
+// that fit in the shape, as few as possible, centered horizontally and
+// vertically. Lines are broken at spaces, after hyphens and at soft
+// hyphens, between syllables when options ask for it, and inside words
+// wider than a line otherwise.
+func Layout(runs []kinds.Run, faces Faces, options Options) Block {
+	o := options.withDefaults()
+	m := metrics{faces: faces, size: o.Size}
+	words := m.words(runs, o.Hyphenate)
+
+	ascent, descent, lineGap := 0.95, -0.3, 0.0
+	if faces.Regular != nil {
+		ascent, descent, lineGap = faces.Regular.Ascent(), faces.Regular.Descent(), faces.Regular.LineGap()
+	}
+	lineHeight := (ascent - descent + lineGap) * o.Size
+	if o.LineHeight > 0 {
+		lineHeight = o.LineHeight * o.Size
+	}
+	// the space left by the line height is shared above and below the text
+	baseline := (lineHeight-(ascent-descent)*o.Size)/2 + ascent*o.Size
+
+	var lines [][]char
+	var top float64
+	truncated := false
+	if height := o.Shape.MaxHeight(); height <= 0 {
+		lines, _ = m.fill(words, o.Shape, 0, lineHeight, math.MaxInt)
+	} else {
+		// lines depend on where they are in shapes that aren't boxes, they
+		// are laid out for every count of lines until they fit
+		maxLines := max(int(height/lineHeight), 1)
+		for n := 1; ; n++ {
+			top = (height - float64(n)*lineHeight) / 2
+			var rest bool
+			lines, rest = m.fill(words, o.Shape, top, lineHeight, n)
+			if !rest || n >= maxLines {
+				truncated = rest
+				break
+			}
+		}
+	}
+
+	block := Block{Lines: make([]Line, 0, len(lines)), Truncated: truncated}
+	for k, chars := range lines {
+		y := top + float64(k)*lineHeight
+		left, right := o.Shape.Span(y, y+lineHeight)
+		if truncated && k == len(lines)-1 {
+			chars = m.ellipsis(chars, right-left)
+		}
+
+		width := m.width(chars)
+		x := left
+		if !math.IsInf(right, 1) {
+			x = (left + right - width) / 2
+		}
+		l := Line{Rect: Rect{X: x, Y: y, Width: width, Height: lineHeight}, Baseline: y + baseline, Spans: make([]Span, 0)}
+		for _, c := range chars {
+			if n := len(l.Spans); n > 0 && slices.Equal(l.Spans[n-1].Styles, c.styles) {
+				l.Spans[n-1].Text += string(c.r)
+				l.Spans[n-1].Width += c.advance
+			} else {
+				l.Spans = append(l.Spans, Span{Text: string(c.r), Styles: c.styles, X: x, Width: c.advance})
+			}
+			x += c.advance
+		}
+		block.Lines = append(block.Lines, l)
+	}
+
+	for i, l := range block.Lines {
+		if i == 0 {
+			block.Bounds = l.Rect
+			continue
+		}
+		right := max(block.Bounds.X+block.Bounds.Width, l.X+l.Width)
+		block.Bounds.X = min(block.Bounds.X, l.X)
+		block.Bounds.Width = right - block.Bounds.X
+		block.Bounds.Height = l.Y + l.Height - block.Bounds.Y
+	}
+	return block
+}
+
+// fill breaks words into at most max lines starting at top, telling if
+// some didn't fit
+func (m metrics) fill(words []word, shape Shape, top float64, lineHeight float64, max int) ([][]char, bool) {
+	lines := make([][]char, 0)
+	var current []char
+	available := func() float64 {
+		y := top + float64(len(lines))*lineHeight
+		left, right := shape.Span(y, y+lineHeight)
+		return right - left
+	}
+	room := available()
+	next := func() bool {
+		lines = append(lines, current)
+		current = nil
+		room = available()
+		return len(lines) < max
+	}
+
+	for i, from := 0, 0; i < len(words); {
+		w := words[i]
+		var space []char
+		if len(current) > 0 {
+			space = []char{m.space(current[len(current)-1], w.chars[from])}
+		}
+		used := m.width(current) + m.width(space)
+
+		if used+m.width(w.chars[from:]) <= room {
+			current = append(append(current, space...), w.chars[from:]...)
+			i, from = i+1, 0
+			continue
+		}
+
+		if at, hyphen, ok := m.breakWord(w, from, room-used); ok {
+			current = append(append(current, space...), w.chars[from:at]...)
+			if hyphen {
+				current = append(current, m.hyphen(w.chars[at-1]))
+			}
+			from = at
+			if !next() {
+				return lines, true
+			}
+			continue
+		}
+
+		if len(current) > 0 {
+			if !next() {
+				return lines, true
+			}
+			continue
+		}
+
+		// alone on its line and too wide, the word is cut where it
+		// overflows, keeping at least a character
+		at := from + 1
+		for at < len(w.chars) && m.width(w.chars[from:at+1]) <= room {
+			at++
+		}
+		current = append(current, w.chars[from:at]...)
+		from = at
+		if from == len(w.chars) {
+			i, from = i+1, 0
+			continue
+		}
+		if !next() {
+			return lines, true
+		}
+	}
+	if len(current) > 0 {
+		lines = append(lines, current)
+	}
+	return lines, false
+}
+
+// breakWord finds the break of a word after from that leaves the most on
+// the line, with its hyphen in room
+func (m metrics) breakWord(w word, from int, room float64) (int, bool, bool) {
+	for i := len(w.breaks) - 1; i >= 0; i-- {
+		b := w.breaks[i]
+		if b.at <= from {
+			break
+		}
+		width := m.width(w.chars[from:b.at])
+		if b.hyphen {
+			width += m.hyphen(w.chars[b.at-1]).advance
+		}
+		if width <= room {
+			return b.at, b.hyphen, true
+		}
+	}
+	return 0, false, false
+}
+
+// ellipsis ends a line with "…", taking characters off so it fits
+func (m metrics) ellipsis(chars []char, room float64) []char {
+	chars = slices.Clone(chars)
+	var styles []string
+	if len(chars) > 0 {
+		styles = chars[len(chars)-1].styles
+	}
+	e := m.char('…', styles)
+	for len(chars) > 0 && (m.width(chars)+e.advance > room || unicode.IsSpace(chars[len(chars)-1].r) || chars[len(chars)-1].r == '-') {
+		chars = chars[:len(chars)-1]
+	}
+	return append(chars, e)
+}
+
+// space is what joins two words. It's only styled when both sides are
+// alike, so an underline doesn't run into the next word.
+func (m metrics) space(before char, after char) char {
+	var styles []string
+	if slices.Equal(before.styles, after.styles) {
+		styles = before.styles
+	}
+	return m.char(' ', styles)
+}
+
+func (m metrics) hyphen(before char) char {
+	return m.char('-', before.styles)
+}
+
+func (m metrics) width(chars []char) float64 {
+	width := 0.0
+	for _, c := range chars {
+		width += c.advance
+	}
+	return width
+}
+
+func (m metrics) char(r rune, styles []string) char {
+	return char{r: r, styles: styles, advance: m.advance(r, styles)}
+}
+
+// advance is the width of a character in pixels, from its font when it has
+// the character
+func (m metrics) advance(r rune, styles []string) float64 {
+	bold, italic := isBold(styles), isItalic(styles)
+	if font := m.faces.face(bold, italic); font != nil {
+		if g := font.Glyph(r); g != 0 {
+			return font.Advance(g) * m.size
+		}
+	}
+	return approximate(r, bold) * m.size
+}
+
+// kern is the kerning of two characters in pixels, when they are in the
+// same font
+func (m metrics) kern(a char, b char) float64 {
+	if !slices.Equal(a.styles, b.styles) {
+		return 0
+	}
+	font := m.faces.face(isBold(a.styles), isItalic(a.styles))
+	if font == nil {
+		return 0
+	}
+	left, right := font.Glyph(a.r), font.Glyph(b.r)
+	if left == 0 || right == 0 {
+		return 0
+	}
+	return font.Kern(left, right) * m.size
+}
+
+// words splits runs at white space, measuring characters with the kerning
+// of the one after folded into their advance
+func (m metrics) words(runs []kinds.Run, hyphenate bool) []word {
+	words := make([]word, 0)
+	current := word{}
+	soft := false
+	end := func() {
+		if len(current.chars) == 0 {
+			return
+		}
+		// kerning isn't applied across breaks, the line would end with it
+		for i := 0; i+1 < len(current.chars); i++ {
+			if !slices.ContainsFunc(current.breaks, func(b wordBreak) bool { return b.at == i+1 }) {
+				current.chars[i].advance += m.kern(current.chars[i], current.chars[i+1])
+			}
+		}
+		if hyphenate && !soft {
+			rs := make([]rune, len(current.chars))
+			for i, c := range current.chars {
+				rs[i] = c.r
+			}
+			for _, at := range hyphenation(rs) {
+				if !slices.ContainsFunc(current.breaks, func(b wordBreak) bool { return b.at == at || b.at == at-1 || b.at == at+1 }) {
+					current.breaks = append(current.breaks, wordBreak{at: at, hyphen: true})
+				}
+			}
+			slices.SortFunc(current.breaks, func(a, b wordBreak) int { return a.at - b.at })
+		}
+		words = append(words, current)
+		current, soft = word{}, false
+	}
+
+	for _, run := range runs {
+		for _, r := range run.Text {
+			switch {
+			case unicode.IsSpace(r):
+				end()
+			case r == '\u00ad':
+				// soft hyphens are only shown when a line is broken there,
+				// and tell where the word can be hyphenated
+				if n := len(current.chars); n > 0 {
+					current.breaks = append(current.breaks, wordBreak{at: n, hyphen: true})
+					soft = true
+				}
+			default:
+				if n := len(current.chars); n > 0 && current.chars[n-1].r == '-' && n > 1 {
+					current.breaks = append(current.breaks, wordBreak{at: n})
+				}
+				current.chars = append(current.chars, m.char(r, run.Styles))
+			}
+		}
+	}
+	end()
+	return words
+}
+
+// approximate is the width of a character in ems for text without a font,
+// close to a comic font: narrow punctuation, wide capitals
+func approximate(r rune, bold bool) float64 {
+	var w float64
+	switch {
+	case r == ' ':
+		w = 0.3
+	case strings.ContainsRune("il.,:;'!|", r):
+		w = 0.28
+	case strings.ContainsRune("mwMW", r):
+		w = 0.85
+	case unicode.IsUpper(r) || unicode.IsDigit(r):
+		w = 0.65
+	case r > 0x2e80:
+		// ideographs and emojis
+		w = 1
+	default:
+		w = 0.55
+	}
+	if bold {
+		w *= 1.08
+	}
+	return w
+}
+
+func isBold(styles []string) bool {
+	return slices.Contains(styles, "bold") || slices.Contains(styles, "b")
+}
+
+func isItalic(styles []string) bool {
+	return slices.Contains(styles, "italic") || slices.Contains(styles, "i")
+}
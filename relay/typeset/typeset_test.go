@@ -0,0 +1,468 @@
+package typeset
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"math"
+	"slices"
+	"strings"
+	"testing"
+
+	"nostr-relay/kinds"
+
+	"github.com/andybalholm/brotli"
+)
+
+func u16s(values ...int) []byte {
+	b := make([]byte, 0, 2*len(values))
+	for _, v := range values {
+		b = binary.BigEndian.AppendUint16(b, uint16(v))
+	}
+	return b
+}
+
+// tables of a font with 1000 units per em: lowercase letters are 500 wide,
+// capitals 600, spaces 250 and hyphens 300. Other characters have no glyph.
+func tables() map[string][]byte {
+	head := make([]byte, 54)
+	binary.BigEndian.PutUint16(head[18:], 1000)
+
+	hhea := make([]byte, 36)
+	copy(hhea[4:], u16s(800, -200, 0))
+	binary.BigEndian.PutUint16(hhea[34:], 55)
+
+	maxp := u16s(0, 0x5000, 55)
+
+	var hmtx []byte
+	for g := 0; g < 55; g++ {
+		advance := 500
+		switch {
+		case g >= 27 && g <= 52:
+			advance = 600
+		case g == 53:
+			advance = 250
+		case g == 54:
+			advance = 300
+		}
+		hmtx = append(hmtx, u16s(advance, 0)...)
+	}
+
+	// format 4, segments for space, hyphen, capitals and lowercase
+	starts := []int{' ', '-', 'A', 'a', 0xffff}
+	ends := []int{' ', '-', 'Z', 'z', 0xffff}
+	deltas := []int{53 - ' ', 54 - '-', 27 - 'A', 1 - 'a', 1}
+	segments := len(starts)
+	sub := u16s(4, 16+8*segments, 0, 2*segments, 0, 0, 0)
+	sub = append(sub, u16s(ends...)...)
+	sub = append(sub, u16s(0)...)
+	sub = append(sub, u16s(starts...)...)
+	sub = append(sub, u16s(deltas...)...)
+	sub = append(sub, u16s(0, 0, 0, 0, 0)...)
+	cmap := append(u16s(0, 1, 3, 1, 0, 12), sub...)
+
+	return map[string][]byte{"head": head, "hhea": hhea, "maxp": maxp, "hmtx": hmtx, "cmap": cmap}
+}
+
+func glyph(r rune) int {
+	if r >= 'A' && r <= 'Z' {
+		return 27 + int(r-'A')
+	}
+	return 1 + int(r-'a')
+}
+
+// kernTable has A V kerned by -100
+func kernTable() []byte {
+	return append(u16s(0, 1, 0, 20, 0x0001, 1, 6, 0, 0), u16s(glyph('A'), glyph('V'), -100)...)
+}
+
+// gposTable has T o kerned by -80, with a pair adjustment of format 1
+func gposTable() []byte {
+	gpos := u16s(1, 0, 0, 10, 24)
+	gpos = append(gpos, u16s(1)...)
+	gpos = append(gpos, "kern"...)
+	gpos = append(gpos, u16s(8, 0, 1, 0)...)
+	gpos = append(gpos, u16s(1, 4)...)
+	gpos = append(gpos, u16s(2, 0, 1, 8)...)
+	// the pair adjustment, its pair set, then its coverage
+	gpos = append(gpos, u16s(1, 18, 0x4, 0, 1, 12)...)
+	gpos = append(gpos, u16s(1, glyph('o'), -80)...)
+	gpos = append(gpos, u16s(1, 1, glyph('T'))...)
+	return gpos
+}
+
+// sfnt makes a TrueType font of tables
+func sfnt(tables map[string][]byte) []byte {
+	tags := make([]string, 0)
+	for tag := range tables {
+		tags = append(tags, tag)
+	}
+	slices.Sort(tags)
+
+	font := append([]byte("\x00\x01\x00\x00"), u16s(len(tags), 0, 0, 0)...)
+	offset := 12 + 16*len(tags)
+	var data []byte
+	for _, tag := range tags {
+		font = append(font, tag...)
+		font = binary.BigEndian.AppendUint32(font, 0)
+		font = binary.BigEndian.AppendUint32(font, uint32(offset+len(data)))
+		font = binary.BigEndian.AppendUint32(font, uint32(len(tables[tag])))
+		data = append(data, tables[tag]...)
+		for len(data)%4 != 0 {
+			data = append(data, 0)
+		}
+	}
+	return append(font, data...)
+}
+
+// woff makes a WOFF font of tables, each compressed
+func woff(tables map[string][]byte) []byte {
+	tags := make([]string, 0)
+	for tag := range tables {
+		tags = append(tags, tag)
+	}
+	slices.Sort(tags)
+
+	header := make([]byte, 44)
+	copy(header, "wOFF\x00\x01\x00\x00")
+	binary.BigEndian.PutUint16(header[12:], uint16(len(tags)))
+	offset := 44 + 20*len(tags)
+	var data []byte
+	for _, tag := range tags {
+		var compressed bytes.Buffer
+		w := zlib.NewWriter(&compressed)
+		w.Write(tables[tag])
+		w.Close()
+		table := compressed.Bytes()
+		if len(table) >= len(tables[tag]) {
+			table = tables[tag]
+		}
+
+		header = append(header, tag...)
+		header = binary.BigEndian.AppendUint32(header, uint32(offset+len(data)))
+		header = binary.BigEndian.AppendUint32(header, uint32(len(table)))
+		header = binary.BigEndian.AppendUint32(header, uint32(len(tables[tag])))
+		header = binary.BigEndian.AppendUint32(header, 0)
+		data = append(data, table...)
+	}
+	font := append(header, data...)
+	binary.BigEndian.PutUint32(font[8:], uint32(len(font)))
+	return font
+}
+
+func base128(n int) []byte {
+	b := []byte{byte(n & 0x7f)}
+	for n >>= 7; n > 0; n >>= 7 {
+		b = append([]byte{byte(n&0x7f) | 0x80}, b...)
+	}
+	return b
+}
+
+// woff2 makes a WOFF2 font of tables, hmtx transformed
+func woff2(tables map[string][]byte) []byte {
+	tags := make([]string, 0)
+	for tag := range tables {
+		tags = append(tags, tag)
+	}
+	slices.Sort(tags)
+
+	header := make([]byte, woff2HeaderSize)
+	copy(header, "wOF2\x00\x01\x00\x00")
+	binary.BigEndian.PutUint16(header[12:], uint16(len(tags)))
+
+	var stream []byte
+	for _, tag := range tags {
+		table := tables[tag]
+		index := slices.Index(knownTags[:], tag)
+		if tag == "hmtx" {
+			// advances only
+			transformed := []byte{0x03}
+			for i := 0; i+4 <= len(table); i += 4 {
+				transformed = append(transformed, table[i:i+2]...)
+			}
+			header = append(header, byte(index)|1<<6)
+			header = append(append(header, base128(len(table))...), base128(len(transformed))...)
+			stream = append(stream, transformed...)
+			continue
+		}
+		header = append(append(header, byte(index)), base128(len(table))...)
+		stream = append(stream, table...)
+	}
+
+	var compressed bytes.Buffer
+	w := brotli.NewWriter(&compressed)
+	w.Write(stream)
+	w.Close()
+	binary.BigEndian.PutUint32(header[20:], uint32(compressed.Len()))
+	font := append(header, compressed.Bytes()...)
+	binary.BigEndian.PutUint32(font[8:], uint32(len(font)))
+	return font
+}
+
+func font(t *testing.T, extra map[string][]byte) *Font {
+	all := tables()
+	for tag, table := range extra {
+		all[tag] = table
+	}
+	f, err := Parse(sfnt(all))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestParse(t *testing.T) {
+	all := tables()
+	all["kern"] = kernTable()
+	for name, data := range map[string][]byte{"ttf": sfnt(all), "woff": woff(all), "woff2": woff2(all)} {
+		f, err := Parse(data)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		a, v := f.Glyph('A'), f.Glyph('V')
+		if a != 27 || f.Glyph('b') != 2 || f.Glyph(' ') != 53 || f.Glyph('é') != 0 {
+			t.Errorf("%s: glyphs %d %d %d", name, a, f.Glyph('b'), f.Glyph(' '))
+		}
+		if f.Advance(a) != 0.6 || f.Advance(f.Glyph('-')) != 0.3 || f.Ascent() != 0.8 || f.Descent() != -0.2 {
+			t.Errorf("%s: metrics %v %v %v", name, f.Advance(a), f.Ascent(), f.Descent())
+		}
+		if f.Kern(a, v) != -0.1 || f.Kern(v, a) != 0 {
+			t.Errorf("%s: kerning %v %v", name, f.Kern(a, v), f.Kern(v, a))
+		}
+	}
+
+	gpos := font(t, map[string][]byte{"GPOS": gposTable(), "kern": kernTable()})
+	if k := gpos.Kern(gpos.Glyph('T'), gpos.Glyph('o')); k != -0.08 {
+		t.Errorf("GPOS kerning: %v", k)
+	}
+	if k := gpos.Kern(gpos.Glyph('A'), gpos.Glyph('V')); k != 0 {
+		t.Errorf("the kern table is ignored with GPOS kerning: %v", k)
+	}
+
+	broken := tables()
+	delete(broken, "hmtx")
+	for name, data := range map[string][]byte{
+		"empty":      nil,
+		"collection": []byte("ttcf\x00\x02\x00\x00\x00\x00\x00\x00"),
+		"no hmtx":    sfnt(broken),
+		"truncated":  sfnt(tables())[:100],
+		"svg":        []byte("<svg/>"),
+	} {
+		if _, err := Parse(data); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestCheckWOFF2(t *testing.T) {
+	font := woff2(tables())
+	if err := CheckWOFF2(font); err != nil {
+		t.Fatal(err)
+	}
+
+	truncated := bytes.Clone(font[:len(font)-4])
+	binary.BigEndian.PutUint32(truncated[8:], uint32(len(truncated)))
+	lying := bytes.Clone(font)
+	lying[woff2HeaderSize+1]++
+
+	for name, data := range map[string][]byte{
+		"short":          font[:20],
+		"not woff2":      append([]byte("wOFF"), font[4:]...),
+		"length":         font[:len(font)-1],
+		"truncated":      truncated,
+		"wrong size":     lying,
+		"leading zeroes": append(bytes.Clone(font[:woff2HeaderSize+1]), 0x80, 0x01),
+	} {
+		if err := CheckWOFF2(data); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestHyphenation(t *testing.T) {
+	for word, want := range map[string]string{
+		"hotel":         "ho-tel",
+		"basket":        "bas-ket",
+		"conversation":  "con-ver-sa-tion",
+		"together":      "to-gether",
+		"Characters":    "Cha-rac-ters",
+		"a":             "a",
+		"rhythm":        "rhythm",
+		"привет":        "привет",
+		"éléphant":      "éléphant",
+		"1234567890abc": "1234567890abc",
+	} {
+		runes := []rune(word)
+		got := ""
+		last := 0
+		for _, at := range hyphenation(runes) {
+			got += string(runes[last:at]) + "-"
+			last = at
+		}
+		got += string(runes[last:])
+		if got != want {
+			t.Errorf("%s: %s, want %s", word, got, want)
+		}
+	}
+}
+
+func text(block Block) []string {
+	lines := make([]string, 0)
+	for _, l := range block.Lines {
+		s := ""
+		for _, span := range l.Spans {
+			s += span.Text
+		}
+		lines = append(lines, s)
+	}
+	return lines
+}
+
+func TestLayout(t *testing.T) {
+	f := font(t, map[string][]byte{"kern": kernTable()})
+	faces := Faces{Regular: f}
+
+	single := Layout(kinds.ParseMarkup("AV <bold>ab</bold>"), faces, Options{Size: 10})
+	if len(single.Lines) != 1 || single.Bounds.Width != 6+6-1+2.5+5+5 || single.Bounds.Height != 10 || single.Lines[0].Baseline != 8 {
+		t.Errorf("a line measured with kerning: %+v", single)
+	}
+	if spans := single.Lines[0].Spans; len(spans) != 2 || spans[1].Text != "ab" || spans[1].X != 13.5 || !isBold(spans[1].Styles) {
+		t.Errorf("spans: %+v", spans)
+	}
+
+	box := Box{Width: 100}
+	runs := kinds.ParseMarkup("a <bold>wel</bold>come message that is long enough to wrap, and averyveryveryveryverylongword")
+	block := Layout(runs, faces, Options{Size: 10, Shape: box})
+	lines := text(block)
+	joined := strings.Join(lines, "|")
+	if !strings.HasPrefix(joined, "a welcome") {
+		t.Errorf("a word whose markup changes stays whole: %q", joined)
+	}
+	if !strings.Contains(joined, "averyveryveryveryver|ylongword") {
+		t.Errorf("a word longer than a line is cut: %q", joined)
+	}
+	for _, l := range block.Lines {
+		if l.Width > box.Width || l.X != (box.Width-l.Width)/2 {
+			t.Errorf("line outside of the box or not centered: %+v", l)
+		}
+	}
+	if block.Bounds.Height != float64(len(lines))*10 || block.Lines[1].Y != 10 {
+		t.Errorf("bounds: %+v", block.Bounds)
+	}
+
+	hyphenated := text(Layout(kinds.ParseMarkup("the conversation"), faces, Options{Size: 10, Shape: Box{Width: 60}, Hyphenate: true}))
+	if !slices.Equal(hyphenated, []string{"the conver-", "sation"}) {
+		t.Errorf("hyphenation: %q", hyphenated)
+	}
+	soft := text(Layout([]kinds.Run{{Text: "the con\u00adversation"}}, faces, Options{Size: 10, Shape: Box{Width: 60}, Hyphenate: true}))
+	if !slices.Equal(soft, []string{"the con-", "versation"}) {
+		t.Errorf("soft hyphens replace hyphenation: %q", soft)
+	}
+	hyphens := text(Layout(kinds.ParseMarkup("a well-known thing"), faces, Options{Size: 10, Shape: Box{Width: 50}}))
+	if !slices.Equal(hyphens, []string{"a well-", "known", "thing"}) {
+		t.Errorf("hyphens: %q", hyphens)
+	}
+
+	cut := Layout(kinds.ParseMarkup(strings.Repeat("words go on ", 20)), faces, Options{Size: 10, Shape: Box{Width: 100, Height: 35}})
+	if !cut.Truncated || len(cut.Lines) != 3 || !strings.HasSuffix(text(cut)[2], "…") || cut.Lines[2].Width > 100 {
+		t.Errorf("text that doesn't fit is cut: %v %q", cut.Truncated, text(cut))
+	}
+	if cut.Bounds.Y != 2.5 {
+		t.Errorf("lines are centered vertically: %+v", cut.Bounds)
+	}
+
+	ellipse := Ellipse{Width: 120, Height: 60}
+	oval := Layout(kinds.ParseMarkup(strings.Repeat("ab ", 20)), faces, Options{Size: 10, Shape: ellipse})
+	if oval.Truncated || len(oval.Lines) < 3 {
+		t.Fatalf("ellipse: %v %q", oval.Truncated, text(oval))
+	}
+	middle := oval.Lines[len(oval.Lines)/2]
+	if oval.Lines[0].Width >= middle.Width {
+		t.Errorf("lines are narrower at the top of an ellipse: %q", text(oval))
+	}
+	for _, l := range oval.Lines {
+		left, right := ellipse.Span(l.Y, l.Y+l.Height)
+		if l.X < left-0.001 || l.X+l.Width > right+0.001 {
+			t.Errorf("line outside of the ellipse: %+v, %v %v", l.Rect, left, right)
+		}
+	}
+
+	approximate := Layout(kinds.ParseMarkup("hello"), Faces{}, Options{Size: 10})
+	if w := approximate.Bounds.Width; math.Abs(w-(0.55*3+0.28*2)*10) > 0.001 || approximate.Bounds.Height != 12.5 {
+		t.Errorf("text without fonts: %+v", approximate.Bounds)
+	}
+}
+
+func TestSFNT(t *testing.T) {
+	all := tables()
+	for name, data := range map[string][]byte{"woff": woff(all), "woff2": woff2(all)} {
+		file, err := SFNT(data)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !bytes.HasPrefix(file, []byte("\x00\x01\x00\x00")) || len(file)%4 != 0 {
+			t.Errorf("%s: not a padded TrueType file: % x", name, file[:4])
+		}
+		tables, err := decode(file)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		for tag, table := range all {
+			if !bytes.Equal(tables[tag], table) {
+				t.Errorf("%s: table %s differs", name, tag)
+			}
+		}
+	}
+
+	ttf := sfnt(all)
+	if file, err := SFNT(ttf); err != nil || !bytes.Equal(file, ttf) {
+		t.Errorf("TrueType files are kept as they are: %v", err)
+	}
+	if _, err := SFNT([]byte("<svg/>")); err == nil {
+		t.Errorf("not a font")
+	}
+}
+
+func TestReconstructGlyf(t *testing.T) {
+	// an empty glyph, a triangle with an off curve point and a composite
+	// moving the triangle, whose bounding box is given
+	contours := u16s(0, 1, 0xffff)
+	points := []byte{3}
+	flags := []byte{1, 11, 126 | 0x80}
+	glyphs := []byte{0, 100, 0, 50, 1, 44, 0}
+	composites := u16s(0x0002, 1)
+	composites = append(composites, 10, 20)
+	bboxes := append([]byte{0x20, 0, 0, 0}, u16s(10, 20, 110, 320)...)
+
+	data := u16s(0, 0, 3, 0)
+	streams := [][]byte{contours, points, flags, glyphs, composites, bboxes, nil}
+	for _, s := range streams {
+		data = binary.BigEndian.AppendUint32(data, uint32(len(s)))
+	}
+	for _, s := range streams {
+		data = append(data, s...)
+	}
+
+	glyf, loca, xMins, err := reconstructGlyf(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	triangle := append(u16s(1, 0, 0, 100, 300, 2, 0), 0x31, 0x33, 0x02, 100, 50, 0x01, 0x2c, 0)
+	composite := append(u16s(0xffff, 10, 20, 110, 320), composites...)
+	if want := append(triangle, composite...); !bytes.Equal(glyf, want) {
+		t.Errorf("glyf:\n% x\nwant\n% x", glyf, want)
+	}
+	if want := u16s(0, 0, 11, 19); !bytes.Equal(loca, want) {
+		t.Errorf("loca: % x", loca)
+	}
+	if !slices.Equal(xMins, []int16{0, 0, 10}) {
+		t.Errorf("xMins: %v", xMins)
+	}
+
+	if _, _, _, err := reconstructGlyf(data[:len(data)-3]); err == nil {
+		t.Errorf("truncated streams")
+	}
+}
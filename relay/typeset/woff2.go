@@ -0,0 +1,285 @@
+package typeset
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/andybalholm/brotli"
+)
+
+// woff2HeaderSize is the size of the fixed part of a WOFF2 header
+const woff2HeaderSize = 48
+
+// maxFontSize is the most a font decompresses to, so a small file can't
+// make the relay allocate gigabytes
+const maxFontSize = 32 << 20
+
+// woff2 known table tags, by index
+var knownTags = [63]string{
+	"cmap", "head", "hhea", "hmtx", "maxp", "name", "OS/2", "post", "cvt ", "fpgm",
+	"glyf", "loca", "prep", "CFF ", "VORG", "EBDT", "EBLC", "gasp", "hdmx", "kern",
+	"LTSH", "PCLT", "VDMX", "vhea", "vmtx", "BASE", "GDEF", "GPOS", "GSUB", "EBSC",
+	"JSTF", "MATH", "CBDT", "CBLC", "COLR", "CPAL", "SVG ", "sbix", "acnt", "avar",
+	"bdat", "bloc", "bsln", "cvar", "fdsc", "feat", "fmtx", "fvar", "gvar", "hsty",
+	"just", "lcar", "mort", "morx", "opbd", "prop", "trak", "Zapf", "Silf", "Glat",
+	"Gloc", "Feat", "Sill",
+}
+
+// woff2 known table tags that are transformed by default, by index
+const (
+	glyfIndex = 10
+	locaIndex = 11
+)
+
+// woff2Table is an entry of the table directory of a WOFF2 font
+type woff2Table struct {
+	tag         string
+	transformed bool
+
+	// length is how long the table is in the decompressed stream, its
+	// transformed length when it is transformed
+	length int
+}
+
+// woff2Directory reads the header and table directory of a WOFF2 font,
+// returning the tables and where the compressed stream starts
+func woff2Directory(data []byte) ([]woff2Table, int, error) {
+	if len(data) < woff2HeaderSize {
+		return nil, 0, errors.New("shorter than a WOFF2 header")
+	}
+	if string(data[:4]) != "wOF2" {
+		return nil, 0, errors.New("no WOFF2 signature")
+	}
+
+	switch flavor := string(data[4:8]); flavor {
+	case "\x00\x01\x00\x00", "OTTO", "true", "ttcf":
+	default:
+		return nil, 0, fmt.Errorf("unknown font flavor %q", flavor)
+	}
+	if length := binary.BigEndian.Uint32(data[8:]); int(length) != len(data) {
+		return nil, 0, fmt.Errorf("header declares %d bytes, the font has %d", length, len(data))
+	}
+	numTables := int(binary.BigEndian.Uint16(data[12:]))
+	if numTables == 0 {
+		return nil, 0, errors.New("no tables")
+	}
+	if reserved := binary.BigEndian.Uint16(data[14:]); reserved != 0 {
+		return nil, 0, errors.New("reserved header field is set")
+	}
+
+	tables := make([]woff2Table, 0, numTables)
+	offset := woff2HeaderSize
+	for i := 0; i < numTables; i++ {
+		if offset >= len(data) {
+			return nil, 0, errors.New("table directory runs past the end")
+		}
+		flags := data[offset]
+		offset++
+
+		index := flags & 0x3f
+		var tag string
+		if index == 0x3f {
+			// an arbitrary tag follows
+			if offset+4 > len(data) {
+				return nil, 0, errors.New("table directory runs past the end")
+			}
+			tag = string(data[offset : offset+4])
+			offset += 4
+		} else if int(index) < len(knownTags) {
+			tag = knownTags[index]
+		}
+		if offset >= len(data) {
+			return nil, 0, errors.New("table directory runs past the end")
+		}
+		length, n, err := readBase128(data[offset:])
+		if err != nil {
+			return nil, 0, fmt.Errorf("table %d: %w", i, err)
+		}
+		offset += n
+
+		// glyf and loca are transformed unless said otherwise, other tables
+		// the other way around
+		version := flags >> 6
+		transformed := version != 0
+		if index == glyfIndex || index == locaIndex {
+			transformed = version == 0
+		}
+		if transformed {
+			length, n, err = readBase128(data[offset:])
+			if err != nil {
+				return nil, 0, fmt.Errorf("table %d: %w", i, err)
+			}
+			offset += n
+		}
+		tables = append(tables, woff2Table{tag: tag, transformed: transformed, length: int(length)})
+	}
+	return tables, offset, nil
+}
+
+// CheckWOFF2 validates the header and table directory of a WOFF2 font and
+// that its tables decompress to the declared sizes
+func CheckWOFF2(data []byte) error {
+	tables, offset, err := woff2Directory(data)
+	if err != nil {
+		return err
+	}
+
+	// collections have a directory of their fonts before the tables, which
+	// isn't checked
+	if string(data[4:8]) == "ttcf" {
+		return nil
+	}
+
+	decompressedSize := 0
+	for _, t := range tables {
+		decompressedSize += t.length
+	}
+	compressedSize := int(binary.BigEndian.Uint32(data[20:]))
+	if offset+compressedSize > len(data) {
+		return errors.New("compressed tables run past the end")
+	}
+	reader := brotli.NewReader(bytes.NewReader(data[offset : offset+compressedSize]))
+	n, err := io.Copy(io.Discard, io.LimitReader(reader, int64(decompressedSize)+1))
+	if err != nil {
+		return fmt.Errorf("tables don't decompress: %w", err)
+	}
+	if n != int64(decompressedSize) {
+		return fmt.Errorf("tables decompress to %d bytes, the directory declares %d", n, decompressedSize)
+	}
+	return nil
+}
+
+// decodeWOFF2 decompresses the tables of a WOFF2 font, by tag, undoing the
+// transforms of glyf, loca and hmtx
+func decodeWOFF2(data []byte) (map[string][]byte, error) {
+	tables, offset, err := woff2Directory(data)
+	if err != nil {
+		return nil, err
+	}
+	if string(data[4:8]) == "ttcf" {
+		return nil, errors.New("font collections aren't supported")
+	}
+
+	decompressedSize := 0
+	for _, t := range tables {
+		decompressedSize += t.length
+	}
+	if decompressedSize > maxFontSize {
+		return nil, fmt.Errorf("tables decompress to more than %d bytes", maxFontSize)
+	}
+	compressedSize := int(binary.BigEndian.Uint32(data[20:]))
+	if offset+compressedSize > len(data) {
+		return nil, errors.New("compressed tables run past the end")
+	}
+	stream, err := io.ReadAll(io.LimitReader(brotli.NewReader(bytes.NewReader(data[offset:offset+compressedSize])), int64(decompressedSize)+1))
+	if err != nil {
+		return nil, fmt.Errorf("tables don't decompress: %w", err)
+	}
+	if len(stream) != decompressedSize {
+		return nil, fmt.Errorf("tables decompress to %d bytes, the directory declares %d", len(stream), decompressedSize)
+	}
+
+	sfnt := make(map[string][]byte, len(tables))
+	var glyf, hmtx []byte
+	position := 0
+	for _, t := range tables {
+		table := stream[position : position+t.length]
+		position += t.length
+		switch {
+		case !t.transformed:
+			sfnt[t.tag] = table
+		case t.tag == "glyf":
+			glyf = table
+		case t.tag == "hmtx":
+			hmtx = table
+		}
+	}
+
+	// the side bearings transformed hmtx tables leave out are the xMin of
+	// glyphs, 0 without outlines
+	var xMins []int16
+	if glyf != nil {
+		if sfnt["glyf"], sfnt["loca"], xMins, err = reconstructGlyf(glyf); err != nil {
+			return nil, fmt.Errorf("glyf: %w", err)
+		}
+	}
+
+	if hmtx != nil {
+		hhea, maxp := sfnt["hhea"], sfnt["maxp"]
+		if len(hhea) < 36 || len(maxp) < 6 {
+			return nil, errors.New("transformed hmtx without hhea or maxp")
+		}
+		if sfnt["hmtx"], err = reconstructHmtx(hmtx, int(binary.BigEndian.Uint16(hhea[34:])), int(binary.BigEndian.Uint16(maxp[4:])), xMins); err != nil {
+			return nil, fmt.Errorf("hmtx: %w", err)
+		}
+	}
+	return sfnt, nil
+}
+
+// reconstructHmtx rebuilds an hmtx table from its advances, a flags byte
+// telling which side bearings were left out
+func reconstructHmtx(data []byte, numMetrics int, numGlyphs int, xMins []int16) ([]byte, error) {
+	s := &stream{data: data}
+	flags := s.u8()
+	advances := s.bytes(2 * numMetrics)
+	lsb := func(glyph int) uint16 {
+		if glyph < len(xMins) {
+			return uint16(xMins[glyph])
+		}
+		return 0
+	}
+
+	table := make([]byte, 0, 4*numMetrics+2*max(numGlyphs-numMetrics, 0))
+	var proportional, monospaced []byte
+	if flags&1 == 0 {
+		proportional = s.bytes(2 * numMetrics)
+	}
+	if flags&2 == 0 {
+		monospaced = s.bytes(2 * max(numGlyphs-numMetrics, 0))
+	}
+	if s.err != nil {
+		return nil, errors.New("transformed hmtx is too short")
+	}
+
+	for i := 0; i < numMetrics; i++ {
+		table = append(table, advances[2*i:2*i+2]...)
+		if proportional != nil {
+			table = append(table, proportional[2*i:2*i+2]...)
+		} else {
+			table = binary.BigEndian.AppendUint16(table, lsb(i))
+		}
+	}
+	for i := numMetrics; i < numGlyphs; i++ {
+		if monospaced != nil {
+			table = append(table, monospaced[2*(i-numMetrics):2*(i-numMetrics)+2]...)
+		} else {
+			table = binary.BigEndian.AppendUint16(table, lsb(i))
+		}
+	}
+	return table, nil
+}
+
+// readBase128 reads a WOFF2 UIntBase128, returning how many bytes it took
+func readBase128(data []byte) (uint32, int, error) {
+	var value uint32
+	for i := 0; i < 5; i++ {
+		if i >= len(data) {
+			return 0, 0, errors.New("truncated number")
+		}
+		b := data[i]
+		if i == 0 && b == 0x80 {
+			return 0, 0, errors.New("number with leading zeros")
+		}
+		if value&0xfe000000 != 0 {
+			return 0, 0, errors.New("number overflows")
+		}
+		value = value<<7 | uint32(b&0x7f)
+		if b&0x80 == 0 {
+			return value, i + 1, nil
+		}
+	}
+	return 0, 0, errors.New("number longer than 5 bytes")
+}
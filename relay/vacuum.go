@@ -0,0 +1,42 @@
+package main
+
+import (
+	"log"
+	"os"
+
+	"nostr-relay/config"
+)
+
+func runVacuum(cfg config.Config, args []string) error {
+	flags := newFlagSet("vacuum", "", &cfg)
+	flags.Parse(args)
+
+	db, err := openDatabase(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	before := fileSize(cfg.DatabasePath)
+
+	// VACUUM needs an exclusive lock, it waits for a running relay to finish writing
+	log.Printf("Compacting database...")
+	if _, err := db.Exec("VACUUM"); err != nil {
+		return err
+	}
+	if _, err := db.Exec("PRAGMA optimize"); err != nil {
+		return err
+	}
+
+	log.Printf("Database compacted from %d to %d bytes", before, fileSize(cfg.DatabasePath))
+	return nil
+}
+
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+
+	return info.Size()
+}
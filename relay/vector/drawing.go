@@ -0,0 +1,310 @@
+package vector
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"math"
+)
+
+// MaxPixels is the largest raster image decoded, so small files that claim
+// huge sizes aren't
+const MaxPixels = 64 << 20
+
+var ErrTooManyPixels = errors.New("image has too many pixels")
+
+// Drawing is what an SVG draws, in order, so it can be written in other
+// formats without a browser
+type Drawing struct {
+	// Width and Height are the size of the drawing, in pixels
+	Width  float64
+	Height float64
+
+	Items []Item
+
+	// Fonts are the @font-face rules of the drawing with a data URL
+	Fonts []Font
+
+	// faces are the fonts read so far, by index in Fonts
+	faces map[int]*face
+}
+
+// Item is a Shape, a Text or an Image
+type Item interface {
+	isItem()
+}
+
+// Matrix is an affine transform: a point (x, y) goes to
+// (m[0]*x + m[2]*y + m[4], m[1]*x + m[3]*y + m[5])
+type Matrix [6]float64
+
+var Identity = Matrix{1, 0, 0, 1, 0, 0}
+
+// Multiply is the transform applying n, then m
+func (m Matrix) Multiply(n Matrix) Matrix {
+	return Matrix{
+		m[0]*n[0] + m[2]*n[1],
+		m[1]*n[0] + m[3]*n[1],
+		m[0]*n[2] + m[2]*n[3],
+		m[1]*n[2] + m[3]*n[3],
+		m[0]*n[4] + m[2]*n[5] + m[4],
+		m[1]*n[4] + m[3]*n[5] + m[5],
+	}
+}
+
+func (m Matrix) Apply(p Point) Point {
+	return Point{m[0]*p.X + m[2]*p.Y + m[4], m[1]*p.X + m[3]*p.Y + m[5]}
+}
+
+// Invert is the transform undoing m, the identity when m can't be undone
+func (m Matrix) Invert() Matrix {
+	det := m[0]*m[3] - m[1]*m[2]
+	if det == 0 {
+		return Identity
+	}
+	return Matrix{
+		m[3] / det,
+		-m[1] / det,
+		-m[2] / det,
+		m[0] / det,
+		(m[2]*m[5] - m[3]*m[4]) / det,
+		(m[1]*m[4] - m[0]*m[5]) / det,
+	}
+}
+
+// Scale is how much the transform scales lengths, on average
+func (m Matrix) Scale() float64 {
+	return math.Sqrt(math.Abs(m[0]*m[3] - m[1]*m[2]))
+}
+
+func Translate(x float64, y float64) Matrix {
+	return Matrix{1, 0, 0, 1, x, y}
+}
+
+func Scale(x float64, y float64) Matrix {
+	return Matrix{x, 0, 0, y, 0, 0}
+}
+
+type Point struct {
+	X, Y float64
+}
+
+// Segment is a piece of a path: Op is 'M' to move to Points[0], 'L' for a
+// line to it, 'C' for a cubic curve to Points[2] and 'Z' to close the
+// subpath
+type Segment struct {
+	Op     byte
+	Points [3]Point
+}
+
+type Path []Segment
+
+// Bounds is the box of the points of a path, control points included
+func (p Path) Bounds() (min Point, max Point) {
+	min = Point{math.Inf(1), math.Inf(1)}
+	max = Point{math.Inf(-1), math.Inf(-1)}
+	for _, s := range p {
+		n := 1
+		if s.Op == 'C' {
+			n = 3
+		} else if s.Op == 'Z' {
+			n = 0
+		}
+		for _, pt := range s.Points[:n] {
+			min = Point{math.Min(min.X, pt.X), math.Min(min.Y, pt.Y)}
+			max = Point{math.Max(max.X, pt.X), math.Max(max.Y, pt.Y)}
+		}
+	}
+	if min.X > max.X {
+		return Point{}, Point{}
+	}
+	return min, max
+}
+
+// Transform is the path with its points moved by m
+func (p Path) Transform(m Matrix) Path {
+	out := make(Path, len(p))
+	for i, s := range p {
+		out[i] = Segment{Op: s.Op}
+		for j, pt := range s.Points {
+			out[i].Points[j] = m.Apply(pt)
+		}
+	}
+	return out
+}
+
+// Clip is the area items are drawn in: the union of its shapes, inside the
+// clip of its parent
+type Clip struct {
+	Shapes []ClipShape
+	Parent *Clip
+}
+
+type ClipShape struct {
+	Path    Path
+	Matrix  Matrix
+	EvenOdd bool
+}
+
+// Paint is a color or a gradient, painting nothing when the color is
+// transparent and there is no gradient
+type Paint struct {
+	Color    color.NRGBA
+	Gradient *Gradient
+}
+
+func (p Paint) None() bool {
+	return p.Gradient == nil && p.Color.A == 0
+}
+
+// Gradient is a linear gradient from X1, Y1 to X2, Y2 or a radial one from
+// the focal point Fx, Fy to the circle at Cx, Cy of radius R
+type Gradient struct {
+	Radial         bool
+	X1, Y1, X2, Y2 float64
+	Cx, Cy, R      float64
+	Fx, Fy         float64
+
+	// Matrix takes the coordinates of the gradient to those of the shape it
+	// paints
+	Matrix Matrix
+
+	// Spread is "pad", "reflect" or "repeat", how the gradient goes on
+	// past its ends
+	Spread string
+
+	Stops []Stop
+}
+
+type Stop struct {
+	Offset float64
+	Color  color.NRGBA
+}
+
+// At is the color of the gradient at t, 0 being its start and 1 its end
+func (g *Gradient) At(t float64) color.NRGBA {
+	switch g.Spread {
+	case "repeat":
+		t -= math.Floor(t)
+	case "reflect":
+		t = math.Abs(t - 2*math.Floor(t/2))
+		if t > 1 {
+			t = 2 - t
+		}
+	}
+	if len(g.Stops) == 0 {
+		return color.NRGBA{}
+	}
+	if t <= g.Stops[0].Offset {
+		return g.Stops[0].Color
+	}
+	for i := 1; i < len(g.Stops); i++ {
+		a, b := g.Stops[i-1], g.Stops[i]
+		if t > b.Offset {
+			continue
+		}
+		if b.Offset == a.Offset {
+			return b.Color
+		}
+		f := (t - a.Offset) / (b.Offset - a.Offset)
+		mix := func(x uint8, y uint8) uint8 {
+			return uint8(math.Round(float64(x) + (float64(y)-float64(x))*f))
+		}
+		return color.NRGBA{mix(a.Color.R, b.Color.R), mix(a.Color.G, b.Color.G), mix(a.Color.B, b.Color.B), mix(a.Color.A, b.Color.A)}
+	}
+	return g.Stops[len(g.Stops)-1].Color
+}
+
+// Shape is a path, filled then stroked. Opacities are already applied to
+// the colors of its paints.
+type Shape struct {
+	Path   Path
+	Matrix Matrix
+	Clip   *Clip
+
+	Fill    Paint
+	EvenOdd bool
+
+	Stroke      Paint
+	StrokeWidth float64
+
+	// LineCap is "butt", "round" or "square", LineJoin "miter", "round" or
+	// "bevel"
+	LineCap    string
+	LineJoin   string
+	MiterLimit float64
+}
+
+// Text is a line of text on the baseline Y, placed around X by its anchor
+// as SVG places text chunks
+type Text struct {
+	Matrix Matrix
+	Clip   *Clip
+
+	X, Y float64
+
+	// Anchor is "start", "middle" or "end", where X is in the text
+	Anchor string
+
+	// Size is the font size, in pixels
+	Size float64
+
+	// Families are the font families asked for, in order
+	Families []string
+
+	Runs []Run
+}
+
+// Run is a piece of text sharing the same style
+type Run struct {
+	Text      string
+	Bold      bool
+	Italic    bool
+	Underline bool
+	Fill      Paint
+}
+
+// Font is a font file given by an @font-face rule
+type Font struct {
+	Family string
+	Bold   bool
+	Italic bool
+	Data   []byte
+}
+
+// Image is a raster image or an SVG drawing
+type Image struct {
+	// Matrix takes the image, from 0,0 to its Width and Height, to where it
+	// is drawn
+	Matrix Matrix
+	Clip   *Clip
+
+	Width, Height float64
+
+	// Type and Data are the file of a raster image, Drawing an SVG one
+	// whose opacity is already applied to its colors
+	Type    string
+	Data    []byte
+	Drawing *Drawing
+
+	Opacity float64
+}
+
+// Decode decodes a raster image, refusing those larger than MaxPixels
+func (img *Image) Decode() (image.Image, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(img.Data))
+	if err != nil {
+		return nil, err
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > MaxPixels {
+		return nil, ErrTooManyPixels
+	}
+
+	decoded, _, err := image.Decode(bytes.NewReader(img.Data))
+	return decoded, err
+}
+
+func (*Shape) isItem() {}
+func (*Text) isItem()  {}
+func (*Image) isItem() {}
@@ -0,0 +1,430 @@
+package vector
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// kappa places the control points of a cubic curve drawing a quarter circle
+const kappa = 0.5522847498
+
+// pathBuilder writes paths with absolute coordinates, curves all being
+// cubic
+type pathBuilder struct {
+	path  Path
+	start Point
+	pos   Point
+}
+
+func (b *pathBuilder) moveTo(p Point) {
+	b.path = append(b.path, Segment{Op: 'M', Points: [3]Point{p}})
+	b.start, b.pos = p, p
+}
+
+func (b *pathBuilder) lineTo(p Point) {
+	b.path = append(b.path, Segment{Op: 'L', Points: [3]Point{p}})
+	b.pos = p
+}
+
+func (b *pathBuilder) cubicTo(c1 Point, c2 Point, p Point) {
+	b.path = append(b.path, Segment{Op: 'C', Points: [3]Point{c1, c2, p}})
+	b.pos = p
+}
+
+func (b *pathBuilder) quadTo(c Point, p Point) {
+	from := b.pos
+	b.cubicTo(
+		Point{from.X + 2.0/3*(c.X-from.X), from.Y + 2.0/3*(c.Y-from.Y)},
+		Point{p.X + 2.0/3*(c.X-p.X), p.Y + 2.0/3*(c.Y-p.Y)},
+		p)
+}
+
+func (b *pathBuilder) close() {
+	b.path = append(b.path, Segment{Op: 'Z'})
+	b.pos = b.start
+}
+
+// arcTo draws an SVG elliptical arc to p as cubic curves, following the
+// endpoint to center conversion of the SVG specification
+func (b *pathBuilder) arcTo(rx float64, ry float64, rotation float64, large bool, sweep bool, p Point) {
+	from := b.pos
+	if from == p {
+		return
+	}
+	rx, ry = math.Abs(rx), math.Abs(ry)
+	if rx == 0 || ry == 0 {
+		b.lineTo(p)
+		return
+	}
+
+	sin, cos := math.Sincos(rotation * math.Pi / 180)
+	dx, dy := (from.X-p.X)/2, (from.Y-p.Y)/2
+	x1 := cos*dx + sin*dy
+	y1 := -sin*dx + cos*dy
+
+	// radii too small to reach p are scaled up
+	if l := x1*x1/(rx*rx) + y1*y1/(ry*ry); l > 1 {
+		rx, ry = rx*math.Sqrt(l), ry*math.Sqrt(l)
+	}
+
+	num := rx*rx*ry*ry - rx*rx*y1*y1 - ry*ry*x1*x1
+	den := rx*rx*y1*y1 + ry*ry*x1*x1
+	coef := math.Sqrt(math.Max(num, 0) / den)
+	if large == sweep {
+		coef = -coef
+	}
+	cx1 := coef * rx * y1 / ry
+	cy1 := -coef * ry * x1 / rx
+	cx := cos*cx1 - sin*cy1 + (from.X+p.X)/2
+	cy := sin*cx1 + cos*cy1 + (from.Y+p.Y)/2
+
+	angle := func(ux, uy, vx, vy float64) float64 {
+		return math.Atan2(ux*vy-uy*vx, ux*vx+uy*vy)
+	}
+	theta := angle(1, 0, (x1-cx1)/rx, (y1-cy1)/ry)
+	delta := angle((x1-cx1)/rx, (y1-cy1)/ry, (-x1-cx1)/rx, (-y1-cy1)/ry)
+	if !sweep && delta > 0 {
+		delta -= 2 * math.Pi
+	} else if sweep && delta < 0 {
+		delta += 2 * math.Pi
+	}
+
+	// at most a quarter turn per curve
+	n := int(math.Ceil(math.Abs(delta) / (math.Pi / 2)))
+	step := delta / float64(n)
+	t := 4.0 / 3 * math.Tan(step/4)
+	point := func(a float64) (Point, Point) {
+		sa, ca := math.Sincos(a)
+		x, y := rx*ca, ry*sa
+		tx, ty := -rx*sa, ry*ca
+		return Point{cos*x - sin*y + cx, sin*x + cos*y + cy}, Point{cos*tx - sin*ty, sin*tx + cos*ty}
+	}
+	for i := 0; i < n; i++ {
+		a0, a1 := theta+float64(i)*step, theta+float64(i+1)*step
+		p0, d0 := point(a0)
+		p1, d1 := point(a1)
+		if i == n-1 {
+			p1 = p
+		}
+		b.cubicTo(Point{p0.X + t*d0.X, p0.Y + t*d0.Y}, Point{p1.X - t*d1.X, p1.Y - t*d1.Y}, p1)
+	}
+}
+
+// ellipse draws a closed ellipse, clockwise from its rightmost point
+func (b *pathBuilder) ellipse(cx float64, cy float64, rx float64, ry float64) {
+	kx, ky := rx*kappa, ry*kappa
+	b.moveTo(Point{cx + rx, cy})
+	b.cubicTo(Point{cx + rx, cy + ky}, Point{cx + kx, cy + ry}, Point{cx, cy + ry})
+	b.cubicTo(Point{cx - kx, cy + ry}, Point{cx - rx, cy + ky}, Point{cx - rx, cy})
+	b.cubicTo(Point{cx - rx, cy - ky}, Point{cx - kx, cy - ry}, Point{cx, cy - ry})
+	b.cubicTo(Point{cx + kx, cy - ry}, Point{cx + rx, cy - ky}, Point{cx + rx, cy})
+	b.close()
+}
+
+// rect draws a rectangle, with rounded corners when rx and ry aren't 0
+func (b *pathBuilder) rect(x float64, y float64, w float64, h float64, rx float64, ry float64) {
+	rx, ry = math.Min(rx, w/2), math.Min(ry, h/2)
+	if rx <= 0 || ry <= 0 {
+		b.moveTo(Point{x, y})
+		b.lineTo(Point{x + w, y})
+		b.lineTo(Point{x + w, y + h})
+		b.lineTo(Point{x, y + h})
+		b.close()
+		return
+	}
+
+	kx, ky := rx*kappa, ry*kappa
+	b.moveTo(Point{x + rx, y})
+	b.lineTo(Point{x + w - rx, y})
+	b.cubicTo(Point{x + w - rx + kx, y}, Point{x + w, y + ry - ky}, Point{x + w, y + ry})
+	b.lineTo(Point{x + w, y + h - ry})
+	b.cubicTo(Point{x + w, y + h - ry + ky}, Point{x + w - rx + kx, y + h}, Point{x + w - rx, y + h})
+	b.lineTo(Point{x + rx, y + h})
+	b.cubicTo(Point{x + rx - kx, y + h}, Point{x, y + h - ry + ky}, Point{x, y + h - ry})
+	b.lineTo(Point{x, y + ry})
+	b.cubicTo(Point{x, y + ry - ky}, Point{x + rx - kx, y}, Point{x + rx, y})
+	b.close()
+}
+
+// parsePath reads the d attribute of a path. Like browsers, what comes
+// after an error is left out but what comes before is drawn.
+func parsePath(d string) (Path, error) {
+	s := &scanner{s: d}
+	b := &pathBuilder{}
+	var cmd byte
+	var control Point // last control point, for S and T
+	var last byte
+
+	for {
+		s.skipSpace()
+		if s.done() {
+			return b.path, nil
+		}
+
+		c := s.s[s.i]
+		if isCommand(c) {
+			cmd = c
+			s.i++
+		} else if cmd == 0 {
+			return b.path, fmt.Errorf("path data starts with %q", c)
+		}
+
+		relative := cmd >= 'a'
+		base := Point{}
+		if relative {
+			base = b.pos
+		}
+		abs := func(x, y float64) Point {
+			return Point{base.X + x, base.Y + y}
+		}
+
+		var err error
+		switch upper := cmd &^ 0x20; upper {
+		case 'Z':
+			b.close()
+			last = 'Z'
+			// a Z isn't followed by numbers
+			cmd = 0
+			continue
+
+		case 'M':
+			var p [2]float64
+			if p, err = s.numbers2(); err != nil {
+				return b.path, err
+			}
+			b.moveTo(abs(p[0], p[1]))
+			// following pairs are lines
+			if relative {
+				cmd = 'l'
+			} else {
+				cmd = 'L'
+			}
+
+		case 'L':
+			var p [2]float64
+			if p, err = s.numbers2(); err != nil {
+				return b.path, err
+			}
+			b.ensureStart()
+			b.lineTo(abs(p[0], p[1]))
+
+		case 'H':
+			var x float64
+			if x, err = s.number(); err != nil {
+				return b.path, err
+			}
+			b.ensureStart()
+			if relative {
+				x += b.pos.X
+			}
+			b.lineTo(Point{x, b.pos.Y})
+
+		case 'V':
+			var y float64
+			if y, err = s.number(); err != nil {
+				return b.path, err
+			}
+			b.ensureStart()
+			if relative {
+				y += b.pos.Y
+			}
+			b.lineTo(Point{b.pos.X, y})
+
+		case 'C', 'S':
+			var c1 Point
+			if upper == 'C' {
+				var p [2]float64
+				if p, err = s.numbers2(); err != nil {
+					return b.path, err
+				}
+				c1 = abs(p[0], p[1])
+			} else {
+				c1 = b.pos
+				if last == 'C' || last == 'S' {
+					c1 = Point{2*b.pos.X - control.X, 2*b.pos.Y - control.Y}
+				}
+			}
+			var p2, p3 [2]float64
+			if p2, err = s.numbers2(); err != nil {
+				return b.path, err
+			}
+			if p3, err = s.numbers2(); err != nil {
+				return b.path, err
+			}
+			b.ensureStart()
+			control = abs(p2[0], p2[1])
+			b.cubicTo(c1, control, abs(p3[0], p3[1]))
+
+		case 'Q', 'T':
+			var c Point
+			if upper == 'Q' {
+				var p [2]float64
+				if p, err = s.numbers2(); err != nil {
+					return b.path, err
+				}
+				c = abs(p[0], p[1])
+			} else {
+				c = b.pos
+				if last == 'Q' || last == 'T' {
+					c = Point{2*b.pos.X - control.X, 2*b.pos.Y - control.Y}
+				}
+			}
+			var p [2]float64
+			if p, err = s.numbers2(); err != nil {
+				return b.path, err
+			}
+			b.ensureStart()
+			control = c
+			b.quadTo(c, abs(p[0], p[1]))
+
+		case 'A':
+			var r [2]float64
+			var rotation float64
+			var large, sweep bool
+			var p [2]float64
+			if r, err = s.numbers2(); err != nil {
+				return b.path, err
+			}
+			if rotation, err = s.number(); err != nil {
+				return b.path, err
+			}
+			if large, err = s.flag(); err != nil {
+				return b.path, err
+			}
+			if sweep, err = s.flag(); err != nil {
+				return b.path, err
+			}
+			if p, err = s.numbers2(); err != nil {
+				return b.path, err
+			}
+			b.ensureStart()
+			b.arcTo(r[0], r[1], rotation, large, sweep, abs(p[0], p[1]))
+		}
+		last = cmd &^ 0x20
+	}
+}
+
+// ensureStart begins a subpath where the last one closed, as drawing after
+// a Z does
+func (b *pathBuilder) ensureStart() {
+	if len(b.path) == 0 || b.path[len(b.path)-1].Op == 'Z' {
+		b.moveTo(b.pos)
+	}
+}
+
+func isCommand(c byte) bool {
+	return strings.IndexByte("MmLlHhVvCcSsQqTtAaZz", c) >= 0
+}
+
+// scanner reads the numbers of path data and attribute lists
+type scanner struct {
+	s string
+	i int
+}
+
+func (s *scanner) done() bool {
+	return s.i >= len(s.s)
+}
+
+func (s *scanner) skipSpace() {
+	for !s.done() && (s.s[s.i] == ' ' || s.s[s.i] == '\t' || s.s[s.i] == '\n' || s.s[s.i] == '\r' || s.s[s.i] == '\f') {
+		s.i++
+	}
+}
+
+// skipSeparator skips spaces and at most one comma
+func (s *scanner) skipSeparator() {
+	s.skipSpace()
+	if !s.done() && s.s[s.i] == ',' {
+		s.i++
+		s.skipSpace()
+	}
+}
+
+// number reads a number like "-1.5e3", or ".5" right after "1.5" in
+// "1.5.5"
+func (s *scanner) number() (float64, error) {
+	s.skipSpace()
+	start := s.i
+	if !s.done() && (s.s[s.i] == '+' || s.s[s.i] == '-') {
+		s.i++
+	}
+	digits := false
+	for !s.done() && s.s[s.i] >= '0' && s.s[s.i] <= '9' {
+		s.i++
+		digits = true
+	}
+	if !s.done() && s.s[s.i] == '.' {
+		s.i++
+		for !s.done() && s.s[s.i] >= '0' && s.s[s.i] <= '9' {
+			s.i++
+			digits = true
+		}
+	}
+	if digits && !s.done() && (s.s[s.i] == 'e' || s.s[s.i] == 'E') {
+		end := s.i
+		s.i++
+		if !s.done() && (s.s[s.i] == '+' || s.s[s.i] == '-') {
+			s.i++
+		}
+		exponent := false
+		for !s.done() && s.s[s.i] >= '0' && s.s[s.i] <= '9' {
+			s.i++
+			exponent = true
+		}
+		if !exponent {
+			s.i = end
+		}
+	}
+	if !digits {
+		s.i = start
+		return 0, fmt.Errorf("expected a number at %d", start)
+	}
+
+	v, err := strconv.ParseFloat(s.s[start:s.i], 64)
+	if err != nil || math.IsInf(v, 0) {
+		return 0, fmt.Errorf("invalid number %q", s.s[start:s.i])
+	}
+	s.skipSeparator()
+	return v, nil
+}
+
+func (s *scanner) numbers2() ([2]float64, error) {
+	x, err := s.number()
+	if err != nil {
+		return [2]float64{}, err
+	}
+	y, err := s.number()
+	return [2]float64{x, y}, err
+}
+
+// flag reads the 0 or 1 of an arc, which needs no separator
+func (s *scanner) flag() (bool, error) {
+	s.skipSpace()
+	if s.done() || (s.s[s.i] != '0' && s.s[s.i] != '1') {
+		return false, fmt.Errorf("expected a flag at %d", s.i)
+	}
+	v := s.s[s.i] == '1'
+	s.i++
+	s.skipSeparator()
+	return v, nil
+}
+
+// parseNumbers reads a list of numbers, like the points of a polygon
+func parseNumbers(value string) []float64 {
+	s := &scanner{s: value}
+	numbers := make([]float64, 0)
+	for {
+		s.skipSeparator()
+		if s.done() {
+			return numbers
+		}
+		v, err := s.number()
+		if err != nil {
+			return numbers
+		}
+		numbers = append(numbers, v)
+	}
+}
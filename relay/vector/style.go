@@ -0,0 +1,447 @@
+package vector
+
+import (
+	"encoding/base64"
+	"image/color"
+	"math"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/colornames"
+)
+
+// parseColor reads a CSS color: hex, rgb(), rgba(), hsl(), hsla() or a
+// name. currentColor is left to the caller.
+func parseColor(value string) (color.NRGBA, bool) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if value == "transparent" {
+		return color.NRGBA{}, true
+	}
+	if c, ok := colornames.Map[value]; ok {
+		return color.NRGBA{c.R, c.G, c.B, c.A}, true
+	}
+
+	if hex, ok := strings.CutPrefix(value, "#"); ok {
+		digits := make([]uint8, 0, 8)
+		for _, r := range hex {
+			d, err := strconv.ParseUint(string(r), 16, 8)
+			if err != nil {
+				return color.NRGBA{}, false
+			}
+			digits = append(digits, uint8(d))
+		}
+		switch len(digits) {
+		case 3, 4:
+			c := color.NRGBA{digits[0] * 17, digits[1] * 17, digits[2] * 17, 255}
+			if len(digits) == 4 {
+				c.A = digits[3] * 17
+			}
+			return c, true
+		case 6, 8:
+			c := color.NRGBA{digits[0]<<4 | digits[1], digits[2]<<4 | digits[3], digits[4]<<4 | digits[5], 255}
+			if len(digits) == 8 {
+				c.A = digits[6]<<4 | digits[7]
+			}
+			return c, true
+		}
+		return color.NRGBA{}, false
+	}
+
+	name, args, ok := strings.Cut(value, "(")
+	if !ok || !strings.HasSuffix(args, ")") {
+		return color.NRGBA{}, false
+	}
+	parts := strings.FieldsFunc(strings.TrimSuffix(args, ")"), func(r rune) bool {
+		return r == ',' || r == ' ' || r == '/'
+	})
+	if len(parts) < 3 || len(parts) > 4 {
+		return color.NRGBA{}, false
+	}
+	alpha := 1.0
+	if len(parts) == 4 {
+		alpha = fraction(parts[3], 1)
+	}
+
+	switch strings.TrimSpace(name) {
+	case "rgb", "rgba":
+		channel := func(s string) uint8 {
+			if p, ok := strings.CutSuffix(s, "%"); ok {
+				v, _ := strconv.ParseFloat(p, 64)
+				return clamp8(v * 2.55)
+			}
+			v, _ := strconv.ParseFloat(s, 64)
+			return clamp8(v)
+		}
+		return color.NRGBA{channel(parts[0]), channel(parts[1]), channel(parts[2]), clamp8(alpha * 255)}, true
+
+	case "hsl", "hsla":
+		h, _ := strconv.ParseFloat(strings.TrimSuffix(parts[0], "deg"), 64)
+		s := fraction(parts[1], 100)
+		l := fraction(parts[2], 100)
+		h = math.Mod(math.Mod(h, 360)+360, 360) / 360
+		hue := func(t float64) uint8 {
+			t = math.Mod(t+1, 1)
+			q := l + s - l*s
+			if l < 0.5 {
+				q = l * (1 + s)
+			}
+			p := 2*l - q
+			var v float64
+			switch {
+			case t < 1.0/6:
+				v = p + (q-p)*6*t
+			case t < 0.5:
+				v = q
+			case t < 2.0/3:
+				v = p + (q-p)*(2.0/3-t)*6
+			default:
+				v = p
+			}
+			return clamp8(v * 255)
+		}
+		return color.NRGBA{hue(h + 1.0/3), hue(h), hue(h - 1.0/3), clamp8(alpha * 255)}, true
+	}
+	return color.NRGBA{}, false
+}
+
+// fraction reads a number or a percentage of scale, as a fraction
+func fraction(s string, scale float64) float64 {
+	if p, ok := strings.CutSuffix(strings.TrimSpace(s), "%"); ok {
+		v, _ := strconv.ParseFloat(p, 64)
+		return math.Max(0, math.Min(1, v/100))
+	}
+	v, _ := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	return math.Max(0, math.Min(1, v/scale))
+}
+
+func clamp8(v float64) uint8 {
+	return uint8(math.Max(0, math.Min(255, math.Round(v))))
+}
+
+// parseOpacity reads an opacity, a number or a percentage, 1 when invalid
+func parseOpacity(value string) float64 {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 1
+	}
+	if p, ok := strings.CutSuffix(value, "%"); ok {
+		v, err := strconv.ParseFloat(p, 64)
+		if err != nil {
+			return 1
+		}
+		return math.Max(0, math.Min(1, v/100))
+	}
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 1
+	}
+	return math.Max(0, math.Min(1, v))
+}
+
+// fontSize is the default size of text, which em lengths are relative to
+const fontSize = 16
+
+// parseLength reads a length in pixels, percentages being of reference
+func parseLength(value string, reference float64) (float64, bool) {
+	value = strings.TrimSpace(value)
+	units := []struct {
+		suffix string
+		scale  float64
+	}{
+		{"px", 1}, {"pt", 4.0 / 3}, {"pc", 16}, {"mm", 96 / 25.4}, {"cm", 96 / 2.54}, {"in", 96},
+		{"em", fontSize}, {"ex", fontSize / 2}, {"%", reference / 100},
+	}
+	scale := 1.0
+	for _, unit := range units {
+		if v, ok := strings.CutSuffix(value, unit.suffix); ok {
+			value, scale = strings.TrimSpace(v), unit.scale
+			break
+		}
+	}
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsInf(v, 0) || math.IsNaN(v) {
+		return 0, false
+	}
+	return v * scale, true
+}
+
+// length reads a length with a default
+func length(value string, reference float64, def float64) float64 {
+	if v, ok := parseLength(value, reference); ok {
+		return v
+	}
+	return def
+}
+
+// parseTransform reads the transform attribute: a list of matrix,
+// translate, scale, rotate, skewX and skewY functions
+func parseTransform(value string) Matrix {
+	m := Identity
+	rest := value
+	for {
+		name, after, ok := strings.Cut(rest, "(")
+		if !ok {
+			return m
+		}
+		args, next, ok := strings.Cut(after, ")")
+		if !ok {
+			return m
+		}
+		rest = next
+		a := parseNumbers(args)
+
+		var t Matrix
+		switch strings.TrimSpace(strings.Trim(strings.TrimSpace(name), ",")) {
+		case "matrix":
+			if len(a) != 6 {
+				return m
+			}
+			t = Matrix{a[0], a[1], a[2], a[3], a[4], a[5]}
+		case "translate":
+			if len(a) == 1 {
+				t = Translate(a[0], 0)
+			} else if len(a) == 2 {
+				t = Translate(a[0], a[1])
+			} else {
+				return m
+			}
+		case "scale":
+			if len(a) == 1 {
+				t = Scale(a[0], a[0])
+			} else if len(a) == 2 {
+				t = Scale(a[0], a[1])
+			} else {
+				return m
+			}
+		case "rotate":
+			if len(a) != 1 && len(a) != 3 {
+				return m
+			}
+			sin, cos := math.Sincos(a[0] * math.Pi / 180)
+			t = Matrix{cos, sin, -sin, cos, 0, 0}
+			if len(a) == 3 {
+				t = Translate(a[1], a[2]).Multiply(t).Multiply(Translate(-a[1], -a[2]))
+			}
+		case "skewX":
+			if len(a) != 1 {
+				return m
+			}
+			t = Matrix{1, 0, math.Tan(a[0] * math.Pi / 180), 1, 0, 0}
+		case "skewY":
+			if len(a) != 1 {
+				return m
+			}
+			t = Matrix{1, math.Tan(a[0] * math.Pi / 180), 0, 1, 0, 0}
+		default:
+			return m
+		}
+		m = m.Multiply(t)
+	}
+}
+
+// parseDeclarations reads "name: value; ..." as in a style attribute
+func parseDeclarations(value string) map[string]string {
+	declarations := make(map[string]string)
+	for _, d := range strings.Split(value, ";") {
+		name, v, ok := strings.Cut(d, ":")
+		if !ok {
+			continue
+		}
+		v = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(v), "!important"))
+		declarations[strings.ToLower(strings.TrimSpace(name))] = v
+	}
+	return declarations
+}
+
+// rule is a CSS rule with simple selectors: a tag, classes and an id, like
+// "path", ".skin" or "g#head.left"
+type rule struct {
+	selectors    []selector
+	declarations map[string]string
+}
+
+type selector struct {
+	tag     string
+	id      string
+	classes []string
+}
+
+func (s selector) matches(e *element) bool {
+	if s.tag != "" && s.tag != "*" && s.tag != e.name {
+		return false
+	}
+	if s.id != "" && s.id != e.attrs["id"] {
+		return false
+	}
+	classes := strings.Fields(e.attrs["class"])
+	for _, c := range s.classes {
+		if !slices.Contains(classes, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseStylesheet reads the rules of a style element, and its @font-face
+// rules as fonts. Rules with selectors it can't match, like descendant
+// selectors, are left out.
+func parseStylesheet(css string) ([]rule, []Font) {
+	rules := make([]rule, 0)
+	fonts := make([]Font, 0)
+	css = stripComments(css)
+	for {
+		prelude, after, ok := strings.Cut(css, "{")
+		if !ok {
+			return rules, fonts
+		}
+		body, next, ok := strings.Cut(after, "}")
+		if !ok {
+			return rules, fonts
+		}
+		css = next
+		prelude = strings.TrimSpace(prelude)
+
+		if strings.HasPrefix(prelude, "@") {
+			if strings.EqualFold(prelude, "@font-face") {
+				if font, ok := parseFontFace(parseDeclarations(body)); ok {
+					fonts = append(fonts, font)
+				}
+			}
+			continue
+		}
+
+		r := rule{declarations: parseDeclarations(body)}
+		for _, s := range strings.Split(prelude, ",") {
+			if sel, ok := parseSelector(strings.TrimSpace(s)); ok {
+				r.selectors = append(r.selectors, sel)
+			}
+		}
+		if len(r.selectors) > 0 {
+			rules = append(rules, r)
+		}
+	}
+}
+
+func stripComments(css string) string {
+	var b strings.Builder
+	for {
+		before, after, ok := strings.Cut(css, "/*")
+		b.WriteString(before)
+		if !ok {
+			return b.String()
+		}
+		_, css, ok = strings.Cut(after, "*/")
+		if !ok {
+			return b.String()
+		}
+	}
+}
+
+func parseSelector(s string) (selector, bool) {
+	if s == "" || strings.ContainsAny(s, " >+~[:") {
+		return selector{}, false
+	}
+	var sel selector
+	i := strings.IndexAny(s, ".#")
+	if i < 0 {
+		sel.tag = s
+		return sel, true
+	}
+	sel.tag = s[:i]
+	s = s[i:]
+	for s != "" {
+		kind := s[0]
+		s = s[1:]
+		end := strings.IndexAny(s, ".#")
+		if end < 0 {
+			end = len(s)
+		}
+		name := s[:end]
+		s = s[end:]
+		if name == "" {
+			return selector{}, false
+		}
+		if kind == '#' {
+			sel.id = name
+		} else {
+			sel.classes = append(sel.classes, name)
+		}
+	}
+	return sel, true
+}
+
+// parseFontFace reads an @font-face rule whose source is a data URL
+func parseFontFace(declarations map[string]string) (Font, bool) {
+	font := Font{Family: unquote(declarations["font-family"])}
+	font.Bold = isBold(declarations["font-weight"])
+	font.Italic = declarations["font-style"] == "italic" || declarations["font-style"] == "oblique"
+
+	for _, src := range strings.Split(declarations["src"], ",") {
+		src = strings.TrimSpace(src)
+		u, ok := strings.CutPrefix(src, "url(")
+		if !ok {
+			continue
+		}
+		u, _, _ = strings.Cut(u, ")")
+		if data, _, ok := decodeDataURL(unquote(u)); ok {
+			font.Data = data
+			return font, font.Family != ""
+		}
+	}
+	return Font{}, false
+}
+
+func unquote(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// isBold tells if a font-weight is bold
+func isBold(weight string) bool {
+	if n, err := strconv.Atoi(strings.TrimSpace(weight)); err == nil {
+		return n >= 600
+	}
+	return weight == "bold" || weight == "bolder"
+}
+
+// parseFamilies reads a font-family list
+func parseFamilies(value string) []string {
+	families := make([]string, 0)
+	for _, f := range strings.Split(value, ",") {
+		if f = unquote(f); f != "" {
+			families = append(families, f)
+		}
+	}
+	return families
+}
+
+// decodeDataURL reads the content and type of a data URL, external
+// references are never followed
+func decodeDataURL(u string) ([]byte, string, bool) {
+	rest, ok := strings.CutPrefix(strings.TrimSpace(u), "data:")
+	if !ok {
+		return nil, "", false
+	}
+	meta, payload, ok := strings.Cut(rest, ",")
+	if !ok {
+		return nil, "", false
+	}
+	mimeType, _, _ := strings.Cut(meta, ";")
+	if strings.HasSuffix(meta, ";base64") {
+		data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(payload), ""))
+		if err != nil {
+			return nil, "", false
+		}
+		return data, mimeType, true
+	}
+	data, err := url.PathUnescape(payload)
+	if err != nil {
+		return nil, "", false
+	}
+	return []byte(data), mimeType, true
+}
@@ -0,0 +1,981 @@
+package vector
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+
+	_ "golang.org/x/image/webp"
+)
+
+const svgNamespace = "http://www.w3.org/2000/svg"
+
+const (
+	// maxElements bounds the size of the documents parsed
+	maxElements = 100000
+
+	// maxDepth bounds the nesting of elements, uses and SVG images
+	maxDepth = 64
+
+	// maxImageDepth bounds SVG images drawn inside SVG images
+	maxImageDepth = 4
+)
+
+var ErrTooLarge = errors.New("svg has too many elements")
+
+// element is a node of the document, name being "" for text
+type element struct {
+	name     string
+	attrs    map[string]string
+	children []*element
+	text     string
+}
+
+// Parse reads an SVG into what it draws. It supports what drawing tools and
+// comic panels use: shapes and paths, groups, use, inline styles and simple
+// CSS, gradients, clip paths, text and images with data URLs. External
+// references, filters, masks and patterns are left out, like scripts and
+// animations.
+func Parse(data []byte) (*Drawing, error) {
+	return parse(data, 0)
+}
+
+func parse(data []byte, depth int) (*Drawing, error) {
+	root, err := decode(data)
+	if err != nil {
+		return nil, err
+	}
+	if root.name != "svg" {
+		return nil, fmt.Errorf("root element is %s, not svg", root.name)
+	}
+
+	p := &parser{ids: make(map[string]*element), drawing: &Drawing{}, imageDepth: depth}
+	p.index(root)
+
+	// the size of the drawing, from its viewBox when it has none
+	viewBox, hasViewBox := parseViewBox(root.attrs["viewBox"])
+	width, height := 300.0, 150.0
+	if hasViewBox {
+		width, height = viewBox[2], viewBox[3]
+	}
+	if w, ok := parseLength(root.attrs["width"], width); ok && w > 0 && !strings.HasSuffix(root.attrs["width"], "%") {
+		if !hasViewBox || root.attrs["height"] != "" {
+			width = w
+		} else {
+			height, width = height*w/width, w
+		}
+	}
+	if h, ok := parseLength(root.attrs["height"], height); ok && h > 0 && !strings.HasSuffix(root.attrs["height"], "%") {
+		if !hasViewBox || root.attrs["width"] != "" {
+			height = h
+		} else {
+			width, height = width*h/height, h
+		}
+	}
+	p.drawing.Width, p.drawing.Height = width, height
+
+	m := Identity
+	viewport := [2]float64{width, height}
+	if hasViewBox {
+		m = viewBoxTransform(viewBox, 0, 0, width, height, root.attrs["preserveAspectRatio"])
+		viewport = [2]float64{viewBox[2], viewBox[3]}
+	}
+	s := p.style(root, nil)
+	p.walkChildren(root, s, state{matrix: m, opacity: parseOpacity(s["opacity"]), viewport: viewport})
+
+	p.drawing.Fonts = p.fonts
+	return p.drawing, nil
+}
+
+// decode reads the elements of the SVG namespace into a tree, leaving out
+// those of other namespaces like editor metadata
+func decode(data []byte) (*element, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	d.Entity = xml.HTMLEntity
+
+	var root *element
+	stack := make([]*element, 0)
+	skip := 0
+	count := 0
+	for {
+		token, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid svg: %w", err)
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			if skip > 0 || (t.Name.Space != "" && t.Name.Space != svgNamespace) {
+				skip++
+				continue
+			}
+			if count++; count > maxElements {
+				return nil, ErrTooLarge
+			}
+			if len(stack) >= maxDepth {
+				return nil, fmt.Errorf("svg is nested more than %d levels", maxDepth)
+			}
+			e := &element{name: t.Name.Local, attrs: make(map[string]string)}
+			for _, a := range t.Attr {
+				// xlink:href is the href of older documents
+				if a.Name.Space == "" || a.Name.Space == svgNamespace || (a.Name.Local == "href" && a.Name.Space == "http://www.w3.org/1999/xlink") {
+					e.attrs[a.Name.Local] = a.Value
+				} else if a.Name.Space == "xml" || a.Name.Space == "http://www.w3.org/XML/1998/namespace" {
+					e.attrs["xml:"+a.Name.Local] = a.Value
+				}
+			}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, e)
+			} else if root == nil {
+				root = e
+			}
+			stack = append(stack, e)
+
+		case xml.EndElement:
+			if skip > 0 {
+				skip--
+				continue
+			}
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+
+		case xml.CharData:
+			if skip > 0 || len(stack) == 0 {
+				continue
+			}
+			parent := stack[len(stack)-1]
+			if n := len(parent.children); n > 0 && parent.children[n-1].name == "" {
+				parent.children[n-1].text += string(t)
+			} else {
+				parent.children = append(parent.children, &element{text: string(t)})
+			}
+		}
+	}
+
+	if root == nil {
+		return nil, errors.New("invalid svg: no root element")
+	}
+	return root, nil
+}
+
+type parser struct {
+	ids     map[string]*element
+	rules   []rule
+	fonts   []Font
+	drawing *Drawing
+
+	// depth is how deep uses are followed, imageDepth how deep SVG images
+	// are nested
+	depth      int
+	imageDepth int
+}
+
+// index finds the elements with an id, and the style elements which apply
+// to the whole document
+func (p *parser) index(e *element) {
+	if id := e.attrs["id"]; id != "" {
+		if _, ok := p.ids[id]; !ok {
+			p.ids[id] = e
+		}
+	}
+	if e.name == "style" {
+		css := ""
+		for _, c := range e.children {
+			css += c.text
+		}
+		rules, fonts := parseStylesheet(css)
+		p.rules = append(p.rules, rules...)
+		p.fonts = append(p.fonts, fonts...)
+	}
+	for _, c := range e.children {
+		if c.name != "" {
+			p.index(c)
+		}
+	}
+}
+
+// inherited are the properties children get from their parent
+var inherited = []string{
+	"fill", "fill-opacity", "fill-rule", "stroke", "stroke-width", "stroke-opacity", "stroke-linecap",
+	"stroke-linejoin", "stroke-miterlimit", "font-family", "font-size", "font-weight", "font-style",
+	"text-anchor", "visibility", "color", "clip-rule", "text-decoration", "xml:space",
+}
+
+// properties are all the properties read from attributes and styles
+var properties = append(append([]string{}, inherited...), "opacity", "display", "clip-path", "stop-color", "stop-opacity")
+
+type style map[string]string
+
+// style is the computed style of an element: what it inherits, then its
+// attributes, the rules matching it and its style attribute
+func (p *parser) style(e *element, parent style) style {
+	s := make(style)
+	for _, name := range inherited {
+		if v, ok := parent[name]; ok {
+			s[name] = v
+		}
+	}
+
+	set := func(name string, value string) {
+		if value == "inherit" {
+			if v, ok := parent[name]; ok {
+				s[name] = v
+			} else {
+				delete(s, name)
+			}
+			return
+		}
+		if name == "font-size" {
+			value = resolveFontSize(value, parentFontSize(parent))
+		}
+		if name == "text-decoration" && parent["text-decoration"] != "" && value != "none" {
+			// decorations of ancestors are drawn on their descendants too
+			value = parent["text-decoration"] + " " + value
+		}
+		s[name] = value
+	}
+
+	for _, name := range properties {
+		if v, ok := e.attrs[name]; ok {
+			set(name, strings.TrimSpace(v))
+		}
+	}
+	for _, r := range p.rules {
+		for _, sel := range r.selectors {
+			if sel.matches(e) {
+				for name, v := range r.declarations {
+					set(name, v)
+				}
+				break
+			}
+		}
+	}
+	for name, v := range parseDeclarations(e.attrs["style"]) {
+		set(name, v)
+	}
+	return s
+}
+
+func parentFontSize(parent style) float64 {
+	if v, err := strconv.ParseFloat(parent["font-size"], 64); err == nil {
+		return v
+	}
+	return fontSize
+}
+
+// resolveFontSize is a font size in pixels, relative to the size of the
+// parent
+func resolveFontSize(value string, parent float64) string {
+	keywords := map[string]float64{
+		"xx-small": 9, "x-small": 10, "small": 13, "medium": 16, "large": 18, "x-large": 24, "xx-large": 32,
+		"smaller": parent / 1.2, "larger": parent * 1.2,
+	}
+	v, ok := keywords[value]
+	if !ok {
+		if em, cut := strings.CutSuffix(value, "em"); cut {
+			n, err := strconv.ParseFloat(strings.TrimSpace(em), 64)
+			v, ok = n*parent, err == nil
+		} else {
+			v, ok = parseLength(value, parent)
+		}
+	}
+	if !ok || v < 0 {
+		v = parent
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// state is what an element draws in: its transform, clip, the opacity of
+// its groups and the size percentages are relative to
+type state struct {
+	matrix   Matrix
+	clip     *Clip
+	opacity  float64
+	viewport [2]float64
+}
+
+func (st state) reference(axis string) float64 {
+	switch axis {
+	case "x":
+		return st.viewport[0]
+	case "y":
+		return st.viewport[1]
+	}
+	return math.Hypot(st.viewport[0], st.viewport[1]) / math.Sqrt2
+}
+
+func (p *parser) walkChildren(e *element, s style, st state) {
+	for _, c := range e.children {
+		if c.name != "" {
+			p.walk(c, s, st)
+		}
+	}
+}
+
+func (p *parser) walk(e *element, parent style, st state) {
+	s := p.style(e, parent)
+	if s["display"] == "none" {
+		return
+	}
+
+	st.matrix = st.matrix.Multiply(parseTransform(e.attrs["transform"]))
+	st.opacity *= parseOpacity(s["opacity"])
+
+	switch e.name {
+	case "g", "a", "switch":
+		st.clip = p.clip(e, s, st, nil)
+		p.walkChildren(e, s, st)
+
+	case "svg":
+		p.nested(e, s, st)
+
+	case "use":
+		p.use(e, s, st)
+
+	case "path", "rect", "circle", "ellipse", "line", "polyline", "polygon":
+		path := p.shapePath(e, st)
+		if len(path) == 0 {
+			return
+		}
+		st.clip = p.clip(e, s, st, path)
+		p.shape(path, s, st)
+
+	case "text":
+		st.clip = p.clip(e, s, st, nil)
+		p.text(e, s, st)
+
+	case "image":
+		st.clip = p.clip(e, s, st, nil)
+		p.image(e, s, st)
+	}
+}
+
+// nested draws an svg element inside the document, clipped to its viewport
+func (p *parser) nested(e *element, s style, st state) {
+	x := length(e.attrs["x"], st.viewport[0], 0)
+	y := length(e.attrs["y"], st.viewport[1], 0)
+	w := length(e.attrs["width"], st.viewport[0], st.viewport[0])
+	h := length(e.attrs["height"], st.viewport[1], st.viewport[1])
+	if w <= 0 || h <= 0 {
+		return
+	}
+
+	b := &pathBuilder{}
+	b.rect(x, y, w, h, 0, 0)
+	st.clip = &Clip{Shapes: []ClipShape{{Path: b.path, Matrix: st.matrix}}, Parent: st.clip}
+
+	if viewBox, ok := parseViewBox(e.attrs["viewBox"]); ok {
+		st.matrix = st.matrix.Multiply(viewBoxTransform(viewBox, x, y, w, h, e.attrs["preserveAspectRatio"]))
+		st.viewport = [2]float64{viewBox[2], viewBox[3]}
+	} else {
+		st.matrix = st.matrix.Multiply(Translate(x, y))
+		st.viewport = [2]float64{w, h}
+	}
+	p.walkChildren(e, s, st)
+}
+
+// use draws the element it refers to, at x and y
+func (p *parser) use(e *element, s style, st state) {
+	target, ok := p.ref(e.attrs["href"])
+	if !ok || p.depth >= maxDepth {
+		return
+	}
+	p.depth++
+	defer func() { p.depth-- }()
+
+	x := length(e.attrs["x"], st.viewport[0], 0)
+	y := length(e.attrs["y"], st.viewport[1], 0)
+	st.clip = p.clip(e, s, st, nil)
+	st.matrix = st.matrix.Multiply(Translate(x, y))
+
+	if target.name == "symbol" {
+		ts := p.style(target, s)
+		if ts["display"] == "none" {
+			return
+		}
+		if viewBox, ok := parseViewBox(target.attrs["viewBox"]); ok {
+			w := length(e.attrs["width"], st.viewport[0], length(target.attrs["width"], st.viewport[0], viewBox[2]))
+			h := length(e.attrs["height"], st.viewport[1], length(target.attrs["height"], st.viewport[1], viewBox[3]))
+			st.matrix = st.matrix.Multiply(viewBoxTransform(viewBox, 0, 0, w, h, target.attrs["preserveAspectRatio"]))
+			st.viewport = [2]float64{viewBox[2], viewBox[3]}
+		}
+		p.walkChildren(target, ts, st)
+		return
+	}
+	p.walk(target, s, st)
+}
+
+// ref finds the element of "#id"
+func (p *parser) ref(href string) (*element, bool) {
+	id, ok := strings.CutPrefix(strings.TrimSpace(href), "#")
+	if !ok {
+		return nil, false
+	}
+	e, ok := p.ids[id]
+	return e, ok
+}
+
+// shapePath is the outline of a basic shape or path, in its own coordinates
+func (p *parser) shapePath(e *element, st state) Path {
+	num := func(name string, axis string) float64 {
+		return length(e.attrs[name], st.reference(axis), 0)
+	}
+
+	b := &pathBuilder{}
+	switch e.name {
+	case "path":
+		// what comes before an error is drawn, as browsers do
+		path, _ := parsePath(e.attrs["d"])
+		return path
+
+	case "rect":
+		w, h := num("width", "x"), num("height", "y")
+		if w <= 0 || h <= 0 {
+			return nil
+		}
+		rx, hasRx := parseLength(e.attrs["rx"], st.viewport[0])
+		ry, hasRy := parseLength(e.attrs["ry"], st.viewport[1])
+		if !hasRx {
+			rx = ry
+		}
+		if !hasRy {
+			ry = rx
+		}
+		b.rect(num("x", "x"), num("y", "y"), w, h, rx, ry)
+
+	case "circle":
+		r := num("r", "")
+		if r <= 0 {
+			return nil
+		}
+		b.ellipse(num("cx", "x"), num("cy", "y"), r, r)
+
+	case "ellipse":
+		rx, ry := num("rx", "x"), num("ry", "y")
+		if rx <= 0 || ry <= 0 {
+			return nil
+		}
+		b.ellipse(num("cx", "x"), num("cy", "y"), rx, ry)
+
+	case "line":
+		b.moveTo(Point{num("x1", "x"), num("y1", "y")})
+		b.lineTo(Point{num("x2", "x"), num("y2", "y")})
+
+	case "polyline", "polygon":
+		points := parseNumbers(e.attrs["points"])
+		for i := 0; i+1 < len(points); i += 2 {
+			if i == 0 {
+				b.moveTo(Point{points[i], points[i+1]})
+			} else {
+				b.lineTo(Point{points[i], points[i+1]})
+			}
+		}
+		if e.name == "polygon" && len(b.path) > 0 {
+			b.close()
+		}
+	}
+	return b.path
+}
+
+// shape adds a path with the fill and stroke of its style
+func (p *parser) shape(path Path, s style, st state) {
+	if s["visibility"] == "hidden" || s["visibility"] == "collapse" {
+		return
+	}
+
+	fill, stroke := s["fill"], s["stroke"]
+	if _, ok := s["fill"]; !ok {
+		fill = "black"
+	}
+	shape := &Shape{
+		Path:        path,
+		Matrix:      st.matrix,
+		Clip:        st.clip,
+		Fill:        p.paint(fill, s, parseOpacity(s["fill-opacity"])*st.opacity, path),
+		EvenOdd:     s["fill-rule"] == "evenodd",
+		Stroke:      p.paint(stroke, s, parseOpacity(s["stroke-opacity"])*st.opacity, path),
+		StrokeWidth: length(s["stroke-width"], st.reference(""), 1),
+		LineCap:     choice(s["stroke-linecap"], "butt", "round", "square"),
+		LineJoin:    choice(s["stroke-linejoin"], "miter", "round", "bevel"),
+		MiterLimit:  length(s["stroke-miterlimit"], 0, 4),
+	}
+	if shape.StrokeWidth <= 0 {
+		shape.Stroke = Paint{}
+	}
+	if shape.Fill.None() && shape.Stroke.None() {
+		return
+	}
+	p.drawing.Items = append(p.drawing.Items, shape)
+}
+
+func choice(value string, def string, others ...string) string {
+	for _, o := range others {
+		if value == o {
+			return value
+		}
+	}
+	return def
+}
+
+// paint resolves a fill or stroke, path being what gradients in bounding
+// box units are relative to
+func (p *parser) paint(value string, s style, opacity float64, path Path) Paint {
+	value = strings.TrimSpace(value)
+	if value == "" || value == "none" {
+		return Paint{}
+	}
+
+	if rest, ok := strings.CutPrefix(value, "url("); ok {
+		ref, fallback, _ := strings.Cut(rest, ")")
+		if e, ok := p.ref(unquote(ref)); ok {
+			if g := p.gradient(e, opacity, path); g != nil {
+				return Paint{Gradient: g}
+			}
+		}
+		return p.paint(fallback, s, opacity, path)
+	}
+
+	if value == "currentColor" {
+		value = s["color"]
+		if value == "" {
+			value = "black"
+		}
+	}
+	c, ok := parseColor(value)
+	if !ok {
+		return Paint{}
+	}
+	c.A = clamp8(float64(c.A) * opacity)
+	return Paint{Color: c}
+}
+
+// gradient reads a linear or radial gradient, with the attributes and
+// stops of the gradients it refers to
+func (p *parser) gradient(e *element, opacity float64, path Path) *Gradient {
+	if e.name != "linearGradient" && e.name != "radialGradient" {
+		return nil
+	}
+
+	// attributes are looked up along href, the first gradient with stops
+	// gives them
+	chain := []*element{e}
+	for len(chain) < 16 {
+		next, ok := p.ref(chain[len(chain)-1].attrs["href"])
+		if !ok || (next.name != "linearGradient" && next.name != "radialGradient") {
+			break
+		}
+		chain = append(chain, next)
+	}
+	attr := func(name string) string {
+		for _, c := range chain {
+			if v, ok := c.attrs[name]; ok {
+				return v
+			}
+		}
+		return ""
+	}
+
+	g := &Gradient{Radial: e.name == "radialGradient", Spread: choice(attr("spreadMethod"), "pad", "reflect", "repeat")}
+	for _, c := range chain {
+		for _, stop := range c.children {
+			if stop.name != "stop" {
+				continue
+			}
+			s := p.style(stop, nil)
+			color := s["stop-color"]
+			if color == "" {
+				color = "black"
+			}
+			paint := p.paint(color, s, parseOpacity(s["stop-opacity"])*opacity, nil)
+			offset := math.Max(0, math.Min(1, fraction(stop.attrs["offset"], 1)))
+			if n := len(g.Stops); n > 0 {
+				offset = math.Max(offset, g.Stops[n-1].Offset)
+			}
+			g.Stops = append(g.Stops, Stop{Offset: offset, Color: paint.Color})
+		}
+		if len(g.Stops) > 0 {
+			break
+		}
+	}
+	if len(g.Stops) == 0 {
+		return nil
+	}
+
+	userSpace := attr("gradientUnits") == "userSpaceOnUse"
+	reference := 1.0
+	if userSpace {
+		reference = 100
+	}
+	coord := func(name string, def string) float64 {
+		v := attr(name)
+		if v == "" {
+			v = def
+		}
+		if f, ok := strings.CutSuffix(strings.TrimSpace(v), "%"); ok && !userSpace {
+			n, _ := strconv.ParseFloat(f, 64)
+			return n / 100
+		}
+		return length(v, reference, 0)
+	}
+	if g.Radial {
+		g.Cx, g.Cy, g.R = coord("cx", "50%"), coord("cy", "50%"), coord("r", "50%")
+		g.Fx, g.Fy = g.Cx, g.Cy
+		if attr("fx") != "" {
+			g.Fx = coord("fx", "")
+		}
+		if attr("fy") != "" {
+			g.Fy = coord("fy", "")
+		}
+	} else {
+		g.X1, g.Y1, g.X2, g.Y2 = coord("x1", "0%"), coord("y1", "0%"), coord("x2", "100%"), coord("y2", "0%")
+	}
+
+	g.Matrix = parseTransform(attr("gradientTransform"))
+	if !userSpace {
+		min, max := path.Bounds()
+		if max.X <= min.X || max.Y <= min.Y {
+			// a box without area can't be painted by its gradient, the last
+			// color is used as browsers do
+			return &Gradient{Stops: []Stop{{Color: g.Stops[len(g.Stops)-1].Color}}, Matrix: Identity}
+		}
+		g.Matrix = Matrix{max.X - min.X, 0, 0, max.Y - min.Y, min.X, min.Y}.Multiply(g.Matrix)
+	}
+	return g
+}
+
+// clip is the clip of an element inside the one of its parent, path being
+// its outline for clip paths in bounding box units
+func (p *parser) clip(e *element, s style, st state, path Path) *Clip {
+	value := s["clip-path"]
+	ref, ok := strings.CutPrefix(strings.TrimSpace(value), "url(")
+	if !ok {
+		return st.clip
+	}
+	ref, _, _ = strings.Cut(ref, ")")
+	target, ok := p.ref(unquote(ref))
+	if !ok || target.name != "clipPath" {
+		return st.clip
+	}
+
+	m := st.matrix.Multiply(parseTransform(target.attrs["transform"]))
+	if target.attrs["clipPathUnits"] == "objectBoundingBox" {
+		if path == nil {
+			// only the boxes of shapes are known
+			return st.clip
+		}
+		min, max := path.Bounds()
+		m = m.Multiply(Matrix{max.X - min.X, 0, 0, max.Y - min.Y, min.X, min.Y})
+	}
+
+	clip := &Clip{Parent: st.clip}
+	ts := p.style(target, nil)
+	inner := state{matrix: m, viewport: st.viewport}
+	for _, c := range target.children {
+		p.clipShapes(clip, c, ts, inner)
+	}
+	return clip
+}
+
+// clipShapes adds the shapes of a clip path, and the ones they use
+func (p *parser) clipShapes(clip *Clip, e *element, parent style, st state) {
+	if e.name == "" || p.depth >= maxDepth {
+		return
+	}
+	s := p.style(e, parent)
+	if s["display"] == "none" || s["visibility"] == "hidden" {
+		return
+	}
+	st.matrix = st.matrix.Multiply(parseTransform(e.attrs["transform"]))
+
+	switch e.name {
+	case "use":
+		if target, ok := p.ref(e.attrs["href"]); ok {
+			st.matrix = st.matrix.Multiply(Translate(length(e.attrs["x"], st.viewport[0], 0), length(e.attrs["y"], st.viewport[1], 0)))
+			p.depth++
+			p.clipShapes(clip, target, s, st)
+			p.depth--
+		}
+	case "path", "rect", "circle", "ellipse", "line", "polyline", "polygon":
+		if path := p.shapePath(e, st); len(path) > 0 {
+			clip.Shapes = append(clip.Shapes, ClipShape{Path: path, Matrix: st.matrix, EvenOdd: s["clip-rule"] == "evenodd"})
+		}
+	}
+}
+
+// text adds the chunks of a text element: a chunk starts at the text and at
+// every tspan with a position
+func (p *parser) text(e *element, s style, st state) {
+	var chunk *Text
+	chunks := make([]*Text, 0)
+	start := func(x float64, y float64, s style) {
+		chunk = &Text{
+			Matrix:   st.matrix,
+			Clip:     st.clip,
+			X:        x,
+			Y:        y,
+			Anchor:   choice(s["text-anchor"], "start", "middle", "end"),
+			Size:     parentFontSize(s),
+			Families: parseFamilies(s["font-family"]),
+		}
+		chunks = append(chunks, chunk)
+	}
+	position := func(e *element) (float64, float64, bool) {
+		xs, ys := parseNumbers(e.attrs["x"]), parseNumbers(e.attrs["y"])
+		if len(xs) == 0 && len(ys) == 0 {
+			return 0, 0, false
+		}
+		x, y := 0.0, 0.0
+		if chunk != nil {
+			x, y = chunk.X, chunk.Y
+		}
+		if len(xs) > 0 {
+			x = xs[0]
+		}
+		if len(ys) > 0 {
+			y = ys[0]
+		}
+		return x, y, true
+	}
+
+	x, y, _ := position(e)
+	start(x, y, s)
+
+	var add func(e *element, s style, depth int)
+	add = func(e *element, s style, depth int) {
+		for _, c := range e.children {
+			if c.name == "" {
+				p.textRun(chunk, c.text, s, st)
+				continue
+			}
+			if c.name != "tspan" && c.name != "a" || depth > maxDepth {
+				continue
+			}
+			cs := p.style(c, s)
+			if cs["display"] == "none" {
+				continue
+			}
+			if x, y, ok := position(c); ok {
+				start(x, y, cs)
+			}
+			add(c, cs, depth+1)
+		}
+	}
+	add(e, s, 0)
+
+	// spaces at the ends of chunks aren't drawn, and empty chunks are left
+	// out
+	for _, c := range chunks {
+		if c.Runs = trimRuns(c.Runs); len(c.Runs) > 0 {
+			p.drawing.Items = append(p.drawing.Items, c)
+		}
+	}
+}
+
+// textRun adds text to a chunk with the style of its element, collapsing
+// white space unless xml:space is preserve
+func (p *parser) textRun(chunk *Text, text string, s style, st state) {
+	if s["visibility"] == "hidden" || s["visibility"] == "collapse" {
+		// hidden text still takes its room
+		text = strings.Repeat(" ", len([]rune(text)))
+	}
+	if s["xml:space"] == "preserve" {
+		text = strings.NewReplacer("\n", " ", "\r", " ", "\t", " ").Replace(text)
+	} else {
+		text = strings.NewReplacer("\n", "", "\r", "", "\t", " ").Replace(text)
+		text = collapseSpaces(text)
+		if n := len(chunk.Runs); strings.HasPrefix(text, " ") && (n == 0 || strings.HasSuffix(chunk.Runs[n-1].Text, " ")) {
+			text = strings.TrimPrefix(text, " ")
+		}
+	}
+	if text == "" {
+		return
+	}
+
+	fill, ok := s["fill"]
+	if !ok {
+		fill = "black"
+	}
+	run := Run{
+		Text:      text,
+		Bold:      isBold(s["font-weight"]),
+		Italic:    s["font-style"] == "italic" || s["font-style"] == "oblique",
+		Underline: strings.Contains(s["text-decoration"], "underline"),
+		Fill:      p.paint(fill, s, parseOpacity(s["fill-opacity"])*st.opacity, nil),
+	}
+	if s["visibility"] == "hidden" || s["visibility"] == "collapse" {
+		run.Fill, run.Underline = Paint{}, false
+	}
+	chunk.Runs = append(chunk.Runs, run)
+}
+
+func collapseSpaces(s string) string {
+	var b strings.Builder
+	for i, r := range s {
+		if r == ' ' && i > 0 && s[i-1] == ' ' {
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// trimRuns removes the spaces at the start and end of a chunk
+func trimRuns(runs []Run) []Run {
+	for len(runs) > 0 {
+		runs[0].Text = strings.TrimLeft(runs[0].Text, " ")
+		if runs[0].Text != "" {
+			break
+		}
+		runs = runs[1:]
+	}
+	for len(runs) > 0 {
+		last := &runs[len(runs)-1]
+		last.Text = strings.TrimRight(last.Text, " ")
+		if last.Text != "" {
+			break
+		}
+		runs = runs[:len(runs)-1]
+	}
+	return runs
+}
+
+// image adds an image given by a data URL, parsing SVG images
+func (p *parser) image(e *element, s style, st state) {
+	if s["visibility"] == "hidden" || s["visibility"] == "collapse" {
+		return
+	}
+	data, mimeType, ok := decodeDataURL(e.attrs["href"])
+	if !ok {
+		return
+	}
+
+	img := &Image{Type: mimeType, Opacity: st.opacity}
+	if mimeType == "image/svg+xml" || (mimeType == "" && bytes.Contains(data[:min(len(data), 512)], []byte("<svg"))) {
+		if p.imageDepth >= maxImageDepth {
+			return
+		}
+		drawing, err := parse(data, p.imageDepth+1)
+		if err != nil {
+			return
+		}
+		fade(drawing, st.opacity)
+		img.Type, img.Drawing, img.Opacity = "image/svg+xml", drawing, 1
+		img.Width, img.Height = drawing.Width, drawing.Height
+	} else {
+		config, format, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil || config.Width*config.Height > MaxPixels {
+			return
+		}
+		img.Type, img.Data = "image/"+format, data
+		img.Width, img.Height = float64(config.Width), float64(config.Height)
+	}
+	if img.Width <= 0 || img.Height <= 0 {
+		return
+	}
+
+	x := length(e.attrs["x"], st.viewport[0], 0)
+	y := length(e.attrs["y"], st.viewport[1], 0)
+	w := length(e.attrs["width"], st.viewport[0], img.Width)
+	h := length(e.attrs["height"], st.viewport[1], img.Height)
+	if w <= 0 || h <= 0 {
+		return
+	}
+
+	par := e.attrs["preserveAspectRatio"]
+	img.Matrix = st.matrix.Multiply(viewBoxTransform([4]float64{0, 0, img.Width, img.Height}, x, y, w, h, par))
+	img.Clip = st.clip
+	if strings.Contains(par, "slice") {
+		b := &pathBuilder{}
+		b.rect(x, y, w, h, 0, 0)
+		img.Clip = &Clip{Shapes: []ClipShape{{Path: b.path, Matrix: st.matrix}}, Parent: st.clip}
+	}
+	p.drawing.Items = append(p.drawing.Items, img)
+}
+
+// fade applies the opacity of an image to the drawing it shows
+func fade(d *Drawing, opacity float64) {
+	if opacity >= 1 {
+		return
+	}
+	alpha := func(p *Paint) {
+		p.Color.A = clamp8(float64(p.Color.A) * opacity)
+		if p.Gradient != nil {
+			for i := range p.Gradient.Stops {
+				p.Gradient.Stops[i].Color.A = clamp8(float64(p.Gradient.Stops[i].Color.A) * opacity)
+			}
+		}
+	}
+	for _, item := range d.Items {
+		switch item := item.(type) {
+		case *Shape:
+			alpha(&item.Fill)
+			alpha(&item.Stroke)
+		case *Text:
+			for i := range item.Runs {
+				alpha(&item.Runs[i].Fill)
+			}
+		case *Image:
+			if item.Drawing != nil {
+				fade(item.Drawing, opacity)
+			} else {
+				item.Opacity *= opacity
+			}
+		}
+	}
+}
+
+func parseViewBox(value string) ([4]float64, bool) {
+	v := parseNumbers(value)
+	if len(v) != 4 || v[2] <= 0 || v[3] <= 0 {
+		return [4]float64{}, false
+	}
+	return [4]float64{v[0], v[1], v[2], v[3]}, true
+}
+
+// viewBoxTransform maps a viewBox into the box at x, y of size w, h as
+// preserveAspectRatio asks
+func viewBoxTransform(viewBox [4]float64, x float64, y float64, w float64, h float64, preserveAspectRatio string) Matrix {
+	sx, sy := w/viewBox[2], h/viewBox[3]
+	fields := strings.Fields(preserveAspectRatio)
+	align := "xMidYMid"
+	if len(fields) > 0 {
+		align = fields[0]
+	}
+	if align == "none" {
+		return Translate(x, y).Multiply(Scale(sx, sy)).Multiply(Translate(-viewBox[0], -viewBox[1]))
+	}
+
+	s := math.Min(sx, sy)
+	if len(fields) > 1 && fields[1] == "slice" {
+		s = math.Max(sx, sy)
+	}
+	tx, ty := x-viewBox[0]*s, y-viewBox[1]*s
+	switch {
+	case strings.Contains(align, "xMid"):
+		tx += (w - viewBox[2]*s) / 2
+	case strings.Contains(align, "xMax"):
+		tx += w - viewBox[2]*s
+	}
+	switch {
+	case strings.Contains(align, "YMid"):
+		ty += (h - viewBox[3]*s) / 2
+	case strings.Contains(align, "YMax"):
+		ty += h - viewBox[3]*s
+	}
+	return Matrix{s, 0, 0, s, tx, ty}
+}
@@ -0,0 +1,277 @@
+package vector
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"nostr-relay/typeset"
+
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/gobolditalic"
+	"golang.org/x/image/font/gofont/goitalic"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/sfnt"
+	"golang.org/x/image/math/fixed"
+)
+
+// face is a font text is drawn with: its metrics, which balloons are laid
+// out with, and its outlines
+type face struct {
+	metrics  *typeset.Font
+	outlines *sfnt.Font
+
+	// bold and italic are the style of the font, others are synthesized
+	bold, italic bool
+
+	// underline is the position and thickness of underlines in ems,
+	// position being below the baseline
+	underline [2]float64
+
+	mu     sync.Mutex
+	buffer sfnt.Buffer
+	glyphs map[uint16]Path
+}
+
+func newFace(data []byte, bold bool, italic bool) (*face, error) {
+	metrics, err := typeset.Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	file, err := typeset.SFNT(data)
+	if err != nil {
+		return nil, err
+	}
+	outlines, err := sfnt.Parse(file)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &face{metrics: metrics, outlines: outlines, bold: bold, italic: italic, glyphs: make(map[uint16]Path)}
+	f.underline = [2]float64{0.1, 0.05}
+	if post := outlines.PostTable(); post != nil && post.UnderlineThickness > 0 {
+		upem := float64(outlines.UnitsPerEm())
+		f.underline = [2]float64{-float64(post.UnderlinePosition) / upem, float64(post.UnderlineThickness) / upem}
+	}
+	return f, nil
+}
+
+// glyph is the outline of a glyph for a size of 1, y going down from the
+// baseline
+func (f *face) glyph(g uint16) Path {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if path, ok := f.glyphs[g]; ok {
+		return path
+	}
+
+	// loaded at a size of one unit per pixel so coordinates are exact
+	upem := float64(f.outlines.UnitsPerEm())
+	segments, err := f.outlines.LoadGlyph(&f.buffer, sfnt.GlyphIndex(g), fixed.Int26_6(f.outlines.UnitsPerEm())<<6, nil)
+	if err != nil {
+		f.glyphs[g] = nil
+		return nil
+	}
+	point := func(p fixed.Point26_6) Point {
+		return Point{float64(p.X) / 64 / upem, float64(p.Y) / 64 / upem}
+	}
+	b := &pathBuilder{}
+	for _, s := range segments {
+		switch s.Op {
+		case sfnt.SegmentOpMoveTo:
+			if len(b.path) > 0 {
+				b.close()
+			}
+			b.moveTo(point(s.Args[0]))
+		case sfnt.SegmentOpLineTo:
+			b.lineTo(point(s.Args[0]))
+		case sfnt.SegmentOpQuadTo:
+			b.quadTo(point(s.Args[0]), point(s.Args[1]))
+		case sfnt.SegmentOpCubeTo:
+			b.cubicTo(point(s.Args[0]), point(s.Args[1]), point(s.Args[2]))
+		}
+	}
+	if len(b.path) > 0 {
+		b.close()
+	}
+	f.glyphs[g] = b.path
+	return b.path
+}
+
+// goFaces are the Go fonts, drawing text whose fonts are missing
+var goFaces = sync.OnceValue(func() [4]*face {
+	var faces [4]*face
+	for i, data := range [][]byte{goregular.TTF, gobold.TTF, goitalic.TTF, gobolditalic.TTF} {
+		f, err := newFace(data, i&1 != 0, i&2 != 0)
+		if err != nil {
+			panic(fmt.Sprintf("go font %d: %v", i, err))
+		}
+		faces[i] = f
+	}
+	return faces
+})
+
+func goFace(bold bool, italic bool) *face {
+	i := 0
+	if bold {
+		i |= 1
+	}
+	if italic {
+		i |= 2
+	}
+	return goFaces()[i]
+}
+
+// face finds the font of a family closest to a style, as browsers do: the
+// same slant first, then the same weight. nil when the drawing doesn't have
+// the family or its fonts can't be read.
+func (d *Drawing) face(family string, bold bool, italic bool) *face {
+	best, score := -1, -1
+	for i, f := range d.Fonts {
+		if !strings.EqualFold(f.Family, family) {
+			continue
+		}
+		s := 0
+		if f.Italic == italic {
+			s += 2
+		}
+		if f.Bold == bold {
+			s++
+		}
+		if s > score {
+			best, score = i, s
+		}
+	}
+	if best < 0 {
+		return nil
+	}
+
+	if d.faces == nil {
+		d.faces = make(map[int]*face)
+	}
+	if f, ok := d.faces[best]; ok {
+		return f
+	}
+	f, err := newFace(d.Fonts[best].Data, d.Fonts[best].Bold, d.Fonts[best].Italic)
+	if err != nil {
+		f = nil
+	}
+	d.faces[best] = f
+	return f
+}
+
+// Glyphs is a run of text laid out with its font
+type Glyphs struct {
+	Run Run
+
+	// X is where the run starts on the baseline Y of its text, in the
+	// coordinates of the text, and Width its advance
+	X, Y  float64
+	Width float64
+	Size  float64
+
+	// Shapes are the outlines of the glyphs and underline, with the matrix
+	// and clip of the text
+	Shapes []*Shape
+}
+
+// placed is a character with the font it's drawn with
+type placed struct {
+	face    *face
+	glyph   uint16
+	advance float64
+}
+
+// Glyphs lays out a text chunk with the first of its families the drawing
+// has fonts for, or the Go fonts, and outlines it. Characters missing from
+// the font are drawn with the Go fonts, bold and italic styles a font
+// doesn't have are synthesized.
+func (d *Drawing) Glyphs(t *Text) []Glyphs {
+	runs := make([]Glyphs, len(t.Runs))
+	chars := make([][]placed, len(t.Runs))
+	width := 0.0
+	// the run and index of the last character, which kerning moves
+	last := [2]int{-1, -1}
+	for i, run := range t.Runs {
+		var f *face
+		for _, family := range t.Families {
+			if f = d.face(family, run.Bold, run.Italic); f != nil {
+				break
+			}
+		}
+		if f == nil {
+			f = goFace(run.Bold, run.Italic)
+		}
+
+		runs[i] = Glyphs{Run: run, Y: t.Y, Size: t.Size}
+		for _, r := range run.Text {
+			p := placed{face: f, glyph: f.metrics.Glyph(r)}
+			if p.glyph == 0 {
+				if fallback := goFace(run.Bold, run.Italic); fallback.metrics.Glyph(r) != 0 {
+					p = placed{face: fallback, glyph: fallback.metrics.Glyph(r)}
+				}
+			}
+			p.advance = p.face.metrics.Advance(p.glyph) * t.Size
+			if last[0] >= 0 && chars[last[0]][last[1]].face == p.face {
+				previous := &chars[last[0]][last[1]]
+				k := p.face.metrics.Kern(previous.glyph, p.glyph) * t.Size
+				previous.advance += k
+				width += k
+			}
+			chars[i] = append(chars[i], p)
+			last = [2]int{i, len(chars[i]) - 1}
+			width += p.advance
+		}
+	}
+
+	start := t.X
+	switch t.Anchor {
+	case "middle":
+		start -= width / 2
+	case "end":
+		start -= width
+	}
+
+	x := start
+	for i := range runs {
+		run := &runs[i]
+		run.X = x
+		for _, c := range chars[i] {
+			if shape := c.shape(t, run.Run, x); shape != nil {
+				run.Shapes = append(run.Shapes, shape)
+			}
+			x += c.advance
+		}
+		run.Width = x - run.X
+
+		if run.Run.Underline && run.Width > 0 && !run.Run.Fill.None() {
+			f := chars[i][0].face
+			b := &pathBuilder{}
+			b.rect(run.X, t.Y+f.underline[0]*t.Size-f.underline[1]*t.Size/2, run.Width, f.underline[1]*t.Size, 0, 0)
+			run.Shapes = append(run.Shapes, &Shape{Path: b.path, Matrix: t.Matrix, Clip: t.Clip, Fill: run.Run.Fill})
+		}
+	}
+	return runs
+}
+
+// shape is the outline of a character at x on the baseline of a text
+func (c placed) shape(t *Text, run Run, x float64) *Shape {
+	if run.Fill.None() {
+		return nil
+	}
+	outline := c.face.glyph(c.glyph)
+	if len(outline) == 0 {
+		return nil
+	}
+
+	m := Translate(x, t.Y).Multiply(Scale(t.Size, t.Size))
+	if run.Italic && !c.face.italic {
+		// a slant of about 12 degrees, leaning right as y goes up
+		m = m.Multiply(Matrix{1, 0, -0.2, 1, 0, 0})
+	}
+	shape := &Shape{Path: outline.Transform(m), Matrix: t.Matrix, Clip: t.Clip, Fill: run.Fill}
+	if run.Bold && !c.face.bold {
+		shape.Stroke, shape.StrokeWidth, shape.LineJoin = run.Fill, t.Size/24, "round"
+	}
+	return shape
+}
@@ -0,0 +1,217 @@
+package vector
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"strings"
+	"testing"
+)
+
+func near(a float64, b float64) bool {
+	return math.Abs(a-b) < 1e-3
+}
+
+func TestParsePath(t *testing.T) {
+	path, err := parsePath("M10,10 h20 v-5 l5 5 Z m0 10 c1 1 2 2 3 3 s4 4 5 5 q1 1 2 2 t2 0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops := make([]byte, len(path))
+	for i, s := range path {
+		ops[i] = s.Op
+	}
+	if string(ops) != "MLLLZMCCCC" {
+		t.Fatalf("ops: %s", ops)
+	}
+	if p := path[3].Points[0]; p != (Point{35, 10}) {
+		t.Errorf("relative line: %v", p)
+	}
+	// the subpath after a close starts where the closed one did
+	if p := path[5].Points[0]; p != (Point{10, 20}) {
+		t.Errorf("move after close: %v", p)
+	}
+	// s reflects the second control point of the previous curve
+	if p := path[7].Points[0]; p != (Point{14, 24}) {
+		t.Errorf("smooth curve: %v", p)
+	}
+
+	// a half circle is drawn with quarter turns
+	arc, err := parsePath("M0 0 A10 10 0 0 1 20 0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(arc) != 3 || arc[2].Points[2] != (Point{20, 0}) {
+		t.Fatalf("arc: %v", arc)
+	}
+	if mid := arc[1].Points[2]; !near(mid.X, 10) || !near(mid.Y, -10) {
+		t.Errorf("the arc goes through %v", mid)
+	}
+
+	partial, err := parsePath("M0 0 L10 10 L20")
+	if err == nil || len(partial) != 2 {
+		t.Errorf("what parses before an error is kept: %v %v", partial, err)
+	}
+}
+
+func TestParseColor(t *testing.T) {
+	for value, want := range map[string]color.NRGBA{
+		"#f00":                 {255, 0, 0, 255},
+		"#00ff0080":            {0, 255, 0, 128},
+		"rgb(0, 0, 255)":       {0, 0, 255, 255},
+		"rgba(100%,0%,0%,0.5)": {255, 0, 0, 128},
+		"hsl(120, 100%, 50%)":  {0, 255, 0, 255},
+		"DarkRed":              {139, 0, 0, 255},
+		"transparent":          {},
+	} {
+		if c, ok := parseColor(value); !ok || c != want {
+			t.Errorf("%s: %v %v", value, c, ok)
+		}
+	}
+	for _, value := range []string{"", "#12", "rgb(1,2)", "notacolor", "url(#a)"} {
+		if _, ok := parseColor(value); ok {
+			t.Errorf("%s is not a color", value)
+		}
+	}
+}
+
+func TestParseTransform(t *testing.T) {
+	m := parseTransform("translate(10 20) scale(2) rotate(90)")
+	if p := m.Apply(Point{1, 0}); !near(p.X, 10) || !near(p.Y, 22) {
+		t.Errorf("transforms apply right to left: %v", p)
+	}
+	if p := m.Invert().Apply(m.Apply(Point{3, 4})); !near(p.X, 3) || !near(p.Y, 4) {
+		t.Errorf("invert: %v", p)
+	}
+	if m := parseTransform("matrix(1 0 0 1 5 6) skewX(45)"); !near(m.Apply(Point{0, 1}).X, 6) {
+		t.Errorf("skew: %v", m)
+	}
+	if parseTransform("nonsense(1)") != Identity {
+		t.Errorf("unknown transforms are ignored")
+	}
+}
+
+func TestParse(t *testing.T) {
+	d, err := Parse([]byte(`<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" viewBox="0 0 100 50" width="200">
+		<style>.red { fill: red } #blue { fill: blue; stroke: black; stroke-width: 2 }</style>
+		<defs>
+			<linearGradient id="g"><stop offset="0" stop-color="#fff"/><stop offset="1" stop-color="#000"/></linearGradient>
+			<clipPath id="c"><circle cx="50" cy="25" r="20"/></clipPath>
+			<rect id="r" width="10" height="10"/>
+		</defs>
+		<rect class="red" x="1" y="2" width="3" height="4" style="opacity: 0.5"/>
+		<circle id="blue" cx="10" cy="10" r="5" clip-path="url(#c)"/>
+		<ellipse rx="5" ry="2" fill="url(#g)"/>
+		<use xlink:href="#r" x="20" fill="green"/>
+		<g display="none"><rect width="10" height="10"/></g>
+		<text x="50" y="40" text-anchor="middle" font-size="10" font-family="'A', sans-serif">Hello
+			<tspan font-weight="bold">big</tspan>  world</text>
+		<image href="data:image/svg+xml;utf8,&lt;svg xmlns='http://www.w3.org/2000/svg' width='4' height='4'&gt;&lt;rect width='4' height='4'/&gt;&lt;/svg&gt;" width="8" height="8"/>
+	</svg>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Width != 200 || d.Height != 100 {
+		t.Errorf("size: %v %v", d.Width, d.Height)
+	}
+	if len(d.Items) != 6 {
+		t.Fatalf("items: %d", len(d.Items))
+	}
+
+	red := d.Items[0].(*Shape)
+	if red.Fill.Color != (color.NRGBA{255, 0, 0, 128}) || red.Matrix != Scale(2, 2) {
+		t.Errorf("class and opacity: %+v", red)
+	}
+	blue := d.Items[1].(*Shape)
+	if blue.Fill.Color != (color.NRGBA{0, 0, 255, 255}) || blue.StrokeWidth != 2 || blue.Clip == nil || len(blue.Clip.Shapes) != 1 {
+		t.Errorf("id rule and clip: %+v", blue)
+	}
+	if g := d.Items[2].(*Shape).Fill.Gradient; g == nil || len(g.Stops) != 2 || g.At(0.5) != (color.NRGBA{128, 128, 128, 255}) {
+		t.Errorf("gradient: %+v", g)
+	}
+	use := d.Items[3].(*Shape)
+	if use.Fill.Color != (color.NRGBA{0, 128, 0, 255}) || use.Matrix.Apply(Point{}) != (Point{40, 0}) {
+		t.Errorf("use: %+v", use)
+	}
+
+	text := d.Items[4].(*Text)
+	if text.Anchor != "middle" || text.Size != 10 || len(text.Families) != 2 || text.Families[0] != "A" {
+		t.Errorf("text: %+v", text)
+	}
+	runs := make([]string, len(text.Runs))
+	for i, r := range text.Runs {
+		runs[i] = r.Text
+	}
+	if strings.Join(runs, "|") != "Hello |big| world" || !text.Runs[1].Bold {
+		t.Errorf("runs: %q", runs)
+	}
+
+	image := d.Items[5].(*Image)
+	// 4 pixels drawn over 8 units, scaled twice by the view box
+	if image.Drawing == nil || len(image.Drawing.Items) != 1 || image.Matrix.Apply(Point{4, 4}) != (Point{16, 16}) {
+		t.Errorf("nested svg: %+v", image)
+	}
+
+	if _, err := Parse([]byte("<html/>")); err == nil {
+		t.Errorf("not an svg")
+	}
+}
+
+func TestGlyphs(t *testing.T) {
+	d := &Drawing{}
+	text := &Text{Matrix: Identity, X: 100, Y: 50, Anchor: "middle", Size: 20, Families: []string{"missing"}, Runs: []Run{
+		{Text: "Hi ", Fill: Paint{Color: color.NRGBA{A: 255}}},
+		{Text: "there", Bold: true, Underline: true, Fill: Paint{Color: color.NRGBA{A: 255}}},
+	}}
+	runs := d.Glyphs(text)
+	if len(runs) != 2 {
+		t.Fatalf("runs: %d", len(runs))
+	}
+	width := runs[0].Width + runs[1].Width
+	if !near(runs[0].X, 100-width/2) || !near(runs[1].X, runs[0].X+runs[0].Width) {
+		t.Errorf("runs are centered on x: %v %v %v", runs[0].X, runs[1].X, width)
+	}
+	// spaces have no outline, underlines are a shape of their own
+	if len(runs[0].Shapes) != 2 || len(runs[1].Shapes) != 6 {
+		t.Errorf("shapes: %d %d", len(runs[0].Shapes), len(runs[1].Shapes))
+	}
+	min, max := runs[0].Shapes[0].Path.Bounds()
+	if min.Y > 50-10 || max.Y > 50.5 || min.X < runs[0].X {
+		t.Errorf("glyphs stand on the baseline: %v %v", min, max)
+	}
+}
+
+// hugePNG is a PNG of a few bytes claiming to be 60000x60000 pixels
+func hugePNG() []byte {
+	var b bytes.Buffer
+	png.Encode(&b, image.NewGray(image.Rect(0, 0, 1, 1)))
+	data := b.Bytes()
+	// the IHDR chunk follows the signature, its size comes first
+	binary.BigEndian.PutUint32(data[16:], 60000)
+	binary.BigEndian.PutUint32(data[20:], 60000)
+	binary.BigEndian.PutUint32(data[29:], crc32.ChecksumIEEE(data[12:29]))
+	return data
+}
+
+func TestHugeImage(t *testing.T) {
+	data := hugePNG()
+	d, err := Parse([]byte(`<svg xmlns="http://www.w3.org/2000/svg" width="10" height="10">
+		<image href="data:image/png;base64,` + base64.StdEncoding.EncodeToString(data) + `" width="10" height="10"/>
+	</svg>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Items) != 0 {
+		t.Errorf("the huge image is left out: %+v", d.Items)
+	}
+
+	if _, err := (&Image{Data: data}).Decode(); !errors.Is(err, ErrTooManyPixels) {
+		t.Errorf("decoding: %v", err)
+	}
+}
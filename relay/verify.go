@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"nostr-relay/blossom"
+	"nostr-relay/config"
+	"nostr-relay/drives"
+
+	"github.com/fiatjaf/eventstore/sqlite3"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// newVerifier checks drives against the local Blossom store, when there is
+// one, and the server lists stored in the database
+func newVerifier(cfg config.Config, db *sqlite3.SQLite3Backend, blobs *blossom.Server) (*drives.Verifier, error) {
+	var store drives.Store
+	if blobs != nil {
+		store = blobs
+	}
+	return drives.New(db, store, db.QueryEvents, drives.Options{MaxSize: int64(cfg.BlossomMaxSize)})
+}
+
+func runVerify(cfg config.Config, args []string) error {
+	flags := newFlagSet("verify", "", &cfg)
+	author := flags.String("author", "", "only the drives of this pubkey")
+	d := flags.String("d", "", "only the drive with this identifier")
+	brokenOnly := flags.Bool("broken", false, "only show broken assets")
+	asJSON := flags.Bool("json", false, "print the reports as JSON")
+	flags.Parse(args)
+
+	db, err := openDatabase(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var blobs *blossom.Server
+	if cfg.Blossom {
+		if blobs, err = blossom.New(db, blossom.Options{Dir: cfg.BlossomDir}); err != nil {
+			return err
+		}
+	}
+	verifier, err := newVerifier(cfg, db, blobs)
+	if err != nil {
+		return err
+	}
+
+	filter := nostr.Filter{Kinds: []int{drives.Kind}}
+	if *author != "" {
+		filter.Authors = []string{*author}
+	}
+	if *d != "" {
+		filter.Tags = nostr.TagMap{"d": {*d}}
+	}
+
+	ctx := context.Background()
+	events, err := db.QueryEvents(ctx, filter)
+	if err != nil {
+		return err
+	}
+
+	reports := make([]drives.Report, 0)
+	broken := 0
+	for event := range events {
+		report, err := verifier.Check(ctx, event)
+		if err != nil {
+			return fmt.Errorf("drive %s: %w", event.ID, err)
+		}
+		if !report.Healthy {
+			broken++
+		}
+		reports = append(reports, report)
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(reports); err != nil {
+			return err
+		}
+	} else if err := driveReport(reports, *brokenOnly); err != nil {
+		return err
+	}
+
+	if broken > 0 {
+		return fmt.Errorf("%d of %d drives are broken", broken, len(reports))
+	}
+	return nil
+}
+
+// driveReport shows the health of every asset, with the problems of the
+// blobs that aren't ok
+func driveReport(reports []drives.Report, brokenOnly bool) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, report := range reports {
+		fmt.Fprintf(w, "%s (%s)\n", report.Address, report.Name)
+		fmt.Fprintln(w, "ASSET\tHEALTH\tPATH\tSTATUS\tPROBLEMS")
+		for _, asset := range report.Assets {
+			if brokenOnly && asset.Healthy {
+				continue
+			}
+			health := "ok"
+			if !asset.Healthy {
+				health = "broken"
+			}
+			for _, blob := range asset.Blobs {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", asset.Name, health, blob.Path, blob.Status, strings.Join(blob.Problems, "; "))
+			}
+		}
+		fmt.Fprintln(w)
+	}
+
+	return w.Flush()
+}
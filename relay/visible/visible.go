@@ -0,0 +1,184 @@
+// Package visible queries the stored events the way the eventstore backend
+// does, with the conditions of the relay policies in the SQL itself: a limit
+// then counts the events clients get, and so does a NIP-45 count.
+package visible
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/fiatjaf/eventstore/sqlite3"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Condition returns an SQL condition on the event table, aliased e, that
+// events have to meet to be seen by clients
+type Condition func() (string, []any)
+
+// Store answers the queries and counts of clients. Internal calls go to the
+// backend and see everything, so deletions and expiration still work.
+type Store struct {
+	db         *sqlite3.SQLite3Backend
+	conditions []Condition
+}
+
+func New(db *sqlite3.SQLite3Backend, conditions ...Condition) *Store {
+	return &Store{db: db, conditions: conditions}
+}
+
+// QueryEvents is meant to replace db.QueryEvents in relay.QueryEvents
+func (s *Store) QueryEvents(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	if khatru.IsInternalCall(ctx) {
+		return s.db.QueryEvents(ctx, filter)
+	}
+
+	query, params, err := s.querySQL(filter, false)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.db.QueryContext(ctx, query, params...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query events: %w", err)
+	}
+
+	ch := make(chan *nostr.Event)
+	go func() {
+		defer rows.Close()
+		defer close(ch)
+		for rows.Next() {
+			var event nostr.Event
+			var createdAt int64
+			if err := rows.Scan(&event.ID, &event.PubKey, &createdAt, &event.Kind, &event.Tags, &event.Content, &event.Sig); err != nil {
+				return
+			}
+			event.CreatedAt = nostr.Timestamp(createdAt)
+
+			select {
+			case ch <- &event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+// CountEvents is meant to replace db.CountEvents in relay.CountEvents
+func (s *Store) CountEvents(ctx context.Context, filter nostr.Filter) (int64, error) {
+	if khatru.IsInternalCall(ctx) {
+		return s.db.CountEvents(ctx, filter)
+	}
+
+	query, params, err := s.querySQL(filter, true)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int64
+	if err := s.db.QueryRowContext(ctx, query, params...).Scan(&count); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("failed to count events: %w", err)
+	}
+	return count, nil
+}
+
+// querySQL translates filter with the limits and the loose tag matching of
+// the backend, so both answer the same but for what's hidden
+func (s *Store) querySQL(filter nostr.Filter, count bool) (string, []any, error) {
+	conditions := make([]string, 0, 7+len(s.conditions))
+	params := make([]any, 0, 20)
+
+	if len(filter.IDs) > 0 {
+		if len(filter.IDs) > 500 {
+			return "", nil, sqlite3.TooManyIDs
+		}
+		conditions = append(conditions, "e.id IN ("+placeholders(len(filter.IDs))+")")
+		for _, id := range filter.IDs {
+			params = append(params, id)
+		}
+	}
+
+	if len(filter.Authors) > 0 {
+		if len(filter.Authors) > s.db.QueryAuthorsLimit {
+			return "", nil, sqlite3.TooManyAuthors
+		}
+		conditions = append(conditions, "e.pubkey IN ("+placeholders(len(filter.Authors))+")")
+		for _, author := range filter.Authors {
+			params = append(params, author)
+		}
+	}
+
+	if len(filter.Kinds) > 0 {
+		if len(filter.Kinds) > 10 {
+			return "", nil, sqlite3.TooManyKinds
+		}
+		conditions = append(conditions, "e.kind IN ("+placeholders(len(filter.Kinds))+")")
+		for _, kind := range filter.Kinds {
+			params = append(params, kind)
+		}
+	}
+
+	// like the backend, only the values of tags are matched
+	total := 0
+	for _, values := range filter.Tags {
+		if len(values) == 0 {
+			return "", nil, sqlite3.EmptyTagSet
+		}
+		total += len(values)
+		if total > s.db.QueryTagsLimit {
+			return "", nil, sqlite3.TooManyTagValues
+		}
+
+		alternatives := make([]string, len(values))
+		for i, value := range values {
+			alternatives[i] = `e.tags LIKE ? ESCAPE '\'`
+			params = append(params, "%"+strings.ReplaceAll(value, "%", `\%`)+"%")
+		}
+		conditions = append(conditions, "("+strings.Join(alternatives, " OR ")+")")
+	}
+
+	if filter.Since != nil {
+		conditions = append(conditions, "e.created_at >= ?")
+		params = append(params, *filter.Since)
+	}
+	if filter.Until != nil {
+		conditions = append(conditions, "e.created_at <= ?")
+		params = append(params, *filter.Until)
+	}
+	if filter.Search != "" {
+		conditions = append(conditions, `e.content LIKE ? ESCAPE '\'`)
+		params = append(params, "%"+strings.ReplaceAll(filter.Search, "%", `\%`)+"%")
+	}
+
+	for _, condition := range s.conditions {
+		sql, conditionParams := condition()
+		conditions = append(conditions, "("+sql+")")
+		params = append(params, conditionParams...)
+	}
+
+	where := "true"
+	if len(conditions) > 0 {
+		where = strings.Join(conditions, " AND ")
+	}
+
+	if count {
+		return "SELECT COUNT(*) FROM event e WHERE " + where, params, nil
+	}
+
+	limit := filter.Limit
+	if limit < 1 || limit > s.db.QueryLimit {
+		limit = s.db.QueryLimit
+	}
+	params = append(params, limit)
+
+	return "SELECT e.id, e.pubkey, e.created_at, e.kind, e.tags, e.content, e.sig FROM event e WHERE " + where +
+		" ORDER BY e.created_at DESC, e.id LIMIT ?", params, nil
+}
+
+func placeholders(n int) string {
+	return strings.TrimRight(strings.Repeat("?,", n), ",")
+}
@@ -0,0 +1,66 @@
+package visible
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/fiatjaf/eventstore/sqlite3"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+	db := &sqlite3.SQLite3Backend{DatabaseURL: filepath.Join(t.TempDir(), "visible.sqlite")}
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+
+	alice, mallory := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+	save := func(sk string, event nostr.Event) nostr.Event {
+		event.Sign(sk)
+		if err := db.SaveEvent(ctx, &event); err != nil {
+			t.Fatal(err)
+		}
+		return event
+	}
+
+	// mallory's notes are the newest, they'd fill a page filtered afterwards
+	var want []string
+	for i := range 3 {
+		want = append(want, save(alice, nostr.Event{Kind: 1, CreatedAt: nostr.Timestamp(1000 - i), Tags: nostr.Tags{{"t", "news"}}}).ID)
+	}
+	for i := range 3 {
+		save(mallory, nostr.Event{Kind: 1, CreatedAt: nostr.Timestamp(2000 + i), Tags: nostr.Tags{{"t", "news"}}})
+	}
+	save(alice, nostr.Event{Kind: 1, CreatedAt: 500, Tags: nostr.Tags{{"t", "other"}}})
+
+	malloryPubKey, _ := nostr.GetPublicKey(mallory)
+	store := New(db, func() (string, []any) { return "e.pubkey <> ?", []any{malloryPubKey} })
+
+	ch, err := store.QueryEvents(ctx, nostr.Filter{Kinds: []int{1}, Tags: nostr.TagMap{"t": {"news"}}, Limit: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]string, 0)
+	for event := range ch {
+		got = append(got, event.ID)
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("a page of visible events, newest first: %v, want %v", got, want)
+	}
+
+	count, err := store.CountEvents(ctx, nostr.Filter{Kinds: []int{1}})
+	if err != nil || count != 4 {
+		t.Errorf("count: %d %v", count, err)
+	}
+	if count, err := db.CountEvents(ctx, nostr.Filter{Kinds: []int{1}}); err != nil || count != 7 {
+		t.Errorf("the backend counts everything: %d %v", count, err)
+	}
+
+	if _, err := store.QueryEvents(ctx, nostr.Filter{Tags: nostr.TagMap{"t": {}}}); err != sqlite3.EmptyTagSet {
+		t.Errorf("the backend limits apply: %v", err)
+	}
+}